@@ -1,44 +1,335 @@
 package main
 
 import (
+	"errors"
 	"flag"
 	"fmt"
 	"log"
 	"net/http"
 	"os"
+	"path/filepath"
 	"strconv"
+	"strings"
 	"time"
 
 	"github.com/zvdy/yamlet/internal/auth"
+	"github.com/zvdy/yamlet/internal/backup"
+	"github.com/zvdy/yamlet/internal/fieldcrypt"
 	"github.com/zvdy/yamlet/internal/handlers"
+	"github.com/zvdy/yamlet/internal/policy"
 	"github.com/zvdy/yamlet/internal/storage"
+	"github.com/zvdy/yamlet/internal/yamlutil"
 
 	"github.com/gorilla/mux"
+	_ "github.com/lib/pq"
+	_ "modernc.org/sqlite"
 )
 
 func main() {
+	// An optional leading command selects what to run; the default serves
+	// the API.
+	command := ""
+	if len(os.Args) > 1 && !strings.HasPrefix(os.Args[1], "-") {
+		command = os.Args[1]
+		os.Args = append(os.Args[:1], os.Args[2:]...)
+	}
+
 	var (
-		port     = flag.Int("port", getEnvAsInt("PORT", 8080), "Server port")
-		dataDir  = flag.String("data-dir", getEnv("DATA_DIR", "/data"), "Data directory for file storage")
-		useFiles = flag.Bool("use-files", getEnvAsBool("USE_FILES", false), "Use file-based storage instead of in-memory")
+		port        = flag.Int("port", getEnvAsInt("PORT", 8080), "Server port")
+		dataDir     = flag.String("data-dir", getEnv("DATA_DIR", "/data"), "Data directory for file storage")
+		useFiles    = flag.Bool("use-files", getEnvAsBool("USE_FILES", false), "Use file-based storage instead of in-memory")
+		useBolt     = flag.Bool("use-bolt", getEnvAsBool("USE_BOLT", false), "Use an embedded bbolt database instead of in-memory")
+		boltPath    = flag.String("bolt-path", getEnv("BOLT_PATH", ""), "Database file for bbolt storage (default <data-dir>/yamlet.db)")
+		sqlDriver   = flag.String("sql-driver", getEnv("SQL_DRIVER", ""), "Use SQL storage through this driver (sqlite or postgres)")
+		sqlDSN      = flag.String("sql-dsn", getEnv("SQL_DSN", ""), "Data source name for SQL storage")
+		s3Bucket    = flag.String("s3-bucket", getEnv("S3_BUCKET", ""), "Use S3 storage in this bucket")
+		s3Prefix    = flag.String("s3-prefix", getEnv("S3_PREFIX", ""), "Key prefix for S3 storage")
+		s3Region    = flag.String("s3-region", getEnv("S3_REGION", getEnv("AWS_REGION", "us-east-1")), "Region of the S3 bucket")
+		s3Endpoint  = flag.String("s3-endpoint", getEnv("S3_ENDPOINT", ""), "Endpoint of an S3-compatible service (default AWS)")
+		s3PathStyle = flag.Bool("s3-path-style", getEnvAsBool("S3_PATH_STYLE", false), "Address the S3 bucket in the URL path")
+		gitDir      = flag.String("git-dir", getEnv("GIT_STORE_DIR", ""), "Use a git repository in this directory for storage")
+		gitRemote   = flag.String("git-remote", getEnv("GIT_STORE_REMOTE", ""), "Bare repository path that git storage pushes every commit to")
+
+		cacheMaxBytes    = flag.Int("cache-max-bytes", getEnvAsInt("CACHE_MAX_BYTES", 0), "Memory for caching config reads in front of storage (0 disables)")
+		cacheTTL         = flag.Duration("cache-ttl", getEnvAsDuration("CACHE_TTL", 30*time.Second), "How long cached configs are served before being read again (0 keeps them until invalidated)")
+		cacheNegativeTTL = flag.Duration("cache-negative-ttl", getEnvAsDuration("CACHE_NEGATIVE_TTL", 5*time.Second), "How long a missing config is remembered as missing (0 disables)")
+
+		maxDepth          = flag.Int("yaml-max-depth", getEnvAsInt("YAML_MAX_DEPTH", yamlutil.DefaultMaxDepth), "Maximum YAML nesting depth (0 disables)")
+		maxNodes          = flag.Int("yaml-max-nodes", getEnvAsInt("YAML_MAX_NODES", yamlutil.DefaultMaxNodes), "Maximum YAML nodes per document (0 disables)")
+		maxAliasExpansion = flag.Int("yaml-max-alias-expansion", getEnvAsInt("YAML_MAX_ALIAS_EXPANSION", yamlutil.DefaultMaxAliasExpansion), "Maximum nodes produced by YAML alias expansion (0 disables)")
+		maxScalarBytes    = flag.Int("yaml-max-scalar-bytes", getEnvAsInt("YAML_MAX_SCALAR_BYTES", yamlutil.DefaultMaxScalarBytes), "Maximum size of a single YAML scalar (0 disables)")
+
+		keyfile         = flag.String("keyfile", getEnv("YAMLET_KEYFILE", ""), "Keyfile with keys that wrap field encryption data keys")
+		ageRecipients   = flag.String("age-recipients", getEnv("YAMLET_AGE_RECIPIENTS", ""), "Comma-separated age recipients that wrap field encryption data keys")
+		ageIdentityFile = flag.String("age-identity-file", getEnv("YAMLET_AGE_IDENTITY_FILE", ""), "age identity file used to unwrap field encryption data keys")
+
+		masterKeyFile  = flag.String("master-key-file", getEnv("YAMLET_MASTER_KEY_FILE", ""), "File of versioned master keys that enables encryption at rest")
+		allowPlaintext = flag.Bool("allow-plaintext", getEnvAsBool("YAMLET_ALLOW_PLAINTEXT", false), "Serve unencrypted configs stored before encryption at rest was enabled, until the next rotation")
+
+		reapInterval   = flag.Duration("reap-interval", getEnvAsDuration("REAP_INTERVAL", time.Minute), "How often expired configs are deleted and the trash purged (0 disables)")
+		trashRetention = flag.Duration("trash-retention", getEnvAsDuration("TRASH_RETENTION", 7*24*time.Hour), "How long deleted configs stay in the trash (0 deletes them for good)")
+
+		backupSchedule          = flag.String("backup-schedule", getEnv("BACKUP_SCHEDULE", ""), "Cron expression on which the server takes backups, in local time (empty disables)")
+		backupDir               = flag.String("backup-dir", getEnv("BACKUP_DIR", ""), "Directory scheduled backups are written to (default <data-dir>/backups)")
+		backupKeepDaily         = flag.Int("backup-keep-daily", getEnvAsInt("BACKUP_KEEP_DAILY", 7), "Days for which the newest scheduled backup is kept")
+		backupKeepWeekly        = flag.Int("backup-keep-weekly", getEnvAsInt("BACKUP_KEEP_WEEKLY", 4), "Weeks for which the newest scheduled backup is kept")
+		backupMaxAge            = flag.Duration("backup-max-age", getEnvAsDuration("BACKUP_MAX_AGE", 0), "How old the last scheduled backup may get before /health/backups fails (default twice the schedule's longest gap)")
+		backupAllowInconsistent = flag.Bool("backup-allow-inconsistent", getEnvAsBool("BACKUP_ALLOW_INCONSISTENT", false), "Back up stores that cannot be read at a single point in time, such as S3, one config at a time")
+
+		restoreNamespaces = flag.String("restore-namespaces", getEnv("RESTORE_NAMESPACES", ""), "Comma-separated namespaces the restore command restores (default all)")
+		restoreMode       = flag.String("restore-mode", getEnv("RESTORE_MODE", "skip"), "What the restore command does with configs and namespace records that exist: skip or overwrite")
 	)
 	flag.Parse()
 
 	// Initialize storage
 	var store storage.Store
-	if *useFiles {
-		store = storage.NewFileStore(*dataDir)
+	backends := 0
+	for _, chosen := range []bool{*useFiles, *useBolt, *sqlDriver != "", *s3Bucket != "", *gitDir != ""} {
+		if chosen {
+			backends++
+		}
+	}
+	if backends > 1 {
+		log.Fatal("Choose at most one of -use-files, -use-bolt, -sql-driver, -s3-bucket and -git-dir")
+	}
+	// keyTable keeps the data keys of encryption at rest. legacyKeyPath is
+	// where older versions kept them for stores that now keep them
+	// themselves, imported on first use.
+	var keyTable storage.KeyTable
+	legacyKeyPath := ""
+	backend := "memory"
+	if *gitDir != "" {
+		gitStore, err := storage.NewGitStore(*gitDir, storage.GitOptions{
+			Remote: *gitRemote,
+			OnPushError: func(err error) {
+				log.Printf("Failed to push to %s: %v", *gitRemote, err)
+			},
+		})
+		if err != nil {
+			log.Fatalf("Failed to open git storage: %v", err)
+		}
+		store = gitStore
+		backend = "git"
+		// The key table stays out of the repository, which may be pushed.
+		keyTable = storage.FileKeyTable{Path: filepath.Join(filepath.Dir(filepath.Clean(*gitDir)), "yamlet-keys.json")}
+		log.Printf("Using git storage in repository: %s", *gitDir)
+	} else if *s3Bucket != "" {
+		s3Store, err := storage.NewS3Store(storage.S3Config{
+			Bucket:          *s3Bucket,
+			Prefix:          *s3Prefix,
+			Region:          *s3Region,
+			Endpoint:        *s3Endpoint,
+			PathStyle:       *s3PathStyle,
+			AccessKeyID:     os.Getenv("AWS_ACCESS_KEY_ID"),
+			SecretAccessKey: os.Getenv("AWS_SECRET_ACCESS_KEY"),
+			SessionToken:    os.Getenv("AWS_SESSION_TOKEN"),
+		})
+		if err != nil {
+			log.Fatalf("Failed to open S3 storage: %v", err)
+		}
+		store = s3Store
+		backend = "s3"
+		keyTable = s3Store
+		legacyKeyPath = filepath.Join(*dataDir, "yamlet-keys.json")
+		log.Printf("Using S3 storage in bucket %s (revision history: %t)", *s3Bucket, s3Store.HasVersioning())
+	} else if *sqlDriver != "" {
+		sqlStore, err := storage.NewSQLStore(*sqlDriver, *sqlDSN)
+		if err != nil {
+			log.Fatalf("Failed to open SQL storage: %v", err)
+		}
+		defer sqlStore.Close()
+		store = sqlStore
+		backend = "sql/" + *sqlDriver
+		keyTable = sqlStore
+		legacyKeyPath = filepath.Join(*dataDir, "yamlet-keys.json")
+		log.Printf("Using %s SQL storage", *sqlDriver)
+	} else if *useBolt {
+		path := *boltPath
+		if path == "" {
+			path = filepath.Join(*dataDir, "yamlet.db")
+		}
+		boltStore, err := storage.NewBoltStore(path)
+		if err != nil {
+			log.Fatalf("Failed to open bbolt storage: %v", err)
+		}
+		defer boltStore.Close()
+		store = boltStore
+		backend = "bolt"
+		keyTable = storage.FileKeyTable{Path: filepath.Join(filepath.Dir(path), "yamlet-keys.json")}
+		log.Printf("Using bbolt storage in database: %s", path)
+	} else if *useFiles {
+		fileStore := storage.NewFileStore(*dataDir)
+		removed, err := fileStore.Recover()
+		if err != nil {
+			log.Fatalf("Failed to recover data directory %s: %v", *dataDir, err)
+		}
+		if removed > 0 {
+			log.Printf("Removed %d temporary files left by interrupted writes", removed)
+		}
+		store = fileStore
+		backend = "file"
+		keyTable = storage.FileKeyTable{Path: fileStore.ReservedPath("keys.json")}
 		log.Printf("Using file-based storage in directory: %s", *dataDir)
 	} else {
 		store = storage.NewMemoryStore()
 		log.Println("Using in-memory storage")
 	}
 
+	// The read cache sits below encryption at rest, so it only ever holds
+	// sealed bytes.
+	var cache *storage.CachingStore
+	if *cacheMaxBytes > 0 {
+		cache = storage.NewCachingStore(store, storage.CacheOptions{
+			MaxBytes:    int64(*cacheMaxBytes),
+			TTL:         *cacheTTL,
+			NegativeTTL: *cacheNegativeTTL,
+		})
+		if watcher, ok := store.(storage.Watcher); ok {
+			stop, err := watcher.Watch(cache.Invalidate)
+			if err != nil && !errors.Is(err, storage.ErrUnsupported) {
+				log.Fatalf("Failed to watch storage for changes: %v", err)
+			}
+			if err == nil {
+				defer stop()
+				log.Println("Read cache follows changes made by other replicas")
+			}
+		}
+		store = cache
+		log.Printf("Caching config reads in up to %d bytes (TTL %s)", *cacheMaxBytes, *cacheTTL)
+	}
+
+	// Encryption at rest wraps whichever store was chosen. The master key
+	// comes from a file or, failing that, YAMLET_MASTER_KEY.
+	master, err := loadMasterKeys(*masterKeyFile)
+	if err != nil {
+		log.Fatalf("Failed to load master key: %v", err)
+	}
+	if master != nil {
+		if legacyKeyPath != "" {
+			if err := importKeyTable(keyTable, legacyKeyPath); err != nil {
+				log.Fatalf("Failed to import key table: %v", err)
+			}
+		}
+		encrypted, err := storage.NewEncryptedStore(store, master, keyTable)
+		if err != nil {
+			log.Fatalf("Failed to enable encryption at rest: %v", err)
+		}
+		if *allowPlaintext {
+			encrypted.AllowPlaintext()
+			log.Println("Serving unencrypted configs until namespaces are rotated")
+		}
+		store = encrypted
+		log.Printf("Encryption at rest enabled with master key version %d", master.Current())
+	}
+
 	// Initialize auth
 	authService := auth.NewTokenAuth()
 
+	switch command {
+	case "":
+	case "rotate-keys":
+		rotateKeys(store)
+		return
+	case "backup":
+		runBackup(store, backend, authService, flag.Arg(0), *backupAllowInconsistent)
+		return
+	case "restore":
+		runRestore(store, flag.Arg(0), *restoreNamespaces, *restoreMode)
+		return
+	default:
+		log.Fatalf("Unknown command %q (want backup, restore, rotate-keys or no command)", command)
+	}
+
+	// Expired configs are not served from the moment they expire; the
+	// reaper deletes them through the full store stack, so caches and
+	// watching replicas see the deletions. It also purges the trash.
+	if *reapInterval > 0 {
+		reaper := storage.NewReaper(store, storage.ReaperOptions{
+			Interval: *reapInterval,
+			OnExpire: func(namespace, name string) {
+				log.Printf("Deleted expired config %s/%s", namespace, name)
+			},
+			TrashRetention: *trashRetention,
+			OnPurge: func(purged int) {
+				log.Printf("Purged %d items from the trash", purged)
+			},
+			OnError: func(err error) {
+				if !errors.Is(err, storage.ErrUnsupported) {
+					log.Printf("Failed to reap expired configs and trash: %v", err)
+				}
+			},
+		})
+		defer reaper.Start()()
+		log.Printf("Deleting expired configs every %s", *reapInterval)
+	}
+
 	// Initialize handlers
 	h := handlers.NewHandler(store, authService)
+	h.SetBackend(backend)
+	if err := h.LoadPolicy(); err != nil {
+		log.Fatalf("Failed to load namespace policies: %v", err)
+	}
+	if *backupAllowInconsistent {
+		h.AllowInconsistentBackups()
+	}
+	if *backupSchedule != "" {
+		schedule, err := backup.ParseSchedule(*backupSchedule)
+		if err != nil {
+			log.Fatalf("Invalid backup schedule: %v", err)
+		}
+		dir := *backupDir
+		if dir == "" {
+			dir = filepath.Join(*dataDir, "backups")
+		}
+		scheduler := backup.NewScheduler(store, backup.SchedulerOptions{
+			Schedule: schedule,
+			Sink:     backup.DirSink{Dir: dir},
+			Source:   backend,
+			Tokens: func() []backup.Token {
+				return backup.TokensFrom(authService.ListTokens(), authService.Permissions)
+			},
+			Policies:          h.Policies,
+			AllowInconsistent: *backupAllowInconsistent,
+			KeepDaily:         *backupKeepDaily,
+			KeepWeekly:        *backupKeepWeekly,
+			MaxAge:            *backupMaxAge,
+			OnBackup: func(name string, manifest backup.Manifest) {
+				log.Printf("Wrote and verified scheduled backup %s (%d files)", name, len(manifest.Files))
+			},
+			OnError: func(err error) {
+				log.Printf("Scheduled backups: %v", err)
+			},
+		})
+		defer scheduler.Start()()
+		h.SetBackupScheduler(scheduler)
+		log.Printf("Backing up to %s on schedule %q, next at %s", dir, schedule, schedule.Next(time.Now()).Format(time.RFC3339))
+	}
+	if cache != nil {
+		h.SetCache(cache)
+	}
+	if *trashRetention > 0 {
+		if _, ok := store.(storage.Trasher); ok {
+			h.SetTrashRetention(*trashRetention)
+			log.Printf("Keeping deleted configs in the trash for %s", *trashRetention)
+		}
+	}
+	h.SetLimits(yamlutil.Limits{
+		MaxDepth:          *maxDepth,
+		MaxNodes:          *maxNodes,
+		MaxAliasExpansion: *maxAliasExpansion,
+		MaxScalarBytes:    *maxScalarBytes,
+	})
+
+	keyring, err := loadKeyring(*keyfile, *ageRecipients, *ageIdentityFile)
+	if err != nil {
+		log.Fatalf("Failed to load encryption keys: %v", err)
+	}
+	if keyring != nil {
+		h.SetKeyring(keyring)
+		log.Println("Field encryption keys loaded")
+	} else if os.Getenv("YAMLET_ENCRYPT_PATHS") != "" {
+		log.Fatal("YAMLET_ENCRYPT_PATHS is set but no keyfile or age recipients are configured")
+	}
 
 	// Setup routes
 	r := mux.NewRouter()
@@ -48,19 +339,53 @@ func main() {
 		w.WriteHeader(http.StatusOK)
 		w.Write([]byte("OK"))
 	}).Methods("GET")
+	r.HandleFunc("/health/backups", h.BackupHealth).Methods("GET")
+	r.HandleFunc("/metrics", h.Metrics).Methods("GET")
 
 	// API routes
 	api := r.PathPrefix("/namespaces").Subrouter()
 	api.HandleFunc("/{namespace}/configs/{name}", h.StoreConfig).Methods("POST")
 	api.HandleFunc("/{namespace}/configs/{name}", h.GetConfig).Methods("GET")
+	api.HandleFunc("/{namespace}/configs/{name}", h.PatchConfig).Methods("PATCH")
 	api.HandleFunc("/{namespace}/configs/{name}", h.DeleteConfig).Methods("DELETE")
+	api.HandleFunc("/{namespace}/configs/{name}/explain", h.ExplainConfig).Methods("GET")
+	api.HandleFunc("/{namespace}/configs/{name}/revisions", h.ListRevisions).Methods("GET")
+	api.HandleFunc("/{namespace}/configs/{name}/rollback", h.RollbackConfig).Methods("POST")
+	api.HandleFunc("/{namespace}/configs/{name}/metadata", h.GetMetadata).Methods("GET")
+	api.HandleFunc("/{namespace}/configs/{name}/metadata", h.SetMetadata).Methods("PUT")
+	api.HandleFunc("/{namespace}/configs/{name}/diff", h.DiffConfig).Methods("GET")
 	api.HandleFunc("/{namespace}/configs", h.ListConfigs).Methods("GET")
+	api.HandleFunc("/{namespace}/usage", h.GetUsage).Methods("GET")
+	api.HandleFunc("/{namespace}/batch", h.BatchConfigs).Methods("POST")
+	api.HandleFunc("/{namespace}/bulk", h.BulkConfigs).Methods("GET")
+	api.HandleFunc("/{namespace}/trash", h.ListTrash).Methods("GET")
+	api.HandleFunc("/{namespace}/trash", h.EmptyTrash).Methods("DELETE")
+	api.HandleFunc("/{namespace}/trash/{id}", h.PurgeTrashItem).Methods("DELETE")
+	api.HandleFunc("/{namespace}/trash/{id}/restore", h.RestoreTrash).Methods("POST")
 
 	// Admin routes for token management
 	admin := r.PathPrefix("/admin").Subrouter()
 	admin.HandleFunc("/tokens", h.CreateToken).Methods("POST")
 	admin.HandleFunc("/tokens", h.ListTokens).Methods("GET")
 	admin.HandleFunc("/tokens/{token}", h.RevokeToken).Methods("DELETE")
+	admin.HandleFunc("/namespaces", h.ListNamespaces).Methods("GET")
+	admin.HandleFunc("/namespaces", h.CreateNamespace).Methods("POST")
+	admin.HandleFunc("/namespaces/{namespace}", h.GetNamespace).Methods("GET")
+	admin.HandleFunc("/namespaces/{namespace}", h.UpdateNamespace).Methods("PUT")
+	admin.HandleFunc("/namespaces/{namespace}", h.DeleteNamespace).Methods("DELETE")
+	admin.HandleFunc("/namespaces/{namespace}/quota", h.GetQuota).Methods("GET")
+	admin.HandleFunc("/namespaces/{namespace}/quota", h.SetQuota).Methods("PUT")
+	admin.HandleFunc("/namespaces/{namespace}/secret-paths", h.GetSecretPaths).Methods("GET")
+	admin.HandleFunc("/namespaces/{namespace}/secret-paths", h.SetSecretPaths).Methods("PUT")
+	admin.HandleFunc("/namespaces/{namespace}/encrypted-paths", h.GetEncryptedPaths).Methods("GET")
+	admin.HandleFunc("/namespaces/{namespace}/encrypted-paths", h.SetEncryptedPaths).Methods("PUT")
+	admin.HandleFunc("/namespaces/{namespace}/referrers", h.GetReferrers).Methods("GET")
+	admin.HandleFunc("/namespaces/{namespace}/referrers", h.SetReferrers).Methods("PUT")
+	admin.HandleFunc("/encryption/rotate", h.RotateKeys).Methods("POST")
+	admin.HandleFunc("/snapshot", h.Snapshot).Methods("GET")
+	admin.HandleFunc("/backup", h.Backup).Methods("GET")
+	admin.HandleFunc("/restore", h.Restore).Methods("POST")
+	admin.HandleFunc("/cache", h.CacheStats).Methods("GET")
 
 	// Start server with explicit timeouts to mitigate slowloris and
 	// resource-exhaustion attacks.
@@ -78,6 +403,177 @@ func main() {
 	log.Fatal(srv.ListenAndServe())
 }
 
+// loadMasterKeys reads the master keys for encryption at rest, or returns
+// nil when encryption at rest is not configured.
+func loadMasterKeys(path string) (*storage.MasterKeys, error) {
+	if path != "" {
+		return storage.LoadMasterKeyFile(path)
+	}
+	if env := os.Getenv("YAMLET_MASTER_KEY"); env != "" {
+		return storage.ParseMasterKeys(env)
+	}
+	return nil, nil
+}
+
+// importKeyTable copies a key table file written by an older version into
+// a store that now keeps the key table itself, unless it has one already.
+func importKeyTable(table storage.KeyTable, path string) error {
+	data, _, err := storage.FileKeyTable{Path: path}.LoadKeyTable()
+	if err != nil || data == nil {
+		return err
+	}
+	revision, err := table.KeyTableRevision()
+	if err != nil || revision != "" {
+		return err
+	}
+	_, err = table.SaveKeyTable(data, "")
+	if errors.Is(err, storage.ErrConflict) {
+		return nil // imported by another replica
+	}
+	if err == nil {
+		log.Printf("Imported key table %s; it is no longer used and can be removed", path)
+	}
+	return err
+}
+
+// rotateKeys re-encrypts the data directory under new keys. The server must
+// not be running against the same data; use POST /admin/encryption/rotate to
+// rotate a live server.
+func rotateKeys(store storage.Store) {
+	rotator, ok := store.(storage.Rotator)
+	if !ok {
+		log.Fatal("Encryption at rest is not enabled; set YAMLET_MASTER_KEY or YAMLET_MASTER_KEY_FILE")
+	}
+	result, err := rotator.Rotate()
+	if err != nil {
+		log.Fatalf("Failed to rotate keys: %v", err)
+	}
+	log.Printf("Re-encrypted %d configs in %d namespaces under master key version %d",
+		result.Configs, result.Namespaces, result.MasterVersion)
+}
+
+// runBackup writes a backup archive of store to path, or to standard output
+// when path is empty or "-". Only the tokens configured through YAMLET_TOKENS
+// are archived; GET /admin/backup also archives those created through the
+// API. The file and bbolt backends must not be in use by a server while it
+// runs.
+func runBackup(store storage.Store, backend string, a *auth.TokenAuth, path string, allowInconsistent bool) {
+	p, err := loadPolicy(store)
+	if err != nil {
+		log.Fatalf("Failed to load namespace policies: %v", err)
+	}
+	opts := backup.Options{
+		Source:            backend,
+		Tokens:            backup.TokensFrom(a.ListTokens(), a.Permissions),
+		Policies:          p.Policies(),
+		AllowInconsistent: allowInconsistent,
+	}
+	var manifest backup.Manifest
+	if path == "" || path == "-" {
+		manifest, err = backup.Write(os.Stdout, store, opts)
+	} else {
+		manifest, err = backup.WriteFile(path, store, opts)
+	}
+	if err != nil {
+		log.Fatalf("Failed to write backup: %v", err)
+	}
+	configs := 0
+	for _, ns := range manifest.Namespaces {
+		configs += len(ns.Configs)
+	}
+	log.Printf("Backed up %d configs in %d namespaces and %d tokens (point in time: %t)",
+		configs, len(manifest.Namespaces), manifest.Tokens, manifest.Consistent)
+}
+
+// runRestore restores a backup archive from path, or from standard input
+// when path is empty or "-", into store. Tokens are held by the server in
+// memory, so they are only restored through POST /admin/restore.
+func runRestore(store storage.Store, path, namespaces, mode string) {
+	restoreMode, err := backup.ParseMode(mode)
+	if err != nil {
+		log.Fatal(err)
+	}
+	in := os.Stdin
+	if path != "" && path != "-" {
+		f, err := os.Open(path)
+		if err != nil {
+			log.Fatalf("Failed to open backup: %v", err)
+		}
+		defer f.Close()
+		in = f
+	}
+	archive, err := backup.Read(in)
+	if err != nil {
+		log.Fatalf("Failed to read backup: %v", err)
+	}
+
+	p, err := loadPolicy(store)
+	if err != nil {
+		log.Fatalf("Failed to load namespace policies: %v", err)
+	}
+	opts := backup.RestoreOptions{Mode: restoreMode}
+	if _, ok := store.(storage.NamespaceStore); ok {
+		opts.RestorePolicy = p.Restore
+	} else {
+		log.Printf("The store keeps no namespace records, so namespace policies are not restored")
+	}
+	for _, ns := range strings.Split(namespaces, ",") {
+		if ns = strings.TrimSpace(ns); ns != "" {
+			opts.Namespaces = append(opts.Namespaces, ns)
+		}
+	}
+	result, err := backup.Restore(archive, store, opts)
+	if err != nil {
+		log.Fatalf("Failed to restore backup after %d configs: %v", result.Configs, err)
+	}
+	log.Printf("Restored %d configs (%d skipped) with %d revisions and %d policies in %d namespaces from a backup taken %s",
+		result.Configs, result.Skipped, result.Revisions, result.Policies, len(result.Namespaces), archive.Manifest.Created.Format(time.RFC3339))
+	if archive.Manifest.Tokens > 0 {
+		log.Printf("The backup holds %d tokens; restore it through POST /admin/restore to add them to a running server", archive.Manifest.Tokens)
+	}
+}
+
+// loadPolicy returns the namespace policies in effect, from the namespace
+// records of store and the environment. Changes to it are saved in the
+// records, where the server loads them.
+func loadPolicy(store storage.Store) (*policy.Policy, error) {
+	p := policy.NewPolicy()
+	if namespaces, ok := store.(storage.NamespaceStore); ok {
+		if err := p.Load(namespaces); err != nil {
+			return nil, err
+		}
+	}
+	return p, nil
+}
+
+// loadKeyring builds the field encryption keyring, or returns nil when no
+// keys are configured.
+func loadKeyring(keyfile, recipients, identityFile string) (*fieldcrypt.Keyring, error) {
+	if keyfile == "" && recipients == "" && identityFile == "" {
+		return nil, nil
+	}
+	k := fieldcrypt.NewKeyring()
+	if keyfile != "" {
+		if err := k.LoadKeyfile(keyfile); err != nil {
+			return nil, err
+		}
+	}
+	if recipients != "" {
+		if err := k.AddAgeRecipients(strings.Split(recipients, ",")...); err != nil {
+			return nil, err
+		}
+	}
+	if identityFile != "" {
+		if err := k.LoadAgeIdentities(identityFile); err != nil {
+			return nil, err
+		}
+	}
+	if !k.CanWrap() {
+		return nil, fmt.Errorf("%w: set a keyfile or age recipients", fieldcrypt.ErrNoKeys)
+	}
+	return k, nil
+}
+
 func getEnv(key, defaultValue string) string {
 	if value := os.Getenv(key); value != "" {
 		return value
@@ -94,6 +590,15 @@ func getEnvAsInt(key string, defaultValue int) int {
 	return defaultValue
 }
 
+func getEnvAsDuration(key string, defaultValue time.Duration) time.Duration {
+	if value := os.Getenv(key); value != "" {
+		if d, err := time.ParseDuration(value); err == nil {
+			return d
+		}
+	}
+	return defaultValue
+}
+
 func getEnvAsBool(key string, defaultValue bool) bool {
 	if value := os.Getenv(key); value != "" {
 		if boolVal, err := strconv.ParseBool(value); err == nil {
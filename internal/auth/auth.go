@@ -1,6 +1,8 @@
 package auth
 
 import (
+	"crypto/sha256"
+	"encoding/hex"
 	"errors"
 	"fmt"
 	"os"
@@ -19,13 +21,36 @@ var (
 	ErrInvalidInput      = errors.New("invalid input")
 )
 
+// Permission grants a token abilities beyond reading and writing its
+// namespace.
+type Permission string
+
+// Known permissions.
+const (
+	// PermReadSecrets lets a token read secret key paths unredacted.
+	PermReadSecrets Permission = "read-secrets"
+)
+
+// ParsePermission validates a permission name.
+func ParsePermission(s string) (Permission, error) {
+	switch p := Permission(s); p {
+	case PermReadSecrets:
+		return p, nil
+	}
+	return "", fmt.Errorf("%w: unknown permission %q", ErrInvalidInput, s)
+}
+
 // Auth interface defines authentication operations
 type Auth interface {
 	ValidateToken(namespace, token string) error
 	GetNamespaceForToken(token string) (string, error)
+	// Permissions returns the permissions granted to a token.
+	Permissions(token string) []Permission
+	// HasPermission reports whether a token holds a permission.
+	HasPermission(token string, perm Permission) bool
 	// Admin operations
 	IsAdminToken(token string) bool
-	CreateToken(adminToken, newToken, namespace string) error
+	CreateToken(adminToken, newToken, namespace string, perms ...Permission) error
 	RevokeToken(adminToken, tokenToRevoke string) error
 	ListAllTokens(adminToken string) (map[string]string, error)
 }
@@ -33,14 +58,16 @@ type Auth interface {
 // TokenAuth implements simple token-based authentication
 type TokenAuth struct {
 	mu         sync.RWMutex
-	tokens     map[string]string // token -> namespace
-	adminToken string            // special admin token
+	tokens     map[string]string       // token -> namespace
+	perms      map[string][]Permission // token -> granted permissions
+	adminToken string                  // special admin token
 }
 
 // NewTokenAuth creates a new token-based auth service
 func NewTokenAuth() *TokenAuth {
 	auth := &TokenAuth{
 		tokens: make(map[string]string),
+		perms:  make(map[string][]Permission),
 	}
 
 	// Set admin token from environment or use default
@@ -62,6 +89,8 @@ func NewTokenAuth() *TokenAuth {
 
 // loadTokensFromEnv loads tokens from environment variables
 // Expected format: YAMLET_TOKENS=token1:namespace1,token2:namespace2
+// A third field grants permissions, joined with "+":
+// token3:namespace3:read-secrets
 func (t *TokenAuth) loadTokensFromEnv() {
 	tokensEnv := os.Getenv("YAMLET_TOKENS")
 	if tokensEnv == "" {
@@ -71,14 +100,38 @@ func (t *TokenAuth) loadTokensFromEnv() {
 	pairs := strings.Split(tokensEnv, ",")
 	for _, pair := range pairs {
 		parts := strings.Split(strings.TrimSpace(pair), ":")
-		if len(parts) == 2 {
-			token := strings.TrimSpace(parts[0])
-			namespace := strings.TrimSpace(parts[1])
-			if token != "" && namespace != "" {
-				t.tokens[token] = namespace
+		if len(parts) != 2 && len(parts) != 3 {
+			continue
+		}
+		token := strings.TrimSpace(parts[0])
+		namespace := strings.TrimSpace(parts[1])
+		if token == "" || namespace == "" {
+			continue
+		}
+		var perms []Permission
+		if len(parts) == 3 {
+			var err error
+			if perms, err = parsePermissions(strings.Split(parts[2], "+")); err != nil {
+				continue
 			}
 		}
+		t.tokens[token] = namespace
+		if len(perms) > 0 {
+			t.perms[token] = perms
+		}
+	}
+}
+
+func parsePermissions(names []string) ([]Permission, error) {
+	perms := make([]Permission, 0, len(names))
+	for _, name := range names {
+		p, err := ParsePermission(strings.TrimSpace(name))
+		if err != nil {
+			return nil, err
+		}
+		perms = append(perms, p)
 	}
+	return perms, nil
 }
 
 // setDevelopmentTokens sets up minimal tokens for development only
@@ -100,6 +153,13 @@ func stripBearer(token string) string {
 	return strings.TrimPrefix(token, "Bearer ")
 }
 
+// Fingerprint identifies a token without revealing it, for recording who
+// made a change. It is the first 12 hex digits of the token's SHA-256.
+func Fingerprint(token string) string {
+	sum := sha256.Sum256([]byte(stripBearer(token)))
+	return hex.EncodeToString(sum[:])[:12]
+}
+
 // ValidateToken validates if a token is valid for the given namespace
 func (t *TokenAuth) ValidateToken(namespace, token string) error {
 	if token == "" {
@@ -137,11 +197,31 @@ func (t *TokenAuth) GetNamespaceForToken(token string) (string, error) {
 	return namespace, nil
 }
 
+// Permissions returns the permissions granted to a token
+func (t *TokenAuth) Permissions(token string) []Permission {
+	token = stripBearer(token)
+
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	return append([]Permission(nil), t.perms[token]...)
+}
+
+// HasPermission reports whether a token holds a permission
+func (t *TokenAuth) HasPermission(token string, perm Permission) bool {
+	for _, p := range t.Permissions(token) {
+		if p == perm {
+			return true
+		}
+	}
+	return false
+}
+
 // AddToken adds a new token for a namespace (useful for testing)
-func (t *TokenAuth) AddToken(token, namespace string) {
+func (t *TokenAuth) AddToken(token, namespace string, perms ...Permission) {
 	t.mu.Lock()
 	defer t.mu.Unlock()
 	t.tokens[token] = namespace
+	t.setPermissions(token, perms)
 }
 
 // RemoveToken removes a token (useful for testing)
@@ -149,6 +229,16 @@ func (t *TokenAuth) RemoveToken(token string) {
 	t.mu.Lock()
 	defer t.mu.Unlock()
 	delete(t.tokens, token)
+	delete(t.perms, token)
+}
+
+// setPermissions records perms for token. Callers hold t.mu.
+func (t *TokenAuth) setPermissions(token string, perms []Permission) {
+	if len(perms) == 0 {
+		delete(t.perms, token)
+		return
+	}
+	t.perms[token] = append([]Permission(nil), perms...)
 }
 
 // ListTokens returns all configured tokens (for debugging, remove in production)
@@ -169,14 +259,20 @@ func (t *TokenAuth) IsAdminToken(token string) bool {
 	return stripBearer(token) == t.adminToken
 }
 
-// CreateToken creates a new namespace token (admin only)
-func (t *TokenAuth) CreateToken(adminToken, newToken, namespace string) error {
+// CreateToken creates a new namespace token with optional permissions
+// (admin only)
+func (t *TokenAuth) CreateToken(adminToken, newToken, namespace string, perms ...Permission) error {
 	if !t.IsAdminToken(adminToken) {
 		return ErrAdminRequired
 	}
 	if newToken == "" || namespace == "" {
 		return fmt.Errorf("%w: token and namespace cannot be empty", ErrInvalidInput)
 	}
+	for _, p := range perms {
+		if _, err := ParsePermission(string(p)); err != nil {
+			return err
+		}
+	}
 
 	t.mu.Lock()
 	defer t.mu.Unlock()
@@ -189,6 +285,7 @@ func (t *TokenAuth) CreateToken(adminToken, newToken, namespace string) error {
 	}
 
 	t.tokens[newToken] = namespace
+	t.setPermissions(newToken, perms)
 	return nil
 }
 
@@ -212,6 +309,7 @@ func (t *TokenAuth) RevokeToken(adminToken, tokenToRevoke string) error {
 	}
 
 	delete(t.tokens, tokenToRevoke)
+	delete(t.perms, tokenToRevoke)
 	return nil
 }
 
@@ -3,6 +3,7 @@ package auth
 import (
 	"errors"
 	"os"
+	"strings"
 	"sync"
 	"testing"
 )
@@ -230,3 +231,50 @@ func TestCreateTokenAtomic(t *testing.T) {
 		t.Fatalf("expected exactly 1 successful CreateToken, got %d", successes)
 	}
 }
+
+func TestTokenPermissions(t *testing.T) {
+	t.Setenv("YAMLET_TOKENS", "reader:dev,auditor:dev:read-secrets,bogus:dev:fly")
+	a := NewTokenAuth()
+
+	if a.HasPermission("reader", PermReadSecrets) {
+		t.Fatal("reader should not hold read-secrets")
+	}
+	if !a.HasPermission("Bearer auditor", PermReadSecrets) {
+		t.Fatal("auditor should hold read-secrets")
+	}
+	if err := a.ValidateToken("dev", "bogus"); !errors.Is(err, ErrInvalidToken) {
+		t.Fatalf("token with an unknown permission should be skipped, got %v", err)
+	}
+
+	const admin = "admin-secret-token-change-me"
+	if err := a.CreateToken(admin, "ops", "dev", PermReadSecrets); err != nil {
+		t.Fatalf("CreateToken: %v", err)
+	}
+	if !a.HasPermission("ops", PermReadSecrets) {
+		t.Fatal("created token should hold its permission")
+	}
+	if err := a.CreateToken(admin, "ops2", "dev", "fly"); !errors.Is(err, ErrInvalidInput) {
+		t.Fatalf("unknown permission should yield ErrInvalidInput, got %v", err)
+	}
+
+	if err := a.RevokeToken(admin, "ops"); err != nil {
+		t.Fatalf("RevokeToken: %v", err)
+	}
+	a.AddToken("ops", "dev")
+	if a.HasPermission("ops", PermReadSecrets) {
+		t.Fatal("permissions must not survive revocation")
+	}
+}
+
+func TestFingerprint(t *testing.T) {
+	fp := Fingerprint("dev-token")
+	if len(fp) != 12 || strings.Contains(fp, "dev") {
+		t.Fatalf("unexpected fingerprint %q", fp)
+	}
+	if Fingerprint("Bearer dev-token") != fp {
+		t.Fatal("fingerprint should ignore the Bearer prefix")
+	}
+	if Fingerprint("prod-token") == fp {
+		t.Fatal("different tokens should have different fingerprints")
+	}
+}
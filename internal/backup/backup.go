@@ -0,0 +1,447 @@
+// Package backup writes and restores portable archives of a yamlet store:
+// every namespace record, config, metadata record and retained revision,
+// together with the namespace tokens and policies. Archives are independent of the
+// storage backend, so one taken from any backend restores into any other.
+//
+// An archive is a gzip-compressed tar file. Its first entry, manifest.json,
+// describes the rest, including the policy of each namespace, and holds a
+// SHA-256 checksum of every other entry:
+//
+//	manifest.json
+//	tokens.json
+//	namespaces/<namespace>/namespace.json
+//	namespaces/<namespace>/configs/<name>
+//	namespaces/<namespace>/metadata/<name>.json
+//	namespaces/<namespace>/revisions/<name>/<revision>
+//
+// Contents are archived as the store serves them, so an EncryptedStore's
+// configs are archived in plaintext and archives need the same protection
+// as the tokens they hold.
+package backup
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/zvdy/yamlet/internal/storage"
+)
+
+// Format and Version identify the archive layout in the manifest.
+const (
+	Format  = "yamlet-backup"
+	Version = 1
+)
+
+const manifestPath = "manifest.json"
+
+// ErrInvalidArchive is returned for archives that are malformed, of an
+// unknown version, or that fail their checksums.
+var ErrInvalidArchive = errors.New("invalid backup archive")
+
+// Token is a namespace token as archived.
+type Token struct {
+	Token       string   `json:"token"`
+	Namespace   string   `json:"namespace"`
+	Permissions []string `json:"permissions,omitempty"`
+}
+
+// Manifest describes an archive.
+type Manifest struct {
+	Format  string    `json:"format"`
+	Version int       `json:"version"`
+	Created time.Time `json:"created"`
+	// Source names the storage backend the archive was taken from.
+	Source string `json:"source,omitempty"`
+	// Consistent reports whether the whole store was read at a single
+	// point in time. Stores that are not storage.Exporters are read one
+	// config at a time, so writes made meanwhile may show up part way.
+	Consistent bool        `json:"consistent"`
+	Namespaces []Namespace `json:"namespaces"`
+	Tokens     int         `json:"tokens"`
+	Files      []File      `json:"files"`
+}
+
+// Namespace lists what an archive holds for one namespace.
+type Namespace struct {
+	Name string `json:"name"`
+	// Record reports whether the namespace has a record.
+	Record bool `json:"record,omitempty"`
+	// Policy is the policy in effect in the namespace: its secret paths,
+	// encrypted paths and quota, whether set through the admin API or the
+	// environment.
+	Policy  *storage.NamespacePolicy `json:"policy,omitempty"`
+	Configs []Config                 `json:"configs"`
+}
+
+// Config lists what an archive holds for one config.
+type Config struct {
+	Name string `json:"name"`
+	Size int    `json:"size"`
+	// Metadata reports whether the config has a metadata record.
+	Metadata  bool               `json:"metadata,omitempty"`
+	Revisions []storage.Revision `json:"revisions,omitempty"`
+}
+
+// File is an archive entry with its checksum.
+type File struct {
+	Path   string `json:"path"`
+	Size   int64  `json:"size"`
+	SHA256 string `json:"sha256"`
+}
+
+// Options configure Write.
+type Options struct {
+	// Source names the storage backend in the manifest.
+	Source string
+	// Tokens are archived in tokens.json.
+	Tokens []Token
+	// Policies are the policies in effect, by namespace, archived in the
+	// manifest for the namespaces the store holds.
+	Policies map[string]storage.NamespacePolicy
+	// AllowInconsistent archives stores that are not storage.Exporters,
+	// such as S3, by reading them one config at a time; Write fails for
+	// them otherwise.
+	AllowInconsistent bool
+}
+
+// Write archives store to w and returns the archive's manifest. Everything
+// is read at a single point in time, which needs a storage.Exporter unless
+// opts.AllowInconsistent is set. The archive is assembled in memory first,
+// so writing to a slow w does not hold the store up.
+func Write(w io.Writer, store storage.Store, opts Options) (Manifest, error) {
+	a := &Archive{
+		Manifest: Manifest{
+			Format:     Format,
+			Version:    Version,
+			Created:    time.Now().UTC(),
+			Source:     opts.Source,
+			Namespaces: []Namespace{},
+			Files:      []File{},
+		},
+		files: make(map[string][]byte),
+	}
+
+	exported := false
+	if exporter, ok := store.(storage.Exporter); ok {
+		err := exporter.Export(func(view storage.StoreView) error {
+			exported = true
+			return a.collect(view)
+		})
+		if err != nil && (exported || !errors.Is(err, storage.ErrUnsupported)) {
+			return Manifest{}, err
+		}
+	}
+	if !exported {
+		if !opts.AllowInconsistent {
+			return Manifest{}, fmt.Errorf("backups not read at a single point in time: %w; allow inconsistent backups to read the store one config at a time",
+				storage.ErrUnsupported)
+		}
+		if err := a.collect(storage.LiveView(store)); err != nil {
+			return Manifest{}, err
+		}
+	}
+	a.Manifest.Consistent = exported
+	for i, ns := range a.Manifest.Namespaces {
+		if np, ok := opts.Policies[ns.Name]; ok {
+			a.Manifest.Namespaces[i].Policy = &np
+		}
+	}
+
+	tokens := slices.Clone(opts.Tokens)
+	slices.SortFunc(tokens, func(x, y Token) int {
+		if c := strings.Compare(x.Namespace, y.Namespace); c != 0 {
+			return c
+		}
+		return strings.Compare(x.Token, y.Token)
+	})
+	if tokens == nil {
+		tokens = []Token{}
+	}
+	if err := a.addJSON("tokens.json", tokens); err != nil {
+		return Manifest{}, err
+	}
+	a.Manifest.Tokens = len(tokens)
+
+	return a.Manifest, a.write(w)
+}
+
+// WriteFile archives store to the named file, as Write does. The archive is
+// written to a temporary file in the same directory and renamed into place
+// once it is on disk, so the file never holds a partial archive.
+func WriteFile(filename string, store storage.Store, opts Options) (Manifest, error) {
+	f, err := os.CreateTemp(filepath.Dir(filename), "."+filepath.Base(filename)+".tmp-*")
+	if err != nil {
+		return Manifest{}, err
+	}
+	defer os.Remove(f.Name())
+
+	manifest, err := Write(f, store, opts)
+	if err == nil {
+		err = f.Sync()
+	}
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(f.Name(), filename)
+	}
+	if err != nil {
+		return Manifest{}, err
+	}
+	return manifest, nil
+}
+
+// collect reads everything view holds into a.
+func (a *Archive) collect(view storage.StoreView) error {
+	a.Manifest.Namespaces = a.Manifest.Namespaces[:0]
+	a.Manifest.Files = a.Manifest.Files[:0]
+	clear(a.files)
+
+	namespaces, err := view.Namespaces()
+	if err != nil {
+		return fmt.Errorf("failed to list namespaces: %w", err)
+	}
+	for _, namespace := range namespaces {
+		ns := Namespace{Name: namespace, Configs: []Config{}}
+		info, err := view.NamespaceInfo(namespace)
+		switch {
+		case err == nil:
+			ns.Record = true
+			if err := a.addJSON(namespacePath(namespace, "namespace.json"), info); err != nil {
+				return err
+			}
+		case !errors.Is(err, storage.ErrNotFound) && !errors.Is(err, storage.ErrUnsupported):
+			return fmt.Errorf("failed to read namespace %s: %w", namespace, err)
+		}
+
+		names, err := view.List(namespace)
+		if err != nil {
+			return fmt.Errorf("failed to list namespace %s: %w", namespace, err)
+		}
+		for _, name := range names {
+			cfg, ok, err := a.collectConfig(view, namespace, name)
+			if err != nil {
+				return err
+			}
+			if ok {
+				ns.Configs = append(ns.Configs, cfg)
+			}
+		}
+		a.Manifest.Namespaces = append(a.Manifest.Namespaces, ns)
+	}
+	return nil
+}
+
+// collectConfig reads one config into a. It reports false for a config
+// deleted since it was listed.
+func (a *Archive) collectConfig(view storage.StoreView, namespace, name string) (Config, bool, error) {
+	content, err := view.Get(namespace, name)
+	if errors.Is(err, storage.ErrNotFound) {
+		return Config{}, false, nil
+	}
+	if err != nil {
+		return Config{}, false, fmt.Errorf("failed to read config %s in namespace %s: %w", name, namespace, err)
+	}
+	cfg := Config{Name: name, Size: len(content)}
+	a.add(namespacePath(namespace, "configs", name), content)
+
+	md, err := view.Metadata(namespace, name)
+	switch {
+	case err == nil:
+		cfg.Metadata = true
+		if err := a.addJSON(namespacePath(namespace, "metadata", name+".json"), md); err != nil {
+			return Config{}, false, err
+		}
+	case !errors.Is(err, storage.ErrNotFound) && !errors.Is(err, storage.ErrUnsupported):
+		return Config{}, false, fmt.Errorf("failed to read metadata of config %s in namespace %s: %w", name, namespace, err)
+	}
+
+	revs, err := view.Revisions(namespace, name)
+	if err != nil && !errors.Is(err, storage.ErrNotFound) && !errors.Is(err, storage.ErrUnsupported) {
+		return Config{}, false, fmt.Errorf("failed to list revisions of config %s in namespace %s: %w", name, namespace, err)
+	}
+	for _, rev := range revs {
+		content, err := view.GetRevision(namespace, name, rev.Number)
+		if errors.Is(err, storage.ErrNotFound) {
+			// Pruned since it was listed.
+			continue
+		}
+		if err != nil {
+			return Config{}, false, fmt.Errorf("failed to read revision %d of config %s in namespace %s: %w", rev.Number, name, namespace, err)
+		}
+		rev.Size = len(content)
+		cfg.Revisions = append(cfg.Revisions, rev)
+		a.add(namespacePath(namespace, "revisions", name, strconv.Itoa(rev.Number)), content)
+	}
+	return cfg, true, nil
+}
+
+func namespacePath(namespace string, elem ...string) string {
+	return path.Join(append([]string{"namespaces", namespace}, elem...)...)
+}
+
+func (a *Archive) add(name string, content []byte) {
+	sum := sha256.Sum256(content)
+	a.Manifest.Files = append(a.Manifest.Files, File{Path: name, Size: int64(len(content)), SHA256: hex.EncodeToString(sum[:])})
+	a.files[name] = content
+}
+
+func (a *Archive) addJSON(name string, v any) error {
+	data, err := json.MarshalIndent(v, "", "  ")
+	if err != nil {
+		return err
+	}
+	a.add(name, data)
+	return nil
+}
+
+// write writes the manifest and then every file as a gzip-compressed tar.
+func (a *Archive) write(w io.Writer) error {
+	manifest, err := json.MarshalIndent(a.Manifest, "", "  ")
+	if err != nil {
+		return err
+	}
+	gz := gzip.NewWriter(w)
+	tw := tar.NewWriter(gz)
+	entry := func(name string, content []byte) error {
+		hdr := &tar.Header{
+			Name:     name,
+			Mode:     0o600,
+			Size:     int64(len(content)),
+			ModTime:  a.Manifest.Created,
+			Typeflag: tar.TypeReg,
+		}
+		if err := tw.WriteHeader(hdr); err != nil {
+			return err
+		}
+		_, err := tw.Write(content)
+		return err
+	}
+	if err := entry(manifestPath, manifest); err != nil {
+		return err
+	}
+	for _, f := range a.Manifest.Files {
+		if err := entry(f.Path, a.files[f.Path]); err != nil {
+			return err
+		}
+	}
+	if err := tw.Close(); err != nil {
+		return err
+	}
+	return gz.Close()
+}
+
+// Archive is an archive read into memory and verified.
+type Archive struct {
+	Manifest Manifest
+	files    map[string][]byte
+}
+
+// Read reads an archive and verifies it: the manifest must be first and of
+// a known version, and every file it lists must be present, with nothing
+// else, and match its checksum. Errors about the archive itself wrap
+// ErrInvalidArchive.
+func Read(r io.Reader) (*Archive, error) {
+	gz, err := gzip.NewReader(r)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %w", ErrInvalidArchive, err)
+	}
+	defer gz.Close()
+	tr := tar.NewReader(gz)
+
+	hdr, err := tr.Next()
+	if err != nil {
+		return nil, fmt.Errorf("%w: %w", ErrInvalidArchive, err)
+	}
+	if hdr.Name != manifestPath {
+		return nil, fmt.Errorf("%w: first entry is %q, not %s", ErrInvalidArchive, hdr.Name, manifestPath)
+	}
+	a := &Archive{files: make(map[string][]byte)}
+	if err := json.NewDecoder(tr).Decode(&a.Manifest); err != nil {
+		return nil, fmt.Errorf("%w: %s: %w", ErrInvalidArchive, manifestPath, err)
+	}
+	if a.Manifest.Format != Format || a.Manifest.Version != Version {
+		return nil, fmt.Errorf("%w: unsupported format %q version %d", ErrInvalidArchive, a.Manifest.Format, a.Manifest.Version)
+	}
+	want := make(map[string]File, len(a.Manifest.Files))
+	for _, f := range a.Manifest.Files {
+		want[f.Path] = f
+	}
+
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("%w: %w", ErrInvalidArchive, err)
+		}
+		f, ok := want[hdr.Name]
+		if !ok {
+			return nil, fmt.Errorf("%w: %s is not in the manifest", ErrInvalidArchive, hdr.Name)
+		}
+		if _, dup := a.files[hdr.Name]; dup {
+			return nil, fmt.Errorf("%w: %s appears twice", ErrInvalidArchive, hdr.Name)
+		}
+		var buf bytes.Buffer
+		if _, err := io.CopyN(&buf, tr, f.Size+1); err != nil && err != io.EOF {
+			return nil, fmt.Errorf("%w: %s: %w", ErrInvalidArchive, hdr.Name, err)
+		}
+		sum := sha256.Sum256(buf.Bytes())
+		if int64(buf.Len()) != f.Size || hex.EncodeToString(sum[:]) != f.SHA256 {
+			return nil, fmt.Errorf("%w: %s does not match its checksum", ErrInvalidArchive, hdr.Name)
+		}
+		a.files[hdr.Name] = buf.Bytes()
+	}
+	for _, f := range a.Manifest.Files {
+		if _, ok := a.files[f.Path]; !ok {
+			return nil, fmt.Errorf("%w: %s is missing", ErrInvalidArchive, f.Path)
+		}
+	}
+	return a, nil
+}
+
+// Verify reads and verifies an archive, as Read does, and returns its
+// manifest.
+func Verify(r io.Reader) (Manifest, error) {
+	a, err := Read(r)
+	if err != nil {
+		return Manifest{}, err
+	}
+	return a.Manifest, nil
+}
+
+// Tokens returns the archived tokens.
+func (a *Archive) Tokens() ([]Token, error) {
+	var tokens []Token
+	if err := a.readJSON("tokens.json", &tokens); err != nil {
+		return nil, err
+	}
+	return tokens, nil
+}
+
+// readJSON decodes an archived file into v.
+func (a *Archive) readJSON(name string, v any) error {
+	data, ok := a.files[name]
+	if !ok {
+		return fmt.Errorf("%w: %s is missing", ErrInvalidArchive, name)
+	}
+	if err := json.Unmarshal(data, v); err != nil {
+		return fmt.Errorf("%w: %s: %w", ErrInvalidArchive, name, err)
+	}
+	return nil
+}
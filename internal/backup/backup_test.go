@@ -0,0 +1,204 @@
+package backup
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/zvdy/yamlet/internal/storage"
+)
+
+// plainStore hides every optional interface of the store it wraps.
+type plainStore struct {
+	inner storage.Store
+}
+
+func (p plainStore) Store(namespace, name string, content []byte) error {
+	return p.inner.Store(namespace, name, content)
+}
+func (p plainStore) Get(namespace, name string) ([]byte, error) { return p.inner.Get(namespace, name) }
+func (p plainStore) Delete(namespace, name string) error        { return p.inner.Delete(namespace, name) }
+func (p plainStore) List(namespace string) ([]string, error)    { return p.inner.List(namespace) }
+
+func newTestStore(t *testing.T) *storage.MemoryStore {
+	t.Helper()
+	store := storage.NewMemoryStore()
+	store.Store("dev", "app.yaml", []byte("v: 1"))
+	store.Store("dev", "app.yaml", []byte("v: 2"))
+	store.SetMetadata("dev", "app.yaml", storage.Metadata{Labels: map[string]string{"tier": "web"}})
+	store.Store("prod", "db.yaml", []byte("db: 1"))
+	store.SetNamespaceInfo(storage.NamespaceInfo{Name: "prod", Owner: "ops"})
+	return store
+}
+
+var testPolicies = map[string]storage.NamespacePolicy{
+	"prod":   {SecretPaths: []string{"db.password"}, Quota: &storage.NamespaceQuota{MaxConfigs: 5}},
+	"absent": {SecretPaths: []string{"token"}},
+}
+
+var testTokens = []Token{
+	{Token: "prod-token", Namespace: "prod", Permissions: []string{"read"}},
+	{Token: "dev-token", Namespace: "dev"},
+}
+
+func TestWrite(t *testing.T) {
+	var buf bytes.Buffer
+	manifest, err := Write(&buf, newTestStore(t), Options{Source: "memory", Tokens: testTokens, Policies: testPolicies})
+	if err != nil {
+		t.Fatalf("Write: %v", err)
+	}
+	if !manifest.Consistent || manifest.Source != "memory" || manifest.Tokens != 2 || len(manifest.Namespaces) != 2 {
+		t.Fatalf("unexpected manifest %+v", manifest)
+	}
+	dev := manifest.Namespaces[0]
+	if dev.Name != "dev" || dev.Record || len(dev.Configs) != 1 || !dev.Configs[0].Metadata || len(dev.Configs[0].Revisions) != 2 {
+		t.Fatalf("unexpected namespace %+v", dev)
+	}
+	if prod := manifest.Namespaces[1]; !prod.Record || len(prod.Configs) != 1 || prod.Policy == nil || prod.Policy.Quota.MaxConfigs != 5 {
+		t.Fatalf("unexpected namespace %+v", prod)
+	}
+	if dev.Policy != nil {
+		t.Fatalf("a namespace without a policy should archive none, got %+v", dev.Policy)
+	}
+
+	a, err := Read(bytes.NewReader(buf.Bytes()))
+	if err != nil {
+		t.Fatalf("Read: %v", err)
+	}
+	if len(a.Manifest.Files) != len(manifest.Files) || !a.Manifest.Created.Equal(manifest.Created) {
+		t.Fatalf("Read manifest = %+v", a.Manifest)
+	}
+	if got := string(a.files["namespaces/dev/revisions/app.yaml/1"]); got != "v: 1" {
+		t.Fatalf("revision 1 = %q", got)
+	}
+	tokens, err := a.Tokens()
+	if err != nil || len(tokens) != 2 || tokens[0].Token != "dev-token" {
+		t.Fatalf("Tokens = %+v, %v", tokens, err)
+	}
+
+	buf.Reset()
+	store := newTestStore(t)
+	manifest, err = Write(&buf, storage.NewCachingStore(plainStore{store}, storage.CacheOptions{}), Options{AllowInconsistent: true})
+	if err == nil {
+		t.Fatalf("Write of a store that cannot list namespaces should fail, got %+v", manifest)
+	}
+	// Stores that cannot export are only read one config at a time when
+	// allowed.
+	if _, err := Write(&buf, namespaceLister{plainStore{store}, store}, Options{}); !errors.Is(err, storage.ErrUnsupported) {
+		t.Fatalf("Write of a store that cannot export should fail unless allowed, got %v", err)
+	}
+	manifest, err = Write(&buf, namespaceLister{plainStore{store}, store}, Options{AllowInconsistent: true})
+	if err != nil || manifest.Consistent || len(manifest.Namespaces) != 2 || manifest.Namespaces[0].Configs[0].Metadata {
+		t.Fatalf("Write through a live view = %+v, %v", manifest, err)
+	}
+}
+
+func TestWriteFile(t *testing.T) {
+	dir := t.TempDir()
+	name := filepath.Join(dir, "backup.tar.gz")
+	manifest, err := WriteFile(name, newTestStore(t), Options{})
+	if err != nil {
+		t.Fatalf("WriteFile: %v", err)
+	}
+	f, err := os.Open(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	if got, err := Verify(f); err != nil || !got.Created.Equal(manifest.Created) {
+		t.Fatalf("Verify = %+v, %v", got, err)
+	}
+	if entries, _ := os.ReadDir(dir); len(entries) != 1 {
+		t.Fatalf("temporary files were left behind: %v", entries)
+	}
+}
+
+type namespaceLister struct {
+	plainStore
+	lister storage.NamespaceLister
+}
+
+func (n namespaceLister) Namespaces() ([]string, error) { return n.lister.Namespaces() }
+
+func TestReadRejectsDamagedArchives(t *testing.T) {
+	var buf bytes.Buffer
+	if _, err := Write(&buf, newTestStore(t), Options{}); err != nil {
+		t.Fatal(err)
+	}
+	entries := readEntries(t, buf.Bytes())
+
+	tests := []struct {
+		name   string
+		modify func(entries []entry) []entry
+	}{
+		{"changed content", func(e []entry) []entry {
+			e[len(e)-1].content = []byte("tampered")
+			return e
+		}},
+		{"missing file", func(e []entry) []entry { return e[:len(e)-1] }},
+		{"extra file", func(e []entry) []entry { return append(e, entry{"extra", []byte("x")}) }},
+		{"manifest not first", func(e []entry) []entry {
+			e[0], e[1] = e[1], e[0]
+			return e
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			modified := tt.modify(append([]entry(nil), entries...))
+			if _, err := Verify(bytes.NewReader(writeEntries(t, modified))); !errors.Is(err, ErrInvalidArchive) {
+				t.Fatalf("expected ErrInvalidArchive, got %v", err)
+			}
+		})
+	}
+	if _, err := Verify(bytes.NewReader([]byte("not an archive"))); !errors.Is(err, ErrInvalidArchive) {
+		t.Fatalf("expected ErrInvalidArchive, got %v", err)
+	}
+	if _, err := Verify(bytes.NewReader(writeEntries(t, entries))); err != nil {
+		t.Fatalf("Verify of the rewritten archive: %v", err)
+	}
+}
+
+type entry struct {
+	name    string
+	content []byte
+}
+
+func readEntries(t *testing.T, archive []byte) []entry {
+	t.Helper()
+	gz, err := gzip.NewReader(bytes.NewReader(archive))
+	if err != nil {
+		t.Fatal(err)
+	}
+	tr := tar.NewReader(gz)
+	var entries []entry
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return entries
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		content, _ := io.ReadAll(tr)
+		entries = append(entries, entry{hdr.Name, content})
+	}
+}
+
+func writeEntries(t *testing.T, entries []entry) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	gz := gzip.NewWriter(&buf)
+	tw := tar.NewWriter(gz)
+	for _, e := range entries {
+		tw.WriteHeader(&tar.Header{Name: e.name, Mode: 0o600, Size: int64(len(e.content))})
+		tw.Write(e.content)
+	}
+	tw.Close()
+	gz.Close()
+	return buf.Bytes()
+}
@@ -0,0 +1,152 @@
+package backup
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Schedule is a parsed cron expression.
+type Schedule struct {
+	expr   string
+	minute [60]bool
+	hour   [24]bool
+	dom    [32]bool
+	month  [13]bool
+	dow    [7]bool
+	// anyDOM and anyDOW record a day field starting with "*"; when both
+	// day fields are restricted, a day matching either one matches, as in
+	// cron.
+	anyDOM, anyDOW bool
+}
+
+// cronMacros are the shorthands ParseSchedule accepts.
+var cronMacros = map[string]string{
+	"@hourly":   "0 * * * *",
+	"@daily":    "0 0 * * *",
+	"@midnight": "0 0 * * *",
+	"@weekly":   "0 0 * * 0",
+	"@monthly":  "0 0 1 * *",
+}
+
+// ParseSchedule parses a cron expression of five fields: minute, hour, day
+// of month, month and day of week (0 or 7 is Sunday). Each field is "*", a
+// number, a range "a-b", or a list of these separated by commas, and may
+// end in a step "/n". The shorthands @hourly, @daily, @midnight, @weekly and
+// @monthly are accepted too.
+func ParseSchedule(expr string) (*Schedule, error) {
+	s := &Schedule{expr: expr}
+	spec := strings.TrimSpace(expr)
+	if macro, ok := cronMacros[spec]; ok {
+		spec = macro
+	}
+	fields := strings.Fields(spec)
+	if len(fields) != 5 {
+		return nil, fmt.Errorf("invalid cron expression %q: want 5 fields, got %d", expr, len(fields))
+	}
+
+	var dow [8]bool
+	for i, f := range []struct {
+		name        string
+		first, last int
+		set         []bool
+	}{
+		{"minute", 0, 59, s.minute[:]},
+		{"hour", 0, 23, s.hour[:]},
+		{"day of month", 1, 31, s.dom[:]},
+		{"month", 1, 12, s.month[:]},
+		{"day of week", 0, 7, dow[:]},
+	} {
+		if err := parseCronField(fields[i], f.first, f.last, f.set); err != nil {
+			return nil, fmt.Errorf("invalid cron expression %q: %s: %w", expr, f.name, err)
+		}
+	}
+	copy(s.dow[:], dow[:7])
+	s.dow[0] = s.dow[0] || dow[7]
+	s.anyDOM = strings.HasPrefix(fields[2], "*")
+	s.anyDOW = strings.HasPrefix(fields[4], "*")
+	// Five years from 2000 cover every day of the year, February 29 too.
+	if s.Next(time.Date(2000, 1, 1, 0, 0, 0, 0, time.UTC)).IsZero() {
+		return nil, fmt.Errorf("invalid cron expression %q: it never runs", expr)
+	}
+	return s, nil
+}
+
+// parseCronField sets the values field selects between first and last.
+func parseCronField(field string, first, last int, set []bool) error {
+	for _, part := range strings.Split(field, ",") {
+		rng, step := part, 1
+		if r, s, ok := strings.Cut(part, "/"); ok {
+			n, err := strconv.Atoi(s)
+			if err != nil || n < 1 {
+				return fmt.Errorf("invalid step %q", s)
+			}
+			rng, step = r, n
+		}
+		lo, hi := first, last
+		if rng != "*" {
+			a, b, isRange := strings.Cut(rng, "-")
+			var err error
+			if lo, err = strconv.Atoi(a); err != nil {
+				return fmt.Errorf("invalid value %q", a)
+			}
+			hi = lo
+			if isRange {
+				if hi, err = strconv.Atoi(b); err != nil {
+					return fmt.Errorf("invalid value %q", b)
+				}
+			} else if step > 1 {
+				// "a/n" runs from a to the end of the range.
+				hi = last
+			}
+			if lo < first || hi > last || lo > hi {
+				return fmt.Errorf("%q is outside %d-%d", rng, first, last)
+			}
+		}
+		for v := lo; v <= hi; v += step {
+			set[v] = true
+		}
+	}
+	return nil
+}
+
+// String returns the expression the schedule was parsed from.
+func (s *Schedule) String() string {
+	return s.expr
+}
+
+// Next returns the first time after t that the schedule selects, in t's
+// location, or the zero time if there is none within five years.
+func (s *Schedule) Next(t time.Time) time.Time {
+	t = t.Truncate(time.Minute).Add(time.Minute)
+	limit := t.AddDate(5, 0, 0)
+	for t.Before(limit) {
+		switch {
+		case !s.month[t.Month()]:
+			t = time.Date(t.Year(), t.Month()+1, 1, 0, 0, 0, 0, t.Location())
+		case !s.dayMatches(t):
+			t = time.Date(t.Year(), t.Month(), t.Day()+1, 0, 0, 0, 0, t.Location())
+		case !s.hour[t.Hour()]:
+			t = time.Date(t.Year(), t.Month(), t.Day(), t.Hour()+1, 0, 0, 0, t.Location())
+		case !s.minute[t.Minute()]:
+			t = t.Add(time.Minute)
+		default:
+			return t
+		}
+	}
+	return time.Time{}
+}
+
+func (s *Schedule) dayMatches(t time.Time) bool {
+	dom, dow := s.dom[t.Day()], s.dow[t.Weekday()]
+	switch {
+	case s.anyDOM && s.anyDOW:
+		return true
+	case s.anyDOM:
+		return dow
+	case s.anyDOW:
+		return dom
+	}
+	return dom || dow
+}
@@ -0,0 +1,246 @@
+package backup
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"slices"
+	"strconv"
+
+	"github.com/zvdy/yamlet/internal/storage"
+)
+
+// RestoreAuthor is recorded for the writes of a restore.
+var RestoreAuthor = storage.Author{Name: "yamlet restore", Email: "restore@yamlet.invalid"}
+
+// ErrUnknownNamespace is returned when a restore selects a namespace the
+// archive does not hold.
+var ErrUnknownNamespace = errors.New("namespace not in archive")
+
+// Mode says what a restore does with what the target already holds.
+type Mode string
+
+const (
+	// ModeSkip leaves existing configs, namespace records and tokens as
+	// they are.
+	ModeSkip Mode = "skip"
+	// ModeOverwrite replaces them with the archived ones.
+	ModeOverwrite Mode = "overwrite"
+)
+
+// ParseMode parses a restore mode; the empty string is ModeSkip.
+func ParseMode(s string) (Mode, error) {
+	switch Mode(s) {
+	case "", ModeSkip:
+		return ModeSkip, nil
+	case ModeOverwrite:
+		return ModeOverwrite, nil
+	}
+	return "", fmt.Errorf("invalid restore mode %q (want skip or overwrite)", s)
+}
+
+// RestoreOptions configure Restore.
+type RestoreOptions struct {
+	// Namespaces selects what to restore; all namespaces when empty.
+	Namespaces []string
+	Mode       Mode
+	// RestoreToken, if set, adds an archived token of a selected namespace
+	// back. It reports false for a token it left as it was because it
+	// exists and overwrite is false. Tokens are skipped when it is nil.
+	RestoreToken func(token Token, overwrite bool) (bool, error)
+	// RestorePolicy, if set, puts the archived policy of a selected
+	// namespace back in effect. It reports false for a policy it left as it
+	// was. Policies are skipped when it is nil.
+	RestorePolicy func(namespace string, policy storage.NamespacePolicy, overwrite bool) (bool, error)
+}
+
+// Result counts what a restore did.
+type Result struct {
+	Namespaces []string `json:"namespaces"`
+	// Configs counts the configs written and Skipped those left as they
+	// were.
+	Configs   int `json:"configs"`
+	Skipped   int `json:"skipped"`
+	Revisions int `json:"revisions"`
+	// Tokens counts the tokens added back and SkippedTokens those left as
+	// they were.
+	Tokens        int `json:"tokens"`
+	SkippedTokens int `json:"skipped_tokens"`
+	// Policies counts the namespace policies put back and SkippedPolicies
+	// those left as they were.
+	Policies        int `json:"policies"`
+	SkippedPolicies int `json:"skipped_policies"`
+}
+
+// Restore writes the selected namespaces of a into store. A config is
+// restored by storing its archived revisions oldest first and then its
+// content, so its history keeps its contents though not its revision
+// numbers, and its metadata record is set after. Configs the store holds
+// that are not archived are left alone. What the store cannot hold, such as
+// revisions or metadata records, is left out. Restore stops at the first
+// error, leaving what it restored so far in place.
+func Restore(a *Archive, store storage.Store, opts RestoreOptions) (Result, error) {
+	selected, err := a.selectNamespaces(opts.Namespaces)
+	if err != nil {
+		return Result{}, err
+	}
+	overwrite := opts.Mode == ModeOverwrite
+	result := Result{Namespaces: []string{}}
+
+	for _, ns := range selected {
+		if err := a.restoreNamespace(store, ns, overwrite, &result); err != nil {
+			return result, err
+		}
+		result.Namespaces = append(result.Namespaces, ns.Name)
+	}
+
+	if opts.RestorePolicy != nil {
+		for _, ns := range selected {
+			if ns.Policy == nil {
+				continue
+			}
+			restored, err := opts.RestorePolicy(ns.Name, *ns.Policy, overwrite)
+			if err != nil {
+				return result, fmt.Errorf("failed to restore the policy of namespace %s: %w", ns.Name, err)
+			}
+			if restored {
+				result.Policies++
+			} else {
+				result.SkippedPolicies++
+			}
+		}
+	}
+
+	if opts.RestoreToken == nil {
+		return result, nil
+	}
+	tokens, err := a.Tokens()
+	if err != nil {
+		return result, err
+	}
+	for _, token := range tokens {
+		if !slices.Contains(result.Namespaces, token.Namespace) {
+			continue
+		}
+		restored, err := opts.RestoreToken(token, overwrite)
+		if err != nil {
+			return result, fmt.Errorf("failed to restore a token of namespace %s: %w", token.Namespace, err)
+		}
+		if restored {
+			result.Tokens++
+		} else {
+			result.SkippedTokens++
+		}
+	}
+	return result, nil
+}
+
+// selectNamespaces returns the archived namespaces named, or all of them.
+func (a *Archive) selectNamespaces(names []string) ([]Namespace, error) {
+	if len(names) == 0 {
+		return a.Manifest.Namespaces, nil
+	}
+	var selected []Namespace
+	for _, name := range names {
+		i := slices.IndexFunc(a.Manifest.Namespaces, func(ns Namespace) bool { return ns.Name == name })
+		if i < 0 {
+			return nil, fmt.Errorf("%w: %s", ErrUnknownNamespace, name)
+		}
+		if !slices.ContainsFunc(selected, func(ns Namespace) bool { return ns.Name == name }) {
+			selected = append(selected, a.Manifest.Namespaces[i])
+		}
+	}
+	return selected, nil
+}
+
+func (a *Archive) restoreNamespace(store storage.Store, ns Namespace, overwrite bool, result *Result) error {
+	if namespaces, ok := store.(storage.NamespaceStore); ok && ns.Record {
+		var info storage.NamespaceInfo
+		if err := a.readJSON(namespacePath(ns.Name, "namespace.json"), &info); err != nil {
+			return err
+		}
+		if info.Name != ns.Name {
+			return fmt.Errorf("%w: record of namespace %s is named %q", ErrInvalidArchive, ns.Name, info.Name)
+		}
+		_, err := namespaces.NamespaceInfo(ns.Name)
+		switch {
+		case errors.Is(err, storage.ErrNotFound) || err == nil && overwrite:
+			if err := namespaces.SetNamespaceInfo(info); err != nil {
+				return fmt.Errorf("failed to restore namespace %s: %w", ns.Name, err)
+			}
+		case err != nil:
+			return fmt.Errorf("failed to read namespace %s: %w", ns.Name, err)
+		}
+	}
+
+	for _, cfg := range ns.Configs {
+		restored, err := a.restoreConfig(store, ns.Name, cfg, overwrite)
+		if err != nil {
+			return err
+		}
+		if !restored {
+			result.Skipped++
+			continue
+		}
+		result.Configs++
+		result.Revisions += len(cfg.Revisions)
+	}
+	return nil
+}
+
+// restoreConfig restores one config, reporting false if it was left as it
+// was.
+func (a *Archive) restoreConfig(store storage.Store, namespace string, cfg Config, overwrite bool) (bool, error) {
+	_, err := store.Get(namespace, cfg.Name)
+	switch {
+	case err == nil && !overwrite:
+		return false, nil
+	case err != nil && !errors.Is(err, storage.ErrNotFound):
+		return false, fmt.Errorf("failed to read config %s in namespace %s: %w", cfg.Name, namespace, err)
+	}
+
+	content, ok := a.files[namespacePath(namespace, "configs", cfg.Name)]
+	if !ok {
+		return false, fmt.Errorf("%w: config %s in namespace %s is missing", ErrInvalidArchive, cfg.Name, namespace)
+	}
+	var last []byte
+	for _, rev := range cfg.Revisions {
+		revision, ok := a.files[namespacePath(namespace, "revisions", cfg.Name, strconv.Itoa(rev.Number))]
+		if !ok {
+			return false, fmt.Errorf("%w: revision %d of config %s in namespace %s is missing", ErrInvalidArchive, rev.Number, cfg.Name, namespace)
+		}
+		if err := storeAs(store, namespace, cfg.Name, revision); err != nil {
+			return false, err
+		}
+		last = revision
+	}
+	if last == nil || !bytes.Equal(last, content) {
+		if err := storeAs(store, namespace, cfg.Name, content); err != nil {
+			return false, err
+		}
+	}
+
+	if metadata, ok := store.(storage.MetadataStore); ok && cfg.Metadata {
+		var md storage.Metadata
+		if err := a.readJSON(namespacePath(namespace, "metadata", cfg.Name+".json"), &md); err != nil {
+			return false, err
+		}
+		if err := metadata.SetMetadata(namespace, cfg.Name, md); err != nil {
+			return false, fmt.Errorf("failed to restore metadata of config %s in namespace %s: %w", cfg.Name, namespace, err)
+		}
+	}
+	return true, nil
+}
+
+func storeAs(store storage.Store, namespace, name string, content []byte) error {
+	var err error
+	if attributed, ok := store.(storage.Attributed); ok {
+		err = attributed.StoreAs(RestoreAuthor, namespace, name, content)
+	} else {
+		err = store.Store(namespace, name, content)
+	}
+	if err != nil {
+		return fmt.Errorf("failed to restore config %s in namespace %s: %w", name, namespace, err)
+	}
+	return nil
+}
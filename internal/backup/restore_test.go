@@ -0,0 +1,150 @@
+package backup
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+
+	"github.com/zvdy/yamlet/internal/storage"
+)
+
+func readTestArchive(t *testing.T) *Archive {
+	t.Helper()
+	var buf bytes.Buffer
+	if _, err := Write(&buf, newTestStore(t), Options{Tokens: testTokens, Policies: testPolicies}); err != nil {
+		t.Fatal(err)
+	}
+	a, err := Read(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return a
+}
+
+func TestRestoreAcrossBackends(t *testing.T) {
+	a := readTestArchive(t)
+	target := storage.NewFileStore(t.TempDir())
+
+	tokens := map[string]Token{}
+	result, err := Restore(a, target, RestoreOptions{
+		RestoreToken: func(token Token, overwrite bool) (bool, error) {
+			tokens[token.Token] = token
+			return true, nil
+		},
+	})
+	if err != nil {
+		t.Fatalf("Restore: %v", err)
+	}
+	if len(result.Namespaces) != 2 || result.Configs != 2 || result.Skipped != 0 || result.Revisions != 3 || result.Tokens != 2 {
+		t.Fatalf("unexpected result %+v", result)
+	}
+	if got, _ := target.Get("dev", "app.yaml"); string(got) != "v: 2" {
+		t.Fatalf("restored content = %q", got)
+	}
+	revs, err := target.Revisions("dev", "app.yaml")
+	if err != nil || len(revs) != 2 {
+		t.Fatalf("restored revisions = %+v, %v", revs, err)
+	}
+	if got, _ := target.GetRevision("dev", "app.yaml", revs[0].Number); string(got) != "v: 1" {
+		t.Fatalf("first restored revision = %q", got)
+	}
+	if md, err := target.Metadata("dev", "app.yaml"); err != nil || md.Labels["tier"] != "web" {
+		t.Fatalf("restored metadata = %+v, %v", md, err)
+	}
+	if info, err := target.NamespaceInfo("prod"); err != nil || info.Owner != "ops" {
+		t.Fatalf("restored namespace record = %+v, %v", info, err)
+	}
+	if tokens["prod-token"].Namespace != "prod" || len(tokens["prod-token"].Permissions) != 1 {
+		t.Fatalf("restored tokens = %+v", tokens)
+	}
+}
+
+func TestRestoreModes(t *testing.T) {
+	a := readTestArchive(t)
+	target := storage.NewMemoryStore()
+	target.Store("dev", "app.yaml", []byte("local"))
+	target.Store("dev", "local.yaml", []byte("keep"))
+
+	result, err := Restore(a, target, RestoreOptions{Namespaces: []string{"dev"}})
+	if err != nil || result.Configs != 0 || result.Skipped != 1 || len(result.Namespaces) != 1 {
+		t.Fatalf("Restore with skip = %+v, %v", result, err)
+	}
+	if got, _ := target.Get("dev", "app.yaml"); string(got) != "local" {
+		t.Fatalf("skip must leave existing configs, got %q", got)
+	}
+	if _, err := target.Get("prod", "db.yaml"); !errors.Is(err, storage.ErrNotFound) {
+		t.Fatalf("unselected namespaces must not be restored, got %v", err)
+	}
+
+	result, err = Restore(a, target, RestoreOptions{Namespaces: []string{"dev"}, Mode: ModeOverwrite})
+	if err != nil || result.Configs != 1 || result.Skipped != 0 {
+		t.Fatalf("Restore with overwrite = %+v, %v", result, err)
+	}
+	if got, _ := target.Get("dev", "app.yaml"); string(got) != "v: 2" {
+		t.Fatalf("overwritten content = %q", got)
+	}
+	if got, _ := target.Get("dev", "local.yaml"); string(got) != "keep" {
+		t.Fatalf("configs that are not archived must be left alone, got %q", got)
+	}
+
+	if _, err := Restore(a, target, RestoreOptions{Namespaces: []string{"staging"}}); !errors.Is(err, ErrUnknownNamespace) {
+		t.Fatalf("expected ErrUnknownNamespace, got %v", err)
+	}
+}
+
+func TestRestoreTokens(t *testing.T) {
+	a := readTestArchive(t)
+	var overwrites []bool
+	restore := func(token Token, overwrite bool) (bool, error) {
+		overwrites = append(overwrites, overwrite)
+		return overwrite, nil
+	}
+
+	result, err := Restore(a, storage.NewMemoryStore(), RestoreOptions{Namespaces: []string{"prod"}, RestoreToken: restore})
+	if err != nil || result.Tokens != 0 || result.SkippedTokens != 1 || len(overwrites) != 1 || overwrites[0] {
+		t.Fatalf("Restore = %+v, %v, overwrites %v", result, err, overwrites)
+	}
+	result, err = Restore(a, storage.NewMemoryStore(), RestoreOptions{Mode: ModeOverwrite, RestoreToken: restore})
+	if err != nil || result.Tokens != 2 {
+		t.Fatalf("Restore with overwrite = %+v, %v", result, err)
+	}
+}
+
+func TestRestorePolicies(t *testing.T) {
+	a := readTestArchive(t)
+	policies := map[string]storage.NamespacePolicy{}
+	restore := func(namespace string, policy storage.NamespacePolicy, overwrite bool) (bool, error) {
+		if _, ok := policies[namespace]; ok && !overwrite {
+			return false, nil
+		}
+		policies[namespace] = policy
+		return true, nil
+	}
+
+	result, err := Restore(a, storage.NewMemoryStore(), RestoreOptions{RestorePolicy: restore})
+	if err != nil || result.Policies != 1 || result.SkippedPolicies != 0 {
+		t.Fatalf("Restore = %+v, %v", result, err)
+	}
+	if prod := policies["prod"]; len(prod.SecretPaths) != 1 || prod.Quota == nil || prod.Quota.MaxConfigs != 5 {
+		t.Fatalf("restored policies = %+v", policies)
+	}
+	result, err = Restore(a, storage.NewMemoryStore(), RestoreOptions{RestorePolicy: restore})
+	if err != nil || result.Policies != 0 || result.SkippedPolicies != 1 {
+		t.Fatalf("Restore with skip = %+v, %v", result, err)
+	}
+	result, err = Restore(a, storage.NewMemoryStore(), RestoreOptions{Namespaces: []string{"dev"}, RestorePolicy: restore})
+	if err != nil || result.Policies != 0 || result.SkippedPolicies != 0 {
+		t.Fatalf("Restore of a namespace without a policy = %+v, %v", result, err)
+	}
+}
+
+func TestParseMode(t *testing.T) {
+	for in, want := range map[string]Mode{"": ModeSkip, "skip": ModeSkip, "overwrite": ModeOverwrite} {
+		if got, err := ParseMode(in); err != nil || got != want {
+			t.Errorf("ParseMode(%q) = %q, %v", in, got, err)
+		}
+	}
+	if _, err := ParseMode("merge"); err == nil {
+		t.Error("ParseMode should reject unknown modes")
+	}
+}
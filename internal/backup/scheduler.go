@@ -0,0 +1,305 @@
+package backup
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/zvdy/yamlet/internal/storage"
+)
+
+// SchedulerOptions configure a Scheduler.
+type SchedulerOptions struct {
+	// Schedule says when backups are taken, in the local time zone.
+	Schedule *Schedule
+	// Sink keeps the archives.
+	Sink Sink
+	// Source names the storage backend in the manifests.
+	Source string
+	// Tokens, when set, returns the tokens to archive at each backup.
+	Tokens func() []Token
+	// Policies, when set, returns the namespace policies to archive at
+	// each backup.
+	Policies func() map[string]storage.NamespacePolicy
+	// AllowInconsistent is passed on to Write.
+	AllowInconsistent bool
+	// KeepDaily and KeepWeekly keep the newest archive of each of the last
+	// KeepDaily days and KeepWeekly ISO weeks that have one; other archives
+	// are deleted after every successful backup. When both are zero every
+	// archive is kept.
+	KeepDaily, KeepWeekly int
+	// MaxAge is how old the last successful backup may get before Status
+	// reports the backups unhealthy. Zero means twice the longest gap
+	// between the next runs of the schedule.
+	MaxAge time.Duration
+	// OnBackup, when set, is called after every successful backup.
+	OnBackup func(name string, manifest Manifest)
+	// OnError, when set, is called when a backup, or the pruning of old
+	// archives after it, fails.
+	OnError func(err error)
+}
+
+// Status reports how scheduled backups are going.
+type Status struct {
+	Schedule string `json:"schedule"`
+	// Healthy is false, with Problem saying why and Kind which of the
+	// Problem kinds it is, when the last backup failed or the last
+	// successful one is older than the maximum age.
+	Healthy       bool      `json:"healthy"`
+	Problem       string    `json:"problem,omitempty"`
+	Kind          string    `json:"kind,omitempty"`
+	MaxAgeSeconds float64   `json:"max_age_seconds"`
+	NextRun       time.Time `json:"next_run,omitzero"`
+
+	LastSuccess         time.Time `json:"last_success,omitzero"`
+	LastArchive         string    `json:"last_archive,omitempty"`
+	LastSize            int64     `json:"last_size,omitempty"`
+	LastDurationSeconds float64   `json:"last_duration_seconds,omitempty"`
+	LastFailure         time.Time `json:"last_failure,omitzero"`
+	LastError           string    `json:"last_error,omitempty"`
+
+	Successes           int `json:"successes"`
+	Failures            int `json:"failures"`
+	ConsecutiveFailures int `json:"consecutive_failures"`
+}
+
+// Problem kinds say why backups are unhealthy without the details, which
+// may name sink paths and storage errors.
+const (
+	// ProblemFailing is reported when the last backup failed.
+	ProblemFailing = "failing"
+	// ProblemNoSuccess is reported when no backup has succeeded for longer
+	// than the maximum age since startup.
+	ProblemNoSuccess = "no_success"
+	// ProblemStale is reported when the last successful backup is older
+	// than the maximum age.
+	ProblemStale = "stale"
+)
+
+// Summary is a Status without its details, for callers who may only learn
+// whether backups are healthy.
+type Summary struct {
+	Healthy bool `json:"healthy"`
+	// Problem is the kind of problem, one of the Problem kinds.
+	Problem string `json:"problem,omitempty"`
+}
+
+// Summary returns st without its details.
+func (st Status) Summary() Summary {
+	return Summary{Healthy: st.Healthy, Problem: st.Kind}
+}
+
+// Scheduler takes backups of a store to a Sink on a schedule. Each archive
+// is read back from the sink and verified before the backup counts as a
+// success, and old archives are pruned after it.
+type Scheduler struct {
+	store   storage.Store
+	opts    SchedulerOptions
+	now     func() time.Time
+	started time.Time
+
+	// runMu keeps runs from overlapping.
+	runMu sync.Mutex
+
+	mu     sync.Mutex
+	status Status
+}
+
+// NewScheduler creates a scheduler of backups of store.
+func NewScheduler(store storage.Store, opts SchedulerOptions) *Scheduler {
+	s := &Scheduler{store: store, opts: opts, now: time.Now}
+	s.started = s.now()
+	if s.opts.MaxAge <= 0 {
+		s.opts.MaxAge = 2 * longestGap(opts.Schedule, s.started)
+	}
+	s.status.Schedule = opts.Schedule.String()
+	return s
+}
+
+// longestGap returns the longest time between the next runs of schedule.
+func longestGap(schedule *Schedule, from time.Time) time.Duration {
+	var longest time.Duration
+	prev := schedule.Next(from)
+	for range 8 {
+		next := schedule.Next(prev)
+		if next.IsZero() {
+			break
+		}
+		longest = max(longest, next.Sub(prev))
+		prev = next
+	}
+	return longest
+}
+
+// Run takes a backup now and returns the name of its archive.
+func (s *Scheduler) Run() (string, error) {
+	s.runMu.Lock()
+	defer s.runMu.Unlock()
+
+	start := s.now()
+	name, manifest, size, err := s.backup()
+
+	s.mu.Lock()
+	if err != nil {
+		s.status.LastFailure = s.now()
+		s.status.LastError = err.Error()
+		s.status.Failures++
+		s.status.ConsecutiveFailures++
+	} else {
+		s.status.LastSuccess = manifest.Created
+		s.status.LastArchive = name
+		s.status.LastSize = int64(size)
+		s.status.LastDurationSeconds = s.now().Sub(start).Seconds()
+		s.status.LastError = ""
+		s.status.Successes++
+		s.status.ConsecutiveFailures = 0
+	}
+	s.mu.Unlock()
+
+	if err != nil {
+		if s.opts.OnError != nil {
+			s.opts.OnError(err)
+		}
+		return "", err
+	}
+	if s.opts.OnBackup != nil {
+		s.opts.OnBackup(name, manifest)
+	}
+	if err := s.prune(); err != nil && s.opts.OnError != nil {
+		s.opts.OnError(fmt.Errorf("failed to prune old backups: %w", err))
+	}
+	return name, nil
+}
+
+// backup writes an archive to the sink and verifies what the sink holds.
+func (s *Scheduler) backup() (string, Manifest, int, error) {
+	opts := Options{Source: s.opts.Source, AllowInconsistent: s.opts.AllowInconsistent}
+	if s.opts.Tokens != nil {
+		opts.Tokens = s.opts.Tokens()
+	}
+	if s.opts.Policies != nil {
+		opts.Policies = s.opts.Policies()
+	}
+	var buf bytes.Buffer
+	manifest, err := Write(&buf, s.store, opts)
+	if err != nil {
+		return "", Manifest{}, 0, fmt.Errorf("failed to write backup: %w", err)
+	}
+	name := ArchiveName(manifest.Created)
+	if err := s.opts.Sink.Put(name, buf.Bytes()); err != nil {
+		return "", Manifest{}, 0, fmt.Errorf("failed to store backup %s: %w", name, err)
+	}
+
+	stored, err := s.opts.Sink.Get(name)
+	if err == nil {
+		var got Manifest
+		got, err = Verify(bytes.NewReader(stored))
+		if err == nil && !got.Created.Equal(manifest.Created) {
+			err = fmt.Errorf("%w: %s holds another backup", ErrInvalidArchive, name)
+		}
+	}
+	if err != nil {
+		// A damaged archive must not take the place of a good one.
+		s.opts.Sink.Delete(name)
+		return "", Manifest{}, 0, fmt.Errorf("backup %s failed verification: %w", name, err)
+	}
+	return name, manifest, buf.Len(), nil
+}
+
+// prune deletes the archives the retention policy does not keep. Names
+// that are not archive names are left alone.
+func (s *Scheduler) prune() error {
+	if s.opts.KeepDaily <= 0 && s.opts.KeepWeekly <= 0 {
+		return nil
+	}
+	names, err := s.opts.Sink.List()
+	if err != nil {
+		return err
+	}
+	type archive struct {
+		name  string
+		taken time.Time
+	}
+	var archives []archive
+	for _, name := range names {
+		if taken, ok := parseArchiveName(name); ok {
+			archives = append(archives, archive{name, taken})
+		}
+	}
+	slices.SortFunc(archives, func(a, b archive) int { return b.taken.Compare(a.taken) })
+
+	loc := s.now().Location()
+	days := make(map[string]bool)
+	weeks := make(map[string]bool)
+	var errs []error
+	for _, a := range archives {
+		taken := a.taken.In(loc)
+		day := taken.Format(time.DateOnly)
+		year, week := taken.ISOWeek()
+		weekKey := fmt.Sprintf("%d-W%02d", year, week)
+		keep := false
+		if !days[day] && len(days) < s.opts.KeepDaily {
+			days[day] = true
+			keep = true
+		}
+		if !weeks[weekKey] && len(weeks) < s.opts.KeepWeekly {
+			weeks[weekKey] = true
+			keep = true
+		}
+		if keep {
+			continue
+		}
+		if err := s.opts.Sink.Delete(a.name); err != nil && !errors.Is(err, storage.ErrNotFound) {
+			errs = append(errs, err)
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// Status reports how scheduled backups are going.
+func (s *Scheduler) Status() Status {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := s.now()
+	st := s.status
+	st.MaxAgeSeconds = s.opts.MaxAge.Seconds()
+	st.NextRun = s.opts.Schedule.Next(now)
+	switch {
+	case st.ConsecutiveFailures > 0:
+		st.Problem = fmt.Sprintf("the last %d backups failed: %s", st.ConsecutiveFailures, st.LastError)
+		st.Kind = ProblemFailing
+	case st.LastSuccess.IsZero() && now.Sub(s.started) > s.opts.MaxAge:
+		st.Problem = fmt.Sprintf("no backup has succeeded in the %s since startup", now.Sub(s.started).Round(time.Second))
+		st.Kind = ProblemNoSuccess
+	case !st.LastSuccess.IsZero() && now.Sub(st.LastSuccess) > s.opts.MaxAge:
+		st.Problem = fmt.Sprintf("the last successful backup is %s old", now.Sub(st.LastSuccess).Round(time.Second))
+		st.Kind = ProblemStale
+	}
+	st.Healthy = st.Problem == ""
+	return st
+}
+
+// Start takes backups on the schedule in the background until stop is
+// called.
+func (s *Scheduler) Start() (stop func()) {
+	done := make(chan struct{})
+	var once sync.Once
+	go func() {
+		for {
+			next := s.opts.Schedule.Next(s.now())
+			timer := time.NewTimer(next.Sub(s.now()))
+			select {
+			case <-done:
+				timer.Stop()
+				return
+			case <-timer.C:
+				s.Run()
+			}
+		}
+	}()
+	return func() { once.Do(func() { close(done) }) }
+}
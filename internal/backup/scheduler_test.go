@@ -0,0 +1,197 @@
+package backup
+
+import (
+	"bytes"
+	"errors"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/zvdy/yamlet/internal/storage"
+)
+
+func newTestScheduler(t *testing.T, sink Sink, opts SchedulerOptions) *Scheduler {
+	t.Helper()
+	schedule, err := ParseSchedule("0 3 * * *")
+	if err != nil {
+		t.Fatal(err)
+	}
+	opts.Schedule = schedule
+	opts.Sink = sink
+	return NewScheduler(newTestStore(t), opts)
+}
+
+func TestSchedulerRun(t *testing.T) {
+	sink := DirSink{Dir: t.TempDir()}
+	var backedUp []string
+	s := newTestScheduler(t, sink, SchedulerOptions{
+		Source:   "memory",
+		Tokens:   func() []Token { return testTokens },
+		OnBackup: func(name string, _ Manifest) { backedUp = append(backedUp, name) },
+	})
+	if status := s.Status(); !status.Healthy || status.MaxAgeSeconds < (48*time.Hour).Seconds() || status.NextRun.IsZero() {
+		t.Fatalf("status before the first run = %+v", status)
+	}
+
+	name, err := s.Run()
+	if err != nil {
+		t.Fatalf("Run: %v", err)
+	}
+	if len(backedUp) != 1 || backedUp[0] != name {
+		t.Fatalf("OnBackup saw %v, want %s", backedUp, name)
+	}
+	archive, err := sink.Get(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	manifest, err := Verify(bytes.NewReader(archive))
+	if err != nil || manifest.Tokens != 2 || manifest.Source != "memory" {
+		t.Fatalf("stored archive = %+v, %v", manifest, err)
+	}
+	status := s.Status()
+	if !status.Healthy || status.LastArchive != name || status.Successes != 1 || status.LastSize != int64(len(archive)) || !status.LastSuccess.Equal(manifest.Created) {
+		t.Fatalf("status after a run = %+v", status)
+	}
+
+	// Backups that stop make the status unhealthy.
+	s.now = func() time.Time { return manifest.Created.Add(s.opts.MaxAge + time.Hour) }
+	if status := s.Status(); status.Healthy || !strings.Contains(status.Problem, "old") || status.Summary() != (Summary{Problem: ProblemStale}) {
+		t.Fatalf("status of stale backups = %+v", status)
+	}
+}
+
+// damagingSink flips a byte of every archive it returns.
+type damagingSink struct {
+	Sink
+}
+
+func (d damagingSink) Get(name string) ([]byte, error) {
+	archive, err := d.Sink.Get(name)
+	if err != nil {
+		return nil, err
+	}
+	archive = slices.Clone(archive)
+	archive[len(archive)/2] ^= 0xff
+	return archive, nil
+}
+
+func TestSchedulerVerifiesArchives(t *testing.T) {
+	sink := StoreSink{Store: storage.NewMemoryStore(), Namespace: "backups"}
+	var errs []error
+	s := newTestScheduler(t, damagingSink{sink}, SchedulerOptions{OnError: func(err error) { errs = append(errs, err) }})
+
+	if _, err := s.Run(); err == nil || !strings.Contains(err.Error(), "verification") {
+		t.Fatalf("Run with a damaging sink should fail verification, got %v", err)
+	}
+	if len(errs) != 1 {
+		t.Fatalf("OnError saw %v", errs)
+	}
+	if names, _ := sink.List(); len(names) != 0 {
+		t.Fatalf("a damaged archive must not be kept, got %v", names)
+	}
+	status := s.Status()
+	if status.Healthy || status.Failures != 1 || status.ConsecutiveFailures != 1 || status.LastFailure.IsZero() || status.Kind != ProblemFailing {
+		t.Fatalf("status after a failure = %+v", status)
+	}
+
+	// A success clears the failure streak but not the count.
+	s.opts.Sink = sink
+	if _, err := s.Run(); err != nil {
+		t.Fatalf("Run: %v", err)
+	}
+	if status := s.Status(); !status.Healthy || status.Failures != 1 || status.ConsecutiveFailures != 0 || status.LastError != "" {
+		t.Fatalf("status after recovering = %+v", status)
+	}
+}
+
+func TestSchedulerRetention(t *testing.T) {
+	sink := StoreSink{Store: storage.NewMemoryStore(), Namespace: "backups"}
+	// Two archives a day for three weeks, ending today.
+	now := time.Now().In(time.Local)
+	today := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, time.Local)
+	var all []string
+	for day := range 21 {
+		for _, hour := range []int{3, 15} {
+			taken := today.AddDate(0, 0, -day).Add(time.Duration(hour) * time.Hour)
+			if taken.After(now) {
+				continue
+			}
+			name := ArchiveName(taken)
+			sink.Put(name, []byte("old"))
+			all = append(all, name)
+		}
+	}
+	sink.Put("notes.txt", []byte("not an archive"))
+
+	s := newTestScheduler(t, sink, SchedulerOptions{KeepDaily: 3, KeepWeekly: 2})
+	name, err := s.Run()
+	if err != nil {
+		t.Fatalf("Run: %v", err)
+	}
+	names, _ := sink.List()
+	if !slices.Contains(names, name) || !slices.Contains(names, "notes.txt") {
+		t.Fatalf("the new archive and other files must be kept, got %v", names)
+	}
+	days := map[string]bool{}
+	for _, n := range names {
+		if taken, ok := parseArchiveName(n); ok {
+			days[taken.In(time.Local).Format(time.DateOnly)] = true
+		}
+	}
+	// Three days, plus the newest archive of last week when today's week
+	// is already covered by the daily ones.
+	if len(names) > 1+3+2 || len(days) < 3 {
+		t.Fatalf("kept %v", names)
+	}
+	if slices.Contains(names, all[len(all)-1]) {
+		t.Fatalf("the oldest archive should have been pruned, got %v", names)
+	}
+
+	// Without a retention policy nothing is pruned.
+	sink.Put(all[len(all)-1], []byte("old"))
+	s = newTestScheduler(t, sink, SchedulerOptions{})
+	s.Run()
+	if names, _ := sink.List(); !slices.Contains(names, all[len(all)-1]) {
+		t.Fatalf("nothing should be pruned without retention, got %v", names)
+	}
+}
+
+func TestDirSink(t *testing.T) {
+	sink := DirSink{Dir: t.TempDir() + "/backups"}
+	if names, err := sink.List(); err != nil || len(names) != 0 {
+		t.Fatalf("List of a missing directory = %v, %v", names, err)
+	}
+	if err := sink.Put("a.tar.gz", []byte("a")); err != nil {
+		t.Fatalf("Put: %v", err)
+	}
+	if got, err := sink.Get("a.tar.gz"); err != nil || string(got) != "a" {
+		t.Fatalf("Get = %q, %v", got, err)
+	}
+	if names, _ := sink.List(); len(names) != 1 {
+		t.Fatalf("List = %v", names)
+	}
+	if err := sink.Delete("a.tar.gz"); err != nil {
+		t.Fatalf("Delete: %v", err)
+	}
+	if _, err := sink.Get("a.tar.gz"); !errors.Is(err, storage.ErrNotFound) {
+		t.Fatalf("expected ErrNotFound, got %v", err)
+	}
+	if err := sink.Put("../a.tar.gz", nil); !errors.Is(err, storage.ErrInvalidName) {
+		t.Fatalf("expected ErrInvalidName, got %v", err)
+	}
+}
+
+func TestArchiveName(t *testing.T) {
+	taken := time.Date(2026, 10, 19, 3, 0, 5, 0, time.UTC)
+	name := ArchiveName(taken)
+	if name != "yamlet-backup-20261019T030005Z.tar.gz" {
+		t.Fatalf("ArchiveName = %q", name)
+	}
+	if got, ok := parseArchiveName(name); !ok || !got.Equal(taken) {
+		t.Fatalf("parseArchiveName = %s, %v", got, ok)
+	}
+	if _, ok := parseArchiveName("yamlet-backup-latest.tar.gz"); ok {
+		t.Fatal("parseArchiveName should reject other names")
+	}
+}
@@ -0,0 +1,158 @@
+package backup
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/zvdy/yamlet/internal/storage"
+)
+
+// Sink keeps archives by name for the Scheduler.
+type Sink interface {
+	// Put stores an archive, replacing any of the same name.
+	Put(name string, archive []byte) error
+	// Get returns an archive, or an error wrapping storage.ErrNotFound.
+	Get(name string) ([]byte, error)
+	// List lists the names of the archives kept.
+	List() ([]string, error)
+	// Delete removes an archive.
+	Delete(name string) error
+}
+
+const (
+	archivePrefix     = "yamlet-backup-"
+	archiveSuffix     = ".tar.gz"
+	archiveTimeFormat = "20060102T150405Z"
+)
+
+// ArchiveName names an archive taken at t, so that names sort by time.
+func ArchiveName(t time.Time) string {
+	return archivePrefix + t.UTC().Format(archiveTimeFormat) + archiveSuffix
+}
+
+// parseArchiveName returns the time an archive named by ArchiveName was
+// taken at.
+func parseArchiveName(name string) (time.Time, bool) {
+	stamp, ok := strings.CutPrefix(name, archivePrefix)
+	if !ok {
+		return time.Time{}, false
+	}
+	if stamp, ok = strings.CutSuffix(stamp, archiveSuffix); !ok {
+		return time.Time{}, false
+	}
+	t, err := time.Parse(archiveTimeFormat, stamp)
+	return t, err == nil
+}
+
+// DirSink keeps archives as files in a local directory, which is created
+// as needed. Files are written to a temporary name and renamed into place
+// once they are on disk.
+type DirSink struct {
+	Dir string
+}
+
+// Put implements Sink.
+func (d DirSink) Put(name string, archive []byte) error {
+	if err := d.validate(name); err != nil {
+		return err
+	}
+	if err := os.MkdirAll(d.Dir, 0o700); err != nil {
+		return err
+	}
+	f, err := os.CreateTemp(d.Dir, "."+name+".tmp-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+	_, err = f.Write(archive)
+	if err == nil {
+		err = f.Sync()
+	}
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+	return os.Rename(f.Name(), filepath.Join(d.Dir, name))
+}
+
+// Get implements Sink.
+func (d DirSink) Get(name string) ([]byte, error) {
+	if err := d.validate(name); err != nil {
+		return nil, err
+	}
+	data, err := os.ReadFile(filepath.Join(d.Dir, name))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, fmt.Errorf("archive %s: %w", name, storage.ErrNotFound)
+	}
+	return data, err
+}
+
+// List implements Sink. Temporary files are left out.
+func (d DirSink) List() ([]string, error) {
+	entries, err := os.ReadDir(d.Dir)
+	if errors.Is(err, os.ErrNotExist) {
+		return []string{}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	names := []string{}
+	for _, e := range entries {
+		if e.Type().IsRegular() && !strings.HasPrefix(e.Name(), ".") {
+			names = append(names, e.Name())
+		}
+	}
+	return names, nil
+}
+
+// Delete implements Sink.
+func (d DirSink) Delete(name string) error {
+	if err := d.validate(name); err != nil {
+		return err
+	}
+	err := os.Remove(filepath.Join(d.Dir, name))
+	if errors.Is(err, os.ErrNotExist) {
+		return fmt.Errorf("archive %s: %w", name, storage.ErrNotFound)
+	}
+	return err
+}
+
+func (d DirSink) validate(name string) error {
+	if name == "" || name != filepath.Base(name) || strings.HasPrefix(name, ".") {
+		return fmt.Errorf("%w: archive name %q", storage.ErrInvalidName, name)
+	}
+	return nil
+}
+
+// StoreSink keeps archives as configs in one namespace of a store, such as
+// an S3Store on another bucket.
+type StoreSink struct {
+	Store     storage.Store
+	Namespace string
+}
+
+// Put implements Sink.
+func (s StoreSink) Put(name string, archive []byte) error {
+	return s.Store.Store(s.Namespace, name, archive)
+}
+
+// Get implements Sink.
+func (s StoreSink) Get(name string) ([]byte, error) {
+	return s.Store.Get(s.Namespace, name)
+}
+
+// List implements Sink.
+func (s StoreSink) List() ([]string, error) {
+	return s.Store.List(s.Namespace)
+}
+
+// Delete implements Sink.
+func (s StoreSink) Delete(name string) error {
+	return s.Store.Delete(s.Namespace, name)
+}
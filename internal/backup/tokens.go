@@ -0,0 +1,54 @@
+package backup
+
+import (
+	"errors"
+
+	"github.com/zvdy/yamlet/internal/auth"
+)
+
+// AuthTokens returns the namespace tokens a holds, for Options.Tokens. The
+// admin token is not among them.
+func AuthTokens(a auth.Auth, adminToken string) ([]Token, error) {
+	tokens, err := a.ListAllTokens(adminToken)
+	if err != nil {
+		return nil, err
+	}
+	return TokensFrom(tokens, a.Permissions), nil
+}
+
+// TokensFrom builds Tokens from a map of token to namespace and the
+// permissions each token holds.
+func TokensFrom(tokens map[string]string, permissions func(token string) []auth.Permission) []Token {
+	out := make([]Token, 0, len(tokens))
+	for token, namespace := range tokens {
+		t := Token{Token: token, Namespace: namespace}
+		for _, p := range permissions(token) {
+			t.Permissions = append(t.Permissions, string(p))
+		}
+		out = append(out, t)
+	}
+	return out
+}
+
+// AuthTokenRestorer returns a RestoreOptions.RestoreToken that adds tokens
+// back to a. Overwriting a token revokes it and creates it anew, with the
+// archived namespace and permissions.
+func AuthTokenRestorer(a auth.Auth, adminToken string) func(Token, bool) (bool, error) {
+	return func(t Token, overwrite bool) (bool, error) {
+		perms := make([]auth.Permission, len(t.Permissions))
+		for i, p := range t.Permissions {
+			perms[i] = auth.Permission(p)
+		}
+		err := a.CreateToken(adminToken, t.Token, t.Namespace, perms...)
+		if errors.Is(err, auth.ErrTokenExists) {
+			if !overwrite {
+				return false, nil
+			}
+			if err := a.RevokeToken(adminToken, t.Token); err != nil {
+				return false, err
+			}
+			err = a.CreateToken(adminToken, t.Token, t.Namespace, perms...)
+		}
+		return err == nil, err
+	}
+}
@@ -0,0 +1,44 @@
+package backup
+
+import (
+	"testing"
+
+	"github.com/zvdy/yamlet/internal/auth"
+)
+
+const testAdminToken = "test-admin"
+
+func TestAuthTokens(t *testing.T) {
+	t.Setenv("YAMLET_ADMIN_TOKEN", testAdminToken)
+	t.Setenv("YAMLET_TOKENS", "a:dev,b:prod:read-secrets")
+	source := auth.NewTokenAuth()
+
+	tokens, err := AuthTokens(source, testAdminToken)
+	if err != nil || len(tokens) != 2 {
+		t.Fatalf("AuthTokens = %+v, %v", tokens, err)
+	}
+	if _, err := AuthTokens(source, "wrong"); err == nil {
+		t.Fatal("AuthTokens should need the admin token")
+	}
+
+	t.Setenv("YAMLET_TOKENS", "b:staging")
+	target := auth.NewTokenAuth()
+	restore := AuthTokenRestorer(target, testAdminToken)
+	for _, token := range tokens {
+		if restored, err := restore(token, false); err != nil || restored != (token.Token == "a") {
+			t.Fatalf("restoring %+v = %v, %v", token, restored, err)
+		}
+	}
+	if ns, _ := target.GetNamespaceForToken("b"); ns != "staging" {
+		t.Fatalf("skipped token should keep its namespace, got %q", ns)
+	}
+
+	for _, token := range tokens {
+		if restored, err := restore(token, true); err != nil || !restored {
+			t.Fatalf("overwriting %+v = %v, %v", token, restored, err)
+		}
+	}
+	if ns, _ := target.GetNamespaceForToken("b"); ns != "prod" || !target.HasPermission("b", auth.PermReadSecrets) {
+		t.Fatalf("overwritten token = %q, %v", ns, target.Permissions("b"))
+	}
+}
@@ -0,0 +1,426 @@
+package fieldcrypt
+
+import (
+	"bytes"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+
+	"github.com/zvdy/yamlet/internal/yamlutil"
+)
+
+// MetadataKey is the top-level key under which a document's wrapped data
+// keys are stored. It is removed again when the document is decrypted.
+const MetadataKey = "x-yamlet-encryption"
+
+// Encrypted values look like ENC[AES256_GCM,data:<base64>,type:<tag>].
+const (
+	valuePrefix = "ENC[AES256_GCM,data:"
+	typeMarker  = ",type:"
+)
+
+// metadata is the content of a document's MetadataKey block.
+type metadata struct {
+	Version int          `yaml:"version"`
+	Keys    []WrappedKey `yaml:"keys"`
+}
+
+// IsEncrypted reports whether a scalar value is an encrypted field.
+func IsEncrypted(value string) bool {
+	return strings.HasPrefix(value, valuePrefix) && strings.HasSuffix(value, "]")
+}
+
+// HasMetadata reports whether a YAML stream may contain encrypted values.
+// It is a cheap check that lets callers skip parsing plain configs.
+func HasMetadata(data []byte) bool {
+	return bytes.Contains(data, []byte(MetadataKey))
+}
+
+// Encrypt seals every scalar at or below a key path matching one of the
+// patterns (see yamlutil.MatchPath) in each document of a YAML stream, and
+// returns the new stream and the number of values sealed. Values that are
+// already encrypted are left alone and the document's existing data key is
+// reused, so patching an encrypted config keeps its old values readable.
+// The scope and key path of each value are bound to its ciphertext, which
+// therefore cannot be moved to another config or path. Aliases are
+// expanded in documents that gain encrypted values.
+func Encrypt(data []byte, scope Scope, patterns []string, k *Keyring) ([]byte, int, error) {
+	docs, err := yamlutil.ParseDocuments(data)
+	if err != nil {
+		return nil, 0, err
+	}
+	total := 0
+	for i, doc := range docs {
+		if len(doc.Content) == 0 {
+			continue
+		}
+		n, err := encryptDocument(doc, scope, patterns, k)
+		if err != nil {
+			return nil, 0, fmt.Errorf("document %d: %w", i, err)
+		}
+		total += n
+	}
+	if total == 0 {
+		return data, 0, nil
+	}
+	out, err := yamlutil.EncodeDocuments(docs)
+	if err != nil {
+		return nil, 0, err
+	}
+	return out, total, nil
+}
+
+func encryptDocument(doc *yaml.Node, scope Scope, patterns []string, k *Keyring) (int, error) {
+	root := doc.Content[0]
+	meta, hasMeta, err := readMetadata(root)
+	if err != nil {
+		return 0, err
+	}
+
+	marked := make(map[*yaml.Node]bool)
+	if len(patterns) > 0 {
+		markFields(root, "", patterns, false, marked)
+	}
+	if len(marked) == 0 {
+		if !hasMeta && containsEncrypted(root) {
+			return 0, ErrMissingMeta
+		}
+		return 0, nil
+	}
+	if root.Kind != yaml.MappingNode {
+		return 0, ErrNotMapping
+	}
+
+	var dek []byte
+	if hasMeta {
+		if dek, err = k.unwrap(meta.Keys, scope); err != nil {
+			return 0, err
+		}
+	} else {
+		if dek, err = newDataKey(); err != nil {
+			return 0, err
+		}
+		wrapped, err := k.wrap(dek, scope)
+		if err != nil {
+			return 0, err
+		}
+		meta = metadata{Version: 1, Keys: wrapped}
+	}
+
+	origins := make(map[*yaml.Node]*yaml.Node)
+	root = cloneNode(root, origins)
+	count := 0
+	err = walkScalars(root, "", func(n *yaml.Node, keyPath string) error {
+		if !marked[origins[n]] || IsEncrypted(n.Value) {
+			return nil
+		}
+		tag := strings.TrimPrefix(n.ShortTag(), "!!")
+		sealed, err := seal(dek, []byte(n.Value), valueAAD(scope, keyPath, tag))
+		if err != nil {
+			return err
+		}
+		setEncrypted(n, sealed, tag)
+		count++
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+	if err := writeMetadata(root, meta); err != nil {
+		return 0, err
+	}
+	doc.Content[0] = root
+	return count, nil
+}
+
+// Decrypt opens every encrypted value in a YAML stream of the config scope
+// names and removes the key metadata. It reports whether anything was
+// decrypted; documents without metadata are returned as they are. Values
+// and data keys encrypted for another config fail with ErrDecrypt or
+// ErrUnwrap.
+func Decrypt(data []byte, scope Scope, k *Keyring) ([]byte, bool, error) {
+	if !HasMetadata(data) {
+		return data, false, nil
+	}
+	docs, err := yamlutil.ParseDocuments(data)
+	if err != nil {
+		return nil, false, err
+	}
+	changed := false
+	for i, doc := range docs {
+		if len(doc.Content) == 0 {
+			continue
+		}
+		root := doc.Content[0]
+		meta, ok, err := readMetadata(root)
+		if err != nil {
+			return nil, false, fmt.Errorf("document %d: %w", i, err)
+		}
+		if !ok {
+			continue
+		}
+		dek, err := k.unwrap(meta.Keys, scope)
+		if err != nil {
+			return nil, false, fmt.Errorf("document %d: %w", i, err)
+		}
+		idx := mappingIndex(root, MetadataKey)
+		root.Content = append(root.Content[:idx], root.Content[idx+2:]...)
+		err = walkScalars(root, "", func(n *yaml.Node, keyPath string) error {
+			if !IsEncrypted(n.Value) {
+				return nil
+			}
+			plaintext, tag, err := openValue(dek, n.Value, scope, keyPath)
+			if err != nil {
+				return err
+			}
+			n.Value = string(plaintext)
+			n.Tag = restoreTag(tag)
+			n.Style = 0
+			return nil
+		})
+		if err != nil {
+			return nil, false, fmt.Errorf("document %d: %w", i, err)
+		}
+		changed = true
+	}
+	if !changed {
+		return data, false, nil
+	}
+	out, err := yamlutil.EncodeDocuments(docs)
+	if err != nil {
+		return nil, false, err
+	}
+	return out, true, nil
+}
+
+// Rebind re-encrypts the encrypted values of a YAML stream of the config
+// from names for the config to names, under new data keys, as when a
+// config is restored under another name. Which values are encrypted stays
+// as it was.
+func Rebind(data []byte, from, to Scope, k *Keyring) ([]byte, error) {
+	if from == to || !HasMetadata(data) {
+		return data, nil
+	}
+	docs, err := yamlutil.ParseDocuments(data)
+	if err != nil {
+		return nil, err
+	}
+	for i, doc := range docs {
+		if len(doc.Content) == 0 {
+			continue
+		}
+		if err := rebindDocument(doc.Content[0], from, to, k); err != nil {
+			return nil, fmt.Errorf("document %d: %w", i, err)
+		}
+	}
+	return yamlutil.EncodeDocuments(docs)
+}
+
+func rebindDocument(root *yaml.Node, from, to Scope, k *Keyring) error {
+	meta, ok, err := readMetadata(root)
+	if err != nil || !ok {
+		return err
+	}
+	dek, err := k.unwrap(meta.Keys, from)
+	if err != nil {
+		return err
+	}
+	fresh, err := newDataKey()
+	if err != nil {
+		return err
+	}
+	wrapped, err := k.wrap(fresh, to)
+	if err != nil {
+		return err
+	}
+	err = walkScalars(root, "", func(n *yaml.Node, keyPath string) error {
+		if !IsEncrypted(n.Value) {
+			return nil
+		}
+		plaintext, tag, err := openValue(dek, n.Value, from, keyPath)
+		if err != nil {
+			return err
+		}
+		sealed, err := seal(fresh, plaintext, valueAAD(to, keyPath, tag))
+		if err != nil {
+			return err
+		}
+		setEncrypted(n, sealed, tag)
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	return writeMetadata(root, metadata{Version: meta.Version, Keys: wrapped})
+}
+
+// openValue opens an encrypted value found at keyPath in a document of
+// scope and returns its plaintext and type tag.
+func openValue(dek []byte, value string, scope Scope, keyPath string) ([]byte, string, error) {
+	body := strings.TrimSuffix(strings.TrimPrefix(value, valuePrefix), "]")
+	idx := strings.LastIndex(body, typeMarker)
+	if idx < 0 {
+		return nil, "", fmt.Errorf("%w: malformed value at %s", ErrDecrypt, keyPath)
+	}
+	sealed, tag := body[:idx], body[idx+len(typeMarker):]
+	plaintext, err := open(dek, sealed, valueAAD(scope, keyPath, tag))
+	if err != nil {
+		return nil, "", fmt.Errorf("%w: value at %s", ErrDecrypt, keyPath)
+	}
+	return plaintext, tag, nil
+}
+
+// setEncrypted replaces a scalar's value with a sealed one of type tag.
+func setEncrypted(n *yaml.Node, sealed, tag string) {
+	n.Value = valuePrefix + sealed + typeMarker + tag + "]"
+	n.Tag = "!!str"
+	n.Style = 0
+}
+
+func valueAAD(scope Scope, keyPath, tag string) []byte {
+	return []byte(scope.binding() + "|" + keyPath + "|" + tag)
+}
+
+func restoreTag(tag string) string {
+	if strings.HasPrefix(tag, "!") {
+		return tag
+	}
+	return "!!" + tag
+}
+
+func readMetadata(root *yaml.Node) (metadata, bool, error) {
+	var meta metadata
+	if root.Kind != yaml.MappingNode {
+		return meta, false, nil
+	}
+	idx := mappingIndex(root, MetadataKey)
+	if idx < 0 {
+		return meta, false, nil
+	}
+	if err := root.Content[idx+1].Decode(&meta); err != nil || len(meta.Keys) == 0 {
+		return meta, false, fmt.Errorf("%w: malformed %s block", ErrInvalidKey, MetadataKey)
+	}
+	return meta, true, nil
+}
+
+func writeMetadata(root *yaml.Node, meta metadata) error {
+	var value yaml.Node
+	if err := value.Encode(meta); err != nil {
+		return err
+	}
+	if idx := mappingIndex(root, MetadataKey); idx >= 0 {
+		root.Content[idx+1] = &value
+		return nil
+	}
+	key := &yaml.Node{Kind: yaml.ScalarNode, Tag: "!!str", Value: MetadataKey}
+	root.Content = append(root.Content, key, &value)
+	return nil
+}
+
+// markFields records the scalars, aliases resolved, at or below key paths
+// matching a pattern. The metadata block is skipped.
+func markFields(node *yaml.Node, keyPath string, patterns []string, matched bool, marked map[*yaml.Node]bool) {
+	for node != nil && node.Kind == yaml.AliasNode {
+		node = node.Alias
+	}
+	if !matched && keyPath != "" {
+		for _, p := range patterns {
+			if yamlutil.MatchPath(p, keyPath) {
+				matched = true
+				break
+			}
+		}
+	}
+	switch node.Kind {
+	case yaml.ScalarNode:
+		if matched && !IsEncrypted(node.Value) && node.ShortTag() != "!!null" {
+			marked[node] = true
+		}
+	case yaml.MappingNode:
+		for i := 0; i+1 < len(node.Content); i += 2 {
+			key := node.Content[i].Value
+			if keyPath == "" && key == MetadataKey {
+				continue
+			}
+			markFields(node.Content[i+1], joinPath(keyPath, key), patterns, matched, marked)
+		}
+	case yaml.SequenceNode:
+		for i, child := range node.Content {
+			markFields(child, joinPath(keyPath, strconv.Itoa(i)), patterns, matched, marked)
+		}
+	}
+}
+
+func containsEncrypted(node *yaml.Node) bool {
+	found := false
+	_ = walkScalars(node, "", func(n *yaml.Node, _ string) error {
+		if IsEncrypted(n.Value) {
+			found = true
+		}
+		return nil
+	})
+	return found
+}
+
+// walkScalars calls fn for every value scalar below node with its key path,
+// without following aliases. The metadata block is skipped.
+func walkScalars(node *yaml.Node, keyPath string, fn func(*yaml.Node, string) error) error {
+	switch node.Kind {
+	case yaml.ScalarNode:
+		return fn(node, keyPath)
+	case yaml.MappingNode:
+		for i := 0; i+1 < len(node.Content); i += 2 {
+			key := node.Content[i].Value
+			if keyPath == "" && key == MetadataKey {
+				continue
+			}
+			if err := walkScalars(node.Content[i+1], joinPath(keyPath, key), fn); err != nil {
+				return err
+			}
+		}
+	case yaml.SequenceNode:
+		for i, child := range node.Content {
+			if err := walkScalars(child, joinPath(keyPath, strconv.Itoa(i)), fn); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// cloneNode deep-copies a node tree with aliases expanded, recording the
+// original of every copy in origins.
+func cloneNode(n *yaml.Node, origins map[*yaml.Node]*yaml.Node) *yaml.Node {
+	for n.Kind == yaml.AliasNode {
+		n = n.Alias
+	}
+	c := *n
+	c.Anchor = ""
+	if n.Content != nil {
+		c.Content = make([]*yaml.Node, len(n.Content))
+		for i, child := range n.Content {
+			c.Content[i] = cloneNode(child, origins)
+		}
+	}
+	origins[&c] = n
+	return &c
+}
+
+// mappingIndex returns the index of key within a mapping's Content, or -1.
+func mappingIndex(mapping *yaml.Node, key string) int {
+	for i := 0; i+1 < len(mapping.Content); i += 2 {
+		if mapping.Content[i].Value == key {
+			return i
+		}
+	}
+	return -1
+}
+
+func joinPath(keyPath, segment string) string {
+	if keyPath == "" {
+		return segment
+	}
+	return keyPath + "." + segment
+}
@@ -0,0 +1,164 @@
+package fieldcrypt
+
+import (
+	"errors"
+	"strings"
+	"testing"
+
+	"gopkg.in/yaml.v3"
+)
+
+// testScope is the config the tests encrypt values for.
+var testScope = Scope{Namespace: "dev", Name: "app.yaml"}
+
+func testKeyring(t *testing.T) *Keyring {
+	t.Helper()
+	k := NewKeyring()
+	if err := k.AddKey("primary", testKey('k')); err != nil {
+		t.Fatal(err)
+	}
+	return k
+}
+
+func TestEncryptDecrypt(t *testing.T) {
+	k := testKeyring(t)
+	in := `app: svc
+db:
+  host: localhost
+  password: hunter2
+  port: 5432
+tokens:
+  - abc
+  - "123"
+`
+	out, n, err := Encrypt([]byte(in), testScope, []string{"db.password", "db.port", "tokens"}, k)
+	if err != nil {
+		t.Fatalf("Encrypt: %v", err)
+	}
+	if n != 4 {
+		t.Fatalf("expected 4 encrypted values, got %d", n)
+	}
+	for _, plain := range []string{"hunter2", "5432", "abc", "123"} {
+		if strings.Contains(string(out), plain) {
+			t.Fatalf("plaintext %q left in output:\n%s", plain, out)
+		}
+	}
+	if !strings.Contains(string(out), "host: localhost") || !strings.Contains(string(out), MetadataKey) {
+		t.Fatalf("unexpected output:\n%s", out)
+	}
+
+	plain, ok, err := Decrypt(out, testScope, k)
+	if err != nil || !ok {
+		t.Fatalf("Decrypt: %v %v", ok, err)
+	}
+	var got, want interface{}
+	if err := yaml.Unmarshal(plain, &got); err != nil {
+		t.Fatal(err)
+	}
+	_ = yaml.Unmarshal([]byte(in), &want)
+	if !equalYAML(got, want) {
+		t.Fatalf("round trip mismatch:\n%s", plain)
+	}
+
+	// Re-encrypting keeps the data key and leaves sealed values alone.
+	again, n, err := Encrypt(out, testScope, []string{"db.password", "db.port", "tokens"}, k)
+	if err != nil || n != 0 || string(again) != string(out) {
+		t.Fatalf("re-encrypt should be a no-op, got %d values, err %v", n, err)
+	}
+}
+
+func TestEncrypt_AliasesAndExistingKey(t *testing.T) {
+	k := testKeyring(t)
+	in := "secret: &s hunter2\ncopy: *s\n"
+	out, n, err := Encrypt([]byte(in), testScope, []string{"secret"}, k)
+	if err != nil || n != 2 || strings.Contains(string(out), "hunter2") {
+		t.Fatalf("aliased copies must be encrypted too: n=%d err=%v\n%s", n, err, out)
+	}
+
+	// A value added later is sealed with the document's existing data key.
+	added := string(out) + "other: plain\n"
+	out, n, err = Encrypt([]byte(added), testScope, []string{"secret", "other"}, k)
+	if err != nil || n != 1 {
+		t.Fatalf("Encrypt with existing metadata: n=%d err=%v", n, err)
+	}
+	plain, _, err := Decrypt(out, testScope, k)
+	if err != nil || !strings.Contains(string(plain), "other: plain") || !strings.Contains(string(plain), "copy: hunter2") {
+		t.Fatalf("Decrypt: %v\n%s", err, plain)
+	}
+}
+
+func TestDecrypt_Tampering(t *testing.T) {
+	k := testKeyring(t)
+	out, _, err := Encrypt([]byte("a: one\nb: two\n"), testScope, []string{"a", "b"}, k)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Swapping two ciphertexts fails because values are bound to their path.
+	var doc map[string]interface{}
+	if err := yaml.Unmarshal(out, &doc); err != nil {
+		t.Fatal(err)
+	}
+	swapped := strings.NewReplacer(doc["a"].(string), doc["b"].(string), doc["b"].(string), doc["a"].(string)).Replace(string(out))
+	if _, _, err := Decrypt([]byte(swapped), testScope, k); !errors.Is(err, ErrDecrypt) {
+		t.Fatalf("expected ErrDecrypt for swapped values, got %v", err)
+	}
+
+	if _, _, err := Decrypt(out, testScope, NewKeyring()); !errors.Is(err, ErrUnwrap) {
+		t.Fatalf("expected ErrUnwrap without keys, got %v", err)
+	}
+}
+
+func TestDecrypt_OtherScope(t *testing.T) {
+	k := testKeyring(t)
+	out, _, err := Encrypt([]byte("password: hunter2\n"), testScope, []string{"password"}, k)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// A document copied to another config, in the same namespace or
+	// another, cannot be decrypted or have values added with its data key.
+	for _, other := range []Scope{{Namespace: "prod", Name: "app.yaml"}, {Namespace: "dev", Name: "other.yaml"}} {
+		if _, _, err := Decrypt(out, other, k); !errors.Is(err, ErrUnwrap) {
+			t.Fatalf("Decrypt as %+v: expected ErrUnwrap, got %v", other, err)
+		}
+		if _, _, err := Encrypt(append(out, "other: x\n"...), other, []string{"other"}, k); !errors.Is(err, ErrUnwrap) {
+			t.Fatalf("Encrypt as %+v: expected ErrUnwrap, got %v", other, err)
+		}
+	}
+
+	// Rebinding makes it the other config's, and only that one's.
+	other := Scope{Namespace: "dev", Name: "copy.yaml"}
+	moved, err := Rebind(out, testScope, other, k)
+	if err != nil {
+		t.Fatalf("Rebind: %v", err)
+	}
+	if strings.Contains(string(moved), "hunter2") {
+		t.Fatalf("Rebind left plaintext:\n%s", moved)
+	}
+	if plain, _, err := Decrypt(moved, other, k); err != nil || string(plain) != "password: hunter2\n" {
+		t.Fatalf("Decrypt after Rebind = %q, %v", plain, err)
+	}
+	if _, _, err := Decrypt(moved, testScope, k); !errors.Is(err, ErrUnwrap) {
+		t.Fatalf("expected ErrUnwrap for the old scope after Rebind, got %v", err)
+	}
+}
+
+func TestEncrypt_Errors(t *testing.T) {
+	k := testKeyring(t)
+	if _, _, err := Encrypt([]byte("a: ENC[AES256_GCM,data:AAAA,type:str]\n"), testScope, nil, k); !errors.Is(err, ErrMissingMeta) {
+		t.Fatalf("expected ErrMissingMeta, got %v", err)
+	}
+	if _, _, err := Encrypt([]byte("a: b\n"), testScope, []string{"a"}, NewKeyring()); !errors.Is(err, ErrNoKeys) {
+		t.Fatalf("expected ErrNoKeys, got %v", err)
+	}
+	if out, n, err := Encrypt([]byte("a: b\n"), testScope, []string{"missing"}, NewKeyring()); err != nil || n != 0 || string(out) != "a: b\n" {
+		t.Fatalf("no match should return data unchanged, got %d %v", n, err)
+	}
+}
+
+func equalYAML(a, b interface{}) bool {
+	x, _ := yaml.Marshal(a)
+	y, _ := yaml.Marshal(b)
+	return string(x) == string(y)
+}
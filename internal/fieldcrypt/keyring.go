@@ -0,0 +1,278 @@
+// Package fieldcrypt encrypts individual scalar values inside stored YAML,
+// in the style of SOPS. Each document gets a random data key; values are
+// sealed with it using AES-256-GCM, and the data key itself is wrapped by
+// every key-encryption key in a Keyring (a local keyfile and/or age
+// recipients) and stored alongside the document.
+package fieldcrypt
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"filippo.io/age"
+)
+
+// Sentinel errors for callers to classify via errors.Is.
+var (
+	ErrNoKeys      = errors.New("no encryption keys configured")
+	ErrInvalidKey  = errors.New("invalid key material")
+	ErrUnwrap      = errors.New("no configured key can unwrap the data key")
+	ErrDecrypt     = errors.New("decryption failed")
+	ErrMissingMeta = errors.New("encrypted value without key metadata")
+	ErrNotMapping  = errors.New("only mapping documents can hold encrypted values")
+)
+
+// Key-wrapping schemes recorded in document metadata.
+const (
+	WrapKeyfile = "keyfile"
+	WrapAge     = "age"
+)
+
+// keySize is the size of data keys and keyfile keys (AES-256).
+const keySize = 32
+
+// Scope is the config a document belongs to. Its encrypted values and
+// wrapped data keys are bound to it, so that they cannot be decrypted as
+// part of another config, in the same namespace or another.
+type Scope struct {
+	Namespace string
+	Name      string
+}
+
+// binding is what values and data keys of the scope are bound to. Names
+// cannot hold NUL bytes, so no two scopes share a binding.
+func (s Scope) binding() string {
+	return s.Namespace + "\x00" + s.Name
+}
+
+// WrappedKey is a data key encrypted by one key-encryption key.
+type WrappedKey struct {
+	Type  string `yaml:"type"`
+	KeyID string `yaml:"key_id,omitempty"`
+	Data  string `yaml:"data"`
+}
+
+// Keyring holds the key-encryption keys that wrap and unwrap data keys.
+// New data keys are wrapped by the active keyfile key and by every age
+// recipient; unwrapping tries every keyfile key and age identity, so old
+// keys can stay in the keyfile after a new one is added.
+type Keyring struct {
+	keys       map[string][]byte // keyfile key id -> key
+	active     string
+	recipients []age.Recipient
+	identities []age.Identity
+}
+
+// NewKeyring creates an empty keyring.
+func NewKeyring() *Keyring {
+	return &Keyring{keys: make(map[string][]byte)}
+}
+
+// LoadKeyfile adds the keys of a keyfile. Each non-empty, non-comment line
+// holds a key id and a base64-encoded 32-byte key separated by whitespace;
+// the last key in the file becomes the active one.
+func (k *Keyring) LoadKeyfile(path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return fmt.Errorf("open keyfile: %w", err)
+	}
+	defer f.Close()
+	return k.readKeyfile(f)
+}
+
+func (k *Keyring) readKeyfile(r io.Reader) error {
+	scanner := bufio.NewScanner(r)
+	line := 0
+	for scanner.Scan() {
+		line++
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+		fields := strings.Fields(text)
+		if len(fields) != 2 {
+			return fmt.Errorf("%w: keyfile line %d: want \"<id> <base64 key>\"", ErrInvalidKey, line)
+		}
+		if err := k.AddKey(fields[0], fields[1]); err != nil {
+			return fmt.Errorf("keyfile line %d: %w", line, err)
+		}
+	}
+	return scanner.Err()
+}
+
+// AddKey adds a base64-encoded 32-byte keyfile key and makes it active.
+func (k *Keyring) AddKey(id, encoded string) error {
+	if id == "" || strings.ContainsAny(id, " \t,") {
+		return fmt.Errorf("%w: key id %q", ErrInvalidKey, id)
+	}
+	key, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil || len(key) != keySize {
+		return fmt.Errorf("%w: key %s must be %d base64-encoded bytes", ErrInvalidKey, id, keySize)
+	}
+	k.keys[id] = key
+	k.active = id
+	return nil
+}
+
+// AddAgeRecipients parses age recipients ("age1...") that new data keys are
+// wrapped for.
+func (k *Keyring) AddAgeRecipients(recipients ...string) error {
+	for _, s := range recipients {
+		r, err := age.ParseX25519Recipient(strings.TrimSpace(s))
+		if err != nil {
+			return fmt.Errorf("%w: age recipient: %v", ErrInvalidKey, err)
+		}
+		k.recipients = append(k.recipients, r)
+	}
+	return nil
+}
+
+// LoadAgeIdentities adds the age identities in an identity file, which are
+// needed to unwrap data keys wrapped for age recipients.
+func (k *Keyring) LoadAgeIdentities(path string) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return fmt.Errorf("open age identity file: %w", err)
+	}
+	ids, err := age.ParseIdentities(bytes.NewReader(data))
+	if err != nil {
+		return fmt.Errorf("%w: age identities: %v", ErrInvalidKey, err)
+	}
+	k.identities = append(k.identities, ids...)
+	return nil
+}
+
+// CanWrap reports whether the keyring can protect new data keys.
+func (k *Keyring) CanWrap() bool {
+	return k != nil && (k.active != "" || len(k.recipients) > 0)
+}
+
+// wrap encrypts a data key for every configured key-encryption key, bound
+// to a scope. Keyfile keys bind it as associated data; age has none, so the
+// scope is sealed with the data key instead.
+func (k *Keyring) wrap(dek []byte, scope Scope) ([]WrappedKey, error) {
+	if !k.CanWrap() {
+		return nil, ErrNoKeys
+	}
+	var wrapped []WrappedKey
+	if k.active != "" {
+		sealed, err := seal(k.keys[k.active], dek, wrapAAD(k.active, scope))
+		if err != nil {
+			return nil, err
+		}
+		wrapped = append(wrapped, WrappedKey{Type: WrapKeyfile, KeyID: k.active, Data: sealed})
+	}
+	if len(k.recipients) > 0 {
+		var buf bytes.Buffer
+		w, err := age.Encrypt(&buf, k.recipients...)
+		if err != nil {
+			return nil, fmt.Errorf("age wrap: %w", err)
+		}
+		if _, err := w.Write(append(append([]byte(nil), dek...), scope.binding()...)); err != nil {
+			return nil, fmt.Errorf("age wrap: %w", err)
+		}
+		if err := w.Close(); err != nil {
+			return nil, fmt.Errorf("age wrap: %w", err)
+		}
+		wrapped = append(wrapped, WrappedKey{Type: WrapAge, Data: base64.StdEncoding.EncodeToString(buf.Bytes())})
+	}
+	return wrapped, nil
+}
+
+// unwrap recovers a data key from any wrapped copy the keyring can open
+// that was wrapped for scope.
+func (k *Keyring) unwrap(wrapped []WrappedKey, scope Scope) ([]byte, error) {
+	if k == nil {
+		return nil, ErrNoKeys
+	}
+	for _, w := range wrapped {
+		switch w.Type {
+		case WrapKeyfile:
+			key, ok := k.keys[w.KeyID]
+			if !ok {
+				continue
+			}
+			if dek, err := open(key, w.Data, wrapAAD(w.KeyID, scope)); err == nil && len(dek) == keySize {
+				return dek, nil
+			}
+		case WrapAge:
+			if len(k.identities) == 0 {
+				continue
+			}
+			data, err := base64.StdEncoding.DecodeString(w.Data)
+			if err != nil {
+				continue
+			}
+			r, err := age.Decrypt(bytes.NewReader(data), k.identities...)
+			if err != nil {
+				continue
+			}
+			payload, err := io.ReadAll(r)
+			if err == nil && len(payload) > keySize && string(payload[keySize:]) == scope.binding() {
+				return payload[:keySize], nil
+			}
+		}
+	}
+	return nil, ErrUnwrap
+}
+
+// wrapAAD binds a data key wrapped by a keyfile key to the key and scope.
+func wrapAAD(keyID string, scope Scope) []byte {
+	return []byte(WrapKeyfile + ":" + keyID + "|" + scope.binding())
+}
+
+// seal encrypts plaintext with AES-256-GCM and returns base64(nonce||ciphertext).
+func seal(key, plaintext, aad []byte) (string, error) {
+	gcm, err := newGCM(key)
+	if err != nil {
+		return "", err
+	}
+	nonce := make([]byte, gcm.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return "", fmt.Errorf("generate nonce: %w", err)
+	}
+	return base64.StdEncoding.EncodeToString(gcm.Seal(nonce, nonce, plaintext, aad)), nil
+}
+
+// open reverses seal.
+func open(key []byte, sealed string, aad []byte) ([]byte, error) {
+	gcm, err := newGCM(key)
+	if err != nil {
+		return nil, err
+	}
+	data, err := base64.StdEncoding.DecodeString(sealed)
+	if err != nil || len(data) < gcm.NonceSize() {
+		return nil, ErrDecrypt
+	}
+	plaintext, err := gcm.Open(nil, data[:gcm.NonceSize()], data[gcm.NonceSize():], aad)
+	if err != nil {
+		return nil, ErrDecrypt
+	}
+	return plaintext, nil
+}
+
+func newGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidKey, err)
+	}
+	return cipher.NewGCM(block)
+}
+
+// newDataKey returns a random data key.
+func newDataKey() ([]byte, error) {
+	dek := make([]byte, keySize)
+	if _, err := rand.Read(dek); err != nil {
+		return nil, fmt.Errorf("generate data key: %w", err)
+	}
+	return dek, nil
+}
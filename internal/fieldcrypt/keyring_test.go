@@ -0,0 +1,114 @@
+package fieldcrypt
+
+import (
+	"encoding/base64"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"filippo.io/age"
+)
+
+// testKey returns a base64-encoded keyfile key filled with b.
+func testKey(b byte) string {
+	return base64.StdEncoding.EncodeToString([]byte(strings.Repeat(string(rune(b)), keySize)))
+}
+
+func TestReadKeyfile(t *testing.T) {
+	k := NewKeyring()
+	keyfile := "# rotated 2026-10\nold " + testKey('a') + "\n\nnew " + testKey('b') + "\n"
+	if err := k.readKeyfile(strings.NewReader(keyfile)); err != nil {
+		t.Fatalf("readKeyfile: %v", err)
+	}
+	if k.active != "new" || len(k.keys) != 2 {
+		t.Fatalf("expected two keys with the last active, got %d keys, active %q", len(k.keys), k.active)
+	}
+
+	for _, bad := range []string{"lonely", "id not-base64!", "id " + base64.StdEncoding.EncodeToString([]byte("short"))} {
+		if err := NewKeyring().readKeyfile(strings.NewReader(bad)); !errors.Is(err, ErrInvalidKey) {
+			t.Errorf("readKeyfile(%q) = %v, want ErrInvalidKey", bad, err)
+		}
+	}
+}
+
+func TestWrapUnwrap(t *testing.T) {
+	dek, err := newDataKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := NewKeyring().wrap(dek, testScope); !errors.Is(err, ErrNoKeys) {
+		t.Fatalf("empty keyring should not wrap, got %v", err)
+	}
+
+	k := NewKeyring()
+	if err := k.AddKey("k1", testKey('a')); err != nil {
+		t.Fatal(err)
+	}
+	wrapped, err := k.wrap(dek, testScope)
+	if err != nil {
+		t.Fatalf("wrap: %v", err)
+	}
+
+	// Adding a newer key keeps data keys wrapped by the old one readable.
+	if err := k.AddKey("k2", testKey('b')); err != nil {
+		t.Fatal(err)
+	}
+	got, err := k.unwrap(wrapped, testScope)
+	if err != nil || string(got) != string(dek) {
+		t.Fatalf("unwrap after adding a key: %v", err)
+	}
+
+	other := NewKeyring()
+	if err := other.AddKey("k1", testKey('c')); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := other.unwrap(wrapped, testScope); !errors.Is(err, ErrUnwrap) {
+		t.Fatalf("a different key with the same id must not unwrap, got %v", err)
+	}
+}
+
+func TestAgeWrapping(t *testing.T) {
+	id, err := age.GenerateX25519Identity()
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(t.TempDir(), "identity.txt")
+	if err := os.WriteFile(path, []byte(id.String()+"\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	writer := NewKeyring()
+	if err := writer.AddAgeRecipients(id.Recipient().String()); err != nil {
+		t.Fatalf("AddAgeRecipients: %v", err)
+	}
+	dek, _ := newDataKey()
+	wrapped, err := writer.wrap(dek, testScope)
+	if err != nil {
+		t.Fatalf("wrap: %v", err)
+	}
+	if len(wrapped) != 1 || wrapped[0].Type != WrapAge {
+		t.Fatalf("expected one age-wrapped key, got %+v", wrapped)
+	}
+	if _, err := writer.unwrap(wrapped, testScope); !errors.Is(err, ErrUnwrap) {
+		t.Fatalf("recipients alone cannot unwrap, got %v", err)
+	}
+
+	reader := NewKeyring()
+	if err := reader.LoadAgeIdentities(path); err != nil {
+		t.Fatalf("LoadAgeIdentities: %v", err)
+	}
+	got, err := reader.unwrap(wrapped, testScope)
+	if err != nil || string(got) != string(dek) {
+		t.Fatalf("unwrap with identity: %v", err)
+	}
+	if _, err := reader.unwrap(wrapped, Scope{Namespace: "prod", Name: "app.yaml"}); !errors.Is(err, ErrUnwrap) {
+		t.Fatalf("a key wrapped for another config must not unwrap, got %v", err)
+	}
+
+	if err := writer.AddAgeRecipients("age1bogus"); !errors.Is(err, ErrInvalidKey) {
+		t.Fatalf("expected ErrInvalidKey for a bad recipient, got %v", err)
+	}
+}
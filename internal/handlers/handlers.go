@@ -1,16 +1,35 @@
 package handlers
 
 import (
+	"archive/tar"
+	"bytes"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
 	"log"
+	"maps"
+	"mime"
+	"mime/multipart"
 	"net/http"
+	"net/textproto"
+	"net/url"
+	"os"
+	"path"
+	"slices"
+	"strconv"
 	"strings"
+	"time"
 
 	"github.com/zvdy/yamlet/internal/auth"
+	"github.com/zvdy/yamlet/internal/backup"
+	"github.com/zvdy/yamlet/internal/fieldcrypt"
+	"github.com/zvdy/yamlet/internal/policy"
 	"github.com/zvdy/yamlet/internal/storage"
+	"github.com/zvdy/yamlet/internal/yamlutil"
 
 	"github.com/gorilla/mux"
 )
@@ -21,20 +40,147 @@ const MaxConfigBodyBytes = 1 << 20 // 1 MiB
 // MaxAdminBodyBytes caps the size of admin JSON payloads.
 const MaxAdminBodyBytes = 16 * 1024 // 16 KiB
 
+// MaxBatchBodyBytes caps the size of a batch update payload.
+const MaxBatchBodyBytes = 4 << 20 // 4 MiB
+
+// MaxBatchOperations caps the number of operations in a batch update.
+const MaxBatchOperations = 100
+
+// MaxRestoreBodyBytes caps the size of a backup archive uploaded for
+// restore.
+const MaxRestoreBodyBytes = 256 << 20 // 256 MiB
+
+// RenderEnvPrefix is prepended to ${env:NAME} lookups during rendering so
+// that templates can only read variables deliberately exported to them, and
+// never secrets such as YAMLET_ADMIN_TOKEN.
+const RenderEnvPrefix = "YAMLET_VAR_"
+
 // Handler contains the dependencies for HTTP handlers
 type Handler struct {
-	store storage.Store
-	auth  auth.Auth
+	store   storage.Store
+	auth    auth.Auth
+	policy  *policy.Policy
+	limits  yamlutil.Limits
+	keyring *fieldcrypt.Keyring
+	cache   *storage.CachingStore
+	// trashRetention is how long deleted configs are kept in the trash;
+	// zero deletes them for good.
+	trashRetention time.Duration
+	// backend names the storage backend in backup manifests.
+	backend string
+	// inconsistentBackups lets GET /admin/backup read stores that are not
+	// Exporters one config at a time.
+	inconsistentBackups bool
+	backups             *backup.Scheduler
 }
 
 // NewHandler creates a new handler instance
 func NewHandler(store storage.Store, a auth.Auth) *Handler {
 	return &Handler{
-		store: store,
-		auth:  a,
+		store:  store,
+		auth:   a,
+		policy: policy.NewPolicy(),
+		limits: yamlutil.DefaultLimits(),
+	}
+}
+
+// SetLimits replaces the YAML parse limits enforced on uploads and on
+// read-time processing. It must be called before the handler serves
+// requests.
+func (h *Handler) SetLimits(l yamlutil.Limits) {
+	h.limits = l
+}
+
+// SetKeyring sets the keys used to encrypt values at a namespace's
+// encrypted paths and to decrypt them on read. Without a keyring, storing a
+// config with values to encrypt fails. It must be called before the handler
+// serves requests.
+func (h *Handler) SetKeyring(k *fieldcrypt.Keyring) {
+	h.keyring = k
+}
+
+// SetCache sets the read cache whose statistics GET /admin/cache reports.
+// It must be called before the handler serves requests.
+func (h *Handler) SetCache(c *storage.CachingStore) {
+	h.cache = c
+}
+
+// SetTrashRetention makes DeleteConfig move configs to their namespace's
+// trash, when the store keeps one, where they stay for retention before
+// they are purged. The purging itself is up to a storage.Reaper. Zero, the
+// default, deletes configs for good. It must be called before the handler
+// serves requests.
+func (h *Handler) SetTrashRetention(retention time.Duration) {
+	h.trashRetention = retention
+}
+
+// LoadPolicy loads the namespace policies kept in the store's namespace
+// records, and makes those set through the admin API persist there, when
+// the store keeps namespace records. It must be called before the handler
+// serves requests.
+func (h *Handler) LoadPolicy() error {
+	store, ok := h.store.(storage.NamespaceStore)
+	if !ok {
+		return nil
 	}
+	return h.policy.Load(store)
+}
+
+// SetBackend names the storage backend in the manifests of backups taken
+// through GET /admin/backup. It must be called before the handler serves
+// requests.
+func (h *Handler) SetBackend(name string) {
+	h.backend = name
+}
+
+// AllowInconsistentBackups lets GET /admin/backup archive stores that
+// cannot be read at a single point in time, such as S3, one config at a
+// time. It must be called before the handler serves requests.
+func (h *Handler) AllowInconsistentBackups() {
+	h.inconsistentBackups = true
+}
+
+// Policies returns the namespace policies in effect, for backups.
+func (h *Handler) Policies() map[string]storage.NamespacePolicy {
+	return h.policy.Policies()
+}
+
+// SetBackupScheduler sets the scheduler whose status GET /health/backups
+// and GET /metrics report. It must be called before the handler serves
+// requests.
+func (h *Handler) SetBackupScheduler(s *backup.Scheduler) {
+	h.backups = s
 }
 
+// RedactedHeader is set on config responses that had secret values
+// redacted.
+const RedactedHeader = "X-Yamlet-Redacted"
+
+// OtherTokenHeader carries the token for other_namespace in a diff across
+// namespaces, when the request's own token is only valid for one of them.
+const OtherTokenHeader = "X-Yamlet-Other-Token"
+
+// Bulk fetch headers. SnapshotHeader reports whether every config was read
+// from the same point in time; StatusHeader gives the status of each part
+// of a multipart response.
+const (
+	SnapshotHeader = "X-Yamlet-Snapshot"
+	StatusHeader   = "X-Yamlet-Status"
+)
+
+// Metadata headers. Labels and annotations are sent with POST to replace
+// the config's and returned with GET as comma-separated key=value pairs
+// with query-escaped values. The other headers are only returned.
+const (
+	LabelsHeader        = "X-Yamlet-Labels"
+	AnnotationsHeader   = "X-Yamlet-Annotations"
+	CreatedHeader       = "X-Yamlet-Created"
+	UpdatedByHeader     = "X-Yamlet-Updated-By"
+	ContentSHA256Header = "X-Yamlet-Content-Sha256"
+	ExpiresHeader       = "X-Yamlet-Expires-At"
+	TTLHeader           = "X-Yamlet-TTL"
+)
+
 // extractToken extracts the token from the Authorization header
 func (h *Handler) extractToken(r *http.Request) string {
 	authHeader := r.Header.Get("Authorization")
@@ -79,8 +225,17 @@ func storeStatusFor(err error) int {
 	switch {
 	case errors.Is(err, storage.ErrNotFound):
 		return http.StatusNotFound
-	case errors.Is(err, storage.ErrInvalidName):
+	case errors.Is(err, storage.ErrInvalidName), errors.Is(err, storage.ErrInvalidMetadata),
+		errors.Is(err, storage.ErrInvalidQuery):
 		return http.StatusBadRequest
+	case errors.Is(err, storage.ErrUnsupported):
+		return http.StatusNotImplemented
+	case errors.Is(err, storage.ErrConflict), errors.Is(err, storage.ErrExists):
+		return http.StatusConflict
+	case errors.Is(err, errConfigTooLarge):
+		return http.StatusRequestEntityTooLarge
+	case errors.Is(err, errQuotaExceeded):
+		return http.StatusInsufficientStorage
 	default:
 		return http.StatusInternalServerError
 	}
@@ -103,14 +258,26 @@ func (h *Handler) StoreConfig(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	labels, annotations, err := metadataHeaders(r)
+	if err != nil {
+		writeErrorJSON(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	expires, err := expiryHeaders(r)
+	if err != nil {
+		writeErrorJSON(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
 	// Cap body size to prevent memory exhaustion DoS.
+	limit := h.maxConfigBytes(namespace)
 	defer r.Body.Close()
-	r.Body = http.MaxBytesReader(w, r.Body, MaxConfigBodyBytes)
+	r.Body = http.MaxBytesReader(w, r.Body, limit)
 	body, err := io.ReadAll(r.Body)
 	if err != nil {
 		if isMaxBytesError(err) {
 			writeErrorJSON(w, http.StatusRequestEntityTooLarge,
-				fmt.Sprintf("Request body exceeds %d bytes", MaxConfigBodyBytes))
+				fmt.Sprintf("Request body exceeds %d bytes", limit))
 			return
 		}
 		writeErrorJSON(w, http.StatusBadRequest, fmt.Sprintf("Failed to read request body: %v", err))
@@ -122,11 +289,45 @@ func (h *Handler) StoreConfig(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	if err := h.store.Store(namespace, name, body); err != nil {
+	// JSON and TOML uploads are canonicalized to YAML before storage; any
+	// other Content-Type (including curl's form default) is taken as YAML.
+	format := yamlutil.FormatYAML
+	if f, ok := yamlutil.FormatForMediaType(r.Header.Get("Content-Type")); ok {
+		format = f
+	}
+	body, err = yamlutil.ToYAML(body, format)
+	if err != nil {
+		writeErrorJSON(w, http.StatusBadRequest, fmt.Sprintf("Invalid %s document: %v", format, err))
+		return
+	}
+	documents, err := yamlutil.CheckLimits(body, h.limits)
+	if errors.Is(err, yamlutil.ErrLimitExceeded) {
+		writeErrorJSON(w, http.StatusUnprocessableEntity, fmt.Sprintf("Config rejected: %v", err))
+		return
+	}
+	if err != nil {
+		writeErrorJSON(w, http.StatusBadRequest, fmt.Sprintf("Invalid YAML: %v", err))
+		return
+	}
+	body, encrypted, err := h.encryptFor(namespace, name, body)
+	if err != nil {
+		status := cryptStatusFor(err)
+		if status == http.StatusInternalServerError {
+			log.Printf("Failed to encrypt config %s/%s: %v", namespace, name, err)
+		}
+		writeErrorJSON(w, status, fmt.Sprintf("Failed to encrypt config: %v", err))
+		return
+	}
+
+	if err := h.storeAs(token, namespace, name, body); err != nil {
 		log.Printf("Failed to store config %s/%s: %v", namespace, name, err)
 		writeErrorJSON(w, storeStatusFor(err), fmt.Sprintf("Failed to store config: %v", err))
 		return
 	}
+	if err := h.recordMetadata(token, namespace, name, body, format.ContentType(), labels, annotations, expires); err != nil {
+		writeMetadataError(w, namespace, name, err)
+		return
+	}
 
 	log.Printf("Stored config %s/%s (%d bytes)", namespace, name, len(body))
 
@@ -135,6 +336,9 @@ func (h *Handler) StoreConfig(w http.ResponseWriter, r *http.Request) {
 		"namespace": namespace,
 		"name":      name,
 		"size":      len(body),
+		"format":    format,
+		"documents": documents,
+		"encrypted": encrypted,
 	})
 }
 
@@ -155,7 +359,13 @@ func (h *Handler) GetConfig(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	content, err := h.store.Get(namespace, name)
+	revision, err := queryInt(r, "revision")
+	if err != nil {
+		writeErrorJSON(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	content, err := h.loadConfig(namespace, name, revision)
 	if err != nil {
 		status := storeStatusFor(err)
 		if status == http.StatusInternalServerError {
@@ -165,183 +375,3275 @@ func (h *Handler) GetConfig(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	log.Printf("Retrieved config %s/%s (%d bytes)", namespace, name, len(content))
-
-	w.Header().Set("Content-Type", "application/x-yaml")
-	w.WriteHeader(http.StatusOK)
-	_, _ = w.Write(content)
-}
-
-// DeleteConfig handles DELETE /namespaces/{namespace}/configs/{name}
-func (h *Handler) DeleteConfig(w http.ResponseWriter, r *http.Request) {
-	vars := mux.Vars(r)
-	namespace := vars["namespace"]
-	name := vars["name"]
-
-	if namespace == "" || name == "" {
-		writeErrorJSON(w, http.StatusBadRequest, "namespace and name are required")
+	merged, err := queryBool(r, "merged")
+	if err != nil {
+		writeErrorJSON(w, http.StatusBadRequest, err.Error())
 		return
 	}
-
-	token := h.extractToken(r)
-	if err := h.auth.ValidateToken(namespace, token); err != nil {
-		writeErrorJSON(w, authStatusFor(err), fmt.Sprintf("Authentication failed: %v", err))
+	render, err := queryBool(r, "render")
+	if err != nil {
+		writeErrorJSON(w, http.StatusBadRequest, err.Error())
 		return
 	}
-
-	if err := h.store.Delete(namespace, name); err != nil {
-		status := storeStatusFor(err)
-		if status == http.StatusInternalServerError {
-			log.Printf("Failed to delete config %s/%s: %v", namespace, name, err)
-		}
-		writeErrorJSON(w, status, fmt.Sprintf("Failed to delete config: %v", err))
+	sel, err := documentSelector(r)
+	if err != nil {
+		writeErrorJSON(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	// encrypted=true returns encrypted values as stored, e.g. for export.
+	keepEncrypted, err := queryBool(r, "encrypted")
+	if err != nil {
+		writeErrorJSON(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	if keepEncrypted && (merged || render) {
+		writeErrorJSON(w, http.StatusBadRequest, "encrypted cannot be combined with merged or render")
+		return
+	}
+	format, ok := yamlutil.NegotiateFormat(r.Header.Get("Accept"))
+	if !ok {
+		writeErrorJSON(w, http.StatusNotAcceptable,
+			"Supported response types are application/x-yaml, application/json and application/toml")
 		return
 	}
 
-	log.Printf("Deleted config %s/%s", namespace, name)
+	// Raw YAML is served as stored; anything that parses it is held to the
+	// parse limits first, which also covers configs stored before the limits
+	// were tightened. Redaction only parses configs that can hold secrets.
+	readSecrets := h.auth.HasPermission(token, auth.PermReadSecrets)
+	redactSecrets := !readSecrets && h.mayHoldSecrets(namespace, content)
+	decrypt := !keepEncrypted && fieldcrypt.HasMetadata(content)
+	if merged || render || !sel.IsZero() || format != yamlutil.FormatYAML || redactSecrets || decrypt {
+		if _, err := yamlutil.CheckLimits(content, h.limits); err != nil {
+			writeErrorJSON(w, renderStatusFor(err), fmt.Sprintf("Failed to parse config: %v", err))
+			return
+		}
+	}
+	if decrypt {
+		if content, err = h.decrypt(namespace, name, content); err != nil {
+			status := cryptStatusFor(err)
+			if status == http.StatusInternalServerError {
+				log.Printf("Failed to decrypt config %s/%s: %v", namespace, name, err)
+			}
+			writeErrorJSON(w, status, fmt.Sprintf("Failed to decrypt config: %v", err))
+			return
+		}
+	}
 
-	writeJSON(w, http.StatusOK, map[string]interface{}{
-		"message":   "Config deleted successfully",
-		"namespace": namespace,
-		"name":      name,
-	})
-}
+	// Secrets are redacted before merging, whose output drops the x-yamlet
+	// annotations, and again at the end for values that references and
+	// bases brought in.
+	redacted := false
+	if redactSecrets {
+		content, redacted, err = h.redactFor(token, namespace, content)
+		if err != nil {
+			writeErrorJSON(w, renderStatusFor(err), fmt.Sprintf("Failed to redact config: %v", err))
+			return
+		}
+	}
+	if merged {
+		m, err := yamlutil.Merge(namespace, name, content, h.resolver(token), 0)
+		if err == nil {
+			content, err = m.YAML()
+		}
+		if err != nil {
+			writeErrorJSON(w, renderStatusFor(err), fmt.Sprintf("Failed to merge config: %v", err))
+			return
+		}
+	}
+	if render {
+		content, err = h.renderConfig(token, namespace, name, content)
+		if err != nil {
+			writeErrorJSON(w, renderStatusFor(err), fmt.Sprintf("Failed to render config: %v", err))
+			return
+		}
+	}
 
-// ListConfigs handles GET /namespaces/{namespace}/configs
-func (h *Handler) ListConfigs(w http.ResponseWriter, r *http.Request) {
-	vars := mux.Vars(r)
-	namespace := vars["namespace"]
+	if !sel.IsZero() {
+		content, err = yamlutil.SelectDocument(content, sel)
+		if err != nil {
+			writeErrorJSON(w, documentStatusFor(err), fmt.Sprintf("Failed to select document: %v", err))
+			return
+		}
+	}
+	if !readSecrets && (merged || render) {
+		var more bool
+		content, more, err = h.redactFor(token, namespace, content)
+		if err != nil {
+			writeErrorJSON(w, renderStatusFor(err), fmt.Sprintf("Failed to redact config: %v", err))
+			return
+		}
+		redacted = redacted || more
+	}
 
-	if namespace == "" {
-		writeErrorJSON(w, http.StatusBadRequest, "namespace is required")
+	content, err = yamlutil.FromYAML(content, format)
+	if err != nil {
+		writeErrorJSON(w, http.StatusUnprocessableEntity, fmt.Sprintf("Config cannot be rendered as %s: %v", format, err))
 		return
 	}
 
-	token := h.extractToken(r)
-	if err := h.auth.ValidateToken(namespace, token); err != nil {
-		writeErrorJSON(w, authStatusFor(err), fmt.Sprintf("Authentication failed: %v", err))
-		return
+	log.Printf("Retrieved config %s/%s (%d bytes)", namespace, name, len(content))
+
+	w.Header().Set("Content-Type", format.ContentType())
+	w.Header().Add("Vary", "Accept")
+	if redacted {
+		w.Header().Set(RedactedHeader, "true")
 	}
+	if revision == 0 {
+		h.setMetadataHeaders(w, namespace, name)
+	}
+	w.WriteHeader(http.StatusOK)
+	_, _ = w.Write(content)
+}
 
-	configs, err := h.store.List(namespace)
+// queryBool parses an optional boolean query parameter.
+func queryBool(r *http.Request, key string) (bool, error) {
+	raw := r.URL.Query().Get(key)
+	if raw == "" {
+		return false, nil
+	}
+	v, err := strconv.ParseBool(raw)
 	if err != nil {
-		status := storeStatusFor(err)
-		if status == http.StatusInternalServerError {
-			log.Printf("Failed to list configs for namespace %s: %v", namespace, err)
-		}
-		writeErrorJSON(w, status, fmt.Sprintf("Failed to list configs: %v", err))
-		return
+		return false, fmt.Errorf("invalid %s parameter %q", key, raw)
 	}
+	return v, nil
+}
 
-	log.Printf("Listed %d configs for namespace %s", len(configs), namespace)
+// queryInt parses an optional non-negative integer query parameter; zero
+// means the parameter was absent.
+func queryInt(r *http.Request, key string) (int, error) {
+	raw := r.URL.Query().Get(key)
+	if raw == "" {
+		return 0, nil
+	}
+	v, err := strconv.Atoi(raw)
+	if err != nil || v < 1 {
+		return 0, fmt.Errorf("invalid %s parameter %q", key, raw)
+	}
+	return v, nil
+}
 
-	writeJSON(w, http.StatusOK, map[string]interface{}{
-		"namespace": namespace,
-		"configs":   configs,
-		"count":     len(configs),
-	})
+// documentSelector builds a document selector from the document (zero-based
+// index) and selector (path=value,...) query parameters. It returns a zero
+// selector when neither is set.
+func documentSelector(r *http.Request) (yamlutil.Selector, error) {
+	return parseDocumentSelector(r.URL.Query().Get("document"), r.URL.Query().Get("selector"))
 }
 
-// Admin endpoints for token management
+// parseDocumentSelector builds a document selector from the values of the
+// document and selector parameters.
+func parseDocumentSelector(index, selector string) (yamlutil.Selector, error) {
+	switch {
+	case index != "" && selector != "":
+		return yamlutil.Selector{}, errors.New("document and selector parameters are mutually exclusive")
+	case index != "":
+		i, err := strconv.Atoi(index)
+		if err != nil || i < 0 {
+			return yamlutil.Selector{}, fmt.Errorf("invalid document parameter %q", index)
+		}
+		return yamlutil.IndexSelector(i), nil
+	case selector != "":
+		return yamlutil.ParseSelector(selector)
+	}
+	return yamlutil.Selector{}, nil
+}
 
-// authAdminStatusFor maps an auth error from admin operations to an HTTP
-// status code.
-func authAdminStatusFor(err error) int {
+// documentStatusFor maps a document selection error to an HTTP status code.
+func documentStatusFor(err error) int {
 	switch {
-	case errors.Is(err, auth.ErrAdminRequired):
-		return http.StatusUnauthorized
-	case errors.Is(err, auth.ErrTokenNotFound):
+	case errors.Is(err, yamlutil.ErrNoDocument):
 		return http.StatusNotFound
-	case errors.Is(err, auth.ErrTokenExists), errors.Is(err, auth.ErrInvalidInput):
+	case errors.Is(err, yamlutil.ErrInvalidSelector):
 		return http.StatusBadRequest
+	case errors.Is(err, yamlutil.ErrAmbiguousDocument), errors.Is(err, yamlutil.ErrInvalidYAML),
+		errors.Is(err, yamlutil.ErrLimitExceeded):
+		return http.StatusUnprocessableEntity
 	default:
-		return http.StatusBadRequest
+		return http.StatusInternalServerError
 	}
 }
 
-// CreateToken handles POST /admin/tokens
-func (h *Handler) CreateToken(w http.ResponseWriter, r *http.Request) {
-	adminToken := h.extractToken(r)
-	if adminToken == "" {
-		writeErrorJSON(w, http.StatusUnauthorized, "Admin token required")
-		return
+// loadConfig returns the current content of a config, or a past revision
+// when revision is non-zero.
+func (h *Handler) loadConfig(namespace, name string, revision int) ([]byte, error) {
+	if revision == 0 {
+		return h.getConfig(namespace, name)
 	}
+	if h.expired(namespace, name) {
+		return nil, errExpired(namespace, name)
+	}
+	versioned, ok := h.store.(storage.Versioned)
+	if !ok {
+		return nil, fmt.Errorf("revision history: %w", storage.ErrUnsupported)
+	}
+	return versioned.GetRevision(namespace, name, revision)
+}
 
-	defer r.Body.Close()
-	r.Body = http.MaxBytesReader(w, r.Body, MaxAdminBodyBytes)
-
-	var req struct {
-		Token     string `json:"token"`
-		Namespace string `json:"namespace"`
+// getConfig reads a config that has not expired. Expired configs are not
+// served even before the reaper deletes them.
+func (h *Handler) getConfig(namespace, name string) ([]byte, error) {
+	content, err := h.store.Get(namespace, name)
+	if err != nil {
+		return nil, err
+	}
+	if h.expired(namespace, name) {
+		return nil, errExpired(namespace, name)
 	}
+	return content, nil
+}
 
-	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
-		if isMaxBytesError(err) {
-			writeErrorJSON(w, http.StatusRequestEntityTooLarge,
-				fmt.Sprintf("Request body exceeds %d bytes", MaxAdminBodyBytes))
-			return
-		}
-		writeErrorJSON(w, http.StatusBadRequest, fmt.Sprintf("Invalid request body: %v", err))
-		return
+// expired reports whether a config's metadata record says it has expired.
+// Configs without a record do not expire.
+func (h *Handler) expired(namespace, name string) bool {
+	store, ok := h.store.(storage.MetadataStore)
+	if !ok {
+		return false
 	}
+	md, err := store.Metadata(namespace, name)
+	return err == nil && md.Expired(time.Now())
+}
 
-	if err := h.auth.CreateToken(adminToken, req.Token, req.Namespace); err != nil {
-		writeErrorJSON(w, authAdminStatusFor(err), err.Error())
-		return
+// dropExpired leaves the expired configs out of a listing. A page may so
+// hold fewer names than its limit.
+func (h *Handler) dropExpired(namespace string, names []string) []string {
+	if _, ok := h.store.(storage.MetadataStore); !ok {
+		return names
+	}
+	kept := names[:0]
+	for _, name := range names {
+		if !h.expired(namespace, name) {
+			kept = append(kept, name)
+		}
 	}
+	return kept
+}
 
-	log.Printf("Admin created token for namespace %s", req.Namespace)
+// errExpired reports an expired config as not found.
+func errExpired(namespace, name string) error {
+	return fmt.Errorf("config %s in namespace %s has expired: %w", name, namespace, storage.ErrNotFound)
+}
 
-	writeJSON(w, http.StatusCreated, map[string]interface{}{
-		"message":   "Token created successfully",
-		"token":     req.Token,
-		"namespace": req.Namespace,
-	})
+// parseExpiry parses when a config expires, given as an RFC 3339 time or
+// as a TTL from now: a duration such as 72h, or a number of seconds. It
+// returns nil when neither is given, so that the recorded expiry is kept,
+// and the zero time when the one given is empty, which clears it.
+func parseExpiry(expiresAt, ttl *string, now time.Time) (*time.Time, error) {
+	var expires time.Time
+	switch {
+	case expiresAt != nil && ttl != nil:
+		return nil, errors.New("expires_at and ttl are mutually exclusive")
+	case expiresAt != nil && *expiresAt != "":
+		t, err := time.Parse(time.RFC3339, strings.TrimSpace(*expiresAt))
+		if err != nil {
+			return nil, fmt.Errorf("invalid expires_at %q: want an RFC 3339 time", *expiresAt)
+		}
+		expires = t.UTC()
+	case ttl != nil && *ttl != "":
+		d, err := time.ParseDuration(strings.TrimSpace(*ttl))
+		if err != nil {
+			seconds, serr := strconv.Atoi(strings.TrimSpace(*ttl))
+			if serr != nil {
+				return nil, fmt.Errorf("invalid ttl %q: want a duration such as 72h or a number of seconds", *ttl)
+			}
+			d = time.Duration(seconds) * time.Second
+		}
+		if d <= 0 {
+			return nil, fmt.Errorf("invalid ttl %q: must be positive", *ttl)
+		}
+		expires = now.Add(d).UTC()
+	case expiresAt == nil && ttl == nil:
+		return nil, nil
+	}
+	if !expires.IsZero() && !expires.After(now) {
+		return nil, fmt.Errorf("expiry %s has already passed", expires.Format(time.RFC3339))
+	}
+	return &expires, nil
 }
 
-// RevokeToken handles DELETE /admin/tokens/{token}
-func (h *Handler) RevokeToken(w http.ResponseWriter, r *http.Request) {
-	vars := mux.Vars(r)
-	tokenToRevoke := vars["token"]
+// expiryHeaders parses the expiry sent with a write, in ExpiresHeader or
+// TTLHeader.
+func expiryHeaders(r *http.Request) (*time.Time, error) {
+	header := func(key string) *string {
+		if values := r.Header.Values(key); len(values) > 0 {
+			v := strings.Join(values, ",")
+			return &v
+		}
+		return nil
+	}
+	return parseExpiry(header(ExpiresHeader), header(TTLHeader), time.Now())
+}
 
-	adminToken := h.extractToken(r)
-	if adminToken == "" {
-		writeErrorJSON(w, http.StatusUnauthorized, "Admin token required")
-		return
+// authorFor names the caller a change is attributed to. Tokens have no
+// names, so a namespace token is identified by its namespace and
+// fingerprint rather than by the secret itself.
+func (h *Handler) authorFor(namespace, token string) storage.Author {
+	fp := auth.Fingerprint(token)
+	return storage.Author{
+		Name:  fmt.Sprintf("%s token %s", namespace, fp),
+		Email: fmt.Sprintf("token-%s@yamlet.invalid", fp),
 	}
+}
 
-	if err := h.auth.RevokeToken(adminToken, tokenToRevoke); err != nil {
-		writeErrorJSON(w, authAdminStatusFor(err), err.Error())
-		return
+// storeAs stores a config within the namespace's quota, attributing the
+// change to the caller when the store records authors.
+func (h *Handler) storeAs(token, namespace, name string, content []byte) error {
+	if err := h.checkQuota(namespace, name, content); err != nil {
+		return err
+	}
+	var err error
+	if attributed, ok := h.store.(storage.Attributed); ok {
+		err = attributed.StoreAs(h.authorFor(namespace, token), namespace, name, content)
+	} else {
+		err = h.store.Store(namespace, name, content)
+	}
+	if err != nil {
+		return err
 	}
+	h.pruneRevisions(namespace, name)
+	return nil
+}
 
-	log.Printf("Admin revoked token: %s", tokenToRevoke)
+// errQuotaExceeded and errConfigTooLarge reject writes beyond a namespace's
+// quota.
+var (
+	errQuotaExceeded  = errors.New("namespace quota exceeded")
+	errConfigTooLarge = errors.New("config too large")
+)
 
-	writeJSON(w, http.StatusOK, map[string]interface{}{
-		"message": "Token revoked successfully",
-		"token":   tokenToRevoke,
-	})
+// maxConfigBytes is the size limit of a single config in a namespace: its
+// quota's, or MaxConfigBodyBytes.
+func (h *Handler) maxConfigBytes(namespace string) int64 {
+	if limit := h.policy.Quota(namespace).MaxConfigBytes; limit > 0 {
+		return limit
+	}
+	return MaxConfigBodyBytes
 }
 
-// ListTokens handles GET /admin/tokens
-func (h *Handler) ListTokens(w http.ResponseWriter, r *http.Request) {
-	adminToken := h.extractToken(r)
-	if adminToken == "" {
-		writeErrorJSON(w, http.StatusUnauthorized, "Admin token required")
-		return
+// checkQuota reports whether writing content to a config keeps the
+// namespace within its quota. Writes that do not grow the namespace are
+// always allowed, so a namespace over a lowered quota can still shrink.
+// Concurrent writes are checked independently and may together overshoot
+// the quota slightly.
+func (h *Handler) checkQuota(namespace, name string, content []byte) error {
+	return h.checkQuotaSize(namespace, name, len(content), storage.StoredSizeOf(h.store, len(content)))
+}
+
+// checkQuotaSize is checkQuota for content of size bytes that the store
+// holds in stored bytes. Namespace sizes are those the store holds, which
+// under encryption at rest are larger than those written, so the config
+// limit applies to size and the namespace limit to stored.
+func (h *Handler) checkQuotaSize(namespace, name string, size, stored int) error {
+	q := h.policy.Quota(namespace)
+	if q.MaxConfigBytes > 0 && int64(size) > q.MaxConfigBytes {
+		return fmt.Errorf("%w: %d bytes exceeds the namespace limit of %d bytes",
+			errConfigTooLarge, size, q.MaxConfigBytes)
+	}
+	if q.MaxConfigs == 0 && q.MaxBytes == 0 {
+		return nil
 	}
 
-	tokens, err := h.auth.ListAllTokens(adminToken)
+	current, err := storage.SizeOf(h.store, namespace, name)
+	exists := err == nil
+	if err != nil && !errors.Is(err, storage.ErrNotFound) {
+		return err
+	}
+	usage, err := storage.UsageOf(h.store, namespace)
 	if err != nil {
-		writeErrorJSON(w, authAdminStatusFor(err), err.Error())
-		return
+		return err
+	}
+	if !exists && q.MaxConfigs > 0 && usage.Configs >= q.MaxConfigs {
+		return fmt.Errorf("%w: namespace %s already holds %d of %d configs",
+			errQuotaExceeded, namespace, usage.Configs, q.MaxConfigs)
+	}
+	if growth := int64(stored - current); q.MaxBytes > 0 && growth > 0 && usage.Bytes+growth > q.MaxBytes {
+		return fmt.Errorf("%w: namespace %s would hold %d of %d bytes",
+			errQuotaExceeded, namespace, usage.Bytes+growth, q.MaxBytes)
 	}
+	return nil
+}
 
-	log.Printf("Admin listed %d tokens", len(tokens))
+// storedSize returns the number of bytes the store holds content in, or
+// 0 for no content.
+func (h *Handler) storedSize(content []byte) int64 {
+	if content == nil {
+		return 0
+	}
+	return int64(storage.StoredSizeOf(h.store, len(content)))
+}
+
+// pruneRevisions drops the revisions of a config beyond its namespace's
+// quota. The write has already succeeded, so failures are only logged;
+// stores whose history cannot be pruned keep their own retention.
+func (h *Handler) pruneRevisions(namespace, name string) {
+	keep := h.policy.Quota(namespace).MaxRevisions
+	pruner, ok := h.store.(storage.Pruner)
+	if keep == 0 || !ok {
+		return
+	}
+	if err := pruner.PruneRevisions(namespace, name, keep); err != nil && !errors.Is(err, storage.ErrUnsupported) {
+		log.Printf("Failed to prune revisions of config %s/%s: %v", namespace, name, err)
+	}
+}
+
+// deleteAs deletes a config, attributing the change to the caller when the
+// store records authors.
+func (h *Handler) deleteAs(token, namespace, name string) error {
+	if attributed, ok := h.store.(storage.Attributed); ok {
+		return attributed.DeleteAs(h.authorFor(namespace, token), namespace, name)
+	}
+	return h.store.Delete(namespace, name)
+}
+
+// trashAs moves a config to its namespace's trash, attributing the change
+// to the caller. It deletes the config for good, returning a nil item, when
+// the trash is disabled or the store keeps none.
+func (h *Handler) trashAs(token, namespace, name string) (*storage.TrashItem, error) {
+	if trasher, ok := h.store.(storage.Trasher); ok && h.trashRetention > 0 {
+		item, err := trasher.Trash(h.authorFor(namespace, token), namespace, name)
+		if !errors.Is(err, storage.ErrUnsupported) {
+			if err != nil {
+				return nil, err
+			}
+			return &item, nil
+		}
+	}
+	return nil, h.deleteAs(token, namespace, name)
+}
+
+// metadataHeaders parses the labels and annotations sent with a write. A
+// map is nil when its header is absent, so that the recorded one is kept.
+func metadataHeaders(r *http.Request) (labels, annotations map[string]string, err error) {
+	if values, ok := r.Header[LabelsHeader]; ok {
+		if labels, err = parseMetadataHeader(LabelsHeader, strings.Join(values, ",")); err != nil {
+			return nil, nil, err
+		}
+	}
+	if values, ok := r.Header[AnnotationsHeader]; ok {
+		if annotations, err = parseMetadataHeader(AnnotationsHeader, strings.Join(values, ",")); err != nil {
+			return nil, nil, err
+		}
+	}
+	if err := storage.ValidateMetadata(storage.Metadata{Labels: labels, Annotations: annotations}); err != nil {
+		return nil, nil, err
+	}
+	return labels, annotations, nil
+}
+
+// parseMetadataHeader parses comma-separated key=value pairs with
+// query-escaped values. An empty header gives an empty map.
+func parseMetadataHeader(header, value string) (map[string]string, error) {
+	m := make(map[string]string)
+	for _, pair := range strings.Split(value, ",") {
+		pair = strings.TrimSpace(pair)
+		if pair == "" {
+			continue
+		}
+		key, v, ok := strings.Cut(pair, "=")
+		if !ok {
+			return nil, fmt.Errorf("invalid %s header: %q is not key=value", header, pair)
+		}
+		v, err := url.QueryUnescape(strings.TrimSpace(v))
+		if err != nil {
+			return nil, fmt.Errorf("invalid %s header: %q: %v", header, pair, err)
+		}
+		m[strings.TrimSpace(key)] = v
+	}
+	return m, nil
+}
+
+// formatMetadataHeader is the inverse of parseMetadataHeader, with keys in
+// sorted order.
+func formatMetadataHeader(m map[string]string) string {
+	pairs := make([]string, 0, len(m))
+	for _, key := range slices.Sorted(maps.Keys(m)) {
+		pairs = append(pairs, key+"="+url.QueryEscape(m[key]))
+	}
+	return strings.Join(pairs, ",")
+}
+
+// contentSHA256 returns the hex SHA-256 recorded for a config's content.
+func contentSHA256(content []byte) string {
+	sum := sha256.Sum256(content)
+	return hex.EncodeToString(sum[:])
+}
+
+// recordMetadata updates a config's metadata record after the caller wrote
+// content to it. An empty content type keeps the recorded one, and nil
+// labels, annotations or expiry keep the recorded ones. Stores that keep no
+// records are skipped unless labels, annotations or an expiry were given.
+func (h *Handler) recordMetadata(token, namespace, name string, content []byte, contentType string,
+	labels, annotations map[string]string, expires *time.Time) error {
+	given := labels != nil || annotations != nil || expires != nil
+	store, ok := h.store.(storage.MetadataStore)
+	if !ok {
+		if given {
+			return fmt.Errorf("metadata: %w", storage.ErrUnsupported)
+		}
+		return nil
+	}
+	md, err := store.Metadata(namespace, name)
+	if errors.Is(err, storage.ErrUnsupported) && !given {
+		return nil
+	}
+	if err != nil && !errors.Is(err, storage.ErrNotFound) {
+		return err
+	}
+
+	now := time.Now().UTC()
+	if md.Created.IsZero() {
+		md.Created = now
+	}
+	md.Updated = now
+	md.UpdatedBy = auth.Fingerprint(token)
+	md.Size = len(content)
+	md.SHA256 = contentSHA256(content)
+	if contentType != "" {
+		md.ContentType = contentType
+	}
+	if labels != nil {
+		md.Labels = labels
+	}
+	if annotations != nil {
+		md.Annotations = annotations
+	}
+	if expires != nil {
+		md.Expires = *expires
+	} else if md.Expired(time.Now()) {
+		// A config written again after it expired starts afresh.
+		md.Expires = time.Time{}
+	}
+	return store.SetMetadata(namespace, name, md)
+}
+
+// writeMetadataError reports a config that was written but whose metadata
+// record was not.
+func writeMetadataError(w http.ResponseWriter, namespace, name string, err error) {
+	status := storeStatusFor(err)
+	if status == http.StatusInternalServerError {
+		log.Printf("Failed to record metadata of config %s/%s: %v", namespace, name, err)
+	}
+	writeErrorJSON(w, status, fmt.Sprintf("Config stored but its metadata was not recorded: %v", err))
+}
+
+// loadMetadata returns a config's metadata record. Configs written before
+// records were kept get one that only describes their content, which is
+// loaded unless given. Expired configs are not found.
+func (h *Handler) loadMetadata(namespace, name string, content []byte) (storage.Metadata, error) {
+	store, ok := h.store.(storage.MetadataStore)
+	if !ok {
+		return storage.Metadata{}, fmt.Errorf("metadata: %w", storage.ErrUnsupported)
+	}
+	md, err := store.Metadata(namespace, name)
+	if err == nil && md.Expired(time.Now()) {
+		return storage.Metadata{}, errExpired(namespace, name)
+	}
+	if !errors.Is(err, storage.ErrNotFound) {
+		return md, err
+	}
+	if content == nil {
+		if content, err = h.store.Get(namespace, name); err != nil {
+			return storage.Metadata{}, err
+		}
+	}
+	return storage.Metadata{Size: len(content), SHA256: contentSHA256(content)}, nil
+}
+
+// setMetadataHeaders describes the current content of a config in response
+// headers. Metadata is informational here, so failing to load it does not
+// fail the response.
+func (h *Handler) setMetadataHeaders(w http.ResponseWriter, namespace, name string) {
+	store, ok := h.store.(storage.MetadataStore)
+	if !ok {
+		return
+	}
+	md, err := store.Metadata(namespace, name)
+	if err != nil {
+		if !errors.Is(err, storage.ErrNotFound) && !errors.Is(err, storage.ErrUnsupported) {
+			log.Printf("Failed to load metadata of config %s/%s: %v", namespace, name, err)
+		}
+		return
+	}
+
+	header := w.Header()
+	if !md.Updated.IsZero() {
+		header.Set("Last-Modified", md.Updated.UTC().Format(http.TimeFormat))
+	}
+	if !md.Created.IsZero() {
+		header.Set(CreatedHeader, md.Created.UTC().Format(time.RFC3339))
+	}
+	if md.UpdatedBy != "" {
+		header.Set(UpdatedByHeader, md.UpdatedBy)
+	}
+	header.Set(ContentSHA256Header, md.SHA256)
+	if len(md.Labels) > 0 {
+		header.Set(LabelsHeader, formatMetadataHeader(md.Labels))
+	}
+	if len(md.Annotations) > 0 {
+		header.Set(AnnotationsHeader, formatMetadataHeader(md.Annotations))
+	}
+	if !md.Expires.IsZero() {
+		header.Set(ExpiresHeader, md.Expires.UTC().Format(time.RFC3339))
+	}
+}
+
+// resolver loads configs referenced by templates and overlays. Every config
+// is authorized with the caller's token, so references can only reach
+// namespaces the token is valid for or that list the token's namespace as
+// a referrer, held to the parse limits, decrypted, and redacted under its
+// own namespace's policy unless the token may read secrets there.
+func (h *Handler) resolver(token string) yamlutil.Resolver {
+	return func(namespace, name string) ([]byte, error) {
+		granted := false
+		if err := h.auth.ValidateToken(namespace, token); err != nil {
+			own, ownErr := h.auth.GetNamespaceForToken(token)
+			if !errors.Is(err, auth.ErrNamespaceMismatch) || ownErr != nil || !h.policy.MayReference(own, namespace) {
+				return nil, err
+			}
+			granted = true
+		}
+		content, err := h.getConfig(namespace, name)
+		if err != nil {
+			return nil, err
+		}
+		if _, err := yamlutil.CheckLimits(content, h.limits); err != nil {
+			return nil, fmt.Errorf("config %s/%s: %w", namespace, name, err)
+		}
+		if content, err = h.decrypt(namespace, name, content); err != nil {
+			return nil, fmt.Errorf("config %s/%s: %w", namespace, name, err)
+		}
+		if granted {
+			// The token's read-secrets permission only covers its own
+			// namespace; a referrer sees the values a namespace keeps
+			// secret redacted.
+			if !h.mayHoldSecrets(namespace, content) {
+				return content, nil
+			}
+			content, _, err = yamlutil.Redact(content, h.policy.SecretPaths(namespace))
+			return content, err
+		}
+		content, _, err = h.redactFor(token, namespace, content)
+		return content, err
+	}
+}
+
+// redactFor redacts the secret values of a config in namespace unless the
+// token holds the read-secrets permission. It reports whether anything was
+// redacted.
+func (h *Handler) redactFor(token, namespace string, content []byte) ([]byte, bool, error) {
+	if h.auth.HasPermission(token, auth.PermReadSecrets) || !h.mayHoldSecrets(namespace, content) {
+		return content, false, nil
+	}
+	return yamlutil.Redact(content, h.policy.SecretPaths(namespace))
+}
+
+// mayHoldSecrets reports whether content may have values to redact: when
+// the namespace has secret paths, or the config may annotate its own in an
+// x-yamlet block. Other configs are served without being parsed.
+func (h *Handler) mayHoldSecrets(namespace string, content []byte) bool {
+	return len(h.policy.SecretPaths(namespace)) > 0 || bytes.Contains(content, []byte(yamlutil.DirectiveKey))
+}
+
+// encryptFor encrypts the values of a config's content at the namespace's
+// encrypted paths and returns how many values were encrypted. Content
+// without values to encrypt is returned unchanged, even when no keyring is
+// configured.
+func (h *Handler) encryptFor(namespace, name string, content []byte) ([]byte, int, error) {
+	patterns := h.policy.EncryptPaths(namespace)
+	if len(patterns) == 0 && !fieldcrypt.HasMetadata(content) && !bytes.Contains(content, []byte("ENC[")) {
+		return content, 0, nil
+	}
+	scope := fieldcrypt.Scope{Namespace: namespace, Name: name}
+	content, n, err := fieldcrypt.Encrypt(content, scope, patterns, h.keyring)
+	if errors.Is(err, fieldcrypt.ErrUnwrap) || errors.Is(err, fieldcrypt.ErrDecrypt) {
+		return nil, 0, fmt.Errorf("%w: %v", errUndecryptable, err)
+	}
+	if err != nil {
+		return nil, 0, err
+	}
+	// Uploads may carry values encrypted elsewhere, for another config or
+	// by another server; refuse any that this config could not decrypt on
+	// read, so that no config can be used to decrypt another's values.
+	if _, _, err := fieldcrypt.Decrypt(content, scope, h.keyring); err != nil {
+		return nil, 0, fmt.Errorf("%w: %v", errUndecryptable, err)
+	}
+	return content, n, nil
+}
+
+// errUndecryptable is returned when a config to be stored holds encrypted
+// values that the configured keys cannot open for it.
+var errUndecryptable = errors.New("config holds values the server cannot decrypt for it")
+
+// decrypt opens the encrypted values of a stored config.
+func (h *Handler) decrypt(namespace, name string, content []byte) ([]byte, error) {
+	content, _, err := fieldcrypt.Decrypt(content, fieldcrypt.Scope{Namespace: namespace, Name: name}, h.keyring)
+	return content, err
+}
+
+// cryptStatusFor maps a field encryption error to an HTTP status code.
+// Missing or unusable server keys are server errors; anything wrong with
+// the submitted document is the client's.
+func cryptStatusFor(err error) int {
+	switch {
+	case errors.Is(err, fieldcrypt.ErrNoKeys), errors.Is(err, fieldcrypt.ErrUnwrap),
+		errors.Is(err, fieldcrypt.ErrDecrypt):
+		return http.StatusInternalServerError
+	case errors.Is(err, errUndecryptable),
+		errors.Is(err, fieldcrypt.ErrMissingMeta), errors.Is(err, fieldcrypt.ErrNotMapping),
+		errors.Is(err, fieldcrypt.ErrInvalidKey), errors.Is(err, yamlutil.ErrInvalidYAML):
+		return http.StatusUnprocessableEntity
+	default:
+		return http.StatusInternalServerError
+	}
+}
+
+// renderConfig resolves ${ref:...} and ${env:...} expressions in content.
+func (h *Handler) renderConfig(token, namespace, name string, content []byte) ([]byte, error) {
+	return yamlutil.Render(namespace, name, content, h.resolver(token), yamlutil.RenderOptions{
+		Env:    func(v string) (string, bool) { return os.LookupEnv(RenderEnvPrefix + v) },
+		Limits: h.limits,
+	})
+}
+
+// renderStatusFor maps a rendering error to an HTTP status code.
+func renderStatusFor(err error) int {
+	switch {
+	case errors.Is(err, auth.ErrMissingToken), errors.Is(err, auth.ErrInvalidToken),
+		errors.Is(err, auth.ErrNamespaceMismatch):
+		return authStatusFor(err)
+	case errors.Is(err, storage.ErrInvalidName):
+		return http.StatusUnprocessableEntity
+	}
+	if status := storeStatusFor(err); status != http.StatusInternalServerError {
+		// A missing referenced config makes this config unrenderable rather
+		// than absent.
+		return http.StatusUnprocessableEntity
+	}
+	if errors.Is(err, yamlutil.ErrInvalidYAML) || errors.Is(err, yamlutil.ErrInvalidDirective) ||
+		errors.Is(err, yamlutil.ErrLimitExceeded) ||
+		errors.Is(err, yamlutil.ErrRenderSyntax) ||
+		errors.Is(err, yamlutil.ErrRenderCycle) || errors.Is(err, yamlutil.ErrRenderDepth) ||
+		errors.Is(err, yamlutil.ErrRefNotFound) {
+		return http.StatusUnprocessableEntity
+	}
+	return http.StatusInternalServerError
+}
+
+// ExplainConfig handles GET /namespaces/{namespace}/configs/{name}/explain
+// and reports which layer of the inheritance chain each merged key came from.
+func (h *Handler) ExplainConfig(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	namespace := vars["namespace"]
+	name := vars["name"]
+
+	if namespace == "" || name == "" {
+		writeErrorJSON(w, http.StatusBadRequest, "namespace and name are required")
+		return
+	}
+
+	token := h.extractToken(r)
+	if err := h.auth.ValidateToken(namespace, token); err != nil {
+		writeErrorJSON(w, authStatusFor(err), fmt.Sprintf("Authentication failed: %v", err))
+		return
+	}
+
+	content, err := h.getConfig(namespace, name)
+	if err != nil {
+		status := storeStatusFor(err)
+		if status == http.StatusInternalServerError {
+			log.Printf("Failed to get config %s/%s: %v", namespace, name, err)
+		}
+		writeErrorJSON(w, status, fmt.Sprintf("Failed to get config: %v", err))
+		return
+	}
+
+	if _, err := yamlutil.CheckLimits(content, h.limits); err != nil {
+		writeErrorJSON(w, renderStatusFor(err), fmt.Sprintf("Failed to parse config: %v", err))
+		return
+	}
+	if content, err = h.decrypt(namespace, name, content); err != nil {
+		status := cryptStatusFor(err)
+		if status == http.StatusInternalServerError {
+			log.Printf("Failed to decrypt config %s/%s: %v", namespace, name, err)
+		}
+		writeErrorJSON(w, status, fmt.Sprintf("Failed to decrypt config: %v", err))
+		return
+	}
+	m, err := yamlutil.Merge(namespace, name, content, h.resolver(token), 0)
+	if err != nil {
+		writeErrorJSON(w, renderStatusFor(err), fmt.Sprintf("Failed to merge config: %v", err))
+		return
+	}
+
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"namespace": namespace,
+		"name":      name,
+		"layers":    m.Layers,
+		"keys":      m.Origins,
+	})
+}
+
+// ListRevisions handles GET /namespaces/{namespace}/configs/{name}/revisions
+func (h *Handler) ListRevisions(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	namespace := vars["namespace"]
+	name := vars["name"]
+
+	if namespace == "" || name == "" {
+		writeErrorJSON(w, http.StatusBadRequest, "namespace and name are required")
+		return
+	}
+
+	token := h.extractToken(r)
+	if err := h.auth.ValidateToken(namespace, token); err != nil {
+		writeErrorJSON(w, authStatusFor(err), fmt.Sprintf("Authentication failed: %v", err))
+		return
+	}
+
+	versioned, ok := h.store.(storage.Versioned)
+	if !ok {
+		writeErrorJSON(w, http.StatusNotImplemented, "Revision history is not supported by the configured storage backend")
+		return
+	}
+
+	revisions, err := versioned.Revisions(namespace, name)
+	if err != nil {
+		status := storeStatusFor(err)
+		if status == http.StatusInternalServerError {
+			log.Printf("Failed to list revisions of %s/%s: %v", namespace, name, err)
+		}
+		writeErrorJSON(w, status, fmt.Sprintf("Failed to list revisions: %v", err))
+		return
+	}
+
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"namespace": namespace,
+		"name":      name,
+		"revisions": revisions,
+		"count":     len(revisions),
+	})
+}
+
+// RollbackConfig handles POST /namespaces/{namespace}/configs/{name}/rollback
+//
+// The content of the revision given by the revision parameter is stored as
+// a new revision, so the rollback itself can be undone.
+func (h *Handler) RollbackConfig(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	namespace := vars["namespace"]
+	name := vars["name"]
+
+	if namespace == "" || name == "" {
+		writeErrorJSON(w, http.StatusBadRequest, "namespace and name are required")
+		return
+	}
+
+	token := h.extractToken(r)
+	if err := h.auth.ValidateToken(namespace, token); err != nil {
+		writeErrorJSON(w, authStatusFor(err), fmt.Sprintf("Authentication failed: %v", err))
+		return
+	}
+
+	revision, err := queryInt(r, "revision")
+	if err != nil {
+		writeErrorJSON(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	if revision == 0 {
+		writeErrorJSON(w, http.StatusBadRequest, "revision parameter is required")
+		return
+	}
+
+	if _, ok := h.store.(storage.Versioned); !ok {
+		writeErrorJSON(w, http.StatusNotImplemented, "Revision history is not supported by the configured storage backend")
+		return
+	}
+	content, err := h.loadConfig(namespace, name, revision)
+	if err != nil {
+		status := storeStatusFor(err)
+		if status == http.StatusInternalServerError {
+			log.Printf("Failed to load revision %d of %s/%s: %v", revision, namespace, name, err)
+		}
+		writeErrorJSON(w, status, fmt.Sprintf("Failed to load revision: %v", err))
+		return
+	}
+
+	if err := h.storeAs(token, namespace, name, content); err != nil {
+		log.Printf("Failed to store config %s/%s: %v", namespace, name, err)
+		writeErrorJSON(w, storeStatusFor(err), fmt.Sprintf("Failed to store config: %v", err))
+		return
+	}
+	if err := h.recordMetadata(token, namespace, name, content, "", nil, nil, nil); err != nil {
+		writeMetadataError(w, namespace, name, err)
+		return
+	}
+
+	log.Printf("Rolled back config %s/%s to revision %d", namespace, name, revision)
+
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"message":   "Config rolled back successfully",
+		"namespace": namespace,
+		"name":      name,
+		"revision":  revision,
+	})
+}
+
+// GetMetadata handles GET /namespaces/{namespace}/configs/{name}/metadata
+func (h *Handler) GetMetadata(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	namespace := vars["namespace"]
+	name := vars["name"]
+
+	if namespace == "" || name == "" {
+		writeErrorJSON(w, http.StatusBadRequest, "namespace and name are required")
+		return
+	}
+
+	token := h.extractToken(r)
+	if err := h.auth.ValidateToken(namespace, token); err != nil {
+		writeErrorJSON(w, authStatusFor(err), fmt.Sprintf("Authentication failed: %v", err))
+		return
+	}
+
+	md, err := h.loadMetadata(namespace, name, nil)
+	if err != nil {
+		status := storeStatusFor(err)
+		if status == http.StatusInternalServerError {
+			log.Printf("Failed to load metadata of config %s/%s: %v", namespace, name, err)
+		}
+		writeErrorJSON(w, status, fmt.Sprintf("Failed to get metadata: %v", err))
+		return
+	}
+
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"namespace": namespace,
+		"name":      name,
+		"metadata":  md,
+	})
+}
+
+// SetMetadata handles PUT /namespaces/{namespace}/configs/{name}/metadata and
+// replaces a config's labels and annotations from a {"labels": {...},
+// "annotations": {...}} body. The body may also set when the config expires,
+// as expires_at or ttl; an empty one clears it and leaving both out keeps
+// it. The rest of the record describes the content and changes only when
+// the config is written.
+func (h *Handler) SetMetadata(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	namespace := vars["namespace"]
+	name := vars["name"]
+
+	if namespace == "" || name == "" {
+		writeErrorJSON(w, http.StatusBadRequest, "namespace and name are required")
+		return
+	}
+
+	token := h.extractToken(r)
+	if err := h.auth.ValidateToken(namespace, token); err != nil {
+		writeErrorJSON(w, authStatusFor(err), fmt.Sprintf("Authentication failed: %v", err))
+		return
+	}
+
+	defer r.Body.Close()
+	r.Body = http.MaxBytesReader(w, r.Body, MaxAdminBodyBytes)
+
+	var req struct {
+		Labels      map[string]string `json:"labels"`
+		Annotations map[string]string `json:"annotations"`
+		ExpiresAt   *string           `json:"expires_at"`
+		TTL         *string           `json:"ttl"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		if isMaxBytesError(err) {
+			writeErrorJSON(w, http.StatusRequestEntityTooLarge,
+				fmt.Sprintf("Request body exceeds %d bytes", MaxAdminBodyBytes))
+			return
+		}
+		writeErrorJSON(w, http.StatusBadRequest, fmt.Sprintf("Invalid request body: %v", err))
+		return
+	}
+	expires, err := parseExpiry(req.ExpiresAt, req.TTL, time.Now())
+	if err != nil {
+		writeErrorJSON(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	md, err := h.loadMetadata(namespace, name, nil)
+	if err == nil {
+		md.Labels = req.Labels
+		md.Annotations = req.Annotations
+		if expires != nil {
+			md.Expires = *expires
+		}
+		if err = storage.ValidateMetadata(md); err == nil {
+			err = h.store.(storage.MetadataStore).SetMetadata(namespace, name, md)
+		}
+	}
+	if err != nil {
+		status := storeStatusFor(err)
+		if status == http.StatusInternalServerError {
+			log.Printf("Failed to set metadata of config %s/%s: %v", namespace, name, err)
+		}
+		writeErrorJSON(w, status, fmt.Sprintf("Failed to set metadata: %v", err))
+		return
+	}
+
+	log.Printf("Set %d labels and %d annotations on config %s/%s",
+		len(md.Labels), len(md.Annotations), namespace, name)
+
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"namespace": namespace,
+		"name":      name,
+		"metadata":  md,
+	})
+}
+
+// DiffConfig handles GET /namespaces/{namespace}/configs/{name}/diff
+//
+// from and to select revisions (the current content when omitted). With
+// other_namespace the "to" side is read from the same config name in that
+// namespace, authorized by the token in OtherTokenHeader, or by the
+// request's own token when the header is absent.
+func (h *Handler) DiffConfig(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	namespace := vars["namespace"]
+	name := vars["name"]
+
+	if namespace == "" || name == "" {
+		writeErrorJSON(w, http.StatusBadRequest, "namespace and name are required")
+		return
+	}
+
+	token := h.extractToken(r)
+	if err := h.auth.ValidateToken(namespace, token); err != nil {
+		writeErrorJSON(w, authStatusFor(err), fmt.Sprintf("Authentication failed: %v", err))
+		return
+	}
+
+	otherNamespace := r.URL.Query().Get("other_namespace")
+	toNamespace, toToken := namespace, token
+	if otherNamespace != "" {
+		if other := r.Header.Get(OtherTokenHeader); other != "" {
+			toToken = strings.TrimPrefix(other, "Bearer ")
+		}
+		if err := h.auth.ValidateToken(otherNamespace, toToken); err != nil {
+			writeErrorJSON(w, authStatusFor(err), fmt.Sprintf("Authentication failed for %s: %v", otherNamespace, err))
+			return
+		}
+		toNamespace = otherNamespace
+	}
+
+	from, err := queryInt(r, "from")
+	if err != nil {
+		writeErrorJSON(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	to, err := queryInt(r, "to")
+	if err != nil {
+		writeErrorJSON(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	if otherNamespace == "" && from == 0 && to == 0 {
+		writeErrorJSON(w, http.StatusBadRequest, "Specify from/to revisions or other_namespace")
+		return
+	}
+
+	fromContent, err := h.loadConfig(namespace, name, from)
+	if err != nil {
+		writeErrorJSON(w, storeStatusFor(err), fmt.Sprintf("Failed to get config: %v", err))
+		return
+	}
+	toContent, err := h.loadConfig(toNamespace, name, to)
+	if err != nil {
+		writeErrorJSON(w, storeStatusFor(err), fmt.Sprintf("Failed to get config: %v", err))
+		return
+	}
+
+	for _, content := range [][]byte{fromContent, toContent} {
+		if _, err := yamlutil.CheckLimits(content, h.limits); err != nil {
+			writeErrorJSON(w, http.StatusUnprocessableEntity, fmt.Sprintf("Failed to diff config: %v", err))
+			return
+		}
+	}
+	if fromContent, err = h.decrypt(namespace, name, fromContent); err == nil {
+		toContent, err = h.decrypt(toNamespace, name, toContent)
+	}
+	if err != nil {
+		status := cryptStatusFor(err)
+		if status == http.StatusInternalServerError {
+			log.Printf("Failed to decrypt config for diff of %s/%s: %v", namespace, name, err)
+		}
+		writeErrorJSON(w, status, fmt.Sprintf("Failed to decrypt config: %v", err))
+		return
+	}
+	// Both sides are redacted under their own namespace's policy and the
+	// permissions of the token that authorized them, so a change to a
+	// secret value does not show up in the diff.
+	if fromContent, _, err = h.redactFor(token, namespace, fromContent); err == nil {
+		toContent, _, err = h.redactFor(toToken, toNamespace, toContent)
+	}
+	if err != nil {
+		writeErrorJSON(w, http.StatusUnprocessableEntity, fmt.Sprintf("Failed to diff config: %v", err))
+		return
+	}
+	changes, err := yamlutil.StructuralDiff(fromContent, toContent)
+	if err != nil {
+		writeErrorJSON(w, http.StatusUnprocessableEntity, fmt.Sprintf("Failed to diff config: %v", err))
+		return
+	}
+	if changes == nil {
+		changes = []yamlutil.Change{}
+	}
+
+	fromLabel := diffLabel(namespace, name, from)
+	toLabel := diffLabel(toNamespace, name, to)
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"from":    fromLabel,
+		"to":      toLabel,
+		"unified": yamlutil.UnifiedDiff(fromLabel, toLabel, fromContent, toContent, yamlutil.DefaultDiffContext),
+		"changes": changes,
+	})
+}
+
+// diffLabel names one side of a diff, e.g. "dev/app.yaml@3".
+func diffLabel(namespace, name string, revision int) string {
+	label := namespace + "/" + name
+	if revision != 0 {
+		label += "@" + strconv.Itoa(revision)
+	}
+	return label
+}
+
+// PatchConfig handles PATCH /namespaces/{namespace}/configs/{name} and
+// applies a merge patch to one document of the config. Multi-document
+// streams need a document or selector parameter to pick the target.
+func (h *Handler) PatchConfig(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	namespace := vars["namespace"]
+	name := vars["name"]
+
+	if namespace == "" || name == "" {
+		writeErrorJSON(w, http.StatusBadRequest, "namespace and name are required")
+		return
+	}
+
+	token := h.extractToken(r)
+	if err := h.auth.ValidateToken(namespace, token); err != nil {
+		writeErrorJSON(w, authStatusFor(err), fmt.Sprintf("Authentication failed: %v", err))
+		return
+	}
+
+	sel, err := documentSelector(r)
+	if err != nil {
+		writeErrorJSON(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	limit := h.maxConfigBytes(namespace)
+	defer r.Body.Close()
+	r.Body = http.MaxBytesReader(w, r.Body, limit)
+	patch, err := io.ReadAll(r.Body)
+	if err != nil {
+		if isMaxBytesError(err) {
+			writeErrorJSON(w, http.StatusRequestEntityTooLarge,
+				fmt.Sprintf("Request body exceeds %d bytes", limit))
+			return
+		}
+		writeErrorJSON(w, http.StatusBadRequest, fmt.Sprintf("Failed to read request body: %v", err))
+		return
+	}
+	if len(patch) == 0 {
+		writeErrorJSON(w, http.StatusBadRequest, "Request body cannot be empty")
+		return
+	}
+
+	// application/merge-patch+json is recognized through its +json suffix.
+	format := yamlutil.FormatYAML
+	if f, ok := yamlutil.FormatForMediaType(r.Header.Get("Content-Type")); ok {
+		format = f
+	}
+	patch, err = yamlutil.ToYAML(patch, format)
+	if err != nil {
+		writeErrorJSON(w, http.StatusBadRequest, fmt.Sprintf("Invalid %s patch: %v", format, err))
+		return
+	}
+	if _, err := yamlutil.CheckLimits(patch, h.limits); err != nil {
+		writeErrorJSON(w, documentStatusFor(err), fmt.Sprintf("Patch rejected: %v", err))
+		return
+	}
+
+	content, err := h.getConfig(namespace, name)
+	if err != nil {
+		status := storeStatusFor(err)
+		if status == http.StatusInternalServerError {
+			log.Printf("Failed to get config %s/%s: %v", namespace, name, err)
+		}
+		writeErrorJSON(w, status, fmt.Sprintf("Failed to get config: %v", err))
+		return
+	}
+
+	_, err = yamlutil.CheckLimits(content, h.limits)
+	if err == nil {
+		content, err = yamlutil.PatchDocument(content, sel, patch)
+	}
+	if err == nil {
+		// Patches can graft large subtrees, so the result is checked too.
+		_, err = yamlutil.CheckLimits(content, h.limits)
+	}
+	if err != nil {
+		status := documentStatusFor(err)
+		if status == http.StatusInternalServerError {
+			log.Printf("Failed to patch config %s/%s: %v", namespace, name, err)
+		}
+		writeErrorJSON(w, status, fmt.Sprintf("Failed to patch config: %v", err))
+		return
+	}
+	if int64(len(content)) > limit {
+		writeErrorJSON(w, http.StatusRequestEntityTooLarge,
+			fmt.Sprintf("Patched config exceeds %d bytes", limit))
+		return
+	}
+	// The patch is applied to the stored form, so values that are already
+	// encrypted stay sealed and only new values at encrypted paths are
+	// encrypted, with the document's existing data key.
+	content, _, err = h.encryptFor(namespace, name, content)
+	if err != nil {
+		status := cryptStatusFor(err)
+		if status == http.StatusInternalServerError {
+			log.Printf("Failed to encrypt config %s/%s: %v", namespace, name, err)
+		}
+		writeErrorJSON(w, status, fmt.Sprintf("Failed to encrypt config: %v", err))
+		return
+	}
+
+	if err := h.storeAs(token, namespace, name, content); err != nil {
+		log.Printf("Failed to store config %s/%s: %v", namespace, name, err)
+		writeErrorJSON(w, storeStatusFor(err), fmt.Sprintf("Failed to store config: %v", err))
+		return
+	}
+	if err := h.recordMetadata(token, namespace, name, content, "", nil, nil, nil); err != nil {
+		writeMetadataError(w, namespace, name, err)
+		return
+	}
+
+	log.Printf("Patched config %s/%s (%d bytes)", namespace, name, len(content))
+
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"message":   "Config patched successfully",
+		"namespace": namespace,
+		"name":      name,
+		"size":      len(content),
+	})
+}
+
+// DeleteConfig handles DELETE /namespaces/{namespace}/configs/{name}
+func (h *Handler) DeleteConfig(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	namespace := vars["namespace"]
+	name := vars["name"]
+
+	if namespace == "" || name == "" {
+		writeErrorJSON(w, http.StatusBadRequest, "namespace and name are required")
+		return
+	}
+
+	token := h.extractToken(r)
+	if err := h.auth.ValidateToken(namespace, token); err != nil {
+		writeErrorJSON(w, authStatusFor(err), fmt.Sprintf("Authentication failed: %v", err))
+		return
+	}
+
+	permanent, err := queryBool(r, "permanent")
+	if err != nil {
+		writeErrorJSON(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	var item *storage.TrashItem
+	if permanent {
+		err = h.deleteAs(token, namespace, name)
+	} else {
+		item, err = h.trashAs(token, namespace, name)
+	}
+	if err != nil {
+		status := storeStatusFor(err)
+		if status == http.StatusInternalServerError {
+			log.Printf("Failed to delete config %s/%s: %v", namespace, name, err)
+		}
+		writeErrorJSON(w, status, fmt.Sprintf("Failed to delete config: %v", err))
+		return
+	}
+
+	response := map[string]interface{}{
+		"message":   "Config deleted successfully",
+		"namespace": namespace,
+		"name":      name,
+	}
+	if item != nil {
+		log.Printf("Moved config %s/%s to the trash as %s", namespace, name, item.ID)
+		response["message"] = "Config moved to the trash"
+		response["trash_id"] = item.ID
+		response["purge_at"] = item.Deleted.Add(h.trashRetention)
+	} else {
+		log.Printf("Deleted config %s/%s", namespace, name)
+	}
+	writeJSON(w, http.StatusOK, response)
+}
+
+// trashItemInfo is a trash item as listed, with the time it will be purged.
+type trashItemInfo struct {
+	storage.TrashItem
+	PurgeAt *time.Time `json:"purge_at,omitempty"`
+}
+
+// trashRequest authenticates a request to a namespace's trash and returns
+// the store's trash, or writes the error response and returns false.
+func (h *Handler) trashRequest(w http.ResponseWriter, r *http.Request) (storage.Trasher, string, string, bool) {
+	namespace := mux.Vars(r)["namespace"]
+	if namespace == "" {
+		writeErrorJSON(w, http.StatusBadRequest, "namespace is required")
+		return nil, "", "", false
+	}
+
+	token := h.extractToken(r)
+	if err := h.auth.ValidateToken(namespace, token); err != nil {
+		writeErrorJSON(w, authStatusFor(err), fmt.Sprintf("Authentication failed: %v", err))
+		return nil, "", "", false
+	}
+
+	trasher, ok := h.store.(storage.Trasher)
+	if !ok {
+		writeErrorJSON(w, http.StatusNotImplemented, "The trash is not supported by the configured storage backend")
+		return nil, "", "", false
+	}
+	return trasher, namespace, token, true
+}
+
+// writeTrashError reports a failed trash operation.
+func writeTrashError(w http.ResponseWriter, action, namespace string, err error) {
+	status := storeStatusFor(err)
+	if status == http.StatusInternalServerError {
+		log.Printf("Failed to %s trash of namespace %s: %v", action, namespace, err)
+	}
+	writeErrorJSON(w, status, fmt.Sprintf("Failed to %s trash: %v", action, err))
+}
+
+// ListTrash handles GET /namespaces/{namespace}/trash. Items are listed
+// oldest first.
+func (h *Handler) ListTrash(w http.ResponseWriter, r *http.Request) {
+	trasher, namespace, _, ok := h.trashRequest(w, r)
+	if !ok {
+		return
+	}
+
+	items, err := trasher.TrashItems(namespace)
+	if err != nil {
+		writeTrashError(w, "list", namespace, err)
+		return
+	}
+	infos := make([]trashItemInfo, len(items))
+	for i, item := range items {
+		infos[i].TrashItem = item
+		if h.trashRetention > 0 {
+			purgeAt := item.Deleted.Add(h.trashRetention)
+			infos[i].PurgeAt = &purgeAt
+		}
+	}
+
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"namespace": namespace,
+		"items":     infos,
+		"count":     len(infos),
+	})
+}
+
+// RestoreTrash handles POST /namespaces/{namespace}/trash/{id}/restore. The
+// item is restored as the config it was deleted from, or as the one given
+// by the name parameter. If that config exists, the restore fails with 409
+// Conflict unless the overwrite parameter is set. An expiry the config had
+// that has since passed is cleared.
+func (h *Handler) RestoreTrash(w http.ResponseWriter, r *http.Request) {
+	trasher, namespace, token, ok := h.trashRequest(w, r)
+	if !ok {
+		return
+	}
+	id := mux.Vars(r)["id"]
+	overwrite, err := queryBool(r, "overwrite")
+	if err != nil {
+		writeErrorJSON(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	opts := storage.RestoreOptions{Name: r.URL.Query().Get("name"), Overwrite: overwrite}
+
+	items, err := trasher.TrashItems(namespace)
+	if err != nil {
+		writeTrashError(w, "read", namespace, err)
+		return
+	}
+	idx := slices.IndexFunc(items, func(item storage.TrashItem) bool { return item.ID == id })
+	if idx < 0 {
+		writeErrorJSON(w, http.StatusNotFound, fmt.Sprintf("Failed to restore config: trash item %s in namespace %s: %v",
+			id, namespace, storage.ErrNotFound))
+		return
+	}
+	name := opts.Name
+	if name == "" {
+		name = items[idx].Name
+	}
+	// Encrypted values are bound to the config they were written to, so a
+	// config restored under another name is re-encrypted for it.
+	opts.Rewrite = func(item storage.TrashItem, content []byte) ([]byte, error) {
+		return fieldcrypt.Rebind(content, fieldcrypt.Scope{Namespace: namespace, Name: item.Name},
+			fieldcrypt.Scope{Namespace: namespace, Name: name}, h.keyring)
+	}
+	// Items are sized as the store holds them, which is what the restored
+	// config will take up too; under encryption at rest that is a little
+	// more than was written.
+	if err := h.checkQuotaSize(namespace, name, items[idx].Size, items[idx].Size); err != nil {
+		writeErrorJSON(w, storeStatusFor(err), fmt.Sprintf("Failed to restore config: %v", err))
+		return
+	}
+
+	item, err := trasher.Restore(h.authorFor(namespace, token), namespace, id, opts)
+	if err != nil {
+		status := storeStatusFor(err)
+		if status == http.StatusInternalServerError {
+			log.Printf("Failed to restore trash item %s in namespace %s: %v", id, namespace, err)
+		}
+		writeErrorJSON(w, status, fmt.Sprintf("Failed to restore config: %v", err))
+		return
+	}
+	h.pruneRevisions(namespace, item.Name)
+	content, err := h.store.Get(namespace, item.Name)
+	if err == nil {
+		err = h.recordMetadata(token, namespace, item.Name, content, "", nil, nil, nil)
+	}
+	if err != nil {
+		writeMetadataError(w, namespace, item.Name, err)
+		return
+	}
+
+	log.Printf("Restored config %s/%s from the trash", namespace, item.Name)
+
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"message":   "Config restored successfully",
+		"namespace": namespace,
+		"name":      item.Name,
+		"id":        item.ID,
+	})
+}
+
+// PurgeTrashItem handles DELETE /namespaces/{namespace}/trash/{id}
+func (h *Handler) PurgeTrashItem(w http.ResponseWriter, r *http.Request) {
+	trasher, namespace, _, ok := h.trashRequest(w, r)
+	if !ok {
+		return
+	}
+	id := mux.Vars(r)["id"]
+
+	if err := trasher.Purge(namespace, id); err != nil {
+		writeTrashError(w, "purge", namespace, err)
+		return
+	}
+
+	log.Printf("Purged trash item %s in namespace %s", id, namespace)
+
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"message":   "Trash item purged successfully",
+		"namespace": namespace,
+		"id":        id,
+	})
+}
+
+// EmptyTrash handles DELETE /namespaces/{namespace}/trash, purging every
+// item in the namespace's trash.
+func (h *Handler) EmptyTrash(w http.ResponseWriter, r *http.Request) {
+	trasher, namespace, _, ok := h.trashRequest(w, r)
+	if !ok {
+		return
+	}
+
+	items, err := trasher.TrashItems(namespace)
+	if err != nil {
+		writeTrashError(w, "empty", namespace, err)
+		return
+	}
+	purged := 0
+	for _, item := range items {
+		err := trasher.Purge(namespace, item.ID)
+		if errors.Is(err, storage.ErrNotFound) {
+			continue // restored or purged meanwhile
+		}
+		if err != nil {
+			writeTrashError(w, "empty", namespace, err)
+			return
+		}
+		purged++
+	}
+
+	log.Printf("Emptied trash of namespace %s, purging %d items", namespace, purged)
+
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"message":   "Trash emptied successfully",
+		"namespace": namespace,
+		"purged":    purged,
+	})
+}
+
+// batchOperation is one operation of a batch update. A put stores content,
+// a patch merges patch into the selected document of the config, and a
+// delete moves the config to the trash, or removes it for good when marked
+// Permanent. IfSHA256 and IfExists are preconditions on the config as the
+// batch finds it, after the operations before it.
+type batchOperation struct {
+	Op          string            `json:"op"`
+	Name        string            `json:"name"`
+	Content     string            `json:"content,omitempty"`
+	Patch       string            `json:"patch,omitempty"`
+	ContentType string            `json:"content_type,omitempty"`
+	Document    *int              `json:"document,omitempty"`
+	Selector    string            `json:"selector,omitempty"`
+	Labels      map[string]string `json:"labels,omitempty"`
+	Annotations map[string]string `json:"annotations,omitempty"`
+	ExpiresAt   *string           `json:"expires_at,omitempty"`
+	TTL         *string           `json:"ttl,omitempty"`
+	IfSHA256    string            `json:"if_sha256,omitempty"`
+	IfExists    *bool             `json:"if_exists,omitempty"`
+	Permanent   bool              `json:"permanent,omitempty"`
+}
+
+// batchRequest is the body of a batch update.
+type batchRequest struct {
+	Operations []batchOperation `json:"operations"`
+}
+
+// batchResult reports an applied operation. Size and SHA256 describe the
+// stored content of puts and patches; TrashID and PurgeAt the trash item of
+// deletes that kept one.
+type batchResult struct {
+	Index   int        `json:"index"`
+	Op      string     `json:"op"`
+	Name    string     `json:"name"`
+	Size    int        `json:"size,omitempty"`
+	SHA256  string     `json:"sha256,omitempty"`
+	TrashID string     `json:"trash_id,omitempty"`
+	PurgeAt *time.Time `json:"purge_at,omitempty"`
+}
+
+// batchError is the failure of one operation, which aborts its batch.
+type batchError struct {
+	index  int
+	name   string
+	status int
+	err    error
+}
+
+func (e *batchError) Error() string {
+	return fmt.Sprintf("operation %d (%s): %v", e.index, e.name, e.err)
+}
+
+func (e *batchError) Unwrap() error { return e.err }
+
+// errPreconditionFailed is returned when a batch operation's precondition
+// does not hold.
+var errPreconditionFailed = errors.New("precondition failed")
+
+// preparedOperation is a batch operation whose input was checked before the
+// batch runs: the stored form of a put's content, or a patch as YAML.
+type preparedOperation struct {
+	batchOperation
+	format   yamlutil.Format
+	content  []byte
+	patch    []byte
+	selector yamlutil.Selector
+	expires  *time.Time
+}
+
+// prepareBatchOperation checks what an operation can be checked for
+// without reading the store.
+func (h *Handler) prepareBatchOperation(namespace string, op batchOperation) (preparedOperation, int, error) {
+	p := preparedOperation{batchOperation: op, format: yamlutil.FormatYAML}
+	if op.Name == "" {
+		return p, http.StatusBadRequest, errors.New("name is required")
+	}
+	if f, ok := yamlutil.FormatForMediaType(op.ContentType); ok {
+		p.format = f
+	}
+	switch op.Op {
+	case "put":
+		if op.Content == "" {
+			return p, http.StatusBadRequest, errors.New("content cannot be empty")
+		}
+		if err := storage.ValidateMetadata(storage.Metadata{Labels: op.Labels, Annotations: op.Annotations}); err != nil {
+			return p, http.StatusBadRequest, err
+		}
+		var err error
+		if p.expires, err = parseExpiry(op.ExpiresAt, op.TTL, time.Now()); err != nil {
+			return p, http.StatusBadRequest, err
+		}
+		content, err := yamlutil.ToYAML([]byte(op.Content), p.format)
+		if err != nil {
+			return p, http.StatusBadRequest, fmt.Errorf("invalid %s document: %v", p.format, err)
+		}
+		if _, err := yamlutil.CheckLimits(content, h.limits); err != nil {
+			return p, documentStatusFor(err), fmt.Errorf("config rejected: %v", err)
+		}
+		if p.content, _, err = h.encryptFor(namespace, op.Name, content); err != nil {
+			return p, cryptStatusFor(err), fmt.Errorf("failed to encrypt config: %v", err)
+		}
+		if limit := h.maxConfigBytes(namespace); int64(len(p.content)) > limit {
+			return p, http.StatusRequestEntityTooLarge, fmt.Errorf("%w: config exceeds %d bytes", errConfigTooLarge, limit)
+		}
+	case "patch":
+		if op.Patch == "" {
+			return p, http.StatusBadRequest, errors.New("patch cannot be empty")
+		}
+		if op.Labels != nil || op.Annotations != nil || op.ExpiresAt != nil || op.TTL != nil {
+			return p, http.StatusBadRequest, errors.New("labels, annotations and expiry can only be set by puts")
+		}
+		index := ""
+		if op.Document != nil {
+			index = strconv.Itoa(*op.Document)
+		}
+		var err error
+		if p.selector, err = parseDocumentSelector(index, op.Selector); err != nil {
+			return p, http.StatusBadRequest, err
+		}
+		if p.patch, err = yamlutil.ToYAML([]byte(op.Patch), p.format); err != nil {
+			return p, http.StatusBadRequest, fmt.Errorf("invalid %s patch: %v", p.format, err)
+		}
+		if _, err := yamlutil.CheckLimits(p.patch, h.limits); err != nil {
+			return p, documentStatusFor(err), fmt.Errorf("patch rejected: %v", err)
+		}
+	case "delete":
+		if op.Content != "" || op.Patch != "" || op.Labels != nil || op.Annotations != nil || op.ExpiresAt != nil || op.TTL != nil {
+			return p, http.StatusBadRequest, errors.New("deletes take no content, patch, labels, annotations or expiry")
+		}
+	default:
+		return p, http.StatusBadRequest, fmt.Errorf("unknown op %q; want put, patch or delete", op.Op)
+	}
+	return p, 0, nil
+}
+
+// applyBatchOperation applies a prepared operation in tx and returns the
+// content it stored, if any, or the trash item a delete kept.
+func (h *Handler) applyBatchOperation(tx storage.Tx, token, namespace string, op preparedOperation) (current, stored []byte, item *storage.TrashItem, status int, err error) {
+	current, err = tx.Get(op.Name)
+	exists := err == nil
+	if err != nil && !errors.Is(err, storage.ErrNotFound) {
+		return nil, nil, nil, storeStatusFor(err), err
+	}
+	if op.IfExists != nil && *op.IfExists != exists {
+		if exists {
+			return nil, nil, nil, http.StatusPreconditionFailed, fmt.Errorf("%w: config exists", errPreconditionFailed)
+		}
+		return nil, nil, nil, http.StatusPreconditionFailed, fmt.Errorf("%w: config does not exist", errPreconditionFailed)
+	}
+	if op.IfSHA256 != "" && (!exists || !strings.EqualFold(contentSHA256(current), op.IfSHA256)) {
+		return nil, nil, nil, http.StatusPreconditionFailed, fmt.Errorf("%w: config does not have SHA-256 %s", errPreconditionFailed, op.IfSHA256)
+	}
+
+	switch op.Op {
+	case "put":
+		stored = op.content
+	case "patch":
+		if !exists {
+			return nil, nil, nil, http.StatusNotFound, err
+		}
+		_, err = yamlutil.CheckLimits(current, h.limits)
+		if err == nil {
+			stored, err = yamlutil.PatchDocument(current, op.selector, op.patch)
+		}
+		if err == nil {
+			_, err = yamlutil.CheckLimits(stored, h.limits)
+		}
+		if err != nil {
+			return nil, nil, nil, documentStatusFor(err), fmt.Errorf("failed to patch config: %v", err)
+		}
+		if limit := h.maxConfigBytes(namespace); int64(len(stored)) > limit {
+			return nil, nil, nil, http.StatusRequestEntityTooLarge, fmt.Errorf("%w: patched config exceeds %d bytes", errConfigTooLarge, limit)
+		}
+		if stored, _, err = h.encryptFor(namespace, op.Name, stored); err != nil {
+			return nil, nil, nil, cryptStatusFor(err), fmt.Errorf("failed to encrypt config: %v", err)
+		}
+	case "delete":
+		if !exists {
+			return nil, nil, nil, http.StatusNotFound, err
+		}
+		if item, err = h.trashIn(tx, token, namespace, op); err != nil {
+			return nil, nil, nil, storeStatusFor(err), err
+		}
+		return current, nil, item, 0, nil
+	}
+	if err := tx.Store(op.Name, stored); err != nil {
+		return nil, nil, nil, storeStatusFor(err), err
+	}
+	return current, stored, nil, 0, nil
+}
+
+// trashIn deletes the config of a batch delete in tx, moving it to the
+// trash as trashAs would unless the operation is marked permanent. It
+// returns a nil item when the config was deleted for good.
+func (h *Handler) trashIn(tx storage.Tx, token, namespace string, op preparedOperation) (*storage.TrashItem, error) {
+	if _, ok := h.store.(storage.Trasher); ok && h.trashRetention > 0 && !op.Permanent {
+		if trasher, ok := tx.(storage.TrashTx); ok {
+			item, err := trasher.Trash(h.authorFor(namespace, token), op.Name)
+			if !errors.Is(err, storage.ErrUnsupported) {
+				if err != nil {
+					return nil, err
+				}
+				return &item, nil
+			}
+		}
+	}
+	return nil, tx.Delete(op.Name)
+}
+
+// expiredTx is a Tx in which the expired configs do not exist until they
+// are written again.
+type expiredTx struct {
+	storage.Tx
+	namespace string
+	expired   map[string]bool
+}
+
+func (t expiredTx) Get(name string) ([]byte, error) {
+	if t.expired[name] {
+		return nil, errExpired(t.namespace, name)
+	}
+	return t.Tx.Get(name)
+}
+
+func (t expiredTx) Store(name string, content []byte) error {
+	if err := t.Tx.Store(name, content); err != nil {
+		return err
+	}
+	delete(t.expired, name)
+	return nil
+}
+
+func (t expiredTx) Delete(name string) error {
+	if t.expired[name] {
+		return errExpired(t.namespace, name)
+	}
+	return t.Tx.Delete(name)
+}
+
+func (t expiredTx) Trash(author storage.Author, name string) (storage.TrashItem, error) {
+	if t.expired[name] {
+		return storage.TrashItem{}, errExpired(t.namespace, name)
+	}
+	trasher, ok := t.Tx.(storage.TrashTx)
+	if !ok {
+		return storage.TrashItem{}, fmt.Errorf("trash: %w", storage.ErrUnsupported)
+	}
+	return trasher.Trash(author, name)
+}
+
+// BatchConfigs handles POST /namespaces/{namespace}/batch. It applies a
+// list of puts, patches and deletes all-or-nothing: if any operation fails,
+// including on its precondition, none is applied. Metadata records are
+// updated once the batch is applied.
+func (h *Handler) BatchConfigs(w http.ResponseWriter, r *http.Request) {
+	namespace := mux.Vars(r)["namespace"]
+	if namespace == "" {
+		writeErrorJSON(w, http.StatusBadRequest, "namespace is required")
+		return
+	}
+
+	token := h.extractToken(r)
+	if err := h.auth.ValidateToken(namespace, token); err != nil {
+		writeErrorJSON(w, authStatusFor(err), fmt.Sprintf("Authentication failed: %v", err))
+		return
+	}
+
+	transactional, ok := h.store.(storage.Transactional)
+	if !ok {
+		writeErrorJSON(w, http.StatusNotImplemented, "Storage backend does not support batch updates")
+		return
+	}
+
+	defer r.Body.Close()
+	r.Body = http.MaxBytesReader(w, r.Body, MaxBatchBodyBytes)
+	var req batchRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		if isMaxBytesError(err) {
+			writeErrorJSON(w, http.StatusRequestEntityTooLarge,
+				fmt.Sprintf("Request body exceeds %d bytes", MaxBatchBodyBytes))
+			return
+		}
+		writeErrorJSON(w, http.StatusBadRequest, fmt.Sprintf("Invalid request body: %v", err))
+		return
+	}
+	if len(req.Operations) == 0 {
+		writeErrorJSON(w, http.StatusBadRequest, "operations cannot be empty")
+		return
+	}
+	if len(req.Operations) > MaxBatchOperations {
+		writeErrorJSON(w, http.StatusRequestEntityTooLarge,
+			fmt.Sprintf("Batch exceeds %d operations", MaxBatchOperations))
+		return
+	}
+
+	ops := make([]preparedOperation, len(req.Operations))
+	for i, op := range req.Operations {
+		p, status, err := h.prepareBatchOperation(namespace, op)
+		if err != nil {
+			writeBatchError(w, namespace, &batchError{index: i, name: op.Name, status: status, err: err})
+			return
+		}
+		ops[i] = p
+	}
+
+	// Usage is read before the batch locks the namespace, so concurrent
+	// writes may together overshoot the quota slightly, as with single
+	// writes.
+	q := h.policy.Quota(namespace)
+	var usage storage.NamespaceUsage
+	if q.MaxConfigs > 0 || q.MaxBytes > 0 {
+		var err error
+		if usage, err = storage.UsageOf(h.store, namespace); err != nil {
+			writeBatchError(w, namespace, err)
+			return
+		}
+	}
+
+	// Expiry is read before the batch locks the namespace too; the batch
+	// sees expired configs as deleted.
+	expired := make(map[string]bool)
+	for _, op := range ops {
+		if h.expired(namespace, op.Name) {
+			expired[op.Name] = true
+		}
+	}
+
+	results := make([]batchResult, len(ops))
+	stored := make([][]byte, len(ops))
+	err := transactional.Update(namespace, func(tx storage.Tx) error {
+		tx = expiredTx{Tx: tx, namespace: namespace, expired: expired}
+		var configs int
+		var growth int64
+		for i, op := range ops {
+			current, content, item, status, err := h.applyBatchOperation(tx, token, namespace, op)
+			if err != nil {
+				return &batchError{index: i, name: op.Name, status: status, err: err}
+			}
+			switch {
+			case op.Op == "delete":
+				configs--
+			case current == nil:
+				configs++
+			}
+			growth += h.storedSize(content) - h.storedSize(current)
+			stored[i] = content
+			results[i] = batchResult{Index: i, Op: op.Op, Name: op.Name}
+			if content != nil {
+				results[i].Size = len(content)
+				results[i].SHA256 = contentSHA256(content)
+			}
+			if item != nil {
+				purgeAt := item.Deleted.Add(h.trashRetention)
+				results[i].TrashID = item.ID
+				results[i].PurgeAt = &purgeAt
+			}
+		}
+		// As with single writes, a batch that does not grow the namespace
+		// is always allowed.
+		if q.MaxConfigs > 0 && configs > 0 && usage.Configs+configs > q.MaxConfigs {
+			return fmt.Errorf("%w: namespace %s would hold %d of %d configs",
+				errQuotaExceeded, namespace, usage.Configs+configs, q.MaxConfigs)
+		}
+		if q.MaxBytes > 0 && growth > 0 && usage.Bytes+growth > q.MaxBytes {
+			return fmt.Errorf("%w: namespace %s would hold %d of %d bytes",
+				errQuotaExceeded, namespace, usage.Bytes+growth, q.MaxBytes)
+		}
+		return nil
+	})
+	if err != nil {
+		writeBatchError(w, namespace, err)
+		return
+	}
+
+	// Only the last write of each config leaves a record.
+	last := make(map[string]int, len(ops))
+	for i, op := range ops {
+		last[op.Name] = i
+	}
+	for i, op := range ops {
+		if last[op.Name] != i || stored[i] == nil {
+			continue
+		}
+		contentType := ""
+		if op.Op == "put" {
+			contentType = op.format.ContentType()
+		}
+		if err := h.recordMetadata(token, namespace, op.Name, stored[i], contentType, op.Labels, op.Annotations, op.expires); err != nil {
+			writeMetadataError(w, namespace, op.Name, err)
+			return
+		}
+		h.pruneRevisions(namespace, op.Name)
+	}
+
+	log.Printf("Applied batch of %d operations in namespace %s", len(ops), namespace)
+
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"message":   "Batch applied successfully",
+		"namespace": namespace,
+		"count":     len(results),
+		"results":   results,
+	})
+}
+
+// writeBatchError reports a batch that was not applied, with the index and
+// name of the operation that failed when there was one, or one that the
+// store applied in part and will complete.
+func writeBatchError(w http.ResponseWriter, namespace string, err error) {
+	if errors.Is(err, storage.ErrIncomplete) {
+		log.Printf("Failed to apply batch in namespace %s: %v", namespace, err)
+		writeErrorJSON(w, http.StatusInternalServerError,
+			fmt.Sprintf("Batch applied in part; the rest will be applied before the next write: %v", err))
+		return
+	}
+	var opErr *batchError
+	if !errors.As(err, &opErr) {
+		status := storeStatusFor(err)
+		if status == http.StatusInternalServerError {
+			log.Printf("Failed to apply batch in namespace %s: %v", namespace, err)
+		}
+		writeErrorJSON(w, status, fmt.Sprintf("Batch not applied: %v", err))
+		return
+	}
+	if opErr.status == http.StatusInternalServerError {
+		log.Printf("Failed to apply batch in namespace %s: %v", namespace, opErr)
+	}
+	writeJSON(w, opErr.status, map[string]interface{}{
+		"error": fmt.Sprintf("Batch not applied: %v", opErr),
+		"index": opErr.index,
+		"name":  opErr.name,
+	})
+}
+
+// MaxBulkConfigs caps the number of configs a bulk fetch returns.
+const MaxBulkConfigs = 100
+
+// Bulk fetch response types.
+const (
+	bulkJSON      = "application/json"
+	bulkMultipart = "multipart/mixed"
+	bulkTar       = "application/x-tar"
+)
+
+// bulkFormatFor picks the bulk fetch response type for an Accept header,
+// by q-value and then order. JSON is the default; the boolean is false when
+// the client ruled out every type.
+func bulkFormatFor(accept string) (string, bool) {
+	if strings.TrimSpace(accept) == "" {
+		return bulkJSON, true
+	}
+	best, bestQ := "", 0.0
+	for _, part := range strings.Split(accept, ",") {
+		mt, params, err := mime.ParseMediaType(strings.TrimSpace(part))
+		if err != nil {
+			continue
+		}
+		q := 1.0
+		if v, ok := params["q"]; ok {
+			if parsed, err := strconv.ParseFloat(v, 64); err == nil {
+				q = parsed
+			}
+		}
+		switch mt {
+		case "*/*", "application/*":
+			mt = bulkJSON
+		case "multipart/*":
+			mt = bulkMultipart
+		case bulkJSON, bulkMultipart, bulkTar:
+		default:
+			continue
+		}
+		if q > bestQ {
+			best, bestQ = mt, q
+		}
+	}
+	return best, best != ""
+}
+
+// bulkItem is one config of a bulk fetch: its content, or why it could not
+// be returned. SHA256 is that of the stored content, as in its metadata.
+type bulkItem struct {
+	Status   int    `json:"status"`
+	Content  string `json:"content,omitempty"`
+	Size     int    `json:"size,omitempty"`
+	SHA256   string `json:"sha256,omitempty"`
+	Redacted bool   `json:"redacted,omitempty"`
+	Error    string `json:"error,omitempty"`
+
+	name string
+}
+
+// errTooManyConfigs is returned when a bulk fetch asks for more than
+// MaxBulkConfigs configs.
+var errTooManyConfigs = errors.New("too many configs")
+
+// readBulk reads the named configs and those matching glob with get and
+// list, named ones first and then matches in byte order, each once.
+func readBulk(names []string, glob string, get func(string) ([]byte, error), list func() ([]string, error)) ([]string, map[string][]byte, map[string]error, error) {
+	order := slices.Clone(names)
+	if glob != "" {
+		all, err := list()
+		if err != nil {
+			return nil, nil, nil, err
+		}
+		slices.Sort(all)
+		for _, name := range all {
+			if ok, _ := path.Match(glob, name); ok {
+				order = append(order, name)
+			}
+		}
+	}
+	seen := make(map[string]bool, len(order))
+	order = slices.DeleteFunc(order, func(name string) bool {
+		dup := seen[name]
+		seen[name] = true
+		return dup
+	})
+	if len(order) > MaxBulkConfigs {
+		return nil, nil, nil, fmt.Errorf("%w: %d configs requested, at most %d are returned at once",
+			errTooManyConfigs, len(order), MaxBulkConfigs)
+	}
+
+	contents := make(map[string][]byte, len(order))
+	errs := make(map[string]error)
+	for _, name := range order {
+		content, err := get(name)
+		if err != nil {
+			errs[name] = err
+			continue
+		}
+		contents[name] = content
+	}
+	return order, contents, errs, nil
+}
+
+// BulkConfigs handles GET /namespaces/{namespace}/bulk. It returns the
+// configs given by repeated name parameters and those matching the glob
+// parameter in one response: a JSON map, a multipart/mixed body or a tar
+// stream, as the Accept header asks. A config that cannot be returned is
+// reported in its place. When the store supports it, every config is read
+// from the same point in time.
+func (h *Handler) BulkConfigs(w http.ResponseWriter, r *http.Request) {
+	namespace := mux.Vars(r)["namespace"]
+	if namespace == "" {
+		writeErrorJSON(w, http.StatusBadRequest, "namespace is required")
+		return
+	}
+
+	token := h.extractToken(r)
+	if err := h.auth.ValidateToken(namespace, token); err != nil {
+		writeErrorJSON(w, authStatusFor(err), fmt.Sprintf("Authentication failed: %v", err))
+		return
+	}
+
+	names := r.URL.Query()["name"]
+	glob := r.URL.Query().Get("glob")
+	if len(names) == 0 && glob == "" {
+		writeErrorJSON(w, http.StatusBadRequest, "name or glob is required")
+		return
+	}
+	if _, err := path.Match(glob, ""); err != nil {
+		writeErrorJSON(w, http.StatusBadRequest, fmt.Sprintf("Invalid glob %q: %v", glob, err))
+		return
+	}
+	format, ok := bulkFormatFor(r.Header.Get("Accept"))
+	if !ok {
+		writeErrorJSON(w, http.StatusNotAcceptable,
+			"Supported response types are application/json, multipart/mixed and application/x-tar")
+		return
+	}
+
+	var order []string
+	var contents map[string][]byte
+	var errs map[string]error
+	read := func(get func(string) ([]byte, error), list func() ([]string, error)) error {
+		var err error
+		order, contents, errs, err = readBulk(names, glob, get, list)
+		return err
+	}
+	snapshot := false
+	err := storage.ErrUnsupported
+	if viewer, ok := h.store.(storage.Viewer); ok {
+		err = viewer.View(namespace, func(tx storage.ReadTx) error {
+			return read(tx.Get, tx.List)
+		})
+		snapshot = err == nil
+	}
+	if errors.Is(err, storage.ErrUnsupported) {
+		err = read(func(name string) ([]byte, error) {
+			return h.store.Get(namespace, name)
+		}, func() ([]string, error) {
+			return h.store.List(namespace)
+		})
+	}
+	if errors.Is(err, errTooManyConfigs) {
+		writeErrorJSON(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	if err != nil {
+		status := storeStatusFor(err)
+		if status == http.StatusInternalServerError {
+			log.Printf("Failed to read configs of namespace %s: %v", namespace, err)
+		}
+		writeErrorJSON(w, status, fmt.Sprintf("Failed to read configs: %v", err))
+		return
+	}
+
+	// Expired configs are reported as not found when named, and left out
+	// when only matched by the glob.
+	items := make([]bulkItem, 0, len(order))
+	for _, name := range order {
+		err := errs[name]
+		if err == nil && h.expired(namespace, name) {
+			if !slices.Contains(names, name) {
+				continue
+			}
+			err = errExpired(namespace, name)
+		}
+		items = append(items, h.bulkItemFor(token, namespace, name, contents[name], err))
+	}
+
+	log.Printf("Retrieved %d configs from namespace %s in bulk", len(items), namespace)
+
+	w.Header().Set(SnapshotHeader, strconv.FormatBool(snapshot))
+	switch format {
+	case bulkMultipart:
+		writeBulkMultipart(w, items)
+	case bulkTar:
+		writeBulkTar(w, items)
+	default:
+		configs := make(map[string]bulkItem, len(items))
+		for _, item := range items {
+			configs[item.name] = item
+		}
+		writeJSON(w, http.StatusOK, map[string]interface{}{
+			"namespace": namespace,
+			"snapshot":  snapshot,
+			"count":     len(items),
+			"configs":   configs,
+		})
+	}
+}
+
+// bulkItemFor prepares a config read by a bulk fetch as GetConfig would
+// serve it as stored YAML: decrypted and, unless the token may read
+// secrets, redacted.
+func (h *Handler) bulkItemFor(token, namespace, name string, content []byte, err error) bulkItem {
+	item := bulkItem{name: name}
+	fail := func(status int, err error) bulkItem {
+		if status == http.StatusInternalServerError {
+			log.Printf("Failed to get config %s/%s: %v", namespace, name, err)
+		}
+		return bulkItem{name: name, Status: status, Error: err.Error()}
+	}
+	if err != nil {
+		return fail(storeStatusFor(err), err)
+	}
+	item.SHA256 = contentSHA256(content)
+
+	redactSecrets := !h.auth.HasPermission(token, auth.PermReadSecrets) && h.mayHoldSecrets(namespace, content)
+	decrypt := fieldcrypt.HasMetadata(content)
+	if redactSecrets || decrypt {
+		if _, err := yamlutil.CheckLimits(content, h.limits); err != nil {
+			return fail(renderStatusFor(err), fmt.Errorf("failed to parse config: %w", err))
+		}
+	}
+	if decrypt {
+		if content, err = h.decrypt(namespace, name, content); err != nil {
+			return fail(cryptStatusFor(err), fmt.Errorf("failed to decrypt config: %w", err))
+		}
+	}
+	if redactSecrets {
+		if content, item.Redacted, err = h.redactFor(token, namespace, content); err != nil {
+			return fail(renderStatusFor(err), fmt.Errorf("failed to redact config: %w", err))
+		}
+	}
+	item.Status = http.StatusOK
+	item.Content = string(content)
+	item.Size = len(content)
+	return item
+}
+
+// writeBulkMultipart writes a bulk fetch as multipart/mixed, one part per
+// config named by its Content-Disposition filename. Each part carries its
+// status in StatusHeader, and a config that could not be returned has a
+// JSON error body.
+func writeBulkMultipart(w http.ResponseWriter, items []bulkItem) {
+	mw := multipart.NewWriter(w)
+	w.Header().Set("Content-Type", mime.FormatMediaType(bulkMultipart, map[string]string{"boundary": mw.Boundary()}))
+	w.WriteHeader(http.StatusOK)
+	for _, item := range items {
+		header := textproto.MIMEHeader{}
+		header.Set("Content-Disposition", mime.FormatMediaType("attachment", map[string]string{"filename": item.name}))
+		header.Set(StatusHeader, strconv.Itoa(item.Status))
+		body := []byte(item.Content)
+		if item.Error != "" {
+			header.Set("Content-Type", "application/json")
+			body, _ = json.Marshal(map[string]string{"error": item.Error})
+		} else {
+			header.Set("Content-Type", yamlutil.FormatYAML.ContentType())
+			header.Set(ContentSHA256Header, item.SHA256)
+			if item.Redacted {
+				header.Set(RedactedHeader, "true")
+			}
+		}
+		part, err := mw.CreatePart(header)
+		if err != nil {
+			log.Printf("Failed to write bulk response: %v", err)
+			return
+		}
+		if _, err := part.Write(body); err != nil {
+			log.Printf("Failed to write bulk response: %v", err)
+			return
+		}
+	}
+	if err := mw.Close(); err != nil {
+		log.Printf("Failed to write bulk response: %v", err)
+	}
+}
+
+// writeBulkTar writes a bulk fetch as a tar stream with a file per config.
+// A config that could not be returned is replaced by a <name>.error file
+// holding the status and error.
+func writeBulkTar(w http.ResponseWriter, items []bulkItem) {
+	w.Header().Set("Content-Type", bulkTar)
+	w.WriteHeader(http.StatusOK)
+	tw := tar.NewWriter(w)
+	now := time.Now().UTC()
+	for _, item := range items {
+		name, body := item.name, []byte(item.Content)
+		if item.Error != "" {
+			name, body = item.name+".error", []byte(fmt.Sprintf("%d %s\n", item.Status, item.Error))
+		}
+		if err := tw.WriteHeader(&tar.Header{Name: name, Mode: 0o644, Size: int64(len(body)), ModTime: now}); err != nil {
+			log.Printf("Failed to write bulk response: %v", err)
+			return
+		}
+		if _, err := tw.Write(body); err != nil {
+			log.Printf("Failed to write bulk response: %v", err)
+			return
+		}
+	}
+	if err := tw.Close(); err != nil {
+		log.Printf("Failed to write bulk response: %v", err)
+	}
+}
+
+// ListConfigs handles GET /namespaces/{namespace}/configs
+func (h *Handler) ListConfigs(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	namespace := vars["namespace"]
+
+	if namespace == "" {
+		writeErrorJSON(w, http.StatusBadRequest, "namespace is required")
+		return
+	}
+
+	token := h.extractToken(r)
+	if err := h.auth.ValidateToken(namespace, token); err != nil {
+		writeErrorJSON(w, authStatusFor(err), fmt.Sprintf("Authentication failed: %v", err))
+		return
+	}
+
+	opts, err := listOptions(r)
+	if err != nil {
+		writeErrorJSON(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	detail, err := queryBool(r, "detail")
+	if err != nil {
+		writeErrorJSON(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	page, err := storage.Query(h.store, namespace, opts)
+	if err != nil {
+		status := storeStatusFor(err)
+		if status == http.StatusInternalServerError {
+			log.Printf("Failed to list configs for namespace %s: %v", namespace, err)
+		}
+		writeErrorJSON(w, status, fmt.Sprintf("Failed to list configs: %v", err))
+		return
+	}
+	configs := h.dropExpired(namespace, page.Names)
+
+	log.Printf("Listed %d configs for namespace %s", len(configs), namespace)
+
+	resp := map[string]interface{}{
+		"namespace": namespace,
+		"configs":   configs,
+		"count":     len(configs),
+	}
+	if page.Next != "" {
+		resp["continue"] = base64.RawURLEncoding.EncodeToString([]byte(page.Next))
+	}
+	if detail {
+		items, err := h.configDetails(namespace, configs)
+		if err != nil {
+			log.Printf("Failed to list configs for namespace %s: %v", namespace, err)
+			writeErrorJSON(w, http.StatusInternalServerError, fmt.Sprintf("Failed to list configs: %v", err))
+			return
+		}
+		resp["items"] = items
+	}
+	writeJSON(w, http.StatusOK, resp)
+}
+
+// listOptions builds listing options from the prefix, glob, label_selector,
+// sort (name or -name), limit and continue query parameters. The continue
+// token is the one returned with the previous page.
+func listOptions(r *http.Request) (storage.ListOptions, error) {
+	q := r.URL.Query()
+	opts := storage.ListOptions{Prefix: q.Get("prefix"), Glob: q.Get("glob")}
+
+	var err error
+	if opts.Selector, err = storage.ParseLabelSelector(q.Get("label_selector")); err != nil {
+		return opts, err
+	}
+	switch order := q.Get("sort"); order {
+	case "", "name":
+	case "-name":
+		opts.Descending = true
+	default:
+		return opts, fmt.Errorf("invalid sort parameter %q", order)
+	}
+	if opts.Limit, err = queryInt(r, "limit"); err != nil {
+		return opts, err
+	}
+	if token := q.Get("continue"); token != "" {
+		after, err := base64.RawURLEncoding.DecodeString(token)
+		if err != nil || len(after) == 0 {
+			return opts, fmt.Errorf("invalid continue parameter %q", token)
+		}
+		opts.After = string(after)
+	}
+	return opts, opts.Validate()
+}
+
+// configInfo is the per-config metadata returned by ListConfigs?detail=true.
+type configInfo struct {
+	Name      string            `json:"name"`
+	Size      int               `json:"size"`
+	Documents int               `json:"documents"`
+	Metadata  *storage.Metadata `json:"metadata,omitempty"`
+}
+
+// configDetails loads each listed config to report its size, document
+// count and metadata record. Configs deleted since the listing are skipped.
+func (h *Handler) configDetails(namespace string, names []string) ([]configInfo, error) {
+	items := make([]configInfo, 0, len(names))
+	for _, name := range names {
+		content, err := h.store.Get(namespace, name)
+		if errors.Is(err, storage.ErrNotFound) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		// Configs stored before validation existed may not parse; they are
+		// reported with zero documents rather than failing the listing.
+		documents, _ := yamlutil.CountDocuments(content)
+		info := configInfo{Name: name, Size: len(content), Documents: documents}
+		md, err := h.loadMetadata(namespace, name, content)
+		switch {
+		case err == nil:
+			info.Metadata = &md
+		case !errors.Is(err, storage.ErrUnsupported):
+			return nil, err
+		}
+		items = append(items, info)
+	}
+	return items, nil
+}
+
+// Admin endpoints for token management
+
+// authAdminStatusFor maps an auth error from admin operations to an HTTP
+// status code.
+func authAdminStatusFor(err error) int {
+	switch {
+	case errors.Is(err, auth.ErrAdminRequired):
+		return http.StatusUnauthorized
+	case errors.Is(err, auth.ErrTokenNotFound):
+		return http.StatusNotFound
+	case errors.Is(err, auth.ErrTokenExists), errors.Is(err, auth.ErrInvalidInput):
+		return http.StatusBadRequest
+	default:
+		return http.StatusBadRequest
+	}
+}
+
+// CreateToken handles POST /admin/tokens
+func (h *Handler) CreateToken(w http.ResponseWriter, r *http.Request) {
+	adminToken := h.extractToken(r)
+	if adminToken == "" {
+		writeErrorJSON(w, http.StatusUnauthorized, "Admin token required")
+		return
+	}
+
+	defer r.Body.Close()
+	r.Body = http.MaxBytesReader(w, r.Body, MaxAdminBodyBytes)
+
+	var req struct {
+		Token       string   `json:"token"`
+		Namespace   string   `json:"namespace"`
+		Permissions []string `json:"permissions"`
+	}
+
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		if isMaxBytesError(err) {
+			writeErrorJSON(w, http.StatusRequestEntityTooLarge,
+				fmt.Sprintf("Request body exceeds %d bytes", MaxAdminBodyBytes))
+			return
+		}
+		writeErrorJSON(w, http.StatusBadRequest, fmt.Sprintf("Invalid request body: %v", err))
+		return
+	}
+
+	perms := make([]auth.Permission, len(req.Permissions))
+	for i, p := range req.Permissions {
+		perms[i] = auth.Permission(p)
+	}
+	if err := h.auth.CreateToken(adminToken, req.Token, req.Namespace, perms...); err != nil {
+		writeErrorJSON(w, authAdminStatusFor(err), err.Error())
+		return
+	}
+
+	log.Printf("Admin created token for namespace %s", req.Namespace)
+
+	writeJSON(w, http.StatusCreated, map[string]interface{}{
+		"message":     "Token created successfully",
+		"token":       req.Token,
+		"namespace":   req.Namespace,
+		"permissions": perms,
+	})
+}
+
+// RevokeToken handles DELETE /admin/tokens/{token}
+func (h *Handler) RevokeToken(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	tokenToRevoke := vars["token"]
+
+	adminToken := h.extractToken(r)
+	if adminToken == "" {
+		writeErrorJSON(w, http.StatusUnauthorized, "Admin token required")
+		return
+	}
+
+	if err := h.auth.RevokeToken(adminToken, tokenToRevoke); err != nil {
+		writeErrorJSON(w, authAdminStatusFor(err), err.Error())
+		return
+	}
+
+	log.Printf("Admin revoked token: %s", tokenToRevoke)
+
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"message": "Token revoked successfully",
+		"token":   tokenToRevoke,
+	})
+}
+
+// ListTokens handles GET /admin/tokens
+func (h *Handler) ListTokens(w http.ResponseWriter, r *http.Request) {
+	adminToken := h.extractToken(r)
+	if adminToken == "" {
+		writeErrorJSON(w, http.StatusUnauthorized, "Admin token required")
+		return
+	}
+
+	tokens, err := h.auth.ListAllTokens(adminToken)
+	if err != nil {
+		writeErrorJSON(w, authAdminStatusFor(err), err.Error())
+		return
+	}
+
+	permissions := make(map[string][]auth.Permission)
+	for token := range tokens {
+		if perms := h.auth.Permissions(token); len(perms) > 0 {
+			permissions[token] = perms
+		}
+	}
+
+	log.Printf("Admin listed %d tokens", len(tokens))
+
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"tokens":      tokens,
+		"permissions": permissions,
+		"count":       len(tokens),
+	})
+}
+
+// GetSecretPaths handles GET /admin/namespaces/{namespace}/secret-paths
+func (h *Handler) GetSecretPaths(w http.ResponseWriter, r *http.Request) {
+	h.getList(w, r, "paths", h.policy.SecretPaths)
+}
+
+// SetSecretPaths handles PUT /admin/namespaces/{namespace}/secret-paths and
+// replaces the key path patterns whose values are redacted for tokens
+// without the read-secrets permission.
+func (h *Handler) SetSecretPaths(w http.ResponseWriter, r *http.Request) {
+	h.setList(w, r, "secret paths", "paths", h.policy.SetSecretPaths, h.policy.SecretPaths)
+}
+
+// GetEncryptedPaths handles GET /admin/namespaces/{namespace}/encrypted-paths
+func (h *Handler) GetEncryptedPaths(w http.ResponseWriter, r *http.Request) {
+	h.getList(w, r, "paths", h.policy.EncryptPaths)
+}
+
+// SetEncryptedPaths handles PUT /admin/namespaces/{namespace}/encrypted-paths
+// and replaces the key path patterns whose values are encrypted at rest.
+// The new patterns apply to configs as they are next written.
+func (h *Handler) SetEncryptedPaths(w http.ResponseWriter, r *http.Request) {
+	if !h.keyring.CanWrap() {
+		if !h.auth.IsAdminToken(h.extractToken(r)) {
+			writeErrorJSON(w, http.StatusUnauthorized, "Admin token required")
+			return
+		}
+		writeErrorJSON(w, http.StatusConflict, "No encryption keys are configured on the server")
+		return
+	}
+	h.setList(w, r, "encrypted paths", "paths", h.policy.SetEncryptPaths, h.policy.EncryptPaths)
+}
+
+// GetReferrers handles GET /admin/namespaces/{namespace}/referrers
+func (h *Handler) GetReferrers(w http.ResponseWriter, r *http.Request) {
+	h.getList(w, r, "namespaces", h.policy.Referrers)
+}
+
+// SetReferrers handles PUT /admin/namespaces/{namespace}/referrers and
+// replaces the other namespaces whose configs may reference the
+// namespace's configs in templates and overlays.
+func (h *Handler) SetReferrers(w http.ResponseWriter, r *http.Request) {
+	h.setList(w, r, "referrers", "namespaces", h.policy.SetReferrers, h.policy.Referrers)
+}
+
+// RotateKeys handles POST /admin/encryption/rotate. It moves every namespace
+// to a new data key wrapped by the newest master key and re-encrypts all
+// stored configs, while requests continue to be served.
+func (h *Handler) RotateKeys(w http.ResponseWriter, r *http.Request) {
+	if !h.auth.IsAdminToken(h.extractToken(r)) {
+		writeErrorJSON(w, http.StatusUnauthorized, "Admin token required")
+		return
+	}
+
+	rotator, ok := h.store.(storage.Rotator)
+	if !ok {
+		writeErrorJSON(w, http.StatusNotImplemented, "Encryption at rest is not enabled")
+		return
+	}
+	result, err := rotator.Rotate()
+	if err != nil {
+		log.Printf("Failed to rotate encryption keys: %v", err)
+		writeErrorJSON(w, storeStatusFor(err), fmt.Sprintf("Failed to rotate keys: %v", err))
+		return
+	}
+
+	log.Printf("Admin rotated encryption keys: %d configs in %d namespaces re-encrypted under master key %d",
+		result.Configs, result.Namespaces, result.MasterVersion)
+
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"message":        "Encryption keys rotated",
+		"master_version": result.MasterVersion,
+		"namespaces":     result.Namespaces,
+		"configs":        result.Configs,
+	})
+}
+
+// CacheStats handles GET /admin/cache, reporting the read cache's hit and
+// miss counters and size.
+func (h *Handler) CacheStats(w http.ResponseWriter, r *http.Request) {
+	if !h.auth.IsAdminToken(h.extractToken(r)) {
+		writeErrorJSON(w, http.StatusUnauthorized, "Admin token required")
+		return
+	}
+	if h.cache == nil {
+		writeErrorJSON(w, http.StatusNotImplemented, "Caching is not enabled")
+		return
+	}
+	writeJSON(w, http.StatusOK, h.cache.Stats())
+}
+
+// Snapshot handles GET /admin/snapshot. It streams a consistent copy of the
+// whole store in the backend's native format, taken while the server keeps
+// serving requests.
+func (h *Handler) Snapshot(w http.ResponseWriter, r *http.Request) {
+	if !h.auth.IsAdminToken(h.extractToken(r)) {
+		writeErrorJSON(w, http.StatusUnauthorized, "Admin token required")
+		return
+	}
+
+	snapshotter, ok := h.store.(storage.Snapshotter)
+	if !ok {
+		writeErrorJSON(w, http.StatusNotImplemented, "Storage backend does not support snapshots")
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/octet-stream")
+	w.Header().Set("Content-Disposition", `attachment; filename="yamlet-snapshot.db"`)
+	n, err := snapshotter.WriteSnapshot(w)
+	if err != nil {
+		if n == 0 {
+			// Nothing was sent yet, so the error can still be reported.
+			w.Header().Del("Content-Disposition")
+			if errors.Is(err, storage.ErrUnsupported) {
+				writeErrorJSON(w, http.StatusNotImplemented, "Storage backend does not support snapshots")
+				return
+			}
+			log.Printf("Failed to write snapshot: %v", err)
+			writeErrorJSON(w, storeStatusFor(err), fmt.Sprintf("Failed to write snapshot: %v", err))
+			return
+		}
+		log.Printf("Snapshot aborted after %d bytes: %v", n, err)
+		return
+	}
+	log.Printf("Admin downloaded a %d byte snapshot", n)
+}
+
+// Backup handles GET /admin/backup. It streams a portable archive of every
+// namespace, config, metadata record, revision, token and namespace policy,
+// read at a single point in time. Stores that cannot be read so are only
+// archived when inconsistent backups are allowed.
+func (h *Handler) Backup(w http.ResponseWriter, r *http.Request) {
+	adminToken := h.extractToken(r)
+	if !h.auth.IsAdminToken(adminToken) {
+		writeErrorJSON(w, http.StatusUnauthorized, "Admin token required")
+		return
+	}
+
+	tokens, err := backup.AuthTokens(h.auth, adminToken)
+	if err != nil {
+		writeErrorJSON(w, authAdminStatusFor(err), err.Error())
+		return
+	}
+	// The archive is assembled before any of it is sent, so that a failure
+	// can still be reported.
+	var buf bytes.Buffer
+	manifest, err := backup.Write(&buf, h.store, backup.Options{
+		Source:            h.backend,
+		Tokens:            tokens,
+		Policies:          h.policy.Policies(),
+		AllowInconsistent: h.inconsistentBackups,
+	})
+	if err != nil {
+		log.Printf("Failed to write backup: %v", err)
+		writeErrorJSON(w, storeStatusFor(err), fmt.Sprintf("Failed to write backup: %v", err))
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/gzip")
+	w.Header().Set("Content-Disposition", `attachment; filename="`+backup.ArchiveName(manifest.Created)+`"`)
+	w.Header().Set("Content-Length", strconv.Itoa(buf.Len()))
+	w.Header().Set(SnapshotHeader, strconv.FormatBool(manifest.Consistent))
+	if _, err := buf.WriteTo(w); err != nil {
+		log.Printf("Backup download aborted: %v", err)
+		return
+	}
+	log.Printf("Admin downloaded a backup of %d namespaces and %d tokens", len(manifest.Namespaces), manifest.Tokens)
+}
+
+// Restore handles POST /admin/restore with a backup archive as the body.
+// The namespace query parameter, which may repeat, selects what to restore,
+// and mode is skip (the default) or overwrite. The archive is verified in
+// full before anything is written.
+func (h *Handler) Restore(w http.ResponseWriter, r *http.Request) {
+	adminToken := h.extractToken(r)
+	if !h.auth.IsAdminToken(adminToken) {
+		writeErrorJSON(w, http.StatusUnauthorized, "Admin token required")
+		return
+	}
+	mode, err := backup.ParseMode(r.URL.Query().Get("mode"))
+	if err != nil {
+		writeErrorJSON(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	defer r.Body.Close()
+	r.Body = http.MaxBytesReader(w, r.Body, MaxRestoreBodyBytes)
+	archive, err := backup.Read(r.Body)
+	if err != nil {
+		if isMaxBytesError(err) {
+			writeErrorJSON(w, http.StatusRequestEntityTooLarge,
+				fmt.Sprintf("Request body exceeds %d bytes", MaxRestoreBodyBytes))
+			return
+		}
+		writeErrorJSON(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	result, err := backup.Restore(archive, h.store, backup.RestoreOptions{
+		Namespaces:    r.URL.Query()["namespace"],
+		Mode:          mode,
+		RestoreToken:  backup.AuthTokenRestorer(h.auth, adminToken),
+		RestorePolicy: h.policy.Restore,
+	})
+	if err != nil {
+		status := storeStatusFor(err)
+		switch {
+		case errors.Is(err, backup.ErrInvalidArchive), errors.Is(err, backup.ErrUnknownNamespace), errors.Is(err, auth.ErrInvalidInput),
+			errors.Is(err, yamlutil.ErrInvalidPattern), errors.Is(err, policy.ErrInvalidQuota):
+			status = http.StatusBadRequest
+		case status == http.StatusInternalServerError:
+			log.Printf("Failed to restore backup: %v", err)
+		}
+		writeJSON(w, status, map[string]interface{}{
+			"error":  fmt.Sprintf("Failed to restore backup: %v", err),
+			"result": result,
+		})
+		return
+	}
+
+	log.Printf("Admin restored %d configs (%d skipped), %d tokens and %d policies in %d namespaces from a backup taken %s",
+		result.Configs, result.Skipped, result.Tokens, result.Policies, len(result.Namespaces), archive.Manifest.Created.Format(time.RFC3339))
+
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"message": "Backup restored",
+		"created": archive.Manifest.Created,
+		"mode":    mode,
+		"result":  result,
+	})
+}
+
+// BackupHealth handles GET /health/backups. It reports the status of
+// scheduled backups with 200 while they are healthy and 503 once the last
+// one failed or the last success got too old, so that a probe can alert
+// when backups stop. Like /health it needs no token, but only admin tokens
+// get the details, as errors may name sink paths and storage internals;
+// other callers get the kind of problem.
+func (h *Handler) BackupHealth(w http.ResponseWriter, r *http.Request) {
+	if h.backups == nil {
+		writeErrorJSON(w, http.StatusNotImplemented, "Scheduled backups are not enabled")
+		return
+	}
+	status := h.backups.Status()
+	code := http.StatusOK
+	if !status.Healthy {
+		code = http.StatusServiceUnavailable
+	}
+	if !h.auth.IsAdminToken(h.extractToken(r)) {
+		writeJSON(w, code, status.Summary())
+		return
+	}
+	writeJSON(w, code, status)
+}
+
+// Metrics handles GET /metrics. It reports scheduled backups and the read
+// cache, when they are enabled, in the Prometheus text format.
+func (h *Handler) Metrics(w http.ResponseWriter, r *http.Request) {
+	var buf bytes.Buffer
+	metric := func(name, kind, help string, value float64) {
+		fmt.Fprintf(&buf, "# HELP %s %s\n# TYPE %s %s\n%s %s\n",
+			name, help, name, kind, name, strconv.FormatFloat(value, 'g', -1, 64))
+	}
+	timestamp := func(t time.Time) float64 {
+		if t.IsZero() {
+			return 0
+		}
+		return float64(t.UnixNano()) / 1e9
+	}
+	bit := func(b bool) float64 {
+		if b {
+			return 1
+		}
+		return 0
+	}
+
+	if h.backups != nil {
+		status := h.backups.Status()
+		metric("yamlet_backup_healthy", "gauge",
+			"Whether scheduled backups are healthy.", bit(status.Healthy))
+		metric("yamlet_backup_last_success_timestamp_seconds", "gauge",
+			"Time of the last successful backup, or 0 if there is none.", timestamp(status.LastSuccess))
+		metric("yamlet_backup_last_failure_timestamp_seconds", "gauge",
+			"Time of the last failed backup, or 0 if there is none.", timestamp(status.LastFailure))
+		metric("yamlet_backup_next_run_timestamp_seconds", "gauge",
+			"Time of the next scheduled backup.", timestamp(status.NextRun))
+		metric("yamlet_backup_max_age_seconds", "gauge",
+			"How old the last successful backup may get before backups are unhealthy.", status.MaxAgeSeconds)
+		metric("yamlet_backup_last_size_bytes", "gauge",
+			"Size of the last successful backup.", float64(status.LastSize))
+		metric("yamlet_backup_last_duration_seconds", "gauge",
+			"Time the last successful backup took.", status.LastDurationSeconds)
+		metric("yamlet_backup_successes_total", "counter",
+			"Scheduled backups that succeeded.", float64(status.Successes))
+		metric("yamlet_backup_failures_total", "counter",
+			"Scheduled backups that failed.", float64(status.Failures))
+		metric("yamlet_backup_consecutive_failures", "gauge",
+			"Scheduled backups that failed since the last success.", float64(status.ConsecutiveFailures))
+	}
+	if h.cache != nil {
+		stats := h.cache.Stats()
+		metric("yamlet_cache_hits_total", "counter", "Reads served from the cache.", float64(stats.Hits))
+		metric("yamlet_cache_negative_hits_total", "counter",
+			"Reads served from the cache that answered not found.", float64(stats.NegativeHits))
+		metric("yamlet_cache_misses_total", "counter", "Reads that missed the cache.", float64(stats.Misses))
+		metric("yamlet_cache_evictions_total", "counter",
+			"Entries dropped to stay under the memory bound.", float64(stats.Evictions))
+		metric("yamlet_cache_invalidations_total", "counter",
+			"Changes that dropped cache entries.", float64(stats.Invalidations))
+		metric("yamlet_cache_entries", "gauge", "Entries in the cache.", float64(stats.Entries))
+		metric("yamlet_cache_bytes", "gauge", "Memory held by the cache.", float64(stats.Bytes))
+	}
+
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	w.WriteHeader(http.StatusOK)
+	w.Write(buf.Bytes())
+}
+
+// namespaceDetails is a namespace as the admin API shows it: its record,
+// which is empty but for the name when it has none, and its usage.
+type namespaceDetails struct {
+	storage.NamespaceInfo
+	Usage storage.NamespaceUsage `json:"usage"`
+}
+
+// namespaceStore returns the store's NamespaceStore, or writes an error
+// when it has none.
+func (h *Handler) namespaceStore(w http.ResponseWriter) (storage.NamespaceStore, bool) {
+	store, ok := h.store.(storage.NamespaceStore)
+	if !ok {
+		writeErrorJSON(w, http.StatusNotImplemented, "Storage backend does not support namespace management")
+	}
+	return store, ok
+}
+
+// namespaceDetailsOf reads a namespace's record and usage. It returns
+// storage.ErrNotFound when the namespace has neither a record nor configs.
+func namespaceDetailsOf(store storage.NamespaceStore, namespace string) (namespaceDetails, error) {
+	info, err := store.NamespaceInfo(namespace)
+	hasRecord := err == nil
+	if errors.Is(err, storage.ErrNotFound) {
+		info, err = storage.NamespaceInfo{Name: namespace}, nil
+	}
+	if err != nil {
+		return namespaceDetails{}, err
+	}
+	usage, err := store.Usage(namespace)
+	if err != nil {
+		return namespaceDetails{}, err
+	}
+	if !hasRecord && usage.Configs == 0 {
+		return namespaceDetails{}, fmt.Errorf("namespace %s: %w", namespace, storage.ErrNotFound)
+	}
+	return namespaceDetails{NamespaceInfo: info, Usage: usage}, nil
+}
+
+// writeNamespaceError reports a failed namespace operation.
+func writeNamespaceError(w http.ResponseWriter, action, namespace string, err error) {
+	status := storeStatusFor(err)
+	if status == http.StatusInternalServerError {
+		log.Printf("Failed to %s namespace %s: %v", action, namespace, err)
+	}
+	writeErrorJSON(w, status, fmt.Sprintf("Failed to %s namespace: %v", action, err))
+}
+
+// namespaceRequest is the body of namespace creates and updates.
+type namespaceRequest struct {
+	Name        string            `json:"name"`
+	Owner       string            `json:"owner"`
+	Description string            `json:"description"`
+	Labels      map[string]string `json:"labels"`
+}
+
+// decodeNamespaceRequest decodes a namespaceRequest, writing an error and
+// returning false when the body is invalid.
+func decodeNamespaceRequest(w http.ResponseWriter, r *http.Request) (namespaceRequest, bool) {
+	defer r.Body.Close()
+	r.Body = http.MaxBytesReader(w, r.Body, MaxAdminBodyBytes)
+
+	var req namespaceRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		if isMaxBytesError(err) {
+			writeErrorJSON(w, http.StatusRequestEntityTooLarge,
+				fmt.Sprintf("Request body exceeds %d bytes", MaxAdminBodyBytes))
+			return req, false
+		}
+		writeErrorJSON(w, http.StatusBadRequest, fmt.Sprintf("Invalid request body: %v", err))
+		return req, false
+	}
+	return req, true
+}
+
+// ListNamespaces handles GET /admin/namespaces. It lists every namespace,
+// whether it was created through the admin API or only holds configs, with
+// its config count and stored bytes.
+func (h *Handler) ListNamespaces(w http.ResponseWriter, r *http.Request) {
+	if !h.auth.IsAdminToken(h.extractToken(r)) {
+		writeErrorJSON(w, http.StatusUnauthorized, "Admin token required")
+		return
+	}
+	store, ok := h.namespaceStore(w)
+	if !ok {
+		return
+	}
+
+	names, err := store.Namespaces()
+	if err != nil {
+		writeNamespaceError(w, "list", "", err)
+		return
+	}
+	namespaces := make([]namespaceDetails, 0, len(names))
+	var total storage.NamespaceUsage
+	for _, name := range names {
+		details, err := namespaceDetailsOf(store, name)
+		if errors.Is(err, storage.ErrNotFound) {
+			// Deleted since it was listed.
+			continue
+		}
+		if err != nil {
+			writeNamespaceError(w, "list", name, err)
+			return
+		}
+		namespaces = append(namespaces, details)
+		total.Configs += details.Usage.Configs
+		total.Bytes += details.Usage.Bytes
+	}
+
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"namespaces": namespaces,
+		"count":      len(namespaces),
+		"usage":      total,
+	})
+}
+
+// CreateNamespace handles POST /admin/namespaces. Creating a namespace that
+// already holds configs gives it a record; creating one that already has a
+// record is a conflict.
+func (h *Handler) CreateNamespace(w http.ResponseWriter, r *http.Request) {
+	if !h.auth.IsAdminToken(h.extractToken(r)) {
+		writeErrorJSON(w, http.StatusUnauthorized, "Admin token required")
+		return
+	}
+	store, ok := h.namespaceStore(w)
+	if !ok {
+		return
+	}
+	req, ok := decodeNamespaceRequest(w, r)
+	if !ok {
+		return
+	}
+	if req.Name == "" {
+		writeErrorJSON(w, http.StatusBadRequest, "name is required")
+		return
+	}
+
+	// A record that only holds the policy set on the namespace does not
+	// make it exist; the policy is kept.
+	existing, err := store.NamespaceInfo(req.Name)
+	if err == nil && !existing.Created.IsZero() {
+		writeErrorJSON(w, http.StatusConflict, fmt.Sprintf("Namespace %s already exists", req.Name))
+		return
+	} else if err != nil && !errors.Is(err, storage.ErrNotFound) {
+		writeNamespaceError(w, "create", req.Name, err)
+		return
+	}
+
+	now := time.Now().UTC()
+	info := storage.NamespaceInfo{
+		Name:        req.Name,
+		Owner:       req.Owner,
+		Description: req.Description,
+		Labels:      req.Labels,
+		Created:     now,
+		Updated:     now,
+		Policy:      existing.Policy,
+	}
+	if err := store.SetNamespaceInfo(info); err != nil {
+		writeNamespaceError(w, "create", req.Name, err)
+		return
+	}
+	details, err := namespaceDetailsOf(store, req.Name)
+	if err != nil {
+		writeNamespaceError(w, "create", req.Name, err)
+		return
+	}
+
+	log.Printf("Admin created namespace %s", req.Name)
+
+	writeJSON(w, http.StatusCreated, details)
+}
+
+// GetNamespace handles GET /admin/namespaces/{namespace}
+func (h *Handler) GetNamespace(w http.ResponseWriter, r *http.Request) {
+	namespace := mux.Vars(r)["namespace"]
+
+	if !h.auth.IsAdminToken(h.extractToken(r)) {
+		writeErrorJSON(w, http.StatusUnauthorized, "Admin token required")
+		return
+	}
+	store, ok := h.namespaceStore(w)
+	if !ok {
+		return
+	}
+
+	details, err := namespaceDetailsOf(store, namespace)
+	if err != nil {
+		writeNamespaceError(w, "read", namespace, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, details)
+}
+
+// UpdateNamespace handles PUT /admin/namespaces/{namespace}. The owner,
+// description and labels are replaced; a namespace without a record gets
+// one.
+func (h *Handler) UpdateNamespace(w http.ResponseWriter, r *http.Request) {
+	namespace := mux.Vars(r)["namespace"]
+
+	if !h.auth.IsAdminToken(h.extractToken(r)) {
+		writeErrorJSON(w, http.StatusUnauthorized, "Admin token required")
+		return
+	}
+	store, ok := h.namespaceStore(w)
+	if !ok {
+		return
+	}
+	req, ok := decodeNamespaceRequest(w, r)
+	if !ok {
+		return
+	}
+	if req.Name != "" && req.Name != namespace {
+		writeErrorJSON(w, http.StatusBadRequest, "name does not match the namespace in the path")
+		return
+	}
+
+	info, err := store.NamespaceInfo(namespace)
+	if err != nil && !errors.Is(err, storage.ErrNotFound) {
+		writeNamespaceError(w, "update", namespace, err)
+		return
+	}
+	now := time.Now().UTC()
+	if info.Created.IsZero() {
+		info.Created = now
+	}
+	info.Name = namespace
+	info.Owner = req.Owner
+	info.Description = req.Description
+	info.Labels = req.Labels
+	info.Updated = now
+	if err := store.SetNamespaceInfo(info); err != nil {
+		writeNamespaceError(w, "update", namespace, err)
+		return
+	}
+	details, err := namespaceDetailsOf(store, namespace)
+	if err != nil {
+		writeNamespaceError(w, "update", namespace, err)
+		return
+	}
+
+	log.Printf("Admin updated namespace %s", namespace)
+
+	writeJSON(w, http.StatusOK, details)
+}
+
+// DeleteNamespace handles DELETE /admin/namespaces/{namespace}. It deletes
+// the namespace's record and every config in it, with their revisions and
+// metadata. The request must either repeat the namespace as
+// ?confirm=<namespace>, or ask for ?dry_run=true to see what would be
+// deleted without deleting it.
+func (h *Handler) DeleteNamespace(w http.ResponseWriter, r *http.Request) {
+	namespace := mux.Vars(r)["namespace"]
+
+	if !h.auth.IsAdminToken(h.extractToken(r)) {
+		writeErrorJSON(w, http.StatusUnauthorized, "Admin token required")
+		return
+	}
+	store, ok := h.namespaceStore(w)
+	if !ok {
+		return
+	}
+	dryRun, err := queryBool(r, "dry_run")
+	if err != nil {
+		writeErrorJSON(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	if !dryRun && r.URL.Query().Get("confirm") != namespace {
+		writeErrorJSON(w, http.StatusBadRequest,
+			fmt.Sprintf("Deleting a namespace deletes all its configs: pass confirm=%s, or dry_run=true to preview", namespace))
+		return
+	}
+
+	details, err := namespaceDetailsOf(store, namespace)
+	if err != nil {
+		writeNamespaceError(w, "delete", namespace, err)
+		return
+	}
+	configs, err := h.store.List(namespace)
+	if err != nil {
+		writeNamespaceError(w, "delete", namespace, err)
+		return
+	}
+	slices.Sort(configs)
+
+	message := "Namespace would be deleted"
+	if !dryRun {
+		if err := store.DeleteNamespace(namespace); err != nil {
+			writeNamespaceError(w, "delete", namespace, err)
+			return
+		}
+		h.policy.Forget(namespace)
+		message = "Namespace deleted successfully"
+		log.Printf("Admin deleted namespace %s with %d configs", namespace, len(configs))
+	}
+
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"message":   message,
+		"namespace": namespace,
+		"dry_run":   dryRun,
+		"configs":   configs,
+		"usage":     details.Usage,
+	})
+}
+
+// GetUsage handles GET /namespaces/{namespace}/usage, reporting what the
+// namespace holds against its quota.
+func (h *Handler) GetUsage(w http.ResponseWriter, r *http.Request) {
+	namespace := mux.Vars(r)["namespace"]
+
+	if err := h.auth.ValidateToken(namespace, h.extractToken(r)); err != nil {
+		writeErrorJSON(w, authStatusFor(err), fmt.Sprintf("Authentication failed: %v", err))
+		return
+	}
+	h.writeQuota(w, namespace)
+}
+
+// GetQuota handles GET /admin/namespaces/{namespace}/quota
+func (h *Handler) GetQuota(w http.ResponseWriter, r *http.Request) {
+	namespace := mux.Vars(r)["namespace"]
+
+	if !h.auth.IsAdminToken(h.extractToken(r)) {
+		writeErrorJSON(w, http.StatusUnauthorized, "Admin token required")
+		return
+	}
+	h.writeQuota(w, namespace)
+}
+
+// SetQuota handles PUT /admin/namespaces/{namespace}/quota and replaces the
+// namespace's quota. Omitted or zero limits are unlimited.
+func (h *Handler) SetQuota(w http.ResponseWriter, r *http.Request) {
+	namespace := mux.Vars(r)["namespace"]
+
+	if !h.auth.IsAdminToken(h.extractToken(r)) {
+		writeErrorJSON(w, http.StatusUnauthorized, "Admin token required")
+		return
+	}
+
+	defer r.Body.Close()
+	r.Body = http.MaxBytesReader(w, r.Body, MaxAdminBodyBytes)
+
+	var q policy.Quota
+	if err := json.NewDecoder(r.Body).Decode(&q); err != nil {
+		if isMaxBytesError(err) {
+			writeErrorJSON(w, http.StatusRequestEntityTooLarge,
+				fmt.Sprintf("Request body exceeds %d bytes", MaxAdminBodyBytes))
+			return
+		}
+		writeErrorJSON(w, http.StatusBadRequest, fmt.Sprintf("Invalid request body: %v", err))
+		return
+	}
+	if err := h.policy.SetQuota(namespace, q); err != nil {
+		status := http.StatusBadRequest
+		if !errors.Is(err, policy.ErrInvalidQuota) {
+			status = storeStatusFor(err)
+		}
+		if status == http.StatusInternalServerError {
+			log.Printf("Failed to set quota of namespace %s: %v", namespace, err)
+		}
+		writeErrorJSON(w, status, err.Error())
+		return
+	}
+
+	log.Printf("Admin set quota of namespace %s: %+v", namespace, q)
+
+	h.writeQuota(w, namespace)
+}
+
+// writeQuota writes a namespace's quota and usage.
+func (h *Handler) writeQuota(w http.ResponseWriter, namespace string) {
+	usage, err := storage.UsageOf(h.store, namespace)
+	if err != nil {
+		status := storeStatusFor(err)
+		if status == http.StatusInternalServerError {
+			log.Printf("Failed to read usage of namespace %s: %v", namespace, err)
+		}
+		writeErrorJSON(w, status, fmt.Sprintf("Failed to read usage: %v", err))
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"namespace": namespace,
+		"quota":     h.policy.Quota(namespace),
+		"usage":     usage,
+	})
+}
+
+// getList writes one of a namespace's policy lists under field.
+func (h *Handler) getList(w http.ResponseWriter, r *http.Request, field string, get func(string) []string) {
+	namespace := mux.Vars(r)["namespace"]
+
+	if !h.auth.IsAdminToken(h.extractToken(r)) {
+		writeErrorJSON(w, http.StatusUnauthorized, "Admin token required")
+		return
+	}
 
 	writeJSON(w, http.StatusOK, map[string]interface{}{
-		"tokens": tokens,
-		"count":  len(tokens),
+		"namespace": namespace,
+		field:       get(namespace),
+	})
+}
+
+// setList replaces one of a namespace's policy lists from a body holding
+// the list under field, such as {"paths": [...]}.
+func (h *Handler) setList(w http.ResponseWriter, r *http.Request, kind, field string,
+	set func(string, []string) error, get func(string) []string) {
+	namespace := mux.Vars(r)["namespace"]
+
+	if !h.auth.IsAdminToken(h.extractToken(r)) {
+		writeErrorJSON(w, http.StatusUnauthorized, "Admin token required")
+		return
+	}
+
+	defer r.Body.Close()
+	r.Body = http.MaxBytesReader(w, r.Body, MaxAdminBodyBytes)
+
+	var req map[string]json.RawMessage
+	var list []string
+	err := json.NewDecoder(r.Body).Decode(&req)
+	if err == nil && req[field] != nil {
+		err = json.Unmarshal(req[field], &list)
+	}
+	if err != nil {
+		if isMaxBytesError(err) {
+			writeErrorJSON(w, http.StatusRequestEntityTooLarge,
+				fmt.Sprintf("Request body exceeds %d bytes", MaxAdminBodyBytes))
+			return
+		}
+		writeErrorJSON(w, http.StatusBadRequest, fmt.Sprintf("Invalid request body: %v", err))
+		return
+	}
+
+	if err := set(namespace, list); err != nil {
+		status := http.StatusBadRequest
+		if !errors.Is(err, yamlutil.ErrInvalidPattern) {
+			status = storeStatusFor(err)
+		}
+		if status == http.StatusInternalServerError {
+			log.Printf("Failed to set %s for namespace %s: %v", kind, namespace, err)
+		}
+		writeErrorJSON(w, status, err.Error())
+		return
+	}
+
+	log.Printf("Admin set %d %s for namespace %s", len(list), kind, namespace)
+
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"namespace": namespace,
+		field:       get(namespace),
 	})
 }
 
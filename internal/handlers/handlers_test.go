@@ -1,18 +1,31 @@
 package handlers
 
 import (
+	"archive/tar"
 	"bytes"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
 	"encoding/json"
 	"fmt"
 	"io"
+	"mime"
+	"mime/multipart"
 	"net/http"
 	"net/http/httptest"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"slices"
 	"strings"
 	"testing"
+	"time"
 
 	"github.com/gorilla/mux"
 
 	"github.com/zvdy/yamlet/internal/auth"
+	"github.com/zvdy/yamlet/internal/backup"
+	"github.com/zvdy/yamlet/internal/fieldcrypt"
 	"github.com/zvdy/yamlet/internal/storage"
 )
 
@@ -24,22 +37,60 @@ func newTestServer(t *testing.T) (*httptest.Server, *auth.TokenAuth, storage.Sto
 	t.Helper()
 	store := storage.NewMemoryStore()
 	a := auth.NewTokenAuth()
-	h := NewHandler(store, a)
+	return serveHandler(t, NewHandler(store, a)), a, store
+}
 
+// serveHandler serves h with the same routes as cmd/yamlet.
+func serveHandler(t *testing.T, h *Handler) *httptest.Server {
+	t.Helper()
 	r := mux.NewRouter()
+	r.HandleFunc("/health/backups", h.BackupHealth).Methods("GET")
+	r.HandleFunc("/metrics", h.Metrics).Methods("GET")
 	api := r.PathPrefix("/namespaces").Subrouter()
 	api.HandleFunc("/{namespace}/configs/{name}", h.StoreConfig).Methods("POST")
 	api.HandleFunc("/{namespace}/configs/{name}", h.GetConfig).Methods("GET")
+	api.HandleFunc("/{namespace}/configs/{name}", h.PatchConfig).Methods("PATCH")
 	api.HandleFunc("/{namespace}/configs/{name}", h.DeleteConfig).Methods("DELETE")
+	api.HandleFunc("/{namespace}/configs/{name}/explain", h.ExplainConfig).Methods("GET")
+	api.HandleFunc("/{namespace}/configs/{name}/revisions", h.ListRevisions).Methods("GET")
+	api.HandleFunc("/{namespace}/configs/{name}/rollback", h.RollbackConfig).Methods("POST")
+	api.HandleFunc("/{namespace}/configs/{name}/metadata", h.GetMetadata).Methods("GET")
+	api.HandleFunc("/{namespace}/configs/{name}/metadata", h.SetMetadata).Methods("PUT")
+	api.HandleFunc("/{namespace}/configs/{name}/diff", h.DiffConfig).Methods("GET")
 	api.HandleFunc("/{namespace}/configs", h.ListConfigs).Methods("GET")
+	api.HandleFunc("/{namespace}/usage", h.GetUsage).Methods("GET")
+	api.HandleFunc("/{namespace}/batch", h.BatchConfigs).Methods("POST")
+	api.HandleFunc("/{namespace}/bulk", h.BulkConfigs).Methods("GET")
+	api.HandleFunc("/{namespace}/trash", h.ListTrash).Methods("GET")
+	api.HandleFunc("/{namespace}/trash", h.EmptyTrash).Methods("DELETE")
+	api.HandleFunc("/{namespace}/trash/{id}", h.PurgeTrashItem).Methods("DELETE")
+	api.HandleFunc("/{namespace}/trash/{id}/restore", h.RestoreTrash).Methods("POST")
 	admin := r.PathPrefix("/admin").Subrouter()
 	admin.HandleFunc("/tokens", h.CreateToken).Methods("POST")
 	admin.HandleFunc("/tokens", h.ListTokens).Methods("GET")
 	admin.HandleFunc("/tokens/{token}", h.RevokeToken).Methods("DELETE")
+	admin.HandleFunc("/namespaces", h.ListNamespaces).Methods("GET")
+	admin.HandleFunc("/namespaces", h.CreateNamespace).Methods("POST")
+	admin.HandleFunc("/namespaces/{namespace}", h.GetNamespace).Methods("GET")
+	admin.HandleFunc("/namespaces/{namespace}", h.UpdateNamespace).Methods("PUT")
+	admin.HandleFunc("/namespaces/{namespace}", h.DeleteNamespace).Methods("DELETE")
+	admin.HandleFunc("/namespaces/{namespace}/quota", h.GetQuota).Methods("GET")
+	admin.HandleFunc("/namespaces/{namespace}/quota", h.SetQuota).Methods("PUT")
+	admin.HandleFunc("/namespaces/{namespace}/secret-paths", h.GetSecretPaths).Methods("GET")
+	admin.HandleFunc("/namespaces/{namespace}/secret-paths", h.SetSecretPaths).Methods("PUT")
+	admin.HandleFunc("/namespaces/{namespace}/encrypted-paths", h.GetEncryptedPaths).Methods("GET")
+	admin.HandleFunc("/namespaces/{namespace}/encrypted-paths", h.SetEncryptedPaths).Methods("PUT")
+	admin.HandleFunc("/namespaces/{namespace}/referrers", h.GetReferrers).Methods("GET")
+	admin.HandleFunc("/namespaces/{namespace}/referrers", h.SetReferrers).Methods("PUT")
+	admin.HandleFunc("/encryption/rotate", h.RotateKeys).Methods("POST")
+	admin.HandleFunc("/snapshot", h.Snapshot).Methods("GET")
+	admin.HandleFunc("/backup", h.Backup).Methods("GET")
+	admin.HandleFunc("/restore", h.Restore).Methods("POST")
+	admin.HandleFunc("/cache", h.CacheStats).Methods("GET")
 
 	ts := httptest.NewServer(r)
 	t.Cleanup(ts.Close)
-	return ts, a, store
+	return ts
 }
 
 func doRequest(t *testing.T, method, url, token string, body io.Reader) *http.Response {
@@ -345,3 +396,2182 @@ func TestStoreConfig_RejectsMalformedPaths(t *testing.T) {
 	}
 	readBody(t, resp)
 }
+
+func doRequestWithHeaders(t *testing.T, method, url, token string, headers map[string]string, body io.Reader) *http.Response {
+	t.Helper()
+	req, err := http.NewRequest(method, url, body)
+	if err != nil {
+		t.Fatalf("new request: %v", err)
+	}
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	for k, v := range headers {
+		req.Header.Set(k, v)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("do request: %v", err)
+	}
+	return resp
+}
+
+func TestStoreConfig_JSONIsNormalizedToYAML(t *testing.T) {
+	ts, _, store := newTestServer(t)
+
+	resp := doRequestWithHeaders(t, "POST", ts.URL+"/namespaces/dev/configs/app.yaml", "dev-token",
+		map[string]string{"Content-Type": "application/json"},
+		strings.NewReader(`{"app": "hello", "port": 8080}`))
+	if resp.StatusCode != http.StatusCreated {
+		t.Fatalf("expected 201, got %d (%s)", resp.StatusCode, readBody(t, resp))
+	}
+	readBody(t, resp)
+
+	got, err := store.Get("dev", "app.yaml")
+	if err != nil {
+		t.Fatalf("store.Get: %v", err)
+	}
+	if string(got) != "app: hello\nport: 8080\n" {
+		t.Fatalf("stored content mismatch: %q", got)
+	}
+
+	// Content negotiation hands the document back as JSON.
+	resp = doRequestWithHeaders(t, "GET", ts.URL+"/namespaces/dev/configs/app.yaml", "dev-token",
+		map[string]string{"Accept": "application/json"}, nil)
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("expected 200, got %d", resp.StatusCode)
+	}
+	if ct := resp.Header.Get("Content-Type"); ct != "application/json" {
+		t.Fatalf("expected json content type, got %q", ct)
+	}
+	if body := readBody(t, resp); string(body) != "{\"app\":\"hello\",\"port\":8080}\n" {
+		t.Fatalf("json body mismatch: %q", body)
+	}
+}
+
+func TestStoreConfig_TOMLIsNormalizedToYAML(t *testing.T) {
+	ts, _, store := newTestServer(t)
+
+	resp := doRequestWithHeaders(t, "POST", ts.URL+"/namespaces/dev/configs/app.yaml", "dev-token",
+		map[string]string{"Content-Type": "application/toml"},
+		strings.NewReader("name = \"svc\"\n[db]\nport = 5432\n"))
+	if resp.StatusCode != http.StatusCreated {
+		t.Fatalf("expected 201, got %d (%s)", resp.StatusCode, readBody(t, resp))
+	}
+	readBody(t, resp)
+
+	got, err := store.Get("dev", "app.yaml")
+	if err != nil {
+		t.Fatalf("store.Get: %v", err)
+	}
+	if string(got) != "name: svc\ndb:\n  port: 5432\n" {
+		t.Fatalf("stored content mismatch: %q", got)
+	}
+}
+
+func TestStoreConfig_InvalidJSONRejected(t *testing.T) {
+	ts, _, _ := newTestServer(t)
+	resp := doRequestWithHeaders(t, "POST", ts.URL+"/namespaces/dev/configs/app.yaml", "dev-token",
+		map[string]string{"Content-Type": "application/json"}, strings.NewReader(`{"app":`))
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Fatalf("expected 400, got %d", resp.StatusCode)
+	}
+	readBody(t, resp)
+}
+
+func TestGetConfig_NotAcceptable(t *testing.T) {
+	ts, _, store := newTestServer(t)
+	if err := store.Store("dev", "app.yaml", []byte("k: v")); err != nil {
+		t.Fatalf("seed: %v", err)
+	}
+	resp := doRequestWithHeaders(t, "GET", ts.URL+"/namespaces/dev/configs/app.yaml", "dev-token",
+		map[string]string{"Accept": "text/html"}, nil)
+	if resp.StatusCode != http.StatusNotAcceptable {
+		t.Fatalf("expected 406, got %d", resp.StatusCode)
+	}
+	readBody(t, resp)
+}
+
+func TestGetConfig_UnrepresentableInTOML(t *testing.T) {
+	ts, _, store := newTestServer(t)
+	if err := store.Store("dev", "app.yaml", []byte("k: null\n")); err != nil {
+		t.Fatalf("seed: %v", err)
+	}
+	resp := doRequestWithHeaders(t, "GET", ts.URL+"/namespaces/dev/configs/app.yaml", "dev-token",
+		map[string]string{"Accept": "application/toml"}, nil)
+	if resp.StatusCode != http.StatusUnprocessableEntity {
+		t.Fatalf("expected 422, got %d", resp.StatusCode)
+	}
+	readBody(t, resp)
+}
+
+func TestGetConfig_Render(t *testing.T) {
+	ts, _, store := newTestServer(t)
+	t.Setenv(RenderEnvPrefix+"LOG_LEVEL", "debug")
+
+	if err := store.Store("dev", "db.yaml", []byte("host: db.internal\n")); err != nil {
+		t.Fatalf("seed: %v", err)
+	}
+	if err := store.Store("dev", "app.yaml",
+		[]byte("db: ${ref:db.yaml#host}\nlevel: ${env:LOG_LEVEL}\n")); err != nil {
+		t.Fatalf("seed: %v", err)
+	}
+
+	// Without render=true the template is returned verbatim.
+	resp := doRequest(t, "GET", ts.URL+"/namespaces/dev/configs/app.yaml", "dev-token", nil)
+	if body := readBody(t, resp); !strings.Contains(string(body), "${ref:db.yaml#host}") {
+		t.Fatalf("unrendered body should keep expressions: %q", body)
+	}
+
+	resp = doRequest(t, "GET", ts.URL+"/namespaces/dev/configs/app.yaml?render=true", "dev-token", nil)
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("expected 200, got %d (%s)", resp.StatusCode, readBody(t, resp))
+	}
+	if body := readBody(t, resp); string(body) != "db: db.internal\nlevel: debug\n" {
+		t.Fatalf("rendered body mismatch: %q", body)
+	}
+}
+
+func TestGetConfig_RenderChecksAuthOnReferences(t *testing.T) {
+	ts, _, store := newTestServer(t)
+	if err := store.Store("test", "secret.yaml", []byte("password: hunter2\n")); err != nil {
+		t.Fatalf("seed: %v", err)
+	}
+	if err := store.Store("dev", "app.yaml", []byte("pw: ${ref:test/secret.yaml#password}\n")); err != nil {
+		t.Fatalf("seed: %v", err)
+	}
+
+	resp := doRequest(t, "GET", ts.URL+"/namespaces/dev/configs/app.yaml?render=true", "dev-token", nil)
+	body := readBody(t, resp)
+	if resp.StatusCode != http.StatusForbidden {
+		t.Fatalf("expected 403, got %d (%s)", resp.StatusCode, body)
+	}
+	if strings.Contains(string(body), "hunter2") {
+		t.Fatalf("response leaked referenced value: %s", body)
+	}
+}
+
+func TestGetConfig_RenderFollowsReferrerGrants(t *testing.T) {
+	ts, a, store := newTestServer(t)
+	a.AddToken("dev-secrets", "dev", auth.PermReadSecrets)
+	if err := store.Store("test", "db.yaml", []byte("host: db.test\npassword: hunter2\n")); err != nil {
+		t.Fatalf("seed: %v", err)
+	}
+	if err := store.Store("dev", "app.yaml", []byte("host: ${ref:test/db.yaml#host}\npw: ${ref:test/db.yaml#password}\n")); err != nil {
+		t.Fatalf("seed: %v", err)
+	}
+	resp := doRequest(t, "PUT", ts.URL+"/admin/namespaces/test/secret-paths", adminToken,
+		strings.NewReader(`{"paths": ["password"]}`))
+	readBody(t, resp)
+
+	resp = doRequest(t, "PUT", ts.URL+"/admin/namespaces/test/referrers", adminToken,
+		strings.NewReader(`{"namespaces": ["a/b"]}`))
+	if body := readBody(t, resp); resp.StatusCode != http.StatusBadRequest {
+		t.Fatalf("invalid referrer: expected 400, got %d: %s", resp.StatusCode, body)
+	}
+	resp = doRequest(t, "PUT", ts.URL+"/admin/namespaces/test/referrers", "dev-token",
+		strings.NewReader(`{"namespaces": ["dev"]}`))
+	if resp.StatusCode != http.StatusUnauthorized {
+		t.Fatalf("referrers need the admin token, got %d", resp.StatusCode)
+	}
+	readBody(t, resp)
+	resp = doRequest(t, "PUT", ts.URL+"/admin/namespaces/test/referrers", adminToken,
+		strings.NewReader(`{"namespaces": ["dev"]}`))
+	if body := readBody(t, resp); resp.StatusCode != http.StatusOK || !strings.Contains(string(body), `"namespaces":["dev"]`) {
+		t.Fatalf("set referrers: %d %s", resp.StatusCode, body)
+	}
+
+	// The reference resolves, with the values test keeps secret redacted
+	// even for a token that may read secrets in dev.
+	for _, token := range []string{"dev-token", "dev-secrets"} {
+		resp = doRequest(t, "GET", ts.URL+"/namespaces/dev/configs/app.yaml?render=true", token, nil)
+		body := readBody(t, resp)
+		if resp.StatusCode != http.StatusOK || !strings.Contains(string(body), "host: db.test") {
+			t.Fatalf("%s: expected the reference to resolve, got %d: %s", token, resp.StatusCode, body)
+		}
+		if strings.Contains(string(body), "hunter2") {
+			t.Fatalf("%s: referrer saw a secret value: %s", token, body)
+		}
+	}
+
+	// The grant only goes one way.
+	if err := store.Store("dev", "local.yaml", []byte("x: 1\n")); err != nil {
+		t.Fatalf("seed: %v", err)
+	}
+	if err := store.Store("test", "app.yaml", []byte("x: ${ref:dev/local.yaml#x}\n")); err != nil {
+		t.Fatalf("seed: %v", err)
+	}
+	resp = doRequest(t, "GET", ts.URL+"/namespaces/test/configs/app.yaml?render=true", "test-token", nil)
+	if resp.StatusCode != http.StatusForbidden {
+		t.Fatalf("expected 403 without a grant from dev, got %d", resp.StatusCode)
+	}
+	readBody(t, resp)
+}
+
+func TestGetConfig_RenderCycleIsUnprocessable(t *testing.T) {
+	ts, _, store := newTestServer(t)
+	_ = store.Store("dev", "a.yaml", []byte("x: ${ref:b.yaml#x}\n"))
+	_ = store.Store("dev", "b.yaml", []byte("x: ${ref:a.yaml#x}\n"))
+
+	resp := doRequest(t, "GET", ts.URL+"/namespaces/dev/configs/a.yaml?render=true", "dev-token", nil)
+	if resp.StatusCode != http.StatusUnprocessableEntity {
+		t.Fatalf("expected 422, got %d", resp.StatusCode)
+	}
+	readBody(t, resp)
+
+	resp = doRequest(t, "GET", ts.URL+"/namespaces/dev/configs/a.yaml?render=maybe", "dev-token", nil)
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Fatalf("expected 400 for invalid render flag, got %d", resp.StatusCode)
+	}
+	readBody(t, resp)
+}
+
+func TestGetConfig_MergedAndExplain(t *testing.T) {
+	ts, _, store := newTestServer(t)
+	if err := store.Store("dev", "base.yaml", []byte("replicas: 1\nimage: app:1\n")); err != nil {
+		t.Fatalf("seed: %v", err)
+	}
+	if err := store.Store("dev", "app.yaml", []byte("x-yamlet:\n  base: base.yaml\nreplicas: 3\n")); err != nil {
+		t.Fatalf("seed: %v", err)
+	}
+
+	resp := doRequest(t, "GET", ts.URL+"/namespaces/dev/configs/app.yaml?merged=true", "dev-token", nil)
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("expected 200, got %d (%s)", resp.StatusCode, readBody(t, resp))
+	}
+	if body := readBody(t, resp); string(body) != "replicas: 3\nimage: app:1\n" {
+		t.Fatalf("merged body mismatch: %q", body)
+	}
+
+	resp = doRequest(t, "GET", ts.URL+"/namespaces/dev/configs/app.yaml/explain", "dev-token", nil)
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("expected 200, got %d", resp.StatusCode)
+	}
+	var out struct {
+		Layers []string `json:"layers"`
+		Keys   []struct {
+			Path  string `json:"path"`
+			Layer string `json:"layer"`
+		} `json:"keys"`
+	}
+	if err := json.Unmarshal(readBody(t, resp), &out); err != nil {
+		t.Fatalf("json: %v", err)
+	}
+	if len(out.Layers) != 2 || len(out.Keys) != 2 {
+		t.Fatalf("unexpected explain response: %+v", out)
+	}
+	if out.Keys[0].Path != "replicas" || out.Keys[0].Layer != "dev/app.yaml" ||
+		out.Keys[1].Path != "image" || out.Keys[1].Layer != "dev/base.yaml" {
+		t.Fatalf("unexpected key origins: %+v", out.Keys)
+	}
+}
+
+func TestGetConfig_MergedBaseRequiresAuth(t *testing.T) {
+	ts, _, store := newTestServer(t)
+	_ = store.Store("test", "base.yaml", []byte("secret: 1\n"))
+	_ = store.Store("dev", "app.yaml", []byte("x-yamlet: {base: test/base.yaml}\n"))
+
+	resp := doRequest(t, "GET", ts.URL+"/namespaces/dev/configs/app.yaml?merged=true", "dev-token", nil)
+	if resp.StatusCode != http.StatusForbidden {
+		t.Fatalf("expected 403, got %d", resp.StatusCode)
+	}
+	readBody(t, resp)
+}
+
+func TestRevisionsAndDiff(t *testing.T) {
+	ts, _, store := newTestServer(t)
+	for _, content := range []string{"host: a\nport: 1\n", "host: b\nport: 1\n"} {
+		if err := store.Store("dev", "app.yaml", []byte(content)); err != nil {
+			t.Fatalf("seed: %v", err)
+		}
+	}
+
+	resp := doRequest(t, "GET", ts.URL+"/namespaces/dev/configs/app.yaml/revisions", "dev-token", nil)
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("expected 200, got %d", resp.StatusCode)
+	}
+	var revs struct {
+		Count int `json:"count"`
+	}
+	if err := json.Unmarshal(readBody(t, resp), &revs); err != nil || revs.Count != 2 {
+		t.Fatalf("unexpected revisions response: %+v, %v", revs, err)
+	}
+
+	resp = doRequest(t, "GET", ts.URL+"/namespaces/dev/configs/app.yaml?revision=1", "dev-token", nil)
+	if body := readBody(t, resp); string(body) != "host: a\nport: 1\n" {
+		t.Fatalf("revision 1 mismatch: %q", body)
+	}
+
+	resp = doRequest(t, "GET", ts.URL+"/namespaces/dev/configs/app.yaml/diff?from=1&to=2", "dev-token", nil)
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("expected 200, got %d (%s)", resp.StatusCode, readBody(t, resp))
+	}
+	var diff struct {
+		Unified string `json:"unified"`
+		Changes []struct {
+			Path string      `json:"path"`
+			Type string      `json:"type"`
+			Old  interface{} `json:"old"`
+			New  interface{} `json:"new"`
+		} `json:"changes"`
+	}
+	if err := json.Unmarshal(readBody(t, resp), &diff); err != nil {
+		t.Fatalf("json: %v", err)
+	}
+	if !strings.Contains(diff.Unified, "-host: a\n+host: b\n") {
+		t.Fatalf("unexpected unified diff:\n%s", diff.Unified)
+	}
+	if len(diff.Changes) != 1 || diff.Changes[0].Path != "host" || diff.Changes[0].Type != "changed" ||
+		diff.Changes[0].Old != "a" || diff.Changes[0].New != "b" {
+		t.Fatalf("unexpected structural diff: %+v", diff.Changes)
+	}
+
+	resp = doRequest(t, "GET", ts.URL+"/namespaces/dev/configs/app.yaml/diff?from=7", "dev-token", nil)
+	if resp.StatusCode != http.StatusNotFound {
+		t.Fatalf("expected 404 for missing revision, got %d", resp.StatusCode)
+	}
+	readBody(t, resp)
+}
+
+func TestRollbackConfig(t *testing.T) {
+	ts, _, store := newTestServer(t)
+	for _, content := range []string{"v: 1\n", "v: 2\n"} {
+		if err := store.Store("dev", "app.yaml", []byte(content)); err != nil {
+			t.Fatalf("seed: %v", err)
+		}
+	}
+
+	resp := doRequest(t, "POST", ts.URL+"/namespaces/dev/configs/app.yaml/rollback?revision=1", "dev-token", nil)
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("expected 200, got %d (%s)", resp.StatusCode, readBody(t, resp))
+	}
+	readBody(t, resp)
+	if got, _ := store.Get("dev", "app.yaml"); string(got) != "v: 1\n" {
+		t.Fatalf("content after rollback = %q", got)
+	}
+	if revs, _ := store.(storage.Versioned).Revisions("dev", "app.yaml"); len(revs) != 3 {
+		t.Fatalf("rollback should add a revision, got %+v", revs)
+	}
+
+	for query, want := range map[string]int{
+		"":            http.StatusBadRequest,
+		"?revision=x": http.StatusBadRequest,
+		"?revision=9": http.StatusNotFound,
+	} {
+		resp := doRequest(t, "POST", ts.URL+"/namespaces/dev/configs/app.yaml/rollback"+query, "dev-token", nil)
+		if resp.StatusCode != want {
+			t.Fatalf("rollback%s: expected %d, got %d", query, want, resp.StatusCode)
+		}
+		readBody(t, resp)
+	}
+
+	resp = doRequest(t, "POST", ts.URL+"/namespaces/test/configs/app.yaml/rollback?revision=1", "dev-token", nil)
+	if resp.StatusCode != http.StatusForbidden {
+		t.Fatalf("expected 403 for another namespace, got %d", resp.StatusCode)
+	}
+	readBody(t, resp)
+}
+
+func TestChangesAttributedToToken(t *testing.T) {
+	if _, err := exec.LookPath("git"); err != nil {
+		t.Skip("git is not installed")
+	}
+	dir := filepath.Join(t.TempDir(), "repo")
+	store, err := storage.NewGitStore(dir, storage.GitOptions{})
+	if err != nil {
+		t.Fatalf("NewGitStore: %v", err)
+	}
+	ts := serveHandler(t, NewHandler(store, auth.NewTokenAuth()))
+
+	resp := doRequest(t, "POST", ts.URL+"/namespaces/dev/configs/app.yaml", "dev-token", strings.NewReader("v: 1\n"))
+	if resp.StatusCode != http.StatusCreated {
+		t.Fatalf("expected 201, got %d (%s)", resp.StatusCode, readBody(t, resp))
+	}
+	readBody(t, resp)
+	resp = doRequest(t, "DELETE", ts.URL+"/namespaces/dev/configs/app.yaml", "dev-token", nil)
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("expected 200, got %d", resp.StatusCode)
+	}
+	readBody(t, resp)
+
+	out, err := exec.Command("git", "-C", dir, "log", "--format=%an <%ae>").Output()
+	if err != nil {
+		t.Fatal(err)
+	}
+	fp := auth.Fingerprint("dev-token")
+	author := "dev token " + fp + " <token-" + fp + "@yamlet.invalid>\n"
+	want := author + author
+	if string(out) != want {
+		t.Fatalf("git log authors =\n%s\nwant\n%s", out, want)
+	}
+}
+
+func TestDiffAcrossNamespaces(t *testing.T) {
+	ts, a, store := newTestServer(t)
+	_ = store.Store("dev", "app.yaml", []byte("replicas: 1\n"))
+	_ = store.Store("test", "app.yaml", []byte("replicas: 3\n"))
+
+	// dev-token cannot read the test namespace.
+	resp := doRequest(t, "GET", ts.URL+"/namespaces/dev/configs/app.yaml/diff?other_namespace=test", "dev-token", nil)
+	if resp.StatusCode != http.StatusForbidden {
+		t.Fatalf("expected 403, got %d", resp.StatusCode)
+	}
+	readBody(t, resp)
+
+	// Comparing a namespace with itself only needs the one token.
+	a.AddToken("dev-reader", "dev")
+	resp = doRequest(t, "GET", ts.URL+"/namespaces/dev/configs/app.yaml/diff?other_namespace=dev", "dev-reader", nil)
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("expected 200, got %d", resp.StatusCode)
+	}
+	var diff struct {
+		Unified string `json:"unified"`
+	}
+	if err := json.Unmarshal(readBody(t, resp), &diff); err != nil || diff.Unified != "" {
+		t.Fatalf("identical configs should have an empty diff: %+v, %v", diff, err)
+	}
+
+	// A token for the other namespace authorizes its side of the diff.
+	resp = doRequestWithHeaders(t, "GET", ts.URL+"/namespaces/dev/configs/app.yaml/diff?other_namespace=test", "dev-token",
+		map[string]string{"X-Yamlet-Other-Token": "Bearer test-token"}, nil)
+	if body := readBody(t, resp); resp.StatusCode != http.StatusOK {
+		t.Fatalf("expected 200, got %d: %s", resp.StatusCode, body)
+	} else if err := json.Unmarshal(body, &diff); err != nil || !strings.Contains(diff.Unified, "+replicas: 3") {
+		t.Fatalf("unexpected diff across namespaces: %+v, %v", diff, err)
+	}
+
+	// The other token must itself be valid for the other namespace.
+	resp = doRequestWithHeaders(t, "GET", ts.URL+"/namespaces/dev/configs/app.yaml/diff?other_namespace=test", "dev-token",
+		map[string]string{"X-Yamlet-Other-Token": "dev-reader"}, nil)
+	if resp.StatusCode != http.StatusForbidden {
+		t.Fatalf("expected 403 for a dev token on test, got %d", resp.StatusCode)
+	}
+	readBody(t, resp)
+}
+
+const testManifests = `kind: Deployment
+metadata:
+  name: api
+spec:
+  replicas: 1
+---
+kind: Service
+metadata:
+  name: api
+`
+
+func TestStoreConfig_InvalidDocumentRejected(t *testing.T) {
+	ts, _, _ := newTestServer(t)
+	resp := doRequest(t, "POST", ts.URL+"/namespaces/dev/configs/app.yaml", "dev-token",
+		strings.NewReader("a: 1\n---\nb: [\n"))
+	body := readBody(t, resp)
+	if resp.StatusCode != http.StatusBadRequest || !strings.Contains(string(body), "document 1") {
+		t.Fatalf("expected 400 naming document 1, got %d: %s", resp.StatusCode, body)
+	}
+}
+
+func TestGetConfig_SelectsDocument(t *testing.T) {
+	ts, _, _ := newTestServer(t)
+	resp := doRequest(t, "POST", ts.URL+"/namespaces/dev/configs/app.yaml", "dev-token", strings.NewReader(testManifests))
+	var stored struct {
+		Documents int `json:"documents"`
+	}
+	if err := json.Unmarshal(readBody(t, resp), &stored); err != nil || stored.Documents != 2 {
+		t.Fatalf("expected 2 documents in store response: %+v, %v", stored, err)
+	}
+
+	cases := []struct {
+		query  string
+		status int
+		want   string
+	}{
+		{"?document=1", http.StatusOK, "kind: Service\nmetadata:\n  name: api\n"},
+		{"?selector=kind=Deployment", http.StatusOK, "kind: Deployment\nmetadata:\n  name: api\nspec:\n  replicas: 1\n"},
+		{"?selector=metadata.name=api", http.StatusUnprocessableEntity, ""},
+		{"?selector=kind=Job", http.StatusNotFound, ""},
+		{"?document=2", http.StatusNotFound, ""},
+		{"?document=-1", http.StatusBadRequest, ""},
+		{"?selector=kind", http.StatusBadRequest, ""},
+		{"?document=0&selector=kind=Service", http.StatusBadRequest, ""},
+	}
+	for _, c := range cases {
+		resp := doRequest(t, "GET", ts.URL+"/namespaces/dev/configs/app.yaml"+c.query, "dev-token", nil)
+		body := readBody(t, resp)
+		if resp.StatusCode != c.status {
+			t.Errorf("%s: expected %d, got %d: %s", c.query, c.status, resp.StatusCode, body)
+			continue
+		}
+		if c.want != "" && string(body) != c.want {
+			t.Errorf("%s: body %q, want %q", c.query, body, c.want)
+		}
+	}
+}
+
+func TestPatchConfig(t *testing.T) {
+	ts, _, store := newTestServer(t)
+	_ = store.Store("dev", "app.yaml", []byte(testManifests))
+
+	// A multi-document stream needs a selection.
+	resp := doRequest(t, "PATCH", ts.URL+"/namespaces/dev/configs/app.yaml", "dev-token",
+		strings.NewReader("spec: {replicas: 3}\n"))
+	if resp.StatusCode != http.StatusUnprocessableEntity {
+		t.Fatalf("expected 422 without a selector, got %d", resp.StatusCode)
+	}
+	readBody(t, resp)
+
+	resp = doRequestWithHeaders(t, "PATCH", ts.URL+"/namespaces/dev/configs/app.yaml?selector=kind=Deployment", "dev-token",
+		map[string]string{"Content-Type": "application/merge-patch+json"},
+		strings.NewReader(`{"spec": {"replicas": 3}, "metadata": {"labels": {"tier": "web"}}}`))
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("expected 200, got %d: %s", resp.StatusCode, readBody(t, resp))
+	}
+	readBody(t, resp)
+
+	got, _ := store.Get("dev", "app.yaml")
+	want := `kind: Deployment
+metadata:
+  name: api
+  labels:
+    tier: web
+spec:
+  replicas: 3
+---
+kind: Service
+metadata:
+  name: api
+`
+	if string(got) != want {
+		t.Fatalf("patched content mismatch:\n got:\n%s\nwant:\n%s", got, want)
+	}
+
+	resp = doRequest(t, "PATCH", ts.URL+"/namespaces/dev/configs/missing.yaml", "dev-token", strings.NewReader("a: 1\n"))
+	if resp.StatusCode != http.StatusNotFound {
+		t.Fatalf("expected 404 for missing config, got %d", resp.StatusCode)
+	}
+	readBody(t, resp)
+}
+
+func TestListConfigs_Detail(t *testing.T) {
+	ts, _, store := newTestServer(t)
+	_ = store.Store("dev", "app.yaml", []byte(testManifests))
+	_ = store.Store("dev", "single.yaml", []byte("x: y\n"))
+
+	resp := doRequest(t, "GET", ts.URL+"/namespaces/dev/configs?detail=true", "dev-token", nil)
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("expected 200, got %d", resp.StatusCode)
+	}
+	var out struct {
+		Items []struct {
+			Name      string `json:"name"`
+			Size      int    `json:"size"`
+			Documents int    `json:"documents"`
+		} `json:"items"`
+	}
+	if err := json.Unmarshal(readBody(t, resp), &out); err != nil {
+		t.Fatalf("json: %v", err)
+	}
+	docs := make(map[string]int)
+	for _, item := range out.Items {
+		docs[item.Name] = item.Documents
+	}
+	if len(out.Items) != 2 || docs["app.yaml"] != 2 || docs["single.yaml"] != 1 {
+		t.Fatalf("unexpected items: %+v", out.Items)
+	}
+}
+
+func TestListConfigs_Filtering(t *testing.T) {
+	ts, _, store := newTestServer(t)
+	md := store.(storage.MetadataStore)
+	for name, app := range map[string]string{"api.yaml": "api", "api-v2.yaml": "api", "db.yaml": "db", "web.json": "web", "notes.txt": ""} {
+		_ = store.Store("dev", name, []byte("x: 1\n"))
+		if app != "" {
+			_ = md.SetMetadata("dev", name, storage.Metadata{Labels: map[string]string{"app": app}})
+		}
+	}
+
+	list := func(query string) (names []string, next string) {
+		t.Helper()
+		resp := doRequest(t, "GET", ts.URL+"/namespaces/dev/configs"+query, "dev-token", nil)
+		if resp.StatusCode != http.StatusOK {
+			t.Fatalf("list%s: expected 200, got %d (%s)", query, resp.StatusCode, readBody(t, resp))
+		}
+		var out struct {
+			Configs  []string `json:"configs"`
+			Count    int      `json:"count"`
+			Continue string   `json:"continue"`
+		}
+		if err := json.Unmarshal(readBody(t, resp), &out); err != nil || out.Count != len(out.Configs) {
+			t.Fatalf("list%s: %+v, %v", query, out, err)
+		}
+		return out.Configs, out.Continue
+	}
+
+	for query, want := range map[string]string{
+		"":                                "api-v2.yaml api.yaml db.yaml notes.txt web.json",
+		"?sort=-name":                     "web.json notes.txt db.yaml api.yaml api-v2.yaml",
+		"?prefix=api":                     "api-v2.yaml api.yaml",
+		"?glob=*.yaml":                    "api-v2.yaml api.yaml db.yaml",
+		"?label_selector=app%3Dapi":       "api-v2.yaml api.yaml",
+		"?label_selector=app!%3Dapi":      "db.yaml notes.txt web.json",
+		"?label_selector=app+in+(db,web)": "db.yaml web.json",
+		"?label_selector=!app":            "notes.txt",
+	} {
+		if names, next := list(query); strings.Join(names, " ") != want || next != "" {
+			t.Errorf("list%s = %q (continue %q), want %q", query, names, next, want)
+		}
+	}
+
+	var all []string
+	query := "?limit=2&sort=-name"
+	for i := 0; ; i++ {
+		names, next := list(query)
+		all = append(all, names...)
+		if next == "" || i > 5 {
+			break
+		}
+		query = "?limit=2&sort=-name&continue=" + next
+	}
+	if strings.Join(all, " ") != "web.json notes.txt db.yaml api.yaml api-v2.yaml" {
+		t.Fatalf("paged listing = %q", all)
+	}
+
+	for _, query := range []string{"?glob=[", "?label_selector=app+in+x", "?sort=size", "?limit=0", "?continue=%21%21"} {
+		resp := doRequest(t, "GET", ts.URL+"/namespaces/dev/configs"+query, "dev-token", nil)
+		if resp.StatusCode != http.StatusBadRequest {
+			t.Errorf("list%s: expected 400, got %d", query, resp.StatusCode)
+		}
+		readBody(t, resp)
+	}
+}
+
+func TestConfigMetadata(t *testing.T) {
+	ts, _, _ := newTestServer(t)
+
+	req, _ := http.NewRequest("POST", ts.URL+"/namespaces/dev/configs/app.yaml", strings.NewReader(`{"v": 1}`))
+	req.Header.Set("Authorization", "Bearer dev-token")
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(LabelsHeader, "app=api, tier=web")
+	req.Header.Set(AnnotationsHeader, "example.com/owner=team+a%2C+on+call")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("do request: %v", err)
+	}
+	if resp.StatusCode != http.StatusCreated {
+		t.Fatalf("expected 201, got %d (%s)", resp.StatusCode, readBody(t, resp))
+	}
+	readBody(t, resp)
+
+	resp = doRequest(t, "GET", ts.URL+"/namespaces/dev/configs/app.yaml", "dev-token", nil)
+	body := readBody(t, resp)
+	sum := sha256.Sum256(body)
+	if got := resp.Header.Get(ContentSHA256Header); got != hex.EncodeToString(sum[:]) {
+		t.Fatalf("%s = %q, want the hash of %q", ContentSHA256Header, got, body)
+	}
+	if got := resp.Header.Get(UpdatedByHeader); got != auth.Fingerprint("dev-token") {
+		t.Fatalf("%s = %q", UpdatedByHeader, got)
+	}
+	if resp.Header.Get("Last-Modified") == "" || resp.Header.Get(CreatedHeader) == "" {
+		t.Fatalf("missing timestamps: %v", resp.Header)
+	}
+	if got := resp.Header.Get(LabelsHeader); got != "app=api,tier=web" {
+		t.Fatalf("%s = %q", LabelsHeader, got)
+	}
+	if got := resp.Header.Get(AnnotationsHeader); got != "example.com/owner=team+a%2C+on+call" {
+		t.Fatalf("%s = %q", AnnotationsHeader, got)
+	}
+
+	// Writes without metadata headers keep labels and creation time.
+	getMetadata := func() storage.Metadata {
+		t.Helper()
+		resp := doRequest(t, "GET", ts.URL+"/namespaces/dev/configs/app.yaml/metadata", "dev-token", nil)
+		if resp.StatusCode != http.StatusOK {
+			t.Fatalf("expected 200, got %d (%s)", resp.StatusCode, readBody(t, resp))
+		}
+		var out struct {
+			Metadata storage.Metadata `json:"metadata"`
+		}
+		if err := json.Unmarshal(readBody(t, resp), &out); err != nil {
+			t.Fatalf("json: %v", err)
+		}
+		return out.Metadata
+	}
+	before := getMetadata()
+	if before.ContentType != "application/json" || before.Annotations["example.com/owner"] != "team a, on call" {
+		t.Fatalf("unexpected metadata: %+v", before)
+	}
+	resp = doRequest(t, "PATCH", ts.URL+"/namespaces/dev/configs/app.yaml", "dev-token", strings.NewReader("v: 2"))
+	readBody(t, resp)
+	after := getMetadata()
+	if !after.Created.Equal(before.Created) || after.Labels["tier"] != "web" || after.SHA256 == before.SHA256 ||
+		after.ContentType != "application/json" {
+		t.Fatalf("metadata after patch = %+v, before %+v", after, before)
+	}
+
+	// PUT replaces labels and annotations only.
+	resp = doRequest(t, "PUT", ts.URL+"/namespaces/dev/configs/app.yaml/metadata", "dev-token",
+		strings.NewReader(`{"labels": {"app": "web"}}`))
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("expected 200, got %d (%s)", resp.StatusCode, readBody(t, resp))
+	}
+	readBody(t, resp)
+	if md := getMetadata(); len(md.Labels) != 1 || md.Labels["app"] != "web" || len(md.Annotations) != 0 ||
+		md.SHA256 != after.SHA256 {
+		t.Fatalf("metadata after PUT = %+v", md)
+	}
+
+	for _, tc := range []struct {
+		method, path, header, body string
+		want                       int
+	}{
+		{"POST", "configs/app.yaml", "app=has space", "v: 3", http.StatusBadRequest},
+		{"POST", "configs/app.yaml", "novalue", "v: 3", http.StatusBadRequest},
+		{"PUT", "configs/app.yaml/metadata", "", `{"labels": {"-bad": "x"}}`, http.StatusBadRequest},
+		{"PUT", "configs/missing.yaml/metadata", "", `{}`, http.StatusNotFound},
+		{"GET", "configs/missing.yaml/metadata", "", "", http.StatusNotFound},
+	} {
+		req, _ := http.NewRequest(tc.method, ts.URL+"/namespaces/dev/"+tc.path, strings.NewReader(tc.body))
+		req.Header.Set("Authorization", "Bearer dev-token")
+		if tc.header != "" {
+			req.Header.Set(LabelsHeader, tc.header)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("do request: %v", err)
+		}
+		if resp.StatusCode != tc.want {
+			t.Errorf("%s %s with labels %q: expected %d, got %d", tc.method, tc.path, tc.header, tc.want, resp.StatusCode)
+		}
+		readBody(t, resp)
+	}
+
+	resp = doRequest(t, "GET", ts.URL+"/namespaces/dev/configs?detail=true", "dev-token", nil)
+	var list struct {
+		Items []configInfo `json:"items"`
+	}
+	if err := json.Unmarshal(readBody(t, resp), &list); err != nil {
+		t.Fatalf("json: %v", err)
+	}
+	if len(list.Items) != 1 || list.Items[0].Metadata == nil || list.Items[0].Metadata.Labels["app"] != "web" {
+		t.Fatalf("unexpected items: %+v", list.Items)
+	}
+}
+
+func TestStoreConfig_YAMLBombRejected(t *testing.T) {
+	ts, _, store := newTestServer(t)
+	bomb := `a: &a ["lol","lol","lol","lol","lol","lol","lol","lol","lol"]
+b: &b [*a,*a,*a,*a,*a,*a,*a,*a,*a]
+c: &c [*b,*b,*b,*b,*b,*b,*b,*b,*b]
+d: &d [*c,*c,*c,*c,*c,*c,*c,*c,*c]
+e: &e [*d,*d,*d,*d,*d,*d,*d,*d,*d]
+f: &f [*e,*e,*e,*e,*e,*e,*e,*e,*e]
+g: &g [*f,*f,*f,*f,*f,*f,*f,*f,*f]
+`
+	resp := doRequest(t, "POST", ts.URL+"/namespaces/dev/configs/bomb.yaml", "dev-token", strings.NewReader(bomb))
+	body := readBody(t, resp)
+	if resp.StatusCode != http.StatusUnprocessableEntity || !strings.Contains(string(body), "alias expansion limit") {
+		t.Fatalf("expected 422 naming the alias limit, got %d: %s", resp.StatusCode, body)
+	}
+	if _, err := store.Get("dev", "bomb.yaml"); err == nil {
+		t.Fatalf("rejected config must not be stored")
+	}
+
+	// Configs that predate the limits are still checked when parsed on read.
+	_ = store.Store("dev", "old.yaml", []byte(bomb))
+	resp = doRequestWithHeaders(t, "GET", ts.URL+"/namespaces/dev/configs/old.yaml", "dev-token",
+		map[string]string{"Accept": "application/json"}, nil)
+	body = readBody(t, resp)
+	if resp.StatusCode != http.StatusUnprocessableEntity || !strings.Contains(string(body), "alias expansion limit") {
+		t.Fatalf("expected 422 on read, got %d: %s", resp.StatusCode, body)
+	}
+}
+
+func TestGetConfig_RedactsSecrets(t *testing.T) {
+	t.Setenv("YAMLET_SECRET_PATHS", "dev:secrets")
+	ts, a, store := newTestServer(t)
+	a.AddToken("dev-auditor", "dev", auth.PermReadSecrets)
+	content := "app: svc\nsecrets:\n  api_key: k\nx-yamlet:\n  secrets: [db.password]\ndb:\n  password: p\n"
+	_ = store.Store("dev", "app.yaml", []byte(content))
+
+	resp := doRequest(t, "GET", ts.URL+"/namespaces/dev/configs/app.yaml", "dev-token", nil)
+	body := readBody(t, resp)
+	if resp.StatusCode != http.StatusOK || resp.Header.Get(RedactedHeader) != "true" {
+		t.Fatalf("expected a redacted 200, got %d (%s)", resp.StatusCode, resp.Header.Get(RedactedHeader))
+	}
+	if strings.Contains(string(body), "api_key") || strings.Contains(string(body), "password: p") {
+		t.Fatalf("secret values leaked: %s", body)
+	}
+
+	resp = doRequest(t, "GET", ts.URL+"/namespaces/dev/configs/app.yaml", "dev-auditor", nil)
+	body = readBody(t, resp)
+	if string(body) != content || resp.Header.Get(RedactedHeader) != "" {
+		t.Fatalf("read-secrets token should see the raw config, got %q", body)
+	}
+
+	// Revisions are served through GetConfig and redacted the same way.
+	resp = doRequest(t, "GET", ts.URL+"/namespaces/dev/configs/app.yaml?revision=1", "dev-token", nil)
+	if body := readBody(t, resp); strings.Contains(string(body), "password: p") {
+		t.Fatalf("revision leaked a secret: %s", body)
+	}
+}
+
+func TestGetConfig_ServesRawWithoutSecrets(t *testing.T) {
+	ts, _, store := newTestServer(t)
+	// A config stored before uploads were validated, which does not parse.
+	legacy := "key: [unclosed\n"
+	_ = store.Store("dev", "legacy.yaml", []byte(legacy))
+
+	resp := doRequest(t, "GET", ts.URL+"/namespaces/dev/configs/legacy.yaml", "dev-token", nil)
+	if body := readBody(t, resp); resp.StatusCode != http.StatusOK || string(body) != legacy {
+		t.Fatalf("a config without secrets should be served as stored, got %d %q", resp.StatusCode, body)
+	}
+	resp = doRequest(t, "GET", ts.URL+"/namespaces/dev/bulk?glob=*.yaml", "dev-token", nil)
+	if body := readBody(t, resp); resp.StatusCode != http.StatusOK || !strings.Contains(string(body), `"status":200`) {
+		t.Fatalf("a bulk fetch should serve the config as stored, got %d %s", resp.StatusCode, body)
+	}
+
+	// With secret paths in the namespace the config has to be parsed.
+	t.Setenv("YAMLET_SECRET_PATHS", "dev:secrets")
+	ts, _, store = newTestServer(t)
+	_ = store.Store("dev", "legacy.yaml", []byte(legacy))
+	resp = doRequest(t, "GET", ts.URL+"/namespaces/dev/configs/legacy.yaml", "dev-token", nil)
+	if body := readBody(t, resp); resp.StatusCode != http.StatusUnprocessableEntity {
+		t.Fatalf("expected 422 when the config must be redacted, got %d %q", resp.StatusCode, body)
+	}
+}
+
+func TestRedactionAppliesToReferencesAndDiffs(t *testing.T) {
+	t.Setenv("YAMLET_SECRET_PATHS", "dev:**.password")
+	ts, _, store := newTestServer(t)
+	_ = store.Store("dev", "db.yaml", []byte("password: hunter2\n"))
+	_ = store.Store("dev", "app.yaml", []byte("dsn: postgres://app:${ref:db.yaml#password}@db\n"))
+
+	resp := doRequest(t, "GET", ts.URL+"/namespaces/dev/configs/app.yaml?render=true", "dev-token", nil)
+	if body := readBody(t, resp); strings.Contains(string(body), "hunter2") {
+		t.Fatalf("rendered reference leaked a secret: %s", body)
+	}
+
+	_ = store.Store("dev", "db.yaml", []byte("password: swordfish\nhost: db\n"))
+	resp = doRequest(t, "GET", ts.URL+"/namespaces/dev/configs/db.yaml/diff?from=1", "dev-token", nil)
+	body := readBody(t, resp)
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("expected 200, got %d: %s", resp.StatusCode, body)
+	}
+	if strings.Contains(string(body), "hunter2") || strings.Contains(string(body), "swordfish") {
+		t.Fatalf("diff leaked a secret: %s", body)
+	}
+}
+
+func TestAdmin_PolicySurvivesRestart(t *testing.T) {
+	dir := t.TempDir()
+	store := storage.NewFileStore(dir)
+	serve := func() *httptest.Server {
+		h := NewHandler(store, auth.NewTokenAuth())
+		k := fieldcrypt.NewKeyring()
+		if err := k.AddKey("primary", base64.StdEncoding.EncodeToString(bytes.Repeat([]byte{7}, 32))); err != nil {
+			t.Fatal(err)
+		}
+		h.SetKeyring(k)
+		if err := h.LoadPolicy(); err != nil {
+			t.Fatalf("LoadPolicy: %v", err)
+		}
+		return serveHandler(t, h)
+	}
+	ts := serve()
+	readBody(t, doRequest(t, "POST", ts.URL+"/namespaces/dev/configs/app.yaml", "dev-token", strings.NewReader("token: abc\n")))
+	resp := doRequest(t, "PUT", ts.URL+"/admin/namespaces/dev/secret-paths", adminToken,
+		strings.NewReader(`{"paths": ["token"]}`))
+	if body := readBody(t, resp); resp.StatusCode != http.StatusOK {
+		t.Fatalf("expected 200, got %d: %s", resp.StatusCode, body)
+	}
+	resp = doRequest(t, "PUT", ts.URL+"/admin/namespaces/dev/encrypted-paths", adminToken,
+		strings.NewReader(`{"paths": ["db.password"]}`))
+	if body := readBody(t, resp); resp.StatusCode != http.StatusOK {
+		t.Fatalf("expected 200, got %d: %s", resp.StatusCode, body)
+	}
+	resp = doRequest(t, "PUT", ts.URL+"/admin/namespaces/dev/quota", adminToken,
+		strings.NewReader(`{"max_configs": 2}`))
+	if body := readBody(t, resp); resp.StatusCode != http.StatusOK {
+		t.Fatalf("expected 200, got %d: %s", resp.StatusCode, body)
+	}
+
+	ts = serve()
+	resp = doRequest(t, "GET", ts.URL+"/namespaces/dev/configs/app.yaml", "dev-token", nil)
+	if body := readBody(t, resp); string(body) != "token: <redacted>\n" {
+		t.Fatalf("secret paths should survive a restart, got %q", body)
+	}
+	readBody(t, doRequest(t, "POST", ts.URL+"/namespaces/dev/configs/db.yaml", "dev-token", strings.NewReader("db:\n  password: hunter2\n")))
+	if stored, _ := store.Get("dev", "db.yaml"); strings.Contains(string(stored), "hunter2") {
+		t.Fatalf("encrypted paths should survive a restart, stored %q", stored)
+	}
+	resp = doRequest(t, "POST", ts.URL+"/namespaces/dev/configs/third.yaml", "dev-token", strings.NewReader("a: 1\n"))
+	if body := readBody(t, resp); resp.StatusCode != http.StatusInsufficientStorage {
+		t.Fatalf("quotas should survive a restart, got %d: %s", resp.StatusCode, body)
+	}
+
+	// The policy record does not make the namespace exist.
+	resp = doRequest(t, "POST", ts.URL+"/admin/namespaces", adminToken, strings.NewReader(`{"name": "dev"}`))
+	if body := readBody(t, resp); resp.StatusCode != http.StatusCreated || !strings.Contains(string(body), `"secret_paths":["token"]`) {
+		t.Fatalf("expected 201 keeping the policy, got %d: %s", resp.StatusCode, body)
+	}
+}
+
+func TestAdmin_SecretPaths(t *testing.T) {
+	ts, _, store := newTestServer(t)
+	_ = store.Store("dev", "app.yaml", []byte("token: abc\n"))
+
+	resp := doRequest(t, "PUT", ts.URL+"/admin/namespaces/dev/secret-paths", "dev-token",
+		strings.NewReader(`{"paths": ["token"]}`))
+	if resp.StatusCode != http.StatusUnauthorized {
+		t.Fatalf("expected 401 for non-admin, got %d", resp.StatusCode)
+	}
+	readBody(t, resp)
+
+	resp = doRequest(t, "PUT", ts.URL+"/admin/namespaces/dev/secret-paths", adminToken,
+		strings.NewReader(`{"paths": ["a..b"]}`))
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Fatalf("expected 400 for invalid pattern, got %d", resp.StatusCode)
+	}
+	readBody(t, resp)
+
+	resp = doRequest(t, "PUT", ts.URL+"/admin/namespaces/dev/secret-paths", adminToken,
+		strings.NewReader(`{"paths": ["token"]}`))
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("expected 200, got %d", resp.StatusCode)
+	}
+	readBody(t, resp)
+
+	resp = doRequest(t, "GET", ts.URL+"/namespaces/dev/configs/app.yaml", "dev-token", nil)
+	if body := readBody(t, resp); string(body) != "token: <redacted>\n" {
+		t.Fatalf("expected redacted token, got %q", body)
+	}
+
+	resp = doRequest(t, "POST", ts.URL+"/admin/tokens", adminToken,
+		strings.NewReader(`{"token": "dev-ops", "namespace": "dev", "permissions": ["read-secrets"]}`))
+	if resp.StatusCode != http.StatusCreated {
+		t.Fatalf("expected 201, got %d", resp.StatusCode)
+	}
+	readBody(t, resp)
+	resp = doRequest(t, "GET", ts.URL+"/namespaces/dev/configs/app.yaml", "dev-ops", nil)
+	if body := readBody(t, resp); string(body) != "token: abc\n" {
+		t.Fatalf("read-secrets token should see the value, got %q", body)
+	}
+
+	resp = doRequest(t, "POST", ts.URL+"/admin/tokens", adminToken,
+		strings.NewReader(`{"token": "dev-x", "namespace": "dev", "permissions": ["fly"]}`))
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Fatalf("expected 400 for unknown permission, got %d", resp.StatusCode)
+	}
+	readBody(t, resp)
+}
+
+func newEncryptingServer(t *testing.T) (*httptest.Server, storage.Store) {
+	t.Helper()
+	store := storage.NewMemoryStore()
+	a := auth.NewTokenAuth()
+	h := NewHandler(store, a)
+	k := fieldcrypt.NewKeyring()
+	if err := k.AddKey("primary", base64.StdEncoding.EncodeToString(bytes.Repeat([]byte{7}, 32))); err != nil {
+		t.Fatal(err)
+	}
+	h.SetKeyring(k)
+	return serveHandler(t, h), store
+}
+
+func TestFieldEncryption(t *testing.T) {
+	t.Setenv("YAMLET_ENCRYPT_PATHS", "dev:db.password")
+	ts, store := newEncryptingServer(t)
+
+	resp := doRequest(t, "POST", ts.URL+"/namespaces/dev/configs/app.yaml", "dev-token",
+		strings.NewReader("db:\n  host: localhost\n  password: hunter2\n"))
+	body := readBody(t, resp)
+	if resp.StatusCode != http.StatusCreated || !strings.Contains(string(body), `"encrypted":1`) {
+		t.Fatalf("expected 201 with one encrypted value, got %d: %s", resp.StatusCode, body)
+	}
+	stored, _ := store.Get("dev", "app.yaml")
+	if strings.Contains(string(stored), "hunter2") || !strings.Contains(string(stored), fieldcrypt.MetadataKey) {
+		t.Fatalf("value not encrypted at rest:\n%s", stored)
+	}
+
+	resp = doRequest(t, "GET", ts.URL+"/namespaces/dev/configs/app.yaml", "dev-token", nil)
+	if body := readBody(t, resp); string(body) != "db:\n  host: localhost\n  password: hunter2\n" {
+		t.Fatalf("expected decrypted config, got %q", body)
+	}
+
+	// Export keeps values encrypted, and an exported config can be stored
+	// again as is.
+	resp = doRequest(t, "GET", ts.URL+"/namespaces/dev/configs/app.yaml?encrypted=true", "dev-token", nil)
+	exported := readBody(t, resp)
+	if string(exported) != string(stored) {
+		t.Fatalf("export should return the stored form, got %q", exported)
+	}
+	resp = doRequest(t, "POST", ts.URL+"/namespaces/dev/configs/app.yaml", "dev-token", bytes.NewReader(exported))
+	if body := readBody(t, resp); resp.StatusCode != http.StatusCreated && resp.StatusCode != http.StatusOK {
+		t.Fatalf("re-importing an export: %d %s", resp.StatusCode, body)
+	}
+
+	// Encrypted values are bound to their config: copied to another one,
+	// in another namespace or the same, they are refused rather than
+	// decrypted for whoever can read the copy.
+	for _, target := range []struct{ namespace, name, token string }{
+		{"test", "app.yaml", "test-token"},
+		{"dev", "copy.yaml", "dev-token"},
+	} {
+		resp = doRequest(t, "POST", ts.URL+"/namespaces/"+target.namespace+"/configs/"+target.name, target.token, bytes.NewReader(exported))
+		if body := readBody(t, resp); resp.StatusCode != http.StatusUnprocessableEntity {
+			t.Fatalf("storing ciphertext copied to %s/%s: expected 422, got %d: %s", target.namespace, target.name, resp.StatusCode, body)
+		}
+	}
+	if err := store.Store("test", "app.yaml", exported); err != nil {
+		t.Fatal(err)
+	}
+	resp = doRequest(t, "GET", ts.URL+"/namespaces/test/configs/app.yaml", "test-token", nil)
+	if body := readBody(t, resp); resp.StatusCode == http.StatusOK || strings.Contains(string(body), "hunter2") {
+		t.Fatalf("ciphertext planted in another namespace must not decrypt, got %d: %s", resp.StatusCode, body)
+	}
+	resp = doRequest(t, "GET", ts.URL+"/namespaces/dev/configs/app.yaml?encrypted=true&render=true", "dev-token", nil)
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Fatalf("expected 400 for encrypted with render, got %d", resp.StatusCode)
+	}
+	readBody(t, resp)
+
+	// Patching keeps the sealed value and encrypts new ones.
+	resp = doRequest(t, "PATCH", ts.URL+"/namespaces/dev/configs/app.yaml", "dev-token",
+		strings.NewReader("db:\n  host: db.internal\n"))
+	if body := readBody(t, resp); resp.StatusCode != http.StatusOK {
+		t.Fatalf("patch: %d %s", resp.StatusCode, body)
+	}
+	resp = doRequest(t, "GET", ts.URL+"/namespaces/dev/configs/app.yaml", "dev-token", nil)
+	if body := readBody(t, resp); string(body) != "db:\n  host: db.internal\n  password: hunter2\n" {
+		t.Fatalf("unexpected config after patch: %q", body)
+	}
+
+	// Values encrypted under keys this server does not hold are refused.
+	foreign := strings.Replace(string(stored), "key_id: primary", "key_id: other", 1)
+	resp = doRequest(t, "POST", ts.URL+"/namespaces/dev/configs/foreign.yaml", "dev-token", strings.NewReader(foreign))
+	if body := readBody(t, resp); resp.StatusCode != http.StatusUnprocessableEntity {
+		t.Fatalf("expected 422 for undecryptable upload, got %d: %s", resp.StatusCode, body)
+	}
+}
+
+func TestFieldEncryption_RedactsAfterDecrypting(t *testing.T) {
+	t.Setenv("YAMLET_ENCRYPT_PATHS", "dev:password")
+	t.Setenv("YAMLET_SECRET_PATHS", "dev:password")
+	ts, _ := newEncryptingServer(t)
+
+	resp := doRequest(t, "POST", ts.URL+"/namespaces/dev/configs/db.yaml", "dev-token", strings.NewReader("password: hunter2\n"))
+	readBody(t, resp)
+	_ = doRequest(t, "POST", ts.URL+"/namespaces/dev/configs/app.yaml", "dev-token",
+		strings.NewReader("dsn: ${ref:db.yaml#password}\n")).Body.Close()
+
+	resp = doRequest(t, "GET", ts.URL+"/namespaces/dev/configs/db.yaml", "dev-token", nil)
+	if body := readBody(t, resp); string(body) != "password: <redacted>\n" {
+		t.Fatalf("expected redacted value, got %q", body)
+	}
+	resp = doRequest(t, "GET", ts.URL+"/namespaces/dev/configs/app.yaml?render=true", "dev-token", nil)
+	if body := readBody(t, resp); string(body) != "dsn: <redacted>\n" {
+		t.Fatalf("references should see decrypted, redacted values, got %q", body)
+	}
+}
+
+func TestAdmin_EncryptedPaths(t *testing.T) {
+	ts, _, _ := newTestServer(t)
+	resp := doRequest(t, "PUT", ts.URL+"/admin/namespaces/dev/encrypted-paths", adminToken,
+		strings.NewReader(`{"paths": ["token"]}`))
+	if resp.StatusCode != http.StatusConflict {
+		t.Fatalf("expected 409 without keys, got %d", resp.StatusCode)
+	}
+	readBody(t, resp)
+
+	ts, _ = newEncryptingServer(t)
+	resp = doRequest(t, "PUT", ts.URL+"/admin/namespaces/dev/encrypted-paths", adminToken,
+		strings.NewReader(`{"paths": ["token"]}`))
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("expected 200, got %d", resp.StatusCode)
+	}
+	readBody(t, resp)
+	resp = doRequest(t, "GET", ts.URL+"/admin/namespaces/dev/encrypted-paths", adminToken, nil)
+	if body := readBody(t, resp); !strings.Contains(string(body), `"paths":["token"]`) {
+		t.Fatalf("unexpected paths: %s", body)
+	}
+}
+
+func TestAdmin_RotateKeys(t *testing.T) {
+	ts, _, _ := newTestServer(t)
+	resp := doRequest(t, "POST", ts.URL+"/admin/encryption/rotate", adminToken, nil)
+	if resp.StatusCode != http.StatusNotImplemented {
+		t.Fatalf("expected 501 without encryption at rest, got %d", resp.StatusCode)
+	}
+	readBody(t, resp)
+
+	master, err := storage.ParseMasterKeys(base64.StdEncoding.EncodeToString(bytes.Repeat([]byte{9}, 32)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	store, err := storage.NewEncryptedStore(storage.NewMemoryStore(), master, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ts = serveHandler(t, NewHandler(store, auth.NewTokenAuth()))
+	resp = doRequest(t, "POST", ts.URL+"/namespaces/dev/configs/app.yaml", "dev-token", strings.NewReader("a: 1\n"))
+	readBody(t, resp)
+
+	resp = doRequest(t, "POST", ts.URL+"/admin/encryption/rotate", "dev-token", nil)
+	if resp.StatusCode != http.StatusUnauthorized {
+		t.Fatalf("expected 401 for non-admin, got %d", resp.StatusCode)
+	}
+	readBody(t, resp)
+	resp = doRequest(t, "POST", ts.URL+"/admin/encryption/rotate", adminToken, nil)
+	if body := readBody(t, resp); resp.StatusCode != http.StatusOK || !strings.Contains(string(body), `"configs":1`) {
+		t.Fatalf("expected 200 rotating one config, got %d: %s", resp.StatusCode, body)
+	}
+	resp = doRequest(t, "GET", ts.URL+"/namespaces/dev/configs/app.yaml", "dev-token", nil)
+	if body := readBody(t, resp); string(body) != "a: 1\n" {
+		t.Fatalf("config unreadable after rotation: %q", body)
+	}
+}
+
+func TestAdmin_Snapshot(t *testing.T) {
+	ts, _, _ := newTestServer(t)
+	resp := doRequest(t, "GET", ts.URL+"/admin/snapshot", adminToken, nil)
+	if resp.StatusCode != http.StatusNotImplemented {
+		t.Fatalf("expected 501 for in-memory storage, got %d", resp.StatusCode)
+	}
+	readBody(t, resp)
+
+	store, err := storage.NewBoltStore(filepath.Join(t.TempDir(), "yamlet.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { store.Close() })
+	ts = serveHandler(t, NewHandler(store, auth.NewTokenAuth()))
+	resp = doRequest(t, "POST", ts.URL+"/namespaces/dev/configs/app.yaml", "dev-token", strings.NewReader("a: 1\n"))
+	readBody(t, resp)
+
+	resp = doRequest(t, "GET", ts.URL+"/admin/snapshot", "dev-token", nil)
+	if resp.StatusCode != http.StatusUnauthorized {
+		t.Fatalf("expected 401 for non-admin, got %d", resp.StatusCode)
+	}
+	readBody(t, resp)
+
+	resp = doRequest(t, "GET", ts.URL+"/admin/snapshot", adminToken, nil)
+	body := readBody(t, resp)
+	if resp.StatusCode != http.StatusOK || resp.Header.Get("Content-Type") != "application/octet-stream" {
+		t.Fatalf("expected 200 octet-stream, got %d %s", resp.StatusCode, resp.Header.Get("Content-Type"))
+	}
+	path := filepath.Join(t.TempDir(), "snapshot.db")
+	if err := os.WriteFile(path, body, 0o600); err != nil {
+		t.Fatal(err)
+	}
+	restored, err := storage.NewBoltStore(path)
+	if err != nil {
+		t.Fatalf("snapshot is not a usable database: %v", err)
+	}
+	defer restored.Close()
+	if got, err := restored.Get("dev", "app.yaml"); err != nil || string(got) != "a: 1\n" {
+		t.Fatalf("snapshot content = %q, %v", got, err)
+	}
+}
+
+func TestAdmin_BackupRestore(t *testing.T) {
+	ts, _, _ := newTestServer(t)
+	resp := doRequest(t, "POST", ts.URL+"/namespaces/dev/configs/app.yaml", "dev-token", strings.NewReader("a: 1\n"))
+	readBody(t, resp)
+	resp = doRequest(t, "POST", ts.URL+"/admin/tokens", adminToken,
+		strings.NewReader(`{"token":"ci-token","namespace":"dev","permissions":["read-secrets"]}`))
+	readBody(t, resp)
+	resp = doRequest(t, "PUT", ts.URL+"/admin/namespaces/dev/secret-paths", adminToken, strings.NewReader(`{"paths": ["password"]}`))
+	readBody(t, resp)
+
+	resp = doRequest(t, "GET", ts.URL+"/admin/backup", "dev-token", nil)
+	if resp.StatusCode != http.StatusUnauthorized {
+		t.Fatalf("expected 401 for non-admin, got %d", resp.StatusCode)
+	}
+	readBody(t, resp)
+	resp = doRequest(t, "GET", ts.URL+"/admin/backup", adminToken, nil)
+	archive := readBody(t, resp)
+	if resp.StatusCode != http.StatusOK || resp.Header.Get("Content-Type") != "application/gzip" || resp.Header.Get(SnapshotHeader) != "true" {
+		t.Fatalf("expected a 200 point-in-time archive, got %d %s %q", resp.StatusCode, resp.Header.Get("Content-Type"), resp.Header.Get(SnapshotHeader))
+	}
+	manifest, err := backup.Verify(bytes.NewReader(archive))
+	if err != nil || manifest.Tokens != 3 || manifest.Namespaces[0].Policy == nil {
+		t.Fatalf("Verify = %+v, %v", manifest, err)
+	}
+
+	// Restore into a server on another backend.
+	target := serveHandler(t, NewHandler(storage.NewFileStore(t.TempDir()), auth.NewTokenAuth()))
+	resp = doRequest(t, "POST", target.URL+"/admin/restore?mode=merge", adminToken, bytes.NewReader(archive))
+	if body := readBody(t, resp); resp.StatusCode != http.StatusBadRequest {
+		t.Fatalf("expected 400 for an unknown mode, got %d: %s", resp.StatusCode, body)
+	}
+	resp = doRequest(t, "POST", target.URL+"/admin/restore", adminToken, bytes.NewReader(archive[:len(archive)/2]))
+	if body := readBody(t, resp); resp.StatusCode != http.StatusBadRequest {
+		t.Fatalf("expected 400 for a truncated archive, got %d: %s", resp.StatusCode, body)
+	}
+	resp = doRequest(t, "POST", target.URL+"/admin/restore?namespace=prod", adminToken, bytes.NewReader(archive))
+	if body := readBody(t, resp); resp.StatusCode != http.StatusBadRequest {
+		t.Fatalf("expected 400 for a namespace not in the archive, got %d: %s", resp.StatusCode, body)
+	}
+
+	resp = doRequest(t, "POST", target.URL+"/admin/restore?namespace=dev", adminToken, bytes.NewReader(archive))
+	body := readBody(t, resp)
+	if resp.StatusCode != http.StatusOK || !strings.Contains(string(body), `"configs":1`) || !strings.Contains(string(body), `"tokens":1`) ||
+		!strings.Contains(string(body), `"policies":1`) {
+		t.Fatalf("expected 200 restoring one config, one new token and a policy, got %d: %s", resp.StatusCode, body)
+	}
+	resp = doRequest(t, "GET", target.URL+"/admin/namespaces/dev/secret-paths", adminToken, nil)
+	if body := readBody(t, resp); !strings.Contains(string(body), `"password"`) {
+		t.Fatalf("restored secret paths = %s", body)
+	}
+	resp = doRequest(t, "GET", target.URL+"/namespaces/dev/configs/app.yaml", "ci-token", nil)
+	if body := readBody(t, resp); resp.StatusCode != http.StatusOK || string(body) != "a: 1\n" {
+		t.Fatalf("restored config through a restored token = %d %q", resp.StatusCode, body)
+	}
+
+	resp = doRequest(t, "POST", target.URL+"/admin/restore", adminToken, bytes.NewReader(archive))
+	if body := readBody(t, resp); resp.StatusCode != http.StatusOK || !strings.Contains(string(body), `"skipped":1`) {
+		t.Fatalf("expected existing configs to be skipped, got %d: %s", resp.StatusCode, body)
+	}
+}
+
+func TestBackupHealthAndMetrics(t *testing.T) {
+	ts, _, _ := newTestServer(t)
+	resp := doRequest(t, "GET", ts.URL+"/health/backups", "", nil)
+	if resp.StatusCode != http.StatusNotImplemented {
+		t.Fatalf("expected 501 without scheduled backups, got %d", resp.StatusCode)
+	}
+	readBody(t, resp)
+
+	store := storage.NewMemoryStore()
+	store.Store("dev", "app.yaml", []byte("a: 1\n"))
+	schedule, err := backup.ParseSchedule("@daily")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// A file where the directory should be makes every backup fail.
+	dir := filepath.Join(t.TempDir(), "backups")
+	os.WriteFile(dir, nil, 0o600)
+	sched := backup.NewScheduler(store, backup.SchedulerOptions{Schedule: schedule, Sink: backup.DirSink{Dir: dir}})
+	h := NewHandler(store, auth.NewTokenAuth())
+	h.SetBackupScheduler(sched)
+	ts = serveHandler(t, h)
+
+	resp = doRequest(t, "GET", ts.URL+"/health/backups", "", nil)
+	if body := readBody(t, resp); resp.StatusCode != http.StatusOK || !strings.Contains(string(body), `"healthy":true`) {
+		t.Fatalf("expected 200 before the first backup, got %d: %s", resp.StatusCode, body)
+	}
+
+	if _, err := sched.Run(); err == nil {
+		t.Fatal("expected the backup to fail")
+	}
+	// Without an admin token only the kind of problem is reported, as the
+	// error names the sink's path.
+	resp = doRequest(t, "GET", ts.URL+"/health/backups", "dev-token", nil)
+	body := string(readBody(t, resp))
+	if resp.StatusCode != http.StatusServiceUnavailable || body != `{"healthy":false,"problem":"failing"}`+"\n" {
+		t.Fatalf("expected a 503 summary after a failed backup, got %d: %s", resp.StatusCode, body)
+	}
+	resp = doRequest(t, "GET", ts.URL+"/health/backups", adminToken, nil)
+	var status backup.Status
+	if err := json.Unmarshal(readBody(t, resp), &status); err != nil {
+		t.Fatalf("json: %v", err)
+	}
+	if resp.StatusCode != http.StatusServiceUnavailable || status.Healthy || status.ConsecutiveFailures != 1 ||
+		status.Kind != backup.ProblemFailing || !strings.Contains(status.LastError, dir) {
+		t.Fatalf("expected 503 with details after a failed backup, got %d: %+v", resp.StatusCode, status)
+	}
+	resp = doRequest(t, "GET", ts.URL+"/metrics", "", nil)
+	body = string(readBody(t, resp))
+	for _, line := range []string{
+		"yamlet_backup_healthy 0\n",
+		"yamlet_backup_failures_total 1\n",
+		"yamlet_backup_last_success_timestamp_seconds 0\n",
+		"# TYPE yamlet_backup_successes_total counter\n",
+	} {
+		if !strings.Contains(body, line) {
+			t.Errorf("metrics lack %q:\n%s", line, body)
+		}
+	}
+
+	os.Remove(dir)
+	if _, err := sched.Run(); err != nil {
+		t.Fatalf("Run: %v", err)
+	}
+	resp = doRequest(t, "GET", ts.URL+"/health/backups", "", nil)
+	if body := readBody(t, resp); resp.StatusCode != http.StatusOK {
+		t.Fatalf("expected 200 after a successful backup, got %d: %s", resp.StatusCode, body)
+	}
+	resp = doRequest(t, "GET", ts.URL+"/metrics", "", nil)
+	body = string(readBody(t, resp))
+	if !strings.Contains(body, "yamlet_backup_healthy 1\n") || !strings.Contains(body, "yamlet_backup_successes_total 1\n") ||
+		strings.Contains(body, "yamlet_backup_last_success_timestamp_seconds 0\n") {
+		t.Fatalf("unexpected metrics after a successful backup:\n%s", body)
+	}
+}
+
+func TestAdmin_CacheStats(t *testing.T) {
+	ts, _, _ := newTestServer(t)
+	resp := doRequest(t, "GET", ts.URL+"/admin/cache", adminToken, nil)
+	if resp.StatusCode != http.StatusNotImplemented {
+		t.Fatalf("expected 501 without a cache, got %d", resp.StatusCode)
+	}
+	readBody(t, resp)
+
+	cache := storage.NewCachingStore(storage.NewMemoryStore(), storage.CacheOptions{MaxBytes: 1 << 20})
+	h := NewHandler(cache, auth.NewTokenAuth())
+	h.SetCache(cache)
+	ts = serveHandler(t, h)
+	readBody(t, doRequest(t, "POST", ts.URL+"/namespaces/dev/configs/app.yaml", "dev-token", strings.NewReader("a: 1\n")))
+	for i := 0; i < 2; i++ {
+		readBody(t, doRequest(t, "GET", ts.URL+"/namespaces/dev/configs/app.yaml", "dev-token", nil))
+	}
+
+	resp = doRequest(t, "GET", ts.URL+"/admin/cache", "dev-token", nil)
+	if resp.StatusCode != http.StatusUnauthorized {
+		t.Fatalf("expected 401 for non-admin, got %d", resp.StatusCode)
+	}
+	readBody(t, resp)
+
+	resp = doRequest(t, "GET", ts.URL+"/admin/cache", adminToken, nil)
+	var stats storage.CacheStats
+	if err := json.Unmarshal(readBody(t, resp), &stats); err != nil {
+		t.Fatalf("json: %v", err)
+	}
+	if stats.Hits != 1 || stats.Misses != 1 || stats.Entries != 1 {
+		t.Fatalf("unexpected stats: %+v", stats)
+	}
+
+	resp = doRequest(t, "GET", ts.URL+"/metrics", "", nil)
+	if body := string(readBody(t, resp)); !strings.Contains(body, "yamlet_cache_hits_total 1\n") || strings.Contains(body, "yamlet_backup_") {
+		t.Fatalf("unexpected metrics:\n%s", body)
+	}
+}
+
+func TestAdmin_Namespaces(t *testing.T) {
+	ts, _, store := newTestServer(t)
+	readBody(t, doRequest(t, "POST", ts.URL+"/namespaces/dev/configs/app.yaml", "dev-token", strings.NewReader("a: 1\n")))
+	readBody(t, doRequest(t, "POST", ts.URL+"/namespaces/dev/configs/db.yaml", "dev-token", strings.NewReader("host: db\n")))
+
+	resp := doRequest(t, "GET", ts.URL+"/admin/namespaces", "dev-token", nil)
+	if resp.StatusCode != http.StatusUnauthorized {
+		t.Fatalf("expected 401 for non-admin, got %d", resp.StatusCode)
+	}
+	readBody(t, resp)
+
+	create := `{"name":"team","owner":"platform","description":"Platform configs","labels":{"tier":"gold"}}`
+	resp = doRequest(t, "POST", ts.URL+"/admin/namespaces", adminToken, strings.NewReader(create))
+	var created namespaceDetails
+	if err := json.Unmarshal(readBody(t, resp), &created); err != nil {
+		t.Fatalf("json: %v", err)
+	}
+	if resp.StatusCode != http.StatusCreated || created.Owner != "platform" || created.Labels["tier"] != "gold" ||
+		created.Created.IsZero() || created.Usage != (storage.NamespaceUsage{}) {
+		t.Fatalf("create = %d %+v", resp.StatusCode, created)
+	}
+	resp = doRequest(t, "POST", ts.URL+"/admin/namespaces", adminToken, strings.NewReader(create))
+	if resp.StatusCode != http.StatusConflict {
+		t.Fatalf("expected 409 for an existing namespace, got %d", resp.StatusCode)
+	}
+	readBody(t, resp)
+	for _, body := range []string{`{"name":"../x"}`, `{"name":"x","labels":{"bad key":"v"}}`, `{}`, `{`} {
+		resp = doRequest(t, "POST", ts.URL+"/admin/namespaces", adminToken, strings.NewReader(body))
+		if resp.StatusCode != http.StatusBadRequest {
+			t.Fatalf("expected 400 for %s, got %d", body, resp.StatusCode)
+		}
+		readBody(t, resp)
+	}
+
+	// Namespaces created through the API and those that only hold configs
+	// are both listed, with their usage.
+	resp = doRequest(t, "GET", ts.URL+"/admin/namespaces", adminToken, nil)
+	var list struct {
+		Namespaces []namespaceDetails     `json:"namespaces"`
+		Count      int                    `json:"count"`
+		Usage      storage.NamespaceUsage `json:"usage"`
+	}
+	if err := json.Unmarshal(readBody(t, resp), &list); err != nil {
+		t.Fatalf("json: %v", err)
+	}
+	if list.Count != 2 || list.Namespaces[0].Name != "dev" || list.Namespaces[1].Name != "team" ||
+		list.Namespaces[0].Usage != (storage.NamespaceUsage{Configs: 2, Bytes: 14}) || list.Usage.Configs != 2 {
+		t.Fatalf("list = %+v", list)
+	}
+
+	// Updating replaces the record but keeps its creation time.
+	resp = doRequest(t, "PUT", ts.URL+"/admin/namespaces/team", adminToken, strings.NewReader(`{"owner":"sre"}`))
+	var updated namespaceDetails
+	if err := json.Unmarshal(readBody(t, resp), &updated); err != nil {
+		t.Fatalf("json: %v", err)
+	}
+	if resp.StatusCode != http.StatusOK || updated.Owner != "sre" || updated.Description != "" ||
+		len(updated.Labels) != 0 || !updated.Created.Equal(created.Created) {
+		t.Fatalf("update = %d %+v", resp.StatusCode, updated)
+	}
+	resp = doRequest(t, "PUT", ts.URL+"/admin/namespaces/team", adminToken, strings.NewReader(`{"name":"other"}`))
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Fatalf("expected 400 for a mismatched name, got %d", resp.StatusCode)
+	}
+	readBody(t, resp)
+
+	resp = doRequest(t, "GET", ts.URL+"/admin/namespaces/dev", adminToken, nil)
+	var dev namespaceDetails
+	if err := json.Unmarshal(readBody(t, resp), &dev); err != nil || resp.StatusCode != http.StatusOK || dev.Usage.Configs != 2 {
+		t.Fatalf("get = %d %+v, %v", resp.StatusCode, dev, err)
+	}
+	resp = doRequest(t, "GET", ts.URL+"/admin/namespaces/missing", adminToken, nil)
+	if resp.StatusCode != http.StatusNotFound {
+		t.Fatalf("expected 404 for a missing namespace, got %d", resp.StatusCode)
+	}
+	readBody(t, resp)
+
+	// Deleting needs a confirmation; a dry run reports without deleting.
+	resp = doRequest(t, "DELETE", ts.URL+"/admin/namespaces/dev", adminToken, nil)
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Fatalf("expected 400 without confirmation, got %d", resp.StatusCode)
+	}
+	readBody(t, resp)
+	resp = doRequest(t, "DELETE", ts.URL+"/admin/namespaces/dev?confirm=team", adminToken, nil)
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Fatalf("expected 400 for the wrong confirmation, got %d", resp.StatusCode)
+	}
+	readBody(t, resp)
+
+	var deleted struct {
+		DryRun  bool                   `json:"dry_run"`
+		Configs []string               `json:"configs"`
+		Usage   storage.NamespaceUsage `json:"usage"`
+	}
+	resp = doRequest(t, "DELETE", ts.URL+"/admin/namespaces/dev?dry_run=true", adminToken, nil)
+	if err := json.Unmarshal(readBody(t, resp), &deleted); err != nil {
+		t.Fatalf("json: %v", err)
+	}
+	if resp.StatusCode != http.StatusOK || !deleted.DryRun || strings.Join(deleted.Configs, ",") != "app.yaml,db.yaml" || deleted.Usage.Bytes != 14 {
+		t.Fatalf("dry run = %d %+v", resp.StatusCode, deleted)
+	}
+	if _, err := store.Get("dev", "app.yaml"); err != nil {
+		t.Fatalf("dry run must not delete: %v", err)
+	}
+
+	resp = doRequest(t, "DELETE", ts.URL+"/admin/namespaces/dev?confirm=dev", adminToken, nil)
+	if err := json.Unmarshal(readBody(t, resp), &deleted); err != nil {
+		t.Fatalf("json: %v", err)
+	}
+	if resp.StatusCode != http.StatusOK || deleted.DryRun || len(deleted.Configs) != 2 {
+		t.Fatalf("delete = %d %+v", resp.StatusCode, deleted)
+	}
+	if names, _ := store.List("dev"); len(names) != 0 {
+		t.Fatalf("configs left after delete: %v", names)
+	}
+	resp = doRequest(t, "DELETE", ts.URL+"/admin/namespaces/dev?confirm=dev", adminToken, nil)
+	if resp.StatusCode != http.StatusNotFound {
+		t.Fatalf("expected 404 deleting again, got %d", resp.StatusCode)
+	}
+	readBody(t, resp)
+}
+
+// basicStore hides the optional interfaces of the store it wraps.
+type basicStore struct {
+	inner storage.Store
+}
+
+func (b basicStore) Store(namespace, name string, content []byte) error {
+	return b.inner.Store(namespace, name, content)
+}
+func (b basicStore) Get(namespace, name string) ([]byte, error) { return b.inner.Get(namespace, name) }
+func (b basicStore) Delete(namespace, name string) error        { return b.inner.Delete(namespace, name) }
+func (b basicStore) List(namespace string) ([]string, error)    { return b.inner.List(namespace) }
+
+func TestAdmin_NamespacesUnsupported(t *testing.T) {
+	for _, store := range []storage.Store{
+		basicStore{storage.NewMemoryStore()},
+		storage.NewCachingStore(basicStore{storage.NewMemoryStore()}, storage.CacheOptions{}),
+	} {
+		ts := serveHandler(t, NewHandler(store, auth.NewTokenAuth()))
+		resp := doRequest(t, "GET", ts.URL+"/admin/namespaces", adminToken, nil)
+		if resp.StatusCode != http.StatusNotImplemented {
+			t.Fatalf("expected 501 for %T, got %d", store, resp.StatusCode)
+		}
+		readBody(t, resp)
+	}
+}
+
+func TestQuotas(t *testing.T) {
+	ts, _, store := newTestServer(t)
+	put := func(name, content string) int {
+		t.Helper()
+		resp := doRequest(t, "POST", ts.URL+"/namespaces/dev/configs/"+name, "dev-token", strings.NewReader(content))
+		readBody(t, resp)
+		return resp.StatusCode
+	}
+
+	quota := `{"max_configs": 2, "max_bytes": 30, "max_config_bytes": 20, "max_revisions": 2}`
+	resp := doRequest(t, "PUT", ts.URL+"/admin/namespaces/dev/quota", "dev-token", strings.NewReader(quota))
+	if resp.StatusCode != http.StatusUnauthorized {
+		t.Fatalf("expected 401 for non-admin, got %d", resp.StatusCode)
+	}
+	readBody(t, resp)
+	resp = doRequest(t, "PUT", ts.URL+"/admin/namespaces/dev/quota", adminToken, strings.NewReader(`{"max_configs": -1}`))
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Fatalf("expected 400 for a negative limit, got %d", resp.StatusCode)
+	}
+	readBody(t, resp)
+	resp = doRequest(t, "PUT", ts.URL+"/admin/namespaces/dev/quota", adminToken, strings.NewReader(quota))
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("expected 200, got %d", resp.StatusCode)
+	}
+	readBody(t, resp)
+
+	if status := put("a.yaml", "a: 1\n"); status != http.StatusCreated {
+		t.Fatalf("expected 201, got %d", status)
+	}
+	if status := put("b.yaml", "b: 1\n"); status != http.StatusCreated {
+		t.Fatalf("expected 201, got %d", status)
+	}
+	if status := put("c.yaml", "c: 1\n"); status != http.StatusInsufficientStorage {
+		t.Fatalf("expected 507 beyond max_configs, got %d", status)
+	}
+	if status := put("a.yaml", "a: 1234567890123456789\n"); status != http.StatusRequestEntityTooLarge {
+		t.Fatalf("expected 413 beyond max_config_bytes, got %d", status)
+	}
+	if status := put("a.yaml", "a: 123456789012345\n"); status != http.StatusCreated {
+		t.Fatalf("expected 201 replacing within the quota, got %d", status)
+	}
+	if status := put("b.yaml", "b: 1234567890\n"); status != http.StatusInsufficientStorage {
+		t.Fatalf("expected 507 beyond max_bytes, got %d", status)
+	}
+	// Other namespaces are not limited.
+	resp = doRequest(t, "POST", ts.URL+"/namespaces/test/configs/c.yaml", "test-token", strings.NewReader("c: 123456789012345678901234567890\n"))
+	if resp.StatusCode != http.StatusCreated {
+		t.Fatalf("expected 201 in another namespace, got %d", resp.StatusCode)
+	}
+	readBody(t, resp)
+
+	// Revisions beyond max_revisions are pruned.
+	put("a.yaml", "a: 2\n")
+	put("a.yaml", "a: 3\n")
+	revs, err := store.(storage.Versioned).Revisions("dev", "a.yaml")
+	if err != nil || len(revs) != 2 || revs[1].Number != 4 {
+		t.Fatalf("expected the 2 newest revisions, got %+v, %v", revs, err)
+	}
+
+	// Patches are held to the same limits.
+	resp = doRequest(t, "PATCH", ts.URL+"/namespaces/dev/configs/b.yaml", "dev-token", strings.NewReader("x: 123456789012345\n"))
+	if resp.StatusCode != http.StatusRequestEntityTooLarge {
+		t.Fatalf("expected 413 for a patch beyond max_config_bytes, got %d", resp.StatusCode)
+	}
+	readBody(t, resp)
+
+	resp = doRequest(t, "GET", ts.URL+"/namespaces/dev/usage", "dev-token", nil)
+	var usage struct {
+		Namespace string                 `json:"namespace"`
+		Quota     map[string]int64       `json:"quota"`
+		Usage     storage.NamespaceUsage `json:"usage"`
+	}
+	if err := json.Unmarshal(readBody(t, resp), &usage); err != nil {
+		t.Fatalf("json: %v", err)
+	}
+	if resp.StatusCode != http.StatusOK || usage.Usage != (storage.NamespaceUsage{Configs: 2, Bytes: 10}) ||
+		usage.Quota["max_configs"] != 2 || usage.Quota["max_revisions"] != 2 {
+		t.Fatalf("usage = %d %+v", resp.StatusCode, usage)
+	}
+	resp = doRequest(t, "GET", ts.URL+"/namespaces/dev/usage", "test-token", nil)
+	if resp.StatusCode != http.StatusForbidden {
+		t.Fatalf("expected 403 for another namespace's token, got %d", resp.StatusCode)
+	}
+	readBody(t, resp)
+
+	// Clearing the quota lifts the limits.
+	resp = doRequest(t, "PUT", ts.URL+"/admin/namespaces/dev/quota", adminToken, strings.NewReader(`{}`))
+	readBody(t, resp)
+	if status := put("c.yaml", "c: 1\n"); status != http.StatusCreated {
+		t.Fatalf("expected 201 without a quota, got %d", status)
+	}
+}
+
+func TestQuotasUnderEncryptionAtRest(t *testing.T) {
+	master, err := storage.ParseMasterKeys(base64.StdEncoding.EncodeToString(bytes.Repeat([]byte{9}, 32)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	store, err := storage.NewEncryptedStore(storage.NewMemoryStore(), master, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ts := serveHandler(t, NewHandler(store, auth.NewTokenAuth()))
+	put := func(name, content string) int {
+		t.Helper()
+		resp := doRequest(t, "POST", ts.URL+"/namespaces/dev/configs/"+name, "dev-token", strings.NewReader(content))
+		readBody(t, resp)
+		return resp.StatusCode
+	}
+	resp := doRequest(t, "PUT", ts.URL+"/admin/namespaces/dev/quota", adminToken, strings.NewReader(`{"max_bytes": 60}`))
+	readBody(t, resp)
+
+	// Quotas count the sealed bytes the store holds, as usage does, so a
+	// second small config does not fit although its plaintext would.
+	sealed := store.StoredSize(len("a: 1\n"))
+	if status := put("a.yaml", "a: 1\n"); status != http.StatusCreated {
+		t.Fatalf("expected 201, got %d", status)
+	}
+	if status := put("b.yaml", "b: 1\n"); status != http.StatusInsufficientStorage {
+		t.Fatalf("expected 507 beyond max_bytes counted in sealed bytes, got %d", status)
+	}
+	resp = doRequest(t, "POST", ts.URL+"/namespaces/dev/batch", "dev-token",
+		strings.NewReader(`{"operations": [{"op": "put", "name": "b.yaml", "content": "b: 1"}]}`))
+	if resp.StatusCode != http.StatusInsufficientStorage {
+		t.Fatalf("expected 507 for a batch beyond max_bytes, got %d", resp.StatusCode)
+	}
+	readBody(t, resp)
+	if status := put("a.yaml", "a: 12\n"); status != http.StatusCreated {
+		t.Fatalf("expected 201 growing within the quota, got %d", status)
+	}
+
+	resp = doRequest(t, "GET", ts.URL+"/namespaces/dev/usage", "dev-token", nil)
+	var usage struct {
+		Usage storage.NamespaceUsage `json:"usage"`
+	}
+	json.Unmarshal(readBody(t, resp), &usage)
+	if usage.Usage != (storage.NamespaceUsage{Configs: 1, Bytes: int64(sealed + 1)}) {
+		t.Fatalf("usage = %+v, want one config of %d bytes", usage.Usage, sealed+1)
+	}
+}
+
+func TestBatchConfigs(t *testing.T) {
+	ts, _, store := newTestServer(t)
+	store.Store("dev", "app.yaml", []byte("db: old\n"))
+	store.Store("dev", "migrator.yaml", []byte("db: old\nlevel: info\n"))
+	store.Store("dev", "legacy.yaml", []byte("v: 1\n"))
+	batch := func(token, body string) (int, map[string]interface{}) {
+		t.Helper()
+		resp := doRequest(t, "POST", ts.URL+"/namespaces/dev/batch", token, strings.NewReader(body))
+		var out map[string]interface{}
+		if err := json.Unmarshal(readBody(t, resp), &out); err != nil {
+			t.Fatalf("json: %v", err)
+		}
+		return resp.StatusCode, out
+	}
+
+	if status, _ := batch("test-token", `{"operations": [{"op": "delete", "name": "app.yaml"}]}`); status != http.StatusForbidden {
+		t.Fatalf("expected 403 for another namespace's token, got %d", status)
+	}
+
+	sum := sha256.Sum256([]byte("db: old\n"))
+	status, out := batch("dev-token", `{"operations": [
+		{"op": "put", "name": "app.yaml", "content": "db: new\n", "if_sha256": "`+hex.EncodeToString(sum[:])+`"},
+		{"op": "put", "name": "worker.yaml", "content": "{\"db\": \"new\"}", "content_type": "application/json",
+		 "labels": {"tier": "backend"}, "if_exists": false},
+		{"op": "patch", "name": "migrator.yaml", "patch": "db: new\n"},
+		{"op": "delete", "name": "legacy.yaml", "if_exists": true}
+	]}`)
+	if status != http.StatusOK || out["count"] != float64(4) {
+		t.Fatalf("batch = %d %v", status, out)
+	}
+	for name, want := range map[string]string{
+		"app.yaml":      "db: new\n",
+		"worker.yaml":   "db: new\n",
+		"migrator.yaml": "db: new\nlevel: info\n",
+	} {
+		if got, err := store.Get("dev", name); err != nil || string(got) != want {
+			t.Fatalf("%s = %q, %v; want %q", name, got, err, want)
+		}
+	}
+	if _, err := store.Get("dev", "legacy.yaml"); err == nil {
+		t.Fatalf("legacy.yaml should be deleted")
+	}
+	md, err := store.(storage.MetadataStore).Metadata("dev", "worker.yaml")
+	if err != nil || md.Labels["tier"] != "backend" || md.ContentType != "application/json" {
+		t.Fatalf("metadata of worker.yaml = %+v, %v", md, err)
+	}
+
+	// A failed precondition aborts the whole batch and names the operation.
+	status, out = batch("dev-token", `{"operations": [
+		{"op": "put", "name": "app.yaml", "content": "db: newer\n"},
+		{"op": "put", "name": "worker.yaml", "content": "db: newer\n", "if_exists": false}
+	]}`)
+	if status != http.StatusPreconditionFailed || out["index"] != float64(1) || out["name"] != "worker.yaml" {
+		t.Fatalf("expected 412 for operation 1, got %d %v", status, out)
+	}
+	if got, _ := store.Get("dev", "app.yaml"); string(got) != "db: new\n" {
+		t.Fatalf("app.yaml should be unchanged, got %q", got)
+	}
+
+	for _, tc := range []struct {
+		body   string
+		status int
+	}{
+		{`{"operations": []}`, http.StatusBadRequest},
+		{`{"operations": [{"op": "rename", "name": "app.yaml"}]}`, http.StatusBadRequest},
+		{`{"operations": [{"op": "put", "name": "app.yaml"}]}`, http.StatusBadRequest},
+		{`{"operations": [{"op": "put", "name": "../x", "content": "a: 1"}]}`, http.StatusBadRequest},
+		{`{"operations": [{"op": "patch", "name": "missing.yaml", "patch": "a: 1"}]}`, http.StatusNotFound},
+		{`{"operations": [{"op": "delete", "name": "missing.yaml"}]}`, http.StatusNotFound},
+		{`{"operations": [{"op": "put", "name": "a.yaml", "content": "a: 1"}, {"op": "delete", "name": "a.yaml"},
+			{"op": "delete", "name": "a.yaml"}]}`, http.StatusNotFound},
+		{`not json`, http.StatusBadRequest},
+	} {
+		if status, out := batch("dev-token", tc.body); status != tc.status {
+			t.Fatalf("%s: expected %d, got %d %v", tc.body, tc.status, status, out)
+		}
+	}
+	if _, err := store.Get("dev", "a.yaml"); err == nil {
+		t.Fatalf("a.yaml from a failed batch should not be stored")
+	}
+
+	ops := strings.Repeat(`{"op": "delete", "name": "app.yaml"},`, MaxBatchOperations)
+	if status, _ := batch("dev-token", `{"operations": [`+ops+`{"op": "delete", "name": "app.yaml"}]}`); status != http.StatusRequestEntityTooLarge {
+		t.Fatalf("expected 413 beyond %d operations, got %d", MaxBatchOperations, status)
+	}
+
+	// Quotas apply to the batch as a whole.
+	resp := doRequest(t, "PUT", ts.URL+"/admin/namespaces/dev/quota", adminToken, strings.NewReader(`{"max_configs": 3}`))
+	readBody(t, resp)
+	status, _ = batch("dev-token", `{"operations": [{"op": "put", "name": "d.yaml", "content": "d: 1"}]}`)
+	if status != http.StatusInsufficientStorage {
+		t.Fatalf("expected 507 beyond max_configs, got %d", status)
+	}
+	status, _ = batch("dev-token", `{"operations": [{"op": "delete", "name": "app.yaml"}, {"op": "put", "name": "d.yaml", "content": "d: 1"}]}`)
+	if status != http.StatusOK {
+		t.Fatalf("expected 200 for a batch that keeps the config count, got %d", status)
+	}
+
+	// A batch the store applied only in part is reported as such.
+	dir := t.TempDir()
+	if err := os.MkdirAll(filepath.Join(dir, ".yamlet", "revisions", "dev"), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, ".yamlet", "revisions", "dev", "b.yaml"), nil, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	ts = serveHandler(t, NewHandler(storage.NewFileStore(dir), auth.NewTokenAuth()))
+	resp = doRequest(t, "POST", ts.URL+"/namespaces/dev/batch", "dev-token", strings.NewReader(`{"operations": [
+		{"op": "put", "name": "a.yaml", "content": "a: 1"}, {"op": "put", "name": "b.yaml", "content": "b: 1"}]}`))
+	if body := readBody(t, resp); resp.StatusCode != http.StatusInternalServerError || !strings.Contains(string(body), "applied in part") {
+		t.Fatalf("expected 500 for a batch applied in part, got %d %s", resp.StatusCode, body)
+	}
+
+	ts = serveHandler(t, NewHandler(basicStore{storage.NewMemoryStore()}, auth.NewTokenAuth()))
+	resp = doRequest(t, "POST", ts.URL+"/namespaces/dev/batch", "dev-token", strings.NewReader(`{"operations": [{"op": "delete", "name": "a.yaml"}]}`))
+	readBody(t, resp)
+	if resp.StatusCode != http.StatusNotImplemented {
+		t.Fatalf("expected 501 for a store without transactions, got %d", resp.StatusCode)
+	}
+}
+
+func TestBulkConfigs(t *testing.T) {
+	t.Setenv("YAMLET_SECRET_PATHS", "dev:db.password")
+	ts, _, store := newTestServer(t)
+	store.Store("dev", "app.yaml", []byte("db:\n  host: db\n  password: p\n"))
+	store.Store("dev", "worker.yaml", []byte("queue: jobs\n"))
+	store.Store("dev", "notes.txt", []byte("n: 1\n"))
+	store.Store("test", "app.yaml", []byte("v: 2\n"))
+	bulkURL := ts.URL + "/namespaces/dev/bulk?name=notes.txt&name=missing.yaml&glob=*.yaml"
+
+	resp := doRequest(t, "GET", bulkURL, "dev-token", nil)
+	var out struct {
+		Snapshot bool `json:"snapshot"`
+		Count    int  `json:"count"`
+		Configs  map[string]struct {
+			Status   int    `json:"status"`
+			Content  string `json:"content"`
+			SHA256   string `json:"sha256"`
+			Redacted bool   `json:"redacted"`
+			Error    string `json:"error"`
+		} `json:"configs"`
+	}
+	if err := json.Unmarshal(readBody(t, resp), &out); err != nil {
+		t.Fatalf("json: %v", err)
+	}
+	if resp.StatusCode != http.StatusOK || !out.Snapshot || out.Count != 4 || resp.Header.Get(SnapshotHeader) != "true" {
+		t.Fatalf("bulk = %d %+v", resp.StatusCode, out)
+	}
+	if app := out.Configs["app.yaml"]; app.Status != http.StatusOK || !app.Redacted || strings.Contains(app.Content, "password: p") {
+		t.Fatalf("app.yaml should be redacted, got %+v", app)
+	}
+	sum := sha256.Sum256([]byte("queue: jobs\n"))
+	if worker := out.Configs["worker.yaml"]; worker.Content != "queue: jobs\n" || worker.SHA256 != hex.EncodeToString(sum[:]) {
+		t.Fatalf("worker.yaml = %+v", worker)
+	}
+	if missing := out.Configs["missing.yaml"]; missing.Status != http.StatusNotFound || missing.Error == "" {
+		t.Fatalf("missing.yaml should be reported inline, got %+v", missing)
+	}
+
+	// multipart/mixed: one part per config, in request order then by name.
+	resp = doRequestWithHeaders(t, "GET", bulkURL, "dev-token", map[string]string{"Accept": "multipart/mixed"}, nil)
+	_, params, err := mime.ParseMediaType(resp.Header.Get("Content-Type"))
+	if err != nil {
+		t.Fatalf("content type %q: %v", resp.Header.Get("Content-Type"), err)
+	}
+	mr := multipart.NewReader(bytes.NewReader(readBody(t, resp)), params["boundary"])
+	var parts []string
+	for {
+		part, err := mr.NextPart()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatalf("next part: %v", err)
+		}
+		body, _ := io.ReadAll(part)
+		parts = append(parts, fmt.Sprintf("%s %s %s", part.FileName(), part.Header.Get(StatusHeader), body))
+	}
+	if len(parts) != 4 || parts[0] != "notes.txt 200 n: 1\n" || !strings.HasPrefix(parts[1], "missing.yaml 404 {") ||
+		!strings.HasPrefix(parts[2], "app.yaml 200") || parts[3] != "worker.yaml 200 queue: jobs\n" {
+		t.Fatalf("parts = %q", parts)
+	}
+
+	// application/x-tar: errors become <name>.error files.
+	resp = doRequestWithHeaders(t, "GET", bulkURL, "dev-token", map[string]string{"Accept": "application/x-tar"}, nil)
+	tr := tar.NewReader(bytes.NewReader(readBody(t, resp)))
+	var files []string
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatalf("tar: %v", err)
+		}
+		files = append(files, hdr.Name)
+	}
+	if strings.Join(files, ",") != "notes.txt,missing.yaml.error,app.yaml,worker.yaml" {
+		t.Fatalf("tar files = %v", files)
+	}
+
+	for _, tc := range []struct {
+		url    string
+		token  string
+		accept string
+		status int
+	}{
+		{"/namespaces/dev/bulk", "dev-token", "", http.StatusBadRequest},
+		{"/namespaces/dev/bulk?glob=[", "dev-token", "", http.StatusBadRequest},
+		{"/namespaces/dev/bulk?glob=*", "test-token", "", http.StatusForbidden},
+		{"/namespaces/dev/bulk?glob=*", "dev-token", "application/x-yaml", http.StatusNotAcceptable},
+		{"/namespaces/dev/bulk?name=../x", "dev-token", "", http.StatusOK},
+	} {
+		resp := doRequestWithHeaders(t, "GET", ts.URL+tc.url, tc.token, map[string]string{"Accept": tc.accept}, nil)
+		readBody(t, resp)
+		if resp.StatusCode != tc.status {
+			t.Fatalf("%s: expected %d, got %d", tc.url, tc.status, resp.StatusCode)
+		}
+	}
+	tooMany := strings.Repeat("name=a.yaml&", MaxBulkConfigs) + "name=b.yaml"
+	for i := range MaxBulkConfigs {
+		tooMany += fmt.Sprintf("&name=c%d.yaml", i)
+	}
+	resp = doRequest(t, "GET", ts.URL+"/namespaces/dev/bulk?"+tooMany, "dev-token", nil)
+	readBody(t, resp)
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Fatalf("expected 400 beyond %d configs, got %d", MaxBulkConfigs, resp.StatusCode)
+	}
+
+	// Stores without snapshot reads still serve bulk fetches.
+	plain := storage.NewMemoryStore()
+	plain.Store("dev", "app.yaml", []byte("v: 1\n"))
+	ts = serveHandler(t, NewHandler(basicStore{plain}, auth.NewTokenAuth()))
+	resp = doRequest(t, "GET", ts.URL+"/namespaces/dev/bulk?glob=*", "dev-token", nil)
+	body := readBody(t, resp)
+	if resp.StatusCode != http.StatusOK || resp.Header.Get(SnapshotHeader) != "false" || !strings.Contains(string(body), `"v: 1\n"`) {
+		t.Fatalf("bulk without snapshots = %d %s", resp.StatusCode, body)
+	}
+}
+
+func TestConfigExpiry(t *testing.T) {
+	ts, _, store := newTestServer(t)
+	metadata := store.(storage.MetadataStore)
+	put := func(name string, headers map[string]string) *http.Response {
+		t.Helper()
+		return doRequestWithHeaders(t, "POST", ts.URL+"/namespaces/dev/configs/"+name, "dev-token", headers, strings.NewReader("v: 1\n"))
+	}
+	expire := func(name string) {
+		t.Helper()
+		md, err := metadata.Metadata("dev", name)
+		if err != nil {
+			t.Fatalf("metadata of %s: %v", name, err)
+		}
+		md.Expires = time.Now().Add(-time.Second)
+		if err := metadata.SetMetadata("dev", name, md); err != nil {
+			t.Fatalf("set metadata of %s: %v", name, err)
+		}
+	}
+
+	resp := put("preview.yaml", map[string]string{TTLHeader: "1h"})
+	if resp.StatusCode != http.StatusCreated {
+		t.Fatalf("expected 201, got %d (%s)", resp.StatusCode, readBody(t, resp))
+	}
+	readBody(t, resp)
+	md, _ := metadata.Metadata("dev", "preview.yaml")
+	if d := time.Until(md.Expires); d < 59*time.Minute || d > time.Hour {
+		t.Fatalf("expiry should be an hour away, got %s", md.Expires)
+	}
+	resp = doRequest(t, "GET", ts.URL+"/namespaces/dev/configs/preview.yaml", "dev-token", nil)
+	readBody(t, resp)
+	if got := resp.Header.Get(ExpiresHeader); got != md.Expires.Format(time.RFC3339) {
+		t.Fatalf("%s = %q, want %s", ExpiresHeader, got, md.Expires.Format(time.RFC3339))
+	}
+
+	for _, headers := range []map[string]string{
+		{TTLHeader: "soon"},
+		{TTLHeader: "-5m"},
+		{ExpiresHeader: "2001-01-01T00:00:00Z"},
+		{ExpiresHeader: "2999-01-01T00:00:00Z", TTLHeader: "1h"},
+	} {
+		if resp := put("bad.yaml", headers); resp.StatusCode != http.StatusBadRequest {
+			t.Fatalf("expected 400 for %v, got %d", headers, resp.StatusCode)
+		}
+	}
+
+	// Expired configs are no longer served, before the reaper deletes them.
+	put("app.yaml", nil)
+	expire("preview.yaml")
+	for _, path := range []string{"/configs/preview.yaml", "/configs/preview.yaml/metadata", "/configs/preview.yaml/explain"} {
+		if resp := doRequest(t, "GET", ts.URL+"/namespaces/dev"+path, "dev-token", nil); resp.StatusCode != http.StatusNotFound {
+			t.Fatalf("GET %s of an expired config = %d, want 404", path, resp.StatusCode)
+		}
+	}
+	var listing struct{ Configs []string }
+	json.Unmarshal(readBody(t, doRequest(t, "GET", ts.URL+"/namespaces/dev/configs", "dev-token", nil)), &listing)
+	if !slices.Equal(listing.Configs, []string{"app.yaml"}) {
+		t.Fatalf("listing should leave out expired configs, got %v", listing.Configs)
+	}
+	var bulk struct {
+		Configs map[string]struct{ Status int }
+	}
+	json.Unmarshal(readBody(t, doRequest(t, "GET", ts.URL+"/namespaces/dev/bulk?glob=*.yaml", "dev-token", nil)), &bulk)
+	if _, ok := bulk.Configs["preview.yaml"]; ok || len(bulk.Configs) != 1 {
+		t.Fatalf("bulk glob should leave out expired configs, got %v", bulk.Configs)
+	}
+	json.Unmarshal(readBody(t, doRequest(t, "GET", ts.URL+"/namespaces/dev/bulk?name=preview.yaml", "dev-token", nil)), &bulk)
+	if bulk.Configs["preview.yaml"].Status != http.StatusNotFound {
+		t.Fatalf("bulk fetch of an expired config = %v, want 404", bulk.Configs)
+	}
+	resp = doRequest(t, "POST", ts.URL+"/namespaces/dev/batch", "dev-token",
+		strings.NewReader(`{"operations": [{"op": "patch", "name": "preview.yaml", "patch": "v: 2\n"}]}`))
+	if resp.StatusCode != http.StatusNotFound {
+		t.Fatalf("batch patch of an expired config = %d, want 404", resp.StatusCode)
+	}
+
+	// Writing an expired config again starts it afresh.
+	if resp := put("preview.yaml", nil); resp.StatusCode != http.StatusCreated {
+		t.Fatalf("expected 201, got %d", resp.StatusCode)
+	}
+	if resp := doRequest(t, "GET", ts.URL+"/namespaces/dev/configs/preview.yaml", "dev-token", nil); resp.StatusCode != http.StatusOK {
+		t.Fatalf("a rewritten config should be served, got %d", resp.StatusCode)
+	}
+
+	// The metadata endpoint sets and clears expiry.
+	setMetadata := func(body string) int {
+		t.Helper()
+		resp := doRequest(t, "PUT", ts.URL+"/namespaces/dev/configs/app.yaml/metadata", "dev-token", strings.NewReader(body))
+		readBody(t, resp)
+		return resp.StatusCode
+	}
+	if status := setMetadata(`{"expires_at": "2999-01-01T00:00:00Z"}`); status != http.StatusOK {
+		t.Fatalf("set expires_at = %d", status)
+	}
+	if md, _ := metadata.Metadata("dev", "app.yaml"); md.Expires.Year() != 2999 {
+		t.Fatalf("expiry = %s", md.Expires)
+	}
+	if status := setMetadata(`{"labels": {"tier": "web"}}`); status != http.StatusOK {
+		t.Fatalf("set labels = %d", status)
+	}
+	if md, _ := metadata.Metadata("dev", "app.yaml"); md.Expires.Year() != 2999 {
+		t.Fatalf("leaving expiry out should keep it, got %s", md.Expires)
+	}
+	if status := setMetadata(`{"ttl": ""}`); status != http.StatusOK {
+		t.Fatalf("clear expiry = %d", status)
+	}
+	if md, _ := metadata.Metadata("dev", "app.yaml"); !md.Expires.IsZero() {
+		t.Fatalf("expiry should be cleared, got %s", md.Expires)
+	}
+	if status := setMetadata(`{"ttl": "0s"}`); status != http.StatusBadRequest {
+		t.Fatalf("expected 400 for a zero ttl, got %d", status)
+	}
+
+	// Batch puts take a ttl; other operations do not.
+	resp = doRequest(t, "POST", ts.URL+"/namespaces/dev/batch", "dev-token",
+		strings.NewReader(`{"operations": [{"op": "put", "name": "pr-7.yaml", "content": "v: 1\n", "ttl": "3600"}]}`))
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("batch put with ttl = %d (%s)", resp.StatusCode, readBody(t, resp))
+	}
+	if md, _ := metadata.Metadata("dev", "pr-7.yaml"); md.Expires.IsZero() {
+		t.Fatalf("batch put should record the expiry")
+	}
+	resp = doRequest(t, "POST", ts.URL+"/namespaces/dev/batch", "dev-token",
+		strings.NewReader(`{"operations": [{"op": "delete", "name": "pr-7.yaml", "ttl": "1h"}]}`))
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Fatalf("expected 400 for a delete with ttl, got %d", resp.StatusCode)
+	}
+}
+
+func TestTrash(t *testing.T) {
+	store := storage.NewMemoryStore()
+	h := NewHandler(store, auth.NewTokenAuth())
+	h.SetTrashRetention(time.Hour)
+	ts := serveHandler(t, h)
+	put := func(name, body string) {
+		t.Helper()
+		resp := doRequest(t, "POST", ts.URL+"/namespaces/dev/configs/"+name, "dev-token", strings.NewReader(body))
+		if resp.StatusCode != http.StatusCreated {
+			t.Fatalf("expected 201, got %d (%s)", resp.StatusCode, readBody(t, resp))
+		}
+		readBody(t, resp)
+	}
+	var trash struct {
+		Items []struct {
+			ID, Name string
+			Deleted  time.Time
+			PurgeAt  time.Time `json:"purge_at"`
+		}
+	}
+	list := func() {
+		t.Helper()
+		resp := doRequest(t, "GET", ts.URL+"/namespaces/dev/trash", "dev-token", nil)
+		if resp.StatusCode != http.StatusOK {
+			t.Fatalf("list trash = %d", resp.StatusCode)
+		}
+		trash.Items = nil
+		json.Unmarshal(readBody(t, resp), &trash)
+	}
+
+	// Deleting moves the config to the trash.
+	put("app.yaml", "v: 1\n")
+	resp := doRequest(t, "DELETE", ts.URL+"/namespaces/dev/configs/app.yaml", "dev-token", nil)
+	var deleted struct {
+		TrashID string `json:"trash_id"`
+	}
+	json.Unmarshal(readBody(t, resp), &deleted)
+	if resp.StatusCode != http.StatusOK || deleted.TrashID == "" {
+		t.Fatalf("delete = %d, trash ID %q", resp.StatusCode, deleted.TrashID)
+	}
+	if resp := doRequest(t, "GET", ts.URL+"/namespaces/dev/configs/app.yaml", "dev-token", nil); resp.StatusCode != http.StatusNotFound {
+		t.Fatalf("a trashed config should not be served, got %d", resp.StatusCode)
+	}
+	list()
+	if len(trash.Items) != 1 || trash.Items[0].ID != deleted.TrashID || trash.Items[0].Name != "app.yaml" ||
+		!trash.Items[0].PurgeAt.Equal(trash.Items[0].Deleted.Add(time.Hour)) {
+		t.Fatalf("trash = %+v", trash.Items)
+	}
+	if resp := doRequest(t, "GET", ts.URL+"/namespaces/dev/trash", "test-token", nil); resp.StatusCode != http.StatusForbidden {
+		t.Fatalf("another namespace's token should be forbidden, got %d", resp.StatusCode)
+	}
+
+	// Restoring over a config that reused the name conflicts unless asked
+	// to overwrite, or restored under another name.
+	put("app.yaml", "v: 2\n")
+	restore := func(query string) int {
+		t.Helper()
+		resp := doRequest(t, "POST", ts.URL+"/namespaces/dev/trash/"+deleted.TrashID+"/restore"+query, "dev-token", nil)
+		readBody(t, resp)
+		return resp.StatusCode
+	}
+	if status := restore(""); status != http.StatusConflict {
+		t.Fatalf("restore over a config = %d, want 409", status)
+	}
+	if status := restore("?overwrite=maybe"); status != http.StatusBadRequest {
+		t.Fatalf("restore with a bad overwrite = %d, want 400", status)
+	}
+	if status := restore("?name=app-old.yaml"); status != http.StatusOK {
+		t.Fatalf("restore under another name = %d", status)
+	}
+	if body := readBody(t, doRequest(t, "GET", ts.URL+"/namespaces/dev/configs/app-old.yaml", "dev-token", nil)); string(body) != "v: 1\n" {
+		t.Fatalf("restored config = %q", body)
+	}
+	if status := restore(""); status != http.StatusNotFound {
+		t.Fatalf("restoring twice = %d, want 404", status)
+	}
+
+	// A restored config whose expiry passed in the trash starts afresh.
+	put("preview.yaml", "v: 1\n")
+	md, _ := store.Metadata("dev", "preview.yaml")
+	md.Expires = time.Now().Add(50 * time.Millisecond)
+	store.SetMetadata("dev", "preview.yaml", md)
+	item, _ := store.Trash(storage.DefaultAuthor, "dev", "preview.yaml")
+	deleted.TrashID = item.ID
+	time.Sleep(time.Until(md.Expires))
+	if status := restore(""); status != http.StatusOK {
+		t.Fatalf("restore of an expired config = %d", status)
+	}
+	if md, _ := store.Metadata("dev", "preview.yaml"); !md.Expires.IsZero() {
+		t.Fatalf("expiry should be cleared, got %s", md.Expires)
+	}
+
+	// Items can be purged one by one or all at once, and deleting for good
+	// bypasses the trash.
+	doRequest(t, "DELETE", ts.URL+"/namespaces/dev/configs/app.yaml", "dev-token", nil)
+	doRequest(t, "DELETE", ts.URL+"/namespaces/dev/configs/app-old.yaml", "dev-token", nil)
+	resp = doRequest(t, "DELETE", ts.URL+"/namespaces/dev/configs/preview.yaml?permanent=true", "dev-token", nil)
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("permanent delete = %d", resp.StatusCode)
+	}
+	list()
+	if len(trash.Items) != 2 {
+		t.Fatalf("trash = %+v", trash.Items)
+	}
+	if resp := doRequest(t, "DELETE", ts.URL+"/namespaces/dev/trash/"+trash.Items[0].ID, "dev-token", nil); resp.StatusCode != http.StatusOK {
+		t.Fatalf("purge = %d", resp.StatusCode)
+	}
+	if resp := doRequest(t, "DELETE", ts.URL+"/namespaces/dev/trash/"+trash.Items[0].ID, "dev-token", nil); resp.StatusCode != http.StatusNotFound {
+		t.Fatalf("second purge = %d, want 404", resp.StatusCode)
+	}
+	resp = doRequest(t, "DELETE", ts.URL+"/namespaces/dev/trash", "dev-token", nil)
+	var emptied struct{ Purged int }
+	json.Unmarshal(readBody(t, resp), &emptied)
+	if resp.StatusCode != http.StatusOK || emptied.Purged != 1 {
+		t.Fatalf("empty trash = %d, purged %d", resp.StatusCode, emptied.Purged)
+	}
+	list()
+	if len(trash.Items) != 0 {
+		t.Fatalf("trash should be empty, got %+v", trash.Items)
+	}
+
+	// Batch deletes move configs to the trash too, unless marked permanent.
+	put("batch.yaml", "v: 1\n")
+	put("other.yaml", "v: 1\n")
+	batch := func(body string) []struct {
+		TrashID string `json:"trash_id"`
+	} {
+		t.Helper()
+		resp := doRequest(t, "POST", ts.URL+"/namespaces/dev/batch", "dev-token", strings.NewReader(body))
+		var applied struct {
+			Results []struct {
+				TrashID string `json:"trash_id"`
+			} `json:"results"`
+		}
+		json.Unmarshal(readBody(t, resp), &applied)
+		if resp.StatusCode != http.StatusOK {
+			t.Fatalf("batch = %d", resp.StatusCode)
+		}
+		return applied.Results
+	}
+	results := batch(`{"operations": [{"op": "delete", "name": "batch.yaml"}, {"op": "put", "name": "other.yaml", "content": "v: 2"}]}`)
+	if len(results) != 2 || results[0].TrashID == "" {
+		t.Fatalf("batch delete should report its trash item, got %+v", results)
+	}
+	list()
+	if len(trash.Items) != 1 || trash.Items[0].ID != results[0].TrashID || trash.Items[0].Name != "batch.yaml" {
+		t.Fatalf("trash after a batch delete = %+v", trash.Items)
+	}
+	deleted.TrashID = results[0].TrashID
+	if status := restore(""); status != http.StatusOK {
+		t.Fatalf("restore of a batch-deleted config = %d", status)
+	}
+	if body := readBody(t, doRequest(t, "GET", ts.URL+"/namespaces/dev/configs/batch.yaml", "dev-token", nil)); string(body) != "v: 1\n" {
+		t.Fatalf("restored config = %q", body)
+	}
+	if results := batch(`{"operations": [{"op": "delete", "name": "batch.yaml", "permanent": true}]}`); results[0].TrashID != "" {
+		t.Fatalf("a permanent batch delete should not trash, got %+v", results)
+	}
+	list()
+	if len(trash.Items) != 0 {
+		t.Fatalf("a permanent batch delete should not trash, got %+v", trash.Items)
+	}
+
+	// Without a retention period, deletes are permanent.
+	ts, _, _ = newTestServer(t)
+	doRequest(t, "POST", ts.URL+"/namespaces/dev/configs/app.yaml", "dev-token", strings.NewReader("v: 1\n"))
+	doRequest(t, "DELETE", ts.URL+"/namespaces/dev/configs/app.yaml", "dev-token", nil)
+	list()
+	if len(trash.Items) != 0 {
+		t.Fatalf("trash should stay empty, got %+v", trash.Items)
+	}
+}
@@ -0,0 +1,479 @@
+// Package policy holds per-namespace settings that administrators manage at
+// runtime, such as which key paths of a namespace's configs are secret or
+// stored encrypted, which other namespaces may reference its configs, and
+// how much a namespace may store.
+package policy
+
+import (
+	"errors"
+	"fmt"
+	"maps"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/zvdy/yamlet/internal/storage"
+	"github.com/zvdy/yamlet/internal/yamlutil"
+)
+
+// Policy stores per-namespace settings in memory, seeded from the
+// environment. Once Load has been called, changes are also kept in the
+// namespace records of a store, so that they survive restarts. It is safe
+// for concurrent use.
+type Policy struct {
+	mu           sync.RWMutex
+	secretPaths  map[string][]string // namespace -> patterns
+	encryptPaths map[string][]string // namespace -> patterns
+	referrers    map[string][]string // namespace -> namespaces
+	quotas       map[string]Quota
+
+	// envSecretPaths, envEncryptPaths and envReferrers hold the settings
+	// from the environment, which a namespace's record overrides.
+	envSecretPaths  map[string][]string
+	envEncryptPaths map[string][]string
+	envReferrers    map[string][]string
+	envQuotas       map[string]Quota
+
+	// saveMu serializes changes, which are saved before they take effect.
+	saveMu sync.Mutex
+	store  storage.NamespaceStore
+}
+
+// ErrInvalidQuota is returned for quotas with negative limits.
+var ErrInvalidQuota = errors.New("invalid quota")
+
+// Quota limits what a namespace may store. A zero limit is no limit.
+type Quota struct {
+	// MaxConfigs caps the number of configs.
+	MaxConfigs int `json:"max_configs,omitempty"`
+	// MaxBytes caps the total size of the configs.
+	MaxBytes int64 `json:"max_bytes,omitempty"`
+	// MaxConfigBytes caps the size of a single config, in place of the
+	// server-wide limit.
+	MaxConfigBytes int64 `json:"max_config_bytes,omitempty"`
+	// MaxRevisions caps the revisions retained per config, below what the
+	// store would retain anyway.
+	MaxRevisions int `json:"max_revisions,omitempty"`
+}
+
+// Validate rejects negative limits.
+func (q Quota) Validate() error {
+	if q.MaxConfigs < 0 || q.MaxBytes < 0 || q.MaxConfigBytes < 0 || q.MaxRevisions < 0 {
+		return fmt.Errorf("%w: limits cannot be negative", ErrInvalidQuota)
+	}
+	return nil
+}
+
+// NewPolicy creates a policy store seeded from the environment.
+func NewPolicy() *Policy {
+	secretPaths := loadPathsFromEnv("YAMLET_SECRET_PATHS")
+	encryptPaths := loadPathsFromEnv("YAMLET_ENCRYPT_PATHS")
+	referrers := loadListsFromEnv("YAMLET_REFERRERS", validateNamespace)
+	quotas := loadQuotasFromEnv("YAMLET_QUOTAS")
+	return &Policy{
+		secretPaths:     clonePaths(secretPaths),
+		encryptPaths:    clonePaths(encryptPaths),
+		referrers:       clonePaths(referrers),
+		quotas:          maps.Clone(quotas),
+		envSecretPaths:  secretPaths,
+		envEncryptPaths: encryptPaths,
+		envReferrers:    referrers,
+		envQuotas:       quotas,
+	}
+}
+
+// Load applies the policies kept in the namespace records of store, over
+// the defaults from the environment, and makes later changes save there
+// first. Stores without namespace records leave the policy in memory only.
+func (p *Policy) Load(store storage.NamespaceStore) error {
+	p.saveMu.Lock()
+	defer p.saveMu.Unlock()
+
+	names, err := store.Namespaces()
+	if errors.Is(err, storage.ErrUnsupported) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("failed to list namespaces: %w", err)
+	}
+	for _, namespace := range names {
+		info, err := store.NamespaceInfo(namespace)
+		if errors.Is(err, storage.ErrNotFound) {
+			continue
+		}
+		if errors.Is(err, storage.ErrUnsupported) {
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("failed to load the policy of namespace %s: %w", namespace, err)
+		}
+		if info.Policy != nil {
+			p.apply(namespace, *info.Policy)
+		}
+	}
+	p.store = store
+	return nil
+}
+
+// Forget drops the settings of a deleted namespace, going back to the
+// defaults from the environment.
+func (p *Policy) Forget(namespace string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	setPaths(p.secretPaths, namespace, p.envSecretPaths[namespace])
+	setPaths(p.encryptPaths, namespace, p.envEncryptPaths[namespace])
+	setPaths(p.referrers, namespace, p.envReferrers[namespace])
+	setQuota(p.quotas, namespace, p.envQuotas[namespace])
+}
+
+// apply takes the settings of a namespace's record into effect.
+func (p *Policy) apply(namespace string, np storage.NamespacePolicy) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if np.SecretPaths != nil {
+		setPaths(p.secretPaths, namespace, np.SecretPaths)
+	}
+	if np.EncryptPaths != nil {
+		setPaths(p.encryptPaths, namespace, np.EncryptPaths)
+	}
+	if np.Referrers != nil {
+		setPaths(p.referrers, namespace, np.Referrers)
+	}
+	if np.Quota != nil {
+		setQuota(p.quotas, namespace, Quota(*np.Quota))
+	}
+}
+
+// save records a change to a namespace's policy in its record, creating
+// one if needed, when the policy has a store. It must be called with
+// p.saveMu held.
+func (p *Policy) save(namespace string, update func(*storage.NamespacePolicy)) error {
+	if p.store == nil {
+		return nil
+	}
+	info, err := p.store.NamespaceInfo(namespace)
+	if errors.Is(err, storage.ErrNotFound) {
+		info, err = storage.NamespaceInfo{Name: namespace}, nil
+	}
+	if err != nil {
+		return err
+	}
+	np := storage.NamespacePolicy{}
+	if info.Policy != nil {
+		np = *info.Policy
+	}
+	update(&np)
+	info.Policy = &np
+	return p.store.SetNamespaceInfo(info)
+}
+
+// loadQuotasFromEnv loads per-namespace quotas from an environment
+// variable. Expected format:
+// VAR=namespace1:max_configs=100,namespace1:max_bytes=1048576
+// Malformed entries are skipped, as with YAMLET_TOKENS.
+func loadQuotasFromEnv(name string) map[string]Quota {
+	quotas := make(map[string]Quota)
+	env := os.Getenv(name)
+	if env == "" {
+		return quotas
+	}
+	for _, pair := range strings.Split(env, ",") {
+		namespace, limit, ok := strings.Cut(strings.TrimSpace(pair), ":")
+		key, value, ok2 := strings.Cut(limit, "=")
+		namespace, key = strings.TrimSpace(namespace), strings.TrimSpace(key)
+		n, err := strconv.ParseInt(strings.TrimSpace(value), 10, 64)
+		if !ok || !ok2 || namespace == "" || err != nil || n < 0 {
+			continue
+		}
+		q := quotas[namespace]
+		switch key {
+		case "max_configs":
+			q.MaxConfigs = int(n)
+		case "max_bytes":
+			q.MaxBytes = n
+		case "max_config_bytes":
+			q.MaxConfigBytes = n
+		case "max_revisions":
+			q.MaxRevisions = int(n)
+		default:
+			continue
+		}
+		quotas[namespace] = q
+	}
+	return quotas
+}
+
+// loadPathsFromEnv loads per-namespace path patterns from an environment
+// variable. Expected format: VAR=namespace1:pattern1,namespace1:pattern2
+// Malformed entries are skipped, as with YAMLET_TOKENS.
+func loadPathsFromEnv(name string) map[string][]string {
+	return loadListsFromEnv(name, yamlutil.ValidatePattern)
+}
+
+// loadListsFromEnv loads per-namespace lists from an environment variable
+// in the format of loadPathsFromEnv, skipping values validate rejects.
+func loadListsFromEnv(name string, validate func(string) error) map[string][]string {
+	lists := make(map[string][]string)
+	env := os.Getenv(name)
+	if env == "" {
+		return lists
+	}
+	for _, pair := range strings.Split(env, ",") {
+		namespace, value, ok := strings.Cut(strings.TrimSpace(pair), ":")
+		namespace, value = strings.TrimSpace(namespace), strings.TrimSpace(value)
+		if !ok || namespace == "" || validate(value) != nil {
+			continue
+		}
+		lists[namespace] = append(lists[namespace], value)
+	}
+	return lists
+}
+
+// validateNamespace rejects referrers that cannot name a namespace.
+func validateNamespace(namespace string) error {
+	return storage.ValidateNamespaceInfo(storage.NamespaceInfo{Name: namespace})
+}
+
+// SecretPaths returns the secret path patterns of a namespace.
+func (p *Policy) SecretPaths(namespace string) []string {
+	return p.get(p.secretPaths, namespace)
+}
+
+// SetSecretPaths replaces the secret path patterns of a namespace. An empty
+// list clears them.
+func (p *Policy) SetSecretPaths(namespace string, patterns []string) error {
+	return p.set(p.secretPaths, namespace, patterns, yamlutil.ValidatePattern, func(np *storage.NamespacePolicy) {
+		np.SecretPaths = append([]string{}, patterns...)
+	})
+}
+
+// EncryptPaths returns the patterns of the key paths that are encrypted at
+// rest in a namespace.
+func (p *Policy) EncryptPaths(namespace string) []string {
+	return p.get(p.encryptPaths, namespace)
+}
+
+// SetEncryptPaths replaces the encrypted path patterns of a namespace. An
+// empty list clears them; values that are already encrypted stay encrypted.
+func (p *Policy) SetEncryptPaths(namespace string, patterns []string) error {
+	return p.set(p.encryptPaths, namespace, patterns, yamlutil.ValidatePattern, func(np *storage.NamespacePolicy) {
+		np.EncryptPaths = append([]string{}, patterns...)
+	})
+}
+
+// Referrers returns the other namespaces whose configs may reference the
+// configs of a namespace.
+func (p *Policy) Referrers(namespace string) []string {
+	return p.get(p.referrers, namespace)
+}
+
+// SetReferrers replaces the namespaces that may reference the configs of a
+// namespace. An empty list clears them.
+func (p *Policy) SetReferrers(namespace string, referrers []string) error {
+	return p.set(p.referrers, namespace, referrers, validateNamespace, func(np *storage.NamespacePolicy) {
+		np.Referrers = append([]string{}, referrers...)
+	})
+}
+
+// MayReference reports whether configs in namespace from may reference the
+// configs of namespace to, which is always the case within one namespace.
+func (p *Policy) MayReference(from, to string) bool {
+	if from == to {
+		return true
+	}
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	return slices.Contains(p.referrers[to], from)
+}
+
+// Quota returns the quota of a namespace; the zero Quota when it has none.
+func (p *Policy) Quota(namespace string) Quota {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	return p.quotas[namespace]
+}
+
+// SetQuota replaces the quota of a namespace. The zero Quota clears it.
+// Lowering a quota below what a namespace holds rejects further growth but
+// deletes nothing.
+func (p *Policy) SetQuota(namespace string, q Quota) error {
+	if namespace == "" {
+		return fmt.Errorf("%w: namespace cannot be empty", ErrInvalidQuota)
+	}
+	if err := q.Validate(); err != nil {
+		return err
+	}
+
+	p.saveMu.Lock()
+	defer p.saveMu.Unlock()
+	err := p.save(namespace, func(np *storage.NamespacePolicy) {
+		sq := storage.NamespaceQuota(q)
+		np.Quota = &sq
+	})
+	if err != nil {
+		return fmt.Errorf("failed to save the quota of namespace %s: %w", namespace, err)
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	setQuota(p.quotas, namespace, q)
+	return nil
+}
+
+// Policies returns the policy in effect in every namespace that has one,
+// from its record or the environment. Only the parts a namespace has are
+// set.
+func (p *Policy) Policies() map[string]storage.NamespacePolicy {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	out := make(map[string]storage.NamespacePolicy)
+	for namespace, patterns := range p.secretPaths {
+		np := out[namespace]
+		np.SecretPaths = slices.Clone(patterns)
+		out[namespace] = np
+	}
+	for namespace, patterns := range p.encryptPaths {
+		np := out[namespace]
+		np.EncryptPaths = slices.Clone(patterns)
+		out[namespace] = np
+	}
+	for namespace, referrers := range p.referrers {
+		np := out[namespace]
+		np.Referrers = slices.Clone(referrers)
+		out[namespace] = np
+	}
+	for namespace, q := range p.quotas {
+		np := out[namespace]
+		sq := storage.NamespaceQuota(q)
+		np.Quota = &sq
+		out[namespace] = np
+	}
+	return out
+}
+
+// Restore sets the parts of a namespace's policy that np sets, as when an
+// archived policy is restored: all of them when overwrite is true, and
+// otherwise only those the namespace does not have yet. It reports false
+// if it left the policy as it was.
+func (p *Policy) Restore(namespace string, np storage.NamespacePolicy, overwrite bool) (bool, error) {
+	if namespace == "" {
+		return false, fmt.Errorf("%w: namespace cannot be empty", yamlutil.ErrInvalidPattern)
+	}
+	for _, pattern := range slices.Concat(np.SecretPaths, np.EncryptPaths) {
+		if err := yamlutil.ValidatePattern(pattern); err != nil {
+			return false, err
+		}
+	}
+	for _, referrer := range np.Referrers {
+		if err := validateNamespace(referrer); err != nil {
+			return false, err
+		}
+	}
+	if np.Quota != nil {
+		if err := Quota(*np.Quota).Validate(); err != nil {
+			return false, err
+		}
+	}
+
+	p.saveMu.Lock()
+	defer p.saveMu.Unlock()
+	var restore storage.NamespacePolicy
+	if np.SecretPaths != nil && (overwrite || len(p.SecretPaths(namespace)) == 0) {
+		restore.SecretPaths = slices.Clone(np.SecretPaths)
+	}
+	if np.EncryptPaths != nil && (overwrite || len(p.EncryptPaths(namespace)) == 0) {
+		restore.EncryptPaths = slices.Clone(np.EncryptPaths)
+	}
+	if np.Referrers != nil && (overwrite || len(p.Referrers(namespace)) == 0) {
+		restore.Referrers = slices.Clone(np.Referrers)
+	}
+	if np.Quota != nil && (overwrite || p.Quota(namespace) == Quota{}) {
+		q := *np.Quota
+		restore.Quota = &q
+	}
+	if restore.SecretPaths == nil && restore.EncryptPaths == nil && restore.Referrers == nil && restore.Quota == nil {
+		return false, nil
+	}
+
+	err := p.save(namespace, func(current *storage.NamespacePolicy) {
+		if restore.SecretPaths != nil {
+			current.SecretPaths = restore.SecretPaths
+		}
+		if restore.EncryptPaths != nil {
+			current.EncryptPaths = restore.EncryptPaths
+		}
+		if restore.Referrers != nil {
+			current.Referrers = restore.Referrers
+		}
+		if restore.Quota != nil {
+			current.Quota = restore.Quota
+		}
+	})
+	if err != nil {
+		return false, fmt.Errorf("failed to save the policy of namespace %s: %w", namespace, err)
+	}
+	p.apply(namespace, restore)
+	return true, nil
+}
+
+// setQuota replaces the quota of a namespace in quotas; the zero Quota
+// removes it.
+func setQuota(quotas map[string]Quota, namespace string, q Quota) {
+	if q == (Quota{}) {
+		delete(quotas, namespace)
+		return
+	}
+	quotas[namespace] = q
+}
+
+func (p *Policy) get(paths map[string][]string, namespace string) []string {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	return append([]string(nil), paths[namespace]...)
+}
+
+// set validates and replaces the patterns of a namespace in paths, saving
+// the change through update first.
+func (p *Policy) set(paths map[string][]string, namespace string, patterns []string,
+	validate func(string) error, update func(*storage.NamespacePolicy)) error {
+	if namespace == "" {
+		return fmt.Errorf("%w: namespace cannot be empty", yamlutil.ErrInvalidPattern)
+	}
+	for _, pattern := range patterns {
+		if err := validate(pattern); err != nil {
+			return err
+		}
+	}
+
+	p.saveMu.Lock()
+	defer p.saveMu.Unlock()
+	if err := p.save(namespace, update); err != nil {
+		return fmt.Errorf("failed to save the policy of namespace %s: %w", namespace, err)
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	setPaths(paths, namespace, patterns)
+	return nil
+}
+
+// setPaths replaces the patterns of a namespace in paths; an empty list
+// removes them.
+func setPaths(paths map[string][]string, namespace string, patterns []string) {
+	if len(patterns) == 0 {
+		delete(paths, namespace)
+		return
+	}
+	paths[namespace] = slices.Clone(patterns)
+}
+
+// clonePaths returns a deep copy of paths.
+func clonePaths(paths map[string][]string) map[string][]string {
+	c := make(map[string][]string, len(paths))
+	for namespace, patterns := range paths {
+		c[namespace] = slices.Clone(patterns)
+	}
+	return c
+}
@@ -0,0 +1,235 @@
+package policy
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/zvdy/yamlet/internal/storage"
+	"github.com/zvdy/yamlet/internal/yamlutil"
+)
+
+func TestSecretPathsFromEnv(t *testing.T) {
+	t.Setenv("YAMLET_SECRET_PATHS", "dev:secrets, dev:**.password ,prod:db.*,broken,test:a..b")
+	p := NewPolicy()
+
+	if got := p.SecretPaths("dev"); len(got) != 2 || got[0] != "secrets" || got[1] != "**.password" {
+		t.Fatalf("unexpected dev paths %v", got)
+	}
+	if got := p.SecretPaths("prod"); len(got) != 1 || got[0] != "db.*" {
+		t.Fatalf("unexpected prod paths %v", got)
+	}
+	if got := p.SecretPaths("test"); len(got) != 0 {
+		t.Fatalf("invalid pattern should be skipped, got %v", got)
+	}
+}
+
+func TestSetSecretPaths(t *testing.T) {
+	p := NewPolicy()
+	if err := p.SetSecretPaths("dev", []string{"secrets.*"}); err != nil {
+		t.Fatalf("SetSecretPaths: %v", err)
+	}
+	got := p.SecretPaths("dev")
+	got[0] = "mutated"
+	if p.SecretPaths("dev")[0] != "secrets.*" {
+		t.Fatalf("SecretPaths must return a copy")
+	}
+
+	if err := p.SetSecretPaths("dev", []string{"ok", "bad..path"}); !errors.Is(err, yamlutil.ErrInvalidPattern) {
+		t.Fatalf("expected ErrInvalidPattern, got %v", err)
+	}
+	if p.SecretPaths("dev")[0] != "secrets.*" {
+		t.Fatalf("a rejected update must not change the policy")
+	}
+
+	if err := p.SetSecretPaths("dev", nil); err != nil || len(p.SecretPaths("dev")) != 0 {
+		t.Fatalf("empty list should clear the paths: %v", err)
+	}
+}
+
+func TestEncryptPaths(t *testing.T) {
+	t.Setenv("YAMLET_ENCRYPT_PATHS", "prod:db.password,prod:tokens.*")
+	p := NewPolicy()
+
+	if got := p.EncryptPaths("prod"); len(got) != 2 || got[1] != "tokens.*" {
+		t.Fatalf("unexpected prod paths %v", got)
+	}
+	if got := p.SecretPaths("prod"); len(got) != 0 {
+		t.Fatalf("encrypted paths must not leak into secret paths, got %v", got)
+	}
+	if err := p.SetEncryptPaths("prod", nil); err != nil || len(p.EncryptPaths("prod")) != 0 {
+		t.Fatalf("empty list should clear the paths: %v", err)
+	}
+}
+
+func TestReferrers(t *testing.T) {
+	t.Setenv("YAMLET_REFERRERS", "shared:dev, shared:prod,shared:a/b,broken")
+	p := NewPolicy()
+
+	if got := p.Referrers("shared"); len(got) != 2 || got[0] != "dev" || got[1] != "prod" {
+		t.Fatalf("unexpected shared referrers %v", got)
+	}
+	if !p.MayReference("dev", "shared") || p.MayReference("test", "shared") || p.MayReference("shared", "dev") {
+		t.Fatal("only the listed namespaces may reference shared, and only that way")
+	}
+	if !p.MayReference("test", "test") {
+		t.Fatal("a namespace may always reference itself")
+	}
+
+	if err := p.SetReferrers("shared", []string{"test", ".."}); !errors.Is(err, storage.ErrInvalidName) {
+		t.Fatalf("expected ErrInvalidName, got %v", err)
+	}
+	if err := p.SetReferrers("shared", []string{"test"}); err != nil {
+		t.Fatalf("SetReferrers: %v", err)
+	}
+	if p.MayReference("dev", "shared") || !p.MayReference("test", "shared") {
+		t.Fatal("SetReferrers should replace the referrers")
+	}
+}
+
+func TestQuotasFromEnv(t *testing.T) {
+	t.Setenv("YAMLET_QUOTAS", "dev:max_configs=100, dev:max_bytes=1048576,prod:max_revisions=5,broken,test:max_configs=-1,test:unknown=3,test:max_bytes=x")
+	p := NewPolicy()
+
+	if got := p.Quota("dev"); got != (Quota{MaxConfigs: 100, MaxBytes: 1048576}) {
+		t.Fatalf("unexpected dev quota %+v", got)
+	}
+	if got := p.Quota("prod"); got != (Quota{MaxRevisions: 5}) {
+		t.Fatalf("unexpected prod quota %+v", got)
+	}
+	if got := p.Quota("test"); got != (Quota{}) {
+		t.Fatalf("malformed entries should be skipped, got %+v", got)
+	}
+}
+
+func TestSetQuota(t *testing.T) {
+	p := NewPolicy()
+	q := Quota{MaxConfigs: 10, MaxConfigBytes: 4096}
+	if err := p.SetQuota("dev", q); err != nil {
+		t.Fatalf("SetQuota: %v", err)
+	}
+	if got := p.Quota("dev"); got != q {
+		t.Fatalf("Quota = %+v, want %+v", got, q)
+	}
+
+	for _, bad := range []Quota{{MaxConfigs: -1}, {MaxBytes: -1}, {MaxConfigBytes: -1}, {MaxRevisions: -1}} {
+		if err := p.SetQuota("dev", bad); !errors.Is(err, ErrInvalidQuota) {
+			t.Fatalf("SetQuota(%+v) should be ErrInvalidQuota, got %v", bad, err)
+		}
+	}
+	if err := p.SetQuota("", q); !errors.Is(err, ErrInvalidQuota) {
+		t.Fatalf("expected ErrInvalidQuota for an empty namespace, got %v", err)
+	}
+	if p.Quota("dev") != q {
+		t.Fatalf("a rejected update must not change the policy")
+	}
+
+	if err := p.SetQuota("dev", Quota{}); err != nil || p.Quota("dev") != (Quota{}) {
+		t.Fatalf("the zero quota should clear it: %v", err)
+	}
+}
+
+func TestPolicyPersists(t *testing.T) {
+	t.Setenv("YAMLET_SECRET_PATHS", "dev:secrets,prod:db.*")
+	t.Setenv("YAMLET_QUOTAS", "dev:max_bytes=100")
+	store := storage.NewMemoryStore()
+	p := NewPolicy()
+	if err := p.Load(store); err != nil {
+		t.Fatalf("Load: %v", err)
+	}
+	if err := p.SetSecretPaths("dev", []string{"token"}); err != nil {
+		t.Fatalf("SetSecretPaths: %v", err)
+	}
+	if err := p.SetEncryptPaths("dev", []string{"db.password"}); err != nil {
+		t.Fatalf("SetEncryptPaths: %v", err)
+	}
+	if err := p.SetQuota("dev", Quota{MaxConfigs: 5}); err != nil {
+		t.Fatalf("SetQuota: %v", err)
+	}
+	// Clearing the paths of a namespace overrides the environment too.
+	if err := p.SetSecretPaths("prod", nil); err != nil {
+		t.Fatalf("SetSecretPaths: %v", err)
+	}
+	info, err := store.NamespaceInfo("dev")
+	if err != nil || info.Policy == nil || len(info.Policy.SecretPaths) != 1 {
+		t.Fatalf("the record should hold the policy, got %+v, %v", info, err)
+	}
+
+	// A restarted server sees the same policy.
+	restarted := NewPolicy()
+	if err := restarted.Load(store); err != nil {
+		t.Fatalf("Load: %v", err)
+	}
+	if got := restarted.SecretPaths("dev"); len(got) != 1 || got[0] != "token" {
+		t.Fatalf("dev paths after a restart = %v", got)
+	}
+	if got := restarted.EncryptPaths("dev"); len(got) != 1 || got[0] != "db.password" {
+		t.Fatalf("encrypted dev paths after a restart = %v", got)
+	}
+	if got := restarted.Quota("dev"); got != (Quota{MaxConfigs: 5}) {
+		t.Fatalf("dev quota after a restart = %+v", got)
+	}
+	if got := restarted.SecretPaths("prod"); len(got) != 0 {
+		t.Fatalf("cleared prod paths came back after a restart: %v", got)
+	}
+
+	// A deleted namespace goes back to the defaults.
+	if err := store.DeleteNamespace("dev"); err != nil {
+		t.Fatal(err)
+	}
+	restarted.Forget("dev")
+	if got := restarted.SecretPaths("dev"); len(got) != 1 || got[0] != "secrets" {
+		t.Fatalf("dev paths after deleting the namespace = %v", got)
+	}
+	if got := restarted.EncryptPaths("dev"); len(got) != 0 {
+		t.Fatalf("encrypted dev paths after deleting the namespace = %v", got)
+	}
+	if got := restarted.Quota("dev"); got != (Quota{MaxBytes: 100}) {
+		t.Fatalf("dev quota after deleting the namespace = %+v", got)
+	}
+}
+
+func TestPoliciesAndRestore(t *testing.T) {
+	t.Setenv("YAMLET_SECRET_PATHS", "dev:secrets")
+	store := storage.NewMemoryStore()
+	p := NewPolicy()
+	if err := p.Load(store); err != nil {
+		t.Fatalf("Load: %v", err)
+	}
+	if err := p.SetQuota("prod", Quota{MaxConfigs: 5}); err != nil {
+		t.Fatalf("SetQuota: %v", err)
+	}
+	policies := p.Policies()
+	if len(policies) != 2 || len(policies["dev"].SecretPaths) != 1 || policies["dev"].Quota != nil ||
+		policies["prod"].SecretPaths != nil || policies["prod"].Quota.MaxConfigs != 5 {
+		t.Fatalf("Policies = %+v", policies)
+	}
+
+	// Without overwrite only what a namespace lacks is restored.
+	archived := storage.NamespacePolicy{SecretPaths: []string{"token"}, EncryptPaths: []string{"db.password"}}
+	if restored, err := p.Restore("dev", archived, false); err != nil || !restored {
+		t.Fatalf("Restore = %t, %v", restored, err)
+	}
+	if got := p.SecretPaths("dev"); len(got) != 1 || got[0] != "secrets" {
+		t.Fatalf("secret paths the namespace had should be kept, got %v", got)
+	}
+	if got := p.EncryptPaths("dev"); len(got) != 1 || got[0] != "db.password" {
+		t.Fatalf("restored encrypted paths = %v", got)
+	}
+	if restored, err := p.Restore("dev", archived, false); err != nil || restored {
+		t.Fatalf("a second Restore should change nothing, got %t, %v", restored, err)
+	}
+	if restored, err := p.Restore("dev", archived, true); err != nil || !restored {
+		t.Fatalf("Restore with overwrite = %t, %v", restored, err)
+	}
+	if got := p.SecretPaths("dev"); len(got) != 1 || got[0] != "token" {
+		t.Fatalf("overwritten secret paths = %v", got)
+	}
+	info, err := store.NamespaceInfo("dev")
+	if err != nil || info.Policy == nil || len(info.Policy.SecretPaths) != 1 || len(info.Policy.EncryptPaths) != 1 {
+		t.Fatalf("the record should hold the restored policy, got %+v, %v", info, err)
+	}
+
+	if _, err := p.Restore("dev", storage.NamespacePolicy{Quota: &storage.NamespaceQuota{MaxBytes: -1}}, true); !errors.Is(err, ErrInvalidQuota) {
+		t.Fatalf("expected ErrInvalidQuota, got %v", err)
+	}
+}
@@ -0,0 +1,142 @@
+package storage
+
+import (
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// tempPrefix starts the name of every temporary file FileStore writes. Names
+// with this prefix are not valid config names, so leftovers can be told
+// apart from data and removed by Recover.
+const tempPrefix = ".yamlet-tmp-"
+
+// writeFileAtomic replaces path with content so that a crash leaves either
+// the old file or the complete new one, never a truncated mix: content goes
+// to a temporary file in the same directory, which is fsynced, renamed over
+// path, and followed by an fsync of the directory so the rename itself is
+// durable. Missing parent directories are created.
+func writeFileAtomic(path string, content []byte) error {
+	dir := filepath.Dir(path)
+	if err := mkdirAllSync(dir); err != nil {
+		return err
+	}
+
+	tmp, err := os.CreateTemp(dir, tempPrefix+filepath.Base(path)+"-*")
+	if err != nil {
+		return fmt.Errorf("failed to create temporary file in %s: %w", dir, err)
+	}
+	tmpPath := tmp.Name()
+	committed := false
+	defer func() {
+		if !committed {
+			_ = os.Remove(tmpPath)
+		}
+	}()
+
+	if _, err := tmp.Write(content); err != nil {
+		tmp.Close()
+		return fmt.Errorf("failed to write file %s: %w", tmpPath, err)
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return fmt.Errorf("failed to sync file %s: %w", tmpPath, err)
+	}
+	if err := tmp.Close(); err != nil {
+		return fmt.Errorf("failed to close file %s: %w", tmpPath, err)
+	}
+	if err := os.Rename(tmpPath, path); err != nil {
+		return fmt.Errorf("failed to replace file %s: %w", path, err)
+	}
+	committed = true
+	return syncDir(dir)
+}
+
+// removeFileSync removes path and fsyncs its directory.
+func removeFileSync(path string) error {
+	if err := os.Remove(path); err != nil {
+		return err
+	}
+	return syncDir(filepath.Dir(path))
+}
+
+// mkdirAllSync creates dir and any missing parents, fsyncing the parent of
+// every directory it creates so the new entries survive a crash.
+func mkdirAllSync(dir string) error {
+	var missing []string
+	for d := dir; ; d = filepath.Dir(d) {
+		if _, err := os.Stat(d); err == nil {
+			break
+		} else if !os.IsNotExist(err) {
+			return fmt.Errorf("failed to stat directory %s: %w", d, err)
+		}
+		missing = append(missing, d)
+		if parent := filepath.Dir(d); parent == d {
+			break
+		}
+	}
+	if len(missing) == 0 {
+		return nil
+	}
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return fmt.Errorf("failed to create directory %s: %w", dir, err)
+	}
+	for i := len(missing) - 1; i >= 0; i-- {
+		if err := syncDir(filepath.Dir(missing[i])); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// syncDir fsyncs a directory, making renames and removals in it durable.
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return fmt.Errorf("failed to open directory %s: %w", dir, err)
+	}
+	defer d.Close()
+	if err := d.Sync(); err != nil {
+		return fmt.Errorf("failed to sync directory %s: %w", dir, err)
+	}
+	return nil
+}
+
+// isTempFile reports whether a file name belongs to a temporary file.
+func isTempFile(name string) bool {
+	return strings.HasPrefix(name, tempPrefix)
+}
+
+// Recover removes temporary files left behind by writes that were
+// interrupted by a crash, and returns how many it removed. It should run at
+// startup, before the store serves requests; the data they would have
+// replaced is intact. A transaction interrupted while its writes were being
+// applied is then finished from its journal.
+func (f *FileStore) Recover() (int, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	removed := 0
+	err := filepath.WalkDir(f.baseDir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			if os.IsNotExist(err) && path == f.baseDir {
+				return filepath.SkipDir
+			}
+			return err
+		}
+		if d.IsDir() || !isTempFile(d.Name()) {
+			return nil
+		}
+		if err := removeFileSync(path); err != nil && !os.IsNotExist(err) {
+			return fmt.Errorf("failed to remove temporary file %s: %w", path, err)
+		}
+		removed++
+		return nil
+	})
+	if err != nil {
+		return removed, err
+	}
+	return removed, f.replayJournal()
+}
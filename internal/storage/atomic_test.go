@@ -0,0 +1,76 @@
+package storage
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestWriteFileAtomic(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "a", "b", "config.yaml")
+	if err := writeFileAtomic(path, []byte("v: 1\n")); err != nil {
+		t.Fatalf("writeFileAtomic: %v", err)
+	}
+	if err := writeFileAtomic(path, []byte("v: 2\n")); err != nil {
+		t.Fatalf("writeFileAtomic over existing file: %v", err)
+	}
+	got, err := os.ReadFile(path)
+	if err != nil || string(got) != "v: 2\n" {
+		t.Fatalf("read back %q, %v", got, err)
+	}
+	info, _ := os.Stat(path)
+	if info.Mode().Perm() != 0o600 {
+		t.Fatalf("expected mode 0600, got %v", info.Mode().Perm())
+	}
+	entries, _ := os.ReadDir(filepath.Dir(path))
+	if len(entries) != 1 {
+		t.Fatalf("temporary files left behind: %v", entries)
+	}
+}
+
+func TestFileStoreRecover(t *testing.T) {
+	dir := t.TempDir()
+	store := NewFileStore(dir)
+	if err := store.Store("dev", "app.yaml", []byte("v: 1\n")); err != nil {
+		t.Fatal(err)
+	}
+
+	// Simulate writes interrupted before their rename.
+	orphans := []string{
+		filepath.Join(dir, "dev", tempPrefix+"app.yaml-123"),
+		filepath.Join(dir, reservedDir, "revisions", "dev", "app.yaml", tempPrefix+"2-456"),
+	}
+	for _, p := range orphans {
+		if err := os.WriteFile(p, []byte("v: tru"), 0o600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if names, _ := store.List("dev"); len(names) != 1 {
+		t.Fatalf("temporary files must not be listed as configs: %v", names)
+	}
+
+	removed, err := store.Recover()
+	if err != nil || removed != 2 {
+		t.Fatalf("Recover = %d, %v; want 2 removed", removed, err)
+	}
+	for _, p := range orphans {
+		if _, err := os.Stat(p); !os.IsNotExist(err) {
+			t.Fatalf("%s not removed", p)
+		}
+	}
+	if got, err := store.Get("dev", "app.yaml"); err != nil || string(got) != "v: 1\n" {
+		t.Fatalf("data damaged by recovery: %q, %v", got, err)
+	}
+	if revs, _ := store.Revisions("dev", "app.yaml"); len(revs) != 1 {
+		t.Fatalf("expected one revision, got %v", revs)
+	}
+
+	if removed, err := NewFileStore(filepath.Join(dir, "missing")).Recover(); err != nil || removed != 0 {
+		t.Fatalf("Recover on a missing directory = %d, %v", removed, err)
+	}
+	if err := store.Store("dev", tempPrefix+"x", []byte("a: 1\n")); !errors.Is(err, ErrInvalidName) {
+		t.Fatalf("expected ErrInvalidName for a temporary file name, got %v", err)
+	}
+}
@@ -0,0 +1,904 @@
+package storage
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io"
+	"path/filepath"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+// Top-level buckets of a BoltStore database. Each namespace is a nested
+// bucket of bucketConfigs holding name -> content, a nested bucket of
+// bucketRevisions holding one bucket per config, keyed by big-endian
+// revision number, and a nested bucket of bucketMetadata holding name ->
+// JSON metadata record, and a nested bucket of bucketTrash holding trash
+// item ID -> JSON item with its content; bucketNamespaces holds namespace ->
+// JSON namespace record. Other top-level buckets are free for further
+// state.
+var (
+	bucketConfigs    = []byte("configs")
+	bucketRevisions  = []byte("revisions")
+	bucketMetadata   = []byte("metadata")
+	bucketNamespaces = []byte("namespaces")
+	bucketTrash      = []byte("trash")
+)
+
+// BoltStore implements storage in a single bbolt database file. Every
+// write, together with its revision, is one ACID transaction, and
+// WriteSnapshot takes consistent backups while the store is in use.
+type BoltStore struct {
+	db           *bolt.DB
+	maxRevisions int
+}
+
+// NewBoltStore opens (creating if needed) the database at path. Only one
+// process can open a database at a time.
+func NewBoltStore(path string) (*BoltStore, error) {
+	if err := mkdirAllSync(filepath.Dir(path)); err != nil {
+		return nil, err
+	}
+	db, err := bolt.Open(path, 0o600, &bolt.Options{Timeout: 5 * time.Second})
+	if err != nil {
+		return nil, fmt.Errorf("failed to open database %s: %w", path, err)
+	}
+	err = db.Update(func(tx *bolt.Tx) error {
+		for _, name := range [][]byte{bucketConfigs, bucketRevisions, bucketMetadata, bucketNamespaces, bucketTrash} {
+			if _, err := tx.CreateBucketIfNotExists(name); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		db.Close()
+		return nil, fmt.Errorf("failed to initialize database %s: %w", path, err)
+	}
+	return &BoltStore{db: db, maxRevisions: DefaultMaxRevisions}, nil
+}
+
+// Close closes the database.
+func (b *BoltStore) Close() error {
+	return b.db.Close()
+}
+
+func (b *BoltStore) Store(namespace, name string, content []byte) error {
+	if err := validateNamespaceAndName(namespace, name); err != nil {
+		return err
+	}
+
+	return b.db.Update(func(tx *bolt.Tx) error {
+		return b.storeTx(tx, namespace, name, content)
+	})
+}
+
+// storeTx writes a config and records it as the next revision in tx.
+func (b *BoltStore) storeTx(tx *bolt.Tx, namespace, name string, content []byte) error {
+	configs, err := tx.Bucket(bucketConfigs).CreateBucketIfNotExists([]byte(namespace))
+	if err != nil {
+		return err
+	}
+	if err := configs.Put([]byte(name), content); err != nil {
+		return err
+	}
+
+	namespaceRevs, err := tx.Bucket(bucketRevisions).CreateBucketIfNotExists([]byte(namespace))
+	if err != nil {
+		return err
+	}
+	revs, err := namespaceRevs.CreateBucketIfNotExists([]byte(name))
+	if err != nil {
+		return err
+	}
+	next := uint64(1)
+	if k, _ := revs.Cursor().Last(); k != nil {
+		next = binary.BigEndian.Uint64(k) + 1
+	}
+	if err := revs.Put(revisionKey(next), encodeRevision(time.Now().UTC(), content)); err != nil {
+		return err
+	}
+
+	return pruneRevisionBucket(revs, b.maxRevisions)
+}
+
+// pruneRevisionBucket deletes the oldest revisions in revs until keep
+// remain.
+func pruneRevisionBucket(revs *bolt.Bucket, keep int) error {
+	c := revs.Cursor()
+	excess := -keep
+	for k, _ := c.First(); k != nil; k, _ = c.Next() {
+		excess++
+	}
+	for k, _ := c.First(); k != nil && excess > 0; k, _ = c.First() {
+		if err := revs.Delete(k); err != nil {
+			return err
+		}
+		excess--
+	}
+	return nil
+}
+
+// PruneRevisions implements Pruner.
+func (b *BoltStore) PruneRevisions(namespace, name string, keep int) error {
+	if err := validateNamespaceAndName(namespace, name); err != nil {
+		return err
+	}
+
+	return b.db.Update(func(tx *bolt.Tx) error {
+		revs := b.revisionBucket(tx, namespace, name)
+		if revs == nil {
+			return fmt.Errorf("config %s in namespace %s: %w", name, namespace, ErrNotFound)
+		}
+		return pruneRevisionBucket(revs, max(keep, 1))
+	})
+}
+
+func (b *BoltStore) Get(namespace, name string) ([]byte, error) {
+	if err := validateNamespaceAndName(namespace, name); err != nil {
+		return nil, err
+	}
+
+	var content []byte
+	err := b.db.View(func(tx *bolt.Tx) error {
+		var err error
+		content, err = getTx(tx, namespace, name)
+		return err
+	})
+	return content, err
+}
+
+// getTx reads a config in tx.
+func getTx(tx *bolt.Tx, namespace, name string) ([]byte, error) {
+	configs := tx.Bucket(bucketConfigs).Bucket([]byte(namespace))
+	if configs == nil {
+		return nil, fmt.Errorf("namespace %s: %w", namespace, ErrNotFound)
+	}
+	v := configs.Get([]byte(name))
+	if v == nil {
+		return nil, fmt.Errorf("config %s in namespace %s: %w", name, namespace, ErrNotFound)
+	}
+	// Values are only valid inside the transaction.
+	return append([]byte(nil), v...), nil
+}
+
+func (b *BoltStore) Delete(namespace, name string) error {
+	if err := validateNamespaceAndName(namespace, name); err != nil {
+		return err
+	}
+
+	return b.db.Update(func(tx *bolt.Tx) error {
+		return deleteTx(tx, namespace, name)
+	})
+}
+
+// deleteTx deletes a config with its revisions and metadata in tx.
+func deleteTx(tx *bolt.Tx, namespace, name string) error {
+	configs := tx.Bucket(bucketConfigs).Bucket([]byte(namespace))
+	if configs == nil {
+		return fmt.Errorf("namespace %s: %w", namespace, ErrNotFound)
+	}
+	if configs.Get([]byte(name)) == nil {
+		return fmt.Errorf("config %s in namespace %s: %w", name, namespace, ErrNotFound)
+	}
+	if err := configs.Delete([]byte(name)); err != nil {
+		return err
+	}
+	if namespaceRevs := tx.Bucket(bucketRevisions).Bucket([]byte(namespace)); namespaceRevs != nil {
+		if err := namespaceRevs.DeleteBucket([]byte(name)); err != nil && err != bolt.ErrBucketNotFound {
+			return err
+		}
+	}
+	if metadata := tx.Bucket(bucketMetadata).Bucket([]byte(namespace)); metadata != nil {
+		if err := metadata.Delete([]byte(name)); err != nil {
+			return err
+		}
+	}
+
+	// Clean up empty namespace
+	if k, _ := configs.Cursor().First(); k == nil {
+		if err := tx.Bucket(bucketConfigs).DeleteBucket([]byte(namespace)); err != nil {
+			return err
+		}
+		for _, bucket := range [][]byte{bucketRevisions, bucketMetadata} {
+			if err := tx.Bucket(bucket).DeleteBucket([]byte(namespace)); err != nil && err != bolt.ErrBucketNotFound {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func (b *BoltStore) List(namespace string) ([]string, error) {
+	if err := validateName(namespace); err != nil {
+		return nil, err
+	}
+
+	var configs []string
+	err := b.db.View(func(tx *bolt.Tx) error {
+		var err error
+		configs, err = listTx(tx, namespace)
+		return err
+	})
+	return configs, err
+}
+
+// listTx lists the configs of a namespace in tx.
+func listTx(tx *bolt.Tx, namespace string) ([]string, error) {
+	configs := []string{}
+	bucket := tx.Bucket(bucketConfigs).Bucket([]byte(namespace))
+	if bucket == nil {
+		return configs, nil
+	}
+	err := bucket.ForEach(func(k, _ []byte) error {
+		configs = append(configs, string(k))
+		return nil
+	})
+	return configs, err
+}
+
+// Query implements Querier, walking the namespace's keys in order from the
+// first one the listing can include and reading metadata from the same
+// transaction.
+func (b *BoltStore) Query(namespace string, opts ListOptions) (ListPage, error) {
+	if err := validateName(namespace); err != nil {
+		return ListPage{}, err
+	}
+	if err := opts.Validate(); err != nil {
+		return ListPage{}, err
+	}
+
+	p := newPager(opts)
+	err := b.db.View(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(bucketConfigs).Bucket([]byte(namespace))
+		if bucket == nil {
+			return nil
+		}
+		metadata := tx.Bucket(bucketMetadata).Bucket([]byte(namespace))
+		labels := func(name []byte) func() (map[string]string, error) {
+			return func() (map[string]string, error) {
+				var data []byte
+				if metadata != nil {
+					data = metadata.Get(name)
+				}
+				if data == nil {
+					return nil, nil
+				}
+				var md Metadata
+				err := json.Unmarshal(data, &md)
+				return md.Labels, err
+			}
+		}
+
+		c := bucket.Cursor()
+		var k []byte
+		switch {
+		case !opts.Descending:
+			start := max(opts.Prefix, opts.After)
+			k, _ = c.Seek([]byte(start))
+		case opts.After != "":
+			if k, _ = c.Seek([]byte(opts.After)); k == nil {
+				k, _ = c.Last()
+			}
+		default:
+			k, _ = c.Last()
+		}
+		for ; k != nil; k = cursorStep(c, opts.Descending) {
+			more, err := p.add(string(k), labels(k))
+			if err != nil || !more {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return ListPage{}, fmt.Errorf("failed to list namespace %s: %w", namespace, err)
+	}
+	return p.page, nil
+}
+
+// cursorStep moves c on in listing order.
+func cursorStep(c *bolt.Cursor, descending bool) []byte {
+	var k []byte
+	if descending {
+		k, _ = c.Prev()
+	} else {
+		k, _ = c.Next()
+	}
+	return k
+}
+
+// Revisions implements Versioned.
+func (b *BoltStore) Revisions(namespace, name string) ([]Revision, error) {
+	if err := validateNamespaceAndName(namespace, name); err != nil {
+		return nil, err
+	}
+
+	var out []Revision
+	err := b.db.View(func(tx *bolt.Tx) error {
+		var err error
+		out, err = b.revisionsTx(tx, namespace, name)
+		return err
+	})
+	return out, err
+}
+
+func (b *BoltStore) revisionsTx(tx *bolt.Tx, namespace, name string) ([]Revision, error) {
+	revs := b.revisionBucket(tx, namespace, name)
+	if revs == nil {
+		return nil, fmt.Errorf("config %s in namespace %s: %w", name, namespace, ErrNotFound)
+	}
+	var out []Revision
+	err := revs.ForEach(func(k, v []byte) error {
+		created, content := decodeRevision(v)
+		out = append(out, Revision{
+			Number:  int(binary.BigEndian.Uint64(k)),
+			Size:    len(content),
+			Created: created,
+		})
+		return nil
+	})
+	return out, err
+}
+
+// GetRevision implements Versioned.
+func (b *BoltStore) GetRevision(namespace, name string, revision int) ([]byte, error) {
+	if err := validateNamespaceAndName(namespace, name); err != nil {
+		return nil, err
+	}
+
+	var content []byte
+	err := b.db.View(func(tx *bolt.Tx) error {
+		var err error
+		content, err = b.getRevisionTx(tx, namespace, name, revision)
+		return err
+	})
+	return content, err
+}
+
+func (b *BoltStore) getRevisionTx(tx *bolt.Tx, namespace, name string, revision int) ([]byte, error) {
+	var v []byte
+	if revs := b.revisionBucket(tx, namespace, name); revs != nil && revision > 0 {
+		v = revs.Get(revisionKey(uint64(revision)))
+	}
+	if v == nil {
+		return nil, fmt.Errorf("revision %d of config %s in namespace %s: %w", revision, name, namespace, ErrNotFound)
+	}
+	_, content := decodeRevision(v)
+	return append([]byte(nil), content...), nil
+}
+
+// Rewrite implements Rewriter. The config and all of its revisions are
+// rewritten in a single transaction.
+func (b *BoltStore) Rewrite(namespace, name string, fn func([]byte) ([]byte, error)) error {
+	if err := validateNamespaceAndName(namespace, name); err != nil {
+		return err
+	}
+
+	return b.db.Update(func(tx *bolt.Tx) error {
+		configs := tx.Bucket(bucketConfigs).Bucket([]byte(namespace))
+		var current []byte
+		if configs != nil {
+			current = configs.Get([]byte(name))
+		}
+		if current == nil {
+			return fmt.Errorf("config %s in namespace %s: %w", name, namespace, ErrNotFound)
+		}
+		content, err := fn(current)
+		if err != nil {
+			return err
+		}
+		if err := configs.Put([]byte(name), content); err != nil {
+			return err
+		}
+
+		revs := b.revisionBucket(tx, namespace, name)
+		if revs == nil {
+			return nil
+		}
+		updates := make(map[string][]byte)
+		err = revs.ForEach(func(k, v []byte) error {
+			created, old := decodeRevision(v)
+			content, err := fn(old)
+			if err != nil {
+				return err
+			}
+			updates[string(k)] = encodeRevision(created, content)
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		for k, v := range updates {
+			if err := revs.Put([]byte(k), v); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// Namespaces implements NamespaceLister.
+func (b *BoltStore) Namespaces() ([]string, error) {
+	var namespaces []string
+	err := b.db.View(func(tx *bolt.Tx) error {
+		var err error
+		namespaces, err = namespacesTx(tx)
+		return err
+	})
+	return namespaces, err
+}
+
+func namespacesTx(tx *bolt.Tx) ([]string, error) {
+	namespaces := []string{}
+	if err := tx.Bucket(bucketConfigs).ForEachBucket(func(k []byte) error {
+		namespaces = append(namespaces, string(k))
+		return nil
+	}); err != nil {
+		return nil, err
+	}
+	err := tx.Bucket(bucketNamespaces).ForEach(func(k, _ []byte) error {
+		namespaces = append(namespaces, string(k))
+		return nil
+	})
+	return mergeNames(namespaces, nil), err
+}
+
+// NamespaceInfo implements NamespaceStore.
+func (b *BoltStore) NamespaceInfo(namespace string) (NamespaceInfo, error) {
+	if err := validateName(namespace); err != nil {
+		return NamespaceInfo{}, err
+	}
+
+	var info NamespaceInfo
+	err := b.db.View(func(tx *bolt.Tx) error {
+		var err error
+		info, err = namespaceInfoTx(tx, namespace)
+		return err
+	})
+	return info, err
+}
+
+func namespaceInfoTx(tx *bolt.Tx, namespace string) (NamespaceInfo, error) {
+	var info NamespaceInfo
+	data := tx.Bucket(bucketNamespaces).Get([]byte(namespace))
+	if data == nil {
+		return info, fmt.Errorf("namespace %s: %w", namespace, ErrNotFound)
+	}
+	err := json.Unmarshal(data, &info)
+	return info, err
+}
+
+// SetNamespaceInfo implements NamespaceStore.
+func (b *BoltStore) SetNamespaceInfo(info NamespaceInfo) error {
+	if err := ValidateNamespaceInfo(info); err != nil {
+		return err
+	}
+	data, err := json.Marshal(info)
+	if err != nil {
+		return err
+	}
+
+	return b.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(bucketNamespaces).Put([]byte(info.Name), data)
+	})
+}
+
+// DeleteNamespace implements NamespaceStore. The namespace goes in one
+// transaction.
+func (b *BoltStore) DeleteNamespace(namespace string) error {
+	if err := validateName(namespace); err != nil {
+		return err
+	}
+
+	return b.db.Update(func(tx *bolt.Tx) error {
+		found := tx.Bucket(bucketNamespaces).Get([]byte(namespace)) != nil
+		for _, bucket := range [][]byte{bucketConfigs, bucketRevisions, bucketMetadata, bucketTrash} {
+			err := tx.Bucket(bucket).DeleteBucket([]byte(namespace))
+			if err == nil && (bytes.Equal(bucket, bucketConfigs) || bytes.Equal(bucket, bucketTrash)) {
+				found = true
+			}
+			if err != nil && err != bolt.ErrBucketNotFound {
+				return err
+			}
+		}
+		if !found {
+			return fmt.Errorf("namespace %s: %w", namespace, ErrNotFound)
+		}
+		return tx.Bucket(bucketNamespaces).Delete([]byte(namespace))
+	})
+}
+
+// Usage implements NamespaceStore.
+func (b *BoltStore) Usage(namespace string) (NamespaceUsage, error) {
+	if err := validateName(namespace); err != nil {
+		return NamespaceUsage{}, err
+	}
+
+	var usage NamespaceUsage
+	err := b.db.View(func(tx *bolt.Tx) error {
+		configs := tx.Bucket(bucketConfigs).Bucket([]byte(namespace))
+		if configs == nil {
+			return nil
+		}
+		return configs.ForEach(func(_, v []byte) error {
+			usage.Configs++
+			usage.Bytes += int64(len(v))
+			return nil
+		})
+	})
+	return usage, err
+}
+
+// WriteSnapshot implements Snapshotter. It writes a consistent copy of the
+// whole database to w without blocking readers or writers, and returns the
+// number of bytes written. The copy is itself a database that NewBoltStore
+// can open.
+func (b *BoltStore) WriteSnapshot(w io.Writer) (int64, error) {
+	var n int64
+	err := b.db.View(func(tx *bolt.Tx) error {
+		var err error
+		n, err = tx.WriteTo(w)
+		return err
+	})
+	return n, err
+}
+
+// Metadata implements MetadataStore.
+func (b *BoltStore) Metadata(namespace, name string) (Metadata, error) {
+	if err := validateNamespaceAndName(namespace, name); err != nil {
+		return Metadata{}, err
+	}
+
+	var md Metadata
+	err := b.db.View(func(tx *bolt.Tx) error {
+		var err error
+		md, err = metadataTx(tx, namespace, name)
+		return err
+	})
+	return md, err
+}
+
+func metadataTx(tx *bolt.Tx, namespace, name string) (Metadata, error) {
+	var md Metadata
+	var data []byte
+	if metadata := tx.Bucket(bucketMetadata).Bucket([]byte(namespace)); metadata != nil {
+		data = metadata.Get([]byte(name))
+	}
+	if data == nil {
+		return md, fmt.Errorf("metadata of config %s in namespace %s: %w", name, namespace, ErrNotFound)
+	}
+	err := json.Unmarshal(data, &md)
+	return md, err
+}
+
+// SetMetadata implements MetadataStore.
+func (b *BoltStore) SetMetadata(namespace, name string, md Metadata) error {
+	if err := validateNamespaceAndName(namespace, name); err != nil {
+		return err
+	}
+	data, err := json.Marshal(md)
+	if err != nil {
+		return err
+	}
+
+	return b.db.Update(func(tx *bolt.Tx) error {
+		configs := tx.Bucket(bucketConfigs).Bucket([]byte(namespace))
+		if configs == nil || configs.Get([]byte(name)) == nil {
+			return fmt.Errorf("config %s in namespace %s: %w", name, namespace, ErrNotFound)
+		}
+		metadata, err := tx.Bucket(bucketMetadata).CreateBucketIfNotExists([]byte(namespace))
+		if err != nil {
+			return err
+		}
+		return metadata.Put([]byte(name), data)
+	})
+}
+
+func (b *BoltStore) revisionBucket(tx *bolt.Tx, namespace, name string) *bolt.Bucket {
+	namespaceRevs := tx.Bucket(bucketRevisions).Bucket([]byte(namespace))
+	if namespaceRevs == nil {
+		return nil
+	}
+	return namespaceRevs.Bucket([]byte(name))
+}
+
+func revisionKey(n uint64) []byte {
+	k := make([]byte, 8)
+	binary.BigEndian.PutUint64(k, n)
+	return k
+}
+
+// Revision values are the creation time in Unix nanoseconds followed by the
+// content.
+func encodeRevision(created time.Time, content []byte) []byte {
+	v := make([]byte, 8, 8+len(content))
+	binary.BigEndian.PutUint64(v, uint64(created.UnixNano()))
+	return append(v, content...)
+}
+
+func decodeRevision(v []byte) (time.Time, []byte) {
+	if len(v) < 8 {
+		return time.Time{}, nil
+	}
+	return time.Unix(0, int64(binary.BigEndian.Uint64(v[:8]))).UTC(), v[8:]
+}
+
+// boltTx is a Tx, and a ReadTx, over a namespace inside a bolt transaction.
+type boltTx struct {
+	store     *BoltStore
+	tx        *bolt.Tx
+	namespace string
+}
+
+func (t boltTx) Get(name string) ([]byte, error) {
+	if err := validateNamespaceAndName(t.namespace, name); err != nil {
+		return nil, err
+	}
+	return getTx(t.tx, t.namespace, name)
+}
+
+func (t boltTx) List() ([]string, error) {
+	return listTx(t.tx, t.namespace)
+}
+
+func (t boltTx) Store(name string, content []byte) error {
+	if err := validateNamespaceAndName(t.namespace, name); err != nil {
+		return err
+	}
+	return t.store.storeTx(t.tx, t.namespace, name, content)
+}
+
+func (t boltTx) Delete(name string) error {
+	if err := validateNamespaceAndName(t.namespace, name); err != nil {
+		return err
+	}
+	return deleteTx(t.tx, t.namespace, name)
+}
+
+func (t boltTx) Trash(_ Author, name string) (TrashItem, error) {
+	if err := validateNamespaceAndName(t.namespace, name); err != nil {
+		return TrashItem{}, err
+	}
+	return trashTx(t.tx, t.namespace, name)
+}
+
+// Update implements Transactional with a single bolt transaction.
+func (b *BoltStore) Update(namespace string, fn func(tx Tx) error) error {
+	if err := validateName(namespace); err != nil {
+		return err
+	}
+
+	return b.db.Update(func(tx *bolt.Tx) error {
+		return fn(boltTx{store: b, tx: tx, namespace: namespace})
+	})
+}
+
+// View implements Viewer with a read-only bolt transaction.
+func (b *BoltStore) View(namespace string, fn func(tx ReadTx) error) error {
+	if err := validateName(namespace); err != nil {
+		return err
+	}
+
+	return b.db.View(func(tx *bolt.Tx) error {
+		return fn(boltTx{store: b, tx: tx, namespace: namespace})
+	})
+}
+
+// Trash implements Trasher in a single bolt transaction.
+func (b *BoltStore) Trash(_ Author, namespace, name string) (TrashItem, error) {
+	if err := validateNamespaceAndName(namespace, name); err != nil {
+		return TrashItem{}, err
+	}
+
+	var item TrashItem
+	err := b.db.Update(func(tx *bolt.Tx) error {
+		var err error
+		item, err = trashTx(tx, namespace, name)
+		return err
+	})
+	return item, err
+}
+
+// trashTx moves a config with its metadata record to the trash in tx.
+func trashTx(tx *bolt.Tx, namespace, name string) (TrashItem, error) {
+	content, err := getTx(tx, namespace, name)
+	if err != nil {
+		return TrashItem{}, err
+	}
+	var md *Metadata
+	if metadata := tx.Bucket(bucketMetadata).Bucket([]byte(namespace)); metadata != nil {
+		if data := metadata.Get([]byte(name)); data != nil {
+			md = &Metadata{}
+			if err := json.Unmarshal(data, md); err != nil {
+				return TrashItem{}, err
+			}
+		}
+	}
+	rec, err := newTrashRecord(name, content, md)
+	if err != nil {
+		return TrashItem{}, err
+	}
+	if err := deleteTx(tx, namespace, name); err != nil {
+		return TrashItem{}, err
+	}
+	data, err := json.Marshal(rec)
+	if err != nil {
+		return TrashItem{}, err
+	}
+	trash, err := tx.Bucket(bucketTrash).CreateBucketIfNotExists([]byte(namespace))
+	if err != nil {
+		return TrashItem{}, err
+	}
+	return rec.TrashItem, trash.Put([]byte(rec.ID), data)
+}
+
+// TrashItems implements Trasher.
+func (b *BoltStore) TrashItems(namespace string) ([]TrashItem, error) {
+	if err := validateName(namespace); err != nil {
+		return nil, err
+	}
+
+	items := []TrashItem{}
+	err := b.db.View(func(tx *bolt.Tx) error {
+		trash := tx.Bucket(bucketTrash).Bucket([]byte(namespace))
+		if trash == nil {
+			return nil
+		}
+		return trash.ForEach(func(_, v []byte) error {
+			var rec trashRecord
+			if err := json.Unmarshal(v, &rec); err != nil {
+				return err
+			}
+			items = append(items, rec.TrashItem)
+			return nil
+		})
+	})
+	sortTrash(items)
+	return items, err
+}
+
+// trashRecordTx reads a trash item in tx.
+func trashRecordTx(tx *bolt.Tx, namespace, id string) (trashRecord, error) {
+	var data []byte
+	if trash := tx.Bucket(bucketTrash).Bucket([]byte(namespace)); trash != nil {
+		data = trash.Get([]byte(id))
+	}
+	if data == nil {
+		return trashRecord{}, errTrashItemNotFound(namespace, id)
+	}
+	var rec trashRecord
+	err := json.Unmarshal(data, &rec)
+	return rec, err
+}
+
+// purgeTx deletes a trash item in tx, and the namespace's trash bucket
+// with its last item.
+func purgeTx(tx *bolt.Tx, namespace, id string) error {
+	trash := tx.Bucket(bucketTrash).Bucket([]byte(namespace))
+	if trash == nil || trash.Get([]byte(id)) == nil {
+		return errTrashItemNotFound(namespace, id)
+	}
+	if err := trash.Delete([]byte(id)); err != nil {
+		return err
+	}
+	if k, _ := trash.Cursor().First(); k == nil {
+		return tx.Bucket(bucketTrash).DeleteBucket([]byte(namespace))
+	}
+	return nil
+}
+
+// Restore implements Trasher in a single bolt transaction.
+func (b *BoltStore) Restore(_ Author, namespace, id string, opts RestoreOptions) (TrashItem, error) {
+	if err := validateNamespaceAndName(namespace, id); err != nil {
+		return TrashItem{}, err
+	}
+
+	var item TrashItem
+	err := b.db.Update(func(tx *bolt.Tx) error {
+		rec, err := trashRecordTx(tx, namespace, id)
+		if err != nil {
+			return err
+		}
+		name := opts.restoreTarget(rec.TrashItem)
+		if err := validateName(name); err != nil {
+			return err
+		}
+		if _, err := getTx(tx, namespace, name); err == nil && !opts.Overwrite {
+			return errConfigExists(namespace, name)
+		}
+		content, err := opts.restoreContent(rec.TrashItem, rec.Content)
+		if err != nil {
+			return err
+		}
+		if err := b.storeTx(tx, namespace, name, content); err != nil {
+			return err
+		}
+		metadata, err := tx.Bucket(bucketMetadata).CreateBucketIfNotExists([]byte(namespace))
+		if err != nil {
+			return err
+		}
+		if rec.Metadata != nil {
+			data, err := json.Marshal(rec.Metadata)
+			if err != nil {
+				return err
+			}
+			err = metadata.Put([]byte(name), data)
+		} else {
+			err = metadata.Delete([]byte(name))
+		}
+		if err != nil {
+			return err
+		}
+		item = restoredItem(rec.TrashItem, name)
+		return purgeTx(tx, namespace, id)
+	})
+	return item, err
+}
+
+// Purge implements Trasher.
+func (b *BoltStore) Purge(namespace, id string) error {
+	if err := validateNamespaceAndName(namespace, id); err != nil {
+		return err
+	}
+
+	return b.db.Update(func(tx *bolt.Tx) error {
+		return purgeTx(tx, namespace, id)
+	})
+}
+
+// PurgeTrash implements Trasher in a single bolt transaction.
+func (b *BoltStore) PurgeTrash(cutoff time.Time) (int, error) {
+	purged := 0
+	err := b.db.Update(func(tx *bolt.Tx) error {
+		var expired [][2]string
+		err := tx.Bucket(bucketTrash).ForEachBucket(func(namespace []byte) error {
+			return tx.Bucket(bucketTrash).Bucket(namespace).ForEach(func(id, _ []byte) error {
+				if deleted, ok := trashDeleted(string(id)); ok && deleted.Before(cutoff) {
+					expired = append(expired, [2]string{string(namespace), string(id)})
+				}
+				return nil
+			})
+		})
+		if err != nil {
+			return err
+		}
+		// Buckets must not change while they are iterated.
+		for _, e := range expired {
+			if err := purgeTx(tx, e[0], e[1]); err != nil {
+				return err
+			}
+			purged++
+		}
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+	return purged, nil
+}
+
+// RewriteTrash implements Trasher.
+func (b *BoltStore) RewriteTrash(namespace, id string, fn func([]byte) ([]byte, error)) error {
+	if err := validateNamespaceAndName(namespace, id); err != nil {
+		return err
+	}
+
+	return b.db.Update(func(tx *bolt.Tx) error {
+		rec, err := trashRecordTx(tx, namespace, id)
+		if err != nil {
+			return err
+		}
+		if rec.Content, err = fn(rec.Content); err != nil {
+			return err
+		}
+		data, err := json.Marshal(rec)
+		if err != nil {
+			return err
+		}
+		return tx.Bucket(bucketTrash).Bucket([]byte(namespace)).Put([]byte(id), data)
+	})
+}
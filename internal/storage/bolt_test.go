@@ -0,0 +1,215 @@
+package storage
+
+import (
+	"bytes"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func newTestBoltStore(t *testing.T) (*BoltStore, string) {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "db", "yamlet.db")
+	store, err := NewBoltStore(path)
+	if err != nil {
+		t.Fatalf("NewBoltStore: %v", err)
+	}
+	t.Cleanup(func() { store.Close() })
+	return store, path
+}
+
+func TestBoltStore(t *testing.T) {
+	store, path := newTestBoltStore(t)
+
+	if err := store.Store("dev", "b.yaml", []byte("b: 1")); err != nil {
+		t.Fatalf("Store: %v", err)
+	}
+	if err := store.Store("dev", "a.yaml", []byte("a: 1")); err != nil {
+		t.Fatalf("Store: %v", err)
+	}
+	if err := store.Store("prod", "a.yaml", []byte("a: 2")); err != nil {
+		t.Fatalf("Store: %v", err)
+	}
+
+	got, err := store.Get("dev", "a.yaml")
+	if err != nil || string(got) != "a: 1" {
+		t.Fatalf("Get = %q, %v", got, err)
+	}
+	names, err := store.List("dev")
+	if err != nil || len(names) != 2 || names[0] != "a.yaml" || names[1] != "b.yaml" {
+		t.Fatalf("List = %v, %v", names, err)
+	}
+	if names, _ := store.List("missing"); len(names) != 0 {
+		t.Fatalf("List of missing namespace = %v", names)
+	}
+	namespaces, err := store.Namespaces()
+	if err != nil || len(namespaces) != 2 || namespaces[0] != "dev" || namespaces[1] != "prod" {
+		t.Fatalf("Namespaces = %v, %v", namespaces, err)
+	}
+
+	if err := store.Delete("prod", "a.yaml"); err != nil {
+		t.Fatalf("Delete: %v", err)
+	}
+	if _, err := store.Get("prod", "a.yaml"); !errors.Is(err, ErrNotFound) {
+		t.Fatalf("Get after Delete should be ErrNotFound, got %v", err)
+	}
+	if err := store.Delete("prod", "a.yaml"); !errors.Is(err, ErrNotFound) {
+		t.Fatalf("second Delete should be ErrNotFound, got %v", err)
+	}
+	if namespaces, _ := store.Namespaces(); len(namespaces) != 1 {
+		t.Fatalf("empty namespace should be removed: %v", namespaces)
+	}
+
+	if err := store.Store("../x", "a.yaml", []byte("x")); !errors.Is(err, ErrInvalidName) {
+		t.Fatalf("expected ErrInvalidName, got %v", err)
+	}
+
+	// Data survives reopening the file.
+	if err := store.Close(); err != nil {
+		t.Fatalf("Close: %v", err)
+	}
+	reopened, err := NewBoltStore(path)
+	if err != nil {
+		t.Fatalf("reopen: %v", err)
+	}
+	defer reopened.Close()
+	if got, err := reopened.Get("dev", "b.yaml"); err != nil || string(got) != "b: 1" {
+		t.Fatalf("Get after reopen = %q, %v", got, err)
+	}
+}
+
+func TestBoltStoreRevisions(t *testing.T) {
+	store, _ := newTestBoltStore(t)
+	testRevisions(t, store)
+}
+
+func TestBoltStorePruneRevisions(t *testing.T) {
+	store, _ := newTestBoltStore(t)
+	testPruneRevisions(t, store)
+}
+
+func TestBoltStoreQuery(t *testing.T) {
+	store, _ := newTestBoltStore(t)
+	testQuery(t, store)
+}
+
+func TestBoltStoreMetadata(t *testing.T) {
+	store, _ := newTestBoltStore(t)
+	testMetadata(t, store)
+}
+
+func TestBoltStoreNamespaces(t *testing.T) {
+	store, _ := newTestBoltStore(t)
+	testNamespaces(t, store)
+}
+
+func TestBoltStoreTrash(t *testing.T) {
+	store, _ := newTestBoltStore(t)
+	testTrash(t, store)
+
+	store, _ = newTestBoltStore(t)
+	testTrashInTransactions(t, store)
+}
+
+func TestBoltStoreRevisionRetention(t *testing.T) {
+	store, _ := newTestBoltStore(t)
+	store.maxRevisions = 2
+	for i := 0; i < 5; i++ {
+		if err := store.Store("dev", "app.yaml", []byte{byte('a' + i)}); err != nil {
+			t.Fatalf("Store: %v", err)
+		}
+	}
+	revs, err := store.Revisions("dev", "app.yaml")
+	if err != nil || len(revs) != 2 || revs[0].Number != 4 || revs[1].Number != 5 {
+		t.Fatalf("expected revisions 4 and 5, got %+v, %v", revs, err)
+	}
+}
+
+func TestBoltStoreRewrite(t *testing.T) {
+	store, _ := newTestBoltStore(t)
+	store.Store("dev", "app.yaml", []byte("v: 1"))
+	store.Store("dev", "app.yaml", []byte("v: 2"))
+
+	err := store.Rewrite("dev", "app.yaml", func(b []byte) ([]byte, error) {
+		return append([]byte("# x\n"), b...), nil
+	})
+	if err != nil {
+		t.Fatalf("Rewrite: %v", err)
+	}
+	if got, _ := store.Get("dev", "app.yaml"); string(got) != "# x\nv: 2" {
+		t.Fatalf("current content not rewritten: %q", got)
+	}
+	if got, _ := store.GetRevision("dev", "app.yaml", 1); string(got) != "# x\nv: 1" {
+		t.Fatalf("revision not rewritten: %q", got)
+	}
+	if revs, _ := store.Revisions("dev", "app.yaml"); len(revs) != 2 {
+		t.Fatalf("Rewrite must not add revisions: %+v", revs)
+	}
+
+	// A failing rewrite leaves everything as it was.
+	boom := errors.New("boom")
+	calls := 0
+	err = store.Rewrite("dev", "app.yaml", func(b []byte) ([]byte, error) {
+		if calls++; calls > 1 {
+			return nil, boom
+		}
+		return []byte("changed"), nil
+	})
+	if !errors.Is(err, boom) {
+		t.Fatalf("expected rewrite error, got %v", err)
+	}
+	if got, _ := store.Get("dev", "app.yaml"); string(got) != "# x\nv: 2" {
+		t.Fatalf("failed rewrite must be rolled back: %q", got)
+	}
+}
+
+func TestBoltStoreSnapshot(t *testing.T) {
+	store, _ := newTestBoltStore(t)
+	store.Store("dev", "app.yaml", []byte("v: 1"))
+
+	var buf bytes.Buffer
+	n, err := store.WriteSnapshot(&buf)
+	if err != nil || n != int64(buf.Len()) || n == 0 {
+		t.Fatalf("WriteSnapshot = %d, %v (buffered %d)", n, err, buf.Len())
+	}
+
+	// Writes after the snapshot are not part of it.
+	store.Store("dev", "app.yaml", []byte("v: 2"))
+
+	path := filepath.Join(t.TempDir(), "snapshot.db")
+	if err := os.WriteFile(path, buf.Bytes(), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	restored, err := NewBoltStore(path)
+	if err != nil {
+		t.Fatalf("open snapshot: %v", err)
+	}
+	defer restored.Close()
+	if got, err := restored.Get("dev", "app.yaml"); err != nil || string(got) != "v: 1" {
+		t.Fatalf("snapshot content = %q, %v", got, err)
+	}
+	if revs, _ := restored.Revisions("dev", "app.yaml"); len(revs) != 1 {
+		t.Fatalf("snapshot should carry history: %+v", revs)
+	}
+}
+
+func TestBoltStoreTransactions(t *testing.T) {
+	store, _ := newTestBoltStore(t)
+	testTransactions(t, store)
+}
+
+func TestBoltStoreViews(t *testing.T) {
+	store, _ := newTestBoltStore(t)
+	testViews(t, store)
+}
+
+func TestBoltStoreReaper(t *testing.T) {
+	store, _ := newTestBoltStore(t)
+	testReaper(t, store)
+}
+
+func TestBoltStoreExport(t *testing.T) {
+	store, _ := newTestBoltStore(t)
+	testExport(t, store)
+}
@@ -0,0 +1,471 @@
+package storage
+
+import (
+	"bytes"
+	"container/list"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+	"time"
+)
+
+// cacheEntryOverhead approximates the memory an entry takes beyond its key
+// and content, so that many tiny or negative entries still count.
+const cacheEntryOverhead = 128
+
+// CacheOptions configures a CachingStore.
+type CacheOptions struct {
+	// MaxBytes bounds the memory held by cached entries. The least
+	// recently used entries are evicted to stay under it.
+	MaxBytes int64
+	// TTL is how long a config is served from the cache before it is read
+	// again. It bounds how stale a config changed elsewhere can be when no
+	// change events arrive; zero keeps entries until they are evicted or
+	// invalidated.
+	TTL time.Duration
+	// NegativeTTL is how long a config found missing is remembered as
+	// missing. Zero disables negative caching.
+	NegativeTTL time.Duration
+}
+
+// CacheStats reports how a CachingStore is doing.
+type CacheStats struct {
+	Hits uint64 `json:"hits"`
+	// NegativeHits counts the hits that answered "not found".
+	NegativeHits uint64 `json:"negative_hits"`
+	Misses       uint64 `json:"misses"`
+	// Evictions counts entries dropped to stay under the memory bound.
+	Evictions uint64 `json:"evictions"`
+	// Invalidations counts changes that dropped entries, local writes and
+	// change events alike.
+	Invalidations uint64 `json:"invalidations"`
+	Entries       int    `json:"entries"`
+	Bytes         int64  `json:"bytes"`
+	MaxBytes      int64  `json:"max_bytes"`
+}
+
+// CachingStore serves Get from memory in front of another store, which pays
+// off with remote backends. Writes through the cache invalidate the config
+// they change; changes made by other replicas are dropped through
+// Invalidate, typically fed by the backend's Watcher, or otherwise expire
+// after the TTL. Only current content is cached: revisions, listings and
+// everything else go to the wrapped store, whose optional interfaces are
+// passed through.
+type CachingStore struct {
+	inner Store
+	opts  CacheOptions
+	now   func() time.Time
+
+	mu      sync.Mutex
+	entries map[cacheKey]*list.Element
+	lru     *list.List // of *cacheEntry, most recently used first
+	bytes   int64
+	// generation increases with every invalidation, so that a read racing
+	// with a write cannot cache what the write replaced.
+	generation uint64
+	stats      CacheStats
+}
+
+type cacheKey struct {
+	namespace, name string
+}
+
+type cacheEntry struct {
+	key     cacheKey
+	content []byte
+	err     error // the ErrNotFound of a negative entry
+	expires time.Time
+	size    int64
+}
+
+// NewCachingStore wraps inner with a read-through cache.
+func NewCachingStore(inner Store, opts CacheOptions) *CachingStore {
+	return &CachingStore{
+		inner:   inner,
+		opts:    opts,
+		now:     time.Now,
+		entries: make(map[cacheKey]*list.Element),
+		lru:     list.New(),
+	}
+}
+
+func (c *CachingStore) Store(namespace, name string, content []byte) error {
+	err := c.inner.Store(namespace, name, content)
+	c.Invalidate(namespace, name)
+	return err
+}
+
+// StoreAs implements Attributed, passing the author on when the wrapped
+// store records authors.
+func (c *CachingStore) StoreAs(author Author, namespace, name string, content []byte) error {
+	attributed, ok := c.inner.(Attributed)
+	if !ok {
+		return c.Store(namespace, name, content)
+	}
+	err := attributed.StoreAs(author, namespace, name, content)
+	c.Invalidate(namespace, name)
+	return err
+}
+
+func (c *CachingStore) Get(namespace, name string) ([]byte, error) {
+	key := cacheKey{namespace, name}
+
+	c.mu.Lock()
+	if el, ok := c.entries[key]; ok {
+		e := el.Value.(*cacheEntry)
+		if e.expires.IsZero() || c.now().Before(e.expires) {
+			c.lru.MoveToFront(el)
+			c.stats.Hits++
+			if e.err != nil {
+				c.stats.NegativeHits++
+				c.mu.Unlock()
+				return nil, e.err
+			}
+			content := bytes.Clone(e.content)
+			c.mu.Unlock()
+			return content, nil
+		}
+		c.removeLocked(el)
+	}
+	c.stats.Misses++
+	generation := c.generation
+	c.mu.Unlock()
+
+	content, err := c.inner.Get(namespace, name)
+	switch {
+	case err == nil:
+		c.add(generation, &cacheEntry{key: key, content: bytes.Clone(content)}, c.opts.TTL)
+	case errors.Is(err, ErrNotFound) && c.opts.NegativeTTL > 0:
+		c.add(generation, &cacheEntry{key: key, err: err}, c.opts.NegativeTTL)
+	}
+	return content, err
+}
+
+func (c *CachingStore) Delete(namespace, name string) error {
+	err := c.inner.Delete(namespace, name)
+	c.Invalidate(namespace, name)
+	return err
+}
+
+// DeleteAs implements Attributed.
+func (c *CachingStore) DeleteAs(author Author, namespace, name string) error {
+	attributed, ok := c.inner.(Attributed)
+	if !ok {
+		return c.Delete(namespace, name)
+	}
+	err := attributed.DeleteAs(author, namespace, name)
+	c.Invalidate(namespace, name)
+	return err
+}
+
+func (c *CachingStore) List(namespace string) ([]string, error) {
+	return c.inner.List(namespace)
+}
+
+// Query implements Querier, passing the listing to the wrapped store.
+func (c *CachingStore) Query(namespace string, opts ListOptions) (ListPage, error) {
+	return Query(c.inner, namespace, opts)
+}
+
+// Revisions implements Versioned when the wrapped store does.
+func (c *CachingStore) Revisions(namespace, name string) ([]Revision, error) {
+	versioned, ok := c.inner.(Versioned)
+	if !ok {
+		return nil, fmt.Errorf("revision history: %w", ErrUnsupported)
+	}
+	return versioned.Revisions(namespace, name)
+}
+
+// GetRevision implements Versioned when the wrapped store does.
+func (c *CachingStore) GetRevision(namespace, name string, revision int) ([]byte, error) {
+	versioned, ok := c.inner.(Versioned)
+	if !ok {
+		return nil, fmt.Errorf("revision history: %w", ErrUnsupported)
+	}
+	return versioned.GetRevision(namespace, name, revision)
+}
+
+// PruneRevisions implements Pruner when the wrapped store does.
+func (c *CachingStore) PruneRevisions(namespace, name string, keep int) error {
+	pruner, ok := c.inner.(Pruner)
+	if !ok {
+		return fmt.Errorf("revision pruning: %w", ErrUnsupported)
+	}
+	return pruner.PruneRevisions(namespace, name, keep)
+}
+
+// Rewrite implements Rewriter when the wrapped store does.
+func (c *CachingStore) Rewrite(namespace, name string, fn func([]byte) ([]byte, error)) error {
+	rewriter, ok := c.inner.(Rewriter)
+	if !ok {
+		return fmt.Errorf("in-place rewrites: %w", ErrUnsupported)
+	}
+	err := rewriter.Rewrite(namespace, name, fn)
+	c.Invalidate(namespace, name)
+	return err
+}
+
+// Update implements Transactional when the wrapped store does.
+func (c *CachingStore) Update(namespace string, fn func(tx Tx) error) error {
+	transactional, ok := c.inner.(Transactional)
+	if !ok {
+		return fmt.Errorf("transactions: %w", ErrUnsupported)
+	}
+	var written []string
+	err := transactional.Update(namespace, func(tx Tx) error {
+		return fn(cachingTx{Tx: tx, written: &written})
+	})
+	for _, name := range written {
+		c.Invalidate(namespace, name)
+	}
+	return err
+}
+
+// View implements Viewer when the wrapped store does. Views read the
+// wrapped store, not the cache, which may hold entries of different ages.
+func (c *CachingStore) View(namespace string, fn func(tx ReadTx) error) error {
+	viewer, ok := c.inner.(Viewer)
+	if !ok {
+		return fmt.Errorf("snapshot reads: %w", ErrUnsupported)
+	}
+	return viewer.View(namespace, fn)
+}
+
+// Trash implements Trasher when the wrapped store does.
+func (c *CachingStore) Trash(author Author, namespace, name string) (TrashItem, error) {
+	trasher, ok := c.inner.(Trasher)
+	if !ok {
+		return TrashItem{}, fmt.Errorf("trash: %w", ErrUnsupported)
+	}
+	item, err := trasher.Trash(author, namespace, name)
+	c.Invalidate(namespace, name)
+	return item, err
+}
+
+// TrashItems implements Trasher when the wrapped store does.
+func (c *CachingStore) TrashItems(namespace string) ([]TrashItem, error) {
+	trasher, ok := c.inner.(Trasher)
+	if !ok {
+		return nil, fmt.Errorf("trash: %w", ErrUnsupported)
+	}
+	return trasher.TrashItems(namespace)
+}
+
+// Restore implements Trasher when the wrapped store does.
+func (c *CachingStore) Restore(author Author, namespace, id string, opts RestoreOptions) (TrashItem, error) {
+	trasher, ok := c.inner.(Trasher)
+	if !ok {
+		return TrashItem{}, fmt.Errorf("trash: %w", ErrUnsupported)
+	}
+	item, err := trasher.Restore(author, namespace, id, opts)
+	if err == nil {
+		c.Invalidate(namespace, item.Name)
+	} else if opts.Name != "" {
+		c.Invalidate(namespace, opts.Name)
+	}
+	return item, err
+}
+
+// Purge implements Trasher when the wrapped store does.
+func (c *CachingStore) Purge(namespace, id string) error {
+	trasher, ok := c.inner.(Trasher)
+	if !ok {
+		return fmt.Errorf("trash: %w", ErrUnsupported)
+	}
+	return trasher.Purge(namespace, id)
+}
+
+// PurgeTrash implements Trasher when the wrapped store does.
+func (c *CachingStore) PurgeTrash(cutoff time.Time) (int, error) {
+	trasher, ok := c.inner.(Trasher)
+	if !ok {
+		return 0, fmt.Errorf("trash: %w", ErrUnsupported)
+	}
+	return trasher.PurgeTrash(cutoff)
+}
+
+// RewriteTrash implements Trasher when the wrapped store does.
+func (c *CachingStore) RewriteTrash(namespace, id string, fn func([]byte) ([]byte, error)) error {
+	trasher, ok := c.inner.(Trasher)
+	if !ok {
+		return fmt.Errorf("trash: %w", ErrUnsupported)
+	}
+	return trasher.RewriteTrash(namespace, id, fn)
+}
+
+// cachingTx records the names a transaction writes, so that they can be
+// invalidated once it is done.
+type cachingTx struct {
+	Tx
+	written *[]string
+}
+
+func (t cachingTx) Store(name string, content []byte) error {
+	*t.written = append(*t.written, name)
+	return t.Tx.Store(name, content)
+}
+
+func (t cachingTx) Delete(name string) error {
+	*t.written = append(*t.written, name)
+	return t.Tx.Delete(name)
+}
+
+func (t cachingTx) Trash(author Author, name string) (TrashItem, error) {
+	trasher, ok := t.Tx.(TrashTx)
+	if !ok {
+		return TrashItem{}, fmt.Errorf("trash: %w", ErrUnsupported)
+	}
+	*t.written = append(*t.written, name)
+	return trasher.Trash(author, name)
+}
+
+// Namespaces implements NamespaceLister when the wrapped store does.
+func (c *CachingStore) Namespaces() ([]string, error) {
+	lister, ok := c.inner.(NamespaceLister)
+	if !ok {
+		return nil, fmt.Errorf("namespace listing: %w", ErrUnsupported)
+	}
+	return lister.Namespaces()
+}
+
+// NamespaceInfo implements NamespaceStore when the wrapped store does.
+func (c *CachingStore) NamespaceInfo(namespace string) (NamespaceInfo, error) {
+	namespaces, ok := c.inner.(NamespaceStore)
+	if !ok {
+		return NamespaceInfo{}, fmt.Errorf("namespace records: %w", ErrUnsupported)
+	}
+	return namespaces.NamespaceInfo(namespace)
+}
+
+// SetNamespaceInfo implements NamespaceStore when the wrapped store does.
+func (c *CachingStore) SetNamespaceInfo(info NamespaceInfo) error {
+	namespaces, ok := c.inner.(NamespaceStore)
+	if !ok {
+		return fmt.Errorf("namespace records: %w", ErrUnsupported)
+	}
+	return namespaces.SetNamespaceInfo(info)
+}
+
+// DeleteNamespace implements NamespaceStore when the wrapped store does,
+// dropping what is cached for the namespace.
+func (c *CachingStore) DeleteNamespace(namespace string) error {
+	namespaces, ok := c.inner.(NamespaceStore)
+	if !ok {
+		return fmt.Errorf("namespace records: %w", ErrUnsupported)
+	}
+	err := namespaces.DeleteNamespace(namespace)
+	c.Invalidate(namespace, "")
+	return err
+}
+
+// Usage implements NamespaceStore when the wrapped store does.
+func (c *CachingStore) Usage(namespace string) (NamespaceUsage, error) {
+	namespaces, ok := c.inner.(NamespaceStore)
+	if !ok {
+		return NamespaceUsage{}, fmt.Errorf("namespace records: %w", ErrUnsupported)
+	}
+	return namespaces.Usage(namespace)
+}
+
+// Metadata implements MetadataStore when the wrapped store does.
+func (c *CachingStore) Metadata(namespace, name string) (Metadata, error) {
+	metadata, ok := c.inner.(MetadataStore)
+	if !ok {
+		return Metadata{}, fmt.Errorf("metadata: %w", ErrUnsupported)
+	}
+	return metadata.Metadata(namespace, name)
+}
+
+// SetMetadata implements MetadataStore when the wrapped store does.
+func (c *CachingStore) SetMetadata(namespace, name string, md Metadata) error {
+	metadata, ok := c.inner.(MetadataStore)
+	if !ok {
+		return fmt.Errorf("metadata: %w", ErrUnsupported)
+	}
+	return metadata.SetMetadata(namespace, name, md)
+}
+
+// WriteSnapshot implements Snapshotter when the wrapped store does.
+func (c *CachingStore) WriteSnapshot(w io.Writer) (int64, error) {
+	snapshotter, ok := c.inner.(Snapshotter)
+	if !ok {
+		return 0, fmt.Errorf("snapshots: %w", ErrUnsupported)
+	}
+	return snapshotter.WriteSnapshot(w)
+}
+
+// Invalidate drops what is cached for a config changed elsewhere. An empty
+// name drops the whole namespace and an empty namespace drops everything.
+// It has the signature Watcher.Watch expects.
+func (c *CachingStore) Invalidate(namespace, name string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.generation++
+	c.stats.Invalidations++
+	switch {
+	case namespace == "":
+		c.entries = make(map[cacheKey]*list.Element)
+		c.lru.Init()
+		c.bytes = 0
+	case name == "":
+		for el := c.lru.Front(); el != nil; {
+			next := el.Next()
+			if el.Value.(*cacheEntry).key.namespace == namespace {
+				c.removeLocked(el)
+			}
+			el = next
+		}
+	default:
+		if el, ok := c.entries[cacheKey{namespace, name}]; ok {
+			c.removeLocked(el)
+		}
+	}
+}
+
+// Stats returns the cache's counters and current size.
+func (c *CachingStore) Stats() CacheStats {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	stats := c.stats
+	stats.Entries = c.lru.Len()
+	stats.Bytes = c.bytes
+	stats.MaxBytes = c.opts.MaxBytes
+	return stats
+}
+
+// add caches e unless an invalidation happened since the read that produced
+// it began, then evicts down to the memory bound.
+func (c *CachingStore) add(generation uint64, e *cacheEntry, ttl time.Duration) {
+	e.size = int64(len(e.key.namespace)+len(e.key.name)+len(e.content)) + cacheEntryOverhead
+	if e.size > c.opts.MaxBytes {
+		return
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if generation != c.generation {
+		return
+	}
+	if ttl > 0 {
+		e.expires = c.now().Add(ttl)
+	}
+	if el, ok := c.entries[e.key]; ok {
+		c.removeLocked(el)
+	}
+	c.entries[e.key] = c.lru.PushFront(e)
+	c.bytes += e.size
+	for c.bytes > c.opts.MaxBytes {
+		c.removeLocked(c.lru.Back())
+		c.stats.Evictions++
+	}
+}
+
+func (c *CachingStore) removeLocked(el *list.Element) {
+	e := c.lru.Remove(el).(*cacheEntry)
+	delete(c.entries, e.key)
+	c.bytes -= e.size
+}
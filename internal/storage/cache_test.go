@@ -0,0 +1,235 @@
+package storage
+
+import (
+	"errors"
+	"sync"
+	"testing"
+	"time"
+)
+
+// countingStore counts the reads that reach a MemoryStore.
+type countingStore struct {
+	*MemoryStore
+	mu   sync.Mutex
+	gets int
+}
+
+func (s *countingStore) Get(namespace, name string) ([]byte, error) {
+	s.mu.Lock()
+	s.gets++
+	s.mu.Unlock()
+	return s.MemoryStore.Get(namespace, name)
+}
+
+func (s *countingStore) reads() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.gets
+}
+
+func newTestCachingStore(opts CacheOptions) (*CachingStore, *countingStore, *time.Time) {
+	inner := &countingStore{MemoryStore: NewMemoryStore()}
+	c := NewCachingStore(inner, opts)
+	now := time.Unix(1000, 0)
+	c.now = func() time.Time { return now }
+	return c, inner, &now
+}
+
+func TestCachingStore(t *testing.T) {
+	c, inner, now := newTestCachingStore(CacheOptions{MaxBytes: 1 << 20, TTL: time.Minute})
+	c.Store("dev", "app.yaml", []byte("v: 1"))
+
+	for i := 0; i < 3; i++ {
+		got, err := c.Get("dev", "app.yaml")
+		if err != nil || string(got) != "v: 1" {
+			t.Fatalf("Get = %q, %v", got, err)
+		}
+	}
+	if inner.reads() != 1 {
+		t.Fatalf("expected one backend read, got %d", inner.reads())
+	}
+
+	// Callers may modify what they get without touching the cache.
+	got, _ := c.Get("dev", "app.yaml")
+	got[0] = 'x'
+	if got, _ := c.Get("dev", "app.yaml"); string(got) != "v: 1" {
+		t.Fatalf("cached content was modified: %q", got)
+	}
+
+	// Writes through the cache invalidate.
+	c.Store("dev", "app.yaml", []byte("v: 2"))
+	if got, _ := c.Get("dev", "app.yaml"); string(got) != "v: 2" {
+		t.Fatalf("Get after Store = %q", got)
+	}
+	c.Delete("dev", "app.yaml")
+	if _, err := c.Get("dev", "app.yaml"); !errors.Is(err, ErrNotFound) {
+		t.Fatalf("Get after Delete should be ErrNotFound, got %v", err)
+	}
+
+	// Entries expire after the TTL.
+	c.Store("dev", "app.yaml", []byte("v: 3"))
+	c.Get("dev", "app.yaml")
+	reads := inner.reads()
+	*now = now.Add(2 * time.Minute)
+	c.Get("dev", "app.yaml")
+	if inner.reads() != reads+1 {
+		t.Fatal("expired entry should be read again")
+	}
+
+	stats := c.Stats()
+	if stats.Hits != 4 || stats.Misses != 5 || stats.Entries != 1 || stats.Bytes == 0 {
+		t.Fatalf("unexpected stats: %+v", stats)
+	}
+}
+
+func TestCachingStoreNegative(t *testing.T) {
+	c, inner, now := newTestCachingStore(CacheOptions{MaxBytes: 1 << 20, TTL: time.Minute, NegativeTTL: time.Second})
+
+	for i := 0; i < 3; i++ {
+		if _, err := c.Get("dev", "missing.yaml"); !errors.Is(err, ErrNotFound) {
+			t.Fatalf("expected ErrNotFound, got %v", err)
+		}
+	}
+	if inner.reads() != 1 {
+		t.Fatalf("missing config should be read once, got %d reads", inner.reads())
+	}
+	if stats := c.Stats(); stats.NegativeHits != 2 {
+		t.Fatalf("expected 2 negative hits, got %+v", stats)
+	}
+
+	*now = now.Add(2 * time.Second)
+	c.Get("dev", "missing.yaml")
+	if inner.reads() != 2 {
+		t.Fatal("negative entry should expire after NegativeTTL")
+	}
+
+	// Creating the config replaces the negative entry.
+	c.Store("dev", "missing.yaml", []byte("v: 1"))
+	if got, err := c.Get("dev", "missing.yaml"); err != nil || string(got) != "v: 1" {
+		t.Fatalf("Get after Store = %q, %v", got, err)
+	}
+
+	// Invalid names are not cached.
+	c.Get("dev", "../x")
+	c.Get("dev", "../x")
+	if stats := c.Stats(); stats.Entries != 1 {
+		t.Fatalf("invalid names should not be cached: %+v", stats)
+	}
+
+	// Without a NegativeTTL, misses are not remembered.
+	c, inner, _ = newTestCachingStore(CacheOptions{MaxBytes: 1 << 20})
+	c.Get("dev", "missing.yaml")
+	c.Get("dev", "missing.yaml")
+	if inner.reads() != 2 {
+		t.Fatalf("negative caching should be off, got %d reads", inner.reads())
+	}
+}
+
+func TestCachingStoreEviction(t *testing.T) {
+	size := int64(len("dev")+len("a.yaml")+100) + cacheEntryOverhead
+	c, inner, _ := newTestCachingStore(CacheOptions{MaxBytes: 2 * size})
+	content := make([]byte, 100)
+	for _, name := range []string{"a.yaml", "b.yaml", "c.yaml"} {
+		c.Store("dev", name, content)
+	}
+
+	c.Get("dev", "a.yaml")
+	c.Get("dev", "b.yaml")
+	c.Get("dev", "a.yaml") // b is now least recently used
+	c.Get("dev", "c.yaml")
+
+	stats := c.Stats()
+	if stats.Entries != 2 || stats.Bytes != 2*size || stats.Evictions != 1 {
+		t.Fatalf("unexpected stats: %+v", stats)
+	}
+	reads := inner.reads()
+	c.Get("dev", "a.yaml")
+	if inner.reads() != reads {
+		t.Fatal("recently used entry should have stayed cached")
+	}
+	c.Get("dev", "b.yaml")
+	if inner.reads() != reads+1 {
+		t.Fatal("least recently used entry should have been evicted")
+	}
+
+	// Entries larger than the whole cache are not cached.
+	c.Store("dev", "big.yaml", make([]byte, 4*size))
+	c.Get("dev", "big.yaml")
+	if stats := c.Stats(); stats.Bytes > stats.MaxBytes {
+		t.Fatalf("cache exceeds its bound: %+v", stats)
+	}
+}
+
+func TestCachingStoreInvalidate(t *testing.T) {
+	c, inner, _ := newTestCachingStore(CacheOptions{MaxBytes: 1 << 20})
+	for _, key := range [][2]string{{"dev", "a.yaml"}, {"dev", "b.yaml"}, {"prod", "a.yaml"}} {
+		c.Store(key[0], key[1], []byte("v"))
+		c.Get(key[0], key[1])
+	}
+
+	// Another replica changes the backend behind the cache's back.
+	inner.MemoryStore.Store("dev", "a.yaml", []byte("changed"))
+	if got, _ := c.Get("dev", "a.yaml"); string(got) != "v" {
+		t.Fatalf("expected the cached content, got %q", got)
+	}
+	c.Invalidate("dev", "a.yaml")
+	if got, _ := c.Get("dev", "a.yaml"); string(got) != "changed" {
+		t.Fatalf("Get after Invalidate = %q", got)
+	}
+
+	c.Invalidate("dev", "")
+	if stats := c.Stats(); stats.Entries != 1 {
+		t.Fatalf("namespace should be dropped: %+v", stats)
+	}
+	c.Invalidate("", "")
+	if stats := c.Stats(); stats.Entries != 0 || stats.Bytes != 0 {
+		t.Fatalf("everything should be dropped: %+v", stats)
+	}
+}
+
+// blockingStore holds Get until released, to race a read with a write.
+type blockingStore struct {
+	*MemoryStore
+	reading, release chan struct{}
+}
+
+func (s *blockingStore) Get(namespace, name string) ([]byte, error) {
+	content, err := s.MemoryStore.Get(namespace, name)
+	s.reading <- struct{}{}
+	<-s.release
+	return content, err
+}
+
+func TestCachingStoreReadRacingWrite(t *testing.T) {
+	inner := &blockingStore{MemoryStore: NewMemoryStore(), reading: make(chan struct{}), release: make(chan struct{})}
+	inner.MemoryStore.Store("dev", "app.yaml", []byte("old"))
+	c := NewCachingStore(inner, CacheOptions{MaxBytes: 1 << 20})
+
+	done := make(chan struct{})
+	go func() {
+		c.Get("dev", "app.yaml")
+		close(done)
+	}()
+	<-inner.reading
+	// The write lands after the read fetched the old content.
+	c.Store("dev", "app.yaml", []byte("new"))
+	close(inner.release)
+	<-done
+
+	go func() { <-inner.reading }()
+	if got, _ := c.Get("dev", "app.yaml"); string(got) != "new" {
+		t.Fatalf("stale content was cached: %q", got)
+	}
+}
+
+func TestCachingStorePassesThrough(t *testing.T) {
+	c, _, _ := newTestCachingStore(CacheOptions{MaxBytes: 1 << 20})
+	testRevisions(t, c)
+
+	if _, err := c.Namespaces(); err != nil {
+		t.Fatalf("Namespaces: %v", err)
+	}
+	if _, err := c.WriteSnapshot(nil); !errors.Is(err, ErrUnsupported) {
+		t.Fatalf("expected ErrUnsupported, got %v", err)
+	}
+}
@@ -0,0 +1,1118 @@
+package storage
+
+import (
+	"bufio"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Encryption errors.
+var (
+	// ErrInvalidMasterKey is returned for malformed master key material.
+	ErrInvalidMasterKey = errors.New("invalid master key")
+	// ErrKeyUnavailable is returned when data was encrypted under a key
+	// that is no longer known, e.g. a master key version that was removed
+	// before rotating away from it.
+	ErrKeyUnavailable = errors.New("encryption key unavailable")
+	// ErrDecrypt is returned when stored data fails authentication.
+	ErrDecrypt = errors.New("stored data failed to decrypt")
+)
+
+// masterKeySize is the size of master and data keys (AES-256).
+const masterKeySize = 32
+
+// MasterKeys holds the versioned master keys that wrap EncryptedStore's
+// data keys. The highest version wraps new data keys; older versions are
+// kept so that data keys wrapped before a rotation can still be unwrapped.
+type MasterKeys struct {
+	keys    map[int][]byte
+	current int
+}
+
+// ParseMasterKeys parses master keys separated by newlines or commas. Each
+// entry is "<version>:<base64 key>" or "<version> <base64 key>"; a single
+// bare base64 key is version 1. Blank lines and lines starting with # are
+// ignored.
+func ParseMasterKeys(s string) (*MasterKeys, error) {
+	m := &MasterKeys{keys: make(map[int][]byte)}
+	scanner := bufio.NewScanner(strings.NewReader(strings.ReplaceAll(s, ",", "\n")))
+	for scanner.Scan() {
+		entry := strings.TrimSpace(scanner.Text())
+		if entry == "" || strings.HasPrefix(entry, "#") {
+			continue
+		}
+		fields := strings.FieldsFunc(entry, func(r rune) bool { return r == ' ' || r == '\t' || r == ':' })
+		version, encoded := 1, fields[0]
+		if len(fields) == 2 {
+			v, err := strconv.Atoi(fields[0])
+			if err != nil || v < 1 {
+				return nil, fmt.Errorf("%w: version %q", ErrInvalidMasterKey, fields[0])
+			}
+			version, encoded = v, fields[1]
+		} else if len(fields) != 1 {
+			return nil, fmt.Errorf("%w: want \"<version>:<base64 key>\"", ErrInvalidMasterKey)
+		}
+		key, err := base64.StdEncoding.DecodeString(encoded)
+		if err != nil || len(key) != masterKeySize {
+			return nil, fmt.Errorf("%w: version %d must be %d base64-encoded bytes", ErrInvalidMasterKey, version, masterKeySize)
+		}
+		if _, dup := m.keys[version]; dup {
+			return nil, fmt.Errorf("%w: duplicate version %d", ErrInvalidMasterKey, version)
+		}
+		m.keys[version] = key
+		if version > m.current {
+			m.current = version
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	if len(m.keys) == 0 {
+		return nil, fmt.Errorf("%w: no keys", ErrInvalidMasterKey)
+	}
+	return m, nil
+}
+
+// LoadMasterKeyFile reads master keys from a file in ParseMasterKeys
+// format, one key per line.
+func LoadMasterKeyFile(path string) (*MasterKeys, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read master key file %s: %w", path, err)
+	}
+	return ParseMasterKeys(string(data))
+}
+
+// Current returns the version of the master key that wraps new data keys.
+func (m *MasterKeys) Current() int {
+	return m.current
+}
+
+// Rotator is implemented by stores that encrypt data at rest and can move it
+// to new keys while serving requests.
+type Rotator interface {
+	Rotate() (RotationResult, error)
+}
+
+// RotationResult summarizes a key rotation.
+type RotationResult struct {
+	// MasterVersion is the master key version that now wraps every data key.
+	MasterVersion int `json:"master_version"`
+	Namespaces    int `json:"namespaces"`
+	// Configs counts the configs re-encrypted, revisions and items in the
+	// trash included.
+	Configs int `json:"configs"`
+}
+
+// EncryptedStore encrypts configs with AES-256-GCM before handing them to
+// another store. Each namespace has its own data key, which is wrapped by
+// the current master key and kept in a key table next to the data.
+// Stored bytes record the data key version they were sealed with, and are
+// bound to their namespace and name so they cannot be swapped between
+// configs. Content that is not encrypted is rejected in namespaces that
+// have a data key, so plaintext slipped into the backend is never served;
+// see AllowPlaintext for migrating data written before encryption was
+// enabled.
+type EncryptedStore struct {
+	inner          Store
+	master         *MasterKeys
+	table          KeyTable
+	allowPlaintext bool
+
+	// switchMu is held for reading across every read and write, and for
+	// writing while a rotation switches namespaces to new data keys or
+	// retires the old ones, so no write seals data under a retiring key and
+	// no read is left holding bytes it can no longer open.
+	switchMu sync.RWMutex
+	// rotateMu serializes rotations.
+	rotateMu sync.Mutex
+
+	mu   sync.RWMutex
+	keys map[string]*namespaceKeys
+	// tableRevision is the revision of the key table keys was loaded from
+	// or last saved as.
+	tableRevision string
+}
+
+// namespaceKeys is a namespace's entry in the key table.
+type namespaceKeys struct {
+	Current int          `json:"current"`
+	Keys    []wrappedKey `json:"keys"`
+	// Sealed records that a rotation re-encrypted everything in the
+	// namespace, after which plaintext is rejected even while allowed.
+	Sealed bool `json:"sealed,omitempty"`
+
+	plain map[int][]byte // version -> unwrapped data key
+}
+
+// wrappedKey is one data key version, encrypted under a master key.
+type wrappedKey struct {
+	Version       int       `json:"version"`
+	MasterVersion int       `json:"master_version"`
+	Data          []byte    `json:"data"`
+	Created       time.Time `json:"created"`
+}
+
+// keyTable is the stored form of the data keys.
+type keyTable struct {
+	Namespaces map[string]*namespaceKeys `json:"namespaces"`
+}
+
+// keyTableAttempts bounds how often a change to the key table is applied
+// again after losing a race with another process.
+const keyTableAttempts = 10
+
+// NewEncryptedStore wraps inner with encryption at rest. The key table is
+// kept in table, which must survive as long as the data does and be shared
+// by every process using the data; a nil table keeps data keys in memory
+// only, which suits MemoryStore.
+func NewEncryptedStore(inner Store, master *MasterKeys, table KeyTable) (*EncryptedStore, error) {
+	s := &EncryptedStore{
+		inner:  inner,
+		master: master,
+		table:  table,
+		keys:   make(map[string]*namespaceKeys),
+	}
+	if table == nil {
+		return s, nil
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := s.loadLocked(); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// loadLocked replaces the data keys with those in the stored key table.
+// Callers must hold s.mu for writing.
+func (s *EncryptedStore) loadLocked() error {
+	data, revision, err := s.table.LoadKeyTable()
+	if err != nil {
+		return err
+	}
+	keys := make(map[string]*namespaceKeys)
+	if data != nil {
+		var table keyTable
+		if err := json.Unmarshal(data, &table); err != nil {
+			return fmt.Errorf("failed to parse key table: %w", err)
+		}
+		for namespace, nk := range table.Namespaces {
+			nk.plain = make(map[int][]byte, len(nk.Keys))
+			for _, wk := range nk.Keys {
+				dek, err := s.unwrap(namespace, wk)
+				if err != nil {
+					return err
+				}
+				nk.plain[wk.Version] = dek
+			}
+			if nk.plain[nk.Current] == nil {
+				return fmt.Errorf("%w: namespace %s has no data key version %d", ErrKeyUnavailable, namespace, nk.Current)
+			}
+			keys[namespace] = nk
+		}
+	}
+	s.keys = keys
+	s.tableRevision = revision
+	return nil
+}
+
+// refresh loads the key table again if another process changed it, so
+// that data keys it created or rotated are used here too.
+func (s *EncryptedStore) refresh() error {
+	if s.table == nil {
+		return nil
+	}
+	revision, err := s.table.KeyTableRevision()
+	if err != nil {
+		return fmt.Errorf("failed to check key table: %w", err)
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if revision == s.tableRevision {
+		return nil
+	}
+	return s.loadLocked()
+}
+
+// updateLocked applies change to the data keys and saves the key table.
+// If another process saved the table first, change is applied again to the
+// table it saved; change reports whether there was anything to save.
+// Callers must hold s.mu for writing.
+func (s *EncryptedStore) updateLocked(change func() (bool, error)) error {
+	for attempt := 0; attempt < keyTableAttempts; attempt++ {
+		before := cloneNamespaceKeys(s.keys)
+		changed, err := change()
+		if err != nil || !changed || s.table == nil {
+			if err != nil {
+				s.keys = before
+			}
+			return err
+		}
+		data, err := json.MarshalIndent(keyTable{Namespaces: s.keys}, "", "  ")
+		if err != nil {
+			s.keys = before
+			return err
+		}
+		revision, err := s.table.SaveKeyTable(data, s.tableRevision)
+		if err == nil {
+			s.tableRevision = revision
+			return nil
+		}
+		s.keys = before
+		if !errors.Is(err, ErrConflict) {
+			return fmt.Errorf("failed to save key table: %w", err)
+		}
+		if err := s.loadLocked(); err != nil {
+			return err
+		}
+	}
+	return fmt.Errorf("key table: %w", ErrConflict)
+}
+
+// cloneNamespaceKeys deep-copies data keys, so a failed change can be
+// undone.
+func cloneNamespaceKeys(keys map[string]*namespaceKeys) map[string]*namespaceKeys {
+	clone := make(map[string]*namespaceKeys, len(keys))
+	for namespace, nk := range keys {
+		c := *nk
+		c.Keys = append([]wrappedKey(nil), nk.Keys...)
+		c.plain = make(map[int][]byte, len(nk.plain))
+		for version, dek := range nk.plain {
+			c.plain[version] = dek
+		}
+		clone[namespace] = &c
+	}
+	return clone
+}
+
+// AllowPlaintext lets content that is not encrypted be read from namespaces
+// that have not been through a rotation yet, as when encryption is enabled
+// over existing data. Rotate then encrypts that content and marks each
+// namespace sealed, so plaintext is rejected there from then on. It must be
+// called before the store is used.
+func (s *EncryptedStore) AllowPlaintext() {
+	s.allowPlaintext = true
+}
+
+func (s *EncryptedStore) Store(namespace, name string, content []byte) error {
+	return s.store(namespace, name, content, s.inner.Store)
+}
+
+// StoreAs implements Attributed, passing the author on when the wrapped
+// store records authors.
+func (s *EncryptedStore) StoreAs(author Author, namespace, name string, content []byte) error {
+	attributed, ok := s.inner.(Attributed)
+	if !ok {
+		return s.Store(namespace, name, content)
+	}
+	return s.store(namespace, name, content, func(namespace, name string, sealed []byte) error {
+		return attributed.StoreAs(author, namespace, name, sealed)
+	})
+}
+
+// store seals content and writes it with write.
+func (s *EncryptedStore) store(namespace, name string, content []byte, write func(namespace, name string, sealed []byte) error) error {
+	if err := validateNamespaceAndName(namespace, name); err != nil {
+		return err
+	}
+
+	s.switchMu.RLock()
+	defer s.switchMu.RUnlock()
+
+	if err := s.prepareWrite(namespace); err != nil {
+		return err
+	}
+	version, dek, err := s.dataKey(namespace)
+	if err != nil {
+		return err
+	}
+	sealed, err := seal(dek, version, namespace, name, content)
+	if err != nil {
+		return err
+	}
+	return write(namespace, name, sealed)
+}
+
+func (s *EncryptedStore) Get(namespace, name string) ([]byte, error) {
+	s.switchMu.RLock()
+	defer s.switchMu.RUnlock()
+
+	content, err := s.inner.Get(namespace, name)
+	if err != nil {
+		return nil, err
+	}
+	return s.openCurrent(namespace, name, content)
+}
+
+func (s *EncryptedStore) Delete(namespace, name string) error {
+	return s.inner.Delete(namespace, name)
+}
+
+// DeleteAs implements Attributed.
+func (s *EncryptedStore) DeleteAs(author Author, namespace, name string) error {
+	if attributed, ok := s.inner.(Attributed); ok {
+		return attributed.DeleteAs(author, namespace, name)
+	}
+	return s.inner.Delete(namespace, name)
+}
+
+func (s *EncryptedStore) List(namespace string) ([]string, error) {
+	return s.inner.List(namespace)
+}
+
+// Query implements Querier, passing the listing to the wrapped store.
+func (s *EncryptedStore) Query(namespace string, opts ListOptions) (ListPage, error) {
+	return Query(s.inner, namespace, opts)
+}
+
+// Revisions implements Versioned when the wrapped store does. Sizes are
+// those of the stored, encrypted bytes.
+func (s *EncryptedStore) Revisions(namespace, name string) ([]Revision, error) {
+	versioned, ok := s.inner.(Versioned)
+	if !ok {
+		return nil, fmt.Errorf("revision history: %w", ErrUnsupported)
+	}
+	return versioned.Revisions(namespace, name)
+}
+
+// GetRevision implements Versioned when the wrapped store does.
+func (s *EncryptedStore) GetRevision(namespace, name string, revision int) ([]byte, error) {
+	versioned, ok := s.inner.(Versioned)
+	if !ok {
+		return nil, fmt.Errorf("revision history: %w", ErrUnsupported)
+	}
+	s.switchMu.RLock()
+	defer s.switchMu.RUnlock()
+
+	content, err := versioned.GetRevision(namespace, name, revision)
+	if err != nil {
+		return nil, err
+	}
+	return s.openCurrent(namespace, name, content)
+}
+
+// PruneRevisions implements Pruner when the wrapped store does.
+func (s *EncryptedStore) PruneRevisions(namespace, name string, keep int) error {
+	pruner, ok := s.inner.(Pruner)
+	if !ok {
+		return fmt.Errorf("revision pruning: %w", ErrUnsupported)
+	}
+	return pruner.PruneRevisions(namespace, name, keep)
+}
+
+// Update implements Transactional when the wrapped store does.
+func (s *EncryptedStore) Update(namespace string, fn func(tx Tx) error) error {
+	transactional, ok := s.inner.(Transactional)
+	if !ok {
+		return fmt.Errorf("transactions: %w", ErrUnsupported)
+	}
+	s.switchMu.RLock()
+	defer s.switchMu.RUnlock()
+
+	if err := s.prepareWrite(namespace); err != nil {
+		return err
+	}
+	return transactional.Update(namespace, func(tx Tx) error {
+		return fn(encryptedTx{Tx: tx, store: s, namespace: namespace})
+	})
+}
+
+// encryptedTx seals what a transaction writes and opens what it reads.
+// Callers hold store.switchMu for reading.
+type encryptedTx struct {
+	Tx
+	store     *EncryptedStore
+	namespace string
+}
+
+func (t encryptedTx) Get(name string) ([]byte, error) {
+	content, err := t.Tx.Get(name)
+	if err != nil {
+		return nil, err
+	}
+	return t.store.open(t.namespace, name, content)
+}
+
+func (t encryptedTx) Store(name string, content []byte) error {
+	if err := validateNamespaceAndName(t.namespace, name); err != nil {
+		return err
+	}
+	version, dek, err := t.store.dataKey(t.namespace)
+	if err != nil {
+		return err
+	}
+	sealed, err := seal(dek, version, t.namespace, name, content)
+	if err != nil {
+		return err
+	}
+	return t.Tx.Store(name, sealed)
+}
+
+// Trash moves a config to the trash as it is stored, encrypted, as Trash
+// does.
+func (t encryptedTx) Trash(author Author, name string) (TrashItem, error) {
+	trasher, ok := t.Tx.(TrashTx)
+	if !ok {
+		return TrashItem{}, fmt.Errorf("trash: %w", ErrUnsupported)
+	}
+	return trasher.Trash(author, name)
+}
+
+// View implements Viewer when the wrapped store does.
+func (s *EncryptedStore) View(namespace string, fn func(tx ReadTx) error) error {
+	viewer, ok := s.inner.(Viewer)
+	if !ok {
+		return fmt.Errorf("snapshot reads: %w", ErrUnsupported)
+	}
+	s.switchMu.RLock()
+	defer s.switchMu.RUnlock()
+
+	if err := s.refresh(); err != nil {
+		return err
+	}
+	return viewer.View(namespace, func(tx ReadTx) error {
+		return fn(encryptedView{ReadTx: tx, store: s, namespace: namespace})
+	})
+}
+
+// encryptedView opens what a view reads. Callers hold store.switchMu for
+// reading.
+type encryptedView struct {
+	ReadTx
+	store     *EncryptedStore
+	namespace string
+}
+
+func (v encryptedView) Get(name string) ([]byte, error) {
+	content, err := v.ReadTx.Get(name)
+	if err != nil {
+		return nil, err
+	}
+	return v.store.open(v.namespace, name, content)
+}
+
+// Namespaces implements NamespaceLister when the wrapped store does.
+func (s *EncryptedStore) Namespaces() ([]string, error) {
+	lister, ok := s.inner.(NamespaceLister)
+	if !ok {
+		return nil, fmt.Errorf("namespace listing: %w", ErrUnsupported)
+	}
+	return lister.Namespaces()
+}
+
+// NamespaceInfo implements NamespaceStore when the wrapped store does.
+func (s *EncryptedStore) NamespaceInfo(namespace string) (NamespaceInfo, error) {
+	namespaces, ok := s.inner.(NamespaceStore)
+	if !ok {
+		return NamespaceInfo{}, fmt.Errorf("namespace records: %w", ErrUnsupported)
+	}
+	return namespaces.NamespaceInfo(namespace)
+}
+
+// SetNamespaceInfo implements NamespaceStore when the wrapped store does.
+func (s *EncryptedStore) SetNamespaceInfo(info NamespaceInfo) error {
+	namespaces, ok := s.inner.(NamespaceStore)
+	if !ok {
+		return fmt.Errorf("namespace records: %w", ErrUnsupported)
+	}
+	return namespaces.SetNamespaceInfo(info)
+}
+
+// DeleteNamespace implements NamespaceStore when the wrapped store does.
+// The namespace's data keys are kept for the revisions left behind.
+func (s *EncryptedStore) DeleteNamespace(namespace string) error {
+	namespaces, ok := s.inner.(NamespaceStore)
+	if !ok {
+		return fmt.Errorf("namespace records: %w", ErrUnsupported)
+	}
+	return namespaces.DeleteNamespace(namespace)
+}
+
+// Usage implements NamespaceStore. Sizes are those of the stored,
+// encrypted bytes, as with StoredSize.
+func (s *EncryptedStore) Usage(namespace string) (NamespaceUsage, error) {
+	return UsageOf(s.inner, namespace)
+}
+
+// StoredSize implements Sizer: every write is sealed.
+func (s *EncryptedStore) StoredSize(size int) int {
+	return size + sealOverhead
+}
+
+// Size implements Sizer.
+func (s *EncryptedStore) Size(namespace, name string) (int, error) {
+	content, err := s.inner.Get(namespace, name)
+	return len(content), err
+}
+
+// Metadata implements MetadataStore when the wrapped store does.
+func (s *EncryptedStore) Metadata(namespace, name string) (Metadata, error) {
+	metadata, ok := s.inner.(MetadataStore)
+	if !ok {
+		return Metadata{}, fmt.Errorf("metadata: %w", ErrUnsupported)
+	}
+	return metadata.Metadata(namespace, name)
+}
+
+// SetMetadata implements MetadataStore when the wrapped store does.
+func (s *EncryptedStore) SetMetadata(namespace, name string, md Metadata) error {
+	metadata, ok := s.inner.(MetadataStore)
+	if !ok {
+		return fmt.Errorf("metadata: %w", ErrUnsupported)
+	}
+	return metadata.SetMetadata(namespace, name, md)
+}
+
+// Trash implements Trasher when the wrapped store does. Items stay
+// encrypted, bound to the config they were deleted from.
+func (s *EncryptedStore) Trash(author Author, namespace, name string) (TrashItem, error) {
+	trasher, ok := s.inner.(Trasher)
+	if !ok {
+		return TrashItem{}, fmt.Errorf("trash: %w", ErrUnsupported)
+	}
+	return trasher.Trash(author, namespace, name)
+}
+
+// TrashItems implements Trasher when the wrapped store does. Sizes are
+// those of the stored, encrypted bytes.
+func (s *EncryptedStore) TrashItems(namespace string) ([]TrashItem, error) {
+	trasher, ok := s.inner.(Trasher)
+	if !ok {
+		return nil, fmt.Errorf("trash: %w", ErrUnsupported)
+	}
+	return trasher.TrashItems(namespace)
+}
+
+// Restore implements Trasher when the wrapped store does. The item is
+// re-encrypted under the current data key and bound to the name it is
+// restored as; opts.Rewrite sees the plaintext.
+func (s *EncryptedStore) Restore(author Author, namespace, id string, opts RestoreOptions) (TrashItem, error) {
+	trasher, ok := s.inner.(Trasher)
+	if !ok {
+		return TrashItem{}, fmt.Errorf("trash: %w", ErrUnsupported)
+	}
+
+	s.switchMu.RLock()
+	defer s.switchMu.RUnlock()
+
+	if err := s.prepareWrite(namespace); err != nil {
+		return TrashItem{}, err
+	}
+	rewrite := opts.Rewrite
+	opts.Rewrite = func(item TrashItem, content []byte) ([]byte, error) {
+		plaintext, err := s.open(namespace, item.Name, content)
+		if err != nil {
+			return nil, err
+		}
+		if rewrite != nil {
+			if plaintext, err = rewrite(item, plaintext); err != nil {
+				return nil, err
+			}
+		}
+		version, dek, err := s.dataKey(namespace)
+		if err != nil {
+			return nil, err
+		}
+		return seal(dek, version, namespace, opts.restoreTarget(item), plaintext)
+	}
+	return trasher.Restore(author, namespace, id, opts)
+}
+
+// Purge implements Trasher when the wrapped store does.
+func (s *EncryptedStore) Purge(namespace, id string) error {
+	trasher, ok := s.inner.(Trasher)
+	if !ok {
+		return fmt.Errorf("trash: %w", ErrUnsupported)
+	}
+	return trasher.Purge(namespace, id)
+}
+
+// PurgeTrash implements Trasher when the wrapped store does.
+func (s *EncryptedStore) PurgeTrash(cutoff time.Time) (int, error) {
+	trasher, ok := s.inner.(Trasher)
+	if !ok {
+		return 0, fmt.Errorf("trash: %w", ErrUnsupported)
+	}
+	return trasher.PurgeTrash(cutoff)
+}
+
+// RewriteTrash implements Trasher when the wrapped store does. fn sees the
+// stored, encrypted bytes.
+func (s *EncryptedStore) RewriteTrash(namespace, id string, fn func([]byte) ([]byte, error)) error {
+	trasher, ok := s.inner.(Trasher)
+	if !ok {
+		return fmt.Errorf("trash: %w", ErrUnsupported)
+	}
+	return trasher.RewriteTrash(namespace, id, fn)
+}
+
+// WriteSnapshot implements Snapshotter when the wrapped store does. Configs
+// stay encrypted in the snapshot; the key table is not part of it.
+func (s *EncryptedStore) WriteSnapshot(w io.Writer) (int64, error) {
+	snapshotter, ok := s.inner.(Snapshotter)
+	if !ok {
+		return 0, fmt.Errorf("snapshots: %w", ErrUnsupported)
+	}
+	return snapshotter.WriteSnapshot(w)
+}
+
+// Rotate implements Rotator. Every namespace gets a new data key wrapped by
+// the current master key, every config and retained revision is re-encrypted
+// under it (plaintext left from before encryption was enabled included), and
+// the old data keys are then discarded. Reads and writes continue while it
+// runs. If re-encryption fails part way, the old keys are kept so that
+// everything stays readable, and Rotate can simply be run again. Adding a
+// new master key version and rotating retires the old master key, which can
+// then be removed from the key file.
+func (s *EncryptedStore) Rotate() (RotationResult, error) {
+	s.rotateMu.Lock()
+	defer s.rotateMu.Unlock()
+
+	rewriter, ok := s.inner.(Rewriter)
+	if !ok {
+		return RotationResult{}, fmt.Errorf("re-encryption: %w", ErrUnsupported)
+	}
+	namespaces, err := s.rotationNamespaces()
+	if err != nil {
+		return RotationResult{}, err
+	}
+
+	// Switch every namespace to a new data key. From here on writes use the
+	// new keys, so re-encrypting below leaves nothing under the old ones.
+	s.switchMu.Lock()
+	err = s.addDataKeys(namespaces)
+	s.switchMu.Unlock()
+	if err != nil {
+		return RotationResult{}, err
+	}
+
+	result := RotationResult{MasterVersion: s.master.Current(), Namespaces: len(namespaces)}
+	versions := make(map[string]int, len(namespaces))
+	for _, namespace := range namespaces {
+		names, err := s.inner.List(namespace)
+		if err != nil {
+			return result, err
+		}
+		s.mu.RLock()
+		nk := s.keys[namespace]
+		version, dek := nk.Current, nk.plain[nk.Current]
+		s.mu.RUnlock()
+		versions[namespace] = version
+		for _, name := range names {
+			err := s.reseal(rewriter, namespace, name, version, dek, false)
+			if errors.Is(err, ErrNotFound) {
+				continue // deleted meanwhile
+			}
+			if err != nil {
+				return result, err
+			}
+			result.Configs++
+		}
+		n, err := s.rotateTrash(namespace, version, dek)
+		result.Configs += n
+		if err != nil {
+			return result, err
+		}
+	}
+
+	// Other processes sharing the key table switch to the new keys with
+	// their next write. One that sealed a write under an old key just
+	// before is caught here, before the old keys go.
+	if s.table != nil {
+		for _, namespace := range namespaces {
+			if err := s.resealStale(rewriter, namespace, versions[namespace]); err != nil {
+				return result, err
+			}
+		}
+	}
+
+	s.switchMu.Lock()
+	defer s.switchMu.Unlock()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return result, s.updateLocked(func() (bool, error) {
+		for _, namespace := range namespaces {
+			nk := s.keys[namespace]
+			if nk == nil {
+				continue
+			}
+			kept := nk.Keys[:0]
+			for _, wk := range nk.Keys {
+				if wk.Version >= versions[namespace] {
+					kept = append(kept, wk)
+				} else {
+					delete(nk.plain, wk.Version)
+				}
+			}
+			nk.Keys = kept
+			nk.Sealed = true
+		}
+		return true, nil
+	})
+}
+
+// reseal re-encrypts every stored version of a config under a data key
+// version. With onlyStale, content sealed under that version or a later
+// one is left as it is.
+func (s *EncryptedStore) reseal(rewriter Rewriter, namespace, name string, version int, dek []byte, onlyStale bool) error {
+	err := rewriter.Rewrite(namespace, name, func(content []byte) ([]byte, error) {
+		if onlyStale && isSealed(content) && sealedVersion(content) >= version {
+			return content, nil
+		}
+		plaintext, err := s.unseal(namespace, name, content)
+		if err != nil {
+			return nil, err
+		}
+		return seal(dek, version, namespace, name, plaintext)
+	})
+	if err != nil && !errors.Is(err, ErrNotFound) {
+		return fmt.Errorf("re-encrypt %s/%s: %w", namespace, name, err)
+	}
+	return err
+}
+
+// resealStale re-encrypts the configs of a namespace whose content is
+// still sealed under a data key older than version.
+func (s *EncryptedStore) resealStale(rewriter Rewriter, namespace string, version int) error {
+	s.mu.RLock()
+	dek := s.keys[namespace].plain[version]
+	s.mu.RUnlock()
+	names, err := s.inner.List(namespace)
+	if err != nil {
+		return err
+	}
+	for _, name := range names {
+		content, err := s.inner.Get(namespace, name)
+		if errors.Is(err, ErrNotFound) {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		if isSealed(content) && sealedVersion(content) >= version {
+			continue
+		}
+		if err := s.reseal(rewriter, namespace, name, version, dek, true); err != nil && !errors.Is(err, ErrNotFound) {
+			return err
+		}
+	}
+	return nil
+}
+
+// rotateTrash re-encrypts the items in a namespace's trash under a data
+// key, if the wrapped store keeps a trash, and returns how many it did.
+func (s *EncryptedStore) rotateTrash(namespace string, version int, dek []byte) (int, error) {
+	trasher, ok := s.inner.(Trasher)
+	if !ok {
+		return 0, nil
+	}
+	items, err := trasher.TrashItems(namespace)
+	if err != nil {
+		return 0, err
+	}
+	rotated := 0
+	for _, item := range items {
+		err := trasher.RewriteTrash(namespace, item.ID, func(content []byte) ([]byte, error) {
+			plaintext, err := s.unseal(namespace, item.Name, content)
+			if err != nil {
+				return nil, err
+			}
+			return seal(dek, version, namespace, item.Name, plaintext)
+		})
+		if errors.Is(err, ErrNotFound) {
+			continue // restored or purged meanwhile
+		}
+		if err != nil {
+			return rotated, fmt.Errorf("re-encrypt trash item %s in namespace %s: %w", item.ID, namespace, err)
+		}
+		rotated++
+	}
+	return rotated, nil
+}
+
+// rotationNamespaces lists the namespaces with data keys together with any
+// the wrapped store knows about, which may still hold plaintext.
+func (s *EncryptedStore) rotationNamespaces() ([]string, error) {
+	seen := make(map[string]bool)
+	s.mu.RLock()
+	for namespace := range s.keys {
+		seen[namespace] = true
+	}
+	s.mu.RUnlock()
+	if lister, ok := s.inner.(NamespaceLister); ok {
+		namespaces, err := lister.Namespaces()
+		if err != nil {
+			return nil, err
+		}
+		for _, namespace := range namespaces {
+			seen[namespace] = true
+		}
+	}
+	namespaces := make([]string, 0, len(seen))
+	for namespace := range seen {
+		namespaces = append(namespaces, namespace)
+	}
+	sort.Strings(namespaces)
+	return namespaces, nil
+}
+
+// addDataKeys makes a new data key current in each namespace, keeping the
+// previous ones for reading.
+func (s *EncryptedStore) addDataKeys(namespaces []string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.updateLocked(func() (bool, error) {
+		for _, namespace := range namespaces {
+			nk := s.keys[namespace]
+			if nk == nil {
+				nk = &namespaceKeys{plain: make(map[int][]byte)}
+				s.keys[namespace] = nk
+			}
+			if err := s.newDataKeyLocked(namespace, nk); err != nil {
+				return false, err
+			}
+		}
+		return true, nil
+	})
+}
+
+// dataKey returns the current data key of a namespace, creating the first
+// one on demand. Creating one saves the key table, so inside transactions
+// of the wrapped store it may only be called for namespaces that have a
+// key; see prepareWrite.
+func (s *EncryptedStore) dataKey(namespace string) (int, []byte, error) {
+	s.mu.RLock()
+	if nk := s.keys[namespace]; nk != nil {
+		defer s.mu.RUnlock()
+		return nk.Current, nk.plain[nk.Current], nil
+	}
+	s.mu.RUnlock()
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if nk := s.keys[namespace]; nk != nil {
+		return nk.Current, nk.plain[nk.Current], nil
+	}
+	err := s.updateLocked(func() (bool, error) {
+		if s.keys[namespace] != nil {
+			return false, nil // created by another process
+		}
+		nk := &namespaceKeys{plain: make(map[int][]byte)}
+		if err := s.newDataKeyLocked(namespace, nk); err != nil {
+			return false, err
+		}
+		s.keys[namespace] = nk
+		return true, nil
+	})
+	if err != nil {
+		return 0, nil, err
+	}
+	nk := s.keys[namespace]
+	return nk.Current, nk.plain[nk.Current], nil
+}
+
+// prepareWrite brings the key table up to date and makes sure a namespace
+// has a data key, ahead of writes to it. Writes in transactions of the
+// wrapped store call it before the transaction starts, since the key table
+// may live in the same database and the transaction hold its only
+// connection.
+func (s *EncryptedStore) prepareWrite(namespace string) error {
+	if err := s.refresh(); err != nil {
+		return err
+	}
+	_, _, err := s.dataKey(namespace)
+	return err
+}
+
+// newDataKeyLocked generates the next data key version of a namespace and
+// makes it current. Callers must hold s.mu for writing.
+func (s *EncryptedStore) newDataKeyLocked(namespace string, nk *namespaceKeys) error {
+	dek := make([]byte, masterKeySize)
+	if _, err := rand.Read(dek); err != nil {
+		return fmt.Errorf("failed to generate data key: %w", err)
+	}
+	version := 1
+	if n := len(nk.Keys); n > 0 {
+		version = nk.Keys[n-1].Version + 1
+	}
+	wk := wrappedKey{Version: version, MasterVersion: s.master.Current(), Created: time.Now().UTC()}
+	gcm, err := newGCM(s.master.keys[wk.MasterVersion])
+	if err != nil {
+		return err
+	}
+	nonce := make([]byte, gcm.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return fmt.Errorf("failed to generate nonce: %w", err)
+	}
+	wk.Data = gcm.Seal(nonce, nonce, dek, wrapAAD(namespace, wk))
+	nk.Keys = append(nk.Keys, wk)
+	nk.Current = version
+	nk.plain[version] = dek
+	return nil
+}
+
+// unwrap decrypts a data key with the master key version it names.
+func (s *EncryptedStore) unwrap(namespace string, wk wrappedKey) ([]byte, error) {
+	key, ok := s.master.keys[wk.MasterVersion]
+	if !ok {
+		return nil, fmt.Errorf("%w: master key version %d (data key %d of namespace %s)",
+			ErrKeyUnavailable, wk.MasterVersion, wk.Version, namespace)
+	}
+	gcm, err := newGCM(key)
+	if err != nil {
+		return nil, err
+	}
+	if len(wk.Data) < gcm.NonceSize() {
+		return nil, fmt.Errorf("%w: data key %d of namespace %s", ErrDecrypt, wk.Version, namespace)
+	}
+	dek, err := gcm.Open(nil, wk.Data[:gcm.NonceSize()], wk.Data[gcm.NonceSize():], wrapAAD(namespace, wk))
+	if err != nil {
+		return nil, fmt.Errorf("%w: data key %d of namespace %s", ErrDecrypt, wk.Version, namespace)
+	}
+	return dek, nil
+}
+
+// wrapAAD binds a wrapped data key to its namespace and version.
+func wrapAAD(namespace string, wk wrappedKey) []byte {
+	return []byte(fmt.Sprintf("yamlet-dek\x00%s\x00%d\x00%d", namespace, wk.Version, wk.MasterVersion))
+}
+
+// openCurrent is open for reads outside transactions of the wrapped store.
+// Data keys it does not know, such as those created by another process
+// sharing the key table, are loaded first.
+func (s *EncryptedStore) openCurrent(namespace, name string, content []byte) ([]byte, error) {
+	if s.table != nil && !s.knowsKey(namespace, content) {
+		if err := s.refresh(); err != nil {
+			return nil, err
+		}
+	}
+	return s.open(namespace, name, content)
+}
+
+// knowsKey reports whether the data key stored bytes were sealed with is
+// loaded or, for content that is not encrypted, whether the namespace has
+// a data key.
+func (s *EncryptedStore) knowsKey(namespace string, content []byte) bool {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	nk := s.keys[namespace]
+	if !isSealed(content) {
+		return nk != nil
+	}
+	return nk != nil && nk.plain[sealedVersion(content)] != nil
+}
+
+// open decrypts stored bytes with the data keys loaded. Content that is not
+// encrypted is returned as is only from namespaces without a data key,
+// which cannot hold anything encrypted, or while AllowPlaintext applies to
+// the namespace.
+func (s *EncryptedStore) open(namespace, name string, content []byte) ([]byte, error) {
+	if !isSealed(content) {
+		s.mu.RLock()
+		nk := s.keys[namespace]
+		allowed := nk == nil || (s.allowPlaintext && !nk.Sealed)
+		s.mu.RUnlock()
+		if !allowed {
+			return nil, fmt.Errorf("%w: config %s in namespace %s is not encrypted", ErrDecrypt, name, namespace)
+		}
+		return content, nil
+	}
+	return s.unseal(namespace, name, content)
+}
+
+// unseal decrypts stored bytes, returning content that is not encrypted as
+// is. Only rotation, which encrypts such content, calls it directly.
+func (s *EncryptedStore) unseal(namespace, name string, content []byte) ([]byte, error) {
+	if !isSealed(content) {
+		return content, nil
+	}
+	version := sealedVersion(content)
+	s.mu.RLock()
+	var dek []byte
+	if nk := s.keys[namespace]; nk != nil {
+		dek = nk.plain[version]
+	}
+	s.mu.RUnlock()
+	if dek == nil {
+		return nil, fmt.Errorf("%w: data key %d of namespace %s", ErrKeyUnavailable, version, namespace)
+	}
+
+	gcm, err := newGCM(dek)
+	if err != nil {
+		return nil, err
+	}
+	body := content[headerSize:]
+	if len(body) < gcm.NonceSize() {
+		return nil, fmt.Errorf("%w: config %s in namespace %s", ErrDecrypt, name, namespace)
+	}
+	plaintext, err := gcm.Open(nil, body[:gcm.NonceSize()], body[gcm.NonceSize():],
+		sealAAD(content[:headerSize], namespace, name))
+	if err != nil {
+		return nil, fmt.Errorf("%w: config %s in namespace %s", ErrDecrypt, name, namespace)
+	}
+	return plaintext, nil
+}
+
+// Sealed content is sealMagic, the big-endian data key version, the nonce
+// and the ciphertext. The magic's control byte cannot start a YAML document.
+const (
+	sealMagic  = "yenc\x01"
+	headerSize = len(sealMagic) + 4
+	// sealOverhead is what sealing adds to content: the header, and the
+	// standard AES-GCM nonce and tag.
+	sealOverhead = headerSize + 12 + 16
+)
+
+func isSealed(content []byte) bool {
+	return len(content) >= headerSize && string(content[:len(sealMagic)]) == sealMagic
+}
+
+// sealedVersion returns the data key version sealed content names.
+func sealedVersion(content []byte) int {
+	return int(binary.BigEndian.Uint32(content[len(sealMagic):headerSize]))
+}
+
+// seal encrypts content for a config under a data key version.
+func seal(dek []byte, version int, namespace, name string, content []byte) ([]byte, error) {
+	gcm, err := newGCM(dek)
+	if err != nil {
+		return nil, err
+	}
+	header := make([]byte, headerSize, headerSize+gcm.NonceSize()+len(content)+gcm.Overhead())
+	copy(header, sealMagic)
+	binary.BigEndian.PutUint32(header[len(sealMagic):], uint32(version))
+	nonce := make([]byte, gcm.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, fmt.Errorf("failed to generate nonce: %w", err)
+	}
+	out := append(header, nonce...)
+	return gcm.Seal(out, nonce, content, sealAAD(header, namespace, name)), nil
+}
+
+// sealAAD binds sealed content to its header and location.
+func sealAAD(header []byte, namespace, name string) []byte {
+	aad := append([]byte(nil), header...)
+	return append(aad, namespace+"\x00"+name...)
+}
+
+func newGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidMasterKey, err)
+	}
+	return cipher.NewGCM(block)
+}
@@ -0,0 +1,194 @@
+package storage
+
+import (
+	"bytes"
+	"encoding/base64"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func testMasterKeys(t *testing.T, versions ...byte) *MasterKeys {
+	t.Helper()
+	var entries []string
+	for _, v := range versions {
+		key := base64.StdEncoding.EncodeToString(bytes.Repeat([]byte{v}, masterKeySize))
+		entries = append(entries, string('0'+rune(v))+":"+key)
+	}
+	m, err := ParseMasterKeys(strings.Join(entries, ","))
+	if err != nil {
+		t.Fatalf("ParseMasterKeys: %v", err)
+	}
+	return m
+}
+
+func TestParseMasterKeys(t *testing.T) {
+	key := base64.StdEncoding.EncodeToString(bytes.Repeat([]byte{1}, masterKeySize))
+	m, err := ParseMasterKeys(key)
+	if err != nil || m.Current() != 1 {
+		t.Fatalf("bare key should be version 1: %v", err)
+	}
+	m, err = ParseMasterKeys("# keys\n1 " + key + "\n3 " + key + "\n")
+	if err != nil || m.Current() != 3 || len(m.keys) != 2 {
+		t.Fatalf("expected versions 1 and 3 with 3 current: %v", err)
+	}
+
+	for _, bad := range []string{"", "1:" + key + ",1:" + key, "x:" + key, "1:c2hvcnQ=", "1 2 3"} {
+		if _, err := ParseMasterKeys(bad); !errors.Is(err, ErrInvalidMasterKey) {
+			t.Errorf("ParseMasterKeys(%q) = %v, want ErrInvalidMasterKey", bad, err)
+		}
+	}
+}
+
+func TestEncryptedStore(t *testing.T) {
+	dir := t.TempDir()
+	inner := NewFileStore(dir)
+	keyPath := inner.ReservedPath("keys.json")
+	s, err := NewEncryptedStore(inner, testMasterKeys(t, 1), FileKeyTable{Path: keyPath})
+	if err != nil {
+		t.Fatalf("NewEncryptedStore: %v", err)
+	}
+
+	content := []byte("password: hunter2\n")
+	if err := s.Store("dev", "app.yaml", content); err != nil {
+		t.Fatalf("Store: %v", err)
+	}
+	raw, _ := os.ReadFile(filepath.Join(dir, "dev", "app.yaml"))
+	if bytes.Contains(raw, []byte("hunter2")) || !isSealed(raw) {
+		t.Fatalf("config stored in plaintext: %q", raw)
+	}
+	got, err := s.Get("dev", "app.yaml")
+	if err != nil || string(got) != string(content) {
+		t.Fatalf("Get = %q, %v", got, err)
+	}
+	// Sizes are those of the sealed bytes, whichever way they are asked.
+	if size, err := s.Size("dev", "app.yaml"); err != nil || size != len(raw) || s.StoredSize(len(content)) != len(raw) {
+		t.Fatalf("Size = %d, %v; StoredSize = %d; want %d", size, err, s.StoredSize(len(content)), len(raw))
+	}
+	if usage, err := s.Usage("dev"); err != nil || usage.Bytes != int64(len(raw)) {
+		t.Fatalf("Usage = %+v, %v; want %d bytes", usage, err, len(raw))
+	}
+	if got, err := s.GetRevision("dev", "app.yaml", 1); err != nil || string(got) != string(content) {
+		t.Fatalf("GetRevision = %q, %v", got, err)
+	}
+
+	// Sealed bytes are bound to their config.
+	_ = os.MkdirAll(filepath.Join(dir, "dev"), 0o700)
+	_ = os.WriteFile(filepath.Join(dir, "dev", "other.yaml"), raw, 0o600)
+	if _, err := s.Get("dev", "other.yaml"); !errors.Is(err, ErrDecrypt) {
+		t.Fatalf("expected ErrDecrypt for moved ciphertext, got %v", err)
+	}
+	// So is plaintext slipped in next to it.
+	_ = os.WriteFile(filepath.Join(dir, "dev", "other.yaml"), []byte("password: injected\n"), 0o600)
+	if _, err := s.Get("dev", "other.yaml"); !errors.Is(err, ErrDecrypt) {
+		t.Fatalf("expected ErrDecrypt for plaintext in a namespace with a data key, got %v", err)
+	}
+
+	// Data keys survive a restart, and need the master key that wrapped them.
+	reopened, err := NewEncryptedStore(NewFileStore(dir), testMasterKeys(t, 1), FileKeyTable{Path: keyPath})
+	if err != nil {
+		t.Fatalf("reopen: %v", err)
+	}
+	if got, err := reopened.Get("dev", "app.yaml"); err != nil || string(got) != string(content) {
+		t.Fatalf("Get after reopen = %q, %v", got, err)
+	}
+	if _, err := NewEncryptedStore(NewFileStore(dir), testMasterKeys(t, 2), FileKeyTable{Path: keyPath}); !errors.Is(err, ErrKeyUnavailable) {
+		t.Fatalf("expected ErrKeyUnavailable without master key 1, got %v", err)
+	}
+}
+
+func TestEncryptedStoreRotate(t *testing.T) {
+	dir := t.TempDir()
+	inner := NewFileStore(dir)
+	keyPath := inner.ReservedPath("keys.json")
+
+	// A config written before encryption was enabled.
+	if err := inner.Store("legacy", "old.yaml", []byte("a: 1\n")); err != nil {
+		t.Fatal(err)
+	}
+	s, err := NewEncryptedStore(inner, testMasterKeys(t, 1), FileKeyTable{Path: keyPath})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, err := s.Get("legacy", "old.yaml"); err != nil || string(got) != "a: 1\n" {
+		t.Fatalf("plaintext should pass through before rotation: %q, %v", got, err)
+	}
+	_ = s.Store("dev", "app.yaml", []byte("v: 1\n"))
+	_ = s.Store("dev", "app.yaml", []byte("v: 2\n"))
+	// Once the namespace has a data key, the plaintext is refused unless
+	// allowed for the migration.
+	_ = s.Store("legacy", "new.yaml", []byte("b: 2\n"))
+	if _, err := s.Get("legacy", "old.yaml"); !errors.Is(err, ErrDecrypt) {
+		t.Fatalf("expected ErrDecrypt for plaintext, got %v", err)
+	}
+
+	// Rotate onto master key 2 while it is served.
+	s, err = NewEncryptedStore(inner, testMasterKeys(t, 1, 2), FileKeyTable{Path: keyPath})
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.AllowPlaintext()
+	if got, err := s.Get("legacy", "old.yaml"); err != nil || string(got) != "a: 1\n" {
+		t.Fatalf("allowed plaintext = %q, %v", got, err)
+	}
+	result, err := s.Rotate()
+	if err != nil {
+		t.Fatalf("Rotate: %v", err)
+	}
+	if result.MasterVersion != 2 || result.Namespaces != 2 || result.Configs != 3 {
+		t.Fatalf("unexpected rotation result %+v", result)
+	}
+	raw, _ := os.ReadFile(filepath.Join(dir, "legacy", "old.yaml"))
+	if !isSealed(raw) {
+		t.Fatalf("rotation should encrypt leftover plaintext")
+	}
+	// Rotated namespaces refuse plaintext even while it is allowed.
+	_ = os.WriteFile(filepath.Join(dir, "legacy", "injected.yaml"), []byte("a: 2\n"), 0o600)
+	if _, err := s.Get("legacy", "injected.yaml"); !errors.Is(err, ErrDecrypt) {
+		t.Fatalf("expected ErrDecrypt for plaintext after rotation, got %v", err)
+	}
+
+	// Master key 1 is no longer needed, and old revisions stay readable.
+	s, err = NewEncryptedStore(inner, testMasterKeys(t, 2), FileKeyTable{Path: keyPath})
+	if err != nil {
+		t.Fatalf("reopen with only master key 2: %v", err)
+	}
+	if got, err := s.GetRevision("dev", "app.yaml", 1); err != nil || string(got) != "v: 1\n" {
+		t.Fatalf("GetRevision after rotation = %q, %v", got, err)
+	}
+	if got, err := s.Get("legacy", "old.yaml"); err != nil || string(got) != "a: 1\n" {
+		t.Fatalf("Get after rotation = %q, %v", got, err)
+	}
+}
+
+func TestEncryptedStoreConcurrentRotate(t *testing.T) {
+	s, err := NewEncryptedStore(NewMemoryStore(), testMasterKeys(t, 1), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < 200; i++ {
+			if err := s.Store("dev", "app.yaml", []byte("v: x\n")); err != nil {
+				t.Errorf("Store: %v", err)
+				return
+			}
+			if _, err := s.Get("dev", "app.yaml"); err != nil {
+				t.Errorf("Get: %v", err)
+				return
+			}
+		}
+	}()
+	for i := 0; i < 5; i++ {
+		if _, err := s.Rotate(); err != nil {
+			t.Fatalf("Rotate: %v", err)
+		}
+	}
+	<-done
+	if _, err := s.Get("dev", "app.yaml"); err != nil {
+		t.Fatalf("Get after rotations: %v", err)
+	}
+}
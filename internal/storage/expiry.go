@@ -0,0 +1,195 @@
+package storage
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// ReaperAuthor is recorded for the deletions of expired configs.
+var ReaperAuthor = Author{Name: "yamlet reaper", Email: "reaper@yamlet.invalid"}
+
+// errRewritten is returned by Reaper.deleteExpired for a config that was
+// written again since it expired.
+var errRewritten = errors.New("config was written since it expired")
+
+// Expired reports whether the config a record describes has expired at now.
+func (md Metadata) Expired(now time.Time) bool {
+	return !md.Expires.IsZero() && !now.Before(md.Expires)
+}
+
+// ReaperOptions configures a Reaper.
+type ReaperOptions struct {
+	// Interval is the time between reaps.
+	Interval time.Duration
+	// OnExpire, when set, is called for every config deleted because it
+	// expired.
+	OnExpire func(namespace, name string)
+	// TrashRetention, when positive, is how long items stay in the trash
+	// of a store that keeps one before they are purged.
+	TrashRetention time.Duration
+	// OnPurge, when set, is called after a reap that purged trash items.
+	OnPurge func(purged int)
+	// OnError, when set, is called when a reap fails.
+	OnError func(err error)
+}
+
+// Reaper deletes expired configs, and purges trash items kept longer than
+// their retention period. Expired configs are deleted for good, not moved
+// to the trash. Deletions go through the store it is
+// given, so wrapping stores see them as any other: caches are invalidated,
+// replicas watching the store are told, and stores that record authors
+// attribute them to ReaperAuthor.
+type Reaper struct {
+	store Store
+	opts  ReaperOptions
+	now   func() time.Time
+}
+
+// NewReaper creates a reaper of the configs in store, which must keep
+// metadata records and list its namespaces.
+func NewReaper(store Store, opts ReaperOptions) *Reaper {
+	return &Reaper{store: store, opts: opts, now: time.Now}
+}
+
+// Reap deletes every config that has expired and returns how many it
+// deleted. Configs deleted by others meanwhile are skipped, and so are
+// configs written again since they expired.
+func (r *Reaper) Reap() (int, error) {
+	lister, ok := r.store.(NamespaceLister)
+	if !ok {
+		return 0, fmt.Errorf("namespace listing: %w", ErrUnsupported)
+	}
+	metadata, ok := r.store.(MetadataStore)
+	if !ok {
+		return 0, fmt.Errorf("metadata: %w", ErrUnsupported)
+	}
+	namespaces, err := lister.Namespaces()
+	if err != nil {
+		return 0, err
+	}
+
+	reaped := 0
+	for _, namespace := range namespaces {
+		names, err := r.store.List(namespace)
+		if err != nil {
+			return reaped, err
+		}
+		for _, name := range names {
+			md, err := metadata.Metadata(namespace, name)
+			if errors.Is(err, ErrNotFound) {
+				continue
+			}
+			if err != nil {
+				return reaped, err
+			}
+			if !md.Expired(r.now()) {
+				continue
+			}
+			if err := r.deleteExpired(metadata, namespace, name); err != nil {
+				if errors.Is(err, ErrNotFound) || errors.Is(err, errRewritten) {
+					continue
+				}
+				return reaped, err
+			}
+			reaped++
+			if r.opts.OnExpire != nil {
+				r.opts.OnExpire(namespace, name)
+			}
+		}
+	}
+	return reaped, nil
+}
+
+// PurgeTrash purges the trash items deleted more than TrashRetention ago
+// and returns how many it purged. It does nothing without a retention
+// period.
+func (r *Reaper) PurgeTrash() (int, error) {
+	if r.opts.TrashRetention <= 0 {
+		return 0, nil
+	}
+	trasher, ok := r.store.(Trasher)
+	if !ok {
+		return 0, fmt.Errorf("trash: %w", ErrUnsupported)
+	}
+	purged, err := trasher.PurgeTrash(r.now().Add(-r.opts.TrashRetention))
+	if purged > 0 && r.opts.OnPurge != nil {
+		r.opts.OnPurge(purged)
+	}
+	return purged, err
+}
+
+// deleteExpired deletes a config if it is still expired and still has the
+// content its metadata record describes. A write replaces the content
+// before its record, so a config written again since it expired is told
+// apart by its content. On stores with transactions the content is checked
+// and the config deleted in one transaction; elsewhere it is checked just
+// before the delete.
+func (r *Reaper) deleteExpired(metadata MetadataStore, namespace, name string) error {
+	md, err := metadata.Metadata(namespace, name)
+	if err != nil {
+		return err
+	}
+	if !md.Expired(r.now()) {
+		return errRewritten
+	}
+	check := func(content []byte) error {
+		if md.SHA256 != "" && sha256Hex(content) != md.SHA256 {
+			return errRewritten
+		}
+		return nil
+	}
+
+	if transactional, ok := r.store.(Transactional); ok {
+		return transactional.Update(namespace, func(tx Tx) error {
+			content, err := tx.Get(name)
+			if err != nil {
+				return err
+			}
+			if err := check(content); err != nil {
+				return err
+			}
+			return tx.Delete(name)
+		})
+	}
+	content, err := r.store.Get(namespace, name)
+	if err != nil {
+		return err
+	}
+	if err := check(content); err != nil {
+		return err
+	}
+	return r.delete(namespace, name)
+}
+
+func (r *Reaper) delete(namespace, name string) error {
+	if attributed, ok := r.store.(Attributed); ok {
+		return attributed.DeleteAs(ReaperAuthor, namespace, name)
+	}
+	return r.store.Delete(namespace, name)
+}
+
+// Start reaps and purges the trash every Interval in the background until
+// stop is called.
+func (r *Reaper) Start() (stop func()) {
+	done := make(chan struct{})
+	var once sync.Once
+	go func() {
+		ticker := time.NewTicker(r.opts.Interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+				for _, reap := range []func() (int, error){r.Reap, r.PurgeTrash} {
+					if _, err := reap(); err != nil && r.opts.OnError != nil {
+						r.opts.OnError(err)
+					}
+				}
+			}
+		}
+	}()
+	return func() { once.Do(func() { close(done) }) }
+}
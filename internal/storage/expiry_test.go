@@ -0,0 +1,149 @@
+package storage
+
+import (
+	"errors"
+	"slices"
+	"testing"
+	"time"
+)
+
+func TestMetadataExpired(t *testing.T) {
+	now := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	if (Metadata{}).Expired(now) {
+		t.Fatal("a config without an expiry should not expire")
+	}
+	if (Metadata{Expires: now.Add(time.Second)}).Expired(now) {
+		t.Fatal("a config should not expire before its expiry")
+	}
+	if !(Metadata{Expires: now}).Expired(now) {
+		t.Fatal("a config should expire at its expiry")
+	}
+}
+
+// testReaper exercises a Reaper over store.
+func testReaper(t *testing.T, store interface {
+	Store
+	MetadataStore
+}) {
+	t.Helper()
+	now := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	for _, c := range []struct {
+		namespace, name string
+		expires         time.Time
+	}{
+		{"preview-1", "app.yaml", now.Add(-time.Minute)},
+		{"preview-1", "db.yaml", now.Add(time.Hour)},
+		{"preview-2", "app.yaml", now},
+		{"dev", "app.yaml", time.Time{}},
+	} {
+		store.Store(c.namespace, c.name, []byte("v: 1"))
+		store.SetMetadata(c.namespace, c.name, Metadata{Expires: c.expires})
+	}
+	store.Store("dev", "untracked.yaml", []byte("v: 1"))
+	// Written again since it expired; its new record is not in yet.
+	store.Store("preview-3", "app.yaml", []byte("v: 2"))
+	store.SetMetadata("preview-3", "app.yaml", Metadata{Expires: now.Add(-time.Minute), SHA256: sha256Hex([]byte("v: 1"))})
+
+	var expired []string
+	reaper := NewReaper(store, ReaperOptions{OnExpire: func(namespace, name string) {
+		expired = append(expired, namespace+"/"+name)
+	}})
+	reaper.now = func() time.Time { return now }
+	reaped, err := reaper.Reap()
+	if err != nil || reaped != 2 {
+		t.Fatalf("Reap = %d, %v", reaped, err)
+	}
+	if !slices.Equal(sorted(expired), []string{"preview-1/app.yaml", "preview-2/app.yaml"}) {
+		t.Fatalf("expired = %v", expired)
+	}
+	for _, c := range [][2]string{{"preview-1", "app.yaml"}, {"preview-2", "app.yaml"}} {
+		if _, err := store.Get(c[0], c[1]); !errors.Is(err, ErrNotFound) {
+			t.Fatalf("%s/%s should be deleted, got %v", c[0], c[1], err)
+		}
+	}
+	for _, c := range [][2]string{{"preview-1", "db.yaml"}, {"dev", "app.yaml"}, {"dev", "untracked.yaml"}, {"preview-3", "app.yaml"}} {
+		if _, err := store.Get(c[0], c[1]); err != nil {
+			t.Fatalf("%s/%s should be kept, got %v", c[0], c[1], err)
+		}
+	}
+
+	if reaped, err := reaper.Reap(); err != nil || reaped != 0 {
+		t.Fatalf("second Reap = %d, %v", reaped, err)
+	}
+}
+
+func TestMemoryStoreReaper(t *testing.T) {
+	testReaper(t, NewMemoryStore())
+}
+
+func TestFileStoreReaper(t *testing.T) {
+	testReaper(t, NewFileStore(t.TempDir()))
+}
+
+func TestReaperThroughCache(t *testing.T) {
+	cache := NewCachingStore(NewMemoryStore(), CacheOptions{MaxBytes: 1 << 20})
+	testReaper(t, cache)
+
+	// The cache must not serve a config the reaper deleted.
+	cache.Store("dev", "tmp.yaml", []byte("v: 1"))
+	cache.SetMetadata("dev", "tmp.yaml", Metadata{Expires: time.Now().Add(-time.Second)})
+	cache.Get("dev", "tmp.yaml")
+	if _, err := NewReaper(cache, ReaperOptions{}).Reap(); err != nil {
+		t.Fatalf("Reap: %v", err)
+	}
+	if _, err := cache.Get("dev", "tmp.yaml"); !errors.Is(err, ErrNotFound) {
+		t.Fatalf("Get after Reap should be ErrNotFound, got %v", err)
+	}
+}
+
+func TestReaperStart(t *testing.T) {
+	store := NewMemoryStore()
+	store.Store("dev", "tmp.yaml", []byte("v: 1"))
+	store.SetMetadata("dev", "tmp.yaml", Metadata{Expires: time.Now().Add(-time.Second)})
+
+	expired := make(chan string, 1)
+	stop := NewReaper(store, ReaperOptions{Interval: time.Millisecond, OnExpire: func(namespace, name string) {
+		expired <- namespace + "/" + name
+	}}).Start()
+	defer stop()
+	select {
+	case name := <-expired:
+		if name != "dev/tmp.yaml" {
+			t.Fatalf("expired %s", name)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("the reaper did not run")
+	}
+	stop()
+	stop()
+}
+
+func TestReaperPurgeTrash(t *testing.T) {
+	store := NewMemoryStore()
+	store.Store("dev", "old.yaml", []byte("v: 1"))
+	store.Store("dev", "new.yaml", []byte("v: 1"))
+	old, _ := store.Trash(DefaultAuthor, "dev", "old.yaml")
+	store.Trash(DefaultAuthor, "dev", "new.yaml")
+
+	if purged, err := NewReaper(store, ReaperOptions{}).PurgeTrash(); err != nil || purged != 0 {
+		t.Fatalf("PurgeTrash without a retention period = %d, %v", purged, err)
+	}
+	var reported int
+	reaper := NewReaper(store, ReaperOptions{TrashRetention: time.Hour, OnPurge: func(purged int) { reported = purged }})
+	reaper.now = func() time.Time { return old.Deleted.Add(time.Hour + time.Nanosecond) }
+	if purged, err := reaper.PurgeTrash(); err != nil || purged != 1 || reported != 1 {
+		t.Fatalf("PurgeTrash = %d, %v (reported %d)", purged, err, reported)
+	}
+	if items, _ := store.TrashItems("dev"); len(items) != 1 || items[0].Name != "new.yaml" {
+		t.Fatalf("items within the retention period should be kept, got %+v", items)
+	}
+}
+
+func TestReaperUnsupported(t *testing.T) {
+	if _, err := NewReaper(plainStore{NewMemoryStore()}, ReaperOptions{}).Reap(); !errors.Is(err, ErrUnsupported) {
+		t.Fatalf("expected ErrUnsupported, got %v", err)
+	}
+	if _, err := NewReaper(plainStore{NewMemoryStore()}, ReaperOptions{TrashRetention: time.Hour}).PurgeTrash(); !errors.Is(err, ErrUnsupported) {
+		t.Fatalf("expected ErrUnsupported, got %v", err)
+	}
+}
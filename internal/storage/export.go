@@ -0,0 +1,307 @@
+package storage
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"maps"
+	"slices"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+// StoreView is a read-only view of a whole store: its namespaces, configs,
+// metadata records and revisions. Reads a store cannot serve return
+// ErrUnsupported.
+type StoreView interface {
+	Namespaces() ([]string, error)
+	NamespaceInfo(namespace string) (NamespaceInfo, error)
+	List(namespace string) ([]string, error)
+	Get(namespace, name string) ([]byte, error)
+	Metadata(namespace, name string) (Metadata, error)
+	Revisions(namespace, name string) ([]Revision, error)
+	GetRevision(namespace, name string, revision int) ([]byte, error)
+}
+
+// Exporter is implemented by stores that can read all of their data as it
+// was at a single point in time, for consistent backups.
+type Exporter interface {
+	// Export calls fn with a view of the whole store that no write changes
+	// while fn runs, and returns fn's error.
+	Export(fn func(view StoreView) error) error
+}
+
+// LiveView returns a StoreView that reads store as it is, one read at a
+// time, for stores that are not Exporters. Writes made while it is read
+// show up part way.
+func LiveView(store Store) StoreView {
+	return liveView{store}
+}
+
+type liveView struct {
+	Store
+}
+
+func (v liveView) Namespaces() ([]string, error) {
+	lister, ok := v.Store.(NamespaceLister)
+	if !ok {
+		return nil, fmt.Errorf("namespace listing: %w", ErrUnsupported)
+	}
+	return lister.Namespaces()
+}
+
+func (v liveView) NamespaceInfo(namespace string) (NamespaceInfo, error) {
+	namespaces, ok := v.Store.(NamespaceStore)
+	if !ok {
+		return NamespaceInfo{}, fmt.Errorf("namespace records: %w", ErrUnsupported)
+	}
+	return namespaces.NamespaceInfo(namespace)
+}
+
+func (v liveView) Metadata(namespace, name string) (Metadata, error) {
+	metadata, ok := v.Store.(MetadataStore)
+	if !ok {
+		return Metadata{}, fmt.Errorf("metadata: %w", ErrUnsupported)
+	}
+	return metadata.Metadata(namespace, name)
+}
+
+func (v liveView) Revisions(namespace, name string) ([]Revision, error) {
+	versioned, ok := v.Store.(Versioned)
+	if !ok {
+		return nil, fmt.Errorf("revisions: %w", ErrUnsupported)
+	}
+	return versioned.Revisions(namespace, name)
+}
+
+func (v liveView) GetRevision(namespace, name string, revision int) ([]byte, error) {
+	versioned, ok := v.Store.(Versioned)
+	if !ok {
+		return nil, fmt.Errorf("revisions: %w", ErrUnsupported)
+	}
+	return versioned.GetRevision(namespace, name, revision)
+}
+
+// Export implements Exporter. fn reads a copy of the store, so writes do not
+// wait for it. Contents are shared with the copy, as the store only ever
+// replaces them.
+func (m *MemoryStore) Export(fn func(view StoreView) error) error {
+	m.mu.RLock()
+	clone := NewMemoryStore()
+	clone.maxRevisions = m.maxRevisions
+	for namespace, configs := range m.data {
+		clone.data[namespace] = maps.Clone(configs)
+	}
+	for namespace, histories := range m.history {
+		clone.history[namespace] = make(map[string][]memoryRevision, len(histories))
+		for name, revs := range histories {
+			clone.history[namespace][name] = slices.Clone(revs)
+		}
+	}
+	for namespace, records := range m.metadata {
+		clone.metadata[namespace] = make(map[string]Metadata, len(records))
+		for name, md := range records {
+			clone.metadata[namespace][name] = cloneMetadata(md)
+		}
+	}
+	for namespace, info := range m.namespaces {
+		info.Labels = maps.Clone(info.Labels)
+		clone.namespaces[namespace] = info
+	}
+	m.mu.RUnlock()
+
+	return fn(clone)
+}
+
+// Export implements Exporter. Writes wait until fn returns.
+func (f *FileStore) Export(fn func(view StoreView) error) error {
+	unlock, err := f.readLock()
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	// The view reads the same directory through its own lock, which no
+	// writer can take while f.mu is held.
+	return fn(&FileStore{baseDir: f.baseDir, maxRevisions: f.maxRevisions})
+}
+
+// Export implements Exporter. Writes wait until fn returns.
+func (g *GitStore) Export(fn func(view StoreView) error) error {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	return fn(&GitStore{dir: g.dir, opts: g.opts})
+}
+
+// Export implements Exporter with a read-only bolt transaction, so neither
+// readers nor writers wait for fn.
+func (b *BoltStore) Export(fn func(view StoreView) error) error {
+	return b.db.View(func(tx *bolt.Tx) error {
+		return fn(boltView{store: b, tx: tx})
+	})
+}
+
+// boltView is a StoreView over a read-only transaction.
+type boltView struct {
+	store *BoltStore
+	tx    *bolt.Tx
+}
+
+func (v boltView) Namespaces() ([]string, error) {
+	return namespacesTx(v.tx)
+}
+
+func (v boltView) NamespaceInfo(namespace string) (NamespaceInfo, error) {
+	if err := validateName(namespace); err != nil {
+		return NamespaceInfo{}, err
+	}
+	return namespaceInfoTx(v.tx, namespace)
+}
+
+func (v boltView) List(namespace string) ([]string, error) {
+	if err := validateName(namespace); err != nil {
+		return nil, err
+	}
+	return listTx(v.tx, namespace)
+}
+
+func (v boltView) Get(namespace, name string) ([]byte, error) {
+	if err := validateNamespaceAndName(namespace, name); err != nil {
+		return nil, err
+	}
+	return getTx(v.tx, namespace, name)
+}
+
+func (v boltView) Metadata(namespace, name string) (Metadata, error) {
+	if err := validateNamespaceAndName(namespace, name); err != nil {
+		return Metadata{}, err
+	}
+	return metadataTx(v.tx, namespace, name)
+}
+
+func (v boltView) Revisions(namespace, name string) ([]Revision, error) {
+	if err := validateNamespaceAndName(namespace, name); err != nil {
+		return nil, err
+	}
+	return v.store.revisionsTx(v.tx, namespace, name)
+}
+
+func (v boltView) GetRevision(namespace, name string, revision int) ([]byte, error) {
+	if err := validateNamespaceAndName(namespace, name); err != nil {
+		return nil, err
+	}
+	return v.store.getRevisionTx(v.tx, namespace, name, revision)
+}
+
+// Export implements Exporter with a read-only transaction: REPEATABLE READ
+// on PostgreSQL, so neither readers nor writers wait for fn, and SQLite's
+// own, whose single connection writes wait for.
+func (s *SQLStore) Export(fn func(view StoreView) error) error {
+	tx, err := s.db.BeginTx(context.Background(), s.dialect.snapshot)
+	if err != nil {
+		return fmt.Errorf("failed to begin export: %w", err)
+	}
+	defer tx.Rollback()
+
+	return fn(sqlView{tx: tx})
+}
+
+// sqlView is a StoreView over a read-only transaction.
+type sqlView struct {
+	tx *sql.Tx
+}
+
+func (v sqlView) Namespaces() ([]string, error) {
+	return namespacesSQL(v.tx)
+}
+
+func (v sqlView) NamespaceInfo(namespace string) (NamespaceInfo, error) {
+	if err := validateName(namespace); err != nil {
+		return NamespaceInfo{}, err
+	}
+	return namespaceInfoSQL(v.tx, namespace)
+}
+
+func (v sqlView) List(namespace string) ([]string, error) {
+	if err := validateName(namespace); err != nil {
+		return nil, err
+	}
+	return listSQL(v.tx, namespace)
+}
+
+func (v sqlView) Get(namespace, name string) ([]byte, error) {
+	if err := validateNamespaceAndName(namespace, name); err != nil {
+		return nil, err
+	}
+	return getSQL(v.tx, namespace, name)
+}
+
+func (v sqlView) Metadata(namespace, name string) (Metadata, error) {
+	if err := validateNamespaceAndName(namespace, name); err != nil {
+		return Metadata{}, err
+	}
+	return readSQLMetadata(v.tx, namespace, name)
+}
+
+func (v sqlView) Revisions(namespace, name string) ([]Revision, error) {
+	if err := validateNamespaceAndName(namespace, name); err != nil {
+		return nil, err
+	}
+	return revisionsSQL(v.tx, namespace, name)
+}
+
+func (v sqlView) GetRevision(namespace, name string, revision int) ([]byte, error) {
+	if err := validateNamespaceAndName(namespace, name); err != nil {
+		return nil, err
+	}
+	return getRevisionSQL(v.tx, namespace, name, revision)
+}
+
+// Export implements Exporter when the wrapped store does. The view reads the
+// wrapped store, not the cache.
+func (c *CachingStore) Export(fn func(view StoreView) error) error {
+	exporter, ok := c.inner.(Exporter)
+	if !ok {
+		return fmt.Errorf("exports: %w", ErrUnsupported)
+	}
+	return exporter.Export(fn)
+}
+
+// Export implements Exporter when the wrapped store does. The view opens
+// what it reads, so fn sees plaintext.
+func (s *EncryptedStore) Export(fn func(view StoreView) error) error {
+	exporter, ok := s.inner.(Exporter)
+	if !ok {
+		return fmt.Errorf("exports: %w", ErrUnsupported)
+	}
+	s.switchMu.RLock()
+	defer s.switchMu.RUnlock()
+
+	return exporter.Export(func(view StoreView) error {
+		return fn(encryptedStoreView{StoreView: view, store: s})
+	})
+}
+
+// encryptedStoreView opens what a StoreView reads. Callers hold
+// store.switchMu for reading.
+type encryptedStoreView struct {
+	StoreView
+	store *EncryptedStore
+}
+
+func (v encryptedStoreView) Get(namespace, name string) ([]byte, error) {
+	content, err := v.StoreView.Get(namespace, name)
+	if err != nil {
+		return nil, err
+	}
+	return v.store.open(namespace, name, content)
+}
+
+func (v encryptedStoreView) GetRevision(namespace, name string, revision int) ([]byte, error) {
+	content, err := v.StoreView.GetRevision(namespace, name, revision)
+	if err != nil {
+		return nil, err
+	}
+	return v.store.open(namespace, name, content)
+}
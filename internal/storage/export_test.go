@@ -0,0 +1,125 @@
+package storage
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+// testExport exercises an Exporter implementation.
+func testExport(t *testing.T, store interface {
+	Store
+	MetadataStore
+	NamespaceStore
+	Exporter
+}) {
+	t.Helper()
+	store.Store("dev", "app.yaml", []byte("v: 1"))
+	store.Store("dev", "app.yaml", []byte("v: 2"))
+	store.SetMetadata("dev", "app.yaml", Metadata{Labels: map[string]string{"tier": "web"}})
+	store.Store("prod", "db.yaml", []byte("db: 1"))
+	store.SetNamespaceInfo(NamespaceInfo{Name: "empty", Owner: "ops"})
+
+	err := store.Export(func(view StoreView) error {
+		// A write made meanwhile must not show up in the view.
+		done := make(chan struct{})
+		go func() {
+			store.Store("dev", "app.yaml", []byte("v: 3"))
+			close(done)
+		}()
+		select {
+		case <-done:
+		case <-time.After(50 * time.Millisecond):
+		}
+
+		if namespaces, err := view.Namespaces(); err != nil || len(namespaces) != 3 {
+			t.Errorf("Namespaces = %v, %v", namespaces, err)
+		}
+		if info, err := view.NamespaceInfo("empty"); err != nil || info.Owner != "ops" {
+			t.Errorf("NamespaceInfo = %+v, %v", info, err)
+		}
+		if names, err := view.List("dev"); err != nil || len(names) != 1 || names[0] != "app.yaml" {
+			t.Errorf("List = %v, %v", names, err)
+		}
+		if got, err := view.Get("dev", "app.yaml"); err != nil || string(got) != "v: 2" {
+			t.Errorf("Get = %q, %v", got, err)
+		}
+		if md, err := view.Metadata("dev", "app.yaml"); err != nil || md.Labels["tier"] != "web" {
+			t.Errorf("Metadata = %+v, %v", md, err)
+		}
+		if _, err := view.Metadata("prod", "db.yaml"); !errors.Is(err, ErrNotFound) {
+			t.Errorf("Metadata of a config without a record should be ErrNotFound, got %v", err)
+		}
+		revs, err := view.Revisions("dev", "app.yaml")
+		if err != nil || len(revs) != 2 {
+			t.Fatalf("Revisions = %+v, %v", revs, err)
+		}
+		if got, err := view.GetRevision("dev", "app.yaml", revs[0].Number); err != nil || string(got) != "v: 1" {
+			t.Errorf("GetRevision = %q, %v", got, err)
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("Export: %v", err)
+	}
+
+	// The write went through once the export was done.
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		got, _ := store.Get("dev", "app.yaml")
+		if string(got) == "v: 3" {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("write made during the export was lost, got %q", got)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	errStop := errors.New("stop")
+	if err := store.Export(func(StoreView) error { return errStop }); !errors.Is(err, errStop) {
+		t.Fatalf("Export should return fn's error, got %v", err)
+	}
+}
+
+func TestMemoryStoreExport(t *testing.T) {
+	testExport(t, NewMemoryStore())
+}
+
+func TestFileStoreExport(t *testing.T) {
+	testExport(t, NewFileStore(t.TempDir()))
+}
+
+func TestExportThroughWrappers(t *testing.T) {
+	testExport(t, NewCachingStore(NewMemoryStore(), CacheOptions{MaxBytes: 1 << 20}))
+
+	store, err := NewEncryptedStore(NewMemoryStore(), testMasterKeys(t, 1), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	testExport(t, store)
+
+	if err := NewCachingStore(plainStore{NewMemoryStore()}, CacheOptions{}).Export(func(StoreView) error { return nil }); !errors.Is(err, ErrUnsupported) {
+		t.Fatalf("expected ErrUnsupported, got %v", err)
+	}
+}
+
+func TestLiveView(t *testing.T) {
+	store := NewMemoryStore()
+	store.Store("dev", "app.yaml", []byte("v: 1"))
+	view := LiveView(store)
+	if got, err := view.Get("dev", "app.yaml"); err != nil || string(got) != "v: 1" {
+		t.Fatalf("Get = %q, %v", got, err)
+	}
+	if revs, err := view.Revisions("dev", "app.yaml"); err != nil || len(revs) != 1 {
+		t.Fatalf("Revisions = %+v, %v", revs, err)
+	}
+
+	plain := LiveView(plainStore{store})
+	if _, err := plain.Revisions("dev", "app.yaml"); !errors.Is(err, ErrUnsupported) {
+		t.Fatalf("expected ErrUnsupported, got %v", err)
+	}
+	if _, err := plain.NamespaceInfo("dev"); !errors.Is(err, ErrUnsupported) {
+		t.Fatalf("expected ErrUnsupported, got %v", err)
+	}
+}
@@ -0,0 +1,729 @@
+package storage
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// gitDir is the repository metadata directory, which can therefore be
+// neither a namespace nor a config name.
+const gitDir = ".git"
+
+// GitOptions configures a GitStore.
+type GitOptions struct {
+	// Branch is the branch changes are committed to. It defaults to
+	// "main".
+	Branch string
+	// Remote is the path of a bare repository that every commit is pushed
+	// to. It is created if it does not exist.
+	Remote string
+	// OnPushError is called when a push fails. The change stays committed
+	// locally and reaches the remote with the next successful push.
+	OnPushError func(error)
+}
+
+// GitStore keeps configs as files in a git working tree, <dir>/<namespace>/
+// <name>, and commits every change with its author. The commits touching a
+// config since it was last created are its revisions. History is never
+// rewritten, so the store does not implement Rewriter. It needs the git
+// command.
+type GitStore struct {
+	dir  string
+	opts GitOptions
+
+	// mu serializes all use of the working tree and index.
+	mu sync.Mutex
+}
+
+// NewGitStore opens the repository in dir, initializing it if needed.
+// Changes left uncommitted by a crash are committed, and temporary files
+// from interrupted writes are removed.
+func NewGitStore(dir string, opts GitOptions) (*GitStore, error) {
+	if _, err := exec.LookPath("git"); err != nil {
+		return nil, fmt.Errorf("git storage needs the git command: %w", err)
+	}
+	if opts.Branch == "" {
+		opts.Branch = "main"
+	}
+	g := &GitStore{dir: dir, opts: opts}
+
+	if err := mkdirAllSync(dir); err != nil {
+		return nil, err
+	}
+	if _, err := os.Stat(filepath.Join(dir, gitDir)); os.IsNotExist(err) {
+		if _, err := g.git("init", "-q", "--initial-branch="+opts.Branch); err != nil {
+			return nil, err
+		}
+	}
+	if opts.Remote != "" {
+		// git runs in dir, so a relative remote must not be taken from there.
+		remote, err := filepath.Abs(opts.Remote)
+		if err != nil {
+			return nil, err
+		}
+		opts.Remote = remote
+		g.opts.Remote = remote
+		if _, err := os.Stat(opts.Remote); os.IsNotExist(err) {
+			if _, err := g.git("init", "-q", "--bare", "--initial-branch="+opts.Branch, opts.Remote); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	if err := g.recover(); err != nil {
+		return nil, err
+	}
+	return g, nil
+}
+
+// recover removes temporary files and commits whatever else a crash left
+// uncommitted.
+func (g *GitStore) recover() error {
+	err := filepath.WalkDir(g.dir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if d.IsDir() && d.Name() == gitDir {
+			return filepath.SkipDir
+		}
+		if !d.IsDir() && isTempFile(d.Name()) {
+			if err := removeFileSync(path); err != nil {
+				return fmt.Errorf("failed to remove temporary file %s: %w", path, err)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	if _, err := g.git("add", "-A"); err != nil {
+		return err
+	}
+	return g.commit(DefaultAuthor, "Recover changes interrupted by a restart")
+}
+
+func (g *GitStore) resolvePath(namespace, name string) (string, error) {
+	if err := validateNamespaceAndName(namespace, name); err != nil {
+		return "", err
+	}
+	for _, s := range []string{namespace, name} {
+		if s == gitDir {
+			return "", fmt.Errorf("%w: %q is reserved", ErrInvalidName, s)
+		}
+	}
+	if isTempFile(name) {
+		return "", fmt.Errorf("%w: %q is reserved for temporary files", ErrInvalidName, name)
+	}
+	return namespace + "/" + name, nil
+}
+
+func (g *GitStore) Store(namespace, name string, content []byte) error {
+	return g.StoreAs(DefaultAuthor, namespace, name, content)
+}
+
+// StoreAs implements Attributed. Storing the content a config already has
+// records no commit.
+func (g *GitStore) StoreAs(author Author, namespace, name string, content []byte) error {
+	rel, err := g.resolvePath(namespace, name)
+	if err != nil {
+		return err
+	}
+
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	path := filepath.Join(g.dir, filepath.FromSlash(rel))
+	verb := "Update"
+	if _, err := os.Stat(path); os.IsNotExist(err) {
+		verb = "Create"
+	}
+	if err := writeFileAtomic(path, content); err != nil {
+		return err
+	}
+	if _, err := g.git("add", "--", rel); err != nil {
+		return err
+	}
+	return g.commit(author, verb+" "+rel)
+}
+
+func (g *GitStore) Get(namespace, name string) ([]byte, error) {
+	rel, err := g.resolvePath(namespace, name)
+	if err != nil {
+		return nil, err
+	}
+
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	content, err := os.ReadFile(filepath.Join(g.dir, filepath.FromSlash(rel)))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, fmt.Errorf("config %s in namespace %s: %w", name, namespace, ErrNotFound)
+		}
+		return nil, fmt.Errorf("failed to read config %s in namespace %s: %w", name, namespace, err)
+	}
+	return content, nil
+}
+
+func (g *GitStore) Delete(namespace, name string) error {
+	return g.DeleteAs(DefaultAuthor, namespace, name)
+}
+
+// DeleteAs implements Attributed. The config's commits stay in the git
+// history, but its revisions start over if it is created again.
+func (g *GitStore) DeleteAs(author Author, namespace, name string) error {
+	rel, err := g.resolvePath(namespace, name)
+	if err != nil {
+		return err
+	}
+
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	if _, err := os.Stat(filepath.Join(g.dir, filepath.FromSlash(rel))); os.IsNotExist(err) {
+		return fmt.Errorf("config %s in namespace %s: %w", name, namespace, ErrNotFound)
+	}
+	if _, err := g.git("rm", "-q", "--", rel); err != nil {
+		return err
+	}
+	if err := removeFileSync(g.metadataPath(rel)); err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("failed to delete metadata of config %s in namespace %s: %w", name, namespace, err)
+	}
+	return g.commit(author, "Delete "+rel)
+}
+
+func (g *GitStore) List(namespace string) ([]string, error) {
+	if err := validateName(namespace); err != nil {
+		return nil, err
+	}
+	if namespace == gitDir {
+		return nil, fmt.Errorf("%w: %q is reserved", ErrInvalidName, namespace)
+	}
+
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	entries, err := os.ReadDir(filepath.Join(g.dir, namespace))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return []string{}, nil
+		}
+		return nil, fmt.Errorf("failed to list namespace %s: %w", namespace, err)
+	}
+	configs := make([]string, 0, len(entries))
+	for _, entry := range entries {
+		if !entry.IsDir() && !isTempFile(entry.Name()) {
+			configs = append(configs, entry.Name())
+		}
+	}
+	return configs, nil
+}
+
+// Query implements Querier. Metadata is only read for the names that pass
+// the other filters.
+func (g *GitStore) Query(namespace string, opts ListOptions) (ListPage, error) {
+	if err := opts.Validate(); err != nil {
+		return ListPage{}, err
+	}
+	names, err := g.List(namespace)
+	if err != nil {
+		return ListPage{}, err
+	}
+	sortNames(names, opts.Descending)
+
+	p := newPager(opts)
+	for _, name := range names {
+		more, err := p.add(name, func() (map[string]string, error) {
+			return labelsOf(g.Metadata(namespace, name))
+		})
+		if err != nil {
+			return ListPage{}, err
+		}
+		if !more {
+			break
+		}
+	}
+	return p.page, nil
+}
+
+// Namespaces implements NamespaceLister.
+func (g *GitStore) Namespaces() ([]string, error) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	entries, err := os.ReadDir(g.dir)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list namespaces: %w", err)
+	}
+	namespaces := make([]string, 0, len(entries))
+	for _, entry := range entries {
+		if entry.IsDir() && entry.Name() != gitDir {
+			namespaces = append(namespaces, entry.Name())
+		}
+	}
+	records, err := readNamespaceDir(g.namespacePath(""))
+	if err != nil {
+		return nil, err
+	}
+	return mergeNames(namespaces, records), nil
+}
+
+// namespacePath returns the file holding the record of a namespace. Like
+// metadata, records are kept inside .git and not committed.
+func (g *GitStore) namespacePath(namespace string) string {
+	return filepath.Join(g.dir, gitDir, "yamlet", "namespaces", namespace)
+}
+
+func validateGitNamespace(namespace string) error {
+	if err := validateName(namespace); err != nil {
+		return err
+	}
+	if namespace == gitDir {
+		return fmt.Errorf("%w: %q is reserved", ErrInvalidName, namespace)
+	}
+	return nil
+}
+
+// NamespaceInfo implements NamespaceStore.
+func (g *GitStore) NamespaceInfo(namespace string) (NamespaceInfo, error) {
+	if err := validateGitNamespace(namespace); err != nil {
+		return NamespaceInfo{}, err
+	}
+
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	return readNamespaceFile(g.namespacePath(namespace), namespace)
+}
+
+// SetNamespaceInfo implements NamespaceStore.
+func (g *GitStore) SetNamespaceInfo(info NamespaceInfo) error {
+	if err := validateGitNamespace(info.Name); err != nil {
+		return err
+	}
+	if err := ValidateNamespaceInfo(info); err != nil {
+		return err
+	}
+
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	return writeNamespaceFile(g.namespacePath(info.Name), info)
+}
+
+// DeleteNamespace implements NamespaceStore. The configs are removed in a
+// single commit.
+func (g *GitStore) DeleteNamespace(namespace string) error {
+	if err := validateGitNamespace(namespace); err != nil {
+		return err
+	}
+
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	dir := filepath.Join(g.dir, namespace)
+	_, dirErr := os.Stat(dir)
+	_, recordErr := os.Stat(g.namespacePath(namespace))
+	_, trashErr := os.Stat(g.trashPath(namespace, ""))
+	if os.IsNotExist(dirErr) && os.IsNotExist(recordErr) && os.IsNotExist(trashErr) {
+		return fmt.Errorf("namespace %s: %w", namespace, ErrNotFound)
+	}
+	if dirErr == nil {
+		if _, err := g.git("rm", "-r", "-q", "--ignore-unmatch", "--", namespace); err != nil {
+			return err
+		}
+		if err := os.RemoveAll(dir); err != nil {
+			return fmt.Errorf("failed to delete namespace %s: %w", namespace, err)
+		}
+	}
+	if err := os.RemoveAll(g.metadataPath(namespace)); err != nil {
+		return fmt.Errorf("failed to delete metadata of namespace %s: %w", namespace, err)
+	}
+	if err := os.RemoveAll(g.trashPath(namespace, "")); err != nil {
+		return fmt.Errorf("failed to delete trash of namespace %s: %w", namespace, err)
+	}
+	if err := removeFileSync(g.namespacePath(namespace)); err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("failed to delete namespace %s: %w", namespace, err)
+	}
+	return g.commit(DefaultAuthor, "Delete namespace "+namespace)
+}
+
+// Usage implements NamespaceStore.
+func (g *GitStore) Usage(namespace string) (NamespaceUsage, error) {
+	if err := validateGitNamespace(namespace); err != nil {
+		return NamespaceUsage{}, err
+	}
+
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	usage, err := dirUsage(filepath.Join(g.dir, namespace))
+	if err != nil {
+		return NamespaceUsage{}, fmt.Errorf("failed to read namespace %s: %w", namespace, err)
+	}
+	return usage, nil
+}
+
+// metadataPath returns the file holding the metadata of a config. Metadata
+// is kept inside .git, so it is neither committed nor pushed; the commits
+// already record who changed what.
+func (g *GitStore) metadataPath(rel string) string {
+	return filepath.Join(g.dir, gitDir, "yamlet", "metadata", filepath.FromSlash(rel))
+}
+
+// Metadata implements MetadataStore.
+func (g *GitStore) Metadata(namespace, name string) (Metadata, error) {
+	rel, err := g.resolvePath(namespace, name)
+	if err != nil {
+		return Metadata{}, err
+	}
+
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	return readMetadataFile(g.metadataPath(rel), namespace, name)
+}
+
+// SetMetadata implements MetadataStore.
+func (g *GitStore) SetMetadata(namespace, name string, md Metadata) error {
+	rel, err := g.resolvePath(namespace, name)
+	if err != nil {
+		return err
+	}
+
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	if _, err := os.Stat(filepath.Join(g.dir, filepath.FromSlash(rel))); os.IsNotExist(err) {
+		return fmt.Errorf("config %s in namespace %s: %w", name, namespace, ErrNotFound)
+	}
+	return writeMetadataFile(g.metadataPath(rel), md)
+}
+
+// trashPath returns the file holding a trash item, or for an empty id the
+// directory of a namespace's trash. Like metadata, the trash is kept inside
+// .git and not committed; the commits removing and restoring configs
+// record who did so.
+func (g *GitStore) trashPath(namespace, id string) string {
+	return filepath.Join(g.dir, gitDir, "yamlet", "trash", namespace, id)
+}
+
+// Trash implements Trasher, committing the removal of the config like
+// DeleteAs.
+func (g *GitStore) Trash(author Author, namespace, name string) (TrashItem, error) {
+	rel, err := g.resolvePath(namespace, name)
+	if err != nil {
+		return TrashItem{}, err
+	}
+
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	content, err := os.ReadFile(filepath.Join(g.dir, filepath.FromSlash(rel)))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return TrashItem{}, fmt.Errorf("config %s in namespace %s: %w", name, namespace, ErrNotFound)
+		}
+		return TrashItem{}, fmt.Errorf("failed to read config %s in namespace %s: %w", name, namespace, err)
+	}
+	var md *Metadata
+	if record, err := readMetadataFile(g.metadataPath(rel), namespace, name); err == nil {
+		md = &record
+	} else if !errors.Is(err, ErrNotFound) {
+		return TrashItem{}, err
+	}
+	rec, err := newTrashRecord(name, content, md)
+	if err != nil {
+		return TrashItem{}, err
+	}
+	if err := writeTrashFile(g.trashPath(namespace, rec.ID), rec); err != nil {
+		return TrashItem{}, err
+	}
+	if _, err := g.git("rm", "-q", "--", rel); err != nil {
+		return TrashItem{}, err
+	}
+	if err := removeFileSync(g.metadataPath(rel)); err != nil && !os.IsNotExist(err) {
+		return TrashItem{}, fmt.Errorf("failed to delete metadata of config %s in namespace %s: %w", name, namespace, err)
+	}
+	return rec.TrashItem, g.commit(author, "Trash "+rel)
+}
+
+// TrashItems implements Trasher.
+func (g *GitStore) TrashItems(namespace string) ([]TrashItem, error) {
+	if err := validateGitNamespace(namespace); err != nil {
+		return nil, err
+	}
+
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	return readTrashDir(g.trashPath(namespace, ""), namespace)
+}
+
+// Restore implements Trasher, committing the config as a new revision.
+func (g *GitStore) Restore(author Author, namespace, id string, opts RestoreOptions) (TrashItem, error) {
+	if _, err := g.resolvePath(namespace, id); err != nil {
+		return TrashItem{}, err
+	}
+
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	rec, err := readTrashFile(g.trashPath(namespace, id), namespace, id)
+	if err != nil {
+		return TrashItem{}, err
+	}
+	name := opts.restoreTarget(rec.TrashItem)
+	rel, err := g.resolvePath(namespace, name)
+	if err != nil {
+		return TrashItem{}, err
+	}
+	path := filepath.Join(g.dir, filepath.FromSlash(rel))
+	if _, err := os.Stat(path); err == nil && !opts.Overwrite {
+		return TrashItem{}, errConfigExists(namespace, name)
+	}
+	content, err := opts.restoreContent(rec.TrashItem, rec.Content)
+	if err != nil {
+		return TrashItem{}, err
+	}
+
+	if err := writeFileAtomic(path, content); err != nil {
+		return TrashItem{}, err
+	}
+	if _, err := g.git("add", "--", rel); err != nil {
+		return TrashItem{}, err
+	}
+	if rec.Metadata != nil {
+		err = writeMetadataFile(g.metadataPath(rel), *rec.Metadata)
+	} else if err = removeFileSync(g.metadataPath(rel)); os.IsNotExist(err) {
+		err = nil
+	}
+	if err != nil {
+		return TrashItem{}, fmt.Errorf("failed to restore metadata of config %s in namespace %s: %w", name, namespace, err)
+	}
+	if err := g.commit(author, "Restore "+rel); err != nil {
+		return TrashItem{}, err
+	}
+	if err := g.purgeLocked(namespace, id); err != nil {
+		return TrashItem{}, err
+	}
+	return restoredItem(rec.TrashItem, name), nil
+}
+
+// Purge implements Trasher.
+func (g *GitStore) Purge(namespace, id string) error {
+	if _, err := g.resolvePath(namespace, id); err != nil {
+		return err
+	}
+
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	return g.purgeLocked(namespace, id)
+}
+
+// purgeLocked removes a trash item. Callers must hold g.mu.
+func (g *GitStore) purgeLocked(namespace, id string) error {
+	path := g.trashPath(namespace, id)
+	if err := removeFileSync(path); err != nil {
+		if os.IsNotExist(err) {
+			return errTrashItemNotFound(namespace, id)
+		}
+		return fmt.Errorf("failed to purge trash item %s in namespace %s: %w", id, namespace, err)
+	}
+	_ = os.Remove(filepath.Dir(path))
+	return nil
+}
+
+// PurgeTrash implements Trasher.
+func (g *GitStore) PurgeTrash(cutoff time.Time) (int, error) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	return purgeTrashDirs(filepath.Join(g.dir, gitDir, "yamlet", "trash"), cutoff)
+}
+
+// RewriteTrash implements Trasher.
+func (g *GitStore) RewriteTrash(namespace, id string, fn func([]byte) ([]byte, error)) error {
+	if _, err := g.resolvePath(namespace, id); err != nil {
+		return err
+	}
+
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	path := g.trashPath(namespace, id)
+	rec, err := readTrashFile(path, namespace, id)
+	if err != nil {
+		return err
+	}
+	if rec.Content, err = fn(rec.Content); err != nil {
+		return err
+	}
+	return writeTrashFile(path, rec)
+}
+
+// Revisions implements Versioned. Each revision records its commit.
+func (g *GitStore) Revisions(namespace, name string) ([]Revision, error) {
+	revs, _, err := g.revisions(namespace, name)
+	return revs, err
+}
+
+// GetRevision implements Versioned.
+func (g *GitStore) GetRevision(namespace, name string, revision int) ([]byte, error) {
+	revs, blobs, err := g.revisions(namespace, name)
+	if err != nil {
+		return nil, err
+	}
+	if revision < 1 || revision > len(revs) {
+		return nil, fmt.Errorf("revision %d of config %s in namespace %s: %w", revision, name, namespace, ErrNotFound)
+	}
+
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	return g.git("cat-file", "blob", blobs[revision-1])
+}
+
+// revisions lists the commits that changed a config since it was last
+// created, oldest first, with the blob each left it at.
+func (g *GitStore) revisions(namespace, name string) ([]Revision, []string, error) {
+	rel, err := g.resolvePath(namespace, name)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	if !g.hasCommits() {
+		return nil, nil, fmt.Errorf("config %s in namespace %s: %w", name, namespace, ErrNotFound)
+	}
+	// Each commit is a header line of "\x1e<hash>\x1f<unix time>" followed
+	// by a raw diff line ":<mode> <mode> <old blob> <new blob> <status>\t<path>".
+	out, err := g.git("log", "--format=%x1e%H%x1f%ct", "--raw", "--no-abbrev", "--no-renames", "--", rel)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	var revs []Revision // newest first until reversed
+	var blobs []string
+	for _, record := range strings.Split(string(out), "\x1e")[1:] {
+		lines := strings.Split(strings.TrimSpace(record), "\n")
+		header := strings.SplitN(lines[0], "\x1f", 2)
+		if len(header) != 2 || len(lines) < 2 {
+			continue
+		}
+		fields := strings.Fields(strings.SplitN(lines[len(lines)-1], "\t", 2)[0])
+		if len(fields) != 5 {
+			return nil, nil, fmt.Errorf("unexpected git log output for %s: %q", rel, lines[len(lines)-1])
+		}
+		status := fields[4]
+		if status == "D" {
+			break
+		}
+		created, _ := strconv.ParseInt(header[1], 10, 64)
+		revs = append(revs, Revision{Created: time.Unix(created, 0).UTC(), Commit: header[0]})
+		blobs = append(blobs, fields[3])
+		if status == "A" {
+			break
+		}
+	}
+	if len(revs) == 0 {
+		return nil, nil, fmt.Errorf("config %s in namespace %s: %w", name, namespace, ErrNotFound)
+	}
+
+	sizes, err := g.run(nil, strings.NewReader(strings.Join(blobs, "\n")+"\n"), "cat-file", "--batch-check=%(objectsize)")
+	if err != nil {
+		return nil, nil, err
+	}
+	scanner := bufio.NewScanner(bytes.NewReader(sizes))
+	for i := 0; i < len(revs) && scanner.Scan(); i++ {
+		revs[i].Size, _ = strconv.Atoi(scanner.Text())
+	}
+
+	for i, j := 0, len(revs)-1; i < j; i, j = i+1, j-1 {
+		revs[i], revs[j] = revs[j], revs[i]
+		blobs[i], blobs[j] = blobs[j], blobs[i]
+	}
+	for i := range revs {
+		revs[i].Number = i + 1
+	}
+	return revs, blobs, nil
+}
+
+// commit commits the index if anything is staged, then pushes. Callers must
+// hold g.mu.
+func (g *GitStore) commit(author Author, message string) error {
+	if _, err := g.git("diff", "--cached", "--quiet"); err == nil {
+		return nil
+	} else if !isExitCode(err, 1) {
+		return err
+	}
+
+	env := []string{
+		"GIT_AUTHOR_NAME=" + author.Name,
+		"GIT_AUTHOR_EMAIL=" + author.Email,
+		"GIT_COMMITTER_NAME=" + DefaultAuthor.Name,
+		"GIT_COMMITTER_EMAIL=" + DefaultAuthor.Email,
+	}
+	if _, err := g.run(env, nil, "commit", "-q", "--no-verify", "-m", message); err != nil {
+		return err
+	}
+
+	if g.opts.Remote != "" {
+		if _, err := g.git("push", "-q", g.opts.Remote, "HEAD:refs/heads/"+g.opts.Branch); err != nil && g.opts.OnPushError != nil {
+			g.opts.OnPushError(err)
+		}
+	}
+	return nil
+}
+
+// hasCommits reports whether the branch has any commit yet.
+func (g *GitStore) hasCommits() bool {
+	_, err := g.git("rev-parse", "--verify", "-q", "HEAD")
+	return err == nil
+}
+
+// git runs a git command in the working tree and returns its output.
+func (g *GitStore) git(args ...string) ([]byte, error) {
+	return g.run(nil, nil, args...)
+}
+
+// run runs a git command with extra environment variables and input.
+// Configuration from the environment and from outside the repository is
+// ignored, so the user's settings cannot change how commits are made.
+func (g *GitStore) run(env []string, stdin io.Reader, args ...string) ([]byte, error) {
+	cmd := exec.Command("git", append([]string{"--literal-pathspecs", "-c", "commit.gpgsign=false", "-c", "core.quotepath=off"}, args...)...)
+	cmd.Dir = g.dir
+	cmd.Stdin = stdin
+	cmd.Env = append([]string{"GIT_CONFIG_NOSYSTEM=1", "GIT_CONFIG_GLOBAL=" + os.DevNull, "GIT_TERMINAL_PROMPT=0"}, env...)
+	for _, kv := range os.Environ() {
+		if !strings.HasPrefix(kv, "GIT_") {
+			cmd.Env = append(cmd.Env, kv)
+		}
+	}
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	out, err := cmd.Output()
+	if err != nil {
+		return out, fmt.Errorf("git %s: %w: %s", args[0], err, strings.TrimSpace(stderr.String()))
+	}
+	return out, nil
+}
+
+// isExitCode reports whether err is a command exiting with code.
+func isExitCode(err error, code int) bool {
+	var exitErr *exec.ExitError
+	return errors.As(err, &exitErr) && exitErr.ExitCode() == code
+}
@@ -0,0 +1,239 @@
+package storage
+
+import (
+	"errors"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func newTestGitStore(t *testing.T, opts GitOptions) (*GitStore, string) {
+	t.Helper()
+	if _, err := exec.LookPath("git"); err != nil {
+		t.Skip("git is not installed")
+	}
+	dir := filepath.Join(t.TempDir(), "repo")
+	store, err := NewGitStore(dir, opts)
+	if err != nil {
+		t.Fatalf("NewGitStore: %v", err)
+	}
+	return store, dir
+}
+
+func TestGitStore(t *testing.T) {
+	store, _ := newTestGitStore(t, GitOptions{})
+
+	if err := store.Store("dev", "b.yaml", []byte("b: 1")); err != nil {
+		t.Fatalf("Store: %v", err)
+	}
+	if err := store.Store("dev", "a.yaml", []byte("a: 1")); err != nil {
+		t.Fatalf("Store: %v", err)
+	}
+	if err := store.Store("prod", "a.yaml", []byte("a: 2")); err != nil {
+		t.Fatalf("Store: %v", err)
+	}
+
+	got, err := store.Get("dev", "a.yaml")
+	if err != nil || string(got) != "a: 1" {
+		t.Fatalf("Get = %q, %v", got, err)
+	}
+	names, err := store.List("dev")
+	if err != nil || len(names) != 2 || names[0] != "a.yaml" || names[1] != "b.yaml" {
+		t.Fatalf("List = %v, %v", names, err)
+	}
+	if names, _ := store.List("missing"); len(names) != 0 {
+		t.Fatalf("List of missing namespace = %v", names)
+	}
+	namespaces, err := store.Namespaces()
+	if err != nil || len(namespaces) != 2 || namespaces[0] != "dev" || namespaces[1] != "prod" {
+		t.Fatalf("Namespaces = %v, %v", namespaces, err)
+	}
+
+	if err := store.Delete("prod", "a.yaml"); err != nil {
+		t.Fatalf("Delete: %v", err)
+	}
+	if _, err := store.Get("prod", "a.yaml"); !errors.Is(err, ErrNotFound) {
+		t.Fatalf("Get after Delete should be ErrNotFound, got %v", err)
+	}
+	if err := store.Delete("prod", "a.yaml"); !errors.Is(err, ErrNotFound) {
+		t.Fatalf("second Delete should be ErrNotFound, got %v", err)
+	}
+	if namespaces, _ := store.Namespaces(); len(namespaces) != 1 {
+		t.Fatalf("empty namespace should be removed: %v", namespaces)
+	}
+
+	for _, tc := range [][2]string{{".git", "a.yaml"}, {"dev", ".git"}, {"../x", "a.yaml"}} {
+		if err := store.Store(tc[0], tc[1], []byte("x")); !errors.Is(err, ErrInvalidName) {
+			t.Fatalf("Store(%q, %q): expected ErrInvalidName, got %v", tc[0], tc[1], err)
+		}
+	}
+	if _, err := store.List(".git"); !errors.Is(err, ErrInvalidName) {
+		t.Fatalf("List(.git): expected ErrInvalidName, got %v", err)
+	}
+}
+
+func TestGitStoreRevisions(t *testing.T) {
+	store, _ := newTestGitStore(t, GitOptions{})
+	testRevisions(t, store)
+
+	// Storing unchanged content makes no commit.
+	store.Store("dev", "same.yaml", []byte("v: 1"))
+	store.Store("dev", "same.yaml", []byte("v: 1"))
+	revs, err := store.Revisions("dev", "same.yaml")
+	if err != nil || len(revs) != 1 || len(revs[0].Commit) != 40 {
+		t.Fatalf("expected one revision with a commit, got %+v, %v", revs, err)
+	}
+}
+
+func TestGitStoreQuery(t *testing.T) {
+	store, _ := newTestGitStore(t, GitOptions{})
+	testQuery(t, store)
+}
+
+func TestGitStoreMetadata(t *testing.T) {
+	store, dir := newTestGitStore(t, GitOptions{})
+	testMetadata(t, store)
+
+	// Metadata is kept out of the history.
+	if out, err := exec.Command("git", "-C", dir, "status", "--porcelain").Output(); err != nil || len(out) != 0 {
+		t.Fatalf("expected a clean work tree, got %q, %v", out, err)
+	}
+}
+
+func TestGitStoreTrash(t *testing.T) {
+	store, dir := newTestGitStore(t, GitOptions{})
+	testTrash(t, store)
+
+	// The trash is kept out of the history, while trashing and restoring
+	// are committed.
+	if out, err := exec.Command("git", "-C", dir, "status", "--porcelain").Output(); err != nil || len(out) != 0 {
+		t.Fatalf("expected a clean work tree, got %q, %v", out, err)
+	}
+	out, err := exec.Command("git", "-C", dir, "log", "--format=%s").Output()
+	if err != nil || !strings.Contains(string(out), "Trash dev/app.yaml") || !strings.Contains(string(out), "Restore dev/app-old.yaml") {
+		t.Fatalf("expected trash and restore commits, got %q, %v", out, err)
+	}
+}
+
+func TestGitStoreExport(t *testing.T) {
+	store, _ := newTestGitStore(t, GitOptions{})
+	testExport(t, store)
+}
+
+func TestGitStoreNamespaces(t *testing.T) {
+	store, dir := newTestGitStore(t, GitOptions{})
+	testNamespaces(t, store)
+
+	// Namespace records are kept out of the history, and deleting a
+	// namespace is committed.
+	if out, err := exec.Command("git", "-C", dir, "status", "--porcelain").Output(); err != nil || len(out) != 0 {
+		t.Fatalf("expected a clean work tree, got %q, %v", out, err)
+	}
+	out, err := exec.Command("git", "-C", dir, "log", "--format=%s").Output()
+	if err != nil || !strings.Contains(string(out), "Delete namespace dev") {
+		t.Fatalf("expected a namespace deletion commit, got %q, %v", out, err)
+	}
+	if err := store.SetNamespaceInfo(NamespaceInfo{Name: ".git"}); !errors.Is(err, ErrInvalidName) {
+		t.Fatalf("expected ErrInvalidName for .git, got %v", err)
+	}
+}
+
+func TestGitStoreAuthors(t *testing.T) {
+	store, dir := newTestGitStore(t, GitOptions{})
+
+	alice := Author{Name: "alice", Email: "alice@example.com"}
+	if err := store.StoreAs(alice, "dev", "app.yaml", []byte("v: 1")); err != nil {
+		t.Fatalf("StoreAs: %v", err)
+	}
+	if err := store.DeleteAs(Author{Name: "bob", Email: "bob@example.com"}, "dev", "app.yaml"); err != nil {
+		t.Fatalf("DeleteAs: %v", err)
+	}
+
+	out, err := exec.Command("git", "-C", dir, "log", "--format=%an <%ae>|%cn|%s").Output()
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := "bob <bob@example.com>|yamlet|Delete dev/app.yaml\n" +
+		"alice <alice@example.com>|yamlet|Create dev/app.yaml\n"
+	if string(out) != want {
+		t.Fatalf("git log =\n%s\nwant\n%s", out, want)
+	}
+}
+
+func TestGitStoreReaper(t *testing.T) {
+	store, dir := newTestGitStore(t, GitOptions{})
+	testReaper(t, store)
+
+	// Expirations are committed as the reaper's.
+	out, err := exec.Command("git", "-C", dir, "log", "--format=%an|%s", "-n", "2").Output()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, line := range strings.Split(strings.TrimSpace(string(out)), "\n") {
+		if !strings.HasPrefix(line, ReaperAuthor.Name+"|Delete preview-") {
+			t.Fatalf("expected the reaper's deletions, got %q", out)
+		}
+	}
+}
+
+func TestGitStorePush(t *testing.T) {
+	remote := filepath.Join(t.TempDir(), "remote.git")
+	var pushErr error
+	store, _ := newTestGitStore(t, GitOptions{Remote: remote, OnPushError: func(err error) { pushErr = err }})
+
+	if err := store.Store("dev", "app.yaml", []byte("v: 1")); err != nil {
+		t.Fatalf("Store: %v", err)
+	}
+	if pushErr != nil {
+		t.Fatalf("push failed: %v", pushErr)
+	}
+
+	clone := filepath.Join(t.TempDir(), "clone")
+	if out, err := exec.Command("git", "clone", "-q", "-b", "main", remote, clone).CombinedOutput(); err != nil {
+		t.Fatalf("clone: %v: %s", err, out)
+	}
+	if got, err := os.ReadFile(filepath.Join(clone, "dev", "app.yaml")); err != nil || string(got) != "v: 1" {
+		t.Fatalf("pushed content = %q, %v", got, err)
+	}
+
+	// A failed push is reported but the change is kept.
+	os.RemoveAll(remote)
+	os.WriteFile(remote, nil, 0644)
+	if err := store.Store("dev", "app.yaml", []byte("v: 2")); err != nil {
+		t.Fatalf("Store with broken remote: %v", err)
+	}
+	if pushErr == nil {
+		t.Fatal("expected a push error")
+	}
+	if got, _ := store.Get("dev", "app.yaml"); string(got) != "v: 2" {
+		t.Fatalf("Get = %q", got)
+	}
+}
+
+func TestGitStoreRecovery(t *testing.T) {
+	store, dir := newTestGitStore(t, GitOptions{})
+	store.Store("dev", "app.yaml", []byte("v: 1"))
+
+	// Simulate a crash between writing a file and committing it.
+	os.WriteFile(filepath.Join(dir, "dev", "app.yaml"), []byte("v: 2"), 0644)
+	tmp := filepath.Join(dir, "dev", tempPrefix+"app.yaml.123")
+	os.WriteFile(tmp, []byte("partial"), 0644)
+
+	store, err := NewGitStore(dir, GitOptions{})
+	if err != nil {
+		t.Fatalf("reopen: %v", err)
+	}
+	if _, err := os.Stat(tmp); !os.IsNotExist(err) {
+		t.Fatalf("temporary file should be removed: %v", err)
+	}
+	revs, err := store.Revisions("dev", "app.yaml")
+	if err != nil || len(revs) != 2 {
+		t.Fatalf("interrupted change should be committed, got %+v, %v", revs, err)
+	}
+	out, _ := exec.Command("git", "-C", dir, "status", "--porcelain").Output()
+	if strings.TrimSpace(string(out)) != "" {
+		t.Fatalf("working tree should be clean:\n%s", out)
+	}
+}
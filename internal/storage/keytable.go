@@ -0,0 +1,71 @@
+package storage
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"os"
+)
+
+// KeyTable keeps the key table of an EncryptedStore: the data keys of
+// every namespace, wrapped by master keys. Stores that several processes
+// share implement it so that all of them use the same data keys; the table
+// holds nothing readable without a master key, so it can live with the
+// data.
+type KeyTable interface {
+	// LoadKeyTable returns the stored table, or nil if there is none yet,
+	// together with its revision.
+	LoadKeyTable() (data []byte, revision string, err error)
+	// KeyTableRevision returns the revision of the stored table, "" if
+	// there is none yet, without reading it.
+	KeyTableRevision() (string, error)
+	// SaveKeyTable stores the table if the stored one is still at
+	// revision ("" for none) and returns the new revision. It returns
+	// ErrConflict if another process saved the table in the meantime.
+	SaveKeyTable(data []byte, revision string) (string, error)
+}
+
+// FileKeyTable keeps a key table in a local file, for stores a single
+// process opens.
+type FileKeyTable struct {
+	Path string
+}
+
+// LoadKeyTable implements KeyTable.
+func (f FileKeyTable) LoadKeyTable() ([]byte, string, error) {
+	data, err := os.ReadFile(f.Path)
+	if os.IsNotExist(err) {
+		return nil, "", nil
+	}
+	if err != nil {
+		return nil, "", fmt.Errorf("failed to read key table %s: %w", f.Path, err)
+	}
+	return data, fileKeyTableRevision(data), nil
+}
+
+// KeyTableRevision implements KeyTable.
+func (f FileKeyTable) KeyTableRevision() (string, error) {
+	_, revision, err := f.LoadKeyTable()
+	return revision, err
+}
+
+// SaveKeyTable implements KeyTable.
+func (f FileKeyTable) SaveKeyTable(data []byte, revision string) (string, error) {
+	current, err := f.KeyTableRevision()
+	if err != nil {
+		return "", err
+	}
+	if current != revision {
+		return "", fmt.Errorf("key table %s: %w", f.Path, ErrConflict)
+	}
+	if err := writeFileAtomic(f.Path, data); err != nil {
+		return "", fmt.Errorf("failed to write key table %s: %w", f.Path, err)
+	}
+	return fileKeyTableRevision(data), nil
+}
+
+// fileKeyTableRevision identifies a key table file by its content.
+func fileKeyTableRevision(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
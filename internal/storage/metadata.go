@@ -0,0 +1,100 @@
+package storage
+
+import (
+	"encoding/json"
+	"fmt"
+	"maps"
+	"os"
+	"strings"
+)
+
+// maxLabelLength bounds label values and the name part of label and
+// annotation keys.
+const maxLabelLength = 63
+
+// ValidateMetadata checks labels and annotations. Keys are an optional DNS
+// prefix and a slash followed by a name of at most 63 letters, digits, '-',
+// '_' and '.', starting and ending with a letter or digit, as in
+// Kubernetes; label values follow the same rule for names but may be empty.
+// Annotation values are free-form.
+func ValidateMetadata(md Metadata) error {
+	for key, value := range md.Labels {
+		if err := validateMetadataKey(key); err != nil {
+			return fmt.Errorf("%w: label %w", ErrInvalidMetadata, err)
+		}
+		if value != "" && !isLabelName(value) {
+			return fmt.Errorf("%w: label %s has invalid value %q", ErrInvalidMetadata, key, value)
+		}
+	}
+	for key := range md.Annotations {
+		if err := validateMetadataKey(key); err != nil {
+			return fmt.Errorf("%w: annotation %w", ErrInvalidMetadata, err)
+		}
+	}
+	return nil
+}
+
+func validateMetadataKey(key string) error {
+	name := key
+	if prefix, rest, ok := strings.Cut(key, "/"); ok {
+		if prefix == "" || len(prefix) > 253 || strings.Trim(prefix, "abcdefghijklmnopqrstuvwxyz0123456789-.") != "" {
+			return fmt.Errorf("key %q has an invalid prefix", key)
+		}
+		name = rest
+	}
+	if !isLabelName(name) {
+		return fmt.Errorf("key %q is invalid", key)
+	}
+	return nil
+}
+
+// isLabelName reports whether s is 1 to 63 letters, digits, '-', '_' and
+// '.', starting and ending with a letter or digit.
+func isLabelName(s string) bool {
+	if s == "" || len(s) > maxLabelLength {
+		return false
+	}
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		alnum := c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9'
+		if (i == 0 || i == len(s)-1) && !alnum {
+			return false
+		}
+		if !alnum && c != '-' && c != '_' && c != '.' {
+			return false
+		}
+	}
+	return true
+}
+
+// cloneMetadata copies md so that the maps are not shared with the caller.
+func cloneMetadata(md Metadata) Metadata {
+	md.Labels = maps.Clone(md.Labels)
+	md.Annotations = maps.Clone(md.Annotations)
+	return md
+}
+
+// readMetadataFile reads a record kept as a JSON file.
+func readMetadataFile(path, namespace, name string) (Metadata, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return Metadata{}, fmt.Errorf("metadata of config %s in namespace %s: %w", name, namespace, ErrNotFound)
+		}
+		return Metadata{}, fmt.Errorf("failed to read metadata of config %s in namespace %s: %w", name, namespace, err)
+	}
+	var md Metadata
+	if err := json.Unmarshal(data, &md); err != nil {
+		return Metadata{}, fmt.Errorf("failed to parse metadata of config %s in namespace %s: %w", name, namespace, err)
+	}
+	return md, nil
+}
+
+// writeMetadataFile writes a record as a JSON file, atomically.
+func writeMetadataFile(path string, md Metadata) error {
+	data, err := json.Marshal(md)
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(path, data)
+}
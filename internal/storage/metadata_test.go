@@ -0,0 +1,119 @@
+package storage
+
+import (
+	"errors"
+	"strings"
+	"testing"
+	"time"
+)
+
+// testMetadata exercises a MetadataStore implementation.
+func testMetadata(t *testing.T, store interface {
+	Store
+	MetadataStore
+}) {
+	t.Helper()
+	if err := store.SetMetadata("dev", "app.yaml", Metadata{}); !errors.Is(err, ErrNotFound) {
+		t.Fatalf("SetMetadata of a missing config should be ErrNotFound, got %v", err)
+	}
+	if err := store.Store("dev", "app.yaml", []byte("v: 1")); err != nil {
+		t.Fatalf("Store: %v", err)
+	}
+	if _, err := store.Metadata("dev", "app.yaml"); !errors.Is(err, ErrNotFound) {
+		t.Fatalf("Metadata before SetMetadata should be ErrNotFound, got %v", err)
+	}
+
+	created := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	want := Metadata{
+		Created:     created,
+		Updated:     created.Add(time.Hour),
+		UpdatedBy:   "3f2a9c1b7e04",
+		Size:        4,
+		SHA256:      "c0ffee",
+		ContentType: "application/yaml",
+		Labels:      map[string]string{"app": "api", "tier": ""},
+		Annotations: map[string]string{"example.com/owner": "team a, on call"},
+		Expires:     created.Add(72 * time.Hour),
+	}
+	if err := store.SetMetadata("dev", "app.yaml", want); err != nil {
+		t.Fatalf("SetMetadata: %v", err)
+	}
+	// The store must not share the caller's maps.
+	want.Labels["app"] = "changed by caller"
+
+	got, err := store.Metadata("dev", "app.yaml")
+	if err != nil {
+		t.Fatalf("Metadata: %v", err)
+	}
+	if !got.Created.Equal(want.Created) || !got.Updated.Equal(want.Updated) || got.UpdatedBy != want.UpdatedBy ||
+		got.Size != want.Size || got.SHA256 != want.SHA256 || got.ContentType != want.ContentType ||
+		len(got.Labels) != 2 || got.Labels["app"] != "api" || got.Labels["tier"] != "" ||
+		got.Annotations["example.com/owner"] != "team a, on call" || !got.Expires.Equal(want.Expires) {
+		t.Fatalf("Metadata = %+v, want %+v", got, want)
+	}
+
+	// Replacing drops what the new record leaves out.
+	if err := store.SetMetadata("dev", "app.yaml", Metadata{Created: created, Labels: map[string]string{"app": "web"}}); err != nil {
+		t.Fatalf("SetMetadata: %v", err)
+	}
+	got, _ = store.Metadata("dev", "app.yaml")
+	if len(got.Labels) != 1 || got.Labels["app"] != "web" || len(got.Annotations) != 0 || got.SHA256 != "" {
+		t.Fatalf("Metadata after replace = %+v", got)
+	}
+
+	// Deleting the config deletes its record, also when it is recreated.
+	if err := store.Delete("dev", "app.yaml"); err != nil {
+		t.Fatalf("Delete: %v", err)
+	}
+	store.Store("dev", "app.yaml", []byte("v: 2"))
+	if _, err := store.Metadata("dev", "app.yaml"); !errors.Is(err, ErrNotFound) {
+		t.Fatalf("metadata should be gone after delete, got %v", err)
+	}
+	if _, err := store.Metadata("../x", "app.yaml"); !errors.Is(err, ErrInvalidName) {
+		t.Fatalf("expected ErrInvalidName, got %v", err)
+	}
+}
+
+func TestMemoryStoreMetadata(t *testing.T) {
+	testMetadata(t, NewMemoryStore())
+}
+
+func TestFileStoreMetadata(t *testing.T) {
+	store := NewFileStore(t.TempDir())
+	testMetadata(t, store)
+
+	if namespaces, _ := store.Namespaces(); len(namespaces) != 1 || namespaces[0] != "dev" {
+		t.Fatalf("metadata must not show up as a namespace: %v", namespaces)
+	}
+}
+
+func TestValidateMetadata(t *testing.T) {
+	valid := []Metadata{
+		{},
+		{Labels: map[string]string{"app": "api", "tier": "", "example.com/team": "a.b_c-d"}},
+		{Annotations: map[string]string{"kubernetes.io/description": "anything, at all = fine"}},
+		{Labels: map[string]string{strings.Repeat("a", 63): strings.Repeat("b", 63)}},
+	}
+	for _, md := range valid {
+		if err := ValidateMetadata(md); err != nil {
+			t.Errorf("ValidateMetadata(%+v) = %v", md, err)
+		}
+	}
+
+	invalid := []Metadata{
+		{Labels: map[string]string{"": "x"}},
+		{Labels: map[string]string{"-app": "x"}},
+		{Labels: map[string]string{"app": "has space"}},
+		{Labels: map[string]string{"app": "x,y"}},
+		{Labels: map[string]string{"Example.com/app": "x"}},
+		{Labels: map[string]string{"/app": "x"}},
+		{Labels: map[string]string{strings.Repeat("a", 64): "x"}},
+		{Labels: map[string]string{"app": strings.Repeat("b", 64)}},
+		{Annotations: map[string]string{"not valid": "x"}},
+	}
+	for _, md := range invalid {
+		if err := ValidateMetadata(md); !errors.Is(err, ErrInvalidMetadata) {
+			t.Errorf("ValidateMetadata(%+v) should be ErrInvalidMetadata, got %v", md, err)
+		}
+	}
+}
@@ -0,0 +1,233 @@
+package storage
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"slices"
+	"time"
+)
+
+// NamespaceInfo is the record of a namespace created through the admin API.
+type NamespaceInfo struct {
+	Name        string            `json:"name"`
+	Owner       string            `json:"owner,omitempty"`
+	Description string            `json:"description,omitempty"`
+	Labels      map[string]string `json:"labels,omitempty"`
+	Created     time.Time         `json:"created,omitzero"`
+	Updated     time.Time         `json:"updated,omitzero"`
+	// Policy is the policy set on the namespace through the admin API. A
+	// namespace without a record gets one when its policy is first set.
+	Policy *NamespacePolicy `json:"policy,omitempty"`
+}
+
+// NamespacePolicy is the per-namespace policy that package policy enforces,
+// kept with the namespace's record so that it survives restarts. A nil list
+// leaves the server's default from the environment in place, while an
+// empty one clears it.
+type NamespacePolicy struct {
+	SecretPaths  []string        `json:"secret_paths"`
+	EncryptPaths []string        `json:"encrypted_paths"`
+	Referrers    []string        `json:"referrers"`
+	Quota        *NamespaceQuota `json:"quota"`
+}
+
+// NamespaceQuota limits what a namespace may store; zero is no limit. See
+// policy.Quota.
+type NamespaceQuota struct {
+	MaxConfigs     int   `json:"max_configs,omitempty"`
+	MaxBytes       int64 `json:"max_bytes,omitempty"`
+	MaxConfigBytes int64 `json:"max_config_bytes,omitempty"`
+	MaxRevisions   int   `json:"max_revisions,omitempty"`
+}
+
+// clone returns a deep copy of p.
+func (p *NamespacePolicy) clone() *NamespacePolicy {
+	if p == nil {
+		return nil
+	}
+	c := *p
+	c.SecretPaths = slices.Clone(p.SecretPaths)
+	c.EncryptPaths = slices.Clone(p.EncryptPaths)
+	c.Referrers = slices.Clone(p.Referrers)
+	if p.Quota != nil {
+		q := *p.Quota
+		c.Quota = &q
+	}
+	return &c
+}
+
+// NamespaceUsage counts what a namespace holds. Revisions and metadata are
+// not included.
+type NamespaceUsage struct {
+	Configs int   `json:"configs"`
+	Bytes   int64 `json:"bytes"`
+}
+
+// NamespaceStore is implemented by stores that keep records of namespaces,
+// so that a namespace exists from its creation until it is deleted rather
+// than only while it holds configs. Namespaces lists namespaces with a
+// record as well as those with configs.
+type NamespaceStore interface {
+	NamespaceLister
+	// NamespaceInfo returns a namespace's record, or ErrNotFound if it has
+	// none.
+	NamespaceInfo(namespace string) (NamespaceInfo, error)
+	// SetNamespaceInfo creates or replaces the record of info.Name.
+	SetNamespaceInfo(info NamespaceInfo) error
+	// DeleteNamespace deletes a namespace's record and every config in it,
+	// with their revisions and metadata, and its trash if the store keeps
+	// one. It returns ErrNotFound if the namespace has none of these.
+	DeleteNamespace(namespace string) error
+	// Usage counts the configs in a namespace and their stored size.
+	Usage(namespace string) (NamespaceUsage, error)
+}
+
+// Sizer is implemented by stores that hold configs in more bytes than are
+// written to them, such as EncryptedStore, so that quotas can be checked
+// against the bytes Usage counts.
+type Sizer interface {
+	// StoredSize returns the number of bytes content of size bytes is
+	// held in once written.
+	StoredSize(size int) int
+	// Size returns the number of bytes a config is held in.
+	Size(namespace, name string) (int, error)
+}
+
+// StoredSizeOf returns the number of bytes store holds content of size
+// bytes in once written.
+func StoredSizeOf(store Store, size int) int {
+	if sizer, ok := store.(Sizer); ok {
+		return sizer.StoredSize(size)
+	}
+	return size
+}
+
+// SizeOf returns the number of bytes store holds a config in, or
+// ErrNotFound if it does not exist.
+func SizeOf(store Store, namespace, name string) (int, error) {
+	if sizer, ok := store.(Sizer); ok {
+		return sizer.Size(namespace, name)
+	}
+	content, err := store.Get(namespace, name)
+	return len(content), err
+}
+
+// UsageOf counts the configs in a namespace and their size, through the
+// store's NamespaceStore if it has one. Otherwise every config is read.
+func UsageOf(store Store, namespace string) (NamespaceUsage, error) {
+	if namespaces, ok := store.(NamespaceStore); ok {
+		usage, err := namespaces.Usage(namespace)
+		if !errors.Is(err, ErrUnsupported) {
+			return usage, err
+		}
+	}
+
+	names, err := store.List(namespace)
+	if err != nil {
+		return NamespaceUsage{}, err
+	}
+	var usage NamespaceUsage
+	for _, name := range names {
+		content, err := store.Get(namespace, name)
+		if errors.Is(err, ErrNotFound) {
+			continue
+		}
+		if err != nil {
+			return NamespaceUsage{}, err
+		}
+		usage.Configs++
+		usage.Bytes += int64(len(content))
+	}
+	return usage, nil
+}
+
+// ValidateNamespaceInfo checks the name and labels of a namespace record.
+// Labels follow the rules for config labels.
+func ValidateNamespaceInfo(info NamespaceInfo) error {
+	if err := validateName(info.Name); err != nil {
+		return err
+	}
+	if info.Name == reservedDir {
+		return fmt.Errorf("%w: %q is reserved", ErrInvalidName, info.Name)
+	}
+	return ValidateMetadata(Metadata{Labels: info.Labels})
+}
+
+// mergeNames returns the sorted union of two lists of names.
+func mergeNames(a, b []string) []string {
+	names := slices.Concat(a, b)
+	slices.Sort(names)
+	return slices.Compact(names)
+}
+
+// readNamespaceFile reads a namespace record kept as a JSON file.
+func readNamespaceFile(path, namespace string) (NamespaceInfo, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return NamespaceInfo{}, fmt.Errorf("namespace %s: %w", namespace, ErrNotFound)
+		}
+		return NamespaceInfo{}, fmt.Errorf("failed to read namespace %s: %w", namespace, err)
+	}
+	var info NamespaceInfo
+	if err := json.Unmarshal(data, &info); err != nil {
+		return NamespaceInfo{}, fmt.Errorf("failed to parse namespace %s: %w", namespace, err)
+	}
+	return info, nil
+}
+
+// writeNamespaceFile writes a namespace record as a JSON file, atomically.
+func writeNamespaceFile(path string, info NamespaceInfo) error {
+	data, err := json.Marshal(info)
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(path, data)
+}
+
+// readNamespaceDir lists the namespace records kept as files in dir.
+func readNamespaceDir(dir string) ([]string, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("failed to list namespaces: %w", err)
+	}
+	var names []string
+	for _, entry := range entries {
+		if !entry.IsDir() && !isTempFile(entry.Name()) {
+			names = append(names, entry.Name())
+		}
+	}
+	return names, nil
+}
+
+// dirUsage counts the config files in a namespace directory.
+func dirUsage(dir string) (NamespaceUsage, error) {
+	var usage NamespaceUsage
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return usage, nil
+		}
+		return usage, err
+	}
+	for _, entry := range entries {
+		if entry.IsDir() || isTempFile(entry.Name()) {
+			continue
+		}
+		fi, err := entry.Info()
+		if err != nil {
+			if os.IsNotExist(err) {
+				continue
+			}
+			return usage, err
+		}
+		usage.Configs++
+		usage.Bytes += fi.Size()
+	}
+	return usage, nil
+}
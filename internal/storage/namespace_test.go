@@ -0,0 +1,165 @@
+package storage
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+	"time"
+)
+
+// testNamespaces exercises a NamespaceStore implementation.
+func testNamespaces(t *testing.T, store interface {
+	Store
+	MetadataStore
+	NamespaceStore
+}) {
+	t.Helper()
+	if _, err := store.NamespaceInfo("team"); !errors.Is(err, ErrNotFound) {
+		t.Fatalf("NamespaceInfo of a missing namespace should be ErrNotFound, got %v", err)
+	}
+
+	created := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	want := NamespaceInfo{
+		Name:        "team",
+		Owner:       "platform",
+		Description: "Configs of the platform team",
+		Labels:      map[string]string{"tier": "gold"},
+		Created:     created,
+		Updated:     created,
+	}
+	if err := store.SetNamespaceInfo(want); err != nil {
+		t.Fatalf("SetNamespaceInfo: %v", err)
+	}
+	// The store must not share the caller's maps.
+	want.Labels["tier"] = "changed by caller"
+
+	got, err := store.NamespaceInfo("team")
+	if err != nil {
+		t.Fatalf("NamespaceInfo: %v", err)
+	}
+	if got.Name != "team" || got.Owner != "platform" || got.Description != want.Description ||
+		len(got.Labels) != 1 || got.Labels["tier"] != "gold" || !got.Created.Equal(created) || !got.Updated.Equal(created) {
+		t.Fatalf("NamespaceInfo = %+v", got)
+	}
+
+	// A namespace with a record is listed before it holds any config, and
+	// alongside the namespaces that only hold configs.
+	store.Store("dev", "app.yaml", []byte("v: 1"))
+	store.Store("dev", "db.yaml", []byte("host: db"))
+	store.SetMetadata("dev", "app.yaml", Metadata{Labels: map[string]string{"app": "api"}})
+	if namespaces, err := store.Namespaces(); err != nil || !slices.Equal(namespaces, []string{"dev", "team"}) {
+		t.Fatalf("Namespaces = %v, %v", namespaces, err)
+	}
+
+	if usage, err := store.Usage("dev"); err != nil || usage != (NamespaceUsage{Configs: 2, Bytes: 12}) {
+		t.Fatalf("Usage(dev) = %+v, %v", usage, err)
+	}
+	if usage, err := store.Usage("team"); err != nil || usage != (NamespaceUsage{}) {
+		t.Fatalf("Usage(team) = %+v, %v", usage, err)
+	}
+
+	// Deleting cascades to the configs and their metadata and revisions.
+	store.Store("dev", "app.yaml", []byte("v: 2"))
+	if err := store.DeleteNamespace("dev"); err != nil {
+		t.Fatalf("DeleteNamespace: %v", err)
+	}
+	if names, err := store.List("dev"); err != nil || len(names) != 0 {
+		t.Fatalf("List after DeleteNamespace = %v, %v", names, err)
+	}
+	if namespaces, _ := store.Namespaces(); !slices.Equal(namespaces, []string{"team"}) {
+		t.Fatalf("Namespaces after DeleteNamespace = %v", namespaces)
+	}
+	store.Store("dev", "app.yaml", []byte("v: 3"))
+	if _, err := store.Metadata("dev", "app.yaml"); !errors.Is(err, ErrNotFound) {
+		t.Fatalf("metadata should be gone with the namespace, got %v", err)
+	}
+	if versioned, ok := Store(store).(Versioned); ok {
+		if revs, err := versioned.Revisions("dev", "app.yaml"); err == nil && len(revs) > 1 {
+			t.Fatalf("revisions should be gone with the namespace, got %+v", revs)
+		}
+	}
+
+	if err := store.DeleteNamespace("team"); err != nil {
+		t.Fatalf("DeleteNamespace of a namespace without configs: %v", err)
+	}
+	if _, err := store.NamespaceInfo("team"); !errors.Is(err, ErrNotFound) {
+		t.Fatalf("record should be gone, got %v", err)
+	}
+	if err := store.DeleteNamespace("team"); !errors.Is(err, ErrNotFound) {
+		t.Fatalf("DeleteNamespace of a missing namespace should be ErrNotFound, got %v", err)
+	}
+
+	if err := store.SetNamespaceInfo(NamespaceInfo{Name: "../x"}); !errors.Is(err, ErrInvalidName) {
+		t.Fatalf("expected ErrInvalidName, got %v", err)
+	}
+	if err := store.SetNamespaceInfo(NamespaceInfo{Name: ".yamlet"}); !errors.Is(err, ErrInvalidName) {
+		t.Fatalf("expected ErrInvalidName for the reserved namespace, got %v", err)
+	}
+	if err := store.SetNamespaceInfo(NamespaceInfo{Name: "ok", Labels: map[string]string{"bad key": "x"}}); !errors.Is(err, ErrInvalidMetadata) {
+		t.Fatalf("expected ErrInvalidMetadata, got %v", err)
+	}
+	if _, err := store.Usage("../x"); !errors.Is(err, ErrInvalidName) {
+		t.Fatalf("expected ErrInvalidName, got %v", err)
+	}
+}
+
+func TestMemoryStoreNamespaces(t *testing.T) {
+	testNamespaces(t, NewMemoryStore())
+}
+
+func TestFileStoreNamespaces(t *testing.T) {
+	dir := t.TempDir()
+	testNamespaces(t, NewFileStore(dir))
+}
+
+func TestFileStoreDeleteRemovesEmptyNamespace(t *testing.T) {
+	dir := t.TempDir()
+	store := NewFileStore(dir)
+	store.Store("dev", "app.yaml", []byte("v: 1"))
+	store.Store("dev", "db.yaml", []byte("v: 1"))
+
+	store.Delete("dev", "app.yaml")
+	if _, err := os.Stat(filepath.Join(dir, "dev")); err != nil {
+		t.Fatalf("namespace directory should stay while it holds configs: %v", err)
+	}
+	store.Delete("dev", "db.yaml")
+	if _, err := os.Stat(filepath.Join(dir, "dev")); !os.IsNotExist(err) {
+		t.Fatalf("empty namespace directory should be removed, got %v", err)
+	}
+	if namespaces, _ := store.Namespaces(); len(namespaces) != 0 {
+		t.Fatalf("Namespaces = %v", namespaces)
+	}
+}
+
+func TestNamespacesThroughWrappers(t *testing.T) {
+	testNamespaces(t, NewCachingStore(NewMemoryStore(), CacheOptions{MaxBytes: 1 << 20}))
+
+	// The cache must not serve configs of a deleted namespace.
+	cache := NewCachingStore(NewMemoryStore(), CacheOptions{MaxBytes: 1 << 20})
+	cache.Store("dev", "app.yaml", []byte("v: 1"))
+	cache.Get("dev", "app.yaml")
+	cache.DeleteNamespace("dev")
+	if _, err := cache.Get("dev", "app.yaml"); !errors.Is(err, ErrNotFound) {
+		t.Fatalf("Get after DeleteNamespace should be ErrNotFound, got %v", err)
+	}
+
+	if err := NewCachingStore(plainStore{NewMemoryStore()}, CacheOptions{}).DeleteNamespace("dev"); !errors.Is(err, ErrUnsupported) {
+		t.Fatalf("expected ErrUnsupported, got %v", err)
+	}
+}
+
+func TestUsageOf(t *testing.T) {
+	for _, store := range []Store{
+		NewMemoryStore(),
+		plainStore{NewMemoryStore()},
+		NewCachingStore(plainStore{NewMemoryStore()}, CacheOptions{}),
+	} {
+		store.Store("dev", "app.yaml", []byte("v: 1"))
+		store.Store("dev", "db.yaml", []byte("host: db"))
+		if usage, err := UsageOf(store, "dev"); err != nil || usage != (NamespaceUsage{Configs: 2, Bytes: 12}) {
+			t.Fatalf("%T: UsageOf = %+v, %v", store, usage, err)
+		}
+	}
+}
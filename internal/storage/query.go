@@ -0,0 +1,291 @@
+package storage
+
+import (
+	"errors"
+	"fmt"
+	"path"
+	"slices"
+	"strings"
+)
+
+// ListOptions filters, orders and pages a listing of configs. Names are
+// listed in byte order, ascending unless Descending is set, so listings are
+// the same on every backend and on every call.
+type ListOptions struct {
+	// Prefix keeps the names that start with it.
+	Prefix string
+	// Glob keeps the names matching it, in path.Match syntax.
+	Glob string
+	// Selector keeps the configs whose labels it matches.
+	Selector LabelSelector
+	// Descending lists names in descending order.
+	Descending bool
+	// After continues a listing after this name, in listing order. It is
+	// the Next of the previous page.
+	After string
+	// Limit bounds the number of names returned; zero returns them all.
+	Limit int
+}
+
+// Validate checks the glob pattern and limit.
+func (o ListOptions) Validate() error {
+	if _, err := path.Match(o.Glob, ""); err != nil {
+		return fmt.Errorf("%w: glob %q: %v", ErrInvalidQuery, o.Glob, err)
+	}
+	if o.Limit < 0 {
+		return fmt.Errorf("%w: negative limit", ErrInvalidQuery)
+	}
+	return nil
+}
+
+// ListPage is one page of a listing.
+type ListPage struct {
+	Names []string
+	// Next is set when more names follow; passing it as After lists them.
+	Next string
+}
+
+// Querier is implemented by stores that filter, order and page listings
+// themselves, reading no more than the page needs.
+type Querier interface {
+	Query(namespace string, opts ListOptions) (ListPage, error)
+}
+
+// Query lists the configs of a namespace with opts, through the store's
+// Querier if it has one. Otherwise the full listing is filtered here,
+// reading the metadata of each candidate when there is a label selector.
+func Query(store Store, namespace string, opts ListOptions) (ListPage, error) {
+	if err := opts.Validate(); err != nil {
+		return ListPage{}, err
+	}
+	if querier, ok := store.(Querier); ok {
+		return querier.Query(namespace, opts)
+	}
+
+	names, err := store.List(namespace)
+	if err != nil {
+		return ListPage{}, err
+	}
+	sortNames(names, opts.Descending)
+	metadata, _ := store.(MetadataStore)
+	p := newPager(opts)
+	for _, name := range names {
+		more, err := p.add(name, func() (map[string]string, error) {
+			if metadata == nil {
+				return nil, fmt.Errorf("label selectors: %w", ErrUnsupported)
+			}
+			return labelsOf(metadata.Metadata(namespace, name))
+		})
+		if err != nil {
+			return ListPage{}, err
+		}
+		if !more {
+			break
+		}
+	}
+	return p.page, nil
+}
+
+// sortNames sorts names in listing order.
+func sortNames(names []string, descending bool) {
+	slices.Sort(names)
+	if descending {
+		slices.Reverse(names)
+	}
+}
+
+// labelsOf returns the labels of a metadata record, treating a config
+// without a record as unlabeled.
+func labelsOf(md Metadata, err error) (map[string]string, error) {
+	if errors.Is(err, ErrNotFound) {
+		return nil, nil
+	}
+	return md.Labels, err
+}
+
+// pager builds a page from names visited in listing order. Stores do what
+// filtering they can natively and leave the rest to it.
+type pager struct {
+	opts ListOptions
+	page ListPage
+}
+
+func newPager(opts ListOptions) *pager {
+	return &pager{opts: opts, page: ListPage{Names: []string{}}}
+}
+
+// add offers the next name in listing order. labels is only called when a
+// selector needs them. It returns false once the page is complete and no
+// further names need to be visited.
+func (p *pager) add(name string, labels func() (map[string]string, error)) (bool, error) {
+	o := p.opts
+	if o.After != "" && (!o.Descending && name <= o.After || o.Descending && name >= o.After) {
+		return true, nil
+	}
+	if !strings.HasPrefix(name, o.Prefix) {
+		// Names are visited in order, so the prefix is behind once a name
+		// sorts past it.
+		past := !o.Descending && name > o.Prefix || o.Descending && name < o.Prefix
+		return !past, nil
+	}
+	if o.Glob != "" {
+		if ok, _ := path.Match(o.Glob, name); !ok {
+			return true, nil
+		}
+	}
+	if !o.Selector.IsZero() {
+		l, err := labels()
+		if err != nil {
+			return false, err
+		}
+		if !o.Selector.Matches(l) {
+			return true, nil
+		}
+	}
+	if o.Limit > 0 && len(p.page.Names) == o.Limit {
+		p.page.Next = p.page.Names[len(p.page.Names)-1]
+		return false, nil
+	}
+	p.page.Names = append(p.page.Names, name)
+	return true, nil
+}
+
+// LabelSelector selects configs by their labels, in the syntax of
+// Kubernetes label selectors: comma-separated requirements such as
+// "app=api", "tier!=db", "env in (dev,test)", "env notin (prod)", "canary"
+// and "!canary", all of which must hold. The zero LabelSelector matches
+// everything.
+type LabelSelector struct {
+	requirements []labelRequirement
+}
+
+type labelOperator int
+
+const (
+	labelIn labelOperator = iota
+	labelNotIn
+	labelExists
+	labelNotExists
+)
+
+// labelRequirement is one requirement of a selector. "=" and "!=" are in
+// and notin with a single value.
+type labelRequirement struct {
+	key    string
+	op     labelOperator
+	values []string
+}
+
+// ParseLabelSelector parses a label selector. An empty string gives the
+// zero LabelSelector.
+func ParseLabelSelector(s string) (LabelSelector, error) {
+	var sel LabelSelector
+	for _, term := range splitSelector(s) {
+		term = strings.TrimSpace(term)
+		if term == "" {
+			if strings.TrimSpace(s) == "" {
+				continue
+			}
+			return LabelSelector{}, fmt.Errorf("%w: empty requirement in label selector %q", ErrInvalidQuery, s)
+		}
+		req, err := parseLabelRequirement(term)
+		if err != nil {
+			return LabelSelector{}, fmt.Errorf("%w: label selector %q: %v", ErrInvalidQuery, s, err)
+		}
+		sel.requirements = append(sel.requirements, req)
+	}
+	return sel, nil
+}
+
+// splitSelector splits a selector at the commas outside parentheses.
+func splitSelector(s string) []string {
+	var terms []string
+	depth, start := 0, 0
+	for i, c := range s {
+		switch c {
+		case '(':
+			depth++
+		case ')':
+			depth--
+		case ',':
+			if depth == 0 {
+				terms = append(terms, s[start:i])
+				start = i + 1
+			}
+		}
+	}
+	return append(terms, s[start:])
+}
+
+func parseLabelRequirement(term string) (labelRequirement, error) {
+	var req labelRequirement
+	switch {
+	case strings.HasPrefix(term, "!"):
+		req = labelRequirement{key: strings.TrimSpace(term[1:]), op: labelNotExists}
+	case strings.Contains(term, "("):
+		open := strings.Index(term, "(")
+		fields := strings.Fields(term[:open])
+		if len(fields) != 2 || !strings.HasSuffix(term, ")") {
+			return req, fmt.Errorf("invalid requirement %q", term)
+		}
+		switch fields[1] {
+		case "in":
+			req.op = labelIn
+		case "notin":
+			req.op = labelNotIn
+		default:
+			return req, fmt.Errorf("unknown operator %q", fields[1])
+		}
+		req.key = fields[0]
+		for _, v := range strings.Split(term[open+1:len(term)-1], ",") {
+			req.values = append(req.values, strings.TrimSpace(v))
+		}
+	case strings.Contains(term, "!="):
+		key, value, _ := strings.Cut(term, "!=")
+		req = labelRequirement{key: strings.TrimSpace(key), op: labelNotIn, values: []string{strings.TrimSpace(value)}}
+	case strings.Contains(term, "="):
+		key, value, _ := strings.Cut(term, "=")
+		value = strings.TrimPrefix(value, "=")
+		req = labelRequirement{key: strings.TrimSpace(key), op: labelIn, values: []string{strings.TrimSpace(value)}}
+	default:
+		req = labelRequirement{key: term, op: labelExists}
+	}
+
+	if err := validateMetadataKey(req.key); err != nil {
+		return req, err
+	}
+	for _, v := range req.values {
+		if v != "" && !isLabelName(v) {
+			return req, fmt.Errorf("invalid value %q", v)
+		}
+	}
+	return req, nil
+}
+
+// IsZero reports whether the selector matches everything.
+func (s LabelSelector) IsZero() bool {
+	return len(s.requirements) == 0
+}
+
+// Matches reports whether labels meet every requirement. As in Kubernetes,
+// "!=" and notin also match configs without the label.
+func (s LabelSelector) Matches(labels map[string]string) bool {
+	for _, req := range s.requirements {
+		value, ok := labels[req.key]
+		var match bool
+		switch req.op {
+		case labelIn:
+			match = ok && slices.Contains(req.values, value)
+		case labelNotIn:
+			match = !ok || !slices.Contains(req.values, value)
+		case labelExists:
+			match = ok
+		case labelNotExists:
+			match = !ok
+		}
+		if !match {
+			return false
+		}
+	}
+	return true
+}
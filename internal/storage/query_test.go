@@ -0,0 +1,194 @@
+package storage
+
+import (
+	"errors"
+	"slices"
+	"testing"
+)
+
+// testQuery exercises Query on a store; stores that implement Querier are
+// tested through their own implementation.
+func testQuery(t *testing.T, store interface {
+	Store
+	MetadataStore
+}) {
+	t.Helper()
+	labels := map[string]map[string]string{
+		"api.yaml":    {"app": "api", "env": "dev"},
+		"db.yaml":     {"app": "db", "tier": "db"},
+		"web.json":    {"app": "web", "env": "prod"},
+		"web-2.yaml":  {"app": "web", "env": "test"},
+		"notes.yaml":  nil,
+		"api-2.yaml":  {"app": "api"},
+		"zz-old.yaml": nil,
+	}
+	for name, l := range labels {
+		if err := store.Store("dev", name, []byte("v: 1")); err != nil {
+			t.Fatalf("Store: %v", err)
+		}
+		if l != nil {
+			if err := store.SetMetadata("dev", name, Metadata{Labels: l}); err != nil {
+				t.Fatalf("SetMetadata: %v", err)
+			}
+		}
+	}
+	store.Store("test", "other.yaml", []byte("v: 1"))
+
+	all := []string{"api-2.yaml", "api.yaml", "db.yaml", "notes.yaml", "web-2.yaml", "web.json", "zz-old.yaml"}
+	cases := []struct {
+		name     string
+		opts     ListOptions
+		selector string
+		want     []string
+	}{
+		{"all", ListOptions{}, "", all},
+		{"descending", ListOptions{Descending: true}, "", []string{"zz-old.yaml", "web.json", "web-2.yaml", "notes.yaml", "db.yaml", "api.yaml", "api-2.yaml"}},
+		{"prefix", ListOptions{Prefix: "web"}, "", []string{"web-2.yaml", "web.json"}},
+		{"prefix descending", ListOptions{Prefix: "api", Descending: true}, "", []string{"api.yaml", "api-2.yaml"}},
+		{"prefix without matches", ListOptions{Prefix: "q"}, "", []string{}},
+		{"glob", ListOptions{Glob: "*.json"}, "", []string{"web.json"}},
+		{"glob and prefix", ListOptions{Prefix: "api", Glob: "*-?.yaml"}, "", []string{"api-2.yaml"}},
+		{"after", ListOptions{After: "notes.yaml"}, "", []string{"web-2.yaml", "web.json", "zz-old.yaml"}},
+		{"after descending", ListOptions{After: "db.yaml", Descending: true}, "", []string{"api.yaml", "api-2.yaml"}},
+		{"equals", ListOptions{}, "app=api", []string{"api-2.yaml", "api.yaml"}},
+		{"double equals", ListOptions{}, "app==db", []string{"db.yaml"}},
+		{"not equals", ListOptions{}, "app!=web", []string{"api-2.yaml", "api.yaml", "db.yaml", "notes.yaml", "zz-old.yaml"}},
+		{"and", ListOptions{}, "app=web,env!=prod", []string{"web-2.yaml"}},
+		{"in", ListOptions{}, "env in (dev, test)", []string{"api.yaml", "web-2.yaml"}},
+		{"notin", ListOptions{}, "env notin (dev,test),app", []string{"api-2.yaml", "db.yaml", "web.json"}},
+		{"exists", ListOptions{}, "tier", []string{"db.yaml"}},
+		{"not exists", ListOptions{}, "!app", []string{"notes.yaml", "zz-old.yaml"}},
+		{"selector and prefix", ListOptions{Prefix: "web"}, "env=prod", []string{"web.json"}},
+		{"selector descending", ListOptions{Descending: true}, "app in (api,db)", []string{"db.yaml", "api.yaml", "api-2.yaml"}},
+	}
+	for _, tc := range cases {
+		opts := tc.opts
+		sel, err := ParseLabelSelector(tc.selector)
+		if err != nil {
+			t.Fatalf("%s: %v", tc.name, err)
+		}
+		opts.Selector = sel
+		page, err := Query(store, "dev", opts)
+		if err != nil {
+			t.Fatalf("%s: Query: %v", tc.name, err)
+		}
+		if !slices.Equal(page.Names, tc.want) || page.Next != "" {
+			t.Errorf("%s: got %q (next %q), want %q", tc.name, page.Names, page.Next, tc.want)
+		}
+	}
+
+	// Paging through with continuation gives the full listing once.
+	for _, tc := range []struct {
+		opts     ListOptions
+		selector string
+	}{
+		{ListOptions{Limit: 2}, ""},
+		{ListOptions{Limit: 3, Descending: true}, ""},
+		{ListOptions{Limit: 1, Glob: "*.yaml"}, "app"},
+		{ListOptions{Limit: 2, Prefix: "w"}, ""},
+	} {
+		opts := tc.opts
+		opts.Selector, _ = ParseLabelSelector(tc.selector)
+		full := opts
+		full.Limit = 0
+		want, _ := Query(store, "dev", full)
+
+		var got []string
+		for pages := 0; ; pages++ {
+			page, err := Query(store, "dev", opts)
+			if err != nil {
+				t.Fatalf("Query %+v: %v", opts, err)
+			}
+			if len(page.Names) > opts.Limit || pages > len(all) {
+				t.Fatalf("Query %+v returned %q", opts, page.Names)
+			}
+			got = append(got, page.Names...)
+			if page.Next == "" {
+				break
+			}
+			opts.After = page.Next
+		}
+		if !slices.Equal(got, want.Names) {
+			t.Errorf("paging %+v gave %q, want %q", tc.opts, got, want.Names)
+		}
+	}
+
+	if page, err := Query(store, "empty", ListOptions{Limit: 5}); err != nil || len(page.Names) != 0 || page.Names == nil {
+		t.Fatalf("Query of an empty namespace = %+v, %v", page, err)
+	}
+	if _, err := Query(store, "dev", ListOptions{Glob: "["}); !errors.Is(err, ErrInvalidQuery) {
+		t.Fatalf("expected ErrInvalidQuery for a bad glob, got %v", err)
+	}
+	if _, err := Query(store, "../x", ListOptions{}); !errors.Is(err, ErrInvalidName) {
+		t.Fatalf("expected ErrInvalidName, got %v", err)
+	}
+}
+
+func TestMemoryStoreQuery(t *testing.T) {
+	testQuery(t, NewMemoryStore())
+}
+
+func TestFileStoreQuery(t *testing.T) {
+	testQuery(t, NewFileStore(t.TempDir()))
+}
+
+// plainStore hides every optional interface of the store it wraps but
+// MetadataStore, so that Query falls back to filtering List.
+type plainStore struct {
+	inner *MemoryStore
+}
+
+func (p plainStore) Store(namespace, name string, content []byte) error {
+	return p.inner.Store(namespace, name, content)
+}
+func (p plainStore) Get(namespace, name string) ([]byte, error) { return p.inner.Get(namespace, name) }
+func (p plainStore) Delete(namespace, name string) error        { return p.inner.Delete(namespace, name) }
+func (p plainStore) List(namespace string) ([]string, error)    { return p.inner.List(namespace) }
+func (p plainStore) Metadata(namespace, name string) (Metadata, error) {
+	return p.inner.Metadata(namespace, name)
+}
+func (p plainStore) SetMetadata(namespace, name string, md Metadata) error {
+	return p.inner.SetMetadata(namespace, name, md)
+}
+
+func TestQueryWithoutQuerier(t *testing.T) {
+	testQuery(t, plainStore{NewMemoryStore()})
+}
+
+func TestQueryThroughWrappers(t *testing.T) {
+	testQuery(t, NewCachingStore(NewMemoryStore(), CacheOptions{MaxBytes: 1 << 20}))
+}
+
+func TestParseLabelSelector(t *testing.T) {
+	valid := map[string]int{
+		"":                             0,
+		"app=api":                      1,
+		" app = api , tier != db ":     2,
+		"env in (dev,test),!canary":    2,
+		"example.com/team notin (a,b)": 1,
+		"app,release=":                 2,
+	}
+	for s, n := range valid {
+		sel, err := ParseLabelSelector(s)
+		if err != nil || len(sel.requirements) != n {
+			t.Errorf("ParseLabelSelector(%q) = %+v, %v; want %d requirements", s, sel, err, n)
+		}
+	}
+
+	for _, s := range []string{
+		"app=api,",
+		",app",
+		"app=has space",
+		"-app=x",
+		"env in dev",
+		"env within (dev)",
+		"env in (dev",
+		"env in (de v)",
+		"=x",
+		"!",
+	} {
+		if _, err := ParseLabelSelector(s); !errors.Is(err, ErrInvalidQuery) {
+			t.Errorf("ParseLabelSelector(%q) should be ErrInvalidQuery, got %v", s, err)
+		}
+	}
+}
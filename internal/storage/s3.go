@@ -0,0 +1,1293 @@
+package storage
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// s3RevisionHeader records the revision number of an object version as
+// user metadata, so numbers stay stable when old versions expire.
+const s3RevisionHeader = "X-Amz-Meta-Yamlet-Revision"
+
+// s3StoreAttempts bounds how often Store retries a write that lost a race.
+const s3StoreAttempts = 5
+
+// S3Config configures an S3Store.
+type S3Config struct {
+	Bucket string
+	// Prefix is prepended to every object key, so one bucket can hold
+	// several stores.
+	Prefix string
+	Region string
+	// Endpoint is the base URL of an S3-compatible service. It defaults to
+	// AWS S3 in Region.
+	Endpoint string
+	// PathStyle addresses the bucket in the URL path instead of the host
+	// name, as MinIO and most other S3-compatible services expect.
+	PathStyle bool
+
+	// Static credentials. When AccessKeyID is empty, credentials of the
+	// EC2 instance role are fetched from the instance metadata service.
+	AccessKeyID     string
+	SecretAccessKey string
+	SessionToken    string
+
+	// Client defaults to an http.Client with a 30 second timeout.
+	Client *http.Client
+
+	// metadataEndpoint overrides the instance metadata service address.
+	metadataEndpoint string
+}
+
+// S3Store implements storage in an S3-compatible bucket, one object per
+// config under <prefix><namespace>/<name>. Writes are conditional on the
+// object's ETag, so concurrent writers from several replicas cannot lose
+// updates; storing unchanged content is a no-op. When the bucket has
+// versioning enabled, object versions serve as the revision history; how
+// many are kept is up to the bucket's lifecycle rules.
+type S3Store struct {
+	client    *http.Client
+	endpoint  *url.URL
+	bucket    string
+	prefix    string
+	region    string
+	pathStyle bool
+	creds     func(ctx context.Context) (s3Credentials, error)
+	versioned bool
+}
+
+// NewS3Store connects to the bucket, checking that it is reachable and
+// whether it has versioning enabled.
+func NewS3Store(cfg S3Config) (*S3Store, error) {
+	if cfg.Bucket == "" {
+		return nil, errors.New("S3 bucket is required")
+	}
+	if cfg.Region == "" {
+		cfg.Region = "us-east-1"
+	}
+	if cfg.Endpoint == "" {
+		cfg.Endpoint = "https://s3." + cfg.Region + ".amazonaws.com"
+	}
+	endpoint, err := url.Parse(cfg.Endpoint)
+	if err != nil || endpoint.Scheme == "" || endpoint.Host == "" {
+		return nil, fmt.Errorf("invalid S3 endpoint %q", cfg.Endpoint)
+	}
+	if cfg.Client == nil {
+		cfg.Client = &http.Client{Timeout: 30 * time.Second}
+	}
+	prefix := strings.Trim(cfg.Prefix, "/")
+	if prefix != "" {
+		prefix += "/"
+	}
+
+	s := &S3Store{
+		client:    cfg.Client,
+		endpoint:  endpoint,
+		bucket:    cfg.Bucket,
+		prefix:    prefix,
+		region:    cfg.Region,
+		pathStyle: cfg.PathStyle,
+	}
+	if cfg.AccessKeyID != "" {
+		static := s3Credentials{cfg.AccessKeyID, cfg.SecretAccessKey, cfg.SessionToken}
+		s.creds = func(context.Context) (s3Credentials, error) { return static, nil }
+	} else {
+		imds := &instanceCredentials{client: cfg.Client, endpoint: cfg.metadataEndpoint}
+		if imds.endpoint == "" {
+			imds.endpoint = "http://169.254.169.254"
+		}
+		s.creds = imds.get
+	}
+
+	var status struct {
+		Status string `xml:"Status"`
+	}
+	resp, err := s.do(http.MethodGet, "", url.Values{"versioning": {""}}, nil, nil)
+	if err != nil {
+		var apiErr *s3Error
+		if !errors.As(err, &apiErr) || apiErr.StatusCode != http.StatusForbidden {
+			return nil, fmt.Errorf("failed to reach S3 bucket %s: %w", cfg.Bucket, err)
+		}
+		// Without permission to read the versioning state, run unversioned.
+	} else {
+		err = decodeXML(resp, &status)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read versioning state of S3 bucket %s: %w", cfg.Bucket, err)
+		}
+		s.versioned = status.Status == "Enabled"
+	}
+	return s, nil
+}
+
+// HasVersioning reports whether the bucket keeps a revision history.
+func (s *S3Store) HasVersioning() bool {
+	return s.versioned
+}
+
+func (s *S3Store) key(namespace, name string) string {
+	return s.prefix + namespace + "/" + name
+}
+
+// namespaceKey is the object holding the record of a namespace, under the
+// reserved reservedDir namespace.
+func (s *S3Store) namespaceKey(namespace string) string {
+	return s.prefix + reservedDir + "/namespaces/" + namespace
+}
+
+// metadataKey is the object holding the metadata of a config, under the
+// reserved reservedDir namespace.
+func (s *S3Store) metadataKey(namespace, name string) string {
+	return s.prefix + reservedDir + "/metadata/" + namespace + "/" + name
+}
+
+// trashKey is the object holding a trash item as JSON, under the reserved
+// reservedDir namespace.
+func (s *S3Store) trashKey(namespace, id string) string {
+	return s.trashPrefix() + namespace + "/" + id
+}
+
+func (s *S3Store) trashPrefix() string {
+	return s.prefix + reservedDir + "/trash/"
+}
+
+// keyTableKey is the object holding the key table of encryption at rest,
+// under the reserved reservedDir namespace.
+func (s *S3Store) keyTableKey() string {
+	return s.prefix + reservedDir + "/keys.json"
+}
+
+// validateS3Name validates a config's names, keeping reservedDir free for
+// metadata.
+func validateS3Name(namespace, name string) error {
+	if err := validateNamespaceAndName(namespace, name); err != nil {
+		return err
+	}
+	if namespace == reservedDir {
+		return fmt.Errorf("%w: %q is reserved", ErrInvalidName, namespace)
+	}
+	return nil
+}
+
+func (s *S3Store) Store(namespace, name string, content []byte) error {
+	if err := validateS3Name(namespace, name); err != nil {
+		return err
+	}
+
+	// Each write is conditional on the version it follows, which both
+	// numbers revisions without gaps or duplicates and keeps concurrent
+	// writers from overwriting each other unseen. A lost race is retried
+	// on top of the winner.
+	for attempt := 0; attempt < s3StoreAttempts; attempt++ {
+		etag, revision, err := s.head(s.key(namespace, name))
+		if err != nil && !errors.Is(err, ErrNotFound) {
+			return fmt.Errorf("failed to store config %s in namespace %s: %w", name, namespace, err)
+		}
+		if etag == s3ContentETag(content) {
+			return nil
+		}
+		_, err = s.put(namespace, name, content, etag, revision+1)
+		if !errors.Is(err, ErrConflict) {
+			return err
+		}
+	}
+	return fmt.Errorf("config %s in namespace %s: %w", name, namespace, ErrConflict)
+}
+
+// GetWithETag returns a config together with its ETag, for a later
+// StoreIfMatch.
+func (s *S3Store) GetWithETag(namespace, name string) ([]byte, string, error) {
+	if err := validateS3Name(namespace, name); err != nil {
+		return nil, "", err
+	}
+	resp, err := s.do(http.MethodGet, s.key(namespace, name), nil, nil, nil)
+	if err != nil {
+		return nil, "", fmt.Errorf("config %s in namespace %s: %w", name, namespace, err)
+	}
+	defer resp.Body.Close()
+	content, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, "", fmt.Errorf("failed to read config %s in namespace %s: %w", name, namespace, err)
+	}
+	return content, resp.Header.Get("ETag"), nil
+}
+
+// StoreIfMatch stores a config only if its ETag still is etag, or, for an
+// empty etag, only if it does not exist yet. It returns the new ETag, or
+// ErrConflict if the condition failed.
+func (s *S3Store) StoreIfMatch(namespace, name string, content []byte, etag string) (string, error) {
+	if err := validateS3Name(namespace, name); err != nil {
+		return "", err
+	}
+	currentETag, revision, err := s.head(s.key(namespace, name))
+	if err != nil && !errors.Is(err, ErrNotFound) {
+		return "", fmt.Errorf("failed to store config %s in namespace %s: %w", name, namespace, err)
+	}
+	if currentETag != etag {
+		return "", fmt.Errorf("config %s in namespace %s: %w", name, namespace, ErrConflict)
+	}
+	if etag == s3ContentETag(content) {
+		return etag, nil
+	}
+	return s.put(namespace, name, content, etag, revision+1)
+}
+
+// s3ContentETag is the ETag S3 gives an object holding content, unless it
+// is encrypted with KMS keys. Writing content a config already has is
+// skipped: the ETag would not change, so a stale conditional write after it
+// would wrongly succeed.
+func s3ContentETag(content []byte) string {
+	sum := md5.Sum(content)
+	return `"` + hex.EncodeToString(sum[:]) + `"`
+}
+
+// put writes an object if its current ETag is etag (or if it does not exist,
+// for an empty etag).
+func (s *S3Store) put(namespace, name string, content []byte, etag string, revision int) (string, error) {
+	header := http.Header{}
+	header.Set("Content-Type", "application/octet-stream")
+	header.Set(s3RevisionHeader, strconv.Itoa(revision))
+	if etag == "" {
+		header.Set("If-None-Match", "*")
+	} else {
+		header.Set("If-Match", etag)
+	}
+	resp, err := s.do(http.MethodPut, s.key(namespace, name), nil, header, content)
+	if err != nil {
+		return "", fmt.Errorf("failed to store config %s in namespace %s: %w", name, namespace, err)
+	}
+	resp.Body.Close()
+	return resp.Header.Get("ETag"), nil
+}
+
+// head returns the ETag and revision number of an object's current
+// version.
+func (s *S3Store) head(key string) (string, int, error) {
+	return s.headVersion(key, "")
+}
+
+func (s *S3Store) headVersion(key, versionID string) (string, int, error) {
+	var query url.Values
+	if versionID != "" {
+		query = url.Values{"versionId": {versionID}}
+	}
+	resp, err := s.do(http.MethodHead, key, query, nil, nil)
+	if err != nil {
+		return "", 0, err
+	}
+	resp.Body.Close()
+	revision, _ := strconv.Atoi(resp.Header.Get(s3RevisionHeader))
+	return resp.Header.Get("ETag"), revision, nil
+}
+
+func (s *S3Store) Get(namespace, name string) ([]byte, error) {
+	content, _, err := s.GetWithETag(namespace, name)
+	return content, err
+}
+
+func (s *S3Store) Delete(namespace, name string) error {
+	if err := validateS3Name(namespace, name); err != nil {
+		return err
+	}
+	key := s.key(namespace, name)
+	if _, _, err := s.head(key); err != nil {
+		return fmt.Errorf("config %s in namespace %s: %w", name, namespace, err)
+	}
+	if err := s.deleteObject(key); err != nil {
+		return fmt.Errorf("failed to delete config %s in namespace %s: %w", name, namespace, err)
+	}
+	if err := s.deleteObject(s.metadataKey(namespace, name)); err != nil {
+		return fmt.Errorf("failed to delete metadata of config %s in namespace %s: %w", name, namespace, err)
+	}
+	return nil
+}
+
+// deleteObject deletes an object. In a versioned bucket a plain delete
+// would only hide it behind a delete marker; removing every version
+// discards the history, as in the other stores.
+func (s *S3Store) deleteObject(key string) error {
+	if !s.versioned {
+		resp, err := s.do(http.MethodDelete, key, nil, nil, nil)
+		if err != nil {
+			return err
+		}
+		resp.Body.Close()
+		return nil
+	}
+
+	versions, err := s.listVersions(key)
+	if err != nil {
+		return err
+	}
+	for _, v := range versions {
+		resp, err := s.do(http.MethodDelete, key, url.Values{"versionId": {v.VersionID}}, nil, nil)
+		if err != nil {
+			return err
+		}
+		resp.Body.Close()
+	}
+	return nil
+}
+
+// Metadata implements MetadataStore.
+func (s *S3Store) Metadata(namespace, name string) (Metadata, error) {
+	if err := validateS3Name(namespace, name); err != nil {
+		return Metadata{}, err
+	}
+	resp, err := s.do(http.MethodGet, s.metadataKey(namespace, name), nil, nil, nil)
+	if err != nil {
+		return Metadata{}, fmt.Errorf("metadata of config %s in namespace %s: %w", name, namespace, err)
+	}
+	defer resp.Body.Close()
+	var md Metadata
+	if err := json.NewDecoder(resp.Body).Decode(&md); err != nil {
+		return Metadata{}, fmt.Errorf("failed to parse metadata of config %s in namespace %s: %w", name, namespace, err)
+	}
+	return md, nil
+}
+
+// SetMetadata implements MetadataStore. Records are kept as JSON objects
+// beside the configs, so they do not add revisions.
+func (s *S3Store) SetMetadata(namespace, name string, md Metadata) error {
+	if err := validateS3Name(namespace, name); err != nil {
+		return err
+	}
+	if _, _, err := s.head(s.key(namespace, name)); err != nil {
+		return fmt.Errorf("config %s in namespace %s: %w", name, namespace, err)
+	}
+	data, err := json.Marshal(md)
+	if err != nil {
+		return err
+	}
+	header := http.Header{}
+	header.Set("Content-Type", "application/json")
+	resp, err := s.do(http.MethodPut, s.metadataKey(namespace, name), nil, header, data)
+	if err != nil {
+		return fmt.Errorf("failed to store metadata of config %s in namespace %s: %w", name, namespace, err)
+	}
+	resp.Body.Close()
+	return nil
+}
+
+func (s *S3Store) List(namespace string) ([]string, error) {
+	if err := validateName(namespace); err != nil {
+		return nil, err
+	}
+	if namespace == reservedDir {
+		return nil, fmt.Errorf("%w: %q is reserved", ErrInvalidName, namespace)
+	}
+	keys, _, err := s.listObjects(s.prefix + namespace + "/")
+	if err != nil {
+		return nil, fmt.Errorf("failed to list namespace %s: %w", namespace, err)
+	}
+	configs := []string{}
+	for _, key := range keys {
+		configs = append(configs, strings.TrimPrefix(key, s.prefix+namespace+"/"))
+	}
+	sort.Strings(configs)
+	return configs, nil
+}
+
+// Query implements Querier. The name prefix and, in ascending order, the
+// continuation point are passed to S3, so an ascending page only lists the
+// objects it needs; descending listings have to list every matching key
+// first. With a label selector, each candidate's metadata is fetched.
+func (s *S3Store) Query(namespace string, opts ListOptions) (ListPage, error) {
+	if err := validateName(namespace); err != nil {
+		return ListPage{}, err
+	}
+	if namespace == reservedDir {
+		return ListPage{}, fmt.Errorf("%w: %q is reserved", ErrInvalidName, namespace)
+	}
+	if err := opts.Validate(); err != nil {
+		return ListPage{}, err
+	}
+
+	dir := s.prefix + namespace + "/"
+	p := newPager(opts)
+	var scanErr error
+	add := func(name string) bool {
+		more, err := p.add(name, func() (map[string]string, error) {
+			return labelsOf(s.Metadata(namespace, name))
+		})
+		if err != nil {
+			scanErr = err
+		}
+		return more
+	}
+
+	var err error
+	if opts.Descending {
+		var names []string
+		err = s.scanObjects(dir+opts.Prefix, "", func(e s3Entry) bool {
+			if e.Key != "" {
+				names = append(names, strings.TrimPrefix(e.Key, dir))
+			}
+			return true
+		})
+		if err == nil {
+			sortNames(names, true)
+			for _, name := range names {
+				if !add(name) {
+					break
+				}
+			}
+		}
+	} else {
+		startAfter := ""
+		if opts.After != "" {
+			startAfter = dir + opts.After
+		}
+		err = s.scanObjects(dir+opts.Prefix, startAfter, func(e s3Entry) bool {
+			return e.Key == "" || add(strings.TrimPrefix(e.Key, dir))
+		})
+	}
+	if err == nil {
+		err = scanErr
+	}
+	if err != nil {
+		return ListPage{}, fmt.Errorf("failed to list namespace %s: %w", namespace, err)
+	}
+	return p.page, nil
+}
+
+// Namespaces implements NamespaceLister.
+func (s *S3Store) Namespaces() ([]string, error) {
+	_, prefixes, err := s.listObjects(s.prefix)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list namespaces: %w", err)
+	}
+	namespaces := []string{}
+	for _, p := range prefixes {
+		if namespace := strings.TrimSuffix(strings.TrimPrefix(p, s.prefix), "/"); namespace != reservedDir {
+			namespaces = append(namespaces, namespace)
+		}
+	}
+	records, _, err := s.listObjects(s.namespaceKey(""))
+	if err != nil {
+		return nil, fmt.Errorf("failed to list namespaces: %w", err)
+	}
+	for i, key := range records {
+		records[i] = strings.TrimPrefix(key, s.namespaceKey(""))
+	}
+	return mergeNames(namespaces, records), nil
+}
+
+// validateS3Namespace validates a namespace name, keeping reservedDir free.
+func validateS3Namespace(namespace string) error {
+	if err := validateName(namespace); err != nil {
+		return err
+	}
+	if namespace == reservedDir {
+		return fmt.Errorf("%w: %q is reserved", ErrInvalidName, namespace)
+	}
+	return nil
+}
+
+// NamespaceInfo implements NamespaceStore.
+func (s *S3Store) NamespaceInfo(namespace string) (NamespaceInfo, error) {
+	if err := validateS3Namespace(namespace); err != nil {
+		return NamespaceInfo{}, err
+	}
+	resp, err := s.do(http.MethodGet, s.namespaceKey(namespace), nil, nil, nil)
+	if err != nil {
+		return NamespaceInfo{}, fmt.Errorf("namespace %s: %w", namespace, err)
+	}
+	defer resp.Body.Close()
+	var info NamespaceInfo
+	if err := json.NewDecoder(resp.Body).Decode(&info); err != nil {
+		return NamespaceInfo{}, fmt.Errorf("failed to parse namespace %s: %w", namespace, err)
+	}
+	return info, nil
+}
+
+// SetNamespaceInfo implements NamespaceStore.
+func (s *S3Store) SetNamespaceInfo(info NamespaceInfo) error {
+	if err := ValidateNamespaceInfo(info); err != nil {
+		return err
+	}
+	data, err := json.Marshal(info)
+	if err != nil {
+		return err
+	}
+	header := http.Header{}
+	header.Set("Content-Type", "application/json")
+	resp, err := s.do(http.MethodPut, s.namespaceKey(info.Name), nil, header, data)
+	if err != nil {
+		return fmt.Errorf("failed to store namespace %s: %w", info.Name, err)
+	}
+	resp.Body.Close()
+	return nil
+}
+
+// DeleteNamespace implements NamespaceStore. Objects are deleted one by
+// one, configs first and the record last, so an interrupted delete can be
+// repeated.
+func (s *S3Store) DeleteNamespace(namespace string) error {
+	if err := validateS3Namespace(namespace); err != nil {
+		return err
+	}
+	configs, _, err := s.listObjects(s.prefix + namespace + "/")
+	if err != nil {
+		return fmt.Errorf("failed to list namespace %s: %w", namespace, err)
+	}
+	trash, _, err := s.listObjects(s.trashPrefix() + namespace + "/")
+	if err != nil {
+		return fmt.Errorf("failed to list trash of namespace %s: %w", namespace, err)
+	}
+	_, _, recordErr := s.head(s.namespaceKey(namespace))
+	if len(configs) == 0 && len(trash) == 0 && errors.Is(recordErr, ErrNotFound) {
+		return fmt.Errorf("namespace %s: %w", namespace, ErrNotFound)
+	}
+	for _, key := range configs {
+		name := strings.TrimPrefix(key, s.prefix+namespace+"/")
+		for _, k := range []string{key, s.metadataKey(namespace, name)} {
+			if err := s.deleteObject(k); err != nil {
+				return fmt.Errorf("failed to delete namespace %s: %w", namespace, err)
+			}
+		}
+	}
+	for _, key := range trash {
+		if err := s.deleteObject(key); err != nil {
+			return fmt.Errorf("failed to delete namespace %s: %w", namespace, err)
+		}
+	}
+	if err := s.deleteObject(s.namespaceKey(namespace)); err != nil {
+		return fmt.Errorf("failed to delete namespace %s: %w", namespace, err)
+	}
+	return nil
+}
+
+// Usage implements NamespaceStore, from the sizes in the object listing.
+func (s *S3Store) Usage(namespace string) (NamespaceUsage, error) {
+	if err := validateS3Namespace(namespace); err != nil {
+		return NamespaceUsage{}, err
+	}
+	var usage NamespaceUsage
+	err := s.scanObjects(s.prefix+namespace+"/", "", func(e s3Entry) bool {
+		if e.Key != "" {
+			usage.Configs++
+			usage.Bytes += e.Size
+		}
+		return true
+	})
+	if err != nil {
+		return NamespaceUsage{}, fmt.Errorf("failed to list namespace %s: %w", namespace, err)
+	}
+	return usage, nil
+}
+
+// Revisions implements Versioned, using the object versions of the config.
+// It returns ErrUnsupported unless the bucket has versioning enabled.
+func (s *S3Store) Revisions(namespace, name string) ([]Revision, error) {
+	versions, err := s.revisions(namespace, name)
+	if err != nil {
+		return nil, err
+	}
+	out := make([]Revision, len(versions))
+	for i, v := range versions {
+		out[i] = v.Revision
+	}
+	return out, nil
+}
+
+// GetRevision implements Versioned.
+func (s *S3Store) GetRevision(namespace, name string, revision int) ([]byte, error) {
+	versions, err := s.revisions(namespace, name)
+	if err != nil {
+		return nil, err
+	}
+	for _, v := range versions {
+		if v.Number != revision {
+			continue
+		}
+		resp, err := s.do(http.MethodGet, s.key(namespace, name), url.Values{"versionId": {v.versionID}}, nil, nil)
+		if err != nil {
+			return nil, fmt.Errorf("revision %d of config %s in namespace %s: %w", revision, name, namespace, err)
+		}
+		defer resp.Body.Close()
+		return io.ReadAll(resp.Body)
+	}
+	return nil, fmt.Errorf("revision %d of config %s in namespace %s: %w", revision, name, namespace, ErrNotFound)
+}
+
+// s3Revision is a revision together with the object version holding it.
+type s3Revision struct {
+	Revision
+	versionID string
+}
+
+// revisions lists the newest DefaultMaxRevisions versions of a config,
+// oldest first.
+func (s *S3Store) revisions(namespace, name string) ([]s3Revision, error) {
+	if err := validateS3Name(namespace, name); err != nil {
+		return nil, err
+	}
+	if !s.versioned {
+		return nil, fmt.Errorf("revision history without bucket versioning: %w", ErrUnsupported)
+	}
+	key := s.key(namespace, name)
+	versions, err := s.listVersions(key)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list revisions of config %s in namespace %s: %w", name, namespace, err)
+	}
+
+	// Versions come newest first. History starts after the latest delete
+	// marker, left by a delete from outside yamlet.
+	var live []s3ObjectVersion
+	for _, v := range versions {
+		if v.XMLName.Local == "DeleteMarker" {
+			break
+		}
+		live = append(live, v)
+		if len(live) == DefaultMaxRevisions {
+			break
+		}
+	}
+	if len(live) == 0 {
+		return nil, fmt.Errorf("config %s in namespace %s: %w", name, namespace, ErrNotFound)
+	}
+
+	out := make([]s3Revision, len(live))
+	for i, v := range live {
+		_, number, err := s.headVersion(key, v.VersionID)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read revision of config %s in namespace %s: %w", name, namespace, err)
+		}
+		out[len(live)-1-i] = s3Revision{
+			Revision:  Revision{Number: number, Size: int(v.Size), Created: v.LastModified.UTC()},
+			versionID: v.VersionID,
+		}
+	}
+	// Objects written without yamlet's metadata are numbered after their
+	// predecessor.
+	for i := range out {
+		if out[i].Number == 0 {
+			out[i].Number = 1
+			if i > 0 {
+				out[i].Number = out[i-1].Number + 1
+			}
+		}
+	}
+	return out, nil
+}
+
+type s3ObjectVersion struct {
+	XMLName      xml.Name
+	Key          string    `xml:"Key"`
+	VersionID    string    `xml:"VersionId"`
+	Size         int64     `xml:"Size"`
+	LastModified time.Time `xml:"LastModified"`
+}
+
+// listVersions lists the versions and delete markers of exactly key, newest
+// first.
+func (s *S3Store) listVersions(key string) ([]s3ObjectVersion, error) {
+	var out []s3ObjectVersion
+	query := url.Values{"versions": {""}, "prefix": {key}}
+	for {
+		var result struct {
+			IsTruncated         bool   `xml:"IsTruncated"`
+			NextKeyMarker       string `xml:"NextKeyMarker"`
+			NextVersionIDMarker string `xml:"NextVersionIdMarker"`
+			// Versions and delete markers are interleaved in order.
+			Entries []s3ObjectVersion `xml:",any"`
+		}
+		resp, err := s.do(http.MethodGet, "", query, nil, nil)
+		if err != nil {
+			return nil, err
+		}
+		if err := decodeXML(resp, &result); err != nil {
+			return nil, err
+		}
+		for _, e := range result.Entries {
+			if (e.XMLName.Local == "Version" || e.XMLName.Local == "DeleteMarker") && e.Key == key {
+				out = append(out, e)
+			}
+		}
+		if !result.IsTruncated {
+			return out, nil
+		}
+		query.Set("key-marker", result.NextKeyMarker)
+		query.Set("version-id-marker", result.NextVersionIDMarker)
+	}
+}
+
+// listObjects lists the keys directly under prefix and the common prefixes
+// one level below it.
+func (s *S3Store) listObjects(prefix string) ([]string, []string, error) {
+	var keys, prefixes []string
+	err := s.scanObjects(prefix, "", func(e s3Entry) bool {
+		if e.Key != "" {
+			keys = append(keys, e.Key)
+		} else {
+			prefixes = append(prefixes, e.CommonPrefix)
+		}
+		return true
+	})
+	return keys, prefixes, err
+}
+
+// s3Entry is an object or a common prefix in a listing.
+type s3Entry struct {
+	Key          string
+	Size         int64
+	CommonPrefix string
+}
+
+// scanObjects visits the keys directly under prefix that sort after
+// startAfter, and the common prefixes one level below it, in order. Pages
+// are fetched as visit asks for more by returning true.
+func (s *S3Store) scanObjects(prefix, startAfter string, visit func(e s3Entry) bool) error {
+	query := url.Values{"list-type": {"2"}, "prefix": {prefix}, "delimiter": {"/"}}
+	if startAfter != "" {
+		query.Set("start-after", startAfter)
+	}
+	for {
+		var result struct {
+			Contents []struct {
+				Key  string `xml:"Key"`
+				Size int64  `xml:"Size"`
+			} `xml:"Contents"`
+			CommonPrefixes []struct {
+				Prefix string `xml:"Prefix"`
+			} `xml:"CommonPrefixes"`
+			IsTruncated           bool   `xml:"IsTruncated"`
+			NextContinuationToken string `xml:"NextContinuationToken"`
+		}
+		resp, err := s.do(http.MethodGet, "", query, nil, nil)
+		if err != nil {
+			return err
+		}
+		if err := decodeXML(resp, &result); err != nil {
+			return err
+		}
+		for _, c := range result.Contents {
+			if !visit(s3Entry{Key: c.Key, Size: c.Size}) {
+				return nil
+			}
+		}
+		for _, p := range result.CommonPrefixes {
+			if !visit(s3Entry{CommonPrefix: p.Prefix}) {
+				return nil
+			}
+		}
+		if !result.IsTruncated {
+			return nil
+		}
+		query.Set("continuation-token", result.NextContinuationToken)
+	}
+}
+
+// s3Error is an error response from S3.
+type s3Error struct {
+	StatusCode int
+	Code       string `xml:"Code"`
+	Message    string `xml:"Message"`
+}
+
+func (e *s3Error) Error() string {
+	if e.Code == "" {
+		return fmt.Sprintf("S3 returned status %d", e.StatusCode)
+	}
+	return fmt.Sprintf("S3 error %s: %s", e.Code, e.Message)
+}
+
+// Unwrap maps S3 errors onto the storage sentinels.
+func (e *s3Error) Unwrap() error {
+	switch {
+	case e.StatusCode == http.StatusNotFound && e.Code != "NoSuchBucket":
+		return ErrNotFound
+	case e.StatusCode == http.StatusPreconditionFailed, e.Code == "ConditionalRequestConflict":
+		return ErrConflict
+	}
+	return nil
+}
+
+// do sends a signed request for key ("" for the bucket itself) and returns
+// the response, or an *s3Error for any status outside 2xx.
+func (s *S3Store) do(method, key string, query url.Values, header http.Header, body []byte) (*http.Response, error) {
+	ctx := context.Background()
+	creds, err := s.creds(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	u := *s.endpoint
+	path := strings.TrimSuffix(u.Path, "/")
+	if s.pathStyle {
+		path += "/" + s.bucket
+	} else {
+		u.Host = s.bucket + "." + u.Host
+	}
+	path += "/" + key
+	u.Path = path
+	u.RawPath = s3Escape(path, false)
+	u.RawQuery = s3CanonicalQuery(query)
+
+	req, err := http.NewRequestWithContext(ctx, method, u.String(), bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	for k, v := range header {
+		req.Header[k] = v
+	}
+	signS3Request(req, u.RawPath, body, creds, s.region, time.Now())
+
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode/100 == 2 {
+		return resp, nil
+	}
+	defer resp.Body.Close()
+	apiErr := &s3Error{StatusCode: resp.StatusCode}
+	if data, _ := io.ReadAll(io.LimitReader(resp.Body, 64<<10)); len(data) > 0 {
+		_ = xml.Unmarshal(data, apiErr)
+	}
+	return nil, apiErr
+}
+
+func decodeXML(resp *http.Response, v interface{}) error {
+	defer resp.Body.Close()
+	return xml.NewDecoder(resp.Body).Decode(v)
+}
+
+// s3Credentials are AWS access keys.
+type s3Credentials struct {
+	AccessKeyID     string
+	SecretAccessKey string
+	SessionToken    string
+}
+
+// signS3Request signs req with AWS Signature Version 4. canonicalPath is
+// the escaped path as sent.
+func signS3Request(req *http.Request, canonicalPath string, body []byte, creds s3Credentials, region string, now time.Time) {
+	now = now.UTC()
+	amzDate := now.Format("20060102T150405Z")
+	date := now.Format("20060102")
+	payloadHash := sha256Hex(body)
+
+	req.Header.Set("X-Amz-Date", amzDate)
+	req.Header.Set("X-Amz-Content-Sha256", payloadHash)
+	if creds.SessionToken != "" {
+		req.Header.Set("X-Amz-Security-Token", creds.SessionToken)
+	}
+
+	headers := map[string]string{"host": req.URL.Host}
+	for k, v := range req.Header {
+		headers[strings.ToLower(k)] = strings.TrimSpace(strings.Join(v, ","))
+	}
+	names := make([]string, 0, len(headers))
+	for k := range headers {
+		names = append(names, k)
+	}
+	sort.Strings(names)
+	var canonicalHeaders strings.Builder
+	for _, k := range names {
+		canonicalHeaders.WriteString(k + ":" + headers[k] + "\n")
+	}
+	signedHeaders := strings.Join(names, ";")
+
+	canonicalRequest := strings.Join([]string{
+		req.Method,
+		canonicalPath,
+		req.URL.RawQuery,
+		canonicalHeaders.String(),
+		signedHeaders,
+		payloadHash,
+	}, "\n")
+	scope := date + "/" + region + "/s3/aws4_request"
+	stringToSign := "AWS4-HMAC-SHA256\n" + amzDate + "\n" + scope + "\n" + sha256Hex([]byte(canonicalRequest))
+
+	key := hmacSHA256([]byte("AWS4"+creds.SecretAccessKey), date)
+	key = hmacSHA256(key, region)
+	key = hmacSHA256(key, "s3")
+	key = hmacSHA256(key, "aws4_request")
+	signature := hex.EncodeToString(hmacSHA256(key, stringToSign))
+
+	req.Header.Set("Authorization", fmt.Sprintf("AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		creds.AccessKeyID, scope, signedHeaders, signature))
+}
+
+// s3Escape percent-encodes everything but unreserved characters, and
+// slashes unless escapeSlash is set, as Signature Version 4 requires.
+func s3Escape(s string, escapeSlash bool) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if 'A' <= c && c <= 'Z' || 'a' <= c && c <= 'z' || '0' <= c && c <= '9' ||
+			c == '-' || c == '_' || c == '.' || c == '~' || c == '/' && !escapeSlash {
+			b.WriteByte(c)
+		} else {
+			fmt.Fprintf(&b, "%%%02X", c)
+		}
+	}
+	return b.String()
+}
+
+// s3CanonicalQuery encodes a query string in the sorted form that is both
+// sent and signed.
+func s3CanonicalQuery(query url.Values) string {
+	keys := make([]string, 0, len(query))
+	for k := range query {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	var parts []string
+	for _, k := range keys {
+		for _, v := range query[k] {
+			parts = append(parts, s3Escape(k, true)+"="+s3Escape(v, true))
+		}
+	}
+	return strings.Join(parts, "&")
+}
+
+func sha256Hex(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(data))
+	return mac.Sum(nil)
+}
+
+// instanceCredentials fetches the credentials of the EC2 instance role
+// from the instance metadata service (IMDSv2) and caches them until shortly
+// before they expire.
+type instanceCredentials struct {
+	client   *http.Client
+	endpoint string
+
+	mu      sync.Mutex
+	cached  s3Credentials
+	expires time.Time
+}
+
+func (c *instanceCredentials) get(ctx context.Context) (s3Credentials, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if time.Until(c.expires) > 5*time.Minute {
+		return c.cached, nil
+	}
+
+	token, err := c.call(ctx, http.MethodPut, "/latest/api/token", "")
+	if err != nil {
+		return s3Credentials{}, err
+	}
+	roles, err := c.call(ctx, http.MethodGet, "/latest/meta-data/iam/security-credentials/", token)
+	if err != nil {
+		return s3Credentials{}, err
+	}
+	role := strings.TrimSpace(strings.SplitN(roles, "\n", 2)[0])
+	if role == "" {
+		return s3Credentials{}, errors.New("no S3 credentials: the instance has no IAM role")
+	}
+	data, err := c.call(ctx, http.MethodGet, "/latest/meta-data/iam/security-credentials/"+role, token)
+	if err != nil {
+		return s3Credentials{}, err
+	}
+	var result struct {
+		AccessKeyID     string    `json:"AccessKeyId"`
+		SecretAccessKey string    `json:"SecretAccessKey"`
+		Token           string    `json:"Token"`
+		Expiration      time.Time `json:"Expiration"`
+	}
+	if err := json.Unmarshal([]byte(data), &result); err != nil {
+		return s3Credentials{}, fmt.Errorf("failed to parse instance credentials: %w", err)
+	}
+	c.cached = s3Credentials{result.AccessKeyID, result.SecretAccessKey, result.Token}
+	c.expires = result.Expiration
+	return c.cached, nil
+}
+
+func (c *instanceCredentials) call(ctx context.Context, method, path, token string) (string, error) {
+	req, err := http.NewRequestWithContext(ctx, method, c.endpoint+path, nil)
+	if err != nil {
+		return "", err
+	}
+	if token == "" {
+		req.Header.Set("X-Aws-Ec2-Metadata-Token-Ttl-Seconds", "21600")
+	} else {
+		req.Header.Set("X-Aws-Ec2-Metadata-Token", token)
+	}
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return "", fmt.Errorf("no S3 credentials configured and the instance metadata service is unreachable: %w", err)
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(io.LimitReader(resp.Body, 64<<10))
+	if err != nil {
+		return "", err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("instance metadata service returned status %d for %s", resp.StatusCode, path)
+	}
+	return string(body), nil
+}
+
+// Trash implements Trasher. The item is written before the config is
+// deleted, so an interrupted call leaves both rather than neither.
+func (s *S3Store) Trash(_ Author, namespace, name string) (TrashItem, error) {
+	if err := validateS3Name(namespace, name); err != nil {
+		return TrashItem{}, err
+	}
+	content, err := s.Get(namespace, name)
+	if err != nil {
+		return TrashItem{}, err
+	}
+	var md *Metadata
+	record, err := s.Metadata(namespace, name)
+	switch {
+	case err == nil:
+		md = &record
+	case !errors.Is(err, ErrNotFound):
+		return TrashItem{}, err
+	}
+	rec, err := newTrashRecord(name, content, md)
+	if err != nil {
+		return TrashItem{}, err
+	}
+	if err := s.putTrashRecord(namespace, rec, ""); err != nil {
+		return TrashItem{}, err
+	}
+	if err := s.Delete(namespace, name); err != nil {
+		return TrashItem{}, err
+	}
+	return rec.TrashItem, nil
+}
+
+// putTrashRecord writes a trash item, if its current ETag is etag when
+// one is given.
+func (s *S3Store) putTrashRecord(namespace string, rec trashRecord, etag string) error {
+	data, err := json.Marshal(rec)
+	if err != nil {
+		return err
+	}
+	header := http.Header{}
+	header.Set("Content-Type", "application/json")
+	if etag != "" {
+		header.Set("If-Match", etag)
+	}
+	resp, err := s.do(http.MethodPut, s.trashKey(namespace, rec.ID), nil, header, data)
+	if err != nil {
+		return fmt.Errorf("failed to store trash item %s in namespace %s: %w", rec.ID, namespace, err)
+	}
+	resp.Body.Close()
+	return nil
+}
+
+// trashRecord reads a trash item together with its ETag.
+func (s *S3Store) trashRecord(namespace, id string) (trashRecord, string, error) {
+	resp, err := s.do(http.MethodGet, s.trashKey(namespace, id), nil, nil, nil)
+	if errors.Is(err, ErrNotFound) {
+		return trashRecord{}, "", errTrashItemNotFound(namespace, id)
+	}
+	if err != nil {
+		return trashRecord{}, "", fmt.Errorf("failed to read trash item %s in namespace %s: %w", id, namespace, err)
+	}
+	defer resp.Body.Close()
+	var rec trashRecord
+	if err := json.NewDecoder(resp.Body).Decode(&rec); err != nil {
+		return trashRecord{}, "", fmt.Errorf("failed to parse trash item %s in namespace %s: %w", id, namespace, err)
+	}
+	return rec, resp.Header.Get("ETag"), nil
+}
+
+// TrashItems implements Trasher, fetching every item in the namespace's
+// trash.
+func (s *S3Store) TrashItems(namespace string) ([]TrashItem, error) {
+	if err := validateS3Namespace(namespace); err != nil {
+		return nil, err
+	}
+	keys, _, err := s.listObjects(s.trashPrefix() + namespace + "/")
+	if err != nil {
+		return nil, fmt.Errorf("failed to list trash of namespace %s: %w", namespace, err)
+	}
+	items := []TrashItem{}
+	for _, key := range keys {
+		rec, _, err := s.trashRecord(namespace, path.Base(key))
+		if errors.Is(err, ErrNotFound) {
+			continue // purged since listed
+		}
+		if err != nil {
+			return nil, err
+		}
+		items = append(items, rec.TrashItem)
+	}
+	sortTrash(items)
+	return items, nil
+}
+
+// Restore implements Trasher. The config is written conditionally on the
+// version checked for a conflict, so a config stored under the name
+// meanwhile is not overwritten unseen.
+func (s *S3Store) Restore(_ Author, namespace, id string, opts RestoreOptions) (TrashItem, error) {
+	if err := validateS3Name(namespace, id); err != nil {
+		return TrashItem{}, err
+	}
+	rec, _, err := s.trashRecord(namespace, id)
+	if err != nil {
+		return TrashItem{}, err
+	}
+	name := opts.restoreTarget(rec.TrashItem)
+	if err := validateName(name); err != nil {
+		return TrashItem{}, err
+	}
+	etag, revision, err := s.head(s.key(namespace, name))
+	switch {
+	case err == nil && !opts.Overwrite:
+		return TrashItem{}, errConfigExists(namespace, name)
+	case err != nil && !errors.Is(err, ErrNotFound):
+		return TrashItem{}, fmt.Errorf("failed to read config %s in namespace %s: %w", name, namespace, err)
+	}
+	content, err := opts.restoreContent(rec.TrashItem, rec.Content)
+	if err != nil {
+		return TrashItem{}, err
+	}
+	if etag != s3ContentETag(content) {
+		if _, err := s.put(namespace, name, content, etag, revision+1); err != nil {
+			return TrashItem{}, err
+		}
+	}
+	if rec.Metadata != nil {
+		err = s.SetMetadata(namespace, name, *rec.Metadata)
+	} else {
+		err = s.deleteObject(s.metadataKey(namespace, name))
+	}
+	if err != nil {
+		return TrashItem{}, fmt.Errorf("failed to restore metadata of config %s in namespace %s: %w", name, namespace, err)
+	}
+	if err := s.deleteObject(s.trashKey(namespace, id)); err != nil {
+		return TrashItem{}, fmt.Errorf("failed to purge trash item %s in namespace %s: %w", id, namespace, err)
+	}
+	return restoredItem(rec.TrashItem, name), nil
+}
+
+// Purge implements Trasher.
+func (s *S3Store) Purge(namespace, id string) error {
+	if err := validateS3Name(namespace, id); err != nil {
+		return err
+	}
+	key := s.trashKey(namespace, id)
+	if _, _, err := s.head(key); errors.Is(err, ErrNotFound) {
+		return errTrashItemNotFound(namespace, id)
+	} else if err != nil {
+		return fmt.Errorf("failed to read trash item %s in namespace %s: %w", id, namespace, err)
+	}
+	if err := s.deleteObject(key); err != nil {
+		return fmt.Errorf("failed to purge trash item %s in namespace %s: %w", id, namespace, err)
+	}
+	return nil
+}
+
+// PurgeTrash implements Trasher. Deletion times are read from the item
+// IDs, so only the listing is fetched.
+func (s *S3Store) PurgeTrash(cutoff time.Time) (int, error) {
+	_, namespaces, err := s.listObjects(s.trashPrefix())
+	if err != nil {
+		return 0, fmt.Errorf("failed to list trash: %w", err)
+	}
+	purged := 0
+	for _, prefix := range namespaces {
+		keys, _, err := s.listObjects(prefix)
+		if err != nil {
+			return purged, fmt.Errorf("failed to list trash: %w", err)
+		}
+		for _, key := range keys {
+			if deleted, ok := trashDeleted(path.Base(key)); !ok || !deleted.Before(cutoff) {
+				continue
+			}
+			if err := s.deleteObject(key); err != nil {
+				return purged, fmt.Errorf("failed to purge trash: %w", err)
+			}
+			purged++
+		}
+	}
+	return purged, nil
+}
+
+// RewriteTrash implements Trasher. The item is written conditionally on
+// the version read, so ErrConflict reports a concurrent change.
+func (s *S3Store) RewriteTrash(namespace, id string, fn func([]byte) ([]byte, error)) error {
+	if err := validateS3Name(namespace, id); err != nil {
+		return err
+	}
+	rec, etag, err := s.trashRecord(namespace, id)
+	if err != nil {
+		return err
+	}
+	content, err := fn(rec.Content)
+	if err != nil {
+		return err
+	}
+	rec.Content = content
+	return s.putTrashRecord(namespace, rec, etag)
+}
+
+// LoadKeyTable implements KeyTable. The key table is an object in the
+// bucket, so replicas sharing the bucket share the data keys; its ETag is
+// the revision.
+func (s *S3Store) LoadKeyTable() ([]byte, string, error) {
+	resp, err := s.do(http.MethodGet, s.keyTableKey(), nil, nil, nil)
+	if errors.Is(err, ErrNotFound) {
+		return nil, "", nil
+	}
+	if err != nil {
+		return nil, "", fmt.Errorf("failed to read key table: %w", err)
+	}
+	defer resp.Body.Close()
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, "", fmt.Errorf("failed to read key table: %w", err)
+	}
+	return data, resp.Header.Get("ETag"), nil
+}
+
+// KeyTableRevision implements KeyTable.
+func (s *S3Store) KeyTableRevision() (string, error) {
+	etag, _, err := s.head(s.keyTableKey())
+	if errors.Is(err, ErrNotFound) {
+		return "", nil
+	}
+	if err != nil {
+		return "", fmt.Errorf("failed to read key table: %w", err)
+	}
+	return etag, nil
+}
+
+// SaveKeyTable implements KeyTable with a conditional PUT.
+func (s *S3Store) SaveKeyTable(data []byte, revision string) (string, error) {
+	header := http.Header{}
+	header.Set("Content-Type", "application/json")
+	if revision == "" {
+		header.Set("If-None-Match", "*")
+	} else {
+		header.Set("If-Match", revision)
+	}
+	resp, err := s.do(http.MethodPut, s.keyTableKey(), nil, header, data)
+	if err != nil {
+		return "", fmt.Errorf("failed to store key table: %w", err)
+	}
+	resp.Body.Close()
+	return resp.Header.Get("ETag"), nil
+}
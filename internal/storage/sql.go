@@ -0,0 +1,1166 @@
+package storage
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+
+	"github.com/lib/pq"
+)
+
+// sqlDialect holds what differs between the SQL databases SQLStore
+// supports. Queries are otherwise shared: both SQLite and PostgreSQL accept
+// $n placeholders, ON CONFLICT upserts and RETURNING. SQLite numbers
+// placeholders by first appearance, so they must appear in order.
+type sqlDialect struct {
+	name string
+	// blob is the column type for config content.
+	blob string
+	// forUpdate is appended to reads that are followed by a write of the
+	// same row in one transaction.
+	forUpdate string
+	// migrationLock, if set, is run first in the migration transaction so
+	// replicas starting together apply migrations one at a time.
+	migrationLock string
+	// maxOpenConns limits the connection pool; 0 leaves it unlimited.
+	maxOpenConns int
+	// notify, if set, is run in every writing transaction with
+	// "<namespace>/<name>" as $1 to tell watchers about the change.
+	notify string
+	// bytewise is appended to names compared or ordered in queries so that
+	// they sort by bytes, like the other stores, whatever the collation.
+	bytewise string
+	// snapshot are the options of the transaction Export reads in, so that
+	// it sees a single point in time; nil for the default, which already
+	// does.
+	snapshot *sql.TxOptions
+}
+
+var sqlDialects = map[string]sqlDialect{
+	"sqlite": {name: "sqlite", blob: "BLOB", maxOpenConns: 1},
+	"postgres": {
+		name:          "postgres",
+		blob:          "BYTEA",
+		forUpdate:     " FOR UPDATE",
+		migrationLock: "SELECT pg_advisory_xact_lock(7955110137)",
+		notify:        "SELECT pg_notify('" + sqlChangeChannel + "', $1)",
+		bytewise:      ` COLLATE "C"`,
+		snapshot:      &sql.TxOptions{Isolation: sql.LevelRepeatableRead, ReadOnly: true},
+	},
+}
+
+// sqlChangeChannel is the PostgreSQL notification channel changes are
+// announced on.
+const sqlChangeChannel = "yamlet_changes"
+
+// sqlMigrations builds the schema, one entry per version. Applied versions
+// are recorded in yamlet_schema; released entries must never change, new
+// ones are appended.
+var sqlMigrations = []func(d sqlDialect) []string{
+	// 1: configs, their revisions, and per-config metadata.
+	func(d sqlDialect) []string {
+		return []string{
+			`CREATE TABLE yamlet_configs (
+				namespace TEXT NOT NULL,
+				name TEXT NOT NULL,
+				content ` + d.blob + ` NOT NULL,
+				revision BIGINT NOT NULL,
+				updated BIGINT NOT NULL,
+				PRIMARY KEY (namespace, name)
+			)`,
+			`CREATE TABLE yamlet_revisions (
+				namespace TEXT NOT NULL,
+				name TEXT NOT NULL,
+				revision BIGINT NOT NULL,
+				content ` + d.blob + ` NOT NULL,
+				created BIGINT NOT NULL,
+				PRIMARY KEY (namespace, name, revision)
+			)`,
+			`CREATE TABLE yamlet_metadata (
+				namespace TEXT NOT NULL,
+				name TEXT NOT NULL,
+				key TEXT NOT NULL,
+				value TEXT NOT NULL,
+				PRIMARY KEY (namespace, name, key)
+			)`,
+		}
+	},
+	// 2: namespace records, as JSON.
+	func(d sqlDialect) []string {
+		return []string{
+			`CREATE TABLE yamlet_namespaces (
+				namespace TEXT NOT NULL PRIMARY KEY,
+				record TEXT NOT NULL
+			)`,
+		}
+	},
+	// 3: trash items, with their metadata records as JSON ('' for none).
+	func(d sqlDialect) []string {
+		return []string{
+			`CREATE TABLE yamlet_trash (
+				namespace TEXT NOT NULL,
+				id TEXT NOT NULL,
+				name TEXT NOT NULL,
+				content ` + d.blob + ` NOT NULL,
+				metadata TEXT NOT NULL,
+				deleted BIGINT NOT NULL,
+				PRIMARY KEY (namespace, id)
+			)`,
+		}
+	},
+	// 4: the key table of encryption at rest, as a single row.
+	func(d sqlDialect) []string {
+		return []string{
+			`CREATE TABLE yamlet_keys (
+				id INTEGER NOT NULL PRIMARY KEY,
+				revision BIGINT NOT NULL,
+				data ` + d.blob + ` NOT NULL
+			)`,
+		}
+	},
+}
+
+// SQLStore implements storage over database/sql, with SQLite for single
+// nodes and PostgreSQL for state shared by several replicas. Every write,
+// together with its revision, is one transaction, and revision numbers are
+// assigned by the database so concurrent writers never collide.
+type SQLStore struct {
+	db           *sql.DB
+	dsn          string
+	dialect      sqlDialect
+	maxRevisions int
+}
+
+// NewSQLStore connects to a database through a registered database/sql
+// driver ("sqlite" or "postgres") and migrates its schema to the current
+// version. The driver must be imported by the caller.
+func NewSQLStore(driver, dsn string) (*SQLStore, error) {
+	dialect, ok := sqlDialects[driver]
+	if !ok {
+		return nil, fmt.Errorf("SQL driver %q: %w", driver, ErrUnsupported)
+	}
+	db, err := sql.Open(driver, dsn)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open %s database: %w", dialect.name, err)
+	}
+	if dialect.maxOpenConns > 0 {
+		db.SetMaxOpenConns(dialect.maxOpenConns)
+	}
+	if err := db.Ping(); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("failed to connect to %s database: %w", dialect.name, err)
+	}
+
+	s := &SQLStore{db: db, dsn: dsn, dialect: dialect, maxRevisions: DefaultMaxRevisions}
+	if err := s.migrate(); err != nil {
+		db.Close()
+		return nil, err
+	}
+	return s, nil
+}
+
+// Close closes the database connections.
+func (s *SQLStore) Close() error {
+	return s.db.Close()
+}
+
+// migrate applies the migrations the database has not seen yet.
+func (s *SQLStore) migrate() error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return fmt.Errorf("failed to migrate schema: %w", err)
+	}
+	defer tx.Rollback()
+
+	if s.dialect.migrationLock != "" {
+		if _, err := tx.Exec(s.dialect.migrationLock); err != nil {
+			return fmt.Errorf("failed to lock schema: %w", err)
+		}
+	}
+	if _, err := tx.Exec(`CREATE TABLE IF NOT EXISTS yamlet_schema (version INTEGER NOT NULL)`); err != nil {
+		return fmt.Errorf("failed to create schema table: %w", err)
+	}
+	var version int
+	if err := tx.QueryRow(`SELECT COALESCE(MAX(version), 0) FROM yamlet_schema`).Scan(&version); err != nil {
+		return fmt.Errorf("failed to read schema version: %w", err)
+	}
+	if version > len(sqlMigrations) {
+		return fmt.Errorf("database schema version %d is newer than this server supports (%d)", version, len(sqlMigrations))
+	}
+
+	for v := version + 1; v <= len(sqlMigrations); v++ {
+		for _, stmt := range sqlMigrations[v-1](s.dialect) {
+			if _, err := tx.Exec(stmt); err != nil {
+				return fmt.Errorf("failed to apply schema migration %d: %w", v, err)
+			}
+		}
+		if _, err := tx.Exec(`INSERT INTO yamlet_schema (version) VALUES ($1)`, v); err != nil {
+			return fmt.Errorf("failed to record schema migration %d: %w", v, err)
+		}
+	}
+	return tx.Commit()
+}
+
+// SchemaVersion returns the schema version the database is at.
+func (s *SQLStore) SchemaVersion() (int, error) {
+	var version int
+	err := s.db.QueryRow(`SELECT COALESCE(MAX(version), 0) FROM yamlet_schema`).Scan(&version)
+	return version, err
+}
+
+func (s *SQLStore) Store(namespace, name string, content []byte) error {
+	if err := validateNamespaceAndName(namespace, name); err != nil {
+		return err
+	}
+	if content == nil {
+		// nil would be stored as NULL.
+		content = []byte{}
+	}
+
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if err := s.storeTx(tx, namespace, name, content); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// storeTx writes a config and records it as the next revision in tx.
+func (s *SQLStore) storeTx(tx *sql.Tx, namespace, name string, content []byte) error {
+	now := time.Now().UTC().UnixNano()
+	var revision int64
+	err := tx.QueryRow(`INSERT INTO yamlet_configs (namespace, name, content, revision, updated)
+		VALUES ($1, $2, $3, 1, $4)
+		ON CONFLICT (namespace, name) DO UPDATE
+		SET content = excluded.content, revision = yamlet_configs.revision + 1, updated = excluded.updated
+		RETURNING revision`, namespace, name, content, now).Scan(&revision)
+	if err != nil {
+		return fmt.Errorf("failed to store config %s in namespace %s: %w", name, namespace, err)
+	}
+	_, err = tx.Exec(`INSERT INTO yamlet_revisions (namespace, name, revision, content, created)
+		VALUES ($1, $2, $3, $4, $5)`, namespace, name, revision, content, now)
+	if err != nil {
+		return fmt.Errorf("failed to record revision %d of config %s in namespace %s: %w", revision, name, namespace, err)
+	}
+	_, err = tx.Exec(`DELETE FROM yamlet_revisions WHERE namespace = $1 AND name = $2 AND revision <= $3`,
+		namespace, name, revision-int64(s.maxRevisions))
+	if err != nil {
+		return fmt.Errorf("failed to prune revisions of config %s in namespace %s: %w", name, namespace, err)
+	}
+	return s.notifyChange(tx, namespace, name)
+}
+
+func (s *SQLStore) Get(namespace, name string) ([]byte, error) {
+	if err := validateNamespaceAndName(namespace, name); err != nil {
+		return nil, err
+	}
+
+	return getSQL(s.db, namespace, name)
+}
+
+// getSQL reads a config through q.
+func getSQL(q sqlQuerier, namespace, name string) ([]byte, error) {
+	var content []byte
+	err := q.QueryRow(`SELECT content FROM yamlet_configs WHERE namespace = $1 AND name = $2`,
+		namespace, name).Scan(&content)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, fmt.Errorf("config %s in namespace %s: %w", name, namespace, ErrNotFound)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read config %s in namespace %s: %w", name, namespace, err)
+	}
+	return content, nil
+}
+
+func (s *SQLStore) Delete(namespace, name string) error {
+	if err := validateNamespaceAndName(namespace, name); err != nil {
+		return err
+	}
+
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if err := s.deleteTx(tx, namespace, name); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// deleteTx deletes a config with its revisions and metadata in tx.
+func (s *SQLStore) deleteTx(tx *sql.Tx, namespace, name string) error {
+	res, err := tx.Exec(`DELETE FROM yamlet_configs WHERE namespace = $1 AND name = $2`, namespace, name)
+	if err != nil {
+		return fmt.Errorf("failed to delete config %s in namespace %s: %w", name, namespace, err)
+	}
+	if n, err := res.RowsAffected(); err != nil {
+		return err
+	} else if n == 0 {
+		return fmt.Errorf("config %s in namespace %s: %w", name, namespace, ErrNotFound)
+	}
+	for _, table := range []string{"yamlet_revisions", "yamlet_metadata"} {
+		if _, err := tx.Exec(`DELETE FROM `+table+` WHERE namespace = $1 AND name = $2`, namespace, name); err != nil {
+			return fmt.Errorf("failed to delete config %s in namespace %s: %w", name, namespace, err)
+		}
+	}
+	return s.notifyChange(tx, namespace, name)
+}
+
+func (s *SQLStore) List(namespace string) ([]string, error) {
+	if err := validateName(namespace); err != nil {
+		return nil, err
+	}
+
+	return listSQL(s.db, namespace)
+}
+
+// listSQL lists a namespace through q.
+func listSQL(q sqlQuerier, namespace string) ([]string, error) {
+	configs, err := queryStrings(q, `SELECT name FROM yamlet_configs WHERE namespace = $1`, namespace)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list namespace %s: %w", namespace, err)
+	}
+	return configs, nil
+}
+
+// Query implements Querier. Everything but glob patterns is matched in the
+// database, labels through the metadata rows, so only the page is read.
+func (s *SQLStore) Query(namespace string, opts ListOptions) (ListPage, error) {
+	if err := validateName(namespace); err != nil {
+		return ListPage{}, err
+	}
+	if err := opts.Validate(); err != nil {
+		return ListPage{}, err
+	}
+
+	args := []interface{}{namespace}
+	arg := func(v interface{}) string {
+		args = append(args, v)
+		return "$" + strconv.Itoa(len(args))
+	}
+	column := "c.name" + s.dialect.bytewise
+	query := `SELECT c.name FROM yamlet_configs c WHERE c.namespace = $1`
+	if opts.Prefix != "" {
+		query += fmt.Sprintf(" AND %s >= %s AND substr(c.name, 1, %d) = %s",
+			column, arg(opts.Prefix), utf8.RuneCountInString(opts.Prefix), arg(opts.Prefix))
+	}
+	if opts.After != "" {
+		op := ">"
+		if opts.Descending {
+			op = "<"
+		}
+		query += fmt.Sprintf(" AND %s %s %s", column, op, arg(opts.After))
+	}
+	for _, req := range opts.Selector.requirements {
+		cond := fmt.Sprintf(`SELECT 1 FROM yamlet_metadata m
+			WHERE m.namespace = c.namespace AND m.name = c.name AND m.key = %s`, arg(sqlLabelPrefix+req.key))
+		if len(req.values) > 0 {
+			placeholders := make([]string, len(req.values))
+			for i, v := range req.values {
+				placeholders[i] = arg(v)
+			}
+			cond += " AND m.value IN (" + strings.Join(placeholders, ", ") + ")"
+		}
+		if req.op == labelIn || req.op == labelExists {
+			query += " AND EXISTS (" + cond + ")"
+		} else {
+			query += " AND NOT EXISTS (" + cond + ")"
+		}
+	}
+	query += " ORDER BY " + column
+	if opts.Descending {
+		query += " DESC"
+	}
+	if opts.Limit > 0 && opts.Glob == "" {
+		// One more than the page tells whether another page follows.
+		query += " LIMIT " + strconv.Itoa(opts.Limit+1)
+	}
+
+	rows, err := s.db.Query(query, args...)
+	if err != nil {
+		return ListPage{}, fmt.Errorf("failed to list namespace %s: %w", namespace, err)
+	}
+	defer rows.Close()
+
+	// The database already applied the selector.
+	filter := opts
+	filter.Selector = LabelSelector{}
+	p := newPager(filter)
+	for rows.Next() {
+		var name string
+		if err := rows.Scan(&name); err != nil {
+			return ListPage{}, err
+		}
+		if more, _ := p.add(name, nil); !more {
+			break
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return ListPage{}, fmt.Errorf("failed to list namespace %s: %w", namespace, err)
+	}
+	return p.page, nil
+}
+
+// PruneRevisions implements Pruner.
+func (s *SQLStore) PruneRevisions(namespace, name string, keep int) error {
+	if err := validateNamespaceAndName(namespace, name); err != nil {
+		return err
+	}
+
+	var revision int64
+	err := s.db.QueryRow(`SELECT revision FROM yamlet_configs WHERE namespace = $1 AND name = $2`,
+		namespace, name).Scan(&revision)
+	if errors.Is(err, sql.ErrNoRows) {
+		return fmt.Errorf("config %s in namespace %s: %w", name, namespace, ErrNotFound)
+	}
+	if err != nil {
+		return fmt.Errorf("failed to read config %s in namespace %s: %w", name, namespace, err)
+	}
+	_, err = s.db.Exec(`DELETE FROM yamlet_revisions WHERE namespace = $1 AND name = $2 AND revision <= $3`,
+		namespace, name, revision-int64(max(keep, 1)))
+	if err != nil {
+		return fmt.Errorf("failed to prune revisions of config %s in namespace %s: %w", name, namespace, err)
+	}
+	return nil
+}
+
+// Revisions implements Versioned.
+func (s *SQLStore) Revisions(namespace, name string) ([]Revision, error) {
+	if err := validateNamespaceAndName(namespace, name); err != nil {
+		return nil, err
+	}
+
+	return revisionsSQL(s.db, namespace, name)
+}
+
+// revisionsSQL lists the revisions of a config through q.
+func revisionsSQL(q sqlQuerier, namespace, name string) ([]Revision, error) {
+	rows, err := q.Query(`SELECT revision, length(content), created FROM yamlet_revisions
+		WHERE namespace = $1 AND name = $2 ORDER BY revision`, namespace, name)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list revisions of config %s in namespace %s: %w", name, namespace, err)
+	}
+	defer rows.Close()
+
+	var out []Revision
+	for rows.Next() {
+		var rev Revision
+		var created int64
+		if err := rows.Scan(&rev.Number, &rev.Size, &created); err != nil {
+			return nil, err
+		}
+		rev.Created = time.Unix(0, created).UTC()
+		out = append(out, rev)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	if len(out) == 0 {
+		return nil, fmt.Errorf("config %s in namespace %s: %w", name, namespace, ErrNotFound)
+	}
+	return out, nil
+}
+
+// GetRevision implements Versioned.
+func (s *SQLStore) GetRevision(namespace, name string, revision int) ([]byte, error) {
+	if err := validateNamespaceAndName(namespace, name); err != nil {
+		return nil, err
+	}
+
+	return getRevisionSQL(s.db, namespace, name, revision)
+}
+
+// getRevisionSQL reads a revision of a config through q.
+func getRevisionSQL(q sqlQuerier, namespace, name string, revision int) ([]byte, error) {
+	var content []byte
+	err := q.QueryRow(`SELECT content FROM yamlet_revisions WHERE namespace = $1 AND name = $2 AND revision = $3`,
+		namespace, name, revision).Scan(&content)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, fmt.Errorf("revision %d of config %s in namespace %s: %w", revision, name, namespace, ErrNotFound)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read revision %d of config %s in namespace %s: %w", revision, name, namespace, err)
+	}
+	return content, nil
+}
+
+// Rewrite implements Rewriter. The config and all of its revisions are
+// rewritten in a single transaction, which holds the config's row lock
+// against concurrent writers.
+func (s *SQLStore) Rewrite(namespace, name string, fn func([]byte) ([]byte, error)) error {
+	if err := validateNamespaceAndName(namespace, name); err != nil {
+		return err
+	}
+
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	var current []byte
+	err = tx.QueryRow(`SELECT content FROM yamlet_configs WHERE namespace = $1 AND name = $2`+s.dialect.forUpdate,
+		namespace, name).Scan(&current)
+	if errors.Is(err, sql.ErrNoRows) {
+		return fmt.Errorf("config %s in namespace %s: %w", name, namespace, ErrNotFound)
+	}
+	if err != nil {
+		return fmt.Errorf("failed to read config %s in namespace %s: %w", name, namespace, err)
+	}
+	content, err := fn(current)
+	if err != nil {
+		return err
+	}
+	if _, err := tx.Exec(`UPDATE yamlet_configs SET content = $1 WHERE namespace = $2 AND name = $3`,
+		content, namespace, name); err != nil {
+		return fmt.Errorf("failed to rewrite config %s in namespace %s: %w", name, namespace, err)
+	}
+
+	rows, err := tx.Query(`SELECT revision, content FROM yamlet_revisions WHERE namespace = $1 AND name = $2`,
+		namespace, name)
+	if err != nil {
+		return fmt.Errorf("failed to read revisions of config %s in namespace %s: %w", name, namespace, err)
+	}
+	revisions := make(map[int64][]byte)
+	for rows.Next() {
+		var revision int64
+		var old []byte
+		if err := rows.Scan(&revision, &old); err != nil {
+			rows.Close()
+			return err
+		}
+		revisions[revision] = old
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	for revision, old := range revisions {
+		content, err := fn(old)
+		if err != nil {
+			return err
+		}
+		if _, err := tx.Exec(`UPDATE yamlet_revisions SET content = $1 WHERE namespace = $2 AND name = $3 AND revision = $4`,
+			content, namespace, name, revision); err != nil {
+			return fmt.Errorf("failed to rewrite revision %d of config %s in namespace %s: %w", revision, name, namespace, err)
+		}
+	}
+	if err := s.notifyChange(tx, namespace, name); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// notifyChange announces a change to watchers when the transaction commits.
+func (s *SQLStore) notifyChange(tx *sql.Tx, namespace, name string) error {
+	if s.dialect.notify == "" {
+		return nil
+	}
+	if _, err := tx.Exec(s.dialect.notify, namespace+"/"+name); err != nil {
+		return fmt.Errorf("failed to announce change of config %s in namespace %s: %w", name, namespace, err)
+	}
+	return nil
+}
+
+// Watch implements Watcher with PostgreSQL's LISTEN and NOTIFY; SQLite
+// databases are not shared, so they do not support it. The listener
+// reconnects on its own and reports a change of everything when it does.
+func (s *SQLStore) Watch(changed func(namespace, name string)) (func(), error) {
+	if s.dialect.notify == "" {
+		return nil, fmt.Errorf("change notifications with %s: %w", s.dialect.name, ErrUnsupported)
+	}
+	listener := pq.NewListener(s.dsn, time.Second, time.Minute, nil)
+	if err := listener.Listen(sqlChangeChannel); err != nil {
+		listener.Close()
+		return nil, fmt.Errorf("failed to listen for changes: %w", err)
+	}
+
+	done := make(chan struct{})
+	go func() {
+		for {
+			select {
+			case <-done:
+				return
+			case n, ok := <-listener.Notify:
+				if !ok {
+					return
+				}
+				if n == nil {
+					// Reconnected; notifications may have been lost.
+					changed("", "")
+					continue
+				}
+				namespace, name, _ := strings.Cut(n.Extra, "/")
+				changed(namespace, name)
+			}
+		}
+	}()
+
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			close(done)
+			listener.Close()
+		})
+	}, nil
+}
+
+// Metadata rows in yamlet_metadata hold the fixed fields under their JSON
+// names, and each label and annotation under its key with these prefixes,
+// so that labels can be matched in queries.
+const (
+	sqlLabelPrefix      = "label:"
+	sqlAnnotationPrefix = "annotation:"
+)
+
+// Metadata implements MetadataStore.
+func (s *SQLStore) Metadata(namespace, name string) (Metadata, error) {
+	if err := validateNamespaceAndName(namespace, name); err != nil {
+		return Metadata{}, err
+	}
+
+	return readSQLMetadata(s.db, namespace, name)
+}
+
+// sqlQuerier is what *sql.DB and *sql.Tx have in common for reads.
+type sqlQuerier interface {
+	Query(query string, args ...interface{}) (*sql.Rows, error)
+	QueryRow(query string, args ...interface{}) *sql.Row
+}
+
+// readSQLMetadata reads a config's metadata rows through q.
+func readSQLMetadata(q sqlQuerier, namespace, name string) (Metadata, error) {
+	rows, err := q.Query(`SELECT key, value FROM yamlet_metadata WHERE namespace = $1 AND name = $2`,
+		namespace, name)
+	if err != nil {
+		return Metadata{}, fmt.Errorf("failed to read metadata of config %s in namespace %s: %w", name, namespace, err)
+	}
+	defer rows.Close()
+
+	var md Metadata
+	found := false
+	for rows.Next() {
+		var key, value string
+		if err := rows.Scan(&key, &value); err != nil {
+			return Metadata{}, err
+		}
+		found = true
+		switch {
+		case strings.HasPrefix(key, sqlLabelPrefix):
+			if md.Labels == nil {
+				md.Labels = make(map[string]string)
+			}
+			md.Labels[strings.TrimPrefix(key, sqlLabelPrefix)] = value
+		case strings.HasPrefix(key, sqlAnnotationPrefix):
+			if md.Annotations == nil {
+				md.Annotations = make(map[string]string)
+			}
+			md.Annotations[strings.TrimPrefix(key, sqlAnnotationPrefix)] = value
+		case key == "created":
+			md.Created, _ = time.Parse(time.RFC3339Nano, value)
+		case key == "updated":
+			md.Updated, _ = time.Parse(time.RFC3339Nano, value)
+		case key == "updated_by":
+			md.UpdatedBy = value
+		case key == "size":
+			md.Size, _ = strconv.Atoi(value)
+		case key == "sha256":
+			md.SHA256 = value
+		case key == "content_type":
+			md.ContentType = value
+		case key == "expires_at":
+			md.Expires, _ = time.Parse(time.RFC3339Nano, value)
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return Metadata{}, err
+	}
+	if !found {
+		return Metadata{}, fmt.Errorf("metadata of config %s in namespace %s: %w", name, namespace, ErrNotFound)
+	}
+	return md, nil
+}
+
+// SetMetadata implements MetadataStore.
+func (s *SQLStore) SetMetadata(namespace, name string, md Metadata) error {
+	if err := validateNamespaceAndName(namespace, name); err != nil {
+		return err
+	}
+
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	var exists int
+	err = tx.QueryRow(`SELECT 1 FROM yamlet_configs WHERE namespace = $1 AND name = $2`+s.dialect.forUpdate,
+		namespace, name).Scan(&exists)
+	if errors.Is(err, sql.ErrNoRows) {
+		return fmt.Errorf("config %s in namespace %s: %w", name, namespace, ErrNotFound)
+	}
+	if err != nil {
+		return fmt.Errorf("failed to read config %s in namespace %s: %w", name, namespace, err)
+	}
+	if err := writeSQLMetadata(tx, namespace, name, &md); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// writeSQLMetadata replaces a config's metadata rows in tx, or deletes
+// them for a nil md.
+func writeSQLMetadata(tx *sql.Tx, namespace, name string, md *Metadata) error {
+	if _, err := tx.Exec(`DELETE FROM yamlet_metadata WHERE namespace = $1 AND name = $2`, namespace, name); err != nil {
+		return fmt.Errorf("failed to replace metadata of config %s in namespace %s: %w", name, namespace, err)
+	}
+	if md == nil {
+		return nil
+	}
+
+	pairs := map[string]string{
+		"created":      md.Created.UTC().Format(time.RFC3339Nano),
+		"updated":      md.Updated.UTC().Format(time.RFC3339Nano),
+		"updated_by":   md.UpdatedBy,
+		"size":         strconv.Itoa(md.Size),
+		"sha256":       md.SHA256,
+		"content_type": md.ContentType,
+	}
+	if !md.Expires.IsZero() {
+		pairs["expires_at"] = md.Expires.UTC().Format(time.RFC3339Nano)
+	}
+	for k, v := range md.Labels {
+		pairs[sqlLabelPrefix+k] = v
+	}
+	for k, v := range md.Annotations {
+		pairs[sqlAnnotationPrefix+k] = v
+	}
+	for key, value := range pairs {
+		if _, err := tx.Exec(`INSERT INTO yamlet_metadata (namespace, name, key, value) VALUES ($1, $2, $3, $4)`,
+			namespace, name, key, value); err != nil {
+			return fmt.Errorf("failed to store metadata of config %s in namespace %s: %w", name, namespace, err)
+		}
+	}
+	return nil
+}
+
+// Namespaces implements NamespaceLister.
+func (s *SQLStore) Namespaces() ([]string, error) {
+	return namespacesSQL(s.db)
+}
+
+// namespacesSQL lists the namespaces through q.
+func namespacesSQL(q sqlQuerier) ([]string, error) {
+	namespaces, err := queryStrings(q, `SELECT namespace FROM yamlet_configs
+		UNION SELECT namespace FROM yamlet_namespaces`)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list namespaces: %w", err)
+	}
+	return namespaces, nil
+}
+
+// NamespaceInfo implements NamespaceStore.
+func (s *SQLStore) NamespaceInfo(namespace string) (NamespaceInfo, error) {
+	if err := validateName(namespace); err != nil {
+		return NamespaceInfo{}, err
+	}
+
+	return namespaceInfoSQL(s.db, namespace)
+}
+
+// namespaceInfoSQL reads the record of a namespace through q.
+func namespaceInfoSQL(q sqlQuerier, namespace string) (NamespaceInfo, error) {
+	var record string
+	err := q.QueryRow(`SELECT record FROM yamlet_namespaces WHERE namespace = $1`, namespace).Scan(&record)
+	if errors.Is(err, sql.ErrNoRows) {
+		return NamespaceInfo{}, fmt.Errorf("namespace %s: %w", namespace, ErrNotFound)
+	}
+	if err != nil {
+		return NamespaceInfo{}, fmt.Errorf("failed to read namespace %s: %w", namespace, err)
+	}
+	var info NamespaceInfo
+	if err := json.Unmarshal([]byte(record), &info); err != nil {
+		return NamespaceInfo{}, fmt.Errorf("failed to parse namespace %s: %w", namespace, err)
+	}
+	return info, nil
+}
+
+// SetNamespaceInfo implements NamespaceStore.
+func (s *SQLStore) SetNamespaceInfo(info NamespaceInfo) error {
+	if err := ValidateNamespaceInfo(info); err != nil {
+		return err
+	}
+	record, err := json.Marshal(info)
+	if err != nil {
+		return err
+	}
+
+	if _, err := s.db.Exec(`INSERT INTO yamlet_namespaces (namespace, record) VALUES ($1, $2)
+		ON CONFLICT (namespace) DO UPDATE SET record = excluded.record`, info.Name, string(record)); err != nil {
+		return fmt.Errorf("failed to store namespace %s: %w", info.Name, err)
+	}
+	return nil
+}
+
+// DeleteNamespace implements NamespaceStore. The namespace goes in one
+// transaction, and watchers hear about it as a change to every config in
+// it.
+func (s *SQLStore) DeleteNamespace(namespace string) error {
+	if err := validateName(namespace); err != nil {
+		return err
+	}
+
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	var deleted int64
+	for _, table := range []string{"yamlet_configs", "yamlet_namespaces", "yamlet_trash", "yamlet_revisions", "yamlet_metadata"} {
+		res, err := tx.Exec(`DELETE FROM `+table+` WHERE namespace = $1`, namespace)
+		if err != nil {
+			return fmt.Errorf("failed to delete namespace %s: %w", namespace, err)
+		}
+		if table == "yamlet_configs" || table == "yamlet_namespaces" || table == "yamlet_trash" {
+			n, err := res.RowsAffected()
+			if err != nil {
+				return err
+			}
+			deleted += n
+		}
+	}
+	if deleted == 0 {
+		return fmt.Errorf("namespace %s: %w", namespace, ErrNotFound)
+	}
+	if err := s.notifyChange(tx, namespace, ""); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// Usage implements NamespaceStore.
+func (s *SQLStore) Usage(namespace string) (NamespaceUsage, error) {
+	if err := validateName(namespace); err != nil {
+		return NamespaceUsage{}, err
+	}
+
+	var usage NamespaceUsage
+	err := s.db.QueryRow(`SELECT COUNT(*), COALESCE(SUM(length(content)), 0) FROM yamlet_configs
+		WHERE namespace = $1`, namespace).Scan(&usage.Configs, &usage.Bytes)
+	if err != nil {
+		return NamespaceUsage{}, fmt.Errorf("failed to read namespace %s: %w", namespace, err)
+	}
+	return usage, nil
+}
+
+// queryStrings runs a query returning one text column and sorts the
+// result bytewise, like the other stores, whatever the database collation.
+func queryStrings(q sqlQuerier, query string, args ...interface{}) ([]string, error) {
+	rows, err := q.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	out := []string{}
+	for rows.Next() {
+		var v string
+		if err := rows.Scan(&v); err != nil {
+			return nil, err
+		}
+		out = append(out, v)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	sort.Strings(out)
+	return out, nil
+}
+
+// Trash implements Trasher in a single transaction.
+func (s *SQLStore) Trash(_ Author, namespace, name string) (TrashItem, error) {
+	if err := validateNamespaceAndName(namespace, name); err != nil {
+		return TrashItem{}, err
+	}
+
+	tx, err := s.db.Begin()
+	if err != nil {
+		return TrashItem{}, err
+	}
+	defer tx.Rollback()
+
+	var content []byte
+	err = tx.QueryRow(`SELECT content FROM yamlet_configs WHERE namespace = $1 AND name = $2`+s.dialect.forUpdate,
+		namespace, name).Scan(&content)
+	if errors.Is(err, sql.ErrNoRows) {
+		return TrashItem{}, fmt.Errorf("config %s in namespace %s: %w", name, namespace, ErrNotFound)
+	}
+	if err != nil {
+		return TrashItem{}, fmt.Errorf("failed to read config %s in namespace %s: %w", name, namespace, err)
+	}
+	var md *Metadata
+	record, err := readSQLMetadata(tx, namespace, name)
+	switch {
+	case err == nil:
+		md = &record
+	case !errors.Is(err, ErrNotFound):
+		return TrashItem{}, err
+	}
+	rec, err := newTrashRecord(name, content, md)
+	if err != nil {
+		return TrashItem{}, err
+	}
+	encoded := ""
+	if md != nil {
+		data, err := json.Marshal(md)
+		if err != nil {
+			return TrashItem{}, err
+		}
+		encoded = string(data)
+	}
+	if _, err := tx.Exec(`INSERT INTO yamlet_trash (namespace, id, name, content, metadata, deleted)
+		VALUES ($1, $2, $3, $4, $5, $6)`,
+		namespace, rec.ID, name, rec.Content, encoded, rec.Deleted.UnixNano()); err != nil {
+		return TrashItem{}, fmt.Errorf("failed to trash config %s in namespace %s: %w", name, namespace, err)
+	}
+	if err := s.deleteTx(tx, namespace, name); err != nil {
+		return TrashItem{}, err
+	}
+	return rec.TrashItem, tx.Commit()
+}
+
+// scanTrashRecord reads a yamlet_trash row selected as id, name, content,
+// metadata, deleted.
+func scanTrashRecord(row interface{ Scan(...interface{}) error }) (trashRecord, error) {
+	var (
+		rec      trashRecord
+		metadata string
+		deleted  int64
+	)
+	if err := row.Scan(&rec.ID, &rec.Name, &rec.Content, &metadata, &deleted); err != nil {
+		return trashRecord{}, err
+	}
+	rec.Deleted = time.Unix(0, deleted).UTC()
+	rec.Size = len(rec.Content)
+	if metadata != "" {
+		rec.Metadata = &Metadata{}
+		if err := json.Unmarshal([]byte(metadata), rec.Metadata); err != nil {
+			return trashRecord{}, err
+		}
+	}
+	return rec, nil
+}
+
+// TrashItems implements Trasher.
+func (s *SQLStore) TrashItems(namespace string) ([]TrashItem, error) {
+	if err := validateName(namespace); err != nil {
+		return nil, err
+	}
+
+	rows, err := s.db.Query(`SELECT id, name, content, metadata, deleted FROM yamlet_trash WHERE namespace = $1`,
+		namespace)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list trash of namespace %s: %w", namespace, err)
+	}
+	defer rows.Close()
+
+	items := []TrashItem{}
+	for rows.Next() {
+		rec, err := scanTrashRecord(rows)
+		if err != nil {
+			return nil, err
+		}
+		items = append(items, rec.TrashItem)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	sortTrash(items)
+	return items, nil
+}
+
+// trashRecordTx reads a trash item in tx, locking its row.
+func (s *SQLStore) trashRecordTx(tx *sql.Tx, namespace, id string) (trashRecord, error) {
+	rec, err := scanTrashRecord(tx.QueryRow(`SELECT id, name, content, metadata, deleted FROM yamlet_trash
+		WHERE namespace = $1 AND id = $2`+s.dialect.forUpdate, namespace, id))
+	if errors.Is(err, sql.ErrNoRows) {
+		return trashRecord{}, errTrashItemNotFound(namespace, id)
+	}
+	if err != nil {
+		return trashRecord{}, fmt.Errorf("failed to read trash item %s in namespace %s: %w", id, namespace, err)
+	}
+	return rec, nil
+}
+
+// Restore implements Trasher in a single transaction.
+func (s *SQLStore) Restore(_ Author, namespace, id string, opts RestoreOptions) (TrashItem, error) {
+	if err := validateNamespaceAndName(namespace, id); err != nil {
+		return TrashItem{}, err
+	}
+
+	tx, err := s.db.Begin()
+	if err != nil {
+		return TrashItem{}, err
+	}
+	defer tx.Rollback()
+
+	rec, err := s.trashRecordTx(tx, namespace, id)
+	if err != nil {
+		return TrashItem{}, err
+	}
+	name := opts.restoreTarget(rec.TrashItem)
+	if err := validateName(name); err != nil {
+		return TrashItem{}, err
+	}
+	var exists int
+	err = tx.QueryRow(`SELECT 1 FROM yamlet_configs WHERE namespace = $1 AND name = $2`+s.dialect.forUpdate,
+		namespace, name).Scan(&exists)
+	switch {
+	case err == nil && !opts.Overwrite:
+		return TrashItem{}, errConfigExists(namespace, name)
+	case err != nil && !errors.Is(err, sql.ErrNoRows):
+		return TrashItem{}, fmt.Errorf("failed to read config %s in namespace %s: %w", name, namespace, err)
+	}
+	content, err := opts.restoreContent(rec.TrashItem, rec.Content)
+	if err != nil {
+		return TrashItem{}, err
+	}
+	if err := s.storeTx(tx, namespace, name, content); err != nil {
+		return TrashItem{}, err
+	}
+	if err := writeSQLMetadata(tx, namespace, name, rec.Metadata); err != nil {
+		return TrashItem{}, err
+	}
+	if _, err := tx.Exec(`DELETE FROM yamlet_trash WHERE namespace = $1 AND id = $2`, namespace, id); err != nil {
+		return TrashItem{}, fmt.Errorf("failed to purge trash item %s in namespace %s: %w", id, namespace, err)
+	}
+	return restoredItem(rec.TrashItem, name), tx.Commit()
+}
+
+// Purge implements Trasher.
+func (s *SQLStore) Purge(namespace, id string) error {
+	if err := validateNamespaceAndName(namespace, id); err != nil {
+		return err
+	}
+
+	res, err := s.db.Exec(`DELETE FROM yamlet_trash WHERE namespace = $1 AND id = $2`, namespace, id)
+	if err != nil {
+		return fmt.Errorf("failed to purge trash item %s in namespace %s: %w", id, namespace, err)
+	}
+	if n, err := res.RowsAffected(); err != nil {
+		return err
+	} else if n == 0 {
+		return errTrashItemNotFound(namespace, id)
+	}
+	return nil
+}
+
+// PurgeTrash implements Trasher.
+func (s *SQLStore) PurgeTrash(cutoff time.Time) (int, error) {
+	res, err := s.db.Exec(`DELETE FROM yamlet_trash WHERE deleted < $1`, cutoff.UnixNano())
+	if err != nil {
+		return 0, fmt.Errorf("failed to purge trash: %w", err)
+	}
+	n, err := res.RowsAffected()
+	return int(n), err
+}
+
+// RewriteTrash implements Trasher in a single transaction.
+func (s *SQLStore) RewriteTrash(namespace, id string, fn func([]byte) ([]byte, error)) error {
+	if err := validateNamespaceAndName(namespace, id); err != nil {
+		return err
+	}
+
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	rec, err := s.trashRecordTx(tx, namespace, id)
+	if err != nil {
+		return err
+	}
+	content, err := fn(rec.Content)
+	if err != nil {
+		return err
+	}
+	if _, err := tx.Exec(`UPDATE yamlet_trash SET content = $1 WHERE namespace = $2 AND id = $3`,
+		content, namespace, id); err != nil {
+		return fmt.Errorf("failed to rewrite trash item %s in namespace %s: %w", id, namespace, err)
+	}
+	return tx.Commit()
+}
+
+// LoadKeyTable implements KeyTable. The key table is the one row of
+// yamlet_keys, so replicas sharing the database share the data keys.
+func (s *SQLStore) LoadKeyTable() ([]byte, string, error) {
+	var data []byte
+	var revision int64
+	err := s.db.QueryRow(`SELECT data, revision FROM yamlet_keys WHERE id = 1`).Scan(&data, &revision)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, "", nil
+	}
+	if err != nil {
+		return nil, "", fmt.Errorf("failed to read key table: %w", err)
+	}
+	return data, strconv.FormatInt(revision, 10), nil
+}
+
+// KeyTableRevision implements KeyTable.
+func (s *SQLStore) KeyTableRevision() (string, error) {
+	var revision int64
+	err := s.db.QueryRow(`SELECT revision FROM yamlet_keys WHERE id = 1`).Scan(&revision)
+	if errors.Is(err, sql.ErrNoRows) {
+		return "", nil
+	}
+	if err != nil {
+		return "", fmt.Errorf("failed to read key table: %w", err)
+	}
+	return strconv.FormatInt(revision, 10), nil
+}
+
+// SaveKeyTable implements KeyTable, numbering revisions from 1.
+func (s *SQLStore) SaveKeyTable(data []byte, revision string) (string, error) {
+	var res sql.Result
+	var next int64 = 1
+	var err error
+	if revision == "" {
+		res, err = s.db.Exec(`INSERT INTO yamlet_keys (id, revision, data) VALUES (1, 1, $1)
+			ON CONFLICT (id) DO NOTHING`, data)
+	} else {
+		current, perr := strconv.ParseInt(revision, 10, 64)
+		if perr != nil {
+			return "", fmt.Errorf("key table revision %q: %w", revision, ErrConflict)
+		}
+		next = current + 1
+		res, err = s.db.Exec(`UPDATE yamlet_keys SET data = $1, revision = $2 WHERE id = 1 AND revision = $3`,
+			data, next, current)
+	}
+	if err != nil {
+		return "", fmt.Errorf("failed to store key table: %w", err)
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return "", err
+	}
+	if n == 0 {
+		return "", fmt.Errorf("key table: %w", ErrConflict)
+	}
+	return strconv.FormatInt(next, 10), nil
+}
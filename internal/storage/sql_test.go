@@ -0,0 +1,351 @@
+package storage
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	_ "github.com/lib/pq"
+	_ "modernc.org/sqlite"
+)
+
+// newTestSQLStores returns an SQLite store and, when YAMLET_TEST_POSTGRES_DSN
+// names a scratch database, a PostgreSQL store on a freshly reset schema.
+func newTestSQLStores(t *testing.T) map[string]*SQLStore {
+	t.Helper()
+	stores := make(map[string]*SQLStore)
+
+	sqlite, err := NewSQLStore("sqlite", filepath.Join(t.TempDir(), "yamlet.db"))
+	if err != nil {
+		t.Logf("SQLite unavailable: %v", err)
+	} else {
+		stores["sqlite"] = sqlite
+	}
+
+	if dsn := os.Getenv("YAMLET_TEST_POSTGRES_DSN"); dsn != "" {
+		pg, err := NewSQLStore("postgres", dsn)
+		if err != nil {
+			t.Fatalf("NewSQLStore(postgres): %v", err)
+		}
+		for _, stmt := range []string{"yamlet_configs", "yamlet_revisions", "yamlet_metadata", "yamlet_namespaces", "yamlet_trash", "yamlet_keys"} {
+			if _, err := pg.db.Exec(`DELETE FROM ` + stmt); err != nil {
+				t.Fatal(err)
+			}
+		}
+		stores["postgres"] = pg
+	}
+
+	if len(stores) == 0 {
+		t.Skip("no SQL database available")
+	}
+	for _, s := range stores {
+		s := s
+		t.Cleanup(func() { s.Close() })
+	}
+	return stores
+}
+
+func TestSQLStore(t *testing.T) {
+	for dialect, store := range newTestSQLStores(t) {
+		t.Run(dialect, func(t *testing.T) {
+			if err := store.Store("dev", "b.yaml", []byte("b: 1")); err != nil {
+				t.Fatalf("Store: %v", err)
+			}
+			if err := store.Store("dev", "a.yaml", []byte("a: 1")); err != nil {
+				t.Fatalf("Store: %v", err)
+			}
+			if err := store.Store("prod", "a.yaml", []byte{}); err != nil {
+				t.Fatalf("Store of empty content: %v", err)
+			}
+
+			got, err := store.Get("dev", "a.yaml")
+			if err != nil || string(got) != "a: 1" {
+				t.Fatalf("Get = %q, %v", got, err)
+			}
+			names, err := store.List("dev")
+			if err != nil || len(names) != 2 || names[0] != "a.yaml" || names[1] != "b.yaml" {
+				t.Fatalf("List = %v, %v", names, err)
+			}
+			namespaces, err := store.Namespaces()
+			if err != nil || len(namespaces) != 2 || namespaces[0] != "dev" || namespaces[1] != "prod" {
+				t.Fatalf("Namespaces = %v, %v", namespaces, err)
+			}
+
+			if err := store.Delete("prod", "a.yaml"); err != nil {
+				t.Fatalf("Delete: %v", err)
+			}
+			if _, err := store.Get("prod", "a.yaml"); !errors.Is(err, ErrNotFound) {
+				t.Fatalf("Get after Delete should be ErrNotFound, got %v", err)
+			}
+			if err := store.Delete("prod", "a.yaml"); !errors.Is(err, ErrNotFound) {
+				t.Fatalf("second Delete should be ErrNotFound, got %v", err)
+			}
+			if err := store.Store("dev", "../x", []byte("x")); !errors.Is(err, ErrInvalidName) {
+				t.Fatalf("expected ErrInvalidName, got %v", err)
+			}
+		})
+	}
+}
+
+func TestSQLStoreQuery(t *testing.T) {
+	for dialect, store := range newTestSQLStores(t) {
+		t.Run(dialect, func(t *testing.T) {
+			testQuery(t, store)
+		})
+	}
+}
+
+func TestSQLStoreMetadata(t *testing.T) {
+	for dialect, store := range newTestSQLStores(t) {
+		t.Run(dialect, func(t *testing.T) {
+			testMetadata(t, store)
+		})
+	}
+}
+
+func TestSQLStoreNamespaces(t *testing.T) {
+	for dialect, store := range newTestSQLStores(t) {
+		t.Run(dialect, func(t *testing.T) {
+			testNamespaces(t, store)
+		})
+	}
+}
+
+func TestSQLStoreExport(t *testing.T) {
+	for dialect, store := range newTestSQLStores(t) {
+		t.Run(dialect, func(t *testing.T) {
+			testExport(t, store)
+		})
+	}
+}
+
+func TestSQLStoreTrash(t *testing.T) {
+	for dialect, store := range newTestSQLStores(t) {
+		t.Run(dialect, func(t *testing.T) {
+			testTrash(t, store)
+		})
+	}
+}
+
+func TestSQLStoreRevisions(t *testing.T) {
+	for dialect, store := range newTestSQLStores(t) {
+		t.Run(dialect, func(t *testing.T) {
+			testRevisions(t, store)
+
+			store.maxRevisions = 2
+			for i := 0; i < 5; i++ {
+				if err := store.Store("dev", "retained.yaml", []byte{byte('a' + i)}); err != nil {
+					t.Fatalf("Store: %v", err)
+				}
+			}
+			revs, err := store.Revisions("dev", "retained.yaml")
+			if err != nil || len(revs) != 2 || revs[0].Number != 4 || revs[1].Number != 5 {
+				t.Fatalf("expected revisions 4 and 5, got %+v, %v", revs, err)
+			}
+
+			store.maxRevisions = DefaultMaxRevisions
+			testPruneRevisions(t, store)
+		})
+	}
+}
+
+func TestSQLStoreRewrite(t *testing.T) {
+	for dialect, store := range newTestSQLStores(t) {
+		t.Run(dialect, func(t *testing.T) {
+			store.Store("dev", "app.yaml", []byte("v: 1"))
+			store.Store("dev", "app.yaml", []byte("v: 2"))
+
+			err := store.Rewrite("dev", "app.yaml", func(b []byte) ([]byte, error) {
+				return append([]byte("# x\n"), b...), nil
+			})
+			if err != nil {
+				t.Fatalf("Rewrite: %v", err)
+			}
+			if got, _ := store.Get("dev", "app.yaml"); string(got) != "# x\nv: 2" {
+				t.Fatalf("current content not rewritten: %q", got)
+			}
+			if got, _ := store.GetRevision("dev", "app.yaml", 1); string(got) != "# x\nv: 1" {
+				t.Fatalf("revision not rewritten: %q", got)
+			}
+
+			boom := errors.New("boom")
+			calls := 0
+			err = store.Rewrite("dev", "app.yaml", func(b []byte) ([]byte, error) {
+				if calls++; calls > 1 {
+					return nil, boom
+				}
+				return []byte("changed"), nil
+			})
+			if !errors.Is(err, boom) {
+				t.Fatalf("expected rewrite error, got %v", err)
+			}
+			if got, _ := store.Get("dev", "app.yaml"); string(got) != "# x\nv: 2" {
+				t.Fatalf("failed rewrite must be rolled back: %q", got)
+			}
+			if err := store.Rewrite("dev", "missing.yaml", nil); !errors.Is(err, ErrNotFound) {
+				t.Fatalf("expected ErrNotFound, got %v", err)
+			}
+		})
+	}
+}
+
+func TestSQLStoreConcurrentWrites(t *testing.T) {
+	for dialect, store := range newTestSQLStores(t) {
+		t.Run(dialect, func(t *testing.T) {
+			var wg sync.WaitGroup
+			for i := 0; i < 10; i++ {
+				wg.Add(1)
+				go func() {
+					defer wg.Done()
+					if err := store.Store("dev", "app.yaml", []byte("v")); err != nil {
+						t.Errorf("Store: %v", err)
+					}
+				}()
+			}
+			wg.Wait()
+
+			revs, err := store.Revisions("dev", "app.yaml")
+			if err != nil || len(revs) != 10 || revs[9].Number != 10 {
+				t.Fatalf("expected revisions 1 to 10, got %+v, %v", revs, err)
+			}
+		})
+	}
+}
+
+func TestSQLStoreSharedKeyTable(t *testing.T) {
+	for dialect, store := range newTestSQLStores(t) {
+		t.Run(dialect, func(t *testing.T) {
+			// Two replicas sharing the database.
+			a, err := NewEncryptedStore(store, testMasterKeys(t, 1), store)
+			if err != nil {
+				t.Fatal(err)
+			}
+			b, err := NewEncryptedStore(store, testMasterKeys(t, 1), store)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			// Each reads what the other wrote under keys it created.
+			if err := a.Store("dev", "app.yaml", []byte("v: 1\n")); err != nil {
+				t.Fatalf("Store: %v", err)
+			}
+			if got, err := b.Get("dev", "app.yaml"); err != nil || string(got) != "v: 1\n" {
+				t.Fatalf("Get from the other replica = %q, %v", got, err)
+			}
+
+			// A replica that creates a data key the other has just created
+			// takes the saved one.
+			if err := a.Store("qa", "app.yaml", []byte("q: 1\n")); err != nil {
+				t.Fatalf("Store: %v", err)
+			}
+			if _, _, err := b.dataKey("qa"); err != nil {
+				t.Fatalf("dataKey: %v", err)
+			}
+			if err := b.Store("qa", "other.yaml", []byte("q: 2\n")); err != nil {
+				t.Fatalf("Store: %v", err)
+			}
+			for _, name := range []string{"app.yaml", "other.yaml"} {
+				if _, err := a.Get("qa", name); err != nil {
+					t.Fatalf("Get %s: %v", name, err)
+				}
+				if _, err := b.Get("qa", name); err != nil {
+					t.Fatalf("Get %s: %v", name, err)
+				}
+			}
+
+			// After one replica rotates, the other writes under the new keys.
+			if _, err := b.Rotate(); err != nil {
+				t.Fatalf("Rotate: %v", err)
+			}
+			if err := a.Store("dev", "app.yaml", []byte("v: 2\n")); err != nil {
+				t.Fatalf("Store after rotation: %v", err)
+			}
+			c, err := NewEncryptedStore(store, testMasterKeys(t, 1), store)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got, err := c.Get("dev", "app.yaml"); err != nil || string(got) != "v: 2\n" {
+				t.Fatalf("Get after rotation = %q, %v", got, err)
+			}
+
+			// Saving over a revision that is not the stored one fails.
+			if _, err := store.SaveKeyTable([]byte("{}"), "1"); !errors.Is(err, ErrConflict) {
+				t.Fatalf("expected ErrConflict for a stale revision, got %v", err)
+			}
+			if _, err := store.SaveKeyTable([]byte("{}"), ""); !errors.Is(err, ErrConflict) {
+				t.Fatalf("expected ErrConflict for a table that exists, got %v", err)
+			}
+		})
+	}
+}
+
+func TestSQLStoreMigrations(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "yamlet.db")
+	store, err := NewSQLStore("sqlite", path)
+	if err != nil {
+		t.Skipf("SQLite unavailable: %v", err)
+	}
+	store.Store("dev", "app.yaml", []byte("v: 1"))
+	store.Close()
+
+	// Reopening leaves an up-to-date schema and its data alone.
+	store, err = NewSQLStore("sqlite", path)
+	if err != nil {
+		t.Fatalf("reopen: %v", err)
+	}
+	defer store.Close()
+	if v, err := store.SchemaVersion(); err != nil || v != len(sqlMigrations) {
+		t.Fatalf("SchemaVersion = %d, %v; want %d", v, err, len(sqlMigrations))
+	}
+	if got, err := store.Get("dev", "app.yaml"); err != nil || string(got) != "v: 1" {
+		t.Fatalf("Get after reopen = %q, %v", got, err)
+	}
+
+	// A schema from a newer server is refused rather than misread.
+	store.db.Exec(`INSERT INTO yamlet_schema (version) VALUES ($1)`, len(sqlMigrations)+1)
+	store.Close()
+	if _, err := NewSQLStore("sqlite", path); err == nil {
+		t.Fatal("expected an error for a newer schema version")
+	}
+
+	if _, err := NewSQLStore("mysql", ""); !errors.Is(err, ErrUnsupported) {
+		t.Fatalf("expected ErrUnsupported for an unknown driver, got %v", err)
+	}
+}
+
+func TestSQLStoreWatch(t *testing.T) {
+	for dialect, store := range newTestSQLStores(t) {
+		t.Run(dialect, func(t *testing.T) {
+			changes := make(chan string, 10)
+			stop, err := store.Watch(func(namespace, name string) {
+				changes <- namespace + "/" + name
+			})
+			if dialect == "sqlite" {
+				if !errors.Is(err, ErrUnsupported) {
+					t.Fatalf("expected ErrUnsupported, got %v", err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Watch: %v", err)
+			}
+			defer stop()
+
+			store.Store("dev", "app.yaml", []byte("v: 1"))
+			store.Delete("dev", "app.yaml")
+			for i := 0; i < 2; i++ {
+				select {
+				case change := <-changes:
+					if change != "dev/app.yaml" {
+						t.Fatalf("unexpected change %q", change)
+					}
+				case <-time.After(5 * time.Second):
+					t.Fatal("no change notification")
+				}
+			}
+		})
+	}
+}
@@ -3,10 +3,15 @@ package storage
 import (
 	"errors"
 	"fmt"
+	"io"
+	"maps"
 	"os"
 	"path/filepath"
+	"sort"
+	"strconv"
 	"strings"
 	"sync"
+	"time"
 )
 
 // ErrNotFound is returned when a namespace or config does not exist.
@@ -17,6 +22,36 @@ var ErrNotFound = errors.New("not found")
 // a relative traversal component (".", "..").
 var ErrInvalidName = errors.New("invalid name")
 
+// ErrUnsupported is returned when a store lacks an optional capability,
+// such as revision history or in-place rewrites.
+var ErrUnsupported = errors.New("not supported by the configured storage backend")
+
+// ErrConflict is returned when a conditional write finds the config changed
+// since it was read.
+var ErrConflict = errors.New("config was modified concurrently")
+
+// ErrInvalidMetadata is returned for labels or annotations that are
+// malformed.
+var ErrInvalidMetadata = errors.New("invalid metadata")
+
+// ErrInvalidQuery is returned for listing options that are malformed, such
+// as a bad glob pattern or label selector.
+var ErrInvalidQuery = errors.New("invalid query")
+
+// ErrIncomplete is returned by Transactional.Update when a transaction's
+// writes were applied only in part. The store completes them before its
+// next read or write.
+var ErrIncomplete = errors.New("transaction applied in part")
+
+// DefaultMaxRevisions is how many past revisions of each config the built-in
+// stores retain before pruning the oldest.
+const DefaultMaxRevisions = 50
+
+// reservedDir holds bookkeeping (revisions, metadata and the like) beside
+// the namespaces of FileStore and S3Store; it can therefore not be used as a
+// namespace.
+const reservedDir = ".yamlet"
+
 // Store interface defines the storage operations
 type Store interface {
 	Store(namespace, name string, content []byte) error
@@ -25,6 +60,115 @@ type Store interface {
 	List(namespace string) ([]string, error)
 }
 
+// Revision describes one stored version of a config. Numbers start at 1 and
+// increase with every write; they are never reused while the config exists.
+type Revision struct {
+	Number  int       `json:"revision"`
+	Size    int       `json:"size"`
+	Created time.Time `json:"created,omitzero"`
+	// Commit is the git commit holding the revision, for GitStore.
+	Commit string `json:"commit,omitempty"`
+}
+
+// Versioned is implemented by stores that keep a history of every write.
+// Deleting a config discards its history.
+type Versioned interface {
+	// Revisions lists the retained revisions of a config, oldest first.
+	Revisions(namespace, name string) ([]Revision, error)
+	// GetRevision returns the content of a single revision.
+	GetRevision(namespace, name string, revision int) ([]byte, error)
+}
+
+// Pruner is implemented by versioned stores that can drop the oldest
+// revisions of a config on demand, to retain fewer than they otherwise
+// would.
+type Pruner interface {
+	// PruneRevisions deletes all but the newest keep revisions of a config.
+	// The newest revision, which is the current content, is always kept.
+	PruneRevisions(namespace, name string, keep int) error
+}
+
+// Rewriter is implemented by stores that can replace the stored bytes of a
+// config in place, current content and every retained revision alike,
+// without recording a new revision. It is what lets EncryptedStore
+// re-encrypt data under new keys.
+type Rewriter interface {
+	// Rewrite calls fn with each stored version of a config and stores
+	// what it returns in its place. Writes to the config are blocked while
+	// it runs.
+	Rewrite(namespace, name string, fn func(content []byte) ([]byte, error)) error
+}
+
+// NamespaceLister is implemented by stores that can enumerate their
+// namespaces.
+type NamespaceLister interface {
+	// Namespaces lists the namespaces holding at least one config.
+	Namespaces() ([]string, error)
+}
+
+// Author identifies who made a change.
+type Author struct {
+	Name  string
+	Email string
+}
+
+// DefaultAuthor is recorded for changes made without an author, such as
+// through the plain Store and Delete methods.
+var DefaultAuthor = Author{Name: "yamlet", Email: "yamlet@localhost"}
+
+// Attributed is implemented by stores that record the author of every
+// change.
+type Attributed interface {
+	StoreAs(author Author, namespace, name string, content []byte) error
+	DeleteAs(author Author, namespace, name string) error
+}
+
+// Snapshotter is implemented by stores that can take a consistent copy of
+// all of their data while serving requests.
+type Snapshotter interface {
+	// WriteSnapshot writes the copy to w in the store's native format and
+	// returns the number of bytes written.
+	WriteSnapshot(w io.Writer) (int64, error)
+}
+
+// Metadata describes a config beyond its content. Stores keep the record
+// as given; filling it in is up to the caller.
+type Metadata struct {
+	Created time.Time `json:"created,omitzero"`
+	Updated time.Time `json:"updated,omitzero"`
+	// UpdatedBy identifies the token that last wrote the config.
+	UpdatedBy string `json:"updated_by,omitempty"`
+	Size      int    `json:"size"`
+	// SHA256 is the hex SHA-256 of the content.
+	SHA256 string `json:"sha256"`
+	// ContentType is the media type the config was uploaded as.
+	ContentType string            `json:"content_type,omitempty"`
+	Labels      map[string]string `json:"labels,omitempty"`
+	Annotations map[string]string `json:"annotations,omitempty"`
+	// Expires is when the config expires, if it does. Expired configs are
+	// no longer served and are deleted by a Reaper.
+	Expires time.Time `json:"expires_at,omitzero"`
+}
+
+// MetadataStore is implemented by stores that keep a metadata record for
+// each config. Deleting a config deletes its record.
+type MetadataStore interface {
+	// Metadata returns a config's record, or ErrNotFound if it has none.
+	Metadata(namespace, name string) (Metadata, error)
+	// SetMetadata replaces a config's record. The config must exist.
+	SetMetadata(namespace, name string, md Metadata) error
+}
+
+// Watcher is implemented by stores that several replicas can share and that
+// can tell each of them about changes, so that caches stay fresh.
+type Watcher interface {
+	// Watch calls changed with the namespace and name of every config
+	// stored, deleted or rewritten by any process, this one included, until
+	// stop is called. Empty names mean that anything may have changed,
+	// e.g. after changes were missed while reconnecting.
+	Watch(changed func(namespace, name string)) (stop func(), err error)
+}
+
 // validateName enforces that a namespace/config segment is a single, safe
 // filesystem component. Segments may not be empty, contain path separators,
 // NUL bytes, or be relative traversal markers.
@@ -48,16 +192,32 @@ func validateNamespaceAndName(namespace, name string) error {
 	return validateName(name)
 }
 
+// memoryRevision is a retained version of a config in MemoryStore.
+type memoryRevision struct {
+	Revision
+	content []byte
+}
+
 // MemoryStore implements in-memory storage
 type MemoryStore struct {
-	mu   sync.RWMutex
-	data map[string]map[string][]byte // namespace -> configName -> content
+	mu           sync.RWMutex
+	data         map[string]map[string][]byte           // namespace -> configName -> content
+	history      map[string]map[string][]memoryRevision // namespace -> configName -> revisions
+	metadata     map[string]map[string]Metadata         // namespace -> configName -> record
+	trash        map[string]map[string]trashRecord      // namespace -> item ID -> item
+	namespaces   map[string]NamespaceInfo
+	maxRevisions int
 }
 
 // NewMemoryStore creates a new in-memory store
 func NewMemoryStore() *MemoryStore {
 	return &MemoryStore{
-		data: make(map[string]map[string][]byte),
+		data:         make(map[string]map[string][]byte),
+		history:      make(map[string]map[string][]memoryRevision),
+		metadata:     make(map[string]map[string]Metadata),
+		trash:        make(map[string]map[string]trashRecord),
+		namespaces:   make(map[string]NamespaceInfo),
+		maxRevisions: DefaultMaxRevisions,
 	}
 }
 
@@ -69,11 +229,32 @@ func (m *MemoryStore) Store(namespace, name string, content []byte) error {
 	m.mu.Lock()
 	defer m.mu.Unlock()
 
+	m.storeLocked(namespace, name, content)
+	return nil
+}
+
+// storeLocked writes a config and records it as the next revision. Callers
+// must hold m.mu for writing.
+func (m *MemoryStore) storeLocked(namespace, name string, content []byte) {
 	if m.data[namespace] == nil {
 		m.data[namespace] = make(map[string][]byte)
+		m.history[namespace] = make(map[string][]memoryRevision)
 	}
 	m.data[namespace][name] = content
-	return nil
+
+	revs := m.history[namespace][name]
+	next := 1
+	if len(revs) > 0 {
+		next = revs[len(revs)-1].Number + 1
+	}
+	revs = append(revs, memoryRevision{
+		Revision: Revision{Number: next, Size: len(content), Created: time.Now().UTC()},
+		content:  content,
+	})
+	if len(revs) > m.maxRevisions {
+		revs = append([]memoryRevision(nil), revs[len(revs)-m.maxRevisions:]...)
+	}
+	m.history[namespace][name] = revs
 }
 
 func (m *MemoryStore) Get(namespace, name string) ([]byte, error) {
@@ -84,6 +265,11 @@ func (m *MemoryStore) Get(namespace, name string) ([]byte, error) {
 	m.mu.RLock()
 	defer m.mu.RUnlock()
 
+	return m.getLocked(namespace, name)
+}
+
+// getLocked reads a config. Callers must hold m.mu.
+func (m *MemoryStore) getLocked(namespace, name string) ([]byte, error) {
 	namespaceData, exists := m.data[namespace]
 	if !exists {
 		return nil, fmt.Errorf("namespace %s: %w", namespace, ErrNotFound)
@@ -105,6 +291,12 @@ func (m *MemoryStore) Delete(namespace, name string) error {
 	m.mu.Lock()
 	defer m.mu.Unlock()
 
+	return m.deleteLocked(namespace, name)
+}
+
+// deleteLocked deletes a config with its history and metadata. Callers
+// must hold m.mu for writing.
+func (m *MemoryStore) deleteLocked(namespace, name string) error {
 	namespaceData, exists := m.data[namespace]
 	if !exists {
 		return fmt.Errorf("namespace %s: %w", namespace, ErrNotFound)
@@ -115,10 +307,14 @@ func (m *MemoryStore) Delete(namespace, name string) error {
 	}
 
 	delete(namespaceData, name)
+	delete(m.history[namespace], name)
+	delete(m.metadata[namespace], name)
 
 	// Clean up empty namespace
 	if len(namespaceData) == 0 {
 		delete(m.data, namespace)
+		delete(m.history, namespace)
+		delete(m.metadata, namespace)
 	}
 
 	return nil
@@ -132,29 +328,280 @@ func (m *MemoryStore) List(namespace string) ([]string, error) {
 	m.mu.RLock()
 	defer m.mu.RUnlock()
 
-	namespaceData, exists := m.data[namespace]
-	if !exists {
-		return []string{}, nil
-	}
+	return m.listLocked(namespace), nil
+}
 
+// listLocked lists the configs of a namespace. Callers must hold m.mu.
+func (m *MemoryStore) listLocked(namespace string) []string {
+	namespaceData := m.data[namespace]
 	configs := make([]string, 0, len(namespaceData))
 	for name := range namespaceData {
 		configs = append(configs, name)
 	}
 
-	return configs, nil
+	return configs
+}
+
+// Query implements Querier.
+func (m *MemoryStore) Query(namespace string, opts ListOptions) (ListPage, error) {
+	if err := validateName(namespace); err != nil {
+		return ListPage{}, err
+	}
+	if err := opts.Validate(); err != nil {
+		return ListPage{}, err
+	}
+
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	names := make([]string, 0, len(m.data[namespace]))
+	for name := range m.data[namespace] {
+		names = append(names, name)
+	}
+	sortNames(names, opts.Descending)
+	p := newPager(opts)
+	for _, name := range names {
+		more, _ := p.add(name, func() (map[string]string, error) {
+			return m.metadata[namespace][name].Labels, nil
+		})
+		if !more {
+			break
+		}
+	}
+	return p.page, nil
+}
+
+// Revisions implements Versioned.
+func (m *MemoryStore) Revisions(namespace, name string) ([]Revision, error) {
+	if err := validateNamespaceAndName(namespace, name); err != nil {
+		return nil, err
+	}
+
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	revs, exists := m.history[namespace][name]
+	if !exists {
+		return nil, fmt.Errorf("config %s in namespace %s: %w", name, namespace, ErrNotFound)
+	}
+	out := make([]Revision, len(revs))
+	for i, rev := range revs {
+		out[i] = rev.Revision
+	}
+	return out, nil
+}
+
+// GetRevision implements Versioned.
+func (m *MemoryStore) GetRevision(namespace, name string, revision int) ([]byte, error) {
+	if err := validateNamespaceAndName(namespace, name); err != nil {
+		return nil, err
+	}
+
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	for _, rev := range m.history[namespace][name] {
+		if rev.Number == revision {
+			return rev.content, nil
+		}
+	}
+	return nil, fmt.Errorf("revision %d of config %s in namespace %s: %w", revision, name, namespace, ErrNotFound)
+}
+
+// Rewrite implements Rewriter.
+func (m *MemoryStore) Rewrite(namespace, name string, fn func([]byte) ([]byte, error)) error {
+	if err := validateNamespaceAndName(namespace, name); err != nil {
+		return err
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	content, exists := m.data[namespace][name]
+	if !exists {
+		return fmt.Errorf("config %s in namespace %s: %w", name, namespace, ErrNotFound)
+	}
+	// Build every replacement before applying any, so a failure leaves the
+	// config untouched.
+	current, err := fn(content)
+	if err != nil {
+		return err
+	}
+	revs := append([]memoryRevision(nil), m.history[namespace][name]...)
+	for i := range revs {
+		if revs[i].content, err = fn(revs[i].content); err != nil {
+			return err
+		}
+		revs[i].Size = len(revs[i].content)
+	}
+	m.data[namespace][name] = current
+	m.history[namespace][name] = revs
+	return nil
 }
 
-// FileStore implements file-based storage
+// PruneRevisions implements Pruner.
+func (m *MemoryStore) PruneRevisions(namespace, name string, keep int) error {
+	if err := validateNamespaceAndName(namespace, name); err != nil {
+		return err
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	revs, exists := m.history[namespace][name]
+	if !exists {
+		return fmt.Errorf("config %s in namespace %s: %w", name, namespace, ErrNotFound)
+	}
+	keep = max(keep, 1)
+	if len(revs) > keep {
+		m.history[namespace][name] = append([]memoryRevision(nil), revs[len(revs)-keep:]...)
+	}
+	return nil
+}
+
+// Namespaces implements NamespaceLister.
+func (m *MemoryStore) Namespaces() ([]string, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	namespaces := make([]string, 0, len(m.data)+len(m.namespaces))
+	for namespace := range m.data {
+		namespaces = append(namespaces, namespace)
+	}
+	for namespace := range m.namespaces {
+		namespaces = append(namespaces, namespace)
+	}
+	return mergeNames(namespaces, nil), nil
+}
+
+// NamespaceInfo implements NamespaceStore.
+func (m *MemoryStore) NamespaceInfo(namespace string) (NamespaceInfo, error) {
+	if err := validateName(namespace); err != nil {
+		return NamespaceInfo{}, err
+	}
+
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	info, ok := m.namespaces[namespace]
+	if !ok {
+		return NamespaceInfo{}, fmt.Errorf("namespace %s: %w", namespace, ErrNotFound)
+	}
+	info.Labels = maps.Clone(info.Labels)
+	info.Policy = info.Policy.clone()
+	return info, nil
+}
+
+// SetNamespaceInfo implements NamespaceStore.
+func (m *MemoryStore) SetNamespaceInfo(info NamespaceInfo) error {
+	if err := ValidateNamespaceInfo(info); err != nil {
+		return err
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	info.Labels = maps.Clone(info.Labels)
+	info.Policy = info.Policy.clone()
+	m.namespaces[info.Name] = info
+	return nil
+}
+
+// DeleteNamespace implements NamespaceStore.
+func (m *MemoryStore) DeleteNamespace(namespace string) error {
+	if err := validateName(namespace); err != nil {
+		return err
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	_, hasConfigs := m.data[namespace]
+	_, hasRecord := m.namespaces[namespace]
+	_, hasTrash := m.trash[namespace]
+	if !hasConfigs && !hasRecord && !hasTrash {
+		return fmt.Errorf("namespace %s: %w", namespace, ErrNotFound)
+	}
+	delete(m.data, namespace)
+	delete(m.history, namespace)
+	delete(m.metadata, namespace)
+	delete(m.trash, namespace)
+	delete(m.namespaces, namespace)
+	return nil
+}
+
+// Usage implements NamespaceStore.
+func (m *MemoryStore) Usage(namespace string) (NamespaceUsage, error) {
+	if err := validateName(namespace); err != nil {
+		return NamespaceUsage{}, err
+	}
+
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	var usage NamespaceUsage
+	for _, content := range m.data[namespace] {
+		usage.Configs++
+		usage.Bytes += int64(len(content))
+	}
+	return usage, nil
+}
+
+// Metadata implements MetadataStore.
+func (m *MemoryStore) Metadata(namespace, name string) (Metadata, error) {
+	if err := validateNamespaceAndName(namespace, name); err != nil {
+		return Metadata{}, err
+	}
+
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	md, ok := m.metadata[namespace][name]
+	if !ok {
+		return Metadata{}, fmt.Errorf("metadata of config %s in namespace %s: %w", name, namespace, ErrNotFound)
+	}
+	return cloneMetadata(md), nil
+}
+
+// SetMetadata implements MetadataStore.
+func (m *MemoryStore) SetMetadata(namespace, name string, md Metadata) error {
+	if err := validateNamespaceAndName(namespace, name); err != nil {
+		return err
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if _, ok := m.data[namespace][name]; !ok {
+		return fmt.Errorf("config %s in namespace %s: %w", name, namespace, ErrNotFound)
+	}
+	if m.metadata[namespace] == nil {
+		m.metadata[namespace] = make(map[string]Metadata)
+	}
+	m.metadata[namespace][name] = cloneMetadata(md)
+	return nil
+}
+
+// FileStore implements file-based storage. Each config is a file at
+// <baseDir>/<namespace>/<name>; past revisions are kept as
+// <baseDir>/.yamlet/revisions/<namespace>/<name>/<number>, metadata as
+// <baseDir>/.yamlet/metadata/<namespace>/<name>, trash items as
+// <baseDir>/.yamlet/trash/<namespace>/<id> and namespace records as
+// <baseDir>/.yamlet/namespaces/<namespace>.
 type FileStore struct {
-	baseDir string
-	mu      sync.RWMutex
+	baseDir      string
+	mu           sync.RWMutex
+	maxRevisions int
+	// noJournal is set once f.mu's holder has seen that no transaction is
+	// pending in the journal; readers replay one first when it is unset.
+	noJournal bool
 }
 
 // NewFileStore creates a new file-based store
 func NewFileStore(baseDir string) *FileStore {
 	return &FileStore{
-		baseDir: baseDir,
+		baseDir:      baseDir,
+		maxRevisions: DefaultMaxRevisions,
 	}
 }
 
@@ -168,6 +615,12 @@ func (f *FileStore) resolvePath(namespace, name string) (string, error) {
 	if err := validateNamespaceAndName(namespace, name); err != nil {
 		return "", err
 	}
+	if namespace == reservedDir {
+		return "", fmt.Errorf("%w: %q is reserved", ErrInvalidName, namespace)
+	}
+	if isTempFile(name) {
+		return "", fmt.Errorf("%w: %q is reserved for temporary files", ErrInvalidName, name)
+	}
 	base := filepath.Clean(f.baseDir)
 	full := filepath.Clean(filepath.Join(base, namespace, name))
 	// Defense in depth: ensure the cleaned path is under base.
@@ -182,6 +635,9 @@ func (f *FileStore) resolveNamespaceDir(namespace string) (string, error) {
 	if err := validateName(namespace); err != nil {
 		return "", err
 	}
+	if namespace == reservedDir {
+		return "", fmt.Errorf("%w: %q is reserved", ErrInvalidName, namespace)
+	}
 	base := filepath.Clean(f.baseDir)
 	full := filepath.Clean(filepath.Join(base, namespace))
 	rel, err := filepath.Rel(base, full)
@@ -199,19 +655,21 @@ func (f *FileStore) Store(namespace, name string, content []byte) error {
 
 	f.mu.Lock()
 	defer f.mu.Unlock()
-
-	// Create directory if it doesn't exist
-	dir := filepath.Dir(filePath)
-	if err := os.MkdirAll(dir, 0o700); err != nil {
-		return fmt.Errorf("failed to create directory %s: %w", dir, err)
+	if err := f.replayJournal(); err != nil {
+		return err
 	}
 
-	// Write file
-	if err := os.WriteFile(filePath, content, 0o600); err != nil {
-		return fmt.Errorf("failed to write file %s: %w", filePath, err)
+	return f.storeLocked(filePath, namespace, name, content)
+}
+
+// storeLocked writes a config to filePath and records it as the next
+// revision. Callers must hold f.mu for writing.
+func (f *FileStore) storeLocked(filePath, namespace, name string, content []byte) error {
+	if err := writeFileAtomic(filePath, content); err != nil {
+		return err
 	}
 
-	return nil
+	return f.appendRevision(namespace, name, content)
 }
 
 func (f *FileStore) Get(namespace, name string) ([]byte, error) {
@@ -220,9 +678,17 @@ func (f *FileStore) Get(namespace, name string) ([]byte, error) {
 		return nil, err
 	}
 
-	f.mu.RLock()
-	defer f.mu.RUnlock()
+	unlock, err := f.readLock()
+	if err != nil {
+		return nil, err
+	}
+	defer unlock()
+
+	return f.getLocked(filePath, namespace, name)
+}
 
+// getLocked reads the config at filePath. Callers must hold f.mu.
+func (f *FileStore) getLocked(filePath, namespace, name string) ([]byte, error) {
 	content, err := os.ReadFile(filePath)
 	if err != nil {
 		if os.IsNotExist(err) {
@@ -242,14 +708,34 @@ func (f *FileStore) Delete(namespace, name string) error {
 
 	f.mu.Lock()
 	defer f.mu.Unlock()
+	if err := f.replayJournal(); err != nil {
+		return err
+	}
+
+	return f.deleteLocked(filePath, namespace, name)
+}
 
-	if err := os.Remove(filePath); err != nil {
+// deleteLocked deletes the config at filePath with its revisions and
+// metadata. Callers must hold f.mu for writing.
+func (f *FileStore) deleteLocked(filePath, namespace, name string) error {
+	if err := removeFileSync(filePath); err != nil {
 		if os.IsNotExist(err) {
 			return fmt.Errorf("config %s in namespace %s: %w", name, namespace, ErrNotFound)
 		}
 		return fmt.Errorf("failed to delete file %s: %w", filePath, err)
 	}
 
+	revDir := f.revisionDir(namespace, name)
+	if err := os.RemoveAll(revDir); err != nil {
+		return fmt.Errorf("failed to delete revisions %s: %w", revDir, err)
+	}
+	if err := removeFileSync(f.metadataPath(namespace, name)); err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("failed to delete metadata of config %s in namespace %s: %w", name, namespace, err)
+	}
+	// The namespace directory goes with its last config; failing to remove
+	// it only means it is not empty.
+	_ = os.Remove(filepath.Dir(filePath))
+
 	return nil
 }
 
@@ -259,9 +745,18 @@ func (f *FileStore) List(namespace string) ([]string, error) {
 		return nil, err
 	}
 
-	f.mu.RLock()
-	defer f.mu.RUnlock()
+	unlock, err := f.readLock()
+	if err != nil {
+		return nil, err
+	}
+	defer unlock()
 
+	return listDir(namespaceDir)
+}
+
+// listDir lists the configs in a namespace directory. Callers must hold
+// f.mu.
+func listDir(namespaceDir string) ([]string, error) {
 	entries, err := os.ReadDir(namespaceDir)
 	if err != nil {
 		if os.IsNotExist(err) {
@@ -272,10 +767,383 @@ func (f *FileStore) List(namespace string) ([]string, error) {
 
 	configs := make([]string, 0, len(entries))
 	for _, entry := range entries {
-		if !entry.IsDir() {
+		if !entry.IsDir() && !isTempFile(entry.Name()) {
 			configs = append(configs, entry.Name())
 		}
 	}
 
 	return configs, nil
 }
+
+// Query implements Querier. Directory entries come sorted, and metadata is
+// only read for the names that pass the other filters.
+func (f *FileStore) Query(namespace string, opts ListOptions) (ListPage, error) {
+	if err := opts.Validate(); err != nil {
+		return ListPage{}, err
+	}
+	names, err := f.List(namespace)
+	if err != nil {
+		return ListPage{}, err
+	}
+	sortNames(names, opts.Descending)
+
+	unlock, err := f.readLock()
+	if err != nil {
+		return ListPage{}, err
+	}
+	defer unlock()
+
+	p := newPager(opts)
+	for _, name := range names {
+		more, err := p.add(name, func() (map[string]string, error) {
+			return labelsOf(readMetadataFile(f.metadataPath(namespace, name), namespace, name))
+		})
+		if err != nil {
+			return ListPage{}, err
+		}
+		if !more {
+			break
+		}
+	}
+	return p.page, nil
+}
+
+// revisionDir returns the directory holding the revisions of a config. The
+// namespace and name must already have been validated.
+func (f *FileStore) revisionDir(namespace, name string) string {
+	return filepath.Join(filepath.Clean(f.baseDir), reservedDir, "revisions", namespace, name)
+}
+
+// readRevisions lists the revision files of a config in ascending order.
+// Callers must hold f.mu.
+func (f *FileStore) readRevisions(namespace, name string) ([]Revision, error) {
+	dir := f.revisionDir(namespace, name)
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("failed to read directory %s: %w", dir, err)
+	}
+
+	revs := make([]Revision, 0, len(entries))
+	for _, entry := range entries {
+		n, err := strconv.Atoi(entry.Name())
+		if err != nil || entry.IsDir() {
+			continue
+		}
+		info, err := entry.Info()
+		if err != nil {
+			return nil, fmt.Errorf("failed to stat revision %s: %w", entry.Name(), err)
+		}
+		revs = append(revs, Revision{Number: n, Size: int(info.Size()), Created: info.ModTime().UTC()})
+	}
+	sort.Slice(revs, func(i, j int) bool { return revs[i].Number < revs[j].Number })
+	return revs, nil
+}
+
+// appendRevision records content as the next revision and prunes revisions
+// beyond the retention limit. Callers must hold f.mu for writing.
+func (f *FileStore) appendRevision(namespace, name string, content []byte) error {
+	revs, err := f.readRevisions(namespace, name)
+	if err != nil {
+		return err
+	}
+	next := 1
+	if len(revs) > 0 {
+		next = revs[len(revs)-1].Number + 1
+	}
+
+	dir := f.revisionDir(namespace, name)
+	if err := writeFileAtomic(filepath.Join(dir, strconv.Itoa(next)), content); err != nil {
+		return err
+	}
+
+	return pruneRevisionFiles(dir, revs, f.maxRevisions-1)
+}
+
+// pruneRevisionFiles deletes the oldest of revs, the revision files in dir,
+// until keep remain.
+func pruneRevisionFiles(dir string, revs []Revision, keep int) error {
+	for len(revs) > keep {
+		old := filepath.Join(dir, strconv.Itoa(revs[0].Number))
+		if err := os.Remove(old); err != nil && !os.IsNotExist(err) {
+			return fmt.Errorf("failed to prune revision %s: %w", old, err)
+		}
+		revs = revs[1:]
+	}
+	return nil
+}
+
+// PruneRevisions implements Pruner.
+func (f *FileStore) PruneRevisions(namespace, name string, keep int) error {
+	filePath, err := f.resolvePath(namespace, name)
+	if err != nil {
+		return err
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if err := f.replayJournal(); err != nil {
+		return err
+	}
+
+	if _, err := os.Stat(filePath); err != nil {
+		if os.IsNotExist(err) {
+			return fmt.Errorf("config %s in namespace %s: %w", name, namespace, ErrNotFound)
+		}
+		return fmt.Errorf("failed to stat file %s: %w", filePath, err)
+	}
+	revs, err := f.readRevisions(namespace, name)
+	if err != nil {
+		return err
+	}
+	return pruneRevisionFiles(f.revisionDir(namespace, name), revs, max(keep, 1))
+}
+
+// Revisions implements Versioned.
+func (f *FileStore) Revisions(namespace, name string) ([]Revision, error) {
+	filePath, err := f.resolvePath(namespace, name)
+	if err != nil {
+		return nil, err
+	}
+
+	unlock, err := f.readLock()
+	if err != nil {
+		return nil, err
+	}
+	defer unlock()
+
+	if _, err := os.Stat(filePath); err != nil {
+		if os.IsNotExist(err) {
+			return nil, fmt.Errorf("config %s in namespace %s: %w", name, namespace, ErrNotFound)
+		}
+		return nil, fmt.Errorf("failed to stat file %s: %w", filePath, err)
+	}
+	return f.readRevisions(namespace, name)
+}
+
+// GetRevision implements Versioned.
+func (f *FileStore) GetRevision(namespace, name string, revision int) ([]byte, error) {
+	if _, err := f.resolvePath(namespace, name); err != nil {
+		return nil, err
+	}
+
+	unlock, err := f.readLock()
+	if err != nil {
+		return nil, err
+	}
+	defer unlock()
+
+	revPath := filepath.Join(f.revisionDir(namespace, name), strconv.Itoa(revision))
+	content, err := os.ReadFile(revPath)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, fmt.Errorf("revision %d of config %s in namespace %s: %w", revision, name, namespace, ErrNotFound)
+		}
+		return nil, fmt.Errorf("failed to read revision %s: %w", revPath, err)
+	}
+	return content, nil
+}
+
+// ReservedPath returns a path under the store's bookkeeping directory,
+// which no namespace can collide with.
+func (f *FileStore) ReservedPath(elem ...string) string {
+	return filepath.Join(append([]string{filepath.Clean(f.baseDir), reservedDir}, elem...)...)
+}
+
+// Rewrite implements Rewriter. Each file is replaced atomically, so a crash
+// leaves either the old or the new bytes.
+func (f *FileStore) Rewrite(namespace, name string, fn func([]byte) ([]byte, error)) error {
+	filePath, err := f.resolvePath(namespace, name)
+	if err != nil {
+		return err
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if err := f.replayJournal(); err != nil {
+		return err
+	}
+
+	revs, err := f.readRevisions(namespace, name)
+	if err != nil {
+		return err
+	}
+	paths := []string{filePath}
+	for _, rev := range revs {
+		paths = append(paths, filepath.Join(f.revisionDir(namespace, name), strconv.Itoa(rev.Number)))
+	}
+	for i, p := range paths {
+		content, err := os.ReadFile(p)
+		if err != nil {
+			if i == 0 && os.IsNotExist(err) {
+				return fmt.Errorf("config %s in namespace %s: %w", name, namespace, ErrNotFound)
+			}
+			return fmt.Errorf("failed to read file %s: %w", p, err)
+		}
+		content, err = fn(content)
+		if err != nil {
+			return err
+		}
+		if err := writeFileAtomic(p, content); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Namespaces implements NamespaceLister.
+func (f *FileStore) Namespaces() ([]string, error) {
+	unlock, err := f.readLock()
+	if err != nil {
+		return nil, err
+	}
+	defer unlock()
+
+	entries, err := os.ReadDir(f.baseDir)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return []string{}, nil
+		}
+		return nil, fmt.Errorf("failed to read directory %s: %w", f.baseDir, err)
+	}
+
+	namespaces := make([]string, 0, len(entries))
+	for _, entry := range entries {
+		if entry.IsDir() && entry.Name() != reservedDir {
+			namespaces = append(namespaces, entry.Name())
+		}
+	}
+	records, err := readNamespaceDir(f.ReservedPath("namespaces"))
+	if err != nil {
+		return nil, err
+	}
+	return mergeNames(namespaces, records), nil
+}
+
+// NamespaceInfo implements NamespaceStore.
+func (f *FileStore) NamespaceInfo(namespace string) (NamespaceInfo, error) {
+	if _, err := f.resolveNamespaceDir(namespace); err != nil {
+		return NamespaceInfo{}, err
+	}
+
+	unlock, err := f.readLock()
+	if err != nil {
+		return NamespaceInfo{}, err
+	}
+	defer unlock()
+
+	return readNamespaceFile(f.ReservedPath("namespaces", namespace), namespace)
+}
+
+// SetNamespaceInfo implements NamespaceStore.
+func (f *FileStore) SetNamespaceInfo(info NamespaceInfo) error {
+	if err := ValidateNamespaceInfo(info); err != nil {
+		return err
+	}
+	if _, err := f.resolveNamespaceDir(info.Name); err != nil {
+		return err
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if err := f.replayJournal(); err != nil {
+		return err
+	}
+
+	return writeNamespaceFile(f.ReservedPath("namespaces", info.Name), info)
+}
+
+// DeleteNamespace implements NamespaceStore.
+func (f *FileStore) DeleteNamespace(namespace string) error {
+	dir, err := f.resolveNamespaceDir(namespace)
+	if err != nil {
+		return err
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if err := f.replayJournal(); err != nil {
+		return err
+	}
+
+	record := f.ReservedPath("namespaces", namespace)
+	trash := f.ReservedPath("trash", namespace)
+	_, dirErr := os.Stat(dir)
+	_, recordErr := os.Stat(record)
+	_, trashErr := os.Stat(trash)
+	if os.IsNotExist(dirErr) && os.IsNotExist(recordErr) && os.IsNotExist(trashErr) {
+		return fmt.Errorf("namespace %s: %w", namespace, ErrNotFound)
+	}
+	// Configs go first, so that an interrupted delete leaves no config
+	// without its record.
+	for _, path := range []string{dir, f.ReservedPath("revisions", namespace), f.ReservedPath("metadata", namespace), trash} {
+		if err := os.RemoveAll(path); err != nil {
+			return fmt.Errorf("failed to delete namespace %s: %w", namespace, err)
+		}
+	}
+	if err := removeFileSync(record); err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("failed to delete namespace %s: %w", namespace, err)
+	}
+	return nil
+}
+
+// Usage implements NamespaceStore.
+func (f *FileStore) Usage(namespace string) (NamespaceUsage, error) {
+	dir, err := f.resolveNamespaceDir(namespace)
+	if err != nil {
+		return NamespaceUsage{}, err
+	}
+
+	unlock, err := f.readLock()
+	if err != nil {
+		return NamespaceUsage{}, err
+	}
+	defer unlock()
+
+	usage, err := dirUsage(dir)
+	if err != nil {
+		return NamespaceUsage{}, fmt.Errorf("failed to read namespace %s: %w", namespace, err)
+	}
+	return usage, nil
+}
+
+// metadataPath returns the file holding the metadata of a config.
+func (f *FileStore) metadataPath(namespace, name string) string {
+	return f.ReservedPath("metadata", namespace, name)
+}
+
+// Metadata implements MetadataStore.
+func (f *FileStore) Metadata(namespace, name string) (Metadata, error) {
+	if _, err := f.resolvePath(namespace, name); err != nil {
+		return Metadata{}, err
+	}
+
+	unlock, err := f.readLock()
+	if err != nil {
+		return Metadata{}, err
+	}
+	defer unlock()
+
+	return readMetadataFile(f.metadataPath(namespace, name), namespace, name)
+}
+
+// SetMetadata implements MetadataStore.
+func (f *FileStore) SetMetadata(namespace, name string, md Metadata) error {
+	filePath, err := f.resolvePath(namespace, name)
+	if err != nil {
+		return err
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if err := f.replayJournal(); err != nil {
+		return err
+	}
+
+	if _, err := os.Stat(filePath); os.IsNotExist(err) {
+		return fmt.Errorf("config %s in namespace %s: %w", name, namespace, ErrNotFound)
+	}
+	return writeMetadataFile(f.metadataPath(namespace, name), md)
+}
@@ -272,3 +272,134 @@ func TestStoreConcurrent(t *testing.T) {
 	}
 	wg.Wait()
 }
+
+// testRevisions exercises the Versioned contract shared by both stores.
+func testRevisions(t *testing.T, store interface {
+	Store
+	Versioned
+}) {
+	t.Helper()
+	for _, content := range []string{"v: 1", "v: 2", "v: 3"} {
+		if err := store.Store("dev", "app.yaml", []byte(content)); err != nil {
+			t.Fatalf("Store: %v", err)
+		}
+	}
+
+	revs, err := store.Revisions("dev", "app.yaml")
+	if err != nil {
+		t.Fatalf("Revisions: %v", err)
+	}
+	if len(revs) != 3 || revs[0].Number != 1 || revs[2].Number != 3 || revs[2].Size != 4 {
+		t.Fatalf("unexpected revisions: %+v", revs)
+	}
+
+	got, err := store.GetRevision("dev", "app.yaml", 2)
+	if err != nil || string(got) != "v: 2" {
+		t.Fatalf("GetRevision(2) = %q, %v", got, err)
+	}
+	if _, err := store.GetRevision("dev", "app.yaml", 9); !errors.Is(err, ErrNotFound) {
+		t.Fatalf("missing revision should be ErrNotFound, got %v", err)
+	}
+
+	if err := store.Delete("dev", "app.yaml"); err != nil {
+		t.Fatalf("Delete: %v", err)
+	}
+	if _, err := store.Revisions("dev", "app.yaml"); !errors.Is(err, ErrNotFound) {
+		t.Fatalf("history should be gone after delete, got %v", err)
+	}
+
+	// A recreated config starts a fresh history.
+	if err := store.Store("dev", "app.yaml", []byte("v: new")); err != nil {
+		t.Fatalf("Store: %v", err)
+	}
+	revs, _ = store.Revisions("dev", "app.yaml")
+	if len(revs) != 1 || revs[0].Number != 1 {
+		t.Fatalf("recreated config should restart at revision 1: %+v", revs)
+	}
+}
+
+func TestMemoryStoreRevisions(t *testing.T) {
+	testRevisions(t, NewMemoryStore())
+}
+
+func TestFileStoreRevisions(t *testing.T) {
+	testRevisions(t, NewFileStore(t.TempDir()))
+}
+
+func TestRevisionRetention(t *testing.T) {
+	mem := NewMemoryStore()
+	mem.maxRevisions = 2
+	files := NewFileStore(t.TempDir())
+	files.maxRevisions = 2
+
+	for _, store := range []interface {
+		Store
+		Versioned
+	}{mem, files} {
+		for i := 0; i < 5; i++ {
+			if err := store.Store("dev", "app.yaml", []byte{byte('a' + i)}); err != nil {
+				t.Fatalf("Store: %v", err)
+			}
+		}
+		revs, err := store.Revisions("dev", "app.yaml")
+		if err != nil {
+			t.Fatalf("Revisions: %v", err)
+		}
+		if len(revs) != 2 || revs[0].Number != 4 || revs[1].Number != 5 {
+			t.Fatalf("%T: expected revisions 4 and 5, got %+v", store, revs)
+		}
+	}
+}
+
+// testPruneRevisions exercises a Pruner implementation.
+func testPruneRevisions(t *testing.T, store interface {
+	Store
+	Versioned
+	Pruner
+}) {
+	t.Helper()
+	if err := store.PruneRevisions("dev", "pruned.yaml", 1); !errors.Is(err, ErrNotFound) {
+		t.Fatalf("PruneRevisions of a missing config should be ErrNotFound, got %v", err)
+	}
+	for i := 0; i < 5; i++ {
+		if err := store.Store("dev", "pruned.yaml", []byte{byte('a' + i)}); err != nil {
+			t.Fatalf("Store: %v", err)
+		}
+	}
+	if err := store.PruneRevisions("dev", "pruned.yaml", 2); err != nil {
+		t.Fatalf("PruneRevisions: %v", err)
+	}
+	revs, err := store.Revisions("dev", "pruned.yaml")
+	if err != nil || len(revs) != 2 || revs[0].Number != 4 || revs[1].Number != 5 {
+		t.Fatalf("expected revisions 4 and 5, got %+v, %v", revs, err)
+	}
+
+	// The current content is always kept, and numbering carries on.
+	if err := store.PruneRevisions("dev", "pruned.yaml", 0); err != nil {
+		t.Fatalf("PruneRevisions: %v", err)
+	}
+	store.Store("dev", "pruned.yaml", []byte("f"))
+	revs, _ = store.Revisions("dev", "pruned.yaml")
+	if len(revs) != 2 || revs[0].Number != 5 || revs[1].Number != 6 {
+		t.Fatalf("expected revisions 5 and 6, got %+v", revs)
+	}
+	if got, err := store.Get("dev", "pruned.yaml"); err != nil || string(got) != "f" {
+		t.Fatalf("Get = %q, %v", got, err)
+	}
+}
+
+func TestPruneRevisions(t *testing.T) {
+	testPruneRevisions(t, NewMemoryStore())
+	testPruneRevisions(t, NewFileStore(t.TempDir()))
+	testPruneRevisions(t, NewCachingStore(NewMemoryStore(), CacheOptions{MaxBytes: 1 << 20}))
+}
+
+func TestFileStoreReservedNamespace(t *testing.T) {
+	store := NewFileStore(t.TempDir())
+	if err := store.Store(reservedDir, "x.yaml", []byte("x")); !errors.Is(err, ErrInvalidName) {
+		t.Fatalf("reserved namespace should be rejected, got %v", err)
+	}
+	if _, err := store.List(reservedDir); !errors.Is(err, ErrInvalidName) {
+		t.Fatalf("reserved namespace should be rejected by List, got %v", err)
+	}
+}
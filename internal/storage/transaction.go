@@ -0,0 +1,435 @@
+package storage
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+)
+
+// Tx is a transaction over the configs of one namespace.
+type Tx interface {
+	// Get returns a config as the transaction sees it, including its own
+	// earlier writes.
+	Get(name string) ([]byte, error)
+	// Store writes a config.
+	Store(name string, content []byte) error
+	// Delete deletes a config, or returns ErrNotFound if it does not exist.
+	Delete(name string) error
+}
+
+// Transactional is implemented by stores that can change several configs
+// of a namespace at once.
+type Transactional interface {
+	// Update calls fn with a transaction over namespace. Its reads see no
+	// concurrent writes, so checks made in fn still hold when its writes
+	// are applied. If fn returns nil the writes are applied together, each
+	// recording a revision as Store and Delete would; otherwise none is,
+	// and Update returns fn's error.
+	Update(namespace string, fn func(tx Tx) error) error
+}
+
+// ReadTx is a read-only view of the configs of one namespace.
+type ReadTx interface {
+	// Get returns a config.
+	Get(name string) ([]byte, error)
+	// List lists the configs of the namespace.
+	List() ([]string, error)
+}
+
+// Viewer is implemented by stores that can read several configs of a
+// namespace as they were at a single point in time.
+type Viewer interface {
+	// View calls fn with a view of namespace that no write changes while
+	// fn runs, and returns fn's error.
+	View(namespace string, fn func(tx ReadTx) error) error
+}
+
+// stagedTx is a TrashTx that collects writes over a base it reads from,
+// for stores that apply them once fn has succeeded. Writes hold the new
+// content, or nil for a delete, in the order the names were first written;
+// trash holds the items of the configs trashed.
+type stagedTx struct {
+	namespace string
+	validate  func(name string) error
+	get       func(name string) ([]byte, error)
+	metadata  func(name string) (*Metadata, error)
+	writes    map[string][]byte
+	order     []string
+	trash     []trashRecord
+}
+
+func newStagedTx(namespace string, validate func(name string) error, get func(name string) ([]byte, error), metadata func(name string) (*Metadata, error)) *stagedTx {
+	return &stagedTx{namespace: namespace, validate: validate, get: get, metadata: metadata, writes: make(map[string][]byte)}
+}
+
+func (t *stagedTx) Get(name string) ([]byte, error) {
+	if err := t.validate(name); err != nil {
+		return nil, err
+	}
+	content, written := t.writes[name]
+	if !written {
+		return t.get(name)
+	}
+	if content == nil {
+		return nil, fmt.Errorf("config %s in namespace %s: %w", name, t.namespace, ErrNotFound)
+	}
+	return append([]byte(nil), content...), nil
+}
+
+func (t *stagedTx) Store(name string, content []byte) error {
+	if err := t.validate(name); err != nil {
+		return err
+	}
+	t.stage(name, append([]byte{}, content...))
+	return nil
+}
+
+func (t *stagedTx) Delete(name string) error {
+	if _, err := t.Get(name); err != nil {
+		return err
+	}
+	t.stage(name, nil)
+	return nil
+}
+
+// Trash stages a delete, keeping the content the transaction sees and the
+// metadata record the store has.
+func (t *stagedTx) Trash(_ Author, name string) (TrashItem, error) {
+	content, err := t.Get(name)
+	if err != nil {
+		return TrashItem{}, err
+	}
+	md, err := t.metadata(name)
+	if err != nil {
+		return TrashItem{}, err
+	}
+	rec, err := newTrashRecord(name, content, md)
+	if err != nil {
+		return TrashItem{}, err
+	}
+	t.stage(name, nil)
+	t.trash = append(t.trash, rec)
+	return rec.TrashItem, nil
+}
+
+func (t *stagedTx) stage(name string, content []byte) {
+	if _, written := t.writes[name]; !written {
+		t.order = append(t.order, name)
+	}
+	t.writes[name] = content
+}
+
+// journal records the writes of a FileStore transaction before they are
+// applied, so that they can be finished after a crash or a failure part way.
+// Trash holds the items of the configs it moves to the trash.
+type journal struct {
+	Namespace string         `json:"namespace"`
+	Writes    []journalWrite `json:"writes"`
+	Trash     []trashRecord  `json:"trash,omitempty"`
+}
+
+// journalWrite is a write of a journal; Delete is set for deletes.
+type journalWrite struct {
+	Name    string `json:"name"`
+	Content []byte `json:"content,omitempty"`
+	Delete  bool   `json:"delete,omitempty"`
+}
+
+func (t *stagedTx) journal() journal {
+	j := journal{Namespace: t.namespace, Trash: t.trash}
+	for _, name := range t.order {
+		content := t.writes[name]
+		j.Writes = append(j.Writes, journalWrite{Name: name, Content: content, Delete: content == nil})
+	}
+	return j
+}
+
+// journalPath is where FileStore keeps the journal of the transaction being
+// applied.
+func (f *FileStore) journalPath() string {
+	return f.ReservedPath("journal.json")
+}
+
+// applyJournal applies the writes of a journal, writing its trash items
+// before any config is deleted. Writes that were already applied before a
+// crash are applied again without recording another revision. Every write
+// path replays a pending journal first, so nothing written since the
+// journal can be overwritten by it. Callers must hold f.mu for writing.
+func (f *FileStore) applyJournal(j journal) error {
+	for _, rec := range j.Trash {
+		if err := writeTrashFile(f.trashPath(j.Namespace, rec.ID), rec); err != nil {
+			return err
+		}
+	}
+	for _, w := range j.Writes {
+		filePath, err := f.resolvePath(j.Namespace, w.Name)
+		if err != nil {
+			return err
+		}
+		if w.Delete {
+			if _, err := os.Stat(filePath); err == nil {
+				if err := f.deleteLocked(filePath, j.Namespace, w.Name); err != nil {
+					return err
+				}
+				continue
+			}
+			// The config may have gone before its revisions and metadata did.
+			if err := os.RemoveAll(f.revisionDir(j.Namespace, w.Name)); err != nil {
+				return err
+			}
+			if err := removeFileSync(f.metadataPath(j.Namespace, w.Name)); err != nil && !os.IsNotExist(err) {
+				return err
+			}
+			continue
+		}
+		if f.isLatestRevision(filePath, j.Namespace, w.Name, w.Content) {
+			continue
+		}
+		if err := f.storeLocked(filePath, j.Namespace, w.Name, w.Content); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// isLatestRevision reports whether content is both the current content of
+// a config and its newest revision. Callers must hold f.mu.
+func (f *FileStore) isLatestRevision(filePath, namespace, name string, content []byte) bool {
+	current, err := os.ReadFile(filePath)
+	if err != nil || string(current) != string(content) {
+		return false
+	}
+	revs, err := f.readRevisions(namespace, name)
+	if err != nil || len(revs) == 0 {
+		return false
+	}
+	latest, err := os.ReadFile(filepath.Join(f.revisionDir(namespace, name), strconv.Itoa(revs[len(revs)-1].Number)))
+	return err == nil && string(latest) == string(content)
+}
+
+// commitJournal applies a transaction's writes through a journal: the
+// journal is made durable first and removed once every write is applied.
+// Callers must hold f.mu for writing.
+func (f *FileStore) commitJournal(j journal) error {
+	if len(j.Writes) == 0 {
+		return nil
+	}
+	data, err := json.Marshal(j)
+	if err != nil {
+		return err
+	}
+	f.noJournal = false
+	if err := writeFileAtomic(f.journalPath(), data); err != nil {
+		return fmt.Errorf("failed to write journal: %w", err)
+	}
+	if err := f.applyJournal(j); err != nil {
+		// The journal stays behind, and the next read or write finishes
+		// the transaction before doing anything else.
+		return fmt.Errorf("failed to apply transaction in namespace %s: %w: %w", j.Namespace, ErrIncomplete, err)
+	}
+	if err := removeFileSync(f.journalPath()); err != nil {
+		return fmt.Errorf("failed to remove journal: %w", err)
+	}
+	f.noJournal = true
+	return nil
+}
+
+// replayJournal finishes applying a transaction that was interrupted by a
+// crash or failed part way, if there is one. Every write path calls it
+// before writing, and readers through readLock. Callers must hold f.mu for
+// writing.
+func (f *FileStore) replayJournal() error {
+	data, err := os.ReadFile(f.journalPath())
+	if os.IsNotExist(err) {
+		f.noJournal = true
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("failed to read journal: %w", err)
+	}
+	var j journal
+	if err := json.Unmarshal(data, &j); err != nil {
+		return fmt.Errorf("failed to parse journal: %w", err)
+	}
+	if err := f.applyJournal(j); err != nil {
+		return fmt.Errorf("failed to replay transaction in namespace %s: %w", j.Namespace, err)
+	}
+	if err := removeFileSync(f.journalPath()); err != nil {
+		return fmt.Errorf("failed to remove journal: %w", err)
+	}
+	f.noJournal = true
+	return nil
+}
+
+// readLock locks f for reading and returns the function that unlocks it.
+// While a transaction is pending in the journal it instead locks f for
+// writing and finishes the transaction, so that readers never see one
+// applied in part; if that fails, f is left unlocked and the error is
+// returned.
+func (f *FileStore) readLock() (func(), error) {
+	f.mu.RLock()
+	if f.noJournal {
+		return f.mu.RUnlock, nil
+	}
+	f.mu.RUnlock()
+
+	f.mu.Lock()
+	if err := f.replayJournal(); err != nil {
+		f.mu.Unlock()
+		return nil, err
+	}
+	return f.mu.Unlock, nil
+}
+
+// Update implements Transactional. The writes are recorded in a journal
+// before any is applied; a transaction that fails part way returns
+// ErrIncomplete and is finished from the journal by the next read or write,
+// or by Recover.
+func (f *FileStore) Update(namespace string, fn func(tx Tx) error) error {
+	if _, err := f.resolveNamespaceDir(namespace); err != nil {
+		return err
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if err := f.replayJournal(); err != nil {
+		return err
+	}
+
+	tx := newStagedTx(namespace, func(name string) error {
+		_, err := f.resolvePath(namespace, name)
+		return err
+	}, func(name string) ([]byte, error) {
+		filePath, err := f.resolvePath(namespace, name)
+		if err != nil {
+			return nil, err
+		}
+		return f.getLocked(filePath, namespace, name)
+	}, func(name string) (*Metadata, error) {
+		md, err := readMetadataFile(f.metadataPath(namespace, name), namespace, name)
+		if errors.Is(err, ErrNotFound) {
+			return nil, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		return &md, nil
+	})
+	if err := fn(tx); err != nil {
+		return err
+	}
+	return f.commitJournal(tx.journal())
+}
+
+// Update implements Transactional.
+func (m *MemoryStore) Update(namespace string, fn func(tx Tx) error) error {
+	if err := validateName(namespace); err != nil {
+		return err
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	tx := newStagedTx(namespace, func(name string) error {
+		return validateNamespaceAndName(namespace, name)
+	}, func(name string) ([]byte, error) {
+		return m.getLocked(namespace, name)
+	}, func(name string) (*Metadata, error) {
+		if record, ok := m.metadata[namespace][name]; ok {
+			return &record, nil
+		}
+		return nil, nil
+	})
+	if err := fn(tx); err != nil {
+		return err
+	}
+	// Every write is checked before any is applied, so that none is if one
+	// would fail. A delete of a config the namespace did not have undoes
+	// the transaction's own store of it, and has nothing left to do.
+	var deletes []string
+	for _, name := range tx.order {
+		if tx.writes[name] != nil {
+			continue
+		}
+		if _, err := m.getLocked(namespace, name); err == nil {
+			deletes = append(deletes, name)
+		} else if !errors.Is(err, ErrNotFound) {
+			return err
+		}
+	}
+	for _, name := range tx.order {
+		if content := tx.writes[name]; content != nil {
+			m.storeLocked(namespace, name, content)
+		}
+	}
+	for _, name := range deletes {
+		if err := m.deleteLocked(namespace, name); err != nil {
+			return err
+		}
+	}
+	for _, rec := range tx.trash {
+		if m.trash[namespace] == nil {
+			m.trash[namespace] = make(map[string]trashRecord)
+		}
+		m.trash[namespace][rec.ID] = rec
+	}
+	return nil
+}
+
+// lockedView is a ReadTx over a store whose lock the caller holds.
+type lockedView struct {
+	get  func(name string) ([]byte, error)
+	list func() ([]string, error)
+}
+
+func (v lockedView) Get(name string) ([]byte, error) { return v.get(name) }
+func (v lockedView) List() ([]string, error)         { return v.list() }
+
+// View implements Viewer.
+func (m *MemoryStore) View(namespace string, fn func(tx ReadTx) error) error {
+	if err := validateName(namespace); err != nil {
+		return err
+	}
+
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	return fn(lockedView{
+		get: func(name string) ([]byte, error) {
+			if err := validateNamespaceAndName(namespace, name); err != nil {
+				return nil, err
+			}
+			return m.getLocked(namespace, name)
+		},
+		list: func() ([]string, error) { return m.listLocked(namespace), nil },
+	})
+}
+
+// View implements Viewer.
+func (f *FileStore) View(namespace string, fn func(tx ReadTx) error) error {
+	namespaceDir, err := f.resolveNamespaceDir(namespace)
+	if err != nil {
+		return err
+	}
+
+	unlock, err := f.readLock()
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	return fn(lockedView{
+		get: func(name string) ([]byte, error) {
+			filePath, err := f.resolvePath(namespace, name)
+			if err != nil {
+				return nil, err
+			}
+			return f.getLocked(filePath, namespace, name)
+		},
+		list: func() ([]string, error) { return listDir(namespaceDir) },
+	})
+}
@@ -0,0 +1,346 @@
+package storage
+
+import (
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+)
+
+// testTransactions exercises a Transactional implementation.
+func testTransactions(t *testing.T, store interface {
+	Store
+	Versioned
+	Transactional
+}) {
+	t.Helper()
+	store.Store("dev", "app.yaml", []byte("db: old"))
+	store.Store("dev", "old.yaml", []byte("v: 1"))
+
+	err := store.Update("dev", func(tx Tx) error {
+		if err := tx.Store("app.yaml", []byte("db: new")); err != nil {
+			return err
+		}
+		if err := tx.Store("worker.yaml", []byte("db: new")); err != nil {
+			return err
+		}
+		if err := tx.Delete("old.yaml"); err != nil {
+			return err
+		}
+		// Reads see the transaction's own writes.
+		if content, err := tx.Get("worker.yaml"); err != nil || string(content) != "db: new" {
+			t.Fatalf("tx.Get of a stored config = %q, %v", content, err)
+		}
+		if _, err := tx.Get("old.yaml"); !errors.Is(err, ErrNotFound) {
+			t.Fatalf("tx.Get of a deleted config should be ErrNotFound, got %v", err)
+		}
+		if err := tx.Delete("old.yaml"); !errors.Is(err, ErrNotFound) {
+			t.Fatalf("deleting twice should be ErrNotFound, got %v", err)
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("Update: %v", err)
+	}
+	if names, err := store.List("dev"); err != nil || !slices.Equal(sorted(names), []string{"app.yaml", "worker.yaml"}) {
+		t.Fatalf("List after commit = %v, %v", names, err)
+	}
+	if content, err := store.Get("dev", "app.yaml"); err != nil || string(content) != "db: new" {
+		t.Fatalf("Get after commit = %q, %v", content, err)
+	}
+	if revs, err := store.Revisions("dev", "app.yaml"); err != nil || len(revs) != 2 {
+		t.Fatalf("a committed write should record a revision, got %+v, %v", revs, err)
+	}
+
+	// A failing transaction applies none of its writes.
+	errAbort := errors.New("abort")
+	err = store.Update("dev", func(tx Tx) error {
+		tx.Store("app.yaml", []byte("db: rolled back"))
+		tx.Delete("worker.yaml")
+		tx.Store("new.yaml", []byte("v: 1"))
+		return errAbort
+	})
+	if !errors.Is(err, errAbort) {
+		t.Fatalf("Update should return fn's error, got %v", err)
+	}
+	if names, _ := store.List("dev"); !slices.Equal(sorted(names), []string{"app.yaml", "worker.yaml"}) {
+		t.Fatalf("List after rollback = %v", names)
+	}
+	if content, _ := store.Get("dev", "app.yaml"); string(content) != "db: new" {
+		t.Fatalf("Get after rollback = %q", content)
+	}
+	if revs, _ := store.Revisions("dev", "app.yaml"); len(revs) != 2 {
+		t.Fatalf("a rolled back write should not record a revision, got %+v", revs)
+	}
+
+	// Deleting every config of a namespace and writing it again works in
+	// one transaction.
+	err = store.Update("dev", func(tx Tx) error {
+		tx.Delete("app.yaml")
+		tx.Delete("worker.yaml")
+		return tx.Store("worker.yaml", []byte("v: 2"))
+	})
+	if err != nil {
+		t.Fatalf("Update: %v", err)
+	}
+	if names, _ := store.List("dev"); !slices.Equal(sorted(names), []string{"worker.yaml"}) {
+		t.Fatalf("List = %v", names)
+	}
+
+	// A config stored and deleted again in one transaction is never
+	// written, and does not stop the transaction's other writes.
+	err = store.Update("dev", func(tx Tx) error {
+		tx.Store("worker.yaml", []byte("v: 3"))
+		tx.Store("tmp.yaml", []byte("v: 1"))
+		return tx.Delete("tmp.yaml")
+	})
+	if err != nil {
+		t.Fatalf("Update: %v", err)
+	}
+	if names, _ := store.List("dev"); !slices.Equal(sorted(names), []string{"worker.yaml"}) {
+		t.Fatalf("List = %v", names)
+	}
+	if content, _ := store.Get("dev", "worker.yaml"); string(content) != "v: 3" {
+		t.Fatalf("Get = %q", content)
+	}
+
+	if err := store.Update("../x", func(Tx) error { return nil }); !errors.Is(err, ErrInvalidName) {
+		t.Fatalf("expected ErrInvalidName, got %v", err)
+	}
+	err = store.Update("dev", func(tx Tx) error { return tx.Store("../x", []byte("v: 1")) })
+	if !errors.Is(err, ErrInvalidName) {
+		t.Fatalf("expected ErrInvalidName, got %v", err)
+	}
+}
+
+// sorted returns names in ascending order; List does not order them.
+func sorted(names []string) []string {
+	slices.Sort(names)
+	return names
+}
+
+func TestMemoryStoreTransactions(t *testing.T) {
+	testTransactions(t, NewMemoryStore())
+}
+
+func TestFileStoreTransactions(t *testing.T) {
+	testTransactions(t, NewFileStore(t.TempDir()))
+}
+
+func TestTransactionsThroughWrappers(t *testing.T) {
+	testTransactions(t, NewCachingStore(NewMemoryStore(), CacheOptions{MaxBytes: 1 << 20}))
+
+	encrypted, err := NewEncryptedStore(NewMemoryStore(), testMasterKeys(t, 1), nil)
+	if err != nil {
+		t.Fatalf("NewEncryptedStore: %v", err)
+	}
+	testTransactions(t, encrypted)
+
+	// The cache must not serve configs written by a transaction.
+	cache := NewCachingStore(NewMemoryStore(), CacheOptions{MaxBytes: 1 << 20})
+	cache.Store("dev", "app.yaml", []byte("v: 1"))
+	cache.Get("dev", "app.yaml")
+	cache.Update("dev", func(tx Tx) error { return tx.Store("app.yaml", []byte("v: 2")) })
+	if content, _ := cache.Get("dev", "app.yaml"); string(content) != "v: 2" {
+		t.Fatalf("Get after Update = %q", content)
+	}
+
+	if err := NewCachingStore(plainStore{NewMemoryStore()}, CacheOptions{}).Update("dev", func(Tx) error { return nil }); !errors.Is(err, ErrUnsupported) {
+		t.Fatalf("expected ErrUnsupported, got %v", err)
+	}
+}
+
+func TestFileStoreRecoverReplaysJournal(t *testing.T) {
+	dir := t.TempDir()
+	store := NewFileStore(dir)
+	store.Store("dev", "app.yaml", []byte("db: old"))
+	store.Store("dev", "old.yaml", []byte("v: 1"))
+
+	// Simulate a crash after the first write of a transaction was applied.
+	j := journal{Namespace: "dev", Writes: []journalWrite{
+		{Name: "app.yaml", Content: []byte("db: new")},
+		{Name: "worker.yaml", Content: []byte("db: new")},
+		{Name: "old.yaml", Delete: true},
+	}}
+	store.Store("dev", "app.yaml", []byte("db: new"))
+	data, _ := json.Marshal(j)
+	if err := os.WriteFile(store.journalPath(), data, 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	reopened := NewFileStore(dir)
+	if _, err := reopened.Recover(); err != nil {
+		t.Fatalf("Recover: %v", err)
+	}
+	if names, _ := reopened.List("dev"); !slices.Equal(sorted(names), []string{"app.yaml", "worker.yaml"}) {
+		t.Fatalf("List after replay = %v", names)
+	}
+	if revs, _ := reopened.Revisions("dev", "app.yaml"); len(revs) != 2 {
+		t.Fatalf("a write applied before the crash should not record another revision, got %+v", revs)
+	}
+	if _, err := os.Stat(reopened.journalPath()); !os.IsNotExist(err) {
+		t.Fatalf("journal should be removed after replay, got %v", err)
+	}
+}
+
+func TestFileStoreReplaysJournalBeforeWrites(t *testing.T) {
+	dir := t.TempDir()
+	store := NewFileStore(dir)
+	store.Store("dev", "app.yaml", []byte("db: old"))
+
+	// A transaction fails part way when a config cannot be written: here,
+	// a directory stands in its place.
+	blocked := filepath.Join(dir, "dev", "worker.yaml")
+	if err := os.MkdirAll(filepath.Join(blocked, "x"), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	err := store.Update("dev", func(tx Tx) error {
+		tx.Store("app.yaml", []byte("db: new"))
+		return tx.Store("worker.yaml", []byte("db: new"))
+	})
+	if !errors.Is(err, ErrIncomplete) {
+		t.Fatalf("expected ErrIncomplete, got %v", err)
+	}
+
+	// The next write completes the transaction first, so it is not
+	// overwritten by it afterwards.
+	if err := os.RemoveAll(blocked); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.Store("dev", "app.yaml", []byte("db: newer")); err != nil {
+		t.Fatalf("Store: %v", err)
+	}
+	if got, _ := store.Get("dev", "worker.yaml"); string(got) != "db: new" {
+		t.Fatalf("worker.yaml = %q, want the transaction's write", got)
+	}
+	if got, _ := store.Get("dev", "app.yaml"); string(got) != "db: newer" {
+		t.Fatalf("app.yaml = %q, want the later write", got)
+	}
+	if err := store.Update("dev", func(Tx) error { return nil }); err != nil {
+		t.Fatalf("Update: %v", err)
+	}
+	if got, _ := store.Get("dev", "app.yaml"); string(got) != "db: newer" {
+		t.Fatalf("app.yaml = %q after another transaction, want the later write", got)
+	}
+}
+
+func TestFileStoreReplaysJournalBeforeReads(t *testing.T) {
+	dir := t.TempDir()
+	store := NewFileStore(dir)
+	store.Store("dev", "app.yaml", []byte("db: old"))
+
+	blocked := filepath.Join(dir, "dev", "worker.yaml")
+	if err := os.MkdirAll(filepath.Join(blocked, "x"), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	err := store.Update("dev", func(tx Tx) error {
+		tx.Store("app.yaml", []byte("db: new"))
+		return tx.Store("worker.yaml", []byte("db: new"))
+	})
+	if !errors.Is(err, ErrIncomplete) {
+		t.Fatalf("expected ErrIncomplete, got %v", err)
+	}
+
+	// While the transaction cannot be finished, reads fail rather than see
+	// app.yaml written without worker.yaml.
+	if got, err := store.Get("dev", "app.yaml"); err == nil {
+		t.Fatalf("Get returned %q while the transaction was applied in part", got)
+	}
+	if err := store.View("dev", func(ReadTx) error { return nil }); err == nil {
+		t.Fatal("View succeeded while the transaction was applied in part")
+	}
+
+	if err := os.RemoveAll(blocked); err != nil {
+		t.Fatal(err)
+	}
+	if names, err := store.List("dev"); err != nil || !slices.Equal(sorted(names), []string{"app.yaml", "worker.yaml"}) {
+		t.Fatalf("List = %v, %v; want both configs of the transaction", names, err)
+	}
+	err = store.View("dev", func(tx ReadTx) error {
+		for _, name := range []string{"app.yaml", "worker.yaml"} {
+			if got, err := tx.Get(name); err != nil || string(got) != "db: new" {
+				t.Errorf("%s = %q, %v; want the transaction's write", name, got, err)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("View: %v", err)
+	}
+	if _, err := os.Stat(store.journalPath()); !os.IsNotExist(err) {
+		t.Fatalf("journal should be removed by the read, got %v", err)
+	}
+}
+
+// testViews exercises a Viewer implementation.
+func testViews(t *testing.T, store interface {
+	Store
+	Viewer
+}) {
+	t.Helper()
+	store.Store("dev", "app.yaml", []byte("v: 1"))
+	store.Store("dev", "db.yaml", []byte("host: db"))
+	store.Store("test", "app.yaml", []byte("v: 2"))
+
+	err := store.View("dev", func(tx ReadTx) error {
+		names, err := tx.List()
+		if err != nil || !slices.Equal(sorted(names), []string{"app.yaml", "db.yaml"}) {
+			t.Fatalf("tx.List = %v, %v", names, err)
+		}
+		if content, err := tx.Get("app.yaml"); err != nil || string(content) != "v: 1" {
+			t.Fatalf("tx.Get = %q, %v", content, err)
+		}
+		if _, err := tx.Get("missing.yaml"); !errors.Is(err, ErrNotFound) {
+			t.Fatalf("tx.Get of a missing config should be ErrNotFound, got %v", err)
+		}
+		if _, err := tx.Get("../x"); !errors.Is(err, ErrInvalidName) {
+			t.Fatalf("expected ErrInvalidName, got %v", err)
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("View: %v", err)
+	}
+
+	err = store.View("empty", func(tx ReadTx) error {
+		if names, err := tx.List(); err != nil || len(names) != 0 {
+			t.Fatalf("tx.List of an empty namespace = %v, %v", names, err)
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("View: %v", err)
+	}
+
+	errAbort := errors.New("abort")
+	if err := store.View("dev", func(ReadTx) error { return errAbort }); !errors.Is(err, errAbort) {
+		t.Fatalf("View should return fn's error, got %v", err)
+	}
+	if err := store.View("../x", func(ReadTx) error { return nil }); !errors.Is(err, ErrInvalidName) {
+		t.Fatalf("expected ErrInvalidName, got %v", err)
+	}
+}
+
+func TestMemoryStoreViews(t *testing.T) {
+	testViews(t, NewMemoryStore())
+}
+
+func TestFileStoreViews(t *testing.T) {
+	testViews(t, NewFileStore(t.TempDir()))
+}
+
+func TestViewsThroughWrappers(t *testing.T) {
+	testViews(t, NewCachingStore(NewMemoryStore(), CacheOptions{MaxBytes: 1 << 20}))
+
+	encrypted, err := NewEncryptedStore(NewMemoryStore(), testMasterKeys(t, 1), nil)
+	if err != nil {
+		t.Fatalf("NewEncryptedStore: %v", err)
+	}
+	testViews(t, encrypted)
+
+	if err := NewCachingStore(plainStore{NewMemoryStore()}, CacheOptions{}).View("dev", func(ReadTx) error { return nil }); !errors.Is(err, ErrUnsupported) {
+		t.Fatalf("expected ErrUnsupported, got %v", err)
+	}
+}
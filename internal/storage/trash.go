@@ -0,0 +1,569 @@
+package storage
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ErrExists is returned when restoring a config from the trash would
+// replace a config that exists.
+var ErrExists = errors.New("already exists")
+
+// TrashItem is a deleted config kept in its namespace's trash.
+type TrashItem struct {
+	// ID identifies the item within its namespace's trash.
+	ID string `json:"id"`
+	// Name is the config the item was deleted from.
+	Name    string    `json:"name"`
+	Deleted time.Time `json:"deleted"`
+	Size    int       `json:"size"`
+	// Metadata is the config's record when it was deleted, if it had one.
+	Metadata *Metadata `json:"metadata,omitempty"`
+}
+
+// RestoreOptions configures Trasher.Restore.
+type RestoreOptions struct {
+	// Name restores the item as this config instead of the one it was
+	// deleted from.
+	Name string
+	// Overwrite replaces a config that exists under the name; otherwise
+	// Restore returns ErrExists.
+	Overwrite bool
+	// Rewrite, when set, is applied to the item's content before it is
+	// restored, e.g. to bind encrypted content to its new name.
+	Rewrite func(item TrashItem, content []byte) ([]byte, error)
+}
+
+// Trasher is implemented by stores that can keep deleted configs in a
+// per-namespace trash, from which they can be restored until purged. Only
+// the content and metadata record of a config are kept; its revisions are
+// discarded as by Delete, and restoring it records a new revision.
+type Trasher interface {
+	// Trash deletes a config as Delete does, keeping its content and
+	// metadata record in the trash. Stores that record authors attribute
+	// the deletion to author.
+	Trash(author Author, namespace, name string) (TrashItem, error)
+	// TrashItems lists the trash of a namespace, oldest first.
+	TrashItems(namespace string) ([]TrashItem, error)
+	// Restore stores an item as a config again, with its metadata record,
+	// and removes it from the trash. It returns the item named as
+	// restored.
+	Restore(author Author, namespace, id string, opts RestoreOptions) (TrashItem, error)
+	// Purge deletes an item from the trash for good.
+	Purge(namespace, id string) error
+	// PurgeTrash purges the items of every namespace deleted before
+	// cutoff and returns how many it purged.
+	PurgeTrash(cutoff time.Time) (int, error)
+	// RewriteTrash replaces the content of an item with what fn returns.
+	// It is what lets EncryptedStore re-encrypt the trash.
+	RewriteTrash(namespace, id string, fn func(content []byte) ([]byte, error)) error
+}
+
+// TrashTx is implemented by the transactions of stores that can move a
+// config to the trash as one of a transaction's writes.
+type TrashTx interface {
+	Tx
+	// Trash deletes a config as Delete does, keeping its content and
+	// metadata record in the trash once the transaction is applied.
+	Trash(author Author, name string) (TrashItem, error)
+}
+
+// trashRecord is a TrashItem together with its content, as the stores that
+// keep items as single records hold them.
+type trashRecord struct {
+	TrashItem
+	Content []byte `json:"content"`
+}
+
+// newTrashRecord records content and metadata of a config being trashed
+// now under a new, unique ID. IDs start with the deletion time, so they
+// sort by it.
+func newTrashRecord(name string, content []byte, md *Metadata) (trashRecord, error) {
+	suffix := make([]byte, 4)
+	if _, err := rand.Read(suffix); err != nil {
+		return trashRecord{}, err
+	}
+	deleted := time.Now().UTC()
+	if md != nil {
+		clone := cloneMetadata(*md)
+		md = &clone
+	}
+	return trashRecord{
+		TrashItem: TrashItem{
+			ID:       fmt.Sprintf("%019d-%s", deleted.UnixNano(), hex.EncodeToString(suffix)),
+			Name:     name,
+			Deleted:  deleted,
+			Size:     len(content),
+			Metadata: md,
+		},
+		Content: append([]byte(nil), content...),
+	}, nil
+}
+
+// trashDeleted returns the deletion time an ID starts with.
+func trashDeleted(id string) (time.Time, bool) {
+	nanos, _, ok := strings.Cut(id, "-")
+	if !ok {
+		return time.Time{}, false
+	}
+	n, err := strconv.ParseInt(nanos, 10, 64)
+	if err != nil {
+		return time.Time{}, false
+	}
+	return time.Unix(0, n).UTC(), true
+}
+
+// restoreTarget returns the name an item is restored as.
+func (o RestoreOptions) restoreTarget(item TrashItem) string {
+	if o.Name != "" {
+		return o.Name
+	}
+	return item.Name
+}
+
+// restoreContent returns the content an item is restored with.
+func (o RestoreOptions) restoreContent(item TrashItem, content []byte) ([]byte, error) {
+	if o.Rewrite == nil {
+		return content, nil
+	}
+	return o.Rewrite(item, content)
+}
+
+// restoredItem returns an item named as restored.
+func restoredItem(item TrashItem, name string) TrashItem {
+	item.Name = name
+	return item
+}
+
+func errTrashItemNotFound(namespace, id string) error {
+	return fmt.Errorf("trash item %s in namespace %s: %w", id, namespace, ErrNotFound)
+}
+
+func errConfigExists(namespace, name string) error {
+	return fmt.Errorf("config %s in namespace %s: %w", name, namespace, ErrExists)
+}
+
+// sortTrash orders items oldest first.
+func sortTrash(items []TrashItem) {
+	sort.Slice(items, func(i, j int) bool {
+		if !items[i].Deleted.Equal(items[j].Deleted) {
+			return items[i].Deleted.Before(items[j].Deleted)
+		}
+		return items[i].ID < items[j].ID
+	})
+}
+
+// readTrashFile reads a trash item kept as a JSON file.
+func readTrashFile(path, namespace, id string) (trashRecord, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return trashRecord{}, errTrashItemNotFound(namespace, id)
+		}
+		return trashRecord{}, fmt.Errorf("failed to read trash item %s in namespace %s: %w", id, namespace, err)
+	}
+	var rec trashRecord
+	if err := json.Unmarshal(data, &rec); err != nil {
+		return trashRecord{}, fmt.Errorf("failed to parse trash item %s in namespace %s: %w", id, namespace, err)
+	}
+	return rec, nil
+}
+
+// writeTrashFile writes a trash item as a JSON file, atomically.
+func writeTrashFile(path string, rec trashRecord) error {
+	data, err := json.Marshal(rec)
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(path, data)
+}
+
+// readTrashDir lists the trash items kept as files in the directory of a
+// namespace's trash.
+func readTrashDir(dir, namespace string) ([]TrashItem, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return []TrashItem{}, nil
+		}
+		return nil, fmt.Errorf("failed to list trash of namespace %s: %w", namespace, err)
+	}
+	items := make([]TrashItem, 0, len(entries))
+	for _, entry := range entries {
+		if entry.IsDir() || isTempFile(entry.Name()) {
+			continue
+		}
+		rec, err := readTrashFile(filepath.Join(dir, entry.Name()), namespace, entry.Name())
+		if errors.Is(err, ErrNotFound) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		items = append(items, rec.TrashItem)
+	}
+	sortTrash(items)
+	return items, nil
+}
+
+// purgeTrashDirs purges the trash items kept as files under root, one
+// directory per namespace, that were deleted before cutoff.
+func purgeTrashDirs(root string, cutoff time.Time) (int, error) {
+	namespaces, err := os.ReadDir(root)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return 0, nil
+		}
+		return 0, fmt.Errorf("failed to list trash: %w", err)
+	}
+	purged := 0
+	for _, namespace := range namespaces {
+		if !namespace.IsDir() {
+			continue
+		}
+		dir := filepath.Join(root, namespace.Name())
+		entries, err := os.ReadDir(dir)
+		if err != nil {
+			return purged, fmt.Errorf("failed to list trash of namespace %s: %w", namespace.Name(), err)
+		}
+		for _, entry := range entries {
+			deleted, ok := trashDeleted(entry.Name())
+			if !ok || !deleted.Before(cutoff) {
+				continue
+			}
+			if err := removeFileSync(filepath.Join(dir, entry.Name())); err != nil && !os.IsNotExist(err) {
+				return purged, fmt.Errorf("failed to purge trash item %s in namespace %s: %w", entry.Name(), namespace.Name(), err)
+			}
+			purged++
+		}
+		// The directory goes with its last item; failing to remove it only
+		// means it is not empty.
+		_ = os.Remove(dir)
+	}
+	return purged, nil
+}
+
+// Trash implements Trasher.
+func (m *MemoryStore) Trash(_ Author, namespace, name string) (TrashItem, error) {
+	if err := validateNamespaceAndName(namespace, name); err != nil {
+		return TrashItem{}, err
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	content, err := m.getLocked(namespace, name)
+	if err != nil {
+		return TrashItem{}, err
+	}
+	var md *Metadata
+	if record, ok := m.metadata[namespace][name]; ok {
+		md = &record
+	}
+	rec, err := newTrashRecord(name, content, md)
+	if err != nil {
+		return TrashItem{}, err
+	}
+	if err := m.deleteLocked(namespace, name); err != nil {
+		return TrashItem{}, err
+	}
+	if m.trash[namespace] == nil {
+		m.trash[namespace] = make(map[string]trashRecord)
+	}
+	m.trash[namespace][rec.ID] = rec
+	return rec.TrashItem, nil
+}
+
+// TrashItems implements Trasher.
+func (m *MemoryStore) TrashItems(namespace string) ([]TrashItem, error) {
+	if err := validateName(namespace); err != nil {
+		return nil, err
+	}
+
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	items := make([]TrashItem, 0, len(m.trash[namespace]))
+	for _, rec := range m.trash[namespace] {
+		items = append(items, rec.TrashItem)
+	}
+	sortTrash(items)
+	return items, nil
+}
+
+// Restore implements Trasher.
+func (m *MemoryStore) Restore(_ Author, namespace, id string, opts RestoreOptions) (TrashItem, error) {
+	if err := validateNamespaceAndName(namespace, id); err != nil {
+		return TrashItem{}, err
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	rec, ok := m.trash[namespace][id]
+	if !ok {
+		return TrashItem{}, errTrashItemNotFound(namespace, id)
+	}
+	name := opts.restoreTarget(rec.TrashItem)
+	if err := validateName(name); err != nil {
+		return TrashItem{}, err
+	}
+	if _, exists := m.data[namespace][name]; exists && !opts.Overwrite {
+		return TrashItem{}, errConfigExists(namespace, name)
+	}
+	content, err := opts.restoreContent(rec.TrashItem, rec.Content)
+	if err != nil {
+		return TrashItem{}, err
+	}
+
+	m.storeLocked(namespace, name, content)
+	if rec.Metadata != nil {
+		if m.metadata[namespace] == nil {
+			m.metadata[namespace] = make(map[string]Metadata)
+		}
+		m.metadata[namespace][name] = cloneMetadata(*rec.Metadata)
+	} else {
+		delete(m.metadata[namespace], name)
+	}
+	m.purgeLocked(namespace, id)
+	return restoredItem(rec.TrashItem, name), nil
+}
+
+// Purge implements Trasher.
+func (m *MemoryStore) Purge(namespace, id string) error {
+	if err := validateNamespaceAndName(namespace, id); err != nil {
+		return err
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if _, ok := m.trash[namespace][id]; !ok {
+		return errTrashItemNotFound(namespace, id)
+	}
+	m.purgeLocked(namespace, id)
+	return nil
+}
+
+// purgeLocked drops an item from the trash. Callers must hold m.mu for
+// writing.
+func (m *MemoryStore) purgeLocked(namespace, id string) {
+	delete(m.trash[namespace], id)
+	if len(m.trash[namespace]) == 0 {
+		delete(m.trash, namespace)
+	}
+}
+
+// PurgeTrash implements Trasher.
+func (m *MemoryStore) PurgeTrash(cutoff time.Time) (int, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	purged := 0
+	for namespace, items := range m.trash {
+		for id, rec := range items {
+			if rec.Deleted.Before(cutoff) {
+				m.purgeLocked(namespace, id)
+				purged++
+			}
+		}
+	}
+	return purged, nil
+}
+
+// RewriteTrash implements Trasher.
+func (m *MemoryStore) RewriteTrash(namespace, id string, fn func([]byte) ([]byte, error)) error {
+	if err := validateNamespaceAndName(namespace, id); err != nil {
+		return err
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	rec, ok := m.trash[namespace][id]
+	if !ok {
+		return errTrashItemNotFound(namespace, id)
+	}
+	content, err := fn(rec.Content)
+	if err != nil {
+		return err
+	}
+	rec.Content = content
+	m.trash[namespace][id] = rec
+	return nil
+}
+
+// trashPath returns the file holding a FileStore trash item.
+func (f *FileStore) trashPath(namespace, id string) string {
+	return f.ReservedPath("trash", namespace, id)
+}
+
+// Trash implements Trasher. The item is written before the config is
+// deleted, so a crash in between leaves both rather than neither.
+func (f *FileStore) Trash(_ Author, namespace, name string) (TrashItem, error) {
+	filePath, err := f.resolvePath(namespace, name)
+	if err != nil {
+		return TrashItem{}, err
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if err := f.replayJournal(); err != nil {
+		return TrashItem{}, err
+	}
+
+	content, err := f.getLocked(filePath, namespace, name)
+	if err != nil {
+		return TrashItem{}, err
+	}
+	var md *Metadata
+	if record, err := readMetadataFile(f.metadataPath(namespace, name), namespace, name); err == nil {
+		md = &record
+	} else if !errors.Is(err, ErrNotFound) {
+		return TrashItem{}, err
+	}
+	rec, err := newTrashRecord(name, content, md)
+	if err != nil {
+		return TrashItem{}, err
+	}
+	if err := writeTrashFile(f.trashPath(namespace, rec.ID), rec); err != nil {
+		return TrashItem{}, err
+	}
+	if err := f.deleteLocked(filePath, namespace, name); err != nil {
+		return TrashItem{}, err
+	}
+	return rec.TrashItem, nil
+}
+
+// TrashItems implements Trasher.
+func (f *FileStore) TrashItems(namespace string) ([]TrashItem, error) {
+	if _, err := f.resolveNamespaceDir(namespace); err != nil {
+		return nil, err
+	}
+
+	unlock, err := f.readLock()
+	if err != nil {
+		return nil, err
+	}
+	defer unlock()
+
+	return readTrashDir(f.ReservedPath("trash", namespace), namespace)
+}
+
+// Restore implements Trasher. The item is removed after the config is
+// written, so a crash in between leaves both rather than neither.
+func (f *FileStore) Restore(_ Author, namespace, id string, opts RestoreOptions) (TrashItem, error) {
+	if _, err := f.resolvePath(namespace, id); err != nil {
+		return TrashItem{}, err
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if err := f.replayJournal(); err != nil {
+		return TrashItem{}, err
+	}
+
+	rec, err := readTrashFile(f.trashPath(namespace, id), namespace, id)
+	if err != nil {
+		return TrashItem{}, err
+	}
+	name := opts.restoreTarget(rec.TrashItem)
+	filePath, err := f.resolvePath(namespace, name)
+	if err != nil {
+		return TrashItem{}, err
+	}
+	if _, err := os.Stat(filePath); err == nil && !opts.Overwrite {
+		return TrashItem{}, errConfigExists(namespace, name)
+	}
+	content, err := opts.restoreContent(rec.TrashItem, rec.Content)
+	if err != nil {
+		return TrashItem{}, err
+	}
+
+	if err := f.storeLocked(filePath, namespace, name, content); err != nil {
+		return TrashItem{}, err
+	}
+	if rec.Metadata != nil {
+		err = writeMetadataFile(f.metadataPath(namespace, name), *rec.Metadata)
+	} else if err = removeFileSync(f.metadataPath(namespace, name)); os.IsNotExist(err) {
+		err = nil
+	}
+	if err != nil {
+		return TrashItem{}, fmt.Errorf("failed to restore metadata of config %s in namespace %s: %w", name, namespace, err)
+	}
+	if err := f.purgeLocked(namespace, id); err != nil {
+		return TrashItem{}, err
+	}
+	return restoredItem(rec.TrashItem, name), nil
+}
+
+// Purge implements Trasher.
+func (f *FileStore) Purge(namespace, id string) error {
+	if _, err := f.resolvePath(namespace, id); err != nil {
+		return err
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if err := f.replayJournal(); err != nil {
+		return err
+	}
+
+	return f.purgeLocked(namespace, id)
+}
+
+// purgeLocked removes a trash item. Callers must hold f.mu for writing.
+func (f *FileStore) purgeLocked(namespace, id string) error {
+	path := f.trashPath(namespace, id)
+	if err := removeFileSync(path); err != nil {
+		if os.IsNotExist(err) {
+			return errTrashItemNotFound(namespace, id)
+		}
+		return fmt.Errorf("failed to purge trash item %s in namespace %s: %w", id, namespace, err)
+	}
+	_ = os.Remove(filepath.Dir(path))
+	return nil
+}
+
+// PurgeTrash implements Trasher.
+func (f *FileStore) PurgeTrash(cutoff time.Time) (int, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if err := f.replayJournal(); err != nil {
+		return 0, err
+	}
+
+	return purgeTrashDirs(f.ReservedPath("trash"), cutoff)
+}
+
+// RewriteTrash implements Trasher.
+func (f *FileStore) RewriteTrash(namespace, id string, fn func([]byte) ([]byte, error)) error {
+	if _, err := f.resolvePath(namespace, id); err != nil {
+		return err
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if err := f.replayJournal(); err != nil {
+		return err
+	}
+
+	path := f.trashPath(namespace, id)
+	rec, err := readTrashFile(path, namespace, id)
+	if err != nil {
+		return err
+	}
+	if rec.Content, err = fn(rec.Content); err != nil {
+		return err
+	}
+	return writeTrashFile(path, rec)
+}
@@ -0,0 +1,274 @@
+package storage
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+	"time"
+)
+
+// testTrash exercises a Trasher implementation.
+func testTrash(t *testing.T, store interface {
+	Store
+	MetadataStore
+	NamespaceStore
+	Trasher
+}) {
+	t.Helper()
+	store.Store("dev", "app.yaml", []byte("v: 1"))
+	store.SetMetadata("dev", "app.yaml", Metadata{Labels: map[string]string{"tier": "web"}})
+
+	item, err := store.Trash(DefaultAuthor, "dev", "app.yaml")
+	if err != nil {
+		t.Fatalf("Trash: %v", err)
+	}
+	if item.ID == "" || item.Name != "app.yaml" || item.Size == 0 || item.Deleted.IsZero() {
+		t.Fatalf("unexpected item %+v", item)
+	}
+	if item.Metadata == nil || item.Metadata.Labels["tier"] != "web" {
+		t.Fatalf("item should keep the metadata record, got %+v", item.Metadata)
+	}
+	if _, err := store.Get("dev", "app.yaml"); !errors.Is(err, ErrNotFound) {
+		t.Fatalf("Get of a trashed config should be ErrNotFound, got %v", err)
+	}
+	if _, err := store.Metadata("dev", "app.yaml"); !errors.Is(err, ErrNotFound) {
+		t.Fatalf("Metadata of a trashed config should be ErrNotFound, got %v", err)
+	}
+	if _, err := store.Trash(DefaultAuthor, "dev", "app.yaml"); !errors.Is(err, ErrNotFound) {
+		t.Fatalf("Trash of a missing config should be ErrNotFound, got %v", err)
+	}
+	items, err := store.TrashItems("dev")
+	if err != nil || len(items) != 1 || items[0].ID != item.ID {
+		t.Fatalf("TrashItems = %+v, %v", items, err)
+	}
+	if items, err := store.TrashItems("prod"); err != nil || len(items) != 0 {
+		t.Fatalf("TrashItems of an empty trash = %+v, %v", items, err)
+	}
+
+	// The name has been reused meanwhile.
+	store.Store("dev", "app.yaml", []byte("v: 2"))
+	if _, err := store.Restore(DefaultAuthor, "dev", item.ID, RestoreOptions{}); !errors.Is(err, ErrExists) {
+		t.Fatalf("Restore over a config should be ErrExists, got %v", err)
+	}
+	restored, err := store.Restore(DefaultAuthor, "dev", item.ID, RestoreOptions{Name: "app-old.yaml"})
+	if err != nil || restored.Name != "app-old.yaml" || restored.ID != item.ID {
+		t.Fatalf("Restore = %+v, %v", restored, err)
+	}
+	if got, _ := store.Get("dev", "app-old.yaml"); string(got) != "v: 1" {
+		t.Fatalf("restored content = %q", got)
+	}
+	if md, err := store.Metadata("dev", "app-old.yaml"); err != nil || md.Labels["tier"] != "web" {
+		t.Fatalf("restored metadata = %+v, %v", md, err)
+	}
+	if got, _ := store.Get("dev", "app.yaml"); string(got) != "v: 2" {
+		t.Fatalf("Restore under another name must not touch the config, got %q", got)
+	}
+	if _, err := store.Restore(DefaultAuthor, "dev", item.ID, RestoreOptions{}); !errors.Is(err, ErrNotFound) {
+		t.Fatalf("a restored item should leave the trash, got %v", err)
+	}
+
+	// Overwriting replaces the config and its metadata record.
+	item, _ = store.Trash(DefaultAuthor, "dev", "app-old.yaml")
+	if _, err := store.Restore(DefaultAuthor, "dev", item.ID, RestoreOptions{Name: "app.yaml", Overwrite: true}); err != nil {
+		t.Fatalf("Restore with Overwrite: %v", err)
+	}
+	if got, _ := store.Get("dev", "app.yaml"); string(got) != "v: 1" {
+		t.Fatalf("overwritten content = %q", got)
+	}
+	if _, err := store.Restore(DefaultAuthor, "dev", "missing", RestoreOptions{}); !errors.Is(err, ErrNotFound) {
+		t.Fatalf("Restore of a missing item should be ErrNotFound, got %v", err)
+	}
+	if _, err := store.Restore(DefaultAuthor, "dev", "../app.yaml", RestoreOptions{}); !errors.Is(err, ErrInvalidName) {
+		t.Fatalf("Restore of an invalid ID should be ErrInvalidName, got %v", err)
+	}
+
+	// Items can be rewritten in place and purged one by one.
+	item, _ = store.Trash(DefaultAuthor, "dev", "app.yaml")
+	if err := store.RewriteTrash("dev", item.ID, func(b []byte) ([]byte, error) { return bytes.ToUpper(b), nil }); err != nil {
+		t.Fatalf("RewriteTrash: %v", err)
+	}
+	store.Restore(DefaultAuthor, "dev", item.ID, RestoreOptions{})
+	if got, _ := store.Get("dev", "app.yaml"); string(got) != "V: 1" {
+		t.Fatalf("rewritten content = %q", got)
+	}
+	item, _ = store.Trash(DefaultAuthor, "dev", "app.yaml")
+	if err := store.Purge("dev", item.ID); err != nil {
+		t.Fatalf("Purge: %v", err)
+	}
+	if err := store.Purge("dev", item.ID); !errors.Is(err, ErrNotFound) {
+		t.Fatalf("second Purge should be ErrNotFound, got %v", err)
+	}
+
+	// Retention purges by deletion time across namespaces.
+	store.Store("dev", "a.yaml", []byte("a"))
+	store.Store("prod", "b.yaml", []byte("b"))
+	first, _ := store.Trash(DefaultAuthor, "dev", "a.yaml")
+	store.Trash(DefaultAuthor, "prod", "b.yaml")
+	store.Store("dev", "a.yaml", []byte("a2"))
+	second, _ := store.Trash(DefaultAuthor, "dev", "a.yaml")
+	if items, _ := store.TrashItems("dev"); len(items) != 2 || items[0].ID != first.ID || items[1].ID != second.ID {
+		t.Fatalf("TrashItems should list the oldest first, got %+v", items)
+	}
+	if purged, err := store.PurgeTrash(first.Deleted.Add(-time.Second)); err != nil || purged != 0 {
+		t.Fatalf("PurgeTrash before any deletion = %d, %v", purged, err)
+	}
+	if purged, err := store.PurgeTrash(time.Now().Add(time.Second)); err != nil || purged != 3 {
+		t.Fatalf("PurgeTrash = %d, %v", purged, err)
+	}
+	if items, _ := store.TrashItems("prod"); len(items) != 0 {
+		t.Fatalf("trash should be empty, got %+v", items)
+	}
+
+	// A namespace holding only trash can still be deleted, trash and all.
+	store.Store("gone", "app.yaml", []byte("v: 1"))
+	store.Trash(DefaultAuthor, "gone", "app.yaml")
+	if err := store.DeleteNamespace("gone"); err != nil {
+		t.Fatalf("DeleteNamespace: %v", err)
+	}
+	if items, _ := store.TrashItems("gone"); len(items) != 0 {
+		t.Fatalf("DeleteNamespace should empty the trash, got %+v", items)
+	}
+}
+
+// testTrashInTransactions exercises moving configs to the trash as part of
+// a transaction.
+func testTrashInTransactions(t *testing.T, store interface {
+	Store
+	MetadataStore
+	Transactional
+	Trasher
+}) {
+	t.Helper()
+	store.Store("dev", "app.yaml", []byte("v: 1"))
+	store.SetMetadata("dev", "app.yaml", Metadata{Labels: map[string]string{"tier": "web"}})
+	store.Store("dev", "worker.yaml", []byte("v: 1"))
+
+	// A transaction that fails trashes nothing.
+	errAbort := errors.New("abort")
+	err := store.Update("dev", func(tx Tx) error {
+		if _, err := tx.(TrashTx).Trash(DefaultAuthor, "app.yaml"); err != nil {
+			t.Fatalf("Trash: %v", err)
+		}
+		return errAbort
+	})
+	if !errors.Is(err, errAbort) {
+		t.Fatalf("Update should return fn's error, got %v", err)
+	}
+	if items, _ := store.TrashItems("dev"); len(items) != 0 {
+		t.Fatalf("a rolled back transaction should trash nothing, got %+v", items)
+	}
+
+	var item TrashItem
+	err = store.Update("dev", func(tx Tx) error {
+		var err error
+		if item, err = tx.(TrashTx).Trash(DefaultAuthor, "app.yaml"); err != nil {
+			return err
+		}
+		if _, err := tx.Get("app.yaml"); !errors.Is(err, ErrNotFound) {
+			t.Fatalf("tx.Get of a trashed config should be ErrNotFound, got %v", err)
+		}
+		if _, err := tx.(TrashTx).Trash(DefaultAuthor, "missing.yaml"); !errors.Is(err, ErrNotFound) {
+			t.Fatalf("Trash of a missing config should be ErrNotFound, got %v", err)
+		}
+		return tx.Store("worker.yaml", []byte("v: 2"))
+	})
+	if err != nil {
+		t.Fatalf("Update: %v", err)
+	}
+	if _, err := store.Get("dev", "app.yaml"); !errors.Is(err, ErrNotFound) {
+		t.Fatalf("Get of a trashed config should be ErrNotFound, got %v", err)
+	}
+	items, err := store.TrashItems("dev")
+	if err != nil || len(items) != 1 || items[0].ID != item.ID {
+		t.Fatalf("TrashItems = %+v, %v; want %+v", items, err, item)
+	}
+	if items[0].Metadata == nil || items[0].Metadata.Labels["tier"] != "web" {
+		t.Fatalf("item should keep the metadata record, got %+v", items[0].Metadata)
+	}
+
+	if _, err := store.Restore(DefaultAuthor, "dev", item.ID, RestoreOptions{}); err != nil {
+		t.Fatalf("Restore: %v", err)
+	}
+	if got, err := store.Get("dev", "app.yaml"); err != nil || string(got) != "v: 1" {
+		t.Fatalf("Get after Restore = %q, %v", got, err)
+	}
+	if md, err := store.Metadata("dev", "app.yaml"); err != nil || md.Labels["tier"] != "web" {
+		t.Fatalf("Metadata after Restore = %+v, %v", md, err)
+	}
+}
+
+func TestMemoryStoreTrash(t *testing.T) {
+	testTrash(t, NewMemoryStore())
+	testTrashInTransactions(t, NewMemoryStore())
+}
+
+func TestFileStoreTrash(t *testing.T) {
+	store := NewFileStore(t.TempDir())
+	testTrash(t, store)
+	testTrashInTransactions(t, NewFileStore(t.TempDir()))
+
+	// Trash IDs are names in the store, so they cannot escape it.
+	if err := store.Purge("dev", ".."); !errors.Is(err, ErrInvalidName) {
+		t.Fatalf("expected ErrInvalidName, got %v", err)
+	}
+	if names, _ := store.List("dev"); len(names) != 0 {
+		t.Fatalf("the trash must not show up as configs, got %v", names)
+	}
+}
+
+func TestTrashThroughWrappers(t *testing.T) {
+	testTrash(t, NewCachingStore(NewMemoryStore(), CacheOptions{MaxBytes: 1 << 20}))
+	testTrashInTransactions(t, NewCachingStore(NewMemoryStore(), CacheOptions{MaxBytes: 1 << 20}))
+
+	// The cache must neither serve a trashed config nor miss a restored one.
+	cache := NewCachingStore(NewMemoryStore(), CacheOptions{MaxBytes: 1 << 20, NegativeTTL: time.Hour})
+	cache.Store("dev", "app.yaml", []byte("v: 1"))
+	cache.Get("dev", "app.yaml")
+	item, _ := cache.Trash(DefaultAuthor, "dev", "app.yaml")
+	if _, err := cache.Get("dev", "app.yaml"); !errors.Is(err, ErrNotFound) {
+		t.Fatalf("Get after Trash should be ErrNotFound, got %v", err)
+	}
+	cache.Restore(DefaultAuthor, "dev", item.ID, RestoreOptions{})
+	if got, err := cache.Get("dev", "app.yaml"); err != nil || string(got) != "v: 1" {
+		t.Fatalf("Get after Restore = %q, %v", got, err)
+	}
+
+	if _, err := NewCachingStore(plainStore{NewMemoryStore()}, CacheOptions{}).TrashItems("dev"); !errors.Is(err, ErrUnsupported) {
+		t.Fatalf("expected ErrUnsupported, got %v", err)
+	}
+}
+
+func TestEncryptedStoreTrash(t *testing.T) {
+	inner := NewMemoryStore()
+	store, err := NewEncryptedStore(inner, testMasterKeys(t, 1), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	store.Store("dev", "app.yaml", []byte("v: 1"))
+	item, _ := store.Trash(DefaultAuthor, "dev", "app.yaml")
+
+	// Items stay encrypted and are re-encrypted by rotation.
+	var sealed []byte
+	inner.RewriteTrash("dev", item.ID, func(b []byte) ([]byte, error) { sealed = b; return b, nil })
+	if !isSealed(sealed) {
+		t.Fatalf("trash item should be encrypted, got %q", sealed)
+	}
+	result, err := store.Rotate()
+	if err != nil || result.Configs != 1 {
+		t.Fatalf("Rotate = %+v, %v", result, err)
+	}
+
+	// Restoring under another name binds the content to it.
+	if _, err := store.Restore(DefaultAuthor, "dev", item.ID, RestoreOptions{Name: "copy.yaml"}); err != nil {
+		t.Fatalf("Restore: %v", err)
+	}
+	if got, err := store.Get("dev", "copy.yaml"); err != nil || string(got) != "v: 1" {
+		t.Fatalf("Get of the restored config = %q, %v", got, err)
+	}
+
+	store, err = NewEncryptedStore(NewMemoryStore(), testMasterKeys(t, 1), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	testTrashInTransactions(t, store)
+}
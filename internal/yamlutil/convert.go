@@ -0,0 +1,715 @@
+// Package yamlutil contains the YAML document handling shared by the HTTP
+// handlers: format conversion, parsing and tree manipulation.
+package yamlutil
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"mime"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/BurntSushi/toml"
+	"gopkg.in/yaml.v3"
+)
+
+// ErrConversion is returned when a document cannot be converted between
+// formats.
+var ErrConversion = errors.New("conversion failed")
+
+// ErrInvalidYAML is returned when a stored or submitted document does not
+// parse as YAML.
+var ErrInvalidYAML = errors.New("invalid YAML")
+
+// Format identifies a document serialization format.
+type Format string
+
+// Supported formats.
+const (
+	FormatYAML Format = "yaml"
+	FormatJSON Format = "json"
+	FormatTOML Format = "toml"
+)
+
+// ContentType returns the canonical media type for f.
+func (f Format) ContentType() string {
+	switch f {
+	case FormatJSON:
+		return "application/json"
+	case FormatTOML:
+		return "application/toml"
+	default:
+		return "application/x-yaml"
+	}
+}
+
+// FormatForMediaType maps a Content-Type or Accept media range to a Format.
+// The boolean is false when the media type is not one yamlet understands.
+func FormatForMediaType(mediaType string) (Format, bool) {
+	mt, _, err := mime.ParseMediaType(mediaType)
+	if err != nil {
+		return "", false
+	}
+	switch mt {
+	case "application/json", "text/json":
+		return FormatJSON, true
+	case "application/toml", "text/toml":
+		return FormatTOML, true
+	case "application/x-yaml", "application/yaml", "text/yaml", "text/x-yaml":
+		return FormatYAML, true
+	}
+	if strings.HasSuffix(mt, "+json") {
+		return FormatJSON, true
+	}
+	if strings.HasSuffix(mt, "+yaml") {
+		return FormatYAML, true
+	}
+	return "", false
+}
+
+// NegotiateFormat picks the response format for an Accept header. Media
+// ranges are honoured in order of their q-value; YAML is the default when
+// nothing acceptable is listed. The boolean is false when the client
+// explicitly ruled out every format yamlet can produce.
+func NegotiateFormat(accept string) (Format, bool) {
+	if strings.TrimSpace(accept) == "" {
+		return FormatYAML, true
+	}
+
+	type candidate struct {
+		format Format
+		q      float64
+		wild   bool
+	}
+	var candidates []candidate
+	for _, part := range strings.Split(accept, ",") {
+		mt, params, err := mime.ParseMediaType(strings.TrimSpace(part))
+		if err != nil {
+			continue
+		}
+		q := 1.0
+		if v, ok := params["q"]; ok {
+			if parsed, err := strconv.ParseFloat(v, 64); err == nil {
+				q = parsed
+			}
+		}
+		if q <= 0 {
+			continue
+		}
+		if mt == "*/*" || mt == "application/*" || mt == "text/*" {
+			candidates = append(candidates, candidate{FormatYAML, q, true})
+			continue
+		}
+		if f, ok := FormatForMediaType(mt); ok {
+			candidates = append(candidates, candidate{f, q, false})
+		}
+	}
+	if len(candidates) == 0 {
+		return "", false
+	}
+	// Stable sort keeps header order for equal q-values; explicit types
+	// win over wildcards of the same weight.
+	sort.SliceStable(candidates, func(i, j int) bool {
+		if candidates[i].q != candidates[j].q {
+			return candidates[i].q > candidates[j].q
+		}
+		return !candidates[i].wild && candidates[j].wild
+	})
+	return candidates[0].format, true
+}
+
+// ToYAML converts a document in format f to block-style YAML. YAML input is
+// returned unchanged so that comments and formatting survive.
+func ToYAML(data []byte, f Format) ([]byte, error) {
+	var (
+		node *yaml.Node
+		err  error
+	)
+	switch f {
+	case FormatYAML, "":
+		return data, nil
+	case FormatJSON:
+		node, err = jsonToNode(data)
+	case FormatTOML:
+		node, err = tomlToNode(data)
+	default:
+		return nil, fmt.Errorf("%w: unsupported source format %q", ErrConversion, f)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return encodeNode(node)
+}
+
+// FromYAML converts a YAML document to format f.
+func FromYAML(data []byte, f Format) ([]byte, error) {
+	switch f {
+	case FormatYAML, "":
+		return data, nil
+	case FormatJSON:
+		docs, err := ParseDocuments(data)
+		if err != nil {
+			return nil, fmt.Errorf("%w: %v", ErrConversion, err)
+		}
+		var buf bytes.Buffer
+		switch len(docs) {
+		case 0:
+			buf.WriteString("null")
+		case 1:
+			if err := writeDocumentJSON(&buf, docs[0]); err != nil {
+				return nil, err
+			}
+		default:
+			// A multi-document stream becomes an array of documents.
+			buf.WriteByte('[')
+			for i, doc := range docs {
+				if i > 0 {
+					buf.WriteByte(',')
+				}
+				if err := writeDocumentJSON(&buf, doc); err != nil {
+					return nil, err
+				}
+			}
+			buf.WriteByte(']')
+		}
+		buf.WriteByte('\n')
+		return buf.Bytes(), nil
+	case FormatTOML:
+		docs, err := ParseDocuments(data)
+		if err != nil {
+			return nil, fmt.Errorf("%w: %v", ErrConversion, err)
+		}
+		switch {
+		case len(docs) > 1:
+			return nil, fmt.Errorf("%w: TOML cannot hold a %d-document stream", ErrConversion, len(docs))
+		case len(docs) == 0 || len(docs[0].Content) == 0:
+			return []byte{}, nil
+		}
+		root := expandAliases(docs[0].Content[0])
+		if root.Kind != yaml.MappingNode {
+			return nil, fmt.Errorf("%w: TOML requires a top-level mapping", ErrConversion)
+		}
+		var buf bytes.Buffer
+		if err := writeTOMLTable(&buf, "", root); err != nil {
+			return nil, err
+		}
+		return buf.Bytes(), nil
+	default:
+		return nil, fmt.Errorf("%w: unsupported target format %q", ErrConversion, f)
+	}
+}
+
+func writeDocumentJSON(buf *bytes.Buffer, doc *yaml.Node) error {
+	if len(doc.Content) == 0 {
+		buf.WriteString("null")
+		return nil
+	}
+	return writeJSON(buf, doc.Content[0])
+}
+
+// encodeNode renders node as block-style YAML with two-space indentation.
+func encodeNode(node *yaml.Node) ([]byte, error) {
+	var buf bytes.Buffer
+	enc := yaml.NewEncoder(&buf)
+	enc.SetIndent(2)
+	if err := enc.Encode(node); err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrConversion, err)
+	}
+	if err := enc.Close(); err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrConversion, err)
+	}
+	return buf.Bytes(), nil
+}
+
+func scalarNode(tag, value string) *yaml.Node {
+	return &yaml.Node{Kind: yaml.ScalarNode, Tag: tag, Value: value}
+}
+
+// jsonToNode decodes a single JSON value into a YAML node tree, preserving
+// object key order and the exact text of numbers.
+func jsonToNode(data []byte) (*yaml.Node, error) {
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.UseNumber()
+	node, err := decodeJSONValue(dec)
+	if err != nil {
+		return nil, fmt.Errorf("%w: invalid JSON: %v", ErrConversion, err)
+	}
+	if _, err := dec.Token(); err != io.EOF {
+		return nil, fmt.Errorf("%w: invalid JSON: trailing data after document", ErrConversion)
+	}
+	return node, nil
+}
+
+func decodeJSONValue(dec *json.Decoder) (*yaml.Node, error) {
+	tok, err := dec.Token()
+	if err != nil {
+		return nil, err
+	}
+	switch v := tok.(type) {
+	case json.Delim:
+		switch v {
+		case '{':
+			node := &yaml.Node{Kind: yaml.MappingNode, Tag: "!!map"}
+			seen := make(map[string]bool)
+			for dec.More() {
+				keyTok, err := dec.Token()
+				if err != nil {
+					return nil, err
+				}
+				key, ok := keyTok.(string)
+				if !ok {
+					return nil, fmt.Errorf("unexpected object key %v", keyTok)
+				}
+				if seen[key] {
+					return nil, fmt.Errorf("duplicate object key %q", key)
+				}
+				seen[key] = true
+				value, err := decodeJSONValue(dec)
+				if err != nil {
+					return nil, err
+				}
+				node.Content = append(node.Content, scalarNode("!!str", key), value)
+			}
+			if _, err := dec.Token(); err != nil {
+				return nil, err
+			}
+			return node, nil
+		case '[':
+			node := &yaml.Node{Kind: yaml.SequenceNode, Tag: "!!seq"}
+			for dec.More() {
+				value, err := decodeJSONValue(dec)
+				if err != nil {
+					return nil, err
+				}
+				node.Content = append(node.Content, value)
+			}
+			if _, err := dec.Token(); err != nil {
+				return nil, err
+			}
+			return node, nil
+		}
+		return nil, fmt.Errorf("unexpected delimiter %v", v)
+	case string:
+		return scalarNode("!!str", v), nil
+	case json.Number:
+		if !strings.ContainsAny(v.String(), ".eE") {
+			return scalarNode("!!int", v.String()), nil
+		}
+		return scalarNode("!!float", v.String()), nil
+	case bool:
+		return scalarNode("!!bool", strconv.FormatBool(v)), nil
+	case nil:
+		return scalarNode("!!null", "null"), nil
+	}
+	return nil, fmt.Errorf("unexpected token %v", tok)
+}
+
+// tomlToNode decodes a TOML document into a YAML node tree. Keys keep the
+// order in which they were defined in the source document.
+func tomlToNode(data []byte) (*yaml.Node, error) {
+	var v map[string]interface{}
+	md, err := toml.Decode(string(data), &v)
+	if err != nil {
+		return nil, fmt.Errorf("%w: invalid TOML: %v", ErrConversion, err)
+	}
+	order := make(map[string]int)
+	for i, key := range md.Keys() {
+		path := key.String()
+		if _, ok := order[path]; !ok {
+			order[path] = i
+		}
+	}
+	return tomlValueToNode(v, "", order)
+}
+
+func tomlValueToNode(v interface{}, path string, order map[string]int) (*yaml.Node, error) {
+	switch val := v.(type) {
+	case map[string]interface{}:
+		keys := make([]string, 0, len(val))
+		for k := range val {
+			keys = append(keys, k)
+		}
+		sort.SliceStable(keys, func(i, j int) bool {
+			oi, iok := order[joinTOMLPath(path, keys[i])]
+			oj, jok := order[joinTOMLPath(path, keys[j])]
+			if iok && jok && oi != oj {
+				return oi < oj
+			}
+			if iok != jok {
+				return iok
+			}
+			return keys[i] < keys[j]
+		})
+		node := &yaml.Node{Kind: yaml.MappingNode, Tag: "!!map"}
+		for _, k := range keys {
+			child, err := tomlValueToNode(val[k], joinTOMLPath(path, k), order)
+			if err != nil {
+				return nil, err
+			}
+			node.Content = append(node.Content, scalarNode("!!str", k), child)
+		}
+		return node, nil
+	case []map[string]interface{}:
+		node := &yaml.Node{Kind: yaml.SequenceNode, Tag: "!!seq"}
+		for _, item := range val {
+			child, err := tomlValueToNode(item, path, order)
+			if err != nil {
+				return nil, err
+			}
+			node.Content = append(node.Content, child)
+		}
+		return node, nil
+	case []interface{}:
+		node := &yaml.Node{Kind: yaml.SequenceNode, Tag: "!!seq"}
+		for _, item := range val {
+			child, err := tomlValueToNode(item, path, order)
+			if err != nil {
+				return nil, err
+			}
+			node.Content = append(node.Content, child)
+		}
+		return node, nil
+	case string:
+		return scalarNode("!!str", val), nil
+	case int64:
+		return scalarNode("!!int", strconv.FormatInt(val, 10)), nil
+	case float64:
+		return floatNode(val), nil
+	case bool:
+		return scalarNode("!!bool", strconv.FormatBool(val)), nil
+	case time.Time:
+		return scalarNode("!!timestamp", val.Format(time.RFC3339Nano)), nil
+	case fmt.Stringer:
+		// toml.LocalDate, LocalTime and LocalDateTime have no YAML
+		// equivalent; keep their canonical text as a string.
+		return scalarNode("!!str", val.String()), nil
+	}
+	return nil, fmt.Errorf("%w: unsupported TOML value of type %T", ErrConversion, v)
+}
+
+// writeTOMLTable writes the keys of mapping node as the body of the TOML
+// table at path, in their order. A mapping, or a sequence of mappings, is
+// written as a [table] or [[array of tables]] when only such values follow
+// it, and inline otherwise, since a key written after a table header would
+// belong to that table.
+func writeTOMLTable(buf *bytes.Buffer, path string, node *yaml.Node) error {
+	split := len(node.Content)
+	for split > 0 && isTOMLTable(node.Content[split-1]) {
+		split -= 2
+	}
+	for i := 0; i < split; i += 2 {
+		key, value := node.Content[i], node.Content[i+1]
+		if err := checkTOMLKey(key); err != nil {
+			return err
+		}
+		buf.WriteString(toml.Key{key.Value}.String())
+		buf.WriteString(" = ")
+		if err := writeTOMLValue(buf, value); err != nil {
+			return err
+		}
+		buf.WriteByte('\n')
+	}
+	for i := split; i < len(node.Content); i += 2 {
+		key, value := node.Content[i], node.Content[i+1]
+		if err := checkTOMLKey(key); err != nil {
+			return err
+		}
+		child := joinTOMLPath(path, key.Value)
+		if value.Kind == yaml.MappingNode {
+			if buf.Len() > 0 {
+				buf.WriteByte('\n')
+			}
+			fmt.Fprintf(buf, "[%s]\n", child)
+			if err := writeTOMLTable(buf, child, value); err != nil {
+				return err
+			}
+			continue
+		}
+		for _, item := range value.Content {
+			if buf.Len() > 0 {
+				buf.WriteByte('\n')
+			}
+			fmt.Fprintf(buf, "[[%s]]\n", child)
+			if err := writeTOMLTable(buf, child, item); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// isTOMLTable reports whether value can be written as a [table] or as an
+// [[array of tables]].
+func isTOMLTable(value *yaml.Node) bool {
+	switch value.Kind {
+	case yaml.MappingNode:
+		return true
+	case yaml.SequenceNode:
+		if len(value.Content) == 0 {
+			return false
+		}
+		for _, item := range value.Content {
+			if item.Kind != yaml.MappingNode {
+				return false
+			}
+		}
+		return true
+	}
+	return false
+}
+
+func checkTOMLKey(key *yaml.Node) error {
+	if key.Kind == yaml.ScalarNode && key.Tag == "!!merge" {
+		return fmt.Errorf("%w: merge keys are not supported in TOML output", ErrConversion)
+	}
+	if key.Kind != yaml.ScalarNode {
+		return fmt.Errorf("%w: non-scalar mapping key at line %d", ErrConversion, key.Line)
+	}
+	return nil
+}
+
+// writeTOMLValue writes node as an inline TOML value. TOML has no null, so
+// a null is rejected rather than dropped.
+func writeTOMLValue(buf *bytes.Buffer, node *yaml.Node) error {
+	switch node.Kind {
+	case yaml.MappingNode:
+		buf.WriteByte('{')
+		for i := 0; i+1 < len(node.Content); i += 2 {
+			key, value := node.Content[i], node.Content[i+1]
+			if err := checkTOMLKey(key); err != nil {
+				return err
+			}
+			if i > 0 {
+				buf.WriteString(", ")
+			}
+			buf.WriteString(toml.Key{key.Value}.String())
+			buf.WriteString(" = ")
+			if err := writeTOMLValue(buf, value); err != nil {
+				return err
+			}
+		}
+		buf.WriteByte('}')
+		return nil
+	case yaml.SequenceNode:
+		buf.WriteByte('[')
+		for i, item := range node.Content {
+			if i > 0 {
+				buf.WriteString(", ")
+			}
+			if err := writeTOMLValue(buf, item); err != nil {
+				return err
+			}
+		}
+		buf.WriteByte(']')
+		return nil
+	case yaml.ScalarNode:
+		return writeTOMLScalar(buf, node)
+	}
+	return fmt.Errorf("%w: unsupported node kind %d", ErrConversion, node.Kind)
+}
+
+func writeTOMLScalar(buf *bytes.Buffer, node *yaml.Node) error {
+	switch node.ShortTag() {
+	case "!!null":
+		return fmt.Errorf("%w: TOML has no null, found at line %d", ErrConversion, node.Line)
+	case "!!bool":
+		var b bool
+		if err := node.Decode(&b); err != nil {
+			return fmt.Errorf("%w: %v", ErrConversion, err)
+		}
+		buf.WriteString(strconv.FormatBool(b))
+	case "!!int":
+		var i int64
+		if err := node.Decode(&i); err != nil {
+			return fmt.Errorf("%w: TOML integers are 64-bit: %v", ErrConversion, err)
+		}
+		buf.WriteString(strconv.FormatInt(i, 10))
+	case "!!float":
+		var f float64
+		if err := node.Decode(&f); err != nil {
+			return fmt.Errorf("%w: %v", ErrConversion, err)
+		}
+		switch {
+		case math.IsInf(f, 1):
+			buf.WriteString("inf")
+		case math.IsInf(f, -1):
+			buf.WriteString("-inf")
+		case math.IsNaN(f):
+			buf.WriteString("nan")
+		default:
+			buf.WriteString(floatNode(f).Value)
+		}
+	case "!!timestamp":
+		var t time.Time
+		if err := node.Decode(&t); err != nil {
+			return fmt.Errorf("%w: %v", ErrConversion, err)
+		}
+		if len(node.Value) == len(time.DateOnly) {
+			buf.WriteString(t.Format(time.DateOnly))
+		} else {
+			buf.WriteString(t.Format(time.RFC3339Nano))
+		}
+	default:
+		writeTOMLString(buf, node.Value)
+	}
+	return nil
+}
+
+// writeTOMLString writes s as a TOML basic string.
+func writeTOMLString(buf *bytes.Buffer, s string) {
+	buf.WriteByte('"')
+	for _, r := range s {
+		switch r {
+		case '"':
+			buf.WriteString(`\"`)
+		case '\\':
+			buf.WriteString(`\\`)
+		case '\b':
+			buf.WriteString(`\b`)
+		case '\t':
+			buf.WriteString(`\t`)
+		case '\n':
+			buf.WriteString(`\n`)
+		case '\f':
+			buf.WriteString(`\f`)
+		case '\r':
+			buf.WriteString(`\r`)
+		default:
+			if r < 0x20 || r == 0x7f {
+				fmt.Fprintf(buf, `\u%04X`, r)
+			} else {
+				buf.WriteRune(r)
+			}
+		}
+	}
+	buf.WriteByte('"')
+}
+
+func joinTOMLPath(path, key string) string {
+	k := toml.Key{key}.String()
+	if path == "" {
+		return k
+	}
+	return path + "." + k
+}
+
+func floatNode(f float64) *yaml.Node {
+	switch {
+	case math.IsInf(f, 1):
+		return scalarNode("!!float", ".inf")
+	case math.IsInf(f, -1):
+		return scalarNode("!!float", "-.inf")
+	case math.IsNaN(f):
+		return scalarNode("!!float", ".nan")
+	}
+	s := strconv.FormatFloat(f, 'g', -1, 64)
+	if !strings.ContainsAny(s, ".eE") {
+		s += ".0"
+	}
+	return scalarNode("!!float", s)
+}
+
+// writeJSON serializes a YAML node as JSON, keeping mapping key order.
+func writeJSON(buf *bytes.Buffer, node *yaml.Node) error {
+	switch node.Kind {
+	case yaml.DocumentNode:
+		if len(node.Content) == 0 {
+			buf.WriteString("null")
+			return nil
+		}
+		return writeJSON(buf, node.Content[0])
+	case yaml.AliasNode:
+		return writeJSON(buf, node.Alias)
+	case yaml.MappingNode:
+		buf.WriteByte('{')
+		first := true
+		for i := 0; i+1 < len(node.Content); i += 2 {
+			key, value := node.Content[i], node.Content[i+1]
+			if key.Kind == yaml.ScalarNode && key.Tag == "!!merge" {
+				return fmt.Errorf("%w: merge keys are not supported in JSON output", ErrConversion)
+			}
+			if key.Kind != yaml.ScalarNode {
+				return fmt.Errorf("%w: non-scalar mapping key at line %d", ErrConversion, key.Line)
+			}
+			if !first {
+				buf.WriteByte(',')
+			}
+			first = false
+			k, _ := json.Marshal(key.Value)
+			buf.Write(k)
+			buf.WriteByte(':')
+			if err := writeJSON(buf, value); err != nil {
+				return err
+			}
+		}
+		buf.WriteByte('}')
+		return nil
+	case yaml.SequenceNode:
+		buf.WriteByte('[')
+		for i, item := range node.Content {
+			if i > 0 {
+				buf.WriteByte(',')
+			}
+			if err := writeJSON(buf, item); err != nil {
+				return err
+			}
+		}
+		buf.WriteByte(']')
+		return nil
+	case yaml.ScalarNode:
+		return writeJSONScalar(buf, node)
+	}
+	return fmt.Errorf("%w: unsupported node kind %d", ErrConversion, node.Kind)
+}
+
+func writeJSONScalar(buf *bytes.Buffer, node *yaml.Node) error {
+	switch node.ShortTag() {
+	case "!!null":
+		buf.WriteString("null")
+	case "!!bool":
+		var b bool
+		if err := node.Decode(&b); err != nil {
+			return fmt.Errorf("%w: %v", ErrConversion, err)
+		}
+		buf.WriteString(strconv.FormatBool(b))
+	case "!!int":
+		// Plain decimal integers are copied verbatim so arbitrarily large
+		// values survive; other notations (0x, 0o, _) are normalized.
+		if isJSONNumber(node.Value) {
+			buf.WriteString(node.Value)
+			return nil
+		}
+		var i int64
+		if err := node.Decode(&i); err != nil {
+			return fmt.Errorf("%w: %v", ErrConversion, err)
+		}
+		buf.WriteString(strconv.FormatInt(i, 10))
+	case "!!float":
+		if isJSONNumber(node.Value) {
+			buf.WriteString(node.Value)
+			return nil
+		}
+		var f float64
+		if err := node.Decode(&f); err != nil {
+			return fmt.Errorf("%w: %v", ErrConversion, err)
+		}
+		if math.IsInf(f, 0) || math.IsNaN(f) {
+			return fmt.Errorf("%w: %q has no JSON representation", ErrConversion, node.Value)
+		}
+		buf.WriteString(strconv.FormatFloat(f, 'g', -1, 64))
+	default:
+		s, _ := json.Marshal(node.Value)
+		buf.Write(s)
+	}
+	return nil
+}
+
+func isJSONNumber(s string) bool {
+	return json.Valid([]byte(s)) && s != "" && (s[0] == '-' || (s[0] >= '0' && s[0] <= '9'))
+}
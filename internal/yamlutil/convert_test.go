@@ -0,0 +1,214 @@
+package yamlutil
+
+import (
+	"errors"
+	"strings"
+	"testing"
+)
+
+func TestFormatForMediaType(t *testing.T) {
+	cases := []struct {
+		in   string
+		want Format
+		ok   bool
+	}{
+		{"application/json", FormatJSON, true},
+		{"application/json; charset=utf-8", FormatJSON, true},
+		{"application/vnd.api+json", FormatJSON, true},
+		{"application/toml", FormatTOML, true},
+		{"application/x-yaml", FormatYAML, true},
+		{"text/yaml", FormatYAML, true},
+		{"application/x-www-form-urlencoded", "", false},
+		{"", "", false},
+	}
+	for _, c := range cases {
+		got, ok := FormatForMediaType(c.in)
+		if got != c.want || ok != c.ok {
+			t.Errorf("FormatForMediaType(%q) = %q, %v; want %q, %v", c.in, got, ok, c.want, c.ok)
+		}
+	}
+}
+
+func TestNegotiateFormat(t *testing.T) {
+	cases := []struct {
+		in   string
+		want Format
+		ok   bool
+	}{
+		{"", FormatYAML, true},
+		{"*/*", FormatYAML, true},
+		{"application/json", FormatJSON, true},
+		{"application/json;q=0.5, application/toml", FormatTOML, true},
+		{"*/*;q=0.1, application/json", FormatJSON, true},
+		{"text/html", "", false},
+		{"application/json;q=0", "", false},
+	}
+	for _, c := range cases {
+		got, ok := NegotiateFormat(c.in)
+		if got != c.want || ok != c.ok {
+			t.Errorf("NegotiateFormat(%q) = %q, %v; want %q, %v", c.in, got, ok, c.want, c.ok)
+		}
+	}
+}
+
+func TestJSONRoundTrip(t *testing.T) {
+	in := `{"zeta": 1, "alpha": {"big": 12345678901234567890, "pi": 3.14, "s": "true"}, "list": [null, false, "x"]}`
+
+	y, err := ToYAML([]byte(in), FormatJSON)
+	if err != nil {
+		t.Fatalf("ToYAML: %v", err)
+	}
+	want := "zeta: 1\nalpha:\n  big: 12345678901234567890\n  pi: 3.14\n  s: \"true\"\nlist:\n  - null\n  - false\n  - x\n"
+	if string(y) != want {
+		t.Fatalf("YAML mismatch:\n got: %q\nwant: %q", y, want)
+	}
+
+	j, err := FromYAML(y, FormatJSON)
+	if err != nil {
+		t.Fatalf("FromYAML: %v", err)
+	}
+	wantJSON := `{"zeta":1,"alpha":{"big":12345678901234567890,"pi":3.14,"s":"true"},"list":[null,false,"x"]}` + "\n"
+	if string(j) != wantJSON {
+		t.Fatalf("JSON mismatch:\n got: %s\nwant: %s", j, wantJSON)
+	}
+}
+
+func TestJSONRejectsInvalidInput(t *testing.T) {
+	for _, in := range []string{`{"a": 1`, `{"a": 1, "a": 2}`, `{} {}`} {
+		if _, err := ToYAML([]byte(in), FormatJSON); !errors.Is(err, ErrConversion) {
+			t.Errorf("ToYAML(%q) error = %v, want ErrConversion", in, err)
+		}
+	}
+}
+
+func TestTOMLToYAMLKeepsKeyOrder(t *testing.T) {
+	in := `
+title = "svc"
+port = 8080
+ratio = 2.0
+
+[database]
+host = "db.internal"
+replicas = ["a", "b"]
+
+[[servers]]
+name = "alpha"
+
+[[servers]]
+name = "beta"
+`
+	y, err := ToYAML([]byte(in), FormatTOML)
+	if err != nil {
+		t.Fatalf("ToYAML: %v", err)
+	}
+	want := `title: svc
+port: 8080
+ratio: 2.0
+database:
+  host: db.internal
+  replicas:
+    - a
+    - b
+servers:
+  - name: alpha
+  - name: beta
+`
+	if string(y) != want {
+		t.Fatalf("YAML mismatch:\n got:\n%s\nwant:\n%s", y, want)
+	}
+}
+
+func TestFromYAMLToTOML(t *testing.T) {
+	out, err := FromYAML([]byte("name: svc\ndb:\n  port: 5432\n"), FormatTOML)
+	if err != nil {
+		t.Fatalf("FromYAML: %v", err)
+	}
+	if !strings.Contains(string(out), `name = "svc"`) || !strings.Contains(string(out), "[db]") {
+		t.Fatalf("unexpected TOML output:\n%s", out)
+	}
+
+	if _, err := FromYAML([]byte("- a\n- b\n"), FormatTOML); !errors.Is(err, ErrConversion) {
+		t.Fatalf("top-level sequence should not convert to TOML, got %v", err)
+	}
+}
+
+func TestTOMLRoundTripIsLossless(t *testing.T) {
+	in := `name: svc
+db:
+  host: db.internal
+  port: 5432
+mixed:
+  - 1
+  - two
+  - three: 3
+replicas: 3
+servers:
+  - name: alpha
+    tags: ["a", "b"]
+  - name: beta
+limits:
+  cpu: 0.5
+  when: 2024-01-02T03:04:05Z
+note: "say \"hi\"\tnow"
+`
+	out, err := FromYAML([]byte(in), FormatTOML)
+	if err != nil {
+		t.Fatalf("FromYAML: %v", err)
+	}
+	back, err := ToYAML(out, FormatTOML)
+	if err != nil {
+		t.Fatalf("ToYAML(%s): %v", out, err)
+	}
+	// Key order and mixed-type arrays survive; a mapping followed by a
+	// plain key is written inline so that the key stays in its place.
+	want := `name: svc
+db:
+  host: db.internal
+  port: 5432
+mixed:
+  - 1
+  - two
+  - three: 3
+replicas: 3
+servers:
+  - name: alpha
+    tags:
+      - a
+      - b
+  - name: beta
+limits:
+  cpu: 0.5
+  when: 2024-01-02T03:04:05Z
+note: "say \"hi\"\tnow"
+`
+	if string(back) != want {
+		t.Fatalf("round trip through\n%s\n got:\n%s\nwant:\n%s", out, back, want)
+	}
+}
+
+func TestFromYAMLToTOMLRejectsWhatTOMLCannotHold(t *testing.T) {
+	for _, in := range []string{
+		"a: null\n",
+		"a: [1, ~]\n",
+		"a:\n  b:\n",
+		"base: &b {x: 1}\nderived:\n  <<: *b\n",
+		"a: 0x8000000000000000\n",
+	} {
+		if out, err := FromYAML([]byte(in), FormatTOML); !errors.Is(err, ErrConversion) {
+			t.Errorf("FromYAML(%q) = %q, %v; want ErrConversion", in, out, err)
+		}
+	}
+}
+
+func TestFromYAMLRejectsNonJSONFloats(t *testing.T) {
+	if _, err := FromYAML([]byte("x: .inf\n"), FormatJSON); !errors.Is(err, ErrConversion) {
+		t.Fatalf("expected ErrConversion for .inf, got %v", err)
+	}
+	out, err := FromYAML([]byte("x: 0x1F\n"), FormatJSON)
+	if err != nil {
+		t.Fatalf("FromYAML: %v", err)
+	}
+	if string(out) != "{\"x\":31}\n" {
+		t.Fatalf("hex int not normalized: %s", out)
+	}
+}
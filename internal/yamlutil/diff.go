@@ -0,0 +1,359 @@
+package yamlutil
+
+import (
+	"fmt"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// DefaultDiffContext is the number of unchanged lines shown around each hunk
+// of a unified diff.
+const DefaultDiffContext = 3
+
+// Change types reported by StructuralDiff.
+const (
+	ChangeAdded   = "added"
+	ChangeRemoved = "removed"
+	ChangeChanged = "changed"
+)
+
+// Change is a single key-path difference between two YAML documents.
+type Change struct {
+	Path string      `json:"path"`
+	Type string      `json:"type"`
+	Old  interface{} `json:"old"`
+	New  interface{} `json:"new"`
+}
+
+// lineOp is one step of a line-level edit script.
+type lineOp struct {
+	kind byte // ' ', '-' or '+'
+	text string
+}
+
+// UnifiedDiff returns a unified diff of a and b labelled with fromLabel and
+// toLabel. It returns an empty string when the inputs are identical.
+func UnifiedDiff(fromLabel, toLabel string, a, b []byte, context int) string {
+	if context < 0 {
+		context = DefaultDiffContext
+	}
+	ops := diffLines(splitLines(string(a)), splitLines(string(b)))
+
+	var out strings.Builder
+	// Walk the edit script, emitting hunks around every run of changes.
+	i := 0
+	for i < len(ops) {
+		if ops[i].kind == ' ' {
+			i++
+			continue
+		}
+		start := i - context
+		if start < 0 {
+			start = 0
+		}
+		// Extend the hunk while changes are separated by at most
+		// 2*context unchanged lines.
+		end := i
+		for end < len(ops) {
+			if ops[end].kind != ' ' {
+				end++
+				continue
+			}
+			run := end
+			for run < len(ops) && ops[run].kind == ' ' {
+				run++
+			}
+			if run == len(ops) || run-end > 2*context {
+				end += minInt(context, run-end)
+				break
+			}
+			end = run
+		}
+
+		if out.Len() == 0 {
+			fmt.Fprintf(&out, "--- %s\n+++ %s\n", fromLabel, toLabel)
+		}
+		aStart, bStart := lineNumbers(ops, start)
+		aCount, bCount := 0, 0
+		for _, op := range ops[start:end] {
+			if op.kind != '+' {
+				aCount++
+			}
+			if op.kind != '-' {
+				bCount++
+			}
+		}
+		fmt.Fprintf(&out, "@@ -%s +%s @@\n", hunkRange(aStart, aCount), hunkRange(bStart, bCount))
+		for _, op := range ops[start:end] {
+			out.WriteByte(op.kind)
+			out.WriteString(op.text)
+			out.WriteByte('\n')
+		}
+		i = end
+	}
+	return out.String()
+}
+
+// lineNumbers returns the 1-based line numbers in a and b at which ops[idx]
+// applies.
+func lineNumbers(ops []lineOp, idx int) (int, int) {
+	a, b := 1, 1
+	for _, op := range ops[:idx] {
+		if op.kind != '+' {
+			a++
+		}
+		if op.kind != '-' {
+			b++
+		}
+	}
+	return a, b
+}
+
+func hunkRange(start, count int) string {
+	if count == 0 {
+		// An empty range points at the line before the change.
+		return strconv.Itoa(start-1) + ",0"
+	}
+	if count == 1 {
+		return strconv.Itoa(start)
+	}
+	return strconv.Itoa(start) + "," + strconv.Itoa(count)
+}
+
+func splitLines(s string) []string {
+	if s == "" {
+		return nil
+	}
+	return strings.Split(strings.TrimSuffix(s, "\n"), "\n")
+}
+
+// maxDiffEdits caps the edit distance, in each direction, that the search
+// for a middle snake explores. Beyond it the differing region is reported as
+// a full replacement, which bounds the time spent on pathological inputs;
+// memory stays linear in the input either way.
+const maxDiffEdits = 2000
+
+// diffLines computes a shortest edit script with the linear-space variant of
+// Myers' O(ND) algorithm.
+func diffLines(a, b []string) []lineOp {
+	ops := make([]lineOp, 0, len(a)+len(b))
+	return myers(a, b, ops)
+}
+
+// myers appends the edit script of a and b to ops. It matches the common
+// prefix and suffix, then finds the middle snake of a shortest edit script
+// and recurses on the regions before and after it.
+func myers(a, b []string, ops []lineOp) []lineOp {
+	prefix := 0
+	for prefix < len(a) && prefix < len(b) && a[prefix] == b[prefix] {
+		prefix++
+	}
+	suffix := 0
+	for suffix < len(a)-prefix && suffix < len(b)-prefix && a[len(a)-1-suffix] == b[len(b)-1-suffix] {
+		suffix++
+	}
+	for _, line := range a[:prefix] {
+		ops = append(ops, lineOp{' ', line})
+	}
+	midA, midB := a[prefix:len(a)-suffix], b[prefix:len(b)-suffix]
+	if len(midA) == 0 || len(midB) == 0 {
+		ops = append(ops, replaceAll(midA, midB)...)
+	} else if x, y, u, v, ok := middleSnake(midA, midB); !ok {
+		ops = append(ops, replaceAll(midA, midB)...)
+	} else {
+		ops = myers(midA[:x], midB[:y], ops)
+		for _, line := range midA[x:u] {
+			ops = append(ops, lineOp{' ', line})
+		}
+		ops = myers(midA[u:], midB[v:], ops)
+	}
+	for _, line := range a[len(a)-suffix:] {
+		ops = append(ops, lineOp{' ', line})
+	}
+	return ops
+}
+
+// middleSnake searches a shortest edit script of a and b from both ends at
+// once and returns the snake (x, y)-(u, v) where the searches meet. Both
+// regions around it have at most half the edit distance. It reports false
+// when the edit distance exceeds twice maxDiffEdits.
+func middleSnake(a, b []string) (x, y, u, v int, ok bool) {
+	n, m := len(a), len(b)
+	delta := n - m
+	odd := delta%2 != 0
+	maxD := min((n+m+1)/2, maxDiffEdits)
+
+	// vf[offset+k] holds the furthest x reached on diagonal k = x-y from the
+	// start; vb the same from the end, on the reversed inputs.
+	offset := maxD + 1
+	vf := make([]int, 2*maxD+3)
+	vb := make([]int, 2*maxD+3)
+	for d := 0; d <= maxD; d++ {
+		for k := -d; k <= d; k += 2 {
+			if k == -d || (k != d && vf[offset+k-1] < vf[offset+k+1]) {
+				x = vf[offset+k+1]
+			} else {
+				x = vf[offset+k-1] + 1
+			}
+			y = x - k
+			u, v = x, y
+			for u < n && v < m && a[u] == b[v] {
+				u++
+				v++
+			}
+			vf[offset+k] = u
+			// The backward search has run d-1 rounds.
+			if c := delta - k; odd && c >= -(d-1) && c <= d-1 && u+vb[offset+c] >= n {
+				return x, y, u, v, true
+			}
+		}
+		for k := -d; k <= d; k += 2 {
+			var xr int
+			if k == -d || (k != d && vb[offset+k-1] < vb[offset+k+1]) {
+				xr = vb[offset+k+1]
+			} else {
+				xr = vb[offset+k-1] + 1
+			}
+			yr := xr - k
+			ur, vr := xr, yr
+			for ur < n && vr < m && a[n-1-ur] == b[m-1-vr] {
+				ur++
+				vr++
+			}
+			vb[offset+k] = ur
+			if c := delta - k; !odd && c >= -d && c <= d && ur+vf[offset+c] >= n {
+				return n - ur, m - vr, n - xr, m - yr, true
+			}
+		}
+	}
+	return 0, 0, 0, 0, false
+}
+
+// replaceAll reports every line of a as removed and every line of b as added.
+func replaceAll(a, b []string) []lineOp {
+	ops := make([]lineOp, 0, len(a)+len(b))
+	for _, line := range a {
+		ops = append(ops, lineOp{'-', line})
+	}
+	for _, line := range b {
+		ops = append(ops, lineOp{'+', line})
+	}
+	return ops
+}
+
+func minInt(a, b int) int {
+	if a < b {
+		return a
+	}
+	return b
+}
+
+// StructuralDiff compares two YAML documents key path by key path. Leaves are
+// scalars and empty collections; paths use the dot notation of Lookup. For
+// multi-document streams the first path segment is the document index. The
+// result is sorted by path.
+func StructuralDiff(a, b []byte) ([]Change, error) {
+	left, err := flattenDocument(a)
+	if err != nil {
+		return nil, err
+	}
+	right, err := flattenDocument(b)
+	if err != nil {
+		return nil, err
+	}
+
+	var changes []Change
+	for path, oldNode := range left {
+		newNode, ok := right[path]
+		if !ok {
+			changes = append(changes, Change{Path: path, Type: ChangeRemoved, Old: leafValue(oldNode)})
+			continue
+		}
+		if !sameLeaf(oldNode, newNode) {
+			changes = append(changes, Change{Path: path, Type: ChangeChanged, Old: leafValue(oldNode), New: leafValue(newNode)})
+		}
+	}
+	for path, newNode := range right {
+		if _, ok := left[path]; !ok {
+			changes = append(changes, Change{Path: path, Type: ChangeAdded, New: leafValue(newNode)})
+		}
+	}
+	sort.Slice(changes, func(i, j int) bool { return changes[i].Path < changes[j].Path })
+	return changes, nil
+}
+
+// flattenDocument collects the leaves of a YAML stream. When the stream holds
+// more than one document, paths are prefixed with the document index.
+func flattenDocument(data []byte) (map[string]*yaml.Node, error) {
+	docs, err := ParseDocuments(data)
+	if err != nil {
+		return nil, err
+	}
+	leaves := make(map[string]*yaml.Node)
+	for i, doc := range docs {
+		if len(doc.Content) == 0 {
+			continue
+		}
+		prefix := ""
+		if len(docs) > 1 {
+			prefix = strconv.Itoa(i)
+		}
+		flattenNode(doc.Content[0], prefix, leaves)
+	}
+	return leaves, nil
+}
+
+func flattenNode(node *yaml.Node, path string, leaves map[string]*yaml.Node) {
+	node = resolveAlias(node)
+	switch {
+	case node.Kind == yaml.MappingNode && len(node.Content) > 0:
+		for i := 0; i+1 < len(node.Content); i += 2 {
+			flattenNode(node.Content[i+1], joinPath(path, node.Content[i].Value), leaves)
+		}
+	case node.Kind == yaml.SequenceNode && len(node.Content) > 0:
+		for i, child := range node.Content {
+			flattenNode(child, joinPath(path, strconv.Itoa(i)), leaves)
+		}
+	default:
+		leaves[path] = node
+	}
+}
+
+func sameLeaf(a, b *yaml.Node) bool {
+	if a.Kind != b.Kind {
+		return false
+	}
+	if a.Kind != yaml.ScalarNode {
+		return true // both empty collections of the same kind
+	}
+	return a.ShortTag() == b.ShortTag() && a.Value == b.Value
+}
+
+// leafValue decodes a leaf node into a JSON-friendly value.
+func leafValue(node *yaml.Node) interface{} {
+	switch node.Kind {
+	case yaml.MappingNode:
+		return map[string]interface{}{}
+	case yaml.SequenceNode:
+		return []interface{}{}
+	}
+	var v interface{}
+	if err := node.Decode(&v); err != nil {
+		return node.Value
+	}
+	switch val := v.(type) {
+	case float64:
+		if math.IsInf(val, 0) || math.IsNaN(val) {
+			return node.Value
+		}
+		return v
+	case string, bool, int, int64, uint64, nil:
+		return v
+	}
+	// Timestamps, binary and other tagged scalars are reported verbatim.
+	return node.Value
+}
@@ -0,0 +1,170 @@
+package yamlutil
+
+import (
+	"math/rand/v2"
+	"slices"
+	"strings"
+	"testing"
+)
+
+func TestUnifiedDiff(t *testing.T) {
+	a := "a: 1\nb: 2\nc: 3\nd: 4\ne: 5\nf: 6\ng: 7\nh: 8\ni: 9\nj: 10\n"
+	b := "a: 1\nb: 20\nc: 3\nd: 4\ne: 5\nf: 6\ng: 7\nh: 8\ni: 9\nj: 10\nk: 11\n"
+
+	got := UnifiedDiff("dev/app.yaml@1", "dev/app.yaml@2", []byte(a), []byte(b), 3)
+	want := `--- dev/app.yaml@1
++++ dev/app.yaml@2
+@@ -1,5 +1,5 @@
+ a: 1
+-b: 2
++b: 20
+ c: 3
+ d: 4
+ e: 5
+@@ -8,3 +8,4 @@
+ h: 8
+ i: 9
+ j: 10
++k: 11
+`
+	if got != want {
+		t.Fatalf("diff mismatch:\n got:\n%s\nwant:\n%s", got, want)
+	}
+
+	if d := UnifiedDiff("x", "y", []byte(a), []byte(a), 3); d != "" {
+		t.Fatalf("identical inputs should produce no diff, got %q", d)
+	}
+}
+
+func TestUnifiedDiffFromEmpty(t *testing.T) {
+	got := UnifiedDiff("a", "b", nil, []byte("x: 1\n"), 3)
+	want := "--- a\n+++ b\n@@ -0,0 +1 @@\n+x: 1\n"
+	if got != want {
+		t.Fatalf("diff mismatch:\n got: %q\nwant: %q", got, want)
+	}
+}
+
+func TestStructuralDiff(t *testing.T) {
+	a := `app: svc
+replicas: 1
+db:
+  host: a.internal
+  port: 5432
+tags: [x, y]
+`
+	b := `app: svc
+replicas: "1"
+db:
+  host: b.internal
+tags: [x]
+features: {}
+`
+	changes, err := StructuralDiff([]byte(a), []byte(b))
+	if err != nil {
+		t.Fatalf("StructuralDiff: %v", err)
+	}
+	var got []string
+	for _, c := range changes {
+		got = append(got, c.Type+" "+c.Path)
+	}
+	want := []string{
+		"changed db.host",
+		"removed db.port",
+		"added features",
+		"changed replicas",
+		"removed tags.1",
+	}
+	if strings.Join(got, ",") != strings.Join(want, ",") {
+		t.Fatalf("changes mismatch:\n got: %v\nwant: %v", got, want)
+	}
+	if changes[0].Old != "a.internal" || changes[0].New != "b.internal" {
+		t.Fatalf("unexpected values for db.host: %+v", changes[0])
+	}
+	if changes[3].Old != 1 || changes[3].New != "1" {
+		t.Fatalf("type change should be reported: %+v", changes[3])
+	}
+}
+
+// TestDiffLinesReconstructsInputs checks that the edit script always
+// replays to both sides, including when the edit budget is exhausted.
+func TestDiffLinesReconstructsInputs(t *testing.T) {
+	cases := [][2][]string{
+		{{"a", "b", "c"}, {"a", "x", "c", "d"}},
+		{{"a", "b"}, {}},
+		{{}, {"a"}},
+		{{"x", "a", "b", "c", "y"}, {"a", "z", "c"}},
+	}
+	var big [2][]string
+	for i := 0; i < 3*maxDiffEdits; i++ {
+		big[0] = append(big[0], "old-"+strings.Repeat("x", i%7))
+		big[1] = append(big[1], "new-"+strings.Repeat("y", i%5))
+	}
+	cases = append(cases, big)
+
+	for i, c := range cases {
+		var left, right []string
+		for _, op := range diffLines(c[0], c[1]) {
+			if op.kind != '+' {
+				left = append(left, op.text)
+			}
+			if op.kind != '-' {
+				right = append(right, op.text)
+			}
+		}
+		if strings.Join(left, "\n") != strings.Join(c[0], "\n") || strings.Join(right, "\n") != strings.Join(c[1], "\n") {
+			t.Errorf("case %d: edit script does not replay to its inputs", i)
+		}
+	}
+}
+
+// TestDiffLinesIsMinimal checks the edit scripts of random inputs against
+// the length of their longest common subsequence.
+func TestDiffLinesIsMinimal(t *testing.T) {
+	rng := rand.New(rand.NewPCG(1, 2))
+	lines := func() []string {
+		out := make([]string, rng.IntN(40))
+		for i := range out {
+			out[i] = string(rune('a' + rng.IntN(4)))
+		}
+		return out
+	}
+	for i := 0; i < 500; i++ {
+		a, b := lines(), lines()
+		ops := diffLines(a, b)
+		var left, right []string
+		edits := 0
+		for _, op := range ops {
+			if op.kind != '+' {
+				left = append(left, op.text)
+			}
+			if op.kind != '-' {
+				right = append(right, op.text)
+			}
+			if op.kind != ' ' {
+				edits++
+			}
+		}
+		if !slices.Equal(left, a) || !slices.Equal(right, b) {
+			t.Fatalf("%v -> %v: edit script does not replay to its inputs", a, b)
+		}
+		if want := len(a) + len(b) - 2*lcsLength(a, b); edits != want {
+			t.Fatalf("%v -> %v: %d edits, want %d", a, b, edits, want)
+		}
+	}
+}
+
+func lcsLength(a, b []string) int {
+	prev := make([]int, len(b)+1)
+	for i := range a {
+		cur := make([]int, len(b)+1)
+		for j := range b {
+			if a[i] == b[j] {
+				cur[j+1] = prev[j] + 1
+			} else {
+				cur[j+1] = max(cur[j], prev[j+1])
+			}
+		}
+		prev = cur
+	}
+	return prev[len(b)]
+}
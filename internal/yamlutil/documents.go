@@ -0,0 +1,199 @@
+package yamlutil
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// ErrNoDocument is returned when a document index or selector matches
+// nothing in a stream.
+var ErrNoDocument = errors.New("no matching document")
+
+// ErrInvalidSelector is returned when a document selector cannot be parsed.
+var ErrInvalidSelector = errors.New("invalid document selector")
+
+// ErrAmbiguousDocument is returned when an operation needs a single document
+// but the stream holds several and none was selected, or a selector matches
+// more than one.
+var ErrAmbiguousDocument = errors.New("ambiguous document selection")
+
+// ParseDocuments parses a ---separated YAML stream and returns its document
+// nodes. Every document is validated; an error names the offending one.
+func ParseDocuments(data []byte) ([]*yaml.Node, error) {
+	dec := yaml.NewDecoder(bytes.NewReader(data))
+	var docs []*yaml.Node
+	for {
+		var doc yaml.Node
+		err := dec.Decode(&doc)
+		if err == io.EOF {
+			return docs, nil
+		}
+		if err != nil {
+			return nil, fmt.Errorf("%w: document %d: %v", ErrInvalidYAML, len(docs), err)
+		}
+		docs = append(docs, &doc)
+	}
+}
+
+// EncodeDocuments serializes documents as a ---separated stream.
+func EncodeDocuments(docs []*yaml.Node) ([]byte, error) {
+	var buf bytes.Buffer
+	enc := yaml.NewEncoder(&buf)
+	enc.SetIndent(2)
+	for _, doc := range docs {
+		if err := enc.Encode(doc); err != nil {
+			return nil, fmt.Errorf("%w: %v", ErrConversion, err)
+		}
+	}
+	if err := enc.Close(); err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrConversion, err)
+	}
+	return buf.Bytes(), nil
+}
+
+// CountDocuments returns the number of documents in a YAML stream.
+func CountDocuments(data []byte) (int, error) {
+	docs, err := ParseDocuments(data)
+	if err != nil {
+		return 0, err
+	}
+	return len(docs), nil
+}
+
+// Selector picks one document out of a stream, either by zero-based index or
+// by matching key paths against scalar values.
+type Selector struct {
+	Index   int
+	Matches map[string]string
+	byIndex bool
+}
+
+// IndexSelector selects the document at a zero-based index.
+func IndexSelector(i int) Selector {
+	return Selector{Index: i, byIndex: true}
+}
+
+// ParseSelector parses a comma-separated list of path=value pairs such as
+// "kind=Deployment,metadata.name=api". Paths use the dot notation of Lookup.
+func ParseSelector(s string) (Selector, error) {
+	sel := Selector{Matches: make(map[string]string)}
+	for _, part := range strings.Split(s, ",") {
+		path, value, ok := strings.Cut(strings.TrimSpace(part), "=")
+		if !ok || path == "" {
+			return Selector{}, fmt.Errorf("%w: term %q", ErrInvalidSelector, part)
+		}
+		sel.Matches[path] = value
+	}
+	return sel, nil
+}
+
+// IsZero reports whether the selector selects nothing in particular.
+func (s Selector) IsZero() bool {
+	return !s.byIndex && len(s.Matches) == 0
+}
+
+// String renders the selector for error messages.
+func (s Selector) String() string {
+	if s.byIndex {
+		return fmt.Sprintf("document %d", s.Index)
+	}
+	terms := make([]string, 0, len(s.Matches))
+	for path, value := range s.Matches {
+		terms = append(terms, path+"="+value)
+	}
+	return strings.Join(terms, ",")
+}
+
+// Find returns the index of the single document matching the selector. A
+// zero selector matches the only document of a single-document stream.
+func (s Selector) Find(docs []*yaml.Node) (int, error) {
+	if s.byIndex {
+		if s.Index < 0 || s.Index >= len(docs) {
+			return 0, fmt.Errorf("%w: index %d out of range (%d documents)", ErrNoDocument, s.Index, len(docs))
+		}
+		return s.Index, nil
+	}
+	if len(s.Matches) == 0 {
+		if len(docs) != 1 {
+			return 0, fmt.Errorf("%w: stream has %d documents", ErrAmbiguousDocument, len(docs))
+		}
+		return 0, nil
+	}
+
+	found := -1
+	for i, doc := range docs {
+		if !s.matches(doc) {
+			continue
+		}
+		if found >= 0 {
+			return 0, fmt.Errorf("%w: %s matches documents %d and %d", ErrAmbiguousDocument, s, found, i)
+		}
+		found = i
+	}
+	if found < 0 {
+		return 0, fmt.Errorf("%w: %s", ErrNoDocument, s)
+	}
+	return found, nil
+}
+
+func (s Selector) matches(doc *yaml.Node) bool {
+	if len(doc.Content) == 0 {
+		return false
+	}
+	for path, want := range s.Matches {
+		node, err := Lookup(doc.Content[0], path)
+		if err != nil || node.Kind != yaml.ScalarNode || node.Value != want {
+			return false
+		}
+	}
+	return true
+}
+
+// SelectDocument returns the selected document of a stream as YAML.
+func SelectDocument(data []byte, sel Selector) ([]byte, error) {
+	docs, err := ParseDocuments(data)
+	if err != nil {
+		return nil, err
+	}
+	idx, err := sel.Find(docs)
+	if err != nil {
+		return nil, err
+	}
+	return EncodeDocuments(docs[idx : idx+1])
+}
+
+// PatchDocument applies a merge patch (RFC 7396 semantics expressed in
+// YAML) to the selected document of a stream and returns the new stream:
+// mappings merge recursively, null deletes a key, and every other value
+// replaces what was there.
+func PatchDocument(data []byte, sel Selector, patch []byte) ([]byte, error) {
+	docs, err := ParseDocuments(data)
+	if err != nil {
+		return nil, err
+	}
+	idx, err := sel.Find(docs)
+	if err != nil {
+		return nil, err
+	}
+
+	patchDocs, err := ParseDocuments(patch)
+	if err != nil {
+		return nil, err
+	}
+	if len(patchDocs) != 1 || len(patchDocs[0].Content) == 0 {
+		return nil, fmt.Errorf("%w: patch must be a single document", ErrInvalidYAML)
+	}
+
+	target := docs[idx]
+	if len(target.Content) == 0 {
+		target.Content = []*yaml.Node{{Kind: yaml.MappingNode, Tag: "!!map"}}
+	}
+	m := &Merged{origin: make(map[*yaml.Node]string)}
+	target.Content[0] = m.mergeNodes(target.Content[0], patchDocs[0].Content[0], directive{Lists: ListReplace})
+	return EncodeDocuments(docs)
+}
@@ -0,0 +1,149 @@
+package yamlutil
+
+import (
+	"errors"
+	"strings"
+	"testing"
+)
+
+const manifests = `kind: Deployment
+metadata:
+  name: api
+spec:
+  replicas: 1
+---
+kind: Service
+metadata:
+  name: api
+---
+kind: Deployment
+metadata:
+  name: worker
+`
+
+func TestParseDocuments(t *testing.T) {
+	docs, err := ParseDocuments([]byte(manifests))
+	if err != nil {
+		t.Fatalf("ParseDocuments: %v", err)
+	}
+	if len(docs) != 3 {
+		t.Fatalf("expected 3 documents, got %d", len(docs))
+	}
+	if n, _ := CountDocuments([]byte("")); n != 0 {
+		t.Fatalf("empty stream should have no documents, got %d", n)
+	}
+
+	_, err = ParseDocuments([]byte("a: 1\n---\nb: [\n"))
+	if !errors.Is(err, ErrInvalidYAML) || !strings.Contains(err.Error(), "document 1") {
+		t.Fatalf("expected error naming document 1, got %v", err)
+	}
+}
+
+func TestSelectDocument(t *testing.T) {
+	cases := []struct {
+		sel  string
+		want string
+	}{
+		{"kind=Service", "kind: Service\nmetadata:\n  name: api\n"},
+		{"kind=Deployment,metadata.name=worker", "kind: Deployment\nmetadata:\n  name: worker\n"},
+	}
+	for _, c := range cases {
+		sel, err := ParseSelector(c.sel)
+		if err != nil {
+			t.Fatalf("ParseSelector(%q): %v", c.sel, err)
+		}
+		out, err := SelectDocument([]byte(manifests), sel)
+		if err != nil {
+			t.Fatalf("SelectDocument(%q): %v", c.sel, err)
+		}
+		if string(out) != c.want {
+			t.Errorf("SelectDocument(%q) = %q, want %q", c.sel, out, c.want)
+		}
+	}
+
+	out, err := SelectDocument([]byte(manifests), IndexSelector(1))
+	if err != nil || !strings.HasPrefix(string(out), "kind: Service") {
+		t.Fatalf("index selection: %q, %v", out, err)
+	}
+
+	sel, _ := ParseSelector("kind=Deployment")
+	if _, err := SelectDocument([]byte(manifests), sel); !errors.Is(err, ErrAmbiguousDocument) {
+		t.Fatalf("expected ErrAmbiguousDocument, got %v", err)
+	}
+	sel, _ = ParseSelector("kind=Job")
+	if _, err := SelectDocument([]byte(manifests), sel); !errors.Is(err, ErrNoDocument) {
+		t.Fatalf("expected ErrNoDocument, got %v", err)
+	}
+	if _, err := SelectDocument([]byte(manifests), IndexSelector(3)); !errors.Is(err, ErrNoDocument) {
+		t.Fatalf("expected ErrNoDocument for out-of-range index, got %v", err)
+	}
+	if _, err := SelectDocument([]byte(manifests), Selector{}); !errors.Is(err, ErrAmbiguousDocument) {
+		t.Fatalf("zero selector on a stream should be ambiguous, got %v", err)
+	}
+	if _, err := ParseSelector("kind"); !errors.Is(err, ErrInvalidSelector) {
+		t.Fatalf("expected ErrInvalidSelector, got %v", err)
+	}
+}
+
+func TestPatchDocument(t *testing.T) {
+	sel, _ := ParseSelector("metadata.name=api,kind=Deployment")
+	out, err := PatchDocument([]byte(manifests), sel, []byte("spec:\n  replicas: 3\nmetadata:\n  labels: {tier: web}\n"))
+	if err != nil {
+		t.Fatalf("PatchDocument: %v", err)
+	}
+	want := `kind: Deployment
+metadata:
+  name: api
+  labels: {tier: web}
+spec:
+  replicas: 3
+---
+kind: Service
+metadata:
+  name: api
+---
+kind: Deployment
+metadata:
+  name: worker
+`
+	if string(out) != want {
+		t.Fatalf("patch mismatch:\n got:\n%s\nwant:\n%s", out, want)
+	}
+
+	out, err = PatchDocument([]byte("a: 1\nb: 2\n"), Selector{}, []byte("b: null\nc: [1]\n"))
+	if err != nil {
+		t.Fatalf("PatchDocument single: %v", err)
+	}
+	if string(out) != "a: 1\nc: [1]\n" {
+		t.Fatalf("unexpected single-document patch %q", out)
+	}
+
+	if _, err := PatchDocument([]byte(manifests), Selector{}, []byte("x: 1\n")); !errors.Is(err, ErrAmbiguousDocument) {
+		t.Fatalf("expected ErrAmbiguousDocument, got %v", err)
+	}
+}
+
+func TestMultiDocumentHelpers(t *testing.T) {
+	stream := []byte("a: 1\n---\nb: 2\n")
+	out, err := FromYAML(stream, FormatJSON)
+	if err != nil || string(out) != "[{\"a\":1},{\"b\":2}]\n" {
+		t.Fatalf("FromYAML JSON stream = %q, %v", out, err)
+	}
+	if _, err := FromYAML(stream, FormatTOML); !errors.Is(err, ErrConversion) {
+		t.Fatalf("expected TOML conversion of a stream to fail, got %v", err)
+	}
+
+	changes, err := StructuralDiff(stream, []byte("a: 1\n---\nb: 3\n"))
+	if err != nil {
+		t.Fatalf("StructuralDiff: %v", err)
+	}
+	if len(changes) != 1 || changes[0].Path != "1.b" {
+		t.Fatalf("unexpected changes %+v", changes)
+	}
+
+	rendered, err := Render("dev", "app.yaml", []byte("x: ${env:A}\n---\ny: ${env:A}\n"), mapResolver(nil),
+		RenderOptions{Env: func(string) (string, bool) { return "v", true }})
+	if err != nil || string(rendered) != "x: v\n---\ny: v\n" {
+		t.Fatalf("Render stream = %q, %v", rendered, err)
+	}
+}
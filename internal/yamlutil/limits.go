@@ -0,0 +1,235 @@
+package yamlutil
+
+import (
+	"errors"
+	"fmt"
+
+	"gopkg.in/yaml.v3"
+)
+
+// Default parse limits. They are generous for hand-written configs and
+// Kubernetes-style manifests while keeping a 1 MiB upload from expanding
+// into something far larger in memory.
+const (
+	DefaultMaxDepth          = 100
+	DefaultMaxNodes          = 100000
+	DefaultMaxAliasExpansion = 100000
+	DefaultMaxScalarBytes    = 1 << 20 // 1 MiB
+)
+
+// Names of the individual limits, as reported by LimitError.
+const (
+	LimitDepth          = "nesting depth"
+	LimitNodes          = "node count"
+	LimitAliasExpansion = "alias expansion"
+	LimitScalarBytes    = "scalar size"
+)
+
+// ErrLimitExceeded is returned (wrapped in a *LimitError) when a document
+// exceeds one of the configured parse limits.
+var ErrLimitExceeded = errors.New("document exceeds parse limits")
+
+// Limits bounds the shape of parsed YAML. A zero field disables that limit.
+type Limits struct {
+	// MaxDepth bounds how deeply mappings and sequences may nest, counting
+	// structure reached through aliases.
+	MaxDepth int
+	// MaxNodes bounds the number of nodes in a document as written.
+	MaxNodes int
+	// MaxAliasExpansion bounds how many nodes aliases may expand to in
+	// total, which is what defeats "billion laughs" documents.
+	MaxAliasExpansion int
+	// MaxScalarBytes bounds the length of any single scalar, keys included.
+	MaxScalarBytes int
+}
+
+// DefaultLimits returns the default parse limits.
+func DefaultLimits() Limits {
+	return Limits{
+		MaxDepth:          DefaultMaxDepth,
+		MaxNodes:          DefaultMaxNodes,
+		MaxAliasExpansion: DefaultMaxAliasExpansion,
+		MaxScalarBytes:    DefaultMaxScalarBytes,
+	}
+}
+
+// LimitError reports which limit a document exceeded.
+type LimitError struct {
+	// Limit is one of the Limit* names.
+	Limit string
+	// Max is the configured value of the limit.
+	Max int
+	// Document is the index of the offending document in its stream, or -1
+	// when the limit applies to rendered output as a whole.
+	Document int
+}
+
+func (e *LimitError) Error() string {
+	where := "rendered config"
+	if e.Document >= 0 {
+		where = fmt.Sprintf("document %d", e.Document)
+	}
+	return fmt.Sprintf("%s exceeds the %s limit of %d %s", where, e.Limit, e.Max, limitUnit(e.Limit))
+}
+
+// Unwrap lets errors.Is match ErrLimitExceeded.
+func (e *LimitError) Unwrap() error { return ErrLimitExceeded }
+
+func limitUnit(limit string) string {
+	switch limit {
+	case LimitDepth:
+		return "levels"
+	case LimitScalarBytes:
+		return "bytes"
+	default:
+		return "nodes"
+	}
+}
+
+// CheckLimits parses a YAML stream and verifies every document against l.
+// It returns the number of documents. Alias cycles are rejected as invalid
+// YAML, since nothing downstream can expand them.
+func CheckLimits(data []byte, l Limits) (int, error) {
+	docs, err := ParseDocuments(data)
+	if err != nil {
+		return 0, err
+	}
+	for i, doc := range docs {
+		if err := l.check(doc, i); err != nil {
+			return 0, err
+		}
+	}
+	return len(docs), nil
+}
+
+// check verifies a single parsed document.
+func (l Limits) check(doc *yaml.Node, index int) error {
+	c := &limitChecker{
+		limits:   l,
+		index:    index,
+		expanded: make(map[*yaml.Node]expansion),
+	}
+	return c.visit(doc, 0)
+}
+
+// expansion is the memoized size of a node with its aliases expanded.
+type expansion struct {
+	nodes int
+	depth int
+}
+
+type limitChecker struct {
+	limits Limits
+	index  int
+	nodes  int
+	// aliased counts nodes materialized through aliases.
+	aliased  int
+	expanded map[*yaml.Node]expansion
+	visiting map[*yaml.Node]bool
+}
+
+func (c *limitChecker) fail(limit string, max int) error {
+	return &LimitError{Limit: limit, Max: max, Document: c.index}
+}
+
+// visit walks the document as written, following aliases only to measure
+// what they expand to.
+func (c *limitChecker) visit(n *yaml.Node, depth int) error {
+	c.nodes++
+	if c.limits.MaxNodes > 0 && c.nodes > c.limits.MaxNodes {
+		return c.fail(LimitNodes, c.limits.MaxNodes)
+	}
+	if c.limits.MaxDepth > 0 && depth > c.limits.MaxDepth {
+		return c.fail(LimitDepth, c.limits.MaxDepth)
+	}
+
+	switch n.Kind {
+	case yaml.ScalarNode:
+		if c.limits.MaxScalarBytes > 0 && len(n.Value) > c.limits.MaxScalarBytes {
+			return c.fail(LimitScalarBytes, c.limits.MaxScalarBytes)
+		}
+	case yaml.AliasNode:
+		exp, err := c.expand(n.Alias)
+		if err != nil {
+			return err
+		}
+		c.aliased += exp.nodes
+		if c.limits.MaxAliasExpansion > 0 && c.aliased > c.limits.MaxAliasExpansion {
+			return c.fail(LimitAliasExpansion, c.limits.MaxAliasExpansion)
+		}
+		if c.limits.MaxDepth > 0 && depth+exp.depth > c.limits.MaxDepth {
+			return c.fail(LimitDepth, c.limits.MaxDepth)
+		}
+	}
+
+	// Documents do not add a nesting level of their own.
+	childDepth := depth + 1
+	if n.Kind == yaml.DocumentNode {
+		childDepth = depth
+	}
+	for _, child := range n.Content {
+		if err := c.visit(child, childDepth); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// expand measures n with aliases expanded. Results are memoized per node so
+// that shared anchors are measured once, and sizes saturate just past the
+// alias limit so that pathological documents cannot overflow the count.
+func (c *limitChecker) expand(n *yaml.Node) (expansion, error) {
+	if n == nil {
+		return expansion{}, nil
+	}
+	if exp, ok := c.expanded[n]; ok {
+		return exp, nil
+	}
+	if c.visiting == nil {
+		c.visiting = make(map[*yaml.Node]bool)
+	}
+	if c.visiting[n] {
+		return expansion{}, fmt.Errorf("%w: document %d: alias %q refers to itself", ErrInvalidYAML, c.index, n.Anchor)
+	}
+	c.visiting[n] = true
+	defer delete(c.visiting, n)
+
+	target := n
+	if n.Kind == yaml.AliasNode {
+		target = n.Alias
+		exp, err := c.expand(target)
+		if err != nil {
+			return expansion{}, err
+		}
+		c.expanded[n] = exp
+		return exp, nil
+	}
+
+	exp := expansion{nodes: 1}
+	for _, child := range target.Content {
+		sub, err := c.expand(child)
+		if err != nil {
+			return expansion{}, err
+		}
+		exp.nodes = c.saturate(exp.nodes + sub.nodes)
+		if sub.depth+1 > exp.depth {
+			exp.depth = sub.depth + 1
+		}
+	}
+	c.expanded[n] = exp
+	return exp, nil
+}
+
+func (c *limitChecker) saturate(n int) int {
+	max := maxExpansion
+	if c.limits.MaxAliasExpansion > 0 {
+		max = c.limits.MaxAliasExpansion + 1
+	}
+	if n > max {
+		return max
+	}
+	return n
+}
+
+// maxExpansion caps measured sizes when the alias limit is disabled.
+const maxExpansion = 1 << 40
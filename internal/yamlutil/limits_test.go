@@ -0,0 +1,85 @@
+package yamlutil
+
+import (
+	"errors"
+	"strings"
+	"testing"
+)
+
+// billionLaughs builds the classic alias bomb with the given number of
+// levels, each expanding the previous one ten times.
+func billionLaughs(levels int) string {
+	var b strings.Builder
+	b.WriteString("a0: &a0 [lol]\n")
+	for i := 1; i <= levels; i++ {
+		b.WriteString("a" + string(rune('0'+i)) + ": &a" + string(rune('0'+i)) + " [")
+		for j := 0; j < 10; j++ {
+			if j > 0 {
+				b.WriteString(", ")
+			}
+			b.WriteString("*a" + string(rune('0'+i-1)))
+		}
+		b.WriteString("]\n")
+	}
+	return b.String()
+}
+
+func TestCheckLimits(t *testing.T) {
+	deep := strings.Repeat("[", 20) + strings.Repeat("]", 20)
+	cases := []struct {
+		name   string
+		in     string
+		limits Limits
+		limit  string
+	}{
+		{"alias bomb", billionLaughs(9), DefaultLimits(), LimitAliasExpansion},
+		{"depth", deep, Limits{MaxDepth: 10}, LimitDepth},
+		{"nodes", "[" + strings.Repeat("1,", 100) + "1]", Limits{MaxNodes: 50}, LimitNodes},
+		{"scalar", "k: " + strings.Repeat("x", 65), Limits{MaxScalarBytes: 64}, LimitScalarBytes},
+		{"aliased depth", "a: &a [[[[1]]]]\nb: [[[*a]]]\n", Limits{MaxDepth: 6}, LimitDepth},
+	}
+	for _, c := range cases {
+		_, err := CheckLimits([]byte(c.in), c.limits)
+		var le *LimitError
+		if !errors.As(err, &le) || !errors.Is(err, ErrLimitExceeded) {
+			t.Errorf("%s: expected a LimitError, got %v", c.name, err)
+			continue
+		}
+		if le.Limit != c.limit {
+			t.Errorf("%s: limit = %q, want %q", c.name, le.Limit, c.limit)
+		}
+	}
+
+	n, err := CheckLimits([]byte(billionLaughs(3)+"---\nx: 1\n"), DefaultLimits())
+	if err != nil || n != 2 {
+		t.Fatalf("small aliases should pass: %d, %v", n, err)
+	}
+	if _, err := CheckLimits([]byte(billionLaughs(9)), Limits{}); err != nil {
+		t.Fatalf("zero limits should disable checks: %v", err)
+	}
+	if _, err := CheckLimits([]byte("a: &a [*a]\n"), Limits{}); !errors.Is(err, ErrInvalidYAML) {
+		t.Fatalf("expected a recursive alias to be invalid, got %v", err)
+	}
+}
+
+func TestLimitErrorNamesDocument(t *testing.T) {
+	_, err := CheckLimits([]byte("a: 1\n---\nb: "+strings.Repeat("x", 20)+"\n"), Limits{MaxScalarBytes: 10})
+	want := "document 1 exceeds the scalar size limit of 10 bytes"
+	if err == nil || err.Error() != want {
+		t.Fatalf("error = %v, want %q", err, want)
+	}
+}
+
+func TestRenderEnforcesLimits(t *testing.T) {
+	configs := map[string]string{"dev/big.yaml": "items: [" + strings.Repeat("1,", 40) + "1]\n"}
+	in := "a: ${ref:big.yaml#items}\nb: ${ref:big.yaml#items}\nc: ${ref:big.yaml#items}\n"
+
+	_, err := Render("dev", "app.yaml", []byte(in), mapResolver(configs), RenderOptions{Limits: Limits{MaxNodes: 100}})
+	var le *LimitError
+	if !errors.As(err, &le) || le.Limit != LimitNodes || le.Document != -1 {
+		t.Fatalf("expected node limit on spliced references, got %v", err)
+	}
+	if _, err := Render("dev", "app.yaml", []byte(in), mapResolver(configs), RenderOptions{Limits: DefaultLimits()}); err != nil {
+		t.Fatalf("default limits should allow the render: %v", err)
+	}
+}
@@ -0,0 +1,319 @@
+package yamlutil
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// DirectiveKey is the top-level mapping key an overlay uses to declare its
+// base and merge options. It is stripped from merged output.
+//
+//	x-yamlet:
+//	  base: base/app.yaml   # namespace/name, or just name in the same namespace
+//	  lists: merge          # replace (default), append or merge
+//	  mergeKey: name        # key that identifies list items when lists: merge
+//	  secrets: [api_key]    # key path patterns redacted on read (see Redact)
+const DirectiveKey = "x-yamlet"
+
+// DefaultMergeKey identifies list items when an overlay asks for merge-by-key
+// without naming a key.
+const DefaultMergeKey = "name"
+
+// ListStrategy controls how an overlay's sequences combine with its base.
+type ListStrategy string
+
+// Supported list strategies.
+const (
+	ListReplace ListStrategy = "replace"
+	ListAppend  ListStrategy = "append"
+	ListMerge   ListStrategy = "merge"
+)
+
+// ErrInvalidDirective is returned when an x-yamlet directive is malformed.
+var ErrInvalidDirective = errors.New("invalid x-yamlet directive")
+
+// Origin records which layer produced a key path in a merged document.
+type Origin struct {
+	Path  string `json:"path"`
+	Layer string `json:"layer"`
+}
+
+// Merged is the result of resolving a config's inheritance chain.
+type Merged struct {
+	// Layers lists the configs that contributed, base first, as "ns/name".
+	Layers []string
+	// Origins maps every leaf path of the merged document to its layer.
+	Origins []Origin
+
+	root   *yaml.Node
+	origin map[*yaml.Node]string
+}
+
+// YAML encodes the merged document.
+func (m *Merged) YAML() ([]byte, error) {
+	if m.root == nil {
+		return []byte{}, nil
+	}
+	return encodeNode(m.root)
+}
+
+// directive is the parsed form of an x-yamlet block.
+type directive struct {
+	Base     string       `yaml:"base"`
+	Lists    ListStrategy `yaml:"lists"`
+	MergeKey string       `yaml:"mergeKey"`
+}
+
+// Merge resolves the inheritance chain of namespace/name, deep-merging each
+// overlay onto its base. Mappings merge key by key, an explicit null in an
+// overlay deletes the inherited key, and sequences follow the overlay's list
+// strategy. Bases are loaded through resolve, with the same cycle and depth
+// protection as Render. Only the first document of a stream takes part.
+func Merge(namespace, name string, data []byte, resolve Resolver, maxDepth int) (*Merged, error) {
+	if maxDepth <= 0 {
+		maxDepth = DefaultMaxRenderDepth
+	}
+	m := &Merged{origin: make(map[*yaml.Node]string)}
+	root, err := m.resolveLayer(namespace, name, data, resolve, maxDepth, nil)
+	if err != nil {
+		return nil, err
+	}
+	m.root = root
+	m.collectOrigins(root, "")
+	return m, nil
+}
+
+func (m *Merged) resolveLayer(namespace, name string, data []byte, resolve Resolver, maxDepth int, stack []string) (*yaml.Node, error) {
+	key := namespace + "/" + name
+	for _, seen := range stack {
+		if seen == key {
+			return nil, fmt.Errorf("%w: %s -> %s", ErrRenderCycle, strings.Join(stack, " -> "), key)
+		}
+	}
+	if len(stack) >= maxDepth {
+		return nil, fmt.Errorf("%w (%d) resolving base %s", ErrRenderDepth, maxDepth, key)
+	}
+	stack = append(stack, key)
+
+	var doc yaml.Node
+	if err := yaml.Unmarshal(data, &doc); err != nil {
+		return nil, fmt.Errorf("%w: config %s: %v", ErrInvalidYAML, key, err)
+	}
+	if len(doc.Content) == 0 {
+		m.Layers = append(m.Layers, key)
+		return nil, nil
+	}
+	// Merging updates nodes in place, so aliases are expanded first: merging
+	// at one site must not change the others that alias the same anchor, nor
+	// leave an alias to an anchored key an overlay deleted. The caller holds
+	// data to the parse limits, which bound the expansion.
+	root := expandAliases(doc.Content[0])
+
+	dir, err := extractDirective(root)
+	if err != nil {
+		return nil, fmt.Errorf("config %s: %w", key, err)
+	}
+
+	var base *yaml.Node
+	if dir.Base != "" {
+		baseNamespace, baseName, ok := strings.Cut(dir.Base, "/")
+		if !ok {
+			baseNamespace, baseName = namespace, dir.Base
+		}
+		if baseNamespace == "" || baseName == "" || strings.Contains(baseName, "/") {
+			return nil, fmt.Errorf("config %s: %w: base %q", key, ErrInvalidDirective, dir.Base)
+		}
+		baseData, err := resolve(baseNamespace, baseName)
+		if err != nil {
+			return nil, fmt.Errorf("resolving base %s of %s: %w", dir.Base, key, err)
+		}
+		base, err = m.resolveLayer(baseNamespace, baseName, baseData, resolve, maxDepth, stack)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	m.Layers = append(m.Layers, key)
+	m.markOrigin(root, key)
+	if base == nil {
+		return root, nil
+	}
+	return m.mergeNodes(base, root, dir), nil
+}
+
+// extractDirective removes the x-yamlet key from a top-level mapping and
+// returns its parsed contents.
+func extractDirective(root *yaml.Node) (directive, error) {
+	dir := directive{Lists: ListReplace}
+	if root.Kind != yaml.MappingNode {
+		return dir, nil
+	}
+	for i := 0; i+1 < len(root.Content); i += 2 {
+		if root.Content[i].Value != DirectiveKey {
+			continue
+		}
+		if err := root.Content[i+1].Decode(&dir); err != nil {
+			return dir, fmt.Errorf("%w: %v", ErrInvalidDirective, err)
+		}
+		root.Content = append(root.Content[:i], root.Content[i+2:]...)
+		break
+	}
+	switch dir.Lists {
+	case "":
+		dir.Lists = ListReplace
+	case ListReplace, ListAppend:
+	case ListMerge:
+		if dir.MergeKey == "" {
+			dir.MergeKey = DefaultMergeKey
+		}
+	default:
+		return dir, fmt.Errorf("%w: unknown list strategy %q", ErrInvalidDirective, dir.Lists)
+	}
+	return dir, nil
+}
+
+// expandAliases returns a deep copy of n with every alias replaced by a copy
+// of what it refers to and anchors dropped.
+func expandAliases(n *yaml.Node) *yaml.Node {
+	n = resolveAlias(n)
+	c := *n
+	c.Anchor = ""
+	if n.Content != nil {
+		c.Content = make([]*yaml.Node, len(n.Content))
+		for i, child := range n.Content {
+			c.Content[i] = expandAliases(child)
+		}
+	}
+	return &c
+}
+
+func (m *Merged) markOrigin(node *yaml.Node, layer string) {
+	if node == nil {
+		return
+	}
+	m.origin[node] = layer
+	for _, child := range node.Content {
+		m.markOrigin(child, layer)
+	}
+}
+
+// mergeNodes merges overlay onto base and returns the combined node. Base
+// mappings are updated in place so that unchanged keys keep their origin;
+// both trees are alias-free copies made by expandAliases.
+func (m *Merged) mergeNodes(base, overlay *yaml.Node, dir directive) *yaml.Node {
+	base = resolveAlias(base)
+	overlay = resolveAlias(overlay)
+	if base.Kind == yaml.MappingNode && overlay.Kind == yaml.MappingNode {
+		for i := 0; i+1 < len(overlay.Content); i += 2 {
+			key, value := overlay.Content[i], overlay.Content[i+1]
+			idx := mappingIndex(base, key.Value)
+			switch {
+			case value.ShortTag() == "!!null" && idx >= 0:
+				base.Content = append(base.Content[:idx], base.Content[idx+2:]...)
+			case value.ShortTag() == "!!null":
+				// Deleting a key the base never had is a no-op.
+			case idx >= 0:
+				base.Content[idx+1] = m.mergeNodes(base.Content[idx+1], value, dir)
+			default:
+				base.Content = append(base.Content, key, value)
+			}
+		}
+		return base
+	}
+	if base.Kind == yaml.SequenceNode && overlay.Kind == yaml.SequenceNode {
+		switch dir.Lists {
+		case ListAppend:
+			base.Content = append(base.Content, overlay.Content...)
+			return base
+		case ListMerge:
+			return m.mergeSequenceByKey(base, overlay, dir)
+		}
+	}
+	return overlay
+}
+
+// mergeSequenceByKey merges mapping items that share the same value for
+// dir.MergeKey and appends the rest.
+func (m *Merged) mergeSequenceByKey(base, overlay *yaml.Node, dir directive) *yaml.Node {
+	for _, item := range overlay.Content {
+		id, ok := itemKey(item, dir.MergeKey)
+		if !ok {
+			base.Content = append(base.Content, item)
+			continue
+		}
+		matched := false
+		for i, existing := range base.Content {
+			if existingID, ok := itemKey(existing, dir.MergeKey); ok && existingID == id {
+				base.Content[i] = m.mergeNodes(existing, item, dir)
+				matched = true
+				break
+			}
+		}
+		if !matched {
+			base.Content = append(base.Content, item)
+		}
+	}
+	return base
+}
+
+func itemKey(item *yaml.Node, mergeKey string) (string, bool) {
+	item = resolveAlias(item)
+	if item.Kind != yaml.MappingNode {
+		return "", false
+	}
+	idx := mappingIndex(item, mergeKey)
+	if idx < 0 || item.Content[idx+1].Kind != yaml.ScalarNode {
+		return "", false
+	}
+	return item.Content[idx+1].Value, true
+}
+
+// mappingIndex returns the index of key within a mapping's Content, or -1.
+func mappingIndex(mapping *yaml.Node, key string) int {
+	for i := 0; i+1 < len(mapping.Content); i += 2 {
+		if mapping.Content[i].Value == key {
+			return i
+		}
+	}
+	return -1
+}
+
+func resolveAlias(n *yaml.Node) *yaml.Node {
+	for n != nil && n.Kind == yaml.AliasNode {
+		n = n.Alias
+	}
+	return n
+}
+
+// collectOrigins records the layer of every leaf below node. Empty mappings
+// and sequences count as leaves so that they still show up.
+func (m *Merged) collectOrigins(node *yaml.Node, path string) {
+	node = resolveAlias(node)
+	if node == nil {
+		return
+	}
+	switch {
+	case node.Kind == yaml.MappingNode && len(node.Content) > 0:
+		for i := 0; i+1 < len(node.Content); i += 2 {
+			m.collectOrigins(node.Content[i+1], joinPath(path, node.Content[i].Value))
+		}
+	case node.Kind == yaml.SequenceNode && len(node.Content) > 0:
+		for i, child := range node.Content {
+			m.collectOrigins(child, joinPath(path, strconv.Itoa(i)))
+		}
+	default:
+		m.Origins = append(m.Origins, Origin{Path: path, Layer: m.origin[node]})
+	}
+}
+
+// joinPath appends a segment to a dot-separated key path.
+func joinPath(path, segment string) string {
+	if path == "" {
+		return segment
+	}
+	return path + "." + segment
+}
@@ -0,0 +1,181 @@
+package yamlutil
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestMergeOverlayOntoBase(t *testing.T) {
+	configs := map[string]string{
+		"base/app.yaml": `app: svc
+replicas: 1
+debug: true
+database:
+  host: db.internal
+  port: 5432
+tags: [a, b]
+`,
+	}
+	overlay := `x-yamlet:
+  base: base/app.yaml
+replicas: 3
+debug: null
+database:
+  host: dev-db.internal
+tags: [c]
+extra: yes
+`
+	m, err := Merge("dev", "app.yaml", []byte(overlay), mapResolver(configs), 0)
+	if err != nil {
+		t.Fatalf("Merge: %v", err)
+	}
+	out, err := m.YAML()
+	if err != nil {
+		t.Fatalf("YAML: %v", err)
+	}
+	want := `app: svc
+replicas: 3
+database:
+  host: dev-db.internal
+  port: 5432
+tags: [c]
+extra: yes
+`
+	if string(out) != want {
+		t.Fatalf("merge mismatch:\n got:\n%s\nwant:\n%s", out, want)
+	}
+
+	if len(m.Layers) != 2 || m.Layers[0] != "base/app.yaml" || m.Layers[1] != "dev/app.yaml" {
+		t.Fatalf("unexpected layers %v", m.Layers)
+	}
+	origins := make(map[string]string)
+	for _, o := range m.Origins {
+		origins[o.Path] = o.Layer
+	}
+	wantOrigins := map[string]string{
+		"app":           "base/app.yaml",
+		"replicas":      "dev/app.yaml",
+		"database.host": "dev/app.yaml",
+		"database.port": "base/app.yaml",
+		"tags.0":        "dev/app.yaml",
+		"extra":         "dev/app.yaml",
+	}
+	for path, layer := range wantOrigins {
+		if origins[path] != layer {
+			t.Errorf("origin of %s = %q, want %q", path, origins[path], layer)
+		}
+	}
+	if _, ok := origins["debug"]; ok {
+		t.Errorf("deleted key debug should not appear in origins")
+	}
+}
+
+func TestMergeListStrategies(t *testing.T) {
+	configs := map[string]string{
+		"dev/base.yaml": `containers:
+  - name: app
+    image: app:1
+  - name: sidecar
+    image: proxy:1
+`,
+	}
+	cases := []struct {
+		strategy string
+		want     string
+	}{
+		{"append", `containers:
+  - name: app
+    image: app:1
+  - name: sidecar
+    image: proxy:1
+  - name: app
+    image: app:2
+`},
+		{"merge", `containers:
+  - name: app
+    image: app:2
+  - name: sidecar
+    image: proxy:1
+`},
+		{"replace", `containers:
+  - name: app
+    image: app:2
+`},
+	}
+	for _, c := range cases {
+		overlay := "x-yamlet:\n  base: base.yaml\n  lists: " + c.strategy + "\ncontainers:\n  - name: app\n    image: app:2\n"
+		m, err := Merge("dev", "app.yaml", []byte(overlay), mapResolver(configs), 0)
+		if err != nil {
+			t.Fatalf("%s: Merge: %v", c.strategy, err)
+		}
+		out, _ := m.YAML()
+		if string(out) != c.want {
+			t.Errorf("%s: merge mismatch:\n got:\n%s\nwant:\n%s", c.strategy, out, c.want)
+		}
+	}
+}
+
+func TestMergeChainAndErrors(t *testing.T) {
+	configs := map[string]string{
+		"dev/a.yaml":     "x-yamlet: {base: b.yaml}\na: 1\n",
+		"dev/b.yaml":     "b: 2\n",
+		"dev/loop1.yaml": "x-yamlet: {base: loop2.yaml}\n",
+		"dev/loop2.yaml": "x-yamlet: {base: loop1.yaml}\n",
+	}
+
+	m, err := Merge("dev", "top.yaml", []byte("x-yamlet: {base: a.yaml}\nc: 3\n"), mapResolver(configs), 0)
+	if err != nil {
+		t.Fatalf("Merge chain: %v", err)
+	}
+	if out, _ := m.YAML(); string(out) != "b: 2\na: 1\nc: 3\n" {
+		t.Fatalf("chain mismatch: %q", out)
+	}
+
+	if _, err := Merge("dev", "loop1.yaml", []byte(configs["dev/loop1.yaml"]), mapResolver(configs), 0); !errors.Is(err, ErrRenderCycle) {
+		t.Fatalf("expected ErrRenderCycle, got %v", err)
+	}
+	if _, err := Merge("dev", "top.yaml", []byte("x-yamlet: {base: a.yaml}\n"), mapResolver(configs), 2); !errors.Is(err, ErrRenderDepth) {
+		t.Fatalf("expected ErrRenderDepth, got %v", err)
+	}
+	if _, err := Merge("dev", "x.yaml", []byte("x-yamlet: {base: b.yaml, lists: zip}\n"), mapResolver(configs), 0); !errors.Is(err, ErrInvalidDirective) {
+		t.Fatalf("expected ErrInvalidDirective, got %v", err)
+	}
+	if _, err := Merge("dev", "x.yaml", []byte("x-yamlet: {base: missing.yaml}\n"), mapResolver(configs), 0); !errors.Is(err, ErrRefNotFound) {
+		t.Fatalf("expected missing base error, got %v", err)
+	}
+}
+
+func TestMergeDoesNotChangeAliasedNodes(t *testing.T) {
+	configs := map[string]string{
+		"base/app.yaml": `defaults: &defaults
+  timeout: 5
+  retries: 3
+primary: *defaults
+replica: *defaults
+`,
+	}
+	overlay := `x-yamlet:
+  base: base/app.yaml
+primary:
+  timeout: 30
+defaults: null
+`
+	m, err := Merge("dev", "app.yaml", []byte(overlay), mapResolver(configs), 0)
+	if err != nil {
+		t.Fatalf("Merge: %v", err)
+	}
+	out, err := m.YAML()
+	if err != nil {
+		t.Fatalf("YAML: %v", err)
+	}
+	want := `primary:
+  timeout: 30
+  retries: 3
+replica:
+  timeout: 5
+  retries: 3
+`
+	if string(out) != want {
+		t.Fatalf("merge mismatch:\n got:\n%s\nwant:\n%s", out, want)
+	}
+}
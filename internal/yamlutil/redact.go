@@ -0,0 +1,178 @@
+package yamlutil
+
+import (
+	"errors"
+	"fmt"
+	"path"
+	"strconv"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// RedactedValue replaces the value of every secret key path in redacted
+// output.
+const RedactedValue = "<redacted>"
+
+// ErrInvalidPattern is returned when a secret path pattern is malformed.
+var ErrInvalidPattern = errors.New("invalid secret path pattern")
+
+// ValidatePattern checks a secret path pattern. Patterns use the dot
+// notation of Lookup; a segment may contain shell-style wildcards (*, ?,
+// [...]) matching within that segment, and a "**" segment matches any number
+// of segments, e.g. "secrets.*", "**.password" or "db.*_key".
+func ValidatePattern(pattern string) error {
+	if pattern == "" {
+		return fmt.Errorf("%w: empty pattern", ErrInvalidPattern)
+	}
+	for _, segment := range strings.Split(pattern, ".") {
+		if segment == "" {
+			return fmt.Errorf("%w: empty segment in %q", ErrInvalidPattern, pattern)
+		}
+		if _, err := path.Match(segment, ""); err != nil {
+			return fmt.Errorf("%w: %q: %v", ErrInvalidPattern, pattern, err)
+		}
+	}
+	return nil
+}
+
+// MatchPath reports whether a dot-separated key path matches a pattern.
+// Invalid patterns match nothing.
+func MatchPath(pattern, keyPath string) bool {
+	return matchSegments(strings.Split(pattern, "."), strings.Split(keyPath, "."))
+}
+
+func matchSegments(pattern, segments []string) bool {
+	for len(pattern) > 0 {
+		if pattern[0] == "**" {
+			for i := 0; i <= len(segments); i++ {
+				if matchSegments(pattern[1:], segments[i:]) {
+					return true
+				}
+			}
+			return false
+		}
+		if len(segments) == 0 {
+			return false
+		}
+		if ok, err := path.Match(pattern[0], segments[0]); err != nil || !ok {
+			return false
+		}
+		pattern, segments = pattern[1:], segments[1:]
+	}
+	return len(segments) == 0
+}
+
+// Redact replaces the values at secret key paths with RedactedValue in every
+// document of a YAML stream. Secret paths come from patterns (typically the
+// namespace's policy) and from a document's own annotation:
+//
+//	x-yamlet:
+//	  secrets: [api_key, "credentials.*"]
+//
+// A matching mapping or sequence is redacted as a whole. Aliases are
+// expanded in the output, and a value that is secret at one path is redacted
+// everywhere an alias repeats it. Redact returns data unchanged, and false,
+// when nothing matched.
+func Redact(data []byte, patterns []string) ([]byte, bool, error) {
+	docs, err := ParseDocuments(data)
+	if err != nil {
+		return nil, false, err
+	}
+	redacted := false
+	for _, doc := range docs {
+		if len(doc.Content) == 0 {
+			continue
+		}
+		docPatterns := append(documentSecrets(doc.Content[0]), patterns...)
+		if len(docPatterns) == 0 {
+			continue
+		}
+		secret := make(map[*yaml.Node]bool)
+		markSecrets(doc.Content[0], "", docPatterns, secret)
+		if len(secret) > 0 {
+			doc.Content[0] = redactClone(doc.Content[0], secret)
+			redacted = true
+		}
+	}
+	if !redacted {
+		return data, false, nil
+	}
+	out, err := EncodeDocuments(docs)
+	if err != nil {
+		return nil, false, err
+	}
+	return out, true, nil
+}
+
+// documentSecrets returns the secret patterns a document declares in its
+// x-yamlet block. Malformed annotations are ignored here; they are the
+// writer's concern and must not make a document unreadable.
+func documentSecrets(root *yaml.Node) []string {
+	if root.Kind != yaml.MappingNode {
+		return nil
+	}
+	idx := mappingIndex(root, DirectiveKey)
+	if idx < 0 {
+		return nil
+	}
+	var dir struct {
+		Secrets []string `yaml:"secrets"`
+	}
+	if err := root.Content[idx+1].Decode(&dir); err != nil {
+		return nil
+	}
+	var patterns []string
+	for _, p := range dir.Secrets {
+		if ValidatePattern(p) == nil {
+			patterns = append(patterns, p)
+		}
+	}
+	return patterns
+}
+
+// markSecrets records in secret every node, aliases resolved, whose key path
+// matches a pattern. The x-yamlet block itself is left alone.
+func markSecrets(node *yaml.Node, keyPath string, patterns []string, secret map[*yaml.Node]bool) {
+	node = resolveAlias(node)
+	if keyPath != "" {
+		for _, p := range patterns {
+			if MatchPath(p, keyPath) {
+				secret[node] = true
+				return
+			}
+		}
+	}
+	switch node.Kind {
+	case yaml.MappingNode:
+		for i := 0; i+1 < len(node.Content); i += 2 {
+			key := node.Content[i].Value
+			if keyPath == "" && key == DirectiveKey {
+				continue
+			}
+			markSecrets(node.Content[i+1], joinPath(keyPath, key), patterns, secret)
+		}
+	case yaml.SequenceNode:
+		for i, child := range node.Content {
+			markSecrets(child, joinPath(keyPath, strconv.Itoa(i)), patterns, secret)
+		}
+	}
+}
+
+// redactClone copies node with aliases expanded, replacing secret nodes with
+// RedactedValue.
+func redactClone(node *yaml.Node, secret map[*yaml.Node]bool) *yaml.Node {
+	node = resolveAlias(node)
+	if secret[node] {
+		return &yaml.Node{Kind: yaml.ScalarNode, Tag: "!!str", Value: RedactedValue}
+	}
+	c := *node
+	c.Anchor = ""
+	if node.Content != nil {
+		c.Content = make([]*yaml.Node, len(node.Content))
+		for i, child := range node.Content {
+			c.Content[i] = redactClone(child, secret)
+		}
+	}
+	return &c
+}
@@ -0,0 +1,95 @@
+package yamlutil
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestMatchPath(t *testing.T) {
+	cases := []struct {
+		pattern, path string
+		want          bool
+	}{
+		{"secrets", "secrets", true},
+		{"secrets.*", "secrets.api_key", true},
+		{"secrets.*", "secrets", false},
+		{"secrets.*", "secrets.a.b", false},
+		{"**.password", "password", true},
+		{"**.password", "db.primary.password", true},
+		{"**.password", "db.password.hint", false},
+		{"db.*_key", "db.api_key", true},
+		{"db.*_key", "db.api_keys", false},
+		{"users.*.token", "users.0.token", true},
+		{"**", "anything.at.all", true},
+	}
+	for _, c := range cases {
+		if got := MatchPath(c.pattern, c.path); got != c.want {
+			t.Errorf("MatchPath(%q, %q) = %v, want %v", c.pattern, c.path, got, c.want)
+		}
+	}
+
+	for _, bad := range []string{"", "a..b", "a.[", ".a"} {
+		if err := ValidatePattern(bad); !errors.Is(err, ErrInvalidPattern) {
+			t.Errorf("ValidatePattern(%q) = %v, want ErrInvalidPattern", bad, err)
+		}
+	}
+}
+
+func TestRedact(t *testing.T) {
+	in := `app: svc
+database:
+  host: db.internal
+  password: hunter2
+secrets:
+  api_key: k
+  jwt_secret: j
+`
+	out, redacted, err := Redact([]byte(in), []string{"secrets", "**.password"})
+	if err != nil {
+		t.Fatalf("Redact: %v", err)
+	}
+	want := `app: svc
+database:
+  host: db.internal
+  password: <redacted>
+secrets: <redacted>
+`
+	if !redacted || string(out) != want {
+		t.Fatalf("redact mismatch (redacted=%v):\n got:\n%s\nwant:\n%s", redacted, out, want)
+	}
+
+	out, redacted, err = Redact([]byte(in), []string{"nothing.here"})
+	if err != nil || redacted || string(out) != in {
+		t.Fatalf("unmatched patterns should leave the input untouched: %q, %v, %v", out, redacted, err)
+	}
+}
+
+func TestRedactAnnotationsAndAliases(t *testing.T) {
+	in := `x-yamlet:
+  secrets: [token]
+token: &t abc
+copy: *t
+---
+token: visible
+`
+	out, redacted, err := Redact([]byte(in), nil)
+	if err != nil {
+		t.Fatalf("Redact: %v", err)
+	}
+	want := `x-yamlet:
+  secrets: [token]
+token: <redacted>
+copy: <redacted>
+---
+token: visible
+`
+	if !redacted || string(out) != want {
+		t.Fatalf("redact mismatch:\n got:\n%s\nwant:\n%s", out, want)
+	}
+
+	// A secret reached through an alias is redacted at the anchor as well.
+	out, _, err = Redact([]byte("base: &b {key: v}\nprod: *b\n"), []string{"prod.key"})
+	if err != nil || string(out) != "base: {key: <redacted>}\nprod: {key: <redacted>}\n" {
+		t.Fatalf("alias redaction = %q, %v", out, err)
+	}
+}
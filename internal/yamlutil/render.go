@@ -0,0 +1,336 @@
+package yamlutil
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// DefaultMaxRenderDepth bounds how many configs deep a chain of references
+// may go before rendering gives up.
+const DefaultMaxRenderDepth = 8
+
+// Sentinel errors returned by Render.
+var (
+	ErrRenderSyntax = errors.New("invalid template expression")
+	ErrRenderCycle  = errors.New("reference cycle")
+	ErrRenderDepth  = errors.New("reference depth limit exceeded")
+	ErrRefNotFound  = errors.New("reference target not found")
+)
+
+// Resolver loads the raw YAML of a referenced config. Implementations are
+// expected to enforce authorization for every namespace they are asked for.
+type Resolver func(namespace, name string) ([]byte, error)
+
+// RenderOptions tune Render.
+type RenderOptions struct {
+	// MaxDepth bounds nested references; DefaultMaxRenderDepth when zero.
+	MaxDepth int
+	// Env looks up ${env:NAME} variables. A nil Env treats every variable
+	// as unset, so only defaults apply.
+	Env func(name string) (string, bool)
+	// Limits bounds the rendered output. References can splice whole
+	// subtrees, so a config within limits may still render into one that is
+	// not. The zero value disables the checks.
+	Limits Limits
+}
+
+// exprPattern matches ${kind:body} expressions. A doubled "$$" escapes the
+// expression so it is emitted literally.
+var exprPattern = regexp.MustCompile(`\$?\$\{([a-z]+):([^}]*)\}`)
+
+// Render resolves template expressions in the YAML config namespace/name:
+//
+//	${ref:ns/name#path}  value at path in another config (ns defaults to the
+//	                     referencing config's namespace, #path to the root)
+//	${env:NAME}          environment variable, ${env:NAME:-default} with a
+//	                     fallback
+//
+// A scalar that consists of a single ${ref:...} expression is replaced by the
+// referenced node, which may be a mapping or sequence. Expressions embedded
+// in a longer string must resolve to scalars. Referenced configs are rendered
+// recursively, with cycle detection and a depth limit.
+func Render(namespace, name string, data []byte, resolve Resolver, opts RenderOptions) ([]byte, error) {
+	if opts.MaxDepth <= 0 {
+		opts.MaxDepth = DefaultMaxRenderDepth
+	}
+	r := &renderer{
+		resolve: resolve,
+		opts:    opts,
+		cache:   make(map[string]*yaml.Node),
+	}
+	docs, err := r.renderStream(namespace, name, data)
+	if err != nil {
+		return nil, err
+	}
+	if len(docs) == 0 {
+		return data, nil
+	}
+	for i, doc := range docs {
+		if err := opts.Limits.check(doc, i); err != nil {
+			return nil, err
+		}
+	}
+	return EncodeDocuments(docs)
+}
+
+type renderer struct {
+	resolve Resolver
+	opts    RenderOptions
+	stack   []string
+	cache   map[string]*yaml.Node
+	// spliced counts nodes copied in by references so far.
+	spliced int
+}
+
+// renderStream renders every document of a config. References into another
+// config resolve against its first document.
+func (r *renderer) renderStream(namespace, name string, data []byte) ([]*yaml.Node, error) {
+	docs, err := ParseDocuments(data)
+	if err != nil {
+		return nil, fmt.Errorf("config %s/%s: %w", namespace, name, err)
+	}
+	r.stack = append(r.stack, namespace+"/"+name)
+	defer func() { r.stack = r.stack[:len(r.stack)-1] }()
+
+	for _, doc := range docs {
+		if len(doc.Content) == 0 {
+			continue
+		}
+		if err := r.walk(doc.Content[0], namespace); err != nil {
+			return nil, err
+		}
+	}
+	return docs, nil
+}
+
+func (r *renderer) walk(node *yaml.Node, namespace string) error {
+	switch node.Kind {
+	case yaml.MappingNode:
+		// Only values are templated; keys stay literal.
+		for i := 1; i < len(node.Content); i += 2 {
+			if err := r.walk(node.Content[i], namespace); err != nil {
+				return err
+			}
+		}
+	case yaml.SequenceNode:
+		for _, child := range node.Content {
+			if err := r.walk(child, namespace); err != nil {
+				return err
+			}
+		}
+	case yaml.ScalarNode:
+		if node.ShortTag() == "!!str" && strings.Contains(node.Value, "${") {
+			return r.expand(node, namespace)
+		}
+	}
+	return nil
+}
+
+// expand substitutes every expression in the scalar node in place.
+func (r *renderer) expand(node *yaml.Node, namespace string) error {
+	matches := exprPattern.FindAllStringSubmatchIndex(node.Value, -1)
+	if len(matches) == 0 {
+		return nil
+	}
+
+	// Whole-value expressions may splice in structured nodes.
+	if len(matches) == 1 && matches[0][0] == 0 && matches[0][1] == len(node.Value) && !strings.HasPrefix(node.Value, "$$") {
+		kind := node.Value[matches[0][2]:matches[0][3]]
+		body := node.Value[matches[0][4]:matches[0][5]]
+		value, err := r.eval(kind, body, namespace)
+		if err != nil {
+			return err
+		}
+		line, column := node.Line, node.Column
+		*node = *value
+		node.Line, node.Column = line, column
+		return nil
+	}
+
+	var out strings.Builder
+	last := 0
+	for _, m := range matches {
+		out.WriteString(node.Value[last:m[0]])
+		last = m[1]
+		expr := node.Value[m[0]:m[1]]
+		if strings.HasPrefix(expr, "$$") {
+			out.WriteString(expr[1:])
+			continue
+		}
+		kind := node.Value[m[2]:m[3]]
+		body := node.Value[m[4]:m[5]]
+		value, err := r.eval(kind, body, namespace)
+		if err != nil {
+			return err
+		}
+		if value.Kind != yaml.ScalarNode {
+			return fmt.Errorf("%w: %s inside a string must resolve to a scalar", ErrRenderSyntax, expr)
+		}
+		out.WriteString(value.Value)
+	}
+	out.WriteString(node.Value[last:])
+	node.Value = out.String()
+	node.Tag = "!!str"
+	node.Style = 0
+	return nil
+}
+
+func (r *renderer) eval(kind, body, namespace string) (*yaml.Node, error) {
+	switch kind {
+	case "ref":
+		return r.evalRef(body, namespace)
+	case "env":
+		return r.evalEnv(body)
+	}
+	return nil, fmt.Errorf("%w: unknown expression kind %q", ErrRenderSyntax, kind)
+}
+
+func (r *renderer) evalEnv(body string) (*yaml.Node, error) {
+	name, def, hasDefault := strings.Cut(body, ":-")
+	if name == "" {
+		return nil, fmt.Errorf("%w: empty variable name in ${env:%s}", ErrRenderSyntax, body)
+	}
+	if r.opts.Env != nil {
+		if v, ok := r.opts.Env(name); ok {
+			return &yaml.Node{Kind: yaml.ScalarNode, Value: v}, nil
+		}
+	}
+	if !hasDefault {
+		return nil, fmt.Errorf("%w: variable %q is not set and has no default", ErrRefNotFound, name)
+	}
+	return &yaml.Node{Kind: yaml.ScalarNode, Value: def}, nil
+}
+
+func (r *renderer) evalRef(body, namespace string) (*yaml.Node, error) {
+	target, path, _ := strings.Cut(body, "#")
+	refNamespace, refName, ok := strings.Cut(target, "/")
+	if !ok {
+		refNamespace, refName = namespace, target
+	}
+	if refNamespace == "" || refName == "" || strings.Contains(refName, "/") {
+		return nil, fmt.Errorf("%w: ${ref:%s}", ErrRenderSyntax, body)
+	}
+
+	key := refNamespace + "/" + refName
+	for _, seen := range r.stack {
+		if seen == key {
+			return nil, fmt.Errorf("%w: %s -> %s", ErrRenderCycle, strings.Join(r.stack, " -> "), key)
+		}
+	}
+
+	root, cached := r.cache[key]
+	if !cached {
+		if len(r.stack) >= r.opts.MaxDepth {
+			return nil, fmt.Errorf("%w (%d) resolving %s", ErrRenderDepth, r.opts.MaxDepth, key)
+		}
+		data, err := r.resolve(refNamespace, refName)
+		if err != nil {
+			return nil, fmt.Errorf("resolving ${ref:%s}: %w", body, err)
+		}
+		docs, err := r.renderStream(refNamespace, refName, data)
+		if err != nil {
+			return nil, err
+		}
+		if len(docs) > 0 && len(docs[0].Content) > 0 {
+			root = docs[0].Content[0]
+		}
+		r.cache[key] = root
+	}
+	if root == nil {
+		return nil, fmt.Errorf("%w: %s is empty", ErrRefNotFound, key)
+	}
+
+	node, err := Lookup(root, path)
+	if err != nil {
+		return nil, fmt.Errorf("${ref:%s}: %w", body, err)
+	}
+	if err := r.charge(node); err != nil {
+		return nil, err
+	}
+	return cloneNode(node), nil
+}
+
+// charge accounts for the nodes a reference is about to splice in, so that
+// fan-out across many references fails before the copies are made.
+func (r *renderer) charge(node *yaml.Node) error {
+	max := r.opts.Limits.MaxNodes
+	if max <= 0 {
+		return nil
+	}
+	c := &limitChecker{limits: Limits{MaxAliasExpansion: max}, expanded: make(map[*yaml.Node]expansion)}
+	exp, err := c.expand(node)
+	if err != nil {
+		return err
+	}
+	r.spliced += exp.nodes
+	if r.spliced > max {
+		return &LimitError{Limit: LimitNodes, Max: max, Document: -1}
+	}
+	return nil
+}
+
+// Lookup returns the node at a dot-separated path below root. Numeric
+// segments index into sequences; an empty path returns root itself.
+func Lookup(root *yaml.Node, path string) (*yaml.Node, error) {
+	node := root
+	if path == "" {
+		return node, nil
+	}
+	for _, segment := range strings.Split(path, ".") {
+		for node.Kind == yaml.AliasNode {
+			node = node.Alias
+		}
+		switch node.Kind {
+		case yaml.MappingNode:
+			var next *yaml.Node
+			for i := 0; i+1 < len(node.Content); i += 2 {
+				if node.Content[i].Value == segment {
+					next = node.Content[i+1]
+					break
+				}
+			}
+			if next == nil {
+				return nil, fmt.Errorf("%w: key %q in path %q", ErrRefNotFound, segment, path)
+			}
+			node = next
+		case yaml.SequenceNode:
+			idx, err := strconv.Atoi(segment)
+			if err != nil || idx < 0 || idx >= len(node.Content) {
+				return nil, fmt.Errorf("%w: index %q in path %q", ErrRefNotFound, segment, path)
+			}
+			node = node.Content[idx]
+		default:
+			return nil, fmt.Errorf("%w: %q descends into a scalar", ErrRefNotFound, path)
+		}
+	}
+	for node.Kind == yaml.AliasNode {
+		node = node.Alias
+	}
+	return node, nil
+}
+
+// cloneNode deep-copies a node tree, expanding aliases so the copy can be
+// spliced into another document.
+func cloneNode(n *yaml.Node) *yaml.Node {
+	if n == nil {
+		return nil
+	}
+	if n.Kind == yaml.AliasNode {
+		return cloneNode(n.Alias)
+	}
+	c := *n
+	c.Anchor = ""
+	c.Alias = nil
+	if n.Content != nil {
+		c.Content = make([]*yaml.Node, len(n.Content))
+		for i, child := range n.Content {
+			c.Content[i] = cloneNode(child)
+		}
+	}
+	return &c
+}
@@ -0,0 +1,136 @@
+package yamlutil
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"testing"
+)
+
+// mapResolver serves configs from an in-memory map keyed by "ns/name".
+func mapResolver(configs map[string]string) Resolver {
+	return func(namespace, name string) ([]byte, error) {
+		data, ok := configs[namespace+"/"+name]
+		if !ok {
+			return nil, fmt.Errorf("config %s/%s: %w", namespace, name, ErrRefNotFound)
+		}
+		return []byte(data), nil
+	}
+}
+
+func TestRenderReferences(t *testing.T) {
+	configs := map[string]string{
+		"shared/db.yaml":  "host: db.internal\nport: 5432\npool:\n  min: 1\n  max: 10\n",
+		"dev/common.yaml": "region: eu-west-1\n",
+	}
+	in := `database:
+  host: ${ref:shared/db.yaml#host}
+  url: postgres://${ref:shared/db.yaml#host}:${ref:shared/db.yaml#port}/app
+  pool: ${ref:shared/db.yaml#pool}
+region: ${ref:common.yaml#region}
+literal: $${ref:not/expanded}
+`
+	out, err := Render("dev", "app.yaml", []byte(in), mapResolver(configs), RenderOptions{})
+	if err != nil {
+		t.Fatalf("Render: %v", err)
+	}
+	want := `database:
+  host: db.internal
+  url: postgres://db.internal:5432/app
+  pool:
+    min: 1
+    max: 10
+region: eu-west-1
+literal: ${ref:not/expanded}
+`
+	if string(out) != want {
+		t.Fatalf("render mismatch:\n got:\n%s\nwant:\n%s", out, want)
+	}
+}
+
+func TestRenderEnv(t *testing.T) {
+	env := func(name string) (string, bool) {
+		if name == "PORT" {
+			return "9090", true
+		}
+		return "", false
+	}
+	in := "port: ${env:PORT}\nlevel: ${env:LOG_LEVEL:-info}\naddr: \":${env:PORT}\"\n"
+	out, err := Render("dev", "app.yaml", []byte(in), mapResolver(nil), RenderOptions{Env: env})
+	if err != nil {
+		t.Fatalf("Render: %v", err)
+	}
+	want := "port: 9090\nlevel: info\naddr: :9090\n"
+	if string(out) != want {
+		t.Fatalf("render mismatch:\n got: %q\nwant: %q", out, want)
+	}
+
+	_, err = Render("dev", "app.yaml", []byte("x: ${env:MISSING}\n"), mapResolver(nil), RenderOptions{Env: env})
+	if !errors.Is(err, ErrRefNotFound) {
+		t.Fatalf("expected ErrRefNotFound for unset variable, got %v", err)
+	}
+}
+
+func TestRenderReferencesAreRecursive(t *testing.T) {
+	configs := map[string]string{
+		"dev/a.yaml": "value: ${ref:b.yaml#value}\n",
+		"dev/b.yaml": "value: from-b\n",
+	}
+	out, err := Render("dev", "root.yaml", []byte("v: ${ref:a.yaml#value}\n"), mapResolver(configs), RenderOptions{})
+	if err != nil {
+		t.Fatalf("Render: %v", err)
+	}
+	if string(out) != "v: from-b\n" {
+		t.Fatalf("unexpected output %q", out)
+	}
+}
+
+func TestRenderDetectsCycles(t *testing.T) {
+	configs := map[string]string{
+		"dev/a.yaml": "x: ${ref:b.yaml#x}\n",
+		"dev/b.yaml": "x: ${ref:a.yaml#x}\n",
+	}
+	_, err := Render("dev", "a.yaml", []byte(configs["dev/a.yaml"]), mapResolver(configs), RenderOptions{})
+	if !errors.Is(err, ErrRenderCycle) {
+		t.Fatalf("expected ErrRenderCycle, got %v", err)
+	}
+}
+
+func TestRenderDepthLimit(t *testing.T) {
+	configs := make(map[string]string)
+	for i := 0; i < 5; i++ {
+		configs[fmt.Sprintf("dev/c%d.yaml", i)] = fmt.Sprintf("x: ${ref:c%d.yaml#x}\n", i+1)
+	}
+	configs["dev/c5.yaml"] = "x: bottom\n"
+
+	_, err := Render("dev", "root.yaml", []byte("x: ${ref:c0.yaml#x}\n"), mapResolver(configs), RenderOptions{MaxDepth: 3})
+	if !errors.Is(err, ErrRenderDepth) {
+		t.Fatalf("expected ErrRenderDepth, got %v", err)
+	}
+
+	out, err := Render("dev", "root.yaml", []byte("x: ${ref:c0.yaml#x}\n"), mapResolver(configs), RenderOptions{})
+	if err != nil || string(out) != "x: bottom\n" {
+		t.Fatalf("default depth should resolve the chain: %q, %v", out, err)
+	}
+}
+
+func TestRenderErrors(t *testing.T) {
+	configs := map[string]string{"dev/a.yaml": "list: [1, 2]\nmap: {k: v}\n"}
+	cases := []struct {
+		in   string
+		want error
+	}{
+		{"x: ${ref:a.yaml#missing}\n", ErrRefNotFound},
+		{"x: ${ref:a.yaml#list.5}\n", ErrRefNotFound},
+		{"x: prefix-${ref:a.yaml#map}\n", ErrRenderSyntax},
+		{"x: ${bogus:thing}\n", ErrRenderSyntax},
+		{"x: ${ref:a/b/c}\n", ErrRenderSyntax},
+		{"x: ${ref:missing.yaml}\n", ErrRefNotFound},
+	}
+	for _, c := range cases {
+		_, err := Render("dev", "root.yaml", []byte(c.in), mapResolver(configs), RenderOptions{})
+		if !errors.Is(err, c.want) {
+			t.Errorf("Render(%q) error = %v, want %v", strings.TrimSpace(c.in), err, c.want)
+		}
+	}
+}